@@ -0,0 +1,22 @@
+# PyInstaller spec of the standalone (single-file) build:
+#
+#     pyinstaller gmail-downloader.spec
+#
+# Release builds are named per platform (see selfupdate.asset_name) and
+# listed in the release's signed SHA256SUMS.
+
+a = Analysis(
+    ["src/gmail_downloader/__main__.py"],
+    pathex=["src"],
+    # The release key `update` checks signatures with, next to selfupdate.py
+    datas=[("src/gmail_downloader/release_key.pem", "gmail_downloader")],
+)
+pyz = PYZ(a.pure)
+exe = EXE(
+    pyz,
+    a.scripts,
+    a.binaries,
+    a.datas,
+    name="gmail-downloader",
+    console=True,
+)
@@ -0,0 +1,5 @@
+"""Run the CLI with python -m gmail_downloader; also the standalone build's entry."""
+
+from gmail_downloader.main import app
+
+app(prog_name="gmail-downloader")
@@ -0,0 +1,186 @@
+"""
+Library API for embedding the downloader in other programs.
+
+The names in __all__ are the stable surface: they keep working across minor
+releases, and changes to them are called out in the changelog. Everything
+else in the package (main, downloader, gmail_client, ...) is the CLI's
+implementation and may change at any time.
+
+    from gmail_downloader.api import Client, Filters
+
+    client = Client(config_path="config/config.yaml")
+    await client.connect()
+
+    matches = await client.search(
+        Filters(senders=["billing@vendor.com"], extensions=[".pdf"])
+    )
+    progress = asyncio.Queue()
+    saved = await client.download(matches, progress=progress)
+
+Searching and downloading use the configuration's destination, layout,
+manifest and limits exactly like the CLI does, so a file fetched through the
+library is not fetched again by `gmail-downloader download` and vice versa.
+"""
+
+import asyncio
+from dataclasses import dataclass, replace
+from typing import List, Optional
+
+from .config import AppConfig, ConfigurationError, FilterConfig, load_config
+from .downloader import (
+    STATUS_EXISTS,
+    STATUS_NEW,
+    STATUS_UPDATED,
+    AttachmentDownloader,
+    DownloadService,
+    PlannedDownload,
+)
+from .events import FileDone
+from .gmail_client import GmailAPI, GmailError, create_client
+from .manifest import DownloadManifest, ManifestEntry, ManifestError
+from .storage import Location, StorageError
+
+__all__ = [
+    "Client",
+    "Filters",
+    "Match",
+    "Progress",
+    "GmailAPI",
+    "AppConfig",
+    "ManifestEntry",
+    "Location",
+    "STATUS_NEW",
+    "STATUS_UPDATED",
+    "STATUS_EXISTS",
+    "ConfigurationError",
+    "GmailError",
+    "ManifestError",
+    "StorageError",
+]
+
+# Which messages and attachments to look at (the filters: config section)
+Filters = FilterConfig
+
+# One matching attachment: its message, destination and status (NEW,
+# UPDATED or EXISTS compared with the manifest and the files on disk)
+Match = PlannedDownload
+
+
+@dataclass
+class Progress:
+    """
+    One saved file, sent on the progress queue of Client.download.
+
+    completed counts files saved so far in this download, total the files
+    the download will try to save (matches that are not EXISTS). Files
+    skipped by the conflict policy are not reported, so completed can end
+    below total.
+    """
+
+    entry: ManifestEntry
+    path: Location
+    completed: int
+    total: int
+
+
+class Client:
+    """
+    Search and download attachments of one Gmail account.
+
+    A client is not safe for concurrent downloads to the same destination;
+    run downloads one after another, or use one client per destination.
+    """
+
+    def __init__(self,
+                 config: Optional[AppConfig] = None,
+                 config_path: str = "config/config.yaml",
+                 gmail: Optional[GmailAPI] = None):
+        """
+        Args:
+            config: Configuration to use; loaded from config_path if omitted
+            gmail: Gmail account to use instead of a GmailClient for the
+                configuration, e.g. a FakeGmail client (tests/gmailtest.py) in tests
+
+        Raises:
+            ConfigurationError: If the configuration file is invalid
+        """
+        self.config = config or load_config(config_path)
+        self.gmail = gmail or create_client(self.config)
+
+    async def connect(self, interactive: bool = True) -> None:
+        """
+        Sign in to Gmail.
+
+        With interactive=False only a saved token is used, and a missing or
+        revoked one raises instead of opening the browser sign-in, which is
+        what a service without a user at the keyboard wants.
+
+        Raises:
+            GmailError: If signing in fails
+        """
+        await self.gmail.authenticate(interactive=interactive)
+
+    def _service(self, filters: Optional[Filters] = None) -> DownloadService:
+        config = replace(self.config, filters=filters) if filters else self.config
+        manifest = DownloadManifest(config.download.get_manifest_dir()).load()
+        return DownloadService(
+            self.gmail, AttachmentDownloader.from_config(config), manifest, config
+        )
+
+    async def search(self, filters: Optional[Filters] = None) -> List[Match]:
+        """
+        Find the attachments matching filters (the configured ones by default).
+
+        Nothing is downloaded. Matches come in search order with their
+        destination already decided, and can be passed to download as they
+        are or after picking some out.
+
+        Raises:
+            GmailError: If the search fails
+        """
+        return await self._service(filters).plan()
+
+    async def download(
+        self,
+        matches: List[Match],
+        progress: Optional["asyncio.Queue[Optional[Progress]]"] = None,
+    ) -> List[Location]:
+        """
+        Download matches, skipping the ones already downloaded.
+
+        Each saved file is recorded in the manifest. If progress is given,
+        a Progress is put on it after every saved file, and None once the
+        download has ended, also when it failed; a consumer can read until
+        None.
+
+        Returns:
+            Where each file was saved
+
+        Raises:
+            GmailError: If Gmail or Drive cannot be read
+            StorageError: If a file cannot be written
+            ManifestError: If the manifest cannot be saved
+        """
+        service = self._service()
+        if progress is None:
+            return await service.execute(matches)
+
+        total = sum(1 for match in matches if match.status != STATUS_EXISTS)
+        channel = service.events.subscribe()
+
+        async def report() -> None:
+            completed = 0
+            async for event in channel:
+                if isinstance(event, FileDone):
+                    completed += 1
+                    await progress.put(
+                        Progress(event.entry, event.path, completed, total)
+                    )
+
+        reporter = asyncio.create_task(report())
+        try:
+            return await service.execute(matches)
+        finally:
+            channel.close()
+            await reporter
+            await progress.put(None)
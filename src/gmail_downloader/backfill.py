@@ -0,0 +1,142 @@
+"""
+Backfills of old mail, one time slice at a time.
+
+A single search over years of mail finds tens of thousands of messages,
+takes hours to work through and starts over from the first one if anything
+interrupts it. `backfill --from 2018-01-01 --to 2024-01-01 --chunk 1m`
+searches one month at a time instead, oldest first, and checkpoints each
+month once all of its attachments are downloaded. Running the same command
+again after an interruption skips the finished months.
+
+Checkpoints are kept per profile and search in a small JSON file next to the
+manifest, like incremental cursors. A slice is recorded by its dates, so a
+later backfill with the same chunk that reaches further back or forward only
+searches the slices it has not done yet.
+"""
+
+import json
+import os
+import re
+from datetime import date, datetime
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple, Union
+
+from dateutil.relativedelta import relativedelta
+
+from .manifest import ManifestError
+from .utils import day_start_timestamp
+
+# Checkpoint of the time slices a backfill has finished
+BACKFILL_FILENAME = ".gmail_downloader_backfill.json"
+
+# Units of --chunk: days, weeks, months, years
+CHUNK_UNITS = {"d": "days", "w": "weeks", "m": "months", "y": "years"}
+
+
+def parse_chunk(chunk_string: str) -> Optional[relativedelta]:
+    """
+    Parse a slice length like "1m" (one month) or "2w".
+
+    Unlike parse_duration, m means months: slices follow the calendar.
+
+    Returns:
+        The length, or None if the string cannot be parsed
+    """
+    match = re.match(r'^\s*(\d+)\s*([dwmy])\s*$', str(chunk_string).lower())
+    if not match or int(match.group(1)) < 1:
+        return None
+    number, unit = match.groups()
+    return relativedelta(**{CHUNK_UNITS[unit]: int(number)})
+
+
+def time_slices(
+    start: date, end: date, chunk: relativedelta
+) -> List[Tuple[date, date]]:
+    """
+    The slices from start up to end (exclusive), oldest first.
+
+    Each slice is chunk long, counted from start; the last one stops at end.
+    Boundaries are whole chunks from start (start + n * chunk), so a month
+    cut short by February does not pull the later ones forward.
+    """
+    slices = []
+    current = start
+    n = 1
+    while current < end:
+        following = min(start + chunk * n, end)
+        slices.append((current, following))
+        current = following
+        n += 1
+    return slices
+
+
+def slice_query(query: str, start: date, end: date, tz: str = "UTC") -> str:
+    """
+    Narrow query to messages received from start up to end.
+
+    The days start at midnight in tz and are sent as Unix timestamps, so
+    neighbouring slices meet exactly.
+    """
+    after = day_start_timestamp(datetime.combine(start, datetime.min.time()), tz)
+    before = day_start_timestamp(datetime.combine(end, datetime.min.time()), tz)
+    return f"({query}) after:{after} before:{before}"
+
+
+def slice_label(start: date, end: date) -> str:
+    """A slice as stored in the checkpoint file, e.g. "2018-01-01/2018-02-01"."""
+    return f"{start.isoformat()}/{end.isoformat()}"
+
+
+class BackfillState:
+    """The finished slices of one download directory's backfills."""
+
+    def __init__(self, directory: Union[str, Path]):
+        self.path = Path(directory) / BACKFILL_FILENAME
+        self._backfills: Dict[str, Dict[str, object]] = {}
+
+    def load(self) -> "BackfillState":
+        """
+        Read the checkpoints; a missing file means no slice is done yet.
+
+        Raises:
+            ManifestError: If the file exists but cannot be parsed
+        """
+        self._backfills = {}
+        if not self.path.exists():
+            return self
+        try:
+            self._backfills = json.loads(
+                self.path.read_text(encoding="utf-8")
+            )["backfills"]
+        except (OSError, ValueError, KeyError, TypeError) as e:
+            raise ManifestError(f"Cannot read {self.path}: {e}")
+        return self
+
+    def is_done(self, key: str, start: date, end: date) -> bool:
+        """Whether a slice of the search key was downloaded completely."""
+        backfill = self._backfills.get(key) or {}
+        return slice_label(start, end) in (backfill.get("done") or [])
+
+    def mark_done(self, key: str, start: date, end: date, query: str = "") -> None:
+        """Record a slice of the search key as done and save."""
+        backfill = self._backfills.setdefault(key, {"query": query, "done": []})
+        done = list(backfill.get("done") or [])
+        label = slice_label(start, end)
+        if label not in done:
+            done.append(label)
+        backfill.update(
+            query=query, done=sorted(done), updated_at=datetime.now().isoformat()
+        )
+        self.save()
+
+    def save(self) -> None:
+        """Write the checkpoints atomically, like the manifest."""
+        temp_path = self.path.with_suffix(".tmp")
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+            temp_path.write_text(
+                json.dumps({"backfills": self._backfills}, indent=2), encoding="utf-8"
+            )
+            os.replace(temp_path, self.path)
+        except OSError as e:
+            raise ManifestError(f"Cannot write {self.path}: {e}")
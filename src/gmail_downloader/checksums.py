@@ -0,0 +1,123 @@
+"""
+Checking the download tree against the manifest's hashes.
+
+The manifest records the SHA-256 of every saved attachment, so whether the
+files on disk are still the ones downloaded can be answered later, long
+after the mail is gone. Two ways:
+
+    gmail-downloader manifest --format sha256sums > downloads/SHA256SUMS
+    cd downloads && sha256sum -c SHA256SUMS
+
+writes the hashes in the format of GNU sha256sum, for checking with
+standard tools (or on a machine without this one), and
+
+    gmail-downloader verify
+
+re-hashes the tree itself and reports the files that were modified or are
+missing. Encrypted files (download.encrypt) are left out of both: the
+manifest holds the hash of the attachment, not of the encrypted file.
+Quarantined files are left out too, as they are not at their path.
+"""
+
+import hashlib
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import Dict, Iterable, List
+
+from .manifest import ManifestEntry
+
+# Read this much of a file at a time while hashing
+CHUNK_BYTES = 1024 * 1024
+
+
+def checkable(entries: Iterable[ManifestEntry]) -> List[ManifestEntry]:
+    """
+    The entries whose file can be checked by its hash, one per path.
+
+    When a path was written more than once (download.conflict_policy
+    overwrite), the file there is the newest download.
+    """
+    newest: Dict[str, ManifestEntry] = {}
+    for entry in entries:
+        if entry.encrypted or entry.quarantine or not entry.sha256:
+            continue
+        previous = newest.get(entry.path)
+        if previous is None or entry.downloaded_at >= previous.downloaded_at:
+            newest[entry.path] = entry
+    return sorted(newest.values(), key=lambda entry: entry.path)
+
+
+def sha256sums_line(sha256: str, path: str) -> str:
+    """
+    One line of a SHA256SUMS file.
+
+    Like sha256sum, a name with a backslash or newline is escaped and the
+    line starts with a backslash.
+    """
+    if "\\" in path or "\n" in path:
+        escaped = path.replace("\\", "\\\\").replace("\n", "\\n")
+        return f"\\{sha256}  {escaped}\n"
+    return f"{sha256}  {path}\n"
+
+
+def sha256sums(entries: Iterable[ManifestEntry]) -> str:
+    """
+    The hashes of the entries' files in sha256sum -c
+    format, paths relative to the download directory.
+    """
+    return "".join(
+        sha256sums_line(entry.sha256, entry.path) for entry in checkable(entries)
+    )
+
+
+def hash_file(path: Path) -> str:
+    """The SHA-256 of the file at path, read in chunks."""
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(CHUNK_BYTES), b""):
+            digest.update(chunk)
+    return digest.hexdigest()
+
+
+@dataclass
+class VerifyResult:
+    """What verify found, by path relative to the download directory."""
+
+    ok: List[str] = field(default_factory=list)
+    modified: List[str] = field(default_factory=list)
+    missing: List[str] = field(default_factory=list)
+
+    # Files that could not be read, with why
+    unreadable: Dict[str, str] = field(default_factory=dict)
+
+    @property
+    def failed(self) -> bool:
+        return bool(self.modified or self.missing or self.unreadable)
+
+    def to_dict(self) -> Dict[str, object]:
+        return {
+            "ok": len(self.ok),
+            "modified": self.modified,
+            "missing": self.missing,
+            "unreadable": self.unreadable,
+        }
+
+
+def verify(entries: Iterable[ManifestEntry], base_dir: Path) -> VerifyResult:
+    """Re-hash the files of the entries below base_dir and compare with the manifest."""
+    result = VerifyResult()
+    for entry in checkable(entries):
+        path = base_dir / entry.path
+        try:
+            actual = hash_file(path)
+        except FileNotFoundError:
+            result.missing.append(entry.path)
+            continue
+        except OSError as e:
+            result.unreadable[entry.path] = str(e)
+            continue
+        if actual == entry.sha256:
+            result.ok.append(entry.path)
+        else:
+            result.modified.append(entry.path)
+    return result
@@ -0,0 +1,168 @@
+"""
+Shell completion.
+
+`gmail-downloader completion <shell>` prints the script to source for bash,
+zsh, fish or PowerShell. Besides commands and flags it completes values:
+--organize-by from the known layouts, --profile from the saved tokens and
+--label from the account's Gmail labels.
+
+Label names need an API call, so they are cached next to the token for
+LABEL_CACHE_TTL seconds. Completion never opens a browser sign-in and never
+prints errors; anything that goes wrong just means no suggestions.
+"""
+
+import asyncio
+import json
+import logging
+import time
+from pathlib import Path
+from typing import Callable, List, Optional
+
+import click
+import typer
+from click.shell_completion import get_completion_class
+
+from .config import ORGANIZE_BY_OPTIONS, AppConfig, GmailConfig, load_config
+
+PROG_NAME = "gmail-downloader"
+
+# Environment variable the shell scripts set to ask for completions
+COMPLETE_VAR = "_GMAIL_DOWNLOADER_COMPLETE"
+
+SHELLS = ["bash", "zsh", "fish", "powershell"]
+
+DEFAULT_CONFIG_PATH = "config/config.yaml"
+
+# How long fetched label names are reused, in seconds
+LABEL_CACHE_TTL = 3600
+
+
+def completion_script(shell: str, cli: click.Command) -> str:
+    """
+    The completion script for a shell.
+
+    The script comes from click's completion class for the shell; typer
+    registers its own (PowerShell included) when it builds cli with
+    typer.main.get_command.
+    """
+    if shell not in SHELLS:
+        raise ValueError(f"Unsupported shell: {shell}. Use one of: {', '.join(SHELLS)}")
+
+    complete_class = get_completion_class(shell)
+    if complete_class is None:
+        raise ValueError(
+            f"Completion for {shell} is not available with this version of typer"
+        )
+    return complete_class(cli, {}, PROG_NAME, COMPLETE_VAR).source()
+
+
+def _matching(candidates: List[str], incomplete: str) -> List[str]:
+    return [
+        value for value in candidates if value.lower().startswith(incomplete.lower())
+    ]
+
+
+def _load_quietly(ctx: typer.Context) -> Optional[AppConfig]:
+    """The configuration named on the command line so far, or None if unloadable."""
+    params = ctx.params if ctx is not None else {}
+    logging.disable(logging.CRITICAL)
+    try:
+        config = load_config(params.get("config_path") or DEFAULT_CONFIG_PATH)
+    except Exception:
+        return None
+    finally:
+        logging.disable(logging.NOTSET)
+
+    if params.get("profile"):
+        config.gmail.use_profile(params["profile"])
+    return config
+
+
+def complete_organize_by(incomplete: str) -> List[str]:
+    """Complete --organize-by."""
+    return _matching(ORGANIZE_BY_OPTIONS, incomplete)
+
+
+def profile_names(token_dir: Path) -> List[str]:
+    """
+    Profiles with a saved token in token_dir.
+
+    Tokens are the JSON files holding a refresh token, which leaves out the
+    OAuth client credentials and other files kept alongside.
+    """
+    names = []
+    for path in sorted(Path(token_dir).glob("*.json")):
+        try:
+            info = json.loads(path.read_text())
+        except (OSError, ValueError):
+            continue
+        if isinstance(info, dict) and "refresh_token" in info:
+            names.append(path.stem)
+    return names
+
+
+def complete_profile(ctx: typer.Context, incomplete: str) -> List[str]:
+    """Complete --profile."""
+    config = _load_quietly(ctx)
+    token_file = config.gmail.token_file if config else GmailConfig().token_file
+    return _matching(profile_names(Path(token_file).parent), incomplete)
+
+
+def label_cache_path(gmail_config: GmailConfig) -> Path:
+    """Where an account's label names are cached."""
+    token_path = Path(gmail_config.token_file)
+    return token_path.with_name(f".{gmail_config.get_profile_name()}-labels.json")
+
+
+def cached_label_names(gmail_config: GmailConfig,
+                       fetch: Callable[[], List[str]],
+                       ttl: float = LABEL_CACHE_TTL) -> List[str]:
+    """
+    Label names of an account, fetched at most once per ttl seconds.
+
+    An empty result is not cached, so a failed fetch is retried on the
+    next completion.
+    """
+    cache_path = label_cache_path(gmail_config)
+    try:
+        cached = json.loads(cache_path.read_text())
+        if time.time() - cached["fetched_at"] < ttl:
+            return list(cached["labels"])
+    except (OSError, ValueError, KeyError, TypeError):
+        pass
+
+    labels = sorted(fetch(), key=str.lower)
+    if labels:
+        try:
+            cache_path.write_text(
+                json.dumps({"fetched_at": time.time(), "labels": labels})
+            )
+        except OSError:
+            pass
+    return labels
+
+
+async def _fetch_label_names(config: AppConfig) -> List[str]:
+    from .gmail_client import create_client
+
+    client = create_client(config)
+    await client.authenticate(interactive=False)
+    return list((await client.get_label_names()).values())
+
+
+def complete_label(ctx: typer.Context, incomplete: str) -> List[str]:
+    """Complete --label with the account's Gmail labels."""
+    config = _load_quietly(ctx)
+    if config is None:
+        return []
+
+    def fetch() -> List[str]:
+        logging.disable(logging.CRITICAL)
+        try:
+            return asyncio.run(_fetch_label_names(config))
+        except Exception:
+            return []
+        finally:
+            logging.disable(logging.NOTSET)
+
+    return _matching(cached_label_names(config.gmail, fetch), incomplete)
@@ -0,0 +1,236 @@
+"""
+Running watch mode as a long-lived service.
+
+``watch --daemon`` is meant to be started by systemd (or supervisord, or a
+container runtime), which expects the process to stay in the foreground.
+This module provides the pieces a well-behaved service needs:
+- A PID file that refuses to start a second watcher on the same files
+- sd_notify messages (READY, STATUS, WATCHDOG, RELOADING, STOPPING) for
+  ``Type=notify`` units, without depending on python-systemd
+- Unix signal handling: SIGHUP reloads the config, SIGUSR1 logs a health
+  report, SIGTERM stops cleanly
+- An optional HTTP endpoint serving the same health report as JSON
+- Watching the config file, so edits apply without a restart (also used
+  by plain ``watch``)
+"""
+
+import asyncio
+import json
+import logging
+import os
+import signal
+import socket
+from pathlib import Path
+from typing import Any, Callable, Dict, Optional, Tuple, Union
+
+from .utils import ensure_directory
+
+logger = logging.getLogger(__name__)
+
+# PID file used by watch --daemon when watch.pid_file is not set
+DEFAULT_PID_FILE = "gmail_downloader.pid"
+
+
+class DaemonError(Exception):
+    """Raised when the watcher cannot run as a service."""
+
+    pass
+
+
+class PidFile:
+    """
+    Exclusive PID file for the lifetime of the service.
+
+    A PID file left behind by a crashed process is taken over; one that
+    belongs to a running process means another watcher is active.
+    """
+
+    def __init__(self, path: Union[str, Path]):
+        self.path = Path(path)
+        self.acquired = False
+
+    def acquire(self) -> None:
+        """Write our PID, failing if another live process holds the file."""
+        ensure_directory(self.path.parent)
+
+        for _ in range(2):
+            try:
+                fd = os.open(self.path, os.O_CREAT | os.O_EXCL | os.O_WRONLY, 0o644)
+            except FileExistsError:
+                pid = self.read_pid()
+                if pid and pid != os.getpid() and process_alive(pid):
+                    raise DaemonError(
+                        f"Another watcher is already running (PID {pid}, {self.path})"
+                    )
+                logger.warning(f"Removing stale PID file {self.path}")
+                self.path.unlink(missing_ok=True)
+                continue
+
+            with os.fdopen(fd, "w") as f:
+                f.write(f"{os.getpid()}\n")
+            self.acquired = True
+            return
+
+        raise DaemonError(f"Could not create PID file {self.path}")
+
+    def release(self) -> None:
+        """Remove the PID file if we wrote it."""
+        if self.acquired and self.read_pid() == os.getpid():
+            self.path.unlink(missing_ok=True)
+        self.acquired = False
+
+    def read_pid(self) -> Optional[int]:
+        try:
+            return int(self.path.read_text().strip())
+        except (OSError, ValueError):
+            return None
+
+    def __enter__(self) -> "PidFile":
+        self.acquire()
+        return self
+
+    def __exit__(self, *exc_info) -> None:
+        self.release()
+
+
+def process_alive(pid: int) -> bool:
+    """Whether a process with this PID exists."""
+    try:
+        os.kill(pid, 0)
+    except ProcessLookupError:
+        return False
+    except PermissionError:
+        return True  # Exists, but belongs to another user
+    return True
+
+
+def sd_notify(*states: str) -> bool:
+    """
+    Send state changes to systemd, e.g. sd_notify("READY=1").
+
+    Does nothing (and returns False) when not started by a Type=notify
+    unit, so it is safe to call unconditionally.
+    """
+    address = os.getenv("NOTIFY_SOCKET")
+    if not address:
+        return False
+
+    if address.startswith("@"):
+        address = "\0" + address[1:]  # Abstract namespace socket
+
+    try:
+        with socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM) as sock:
+            sock.connect(address)
+            sock.sendall("\n".join(states).encode("utf-8"))
+    except OSError as e:
+        logger.debug(f"sd_notify failed: {e}")
+        return False
+    return True
+
+
+def parse_health_addr(addr: str) -> Tuple[str, int]:
+    """
+    Split "host:port" (or just ":port") for the health endpoint.
+
+    Raises:
+        ValueError: If the port is missing or invalid
+    """
+    host, _, port = addr.rpartition(":")
+    if not port.isdigit() or not 0 < int(port) < 65536:
+        raise ValueError(
+            f"Invalid health address: {addr} (use host:port, e.g. 127.0.0.1:8765)"
+        )
+    return host.strip("[]") or "127.0.0.1", int(port)
+
+
+async def serve_health(
+    addr: str, status: Callable[[], Dict[str, Any]]
+) -> asyncio.AbstractServer:
+    """
+    Serve status() as JSON over HTTP on addr.
+
+    Any GET returns the report, with 200 while healthy and 503 otherwise,
+    so it works directly as a load balancer or container health check.
+    """
+    host, port = parse_health_addr(addr)
+
+    async def handle(
+        reader: asyncio.StreamReader, writer: asyncio.StreamWriter
+    ) -> None:
+        try:
+            # Only the request line matters; skip the headers
+            await reader.readline()
+            while (await reader.readline()) not in (b"\r\n", b"\n", b""):
+                pass
+
+            report = status()
+            body = json.dumps(report, default=str).encode("utf-8")
+            code = "200 OK" if report.get("healthy") else "503 Service Unavailable"
+            head = (
+                f"HTTP/1.1 {code}\r\nContent-Type: application/json\r\n"
+                f"Content-Length: {len(body)}\r\nConnection: close\r\n\r\n"
+            )
+            writer.write(head.encode("ascii") + body)
+            await writer.drain()
+        except (ConnectionError, asyncio.IncompleteReadError):
+            pass
+        finally:
+            writer.close()
+
+    server = await asyncio.start_server(handle, host, port)
+    logger.info(f"Health endpoint listening on http://{host}:{port}/")
+    return server
+
+
+def install_signal_handlers(handlers: Dict[str, Callable[[], Any]]) -> None:
+    """
+    Run handlers on the event loop when their signal arrives.
+
+    Handlers are keyed by signal name ("SIGHUP"); platforms without Unix
+    signals (Windows) skip the ones they lack.
+    """
+    loop = asyncio.get_running_loop()
+    for name, handler in handlers.items():
+        signum = getattr(signal, name, None)
+        if signum is None:
+            logger.debug(f"{name} is not available on this platform")
+            continue
+        try:
+            loop.add_signal_handler(signum, handler)
+        except (NotImplementedError, RuntimeError):
+            logger.debug(f"{name} cannot be handled here")
+
+
+async def watch_file(path: Union[str, Path],
+                     on_change: Callable[[], Any],
+                     interval: float = 2.0) -> None:
+    """
+    Call on_change whenever the file at path is modified, until cancelled.
+
+    Polls the modification time and size, which works on every platform
+    and file system without extra dependencies. A change is only reported
+    once the file has stopped changing for one interval, so an editor that
+    is still writing (or replacing the file) does not trigger a reload of
+    half a config.
+    """
+    def signature() -> Optional[Tuple[int, int]]:
+        try:
+            stat = os.stat(path)
+        except OSError:
+            return None  # Missing while an editor swaps the file in
+        return stat.st_mtime_ns, stat.st_size
+
+    seen = signature()
+    while True:
+        await asyncio.sleep(interval)
+        current = signature()
+        if current is None or current == seen:
+            continue
+
+        await asyncio.sleep(interval)
+        if signature() != current:
+            continue  # Still being written; look again next round
+
+        seen = current
+        logger.info(f"{path} changed; reloading the configuration")
+        on_change()
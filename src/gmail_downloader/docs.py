@@ -0,0 +1,326 @@
+"""
+Command documentation: usage examples and man pages.
+
+The examples are shown at the end of each command's --help and in the
+EXAMPLES section of its man page. `gmail-downloader man` renders one page
+for the program and one per command (gmail-downloader-download(1), ...)
+from the same option definitions --help uses, so they cannot drift apart.
+"""
+
+from dataclasses import dataclass, field
+from datetime import date
+from pathlib import Path
+from typing import Any, Dict, List, Optional, Tuple
+
+# Command -> (what it does, command line)
+EXAMPLES: Dict[str, List[Tuple[str, str]]] = {
+    "download": [
+        ("Download PDFs from one sender since January",
+         "gmail-downloader download -s billing@vendor.com -e .pdf -a 2025-01-01"),
+        ("Check the quota cost of a large download first",
+         "gmail-downloader download -a 2020-01-01 --estimate"),
+        ("Grab the attachments of one email, pasting its Gmail URL",
+         "gmail-downloader download -m "
+         "'https://mail.google.com/mail/u/0/#inbox/18ac3f0d2e7b5a91'"),
+        ("From cron: fetch only what arrived since the last run",
+         "gmail-downloader download -s reports@vendor.com -e .csv --incremental"),
+        ("Preview what a labelled search would fetch",
+         "gmail-downloader download --label Invoices --dry-run"),
+        ("Retry only what failed in an earlier run",
+         "gmail-downloader download "
+         "--retry-from downloads/reports/run-2025-06-01-093012.json"),
+        ("Follow a long download as JSON events, one per line",
+         "gmail-downloader download -a 2024-01-01 --progress json"),
+        ("Cherry-pick files from a checklist of this year's matches",
+         "gmail-downloader download -a 2025-01-01 --interactive"),
+        ("Split one large download between two processes, by sender",
+         "gmail-downloader download -a 2020-01-01 --shard 1/2 -o ./part1"),
+        ("Use another account and a date-based layout",
+         "gmail-downloader download --profile work --organize-by date"),
+    ],
+    "backfill": [
+        ("Download six years of invoices a month at a time; rerun to resume",
+         "gmail-downloader backfill --from 2018-01-01 --to 2024-01-01 --chunk 1m "
+         "-s billing@vendor.com"),
+        ("Count what each quarter of 2019 would download",
+         "gmail-downloader backfill --from 2019-01-01 --to 2020-01-01 --chunk 3m "
+         "--dry-run"),
+        ("Take the second of four parts of a backfill shared by four machines",
+         "gmail-downloader backfill --from 2015-01-01 --shard 2/4 -o /data/shard2"),
+    ],
+    "retry": [
+        ("Retry what failed in the most recent run",
+         "gmail-downloader retry --last"),
+        ("Retry one run, five tries each, starting a minute apart",
+         "gmail-downloader retry run-2025-06-01-093012 --attempts 5 --backoff 1m"),
+    ],
+    "auth status": [
+        ("See which scopes the work account granted and which it needs",
+         "gmail-downloader auth status --profile work"),
+    ],
+    "auth login": [
+        ("Sign in again after turning on drive_links",
+         "gmail-downloader auth login"),
+    ],
+    "preview": [
+        ("Check an attachment before downloading a year of them",
+         "gmail-downloader preview -m 18ac3f0d2e7b5a91 --attachment export.csv"),
+        ("Show the sheets of a message's second attachment",
+         "gmail-downloader preview -m 18ac3f0d2e7b5a91 --attachment 2"),
+    ],
+    "watch": [
+        ("Check every minute, catching up on the last week first",
+         "gmail-downloader watch -i 60 --backfill 7d"),
+        ("Only check during business hours, every quarter hour",
+         'gmail-downloader watch --schedule "*/15 7-18 * * MON-FRI"'),
+        ("Run under systemd with a health endpoint",
+         "gmail-downloader watch --daemon --health-addr 127.0.0.1:8765"),
+        ("Run only some of the rules: in the config",
+         "gmail-downloader watch --rule finance --rule hr"),
+    ],
+    "run": [
+        ("One pass from an Airflow or Prefect task, with a JSON summary on stdout",
+         "gmail-downloader run --once --json-summary"),
+        ("Keep running on the config's watch schedule, one summary line per pass",
+         "gmail-downloader run --json-summary --profile finance"),
+    ],
+    "list": [
+        ("The ten largest spreadsheets as JSON",
+         "gmail-downloader list -e .xlsx --sort-by size -r -n 10 -f json"),
+        ("Attachments under a label, as CSV",
+         "gmail-downloader list --label Reports -f csv > reports.csv"),
+    ],
+    "stats": [
+        ("Top five senders and file types by size",
+         "gmail-downloader stats --top 5"),
+    ],
+    "index": [
+        ("Index what was downloaded since the last time",
+         "gmail-downloader index"),
+    ],
+    "search": [
+        ("Which downloaded file mentions order 4812?",
+         'gmail-downloader search "order 4812"'),
+        ("Invoices from one sender, as JSON",
+         'gmail-downloader search "sender:acme AND invoice" -f json'),
+    ],
+    "manifest": [
+        ("Write the hashes of the downloads for sha256sum -c",
+         "gmail-downloader manifest --format sha256sums > downloads/SHA256SUMS"),
+        ("One sender's files as CSV",
+         "gmail-downloader manifest -q 'sender=bi@acme.com' -f csv"),
+    ],
+    "verify": [
+        ("Check that no downloaded file was modified or deleted",
+         "gmail-downloader verify"),
+    ],
+    "clean": [
+        ("See what a 90-day retention keeping each feed's last three would remove",
+         "gmail-downloader clean --older-than 90d --keep-latest 3 --dry-run"),
+        ("Apply the retention: section of the config, e.g. nightly from cron",
+         "gmail-downloader clean"),
+    ],
+    "recover": [
+        ("See what can still be rescued from Trash and Spam",
+         "gmail-downloader recover --include-trash --include-spam --dry-run"),
+    ],
+    "import": [
+        ("Extract the PDFs from a Google Takeout export, no API quota used",
+         "gmail-downloader import -e .pdf "
+         "--mbox 'Takeout/Mail/All mail Including Spam and Trash.mbox'"),
+    ],
+    "doctor": [
+        ("Check that everything needed to download is in place",
+         "gmail-downloader doctor"),
+        ("Check a second account's sign-in",
+         "gmail-downloader doctor --profile work"),
+    ],
+    "update": [
+        ("See whether a newer release is out",
+         "gmail-downloader update --check-only"),
+        ("Update a standalone build, checking the release against its signature",
+         "gmail-downloader update"),
+        ("Check the signature with another key than the pinned one",
+         "gmail-downloader update --public-key release-key.pem"),
+    ],
+    "completion": [
+        ("Enable completion in the current bash session",
+         'eval "$(gmail-downloader completion bash)"'),
+        ("Install zsh completion",
+         "gmail-downloader completion zsh > ~/.zfunc/_gmail-downloader"),
+    ],
+    "man": [
+        ("Install the man pages for the current user",
+         "gmail-downloader man -o ~/.local/share/man/man1"),
+    ],
+}
+
+
+def examples_epilog(command: str) -> Optional[str]:
+    """The examples of a command as --help epilog text."""
+    examples = EXAMPLES.get(command)
+    if not examples:
+        return None
+    # Paragraphs become lines in the rendered help
+    paragraphs = ["Examples:"]
+    for description, command_line in examples:
+        paragraphs.append(f"{description}:")
+        paragraphs.append(f"  $ {command_line}")
+    return "\n\n".join(paragraphs)
+
+
+def roff_escape(text: str) -> str:
+    """Escape text for roff: backslashes, hyphens, and leading dots or quotes."""
+    text = text.replace("\\", "\\e").replace("-", "\\-")
+    lines = []
+    for line in text.splitlines() or [""]:
+        if line.startswith((".", "'")):
+            line = "\\&" + line
+        lines.append(line)
+    return "\n".join(lines)
+
+
+@dataclass
+class ManPage:
+    """The content of one man page."""
+
+    name: str
+    summary: str
+    synopsis: str
+    description: str = ""
+    # (flags, help), e.g. ("-s, --sender TEXT", "Filter by sender email")
+    options: List[Tuple[str, str]] = field(default_factory=list)
+    # (command, summary)
+    commands: List[Tuple[str, str]] = field(default_factory=list)
+    examples: List[Tuple[str, str]] = field(default_factory=list)
+    # (code, meaning)
+    exit_status: List[Tuple[int, str]] = field(default_factory=list)
+    see_also: List[str] = field(default_factory=list)
+
+    @property
+    def filename(self) -> str:
+        return f"{self.name}.1"
+
+    def render(self, version: str, when: Optional[date] = None) -> str:
+        """The page as roff source for man(1)."""
+        when = when or date.today()
+        out = [
+            f'.TH "{self.name.upper()}" "1" "{when.isoformat()}" '
+            f'"gmail-downloader {version}" "User Commands"',
+            ".SH NAME",
+            f"{roff_escape(self.name)} \\- {roff_escape(self.summary)}",
+            ".SH SYNOPSIS",
+            f".B {roff_escape(self.synopsis)}",
+        ]
+        if self.description:
+            out += [".SH DESCRIPTION", roff_escape(self.description)]
+        if self.commands:
+            out.append(".SH COMMANDS")
+            for command, summary in self.commands:
+                out += [".TP", f".B {roff_escape(command)}", roff_escape(summary)]
+        if self.options:
+            out.append(".SH OPTIONS")
+            for flags, help_text in self.options:
+                out += [".TP", f".B {roff_escape(flags)}", roff_escape(help_text)]
+        if self.examples:
+            out.append(".SH EXAMPLES")
+            for description, command_line in self.examples:
+                out += [".PP", roff_escape(description) + ":", ".IP", ".nf",
+                        roff_escape(command_line), ".fi"]
+        if self.exit_status:
+            out.append(".SH EXIT STATUS")
+            for code, meaning in self.exit_status:
+                out += [".TP", f".B {code}", roff_escape(meaning)]
+        if self.see_also:
+            out += [
+                ".SH SEE ALSO",
+                ", ".join(f"\\fB{roff_escape(name)}\\fR(1)" for name in self.see_also),
+            ]
+        return "\n".join(out) + "\n"
+
+
+def _option_rows(command) -> List[Tuple[str, str]]:
+    """(flags, help) for each visible option of a click command."""
+    rows = []
+    for param in command.params:
+        if getattr(param, "hidden", False) or param.param_type_name != "option":
+            continue
+        flags = ", ".join(param.opts)
+        if param.secondary_opts:
+            flags += " / " + ", ".join(param.secondary_opts)
+        if not param.is_flag:
+            flags += " " + (param.metavar or param.type.name.upper())
+        rows.append((flags, param.help or ""))
+    return rows
+
+
+def _first_line(text: Optional[str]) -> str:
+    lines = (text or "").strip().splitlines()
+    return lines[0] if lines else ""
+
+
+def _flatten(commands: Dict[str, Any]) -> Dict[str, Any]:
+    """commands plus the commands of command groups, e.g. "auth status"."""
+    flat = dict(commands)
+    for name, command in commands.items():
+        for sub_name, sub_command in getattr(command, "commands", {}).items():
+            if not sub_command.hidden:
+                flat[f"{name} {sub_name}"] = sub_command
+    return flat
+
+
+def build_man_pages(
+    group, prog_name: str, exit_status: Optional[List[Tuple[int, str]]] = None
+) -> List[ManPage]:
+    """
+    Man pages for a click group (the Typer app) and each of its commands.
+
+    Args:
+        group: click.Group, e.g. typer.main.get_command(app)
+        prog_name: Name the program is installed as
+        exit_status: (code, meaning) of the exit codes, for the main page
+    """
+    commands = {
+        name: command for name, command in group.commands.items() if not command.hidden
+    }
+    pages = [ManPage(
+        name=prog_name,
+        summary=_first_line(group.help),
+        synopsis=f"{prog_name} [OPTIONS] COMMAND [ARGS]...",
+        description=(group.help or "").strip(),
+        options=_option_rows(group),
+        commands=[
+            (name, _first_line(command.help))
+            for name, command in sorted(commands.items())
+        ],
+        exit_status=exit_status or [],
+        see_also=[f"{prog_name}-{name}" for name in sorted(commands)],
+    )]
+    for name, command in sorted(_flatten(commands).items()):
+        arguments = " ".join(
+            param.name.upper()
+            for param in command.params
+            if param.param_type_name == "argument"
+        )
+        pages.append(ManPage(
+            name=f"{prog_name}-{name.replace(' ', '-')}",
+            summary=_first_line(command.help),
+            synopsis=f"{prog_name} {name} [OPTIONS] {arguments}".rstrip(),
+            description=(command.help or "").strip(),
+            options=_option_rows(command),
+            examples=EXAMPLES.get(name, []),
+            see_also=[prog_name],
+        ))
+    return pages
+
+
+def write_man_pages(pages: List[ManPage], output_dir: Path, version: str) -> List[Path]:
+    """Write pages into output_dir, returning the files written."""
+    output_dir = Path(output_dir)
+    output_dir.mkdir(parents=True, exist_ok=True)
+    written = []
+    for page in pages:
+        path = output_dir / page.filename
+        path.write_text(page.render(version))
+        written.append(path)
+    return written
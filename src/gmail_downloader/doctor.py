@@ -0,0 +1,370 @@
+"""
+Diagnosing a setup that does not work.
+
+Most first runs that fail do so for one of a handful of reasons: the OAuth
+client was never downloaded, the token has expired without a refresh token,
+a newly enabled feature needs a scope the token lacks, the Gmail API is not
+enabled on the Cloud project, the output directory is read-only, the clock
+is off (Google rejects sign-ins from skewed clocks) or a firewall keeps
+googleapis.com out of reach. `gmail-downloader doctor` checks each in turn
+and says how to fix what fails:
+
+    ✅ Output directory: downloads, 212.4 GB free
+    ❌ Token: expired and there is no refresh token
+       → Sign in again: gmail-downloader auth login
+
+Every check returns a Check rather than raising, so one failure does not
+hide the others.
+"""
+
+import json
+import tempfile
+import urllib.error
+import urllib.request
+from dataclasses import dataclass
+from datetime import datetime, timezone
+from email.utils import parsedate_to_datetime
+from pathlib import Path
+from typing import Callable, List, Mapping, Optional
+
+from .config import AppConfig, DownloadConfig, GmailConfig
+from .gmail_client import GmailError, create_client, missing_scopes
+from .tokenstore import TokenStoreError, open_token_store
+from .utils import format_file_size, free_disk_space
+
+# Check outcomes: WARN is worth a look, FAIL stops downloads from working
+OK = "ok"
+WARN = "warn"
+FAIL = "fail"
+SKIP = "skip"
+
+# Endpoint probed for reachability; its Date header gives Google's clock
+PROBE_URL = "https://gmail.googleapis.com/$discovery/rest?version=v1"
+
+# Clock skew, in seconds, worth a warning and the point sign-ins start failing
+CLOCK_SKEW_WARN = 30
+CLOCK_SKEW_FAIL = 300
+
+# Where the Gmail API is enabled for a Cloud project
+ENABLE_API_URL = "https://console.cloud.google.com/apis/library/gmail.googleapis.com"
+
+# Errors Google answers with when the project has not enabled the API
+API_DISABLED_REASONS = (
+    "accessNotConfigured", "SERVICE_DISABLED", "has not been used in project"
+)
+
+# Fetches a URL and returns the response headers, whatever its status
+Probe = Callable[[str], Mapping[str, str]]
+
+
+@dataclass
+class Check:
+    """The outcome of one check, with how to fix it if it did not pass."""
+
+    name: str
+    status: str
+    detail: str = ""
+    fix: str = ""
+
+    @property
+    def failed(self) -> bool:
+        return self.status == FAIL
+
+
+def uses_oauth_client(config: AppConfig) -> bool:
+    """Whether the profile signs in to Google with the credentials_file client."""
+    if config.gmail.get_provider() != "gmail":
+        return False
+    return not (config.gmail.protocol == "imap" and config.imap.auth == "password")
+
+
+def check_credentials(gmail: GmailConfig) -> Check:
+    """The OAuth client file exists and is a Desktop (installed) or web client."""
+    name = "Credentials file"
+    path = Path(gmail.credentials_file)
+    download_fix = (
+        "In Google Cloud Console open APIs & Services "
+        "> Credentials, create an OAuth client ID "
+        f"of type Desktop app, download its JSON and save it as {path}"
+    )
+    if not path.exists():
+        return Check(name, FAIL, f"{path} not found", download_fix)
+    try:
+        data = json.loads(path.read_text(encoding="utf-8"))
+    except (OSError, ValueError) as e:
+        return Check(name, FAIL, f"{path} cannot be read as JSON: {e}", download_fix)
+
+    kind = next(
+        (key for key in ("installed", "web") if isinstance(data, dict) and key in data),
+        None,
+    )
+    if kind is None:
+        return Check(
+            name,
+            FAIL,
+            f"{path} is not an OAuth client file (a service account key?)",
+            download_fix,
+        )
+    client_id = data[kind].get("client_id")
+    if not client_id:
+        return Check(name, FAIL, f"{path} has no client_id", download_fix)
+    if kind == "web":
+        return Check(
+            name,
+            WARN,
+            f"{path} is a Web application client ({client_id})",
+            "Sign-in uses a local redirect, which Web "
+            "clients refuse unless http://localhost is "
+            "an authorized redirect URI; a Desktop app client needs no setup",
+        )
+    return Check(name, OK, f"{path} (Desktop app client {client_id})")
+
+
+def _token_info(config: AppConfig) -> Optional[dict]:
+    """The saved token as JSON, None if there is none; ValueError if unreadable."""
+    try:
+        token = open_token_store(config.gmail, interactive=False).load()
+    except TokenStoreError as e:
+        raise ValueError(str(e))
+    if not token:
+        return None
+    info = json.loads(token)
+    if not isinstance(info, dict):
+        raise ValueError("the token is not a JSON object")
+    return info
+
+
+def parse_expiry(expiry: str) -> datetime:
+    """A token's expiry, as google-auth writes it (UTC, with or without a Z)."""
+    moment = datetime.fromisoformat(expiry.rstrip("Z"))
+    if moment.tzinfo is None:
+        moment = moment.replace(tzinfo=timezone.utc)
+    return moment
+
+
+def check_token(config: AppConfig, now: Optional[datetime] = None) -> Check:
+    """A token is saved, and is either still valid or can be refreshed."""
+    name = "Token"
+    login_fix = "Sign in: gmail-downloader auth login"
+    describe = open_token_store(config.gmail, interactive=False).describe()
+    try:
+        info = _token_info(config)
+    except ValueError as e:
+        return Check(name, FAIL, f"{describe} cannot be read: {e}", login_fix)
+    if info is None:
+        return Check(name, FAIL, f"not signed in: no token in {describe}", login_fix)
+
+    now = now or datetime.now(timezone.utc)
+    refreshable = bool(info.get("refresh_token"))
+    expiry = info.get("expiry")
+    try:
+        expired = bool(expiry) and parse_expiry(expiry) <= now
+    except ValueError:
+        return Check(
+            name, FAIL, f"{describe} has an unreadable expiry: {expiry}", login_fix
+        )
+
+    if expired and not refreshable:
+        return Check(
+            name,
+            FAIL,
+            "expired and there is no refresh token",
+            "Sign in again: gmail-downloader auth login",
+        )
+    if not refreshable:
+        return Check(
+            name,
+            WARN,
+            f"valid until {expiry}, but there is no refresh token",
+            "Sign in again once it expires, or revoke the app's access at "
+            "https://myaccount.google.com/permissions "
+            "and sign in to get a refresh token",
+        )
+    if expired:
+        return Check(
+            name, OK, f"{describe}; access token expired, refreshed on the next run"
+        )
+    return Check(
+        name, OK, f"{describe}" + (f", valid until {expiry}" if expiry else "")
+    )
+
+
+def check_scopes(config: AppConfig, needed: List[str]) -> Check:
+    """The saved token grants every scope the enabled features need."""
+    name = "Scopes"
+    try:
+        info = _token_info(config)
+    except ValueError:
+        info = None
+    if info is None:
+        return Check(name, SKIP, "no token to check")
+    granted = info.get("scopes") or []
+    lacking = missing_scopes(granted, needed)
+    if lacking:
+        return Check(
+            name, FAIL, f"the token lacks {', '.join(lacking)}",
+            "Sign in again to grant them: gmail-downloader auth login",
+        )
+    return Check(name, OK, f"{len(needed)} needed, all granted")
+
+
+def check_output_dir(download: DownloadConfig) -> Check:
+    """The download directory can be written to and has room to spare."""
+    name = "Output directory"
+    if download.is_remote():
+        return Check(name, SKIP, f"{download.base_dir} is remote storage")
+    path = Path(download.base_dir)
+    existing = path
+    while not existing.exists() and existing.parent != existing:
+        existing = existing.parent
+    if not existing.is_dir():
+        return Check(
+            name,
+            FAIL,
+            f"{existing} is not a directory",
+            "Set download.base_dir to a directory",
+        )
+    if not path.exists() and not download.create_missing_dirs:
+        return Check(
+            name, FAIL, f"{path} does not exist and create_missing_dirs is off",
+            f"Create it: mkdir -p {path}",
+        )
+
+    try:
+        with tempfile.NamedTemporaryFile(dir=existing, prefix=".doctor-"):
+            pass
+    except OSError as e:
+        return Check(
+            name,
+            FAIL,
+            f"{existing} is not writable: {e.strerror or e}",
+            f"Make it writable (chmod u+w {existing}) "
+            "or set download.base_dir elsewhere",
+        )
+
+    free = free_disk_space(existing)
+    detail = str(path) + ("" if path.exists() else " (created on the first download)")
+    if free is not None:
+        detail += f", {format_file_size(free)} free"
+        if download.min_free_space is not None and free < download.min_free_space:
+            limit = format_file_size(download.min_free_space)
+            return Check(
+                name,
+                FAIL,
+                f"{detail}, below min_free_space ({limit})",
+                "Free up space or point download.base_dir at a larger disk",
+            )
+    return Check(name, OK, detail)
+
+
+def url_probe(opener: urllib.request.OpenerDirector, timeout: float = 10) -> Probe:
+    """A probe sending HEAD requests through opener; error statuses still answer."""
+
+    def probe(url: str) -> Mapping[str, str]:
+        try:
+            with opener.open(
+                urllib.request.Request(url, method="HEAD"), timeout=timeout
+            ) as response:
+                return dict(response.headers)
+        except urllib.error.HTTPError as e:
+            return dict(e.headers or {})
+
+    return probe
+
+
+def check_network(
+    probe: Probe, now: Callable[[], datetime] = lambda: datetime.now(timezone.utc)
+) -> List[Check]:
+    """googleapis.com can be reached, and the local clock agrees with Google's."""
+    try:
+        headers = {key.lower(): value for key, value in probe(PROBE_URL).items()}
+    except (OSError, ValueError) as e:
+        reason = getattr(e, "reason", None) or e
+        return [
+            Check(
+                "Network", FAIL, f"cannot reach gmail.googleapis.com: {reason}",
+                "Check the connection and firewall; "
+                "behind a proxy set network.proxy_url "
+                "(or HTTPS_PROXY), and with TLS inspection network.ca_bundle",
+            ),
+            Check("Clock", SKIP, "Google's time is unknown without a connection"),
+        ]
+    network = Check("Network", OK, "gmail.googleapis.com is reachable")
+
+    try:
+        google_time = parsedate_to_datetime(headers["date"])
+    except (KeyError, TypeError, ValueError):
+        return [network, Check("Clock", SKIP, "the response carried no Date header")]
+    skew = (now() - google_time).total_seconds()
+    detail = f"{abs(skew):.0f}s {'ahead of' if skew > 0 else 'behind'} Google"
+    fix = (
+        "Synchronize the clock, e.g. enable NTP: timedatectl set-ntp true (Linux) or "
+        "Settings > Time (Windows, macOS)"
+    )
+    if abs(skew) > CLOCK_SKEW_FAIL:
+        return [
+            network,
+            Check(
+                "Clock",
+                FAIL,
+                detail + "; sign-ins and token refreshes are refused",
+                fix,
+            ),
+        ]
+    if abs(skew) > CLOCK_SKEW_WARN:
+        return [network, Check("Clock", WARN, detail, fix)]
+    return [network, Check("Clock", OK, detail)]
+
+
+async def check_api(config: AppConfig) -> Check:
+    """The Gmail API answers with the saved token, i.e. it is enabled on the project."""
+    name = "Gmail API"
+    client = create_client(config)
+    try:
+        await client.authenticate(interactive=False)
+        profile = await client.get_user_profile()
+    except GmailError as e:
+        message = str(e)
+        if any(reason in message for reason in API_DISABLED_REASONS):
+            return Check(
+                name,
+                FAIL,
+                "the Gmail API is not enabled on the OAuth client's Cloud project",
+                f"Enable it at {ENABLE_API_URL} (pick the project the client belongs "
+                "to), then wait a minute",
+            )
+        return Check(
+            name,
+            FAIL,
+            message.splitlines()[0],
+            "Fix the checks above, then run doctor again",
+        )
+    return Check(name, OK, f"signed in as {profile.get('emailAddress', 'unknown')}")
+
+
+async def run_checks(config: AppConfig, needed: List[str], probe: Probe) -> List[Check]:
+    """Every check for config, in the order they are printed."""
+    checks: List[Check] = []
+    if uses_oauth_client(config):
+        checks.append(check_credentials(config.gmail))
+        checks.append(check_token(config))
+        checks.append(check_scopes(config, needed))
+    else:
+        checks.append(
+            Check(
+                "Credentials",
+                SKIP,
+                "the profile does not sign in with a Google OAuth client",
+            )
+        )
+    output = check_output_dir(config.download)
+    checks.append(output)
+    checks.extend(check_network(probe))
+
+    if not uses_oauth_client(config) or config.gmail.protocol == "imap":
+        return checks
+    if any(check.failed for check in checks if check is not output):
+        checks.append(Check("Gmail API", SKIP, "not tried until the checks above pass"))
+    else:
+        checks.append(await check_api(config))
+    return checks
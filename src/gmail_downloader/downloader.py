@@ -3,69 +3,794 @@ Attachment downloader with smart organization and async support
 """
 
 import asyncio
-import aiofiles
+import errno
+import hashlib
+import json
+import logging
+import os
+import re
+import time
+from dataclasses import dataclass, replace
 from pathlib import Path
-from typing import List, Dict, Any, Optional
-from datetime import datetime
+from typing import (
+    List,
+    Dict,
+    Any,
+    Optional,
+    Callable,
+    Awaitable,
+    Iterator,
+    Set,
+    Tuple,
+    TYPE_CHECKING,
+)
+from datetime import datetime, timedelta
+
+from .config import AppConfig
+from .drive import (
+    DriveClient,
+    DriveError,
+    NATIVE_STUB_EXTENSIONS,
+    drive_file_id,
+    find_drive_links,
+    is_native_reference,
+    stub_file_id,
+)
+from .dvc import DvcTracker, open_dvc
+from .encryption import Encryptor, open_encryptor
+from .events import (
+    EventBus,
+    EventMetrics,
+    FileDone,
+    FileFailed,
+    FileProgress,
+    FileStarted,
+    RunDone,
+    SchemaChanged,
+    SearchStarted,
+)
+from .gmail_client import (
+    MAX_QUERY_LENGTH,
+    QUOTA_COSTS,
+    GmailAuthenticationError,
+    GmailError,
+    GmailQuotaExceededError,
+)
+from .freshness import FreshnessMonitor, latest_arrival
+from .gitsync import GitCommitter, open_git
+from .junk import JunkFilter
+from .latest import latest_path, link_target, update_latest
+from .manifest import DownloadManifest, ManifestEntry, ManifestError
+from .notifier import WebhookNotifier
+from .partial import PartialDownloads, partial_key
+from .quarantine import (
+    REASON_MALWARE,
+    REASON_UNSAFE_FILENAME,
+    REASON_VERIFY_FAILED,
+    quarantine_path,
+    reason_record,
+    write_quarantined,
+)
+from .scanner import VERDICT_CLEAN, ScanError, open_scanner
+from .schedule import next_run, parse_schedules
+from .schema import SchemaChange, SchemaHistory, missing_columns
+from .sniff import detect_extension, fixed_filename
+from .storage import Location, SpoolingStorage, Storage, StorageError, open_storage
+from .transforms import Transforms, open_transforms
+from .unlock import PROTECTION_LOCKED, open_unlocker
+from .utils import (
+    clean_subject,
+    extract_email_address,
+    format_date_folder,
+    format_file_size,
+    free_disk_space,
+    get_timezone,
+    matches_filename_pattern,
+    parse_bandwidth,
+    resolve_sender_alias,
+    sanitize_filename,
+    truncate_string,
+    type_folder,
+    unsafe_filename,
+)
+
+if TYPE_CHECKING:
+    from .gmail_client import EmailAttachment, EmailMessage, GmailAPI
+
+logger = logging.getLogger(__name__)
+
+
+# Sync status of a planned download compared to what is already on disk
+STATUS_NEW = "NEW"          # Nothing at the destination path yet
+STATUS_UPDATED = "UPDATED"  # A different file already sits at the destination
+STATUS_EXISTS = "EXISTS"    # The same file has already been downloaded
+
+
+@dataclass
+class PlannedDownload:
+    """An attachment that matched the filters, with its destination and status."""
+
+    message: "EmailMessage"
+    attachment: "EmailAttachment"
+    path: Location
+    status: str
+    
+    # Name the file is saved under (see disambiguate_filenames)
+    filename: str = ""
+    
+    def to_dict(self) -> Dict[str, Any]:
+        """
+        Describe the attachment for machine-readable output.
+        
+        part_id is the stable way to point at one attachment within its
+        message; attachment_id is what Gmail needs to download it right now.
+        """
+        return {
+            "message_id": self.message.message_id,
+            "thread_id": self.message.thread_id,
+            "part_id": self.attachment.part_id,
+            "attachment_id": self.attachment.attachment_id,
+            "filename": self.attachment.filename,
+            "saved_as": self.filename,
+            "mime_type": self.attachment.mime_type,
+            "size": self.attachment.size,
+            "sender": self.message.sender,
+            "sender_name": self.message.sender_name,
+            "subject": self.message.subject,
+            "date": self.message.date.isoformat(),
+            "labels": list(self.message.labels),
+            "path": str(self.path),
+            "status": self.status,
+        }
+
+
+class VerificationError(StorageError):
+    """Raised when a written file still does not match the downloaded data."""
+
+    pass
+
+
+@dataclass
+class FailedDownload:
+    """A planned attachment that could not be downloaded or saved."""
+
+    item: PlannedDownload
+    error: str
+
+
+# Ways to order planned downloads, e.g. for the list command
+SORT_KEYS: Dict[str, Callable[[PlannedDownload], Any]] = {
+    "date": lambda item: item.message.date,
+    "sender": lambda item: item.message.sender.lower(),
+    "subject": lambda item: item.message.subject.lower(),
+    "filename": lambda item: item.filename.lower(),
+    "size": lambda item: item.attachment.size,
+}
+
+
+def sort_planned(planned: List[PlannedDownload],
+                 sort_by: str = "date",
+                 descending: bool = False) -> List[PlannedDownload]:
+    """
+    Return planned downloads ordered by one of SORT_KEYS.
+    
+    The sort is stable, so attachments of the same message keep their order.
+    
+    Raises:
+        ValueError: If sort_by is not a known sort key
+    """
+    if sort_by not in SORT_KEYS:
+        raise ValueError(
+            f"Invalid sort key: {sort_by}. Must be one of: {', '.join(SORT_KEYS)}"
+        )
+    return sorted(planned, key=SORT_KEYS[sort_by], reverse=descending)
+
+
+def latest_per_thread(planned: List[PlannedDownload]) -> List[PlannedDownload]:
+    """
+    Keep only the newest attachment of each filename within each thread.
+    
+    A vendor re-sending a corrected report.csv as a reply replaces the
+    earlier one instead of adding a stale duplicate. Filenames are compared
+    case-insensitively; the plan's order is kept.
+    """
+    newest: Dict[Tuple[str, str], PlannedDownload] = {}
+    for item in planned:
+        key = (item.message.thread_id, item.filename.lower())
+        current = newest.get(key)
+        if current is None or item.message.date > current.message.date:
+            newest[key] = item
+    
+    kept = set(map(id, newest.values()))
+    return [item for item in planned if id(item) in kept]
+
+
+@dataclass
+class AttachmentStats:
+    """Number and total size of attachments in one group"""
+    
+    count: int = 0
+    total_bytes: int = 0
+
+
+# Ways to group planned downloads for the stats command
+STATS_DIMENSIONS: Dict[str, Callable[[PlannedDownload], str]] = {
+    "sender": lambda item: extract_email_address(item.message.sender).lower(),
+    "extension": lambda item: Path(item.attachment.filename).suffix.lower() or "(none)",
+    "month": lambda item: item.message.date.strftime("%Y-%m"),
+}
+
+
+def aggregate_planned(planned: List[PlannedDownload],
+                      sender_aliases: Optional[Dict[str, str]] = None
+                      ) -> Dict[str, Dict[str, AttachmentStats]]:
+    """
+    Count attachments and bytes per sender, per extension and per month.
+    
+    Sizes are what Gmail reports, so this works before anything is
+    downloaded - useful for planning storage. Senders with an alias are
+    counted under the alias.
+    
+    Returns:
+        {dimension: {group: AttachmentStats}} for every STATS_DIMENSIONS key
+    """
+    stats: Dict[str, Dict[str, AttachmentStats]] = {
+        dimension: {} for dimension in STATS_DIMENSIONS
+    }
+    
+    for item in planned:
+        for dimension, group_of in STATS_DIMENSIONS.items():
+            key = group_of(item)
+            if dimension == "sender":
+                key = resolve_sender_alias(item.message.sender, sender_aliases) or key
+            group = stats[dimension].setdefault(key, AttachmentStats())
+            group.count += 1
+            group.total_bytes += item.attachment.size
+    
+    return stats
+
+
+def limit_path_depth(folders: List[str], max_depth: int) -> List[str]:
+    """
+    Flatten a folder path that is deeper than max_depth levels.
+    
+    The first max_depth - 1 folders are kept as they are; everything below
+    is replaced by one folder named after a short hash of the remainder.
+    Different deep paths stay apart, the same path always maps to the same
+    folder, and the tree never gets deeper than max_depth. For example, with
+    max_depth=2, ["a", "b", "c", "d"] becomes ["a", <hash of "b/c/d">].
+    
+    A max_depth of 0 means no limit.
+    """
+    if max_depth <= 0 or len(folders) <= max_depth:
+        return folders
+    
+    keep = folders[:max_depth - 1]
+    remainder = "/".join(folders[max_depth - 1:])
+    digest = hashlib.sha256(remainder.encode("utf-8")).hexdigest()[:12]
+    return keep + [digest]
+
+
+def fit_path_length(folders: List[str],
+                    filename: str,
+                    max_length: int,
+                    min_component: int = 16) -> Tuple[List[str], str]:
+    """
+    Shorten folder names, then the file name, until the key fits max_length.
+    
+    Folder names are shortened longest first, because subject and sender
+    folders are usually what makes a path long, and end in a short hash of
+    the full name so folders that only differ at the end stay apart. The
+    file name is only cut (keeping its extension, and with a hash too) when
+    shortening every folder to min_component characters is not enough.
+    """
+    folders = list(folders)
+    
+    def excess() -> int:
+        return len("/".join(folders + [filename])) - max_length
+    
+    while excess() > 0:
+        longest = max(range(len(folders)), key=lambda i: len(folders[i]), default=None)
+        if longest is None or len(folders[longest]) <= min_component:
+            break
+        
+        name = folders[longest]
+        digest = hashlib.sha256(name.encode("utf-8")).hexdigest()[:6]
+        keep = max(min_component, len(name) - excess()) - len(digest) - 1
+        folders[longest] = f"{name[:keep]}_{digest}"
+    
+    if excess() > 0:
+        path = Path(filename)
+        digest = hashlib.sha256(filename.encode("utf-8")).hexdigest()[:6]
+        keep = max(
+            min_component - len(path.suffix), len(path.stem) - excess()
+        ) - len(digest) - 1
+        filename = f"{path.stem[:max(keep, 1)]}_{digest}{path.suffix}"
+    
+    return folders, filename
+
+
+def numbered_variants(key: str) -> Iterator[str]:
+    """Yield key, then reports/a_1.pdf, reports/a_2.pdf, ... for key reports/a.pdf"""
+    folder, _, name = key.rpartition("/")
+    path = Path(name)
+    prefix = f"{folder}/" if folder else ""
+    
+    yield key
+    counter = 1
+    while True:
+        yield f"{prefix}{path.stem}_{counter}{path.suffix}"
+        counter += 1
+
+
+def versioned_key(key: str, date: str) -> str:
+    """key with a version date before the extension: reports/a_2024-06-01.pdf"""
+    folder, _, name = key.rpartition("/")
+    path = Path(name)
+    prefix = f"{folder}/" if folder else ""
+    return f"{prefix}{path.stem}_{date}{path.suffix}"
+
+
+def is_numbered_variant(key: str, base_key: str) -> bool:
+    """
+    Whether key is base_key, one of its numbered_variants or a versioned_key
+    of it (which may be numbered in turn: a_2024-06-01_1.pdf)
+    """
+    if key == base_key:
+        return True
+    folder, _, name = base_key.rpartition("/")
+    path = Path(name)
+    prefix = re.escape(f"{folder}/" if folder else "")
+    pattern = (
+        f"{prefix}{re.escape(path.stem)}(_[0-9]+|_{VERSION_DATE_PATTERN}(_[0-9]+)?){re.escape(path.suffix)}"
+    )
+    return re.fullmatch(pattern, key) is not None
+
+
+def disambiguate_filenames(attachments: List["EmailAttachment"],
+                           unicode: str = "keep") -> List[str]:
+    """
+    Give every attachment in one message a distinct filename.
+    
+    A message can carry two different files that are both called data.csv.
+    The first keeps its name; later ones get a suffix built from their MIME
+    part ID (or their position when Gmail gives no part ID), e.g.
+    data_part2.csv. The result only depends on the message itself, so the
+    same attachment always gets the same name on every run.
+    
+    Names are compared after sanitization (in the downloader's unicode
+    mode) and case-folding, because that is what decides whether two files
+    would land on the same path.
+    """
+    taken = set()
+    names = []
+    
+    for index, attachment in enumerate(attachments):
+        name = attachment.filename
+        
+        if sanitize_filename(name, unicode).lower() in taken:
+            path = Path(name)
+            part = (getattr(attachment, "part_id", "") or str(index)).replace(".", "-")
+            name = f"{path.stem}_part{part}{path.suffix}"
+            
+            # Extremely unlikely, but never hand out a name twice
+            counter = 2
+            while sanitize_filename(name, unicode).lower() in taken:
+                name = f"{path.stem}_part{part}_{counter}{path.suffix}"
+                counter += 1
+        
+        taken.add(sanitize_filename(name, unicode).lower())
+        names.append(name)
+    
+    return names
+
+
+# Manifest anomaly values for attachments whose size differs from Gmail's
+ANOMALY_SIZE_MISMATCH = "size_mismatch"
+ANOMALY_RECOVERED_RAW = "recovered_raw"
+
+# Manifest skipped values for attachments left out once downloaded
+SKIPPED_MISSING_COLUMNS = "missing_columns"
+SKIPPED_BANNER = "banner"
+
+# Version dates in filenames (download.conflict_policy "version")
+VERSION_DATE_FORMAT = "%Y-%m-%d"
+VERSION_DATE_PATTERN = r"[0-9]{4}-[0-9]{2}-[0-9]{2}"
+
+# Characters of the thread ID in organize_by "thread" folder names; Gmail
+# thread IDs start with a timestamp, so the end tells threads apart
+THREAD_ID_LENGTH = 8
+
+# Manifest fields stored with each file when file_metadata is enabled
+METADATA_FIELDS = [
+    "message_id", "thread_id", "part_id", "filename",
+    "sender", "sender_name", "subject", "date", "size", "sha256",
+]
+SIDECAR_SUFFIX = ".meta.json"
+XATTR_PREFIX = "user.gmail_downloader."
+
+
+def file_metadata(entry: ManifestEntry) -> Dict[str, Any]:
+    """Provenance of a downloaded file, taken from its manifest entry"""
+    return {name: getattr(entry, name) for name in METADATA_FIELDS}
+
+
+def set_xattrs(path: Path, metadata: Dict[str, Any]) -> None:
+    """
+    Store metadata as user extended attributes on a local file.
+    
+    Raises AttributeError where the platform has no xattr support and
+    OSError where the filesystem does not support it.
+    """
+    for name, value in metadata.items():
+        os.setxattr(path, XATTR_PREFIX + name, str(value).encode("utf-8"))
+
 
 class AttachmentDownloader:
     """Handle attachment downloads with organization"""
     
-    def __init__(self, base_dir: str, organize_by: str = "sender"):
-        """Initialize downloader with base directory and organization strategy"""
-        self.base_dir = Path(base_dir)
-        self.organize_by = organize_by  # sender, date, flat
-        self.base_dir.mkdir(parents=True, exist_ok=True)
+    def __init__(self,
+                 base_dir: str,
+                 organize_by: str = "sender",
+                 storage: Optional[Storage] = None,
+                 max_path_depth: int = 0,
+                 max_path_length: int = 0,
+                 subject_cleanup_patterns: Optional[List[str]] = None,
+                 sender_aliases: Optional[Dict[str, str]] = None,
+                 file_metadata: str = "none",
+                 filename_unicode: str = "keep",
+                 verify_writes: str = "none",
+                 write_attempts: int = 1,
+                 type_groups: Optional[Dict[str, List[str]]] = None,
+                 sender_key: str = "local",
+                 date_format: str = "day",
+                 timezone: str = "UTC",
+                 encryptor: Optional[Encryptor] = None):
+        """
+        Initialize downloader with base directory and organization strategy.
+        
+        base_dir may also be a remote URL such as s3://bucket/prefix; the
+        matching storage backend is created unless one is passed in.
+        max_path_depth limits how many folders deep files are saved (0 = no
+        limit, see limit_path_depth), max_path_length the length of the full
+        path (0 = no limit, see fit_path_length). subject_cleanup_patterns
+        override the regexes used to turn subjects into folder names (see
+        clean_subject).
+        sender_aliases map sender addresses to shared folder names, and
+        sender_key names the other sender folders (see sender_folder).
+        file_metadata is "none", "sidecar" or "xattr" (see write_metadata).
+        filename_unicode is "keep" or "ascii" (see utils.sanitize_filename).
+        verify_writes is "none", "size" or "hash" (see write_file).
+        type_groups add folders for the "type" layout (see utils.type_folder).
+        date_format and timezone shape date folders (see
+        utils.format_date_folder).
+        encryptor encrypts every file before it is written and adds its
+        suffix to file names (see encryption.Encryptor).
+        """
+        self.storage = storage or open_storage(str(base_dir))
+        # sender, date, sender_date, subject, sender_subject, thread, type, flat
+        self.organize_by = organize_by
+        self.max_path_depth = max_path_depth
+        self.max_path_length = max_path_length
+        self.subject_cleanup_patterns = subject_cleanup_patterns
+        self.sender_aliases = sender_aliases or {}
+        self.file_metadata = file_metadata
+        self.filename_unicode = filename_unicode
+        self.verify_writes = verify_writes
+        self.write_attempts = max(1, write_attempts)
+        self.type_groups = type_groups or {}
+        self.sender_key = sender_key
+        self.date_format = date_format
+        self.timezone = timezone
+        self.encryptor = encryptor
+        
+        # Storage key -> how its last write was verified ("size", "md5", "")
+        self.verified: Dict[str, str] = {}
+        
+        # Only meaningful for local storage
+        self.base_dir = None if self.storage.is_remote else Path(base_dir)
+        
+        # Keys claimed by this process (see reserve_path)
+        self._reserved: Set[str] = set()
+        self._reserve_lock = asyncio.Lock()
+    
+    @classmethod
+    def from_config(cls, config: AppConfig) -> "AttachmentDownloader":
+        """Create the downloader for the configured destination and storage"""
+        return cls(
+            config.download.base_dir,
+            config.download.organize_by,
+            storage=open_storage(config.download.base_dir, config.storage),
+            max_path_depth=config.download.max_path_depth,
+            max_path_length=config.download.max_path_length,
+            filename_unicode=config.download.filename_unicode,
+            subject_cleanup_patterns=config.download.subject_cleanup_patterns,
+            sender_aliases=config.senders.aliases,
+            file_metadata=config.download.file_metadata,
+            verify_writes=config.download.verify_writes,
+            write_attempts=config.download.write_attempts,
+            type_groups=config.download.type_groups,
+            sender_key=config.download.sender_key,
+            date_format=config.download.date_format,
+            timezone=config.download.timezone,
+            encryptor=open_encryptor(config.download),
+        )
     
     async def download_attachment(self, 
                                 attachment_data: bytes,
                                 filename: str,
                                 sender: str,
-                                date: datetime) -> Path:
+                                date: datetime,
+                                subject: str = "",
+                                sender_name: str = "") -> Location:
         """Download and save attachment to organized folder"""
         
         # Get organized path
-        download_path = self.get_download_path(filename, sender, date)
-        download_path.parent.mkdir(parents=True, exist_ok=True)
+        download_path = self.get_download_path(
+            filename, sender, date, subject, sender_name
+        )
         
-        # TODO: Implement async file writing
-        print(f"💾 Downloading to: {download_path}")
-        
-        # async with aiofiles.open(download_path, 'wb') as f:
-        #     await f.write(attachment_data)
+        logger.info(f"Downloading to: {download_path}")
+        await self.write_file(download_path, attachment_data)
         
         return download_path
     
-    def get_download_path(self, filename: str, sender: str, date: datetime) -> Path:
+    async def write_file(self, path: Location, data: bytes) -> str:
+        """
+        Write attachment bytes to path through the storage backend
+        
+        With verify_writes, the stored file is checked afterwards (see
+        Storage.verify; remote backends check their uploads themselves) and
+        written again on a mismatch, so a truncated write never counts as a
+        download.
+        Returns how the file was verified ("size", "md5" or "").
+        With an encryptor, data is encrypted first and the encrypted file
+        is what gets verified.
+        
+        Raises:
+            VerificationError: If no attempt could be verified
+        """
+        if self.encryptor is not None:
+            data = await self.encryptor.encrypt(data)
+        key = self.storage.key_for(path)
+        for attempt in range(1, self.write_attempts + 1):
+            verified = await self.storage.write_verified(key, data)
+            if not verified and self.verify_writes != "none":
+                verified = await asyncio.to_thread(
+                    self.storage.verify, key, data, self.verify_writes
+                )
+            if verified is not None:
+                self.verified[key] = verified
+                return verified
+            logger.warning(
+                f"{path} does not match the downloaded data after writing "
+                f"(attempt {attempt}/{self.write_attempts})"
+            )
+        
+        raise VerificationError(
+            f"{path} could not be verified after {self.write_attempts} attempts"
+        )
+    
+    async def reserve_path(self, path: Location) -> Location:
+        """
+        Claim path for a new file, or the first free numbered variant
+        
+        Checking that a name is free and then writing it would let two
+        downloads (or two processes) that want report.pdf both pick it and
+        overwrite each other. Claims are atomic instead: an in-process
+        registry under a lock, plus an O_EXCL placeholder file for local
+        storage (see Storage.claim), so the loser moves on to report_1.pdf.
+        """
+        async with self._reserve_lock:
+            for key in numbered_variants(self.storage.key_for(path)):
+                if key in self._reserved:
+                    continue
+                if await asyncio.to_thread(self.storage.claim, key):
+                    self._reserved.add(key)
+                    return self.storage.locate(key)
+    
+    def versioned_path(self, path: Location, date: datetime) -> Location:
+        """path with the email date before the extension, in the folders' time zone"""
+        if date.tzinfo is not None:
+            date = date.astimezone(get_timezone(self.timezone))
+        key = versioned_key(
+            self.storage.key_for(path), date.strftime(VERSION_DATE_FORMAT)
+        )
+        return self.storage.locate(key)
+    
+    async def save_new(self, path: Location, data: bytes) -> Location:
+        """
+        Write a new file at path without ever replacing another file
+        
+        Returns where the data was saved: path itself, or a numbered
+        variant when path was taken in the meantime.
+        """
+        reserved = await self.reserve_path(path)
+        if reserved != path:
+            logger.info(f"{path} is taken; saving as {reserved}")
+        
+        key = self.storage.key_for(reserved)
+        try:
+            await self.write_file(reserved, data)
+        except BaseException:
+            # Do not leave an empty placeholder behind, even when cancelled
+            self.storage.release(key)
+            raise
+        finally:
+            # Written or released, the storage itself now answers for the key;
+            # keeping it would grow the registry for as long as watch runs
+            self._reserved.discard(key)
+        return reserved
+    
+    async def write_metadata(self, path: Location, entry: ManifestEntry) -> None:
+        """
+        Store the file's provenance next to it, so it travels with copies
+        
+        Extended attributes fall back to a .meta.json sidecar when the
+        filesystem does not support them.
+        """
+        if self.file_metadata == "none":
+            return
+        
+        metadata = file_metadata(entry)
+        
+        if self.file_metadata == "xattr":
+            try:
+                set_xattrs(path, metadata)
+                return
+            except (AttributeError, OSError) as e:
+                logger.warning(
+                    f"Extended attributes unavailable ({e}); "
+                    "writing .meta.json sidecars instead"
+                )
+                self.file_metadata = "sidecar"
+        
+        key = self.storage.key_for(path) + SIDECAR_SUFFIX
+        await self.storage.write(key, json.dumps(metadata, indent=2).encode("utf-8"))
+    
+    def get_download_path(self,
+                          filename: str,
+                          sender: str,
+                          date: datetime,
+                          subject: str = "",
+                          sender_name: str = "",
+                          thread_id: str = "") -> Location:
         """Generate organized download path based on strategy"""
+        return self.storage.locate(
+            self.get_storage_key(
+                filename, sender, date, subject, sender_name, thread_id
+            )
+        )
+    
+    def get_storage_key(self,
+                        filename: str,
+                        sender: str,
+                        date: datetime,
+                        subject: str = "",
+                        sender_name: str = "",
+                        thread_id: str = "") -> str:
+        """Generate the organized path relative to the download location"""
         
         # Sanitize filename
         safe_filename = self.sanitize_filename(filename)
+        if self.encryptor is not None:
+            safe_filename += self.encryptor.suffix
+        
+        folders = limit_path_depth(
+            self.get_folders(sender, date, subject, filename, sender_name, thread_id),
+            self.max_path_depth,
+        )
+        
+        if self.max_path_length:
+            # The download folder itself counts towards the limit
+            base = str(self.storage.locate(""))
+            if not self.storage.is_remote:
+                base = os.path.abspath(base)
+            folders, safe_filename = fit_path_length(
+                folders,
+                safe_filename,
+                self.max_path_length - len(base.rstrip("/\\")) - 1,
+            )
+        
+        return "/".join(folders + [safe_filename])
+    
+    def get_folders(self,
+                    sender: str,
+                    date: datetime,
+                    subject: str = "",
+                    filename: str = "",
+                    sender_name: str = "",
+                    thread_id: str = "") -> List[str]:
+        """
+        Folder names between the download location and the file
+        
+        For organize_by "thread", subject is that of the thread's first
+        message (see DownloadService.thread_subject).
+        """
+        safe_sender = self.sanitize_filename(self.sender_folder(sender, sender_name))
+        date_folders = [
+            self.sanitize_filename(folder)
+            for folder in format_date_folder(date, self.date_format, self.timezone)
+        ]
+        
+        if self.organize_by in ("subject", "sender_subject"):
+            # Recurring threads should share a folder, so strip Re:, dates, etc.
+            subject_folder = truncate_string(
+                self.sanitize_filename(
+                    clean_subject(subject, self.subject_cleanup_patterns)
+                ),
+                80,
+                suffix="",
+            )
+            if self.organize_by == "subject":
+                return [subject_folder]
+            return [safe_sender, subject_folder]
+        
+        if self.organize_by == "thread":
+            return [self.thread_folder(subject, thread_id)]
         
         if self.organize_by == "sender":
-            safe_sender = self.sanitize_filename(sender.split("@")[0])
-            return self.base_dir / safe_sender / safe_filename
+            return [safe_sender]
         
         elif self.organize_by == "date":
-            date_folder = date.strftime("%Y-%m-%d")
-            return self.base_dir / date_folder / safe_filename
+            return date_folders
+        
+        elif self.organize_by == "sender_date":
+            return [safe_sender] + date_folders
+        
+        elif self.organize_by == "type":
+            return [self.sanitize_filename(type_folder(filename, self.type_groups))]
         
         elif self.organize_by == "flat":
-            return self.base_dir / safe_filename
+            return []
         
         else:
             # Default to sender organization
-            safe_sender = self.sanitize_filename(sender.split("@")[0])
-            return self.base_dir / safe_sender / safe_filename
+            return [safe_sender]
+    
+    def thread_folder(self, subject: str, thread_id: str) -> str:
+        """
+        Folder name for a conversation, e.g. "Model review_1a2b3c4d"
+        
+        The cleaned-up subject keeps it readable, the end of the thread ID
+        keeps conversations with the same subject apart.
+        """
+        name = truncate_string(
+            self.sanitize_filename(
+                clean_subject(subject, self.subject_cleanup_patterns)
+            ),
+            80,
+            suffix="",
+        )
+        short_id = (
+            self.sanitize_filename(thread_id[-THREAD_ID_LENGTH:]) if thread_id else ""
+        )
+        return f"{name}_{short_id}" if short_id else name
+    
+    def sender_folder(self, sender: str, sender_name: str = "") -> str:
+        """
+        Folder name for a sender: its alias, or what sender_key picks
+        
+        "local" is the address's local part, "address" the whole address,
+        "name" the display name (the local part when there is none) and
+        "domain" the part after the @.
+        """
+        alias = resolve_sender_alias(sender, self.sender_aliases)
+        if alias:
+            return alias
+        
+        local, _, domain = sender.partition("@")
+        if self.sender_key == "address":
+            return sender
+        if self.sender_key == "name" and sender_name:
+            return sender_name
+        if self.sender_key == "domain" and domain:
+            return domain.lower()
+        return local
     
     def sanitize_filename(self, filename: str) -> str:
         """Sanitize filename for safe file system operations"""
-        # TODO: Implement proper filename sanitization
-        # Remove or replace unsafe characters
-        unsafe_chars = '<>:"/\|?*'
-        for char in unsafe_chars:
-            filename = filename.replace(char, '_')
-        return filename.strip()
+        return sanitize_filename(filename, self.filename_unicode)
     
     def is_valid_attachment(self, 
                           filename: str, 
@@ -85,33 +810,1851 @@ class AttachmentDownloader:
             return False
         
         return True
+    
+    def compare_with_existing(self,
+                              path: Location,
+                              expected_size: int,
+                              manifest_entry: Optional[ManifestEntry] = None) -> str:
+        """
+        Work out what a sync would do with a planned download.
+        
+        The manifest is the most reliable source: if it says we already saved
+        this exact attachment to this path and the file on disk still has the
+        recorded size, nothing needs to happen. Without a manifest entry we
+        fall back to comparing the on-disk size with the size Gmail reports.
+        
+        A file that was quarantined counts as present, so it is not
+        downloaded (and flagged) again on every run; so do one the
+        retention policy removed (a tombstone, see DownloadManifest) and
+        one left out after downloading it (ManifestEntry.skipped).
+        
+        Returns:
+            STATUS_NEW, STATUS_UPDATED or STATUS_EXISTS
+        """
+        if manifest_entry is not None and (
+            manifest_entry.quarantine or not manifest_entry.listed
+        ):
+            return STATUS_EXISTS
+        
+        key = self.storage.key_for(path)
+        stored_size = self.storage.size(key)
+        if stored_size is None:
+            return STATUS_NEW
+        
+        if manifest_entry is not None:
+            if manifest_entry.path != key:
+                return STATUS_UPDATED
+            # An encrypted file's size says nothing about the attachment's:
+            # compare what Gmail declares with what was saved instead
+            if manifest_entry.encrypted:
+                unchanged = not expected_size or expected_size == manifest_entry.size
+            else:
+                unchanged = stored_size == manifest_entry.size
+            return STATUS_EXISTS if unchanged else STATUS_UPDATED
+        
+        return STATUS_EXISTS if stored_size == expected_size else STATUS_UPDATED
 
 
-class EmailWatcher:
-    """Watch for new emails in real-time"""
+class BandwidthLimiter:
+    """
+    Caps the combined throughput of all downloads sharing this limiter.
+    
+    Gmail hands us each attachment in one response, so instead of slowing
+    a stream we space the requests out: every download reserves the time
+    its bytes take at the allowed rate, and waits until the reservations
+    before it have passed. Over any stretch of time the average stays at
+    or below the limit, however many workers are downloading.
+    """
+    
+    def __init__(self,
+                 bytes_per_second: int,
+                 clock: Callable[[], float] = time.monotonic,
+                 sleep: Callable[[float], Awaitable[Any]] = asyncio.sleep):
+        """Create a limiter; clock and sleep can be replaced in tests"""
+        self.bytes_per_second = bytes_per_second
+        self.clock = clock
+        self.sleep = sleep
+        self._next_free = clock()
+    
+    async def acquire(self, nbytes: int) -> None:
+        """Wait until nbytes may be transferred without exceeding the rate"""
+        now = self.clock()
+        start = max(now, self._next_free)
+        
+        # Reserve the slot before sleeping, so concurrent callers queue up
+        self._next_free = start + nbytes / self.bytes_per_second
+        
+        if start > now:
+            await self.sleep(start - now)
+
+
+class DownloadService:
+    """
+    Ties the Gmail client, downloader and manifest together.
+    
+    Planning and executing are separate steps so that dry-run can show the
+    exact same plan a real run would carry out.
+    """
     
-    def __init__(self, gmail_client, downloader: AttachmentDownloader):
-        """Initialize email watcher"""
+    def __init__(self,
+                 gmail_client: "GmailAPI",
+                 downloader: AttachmentDownloader,
+                 manifest: DownloadManifest,
+                 config: AppConfig):
+        """Initialize the service with its collaborators"""
         self.gmail_client = gmail_client
         self.downloader = downloader
+        self.manifest = manifest
+        self.config = config
+        
+        # Progress of searches and downloads, for any number of consumers
+        # (see events.py)
+        self.events = EventBus()
+        
+        # Async callbacks run after each attachment is saved, before the
+        # next one is downloaded
+        self.download_listeners: List[
+            Callable[[ManifestEntry, Location], Awaitable[Any]]
+        ] = []
+        
+        # Chooses "skip", "overwrite", "rename" or "version" for a conflict under
+        # conflict_policy "ask"; None when there is nobody to ask
+        self.ask_conflict: Optional[Callable[[PlannedDownload], Awaitable[str]]] = None
+        
+        # Entries whose downloaded size differed from the declared size in
+        # this session, for the end-of-run summary
+        self.size_anomalies: List[ManifestEntry] = []
+        
+        # What the last execute left out because download.max_total_size or
+        # max_files was reached, and which limit that was ("" = none)
+        self.budget_skipped: List[PlannedDownload] = []
+        self.budget_reason = ""
+        
+        # Checks files before they are saved (scan.scanner); entries of
+        # files it flagged in this session, for the end-of-run summary
+        self.scanner = open_scanner(config.scan)
+        self.quarantined: List[ManifestEntry] = []
+        
+        # Removes passwords from protected attachments (passwords); entries
+        # of files that stayed locked in this session
+        self.unlocker = open_unlocker(config.passwords)
+        self.locked: List[ManifestEntry] = []
+        
+        # Header rows of CSV feeds (schema.enabled), read on first use;
+        # changes found in this session, for the end-of-run summary
+        self.schemas: Optional[SchemaHistory] = None
+        self.schema_changes: List[SchemaChange] = []
+        
+        # Webhook posts about them (schema.notify), sent while the
+        # downloads go on and awaited at the end of the run
+        self.notifications: Set[asyncio.Task] = set()
+        
+        # Subject naming each thread's folder (organize_by "thread")
+        self.thread_subjects: Dict[str, str] = {}
+        
+        # Journal of large Drive files downloaded in ranges, and of large
+        # attachments whose attempt failed (download.enable_resume), read
+        # on first use
+        self.partial: Optional[PartialDownloads] = None
+        
+        # What the last execute could not download, with the errors, and
+        # how many bytes it saved
+        self.failed: List[FailedDownload] = []
+        self.saved_bytes = 0
+        
+        # Files and bytes earlier executes of the same run saved, counted
+        # against the budget too (a backfill sets them between slices)
+        self.spent_files = 0
+        self.spent_bytes = 0
+        
+        # Reads files linked in message bodies (download.drive_links) and
+        # exports Google-native references (conversions)
+        self.drive: Optional[DriveClient] = None
+        if config.download.drive_links or config.conversions:
+            export_formats = {
+                **config.download.drive_export_formats, **config.conversions
+            }
+            self.drive = DriveClient(gmail_client, export_formats, config.network)
+        
+        # Derives other formats from each saved file (transforms)
+        self.transforms: Optional[Transforms] = None
+        if config.transforms.enabled() and not config.download.is_remote():
+            self.transforms = open_transforms(
+                config.transforms, config.download.base_dir
+            )
+        if self.transforms:
+            self.download_listeners.append(self.transforms.apply)
+        
+        # Adds the files each run saved to DVC (integrations.dvc)
+        self.dvc: Optional[DvcTracker] = None
+        if config.integrations.dvc.enabled and not config.download.is_remote():
+            self.dvc = open_dvc(config.integrations.dvc, config.download.base_dir)
+        if self.dvc:
+            self.download_listeners.append(self.dvc.queue)
+        
+        # Commits the files each run saved (integrations.git), after DVC has
+        # added them
+        self.git: Optional[GitCommitter] = None
+        if config.integrations.git.enabled and not config.download.is_remote():
+            self.git = open_git(config.integrations.git, config.download.base_dir)
+        if self.git:
+            self.download_listeners.append(self.git.queue)
+        
+        # Shared by every download this service makes (download.max_bandwidth)
+        rate = (
+            parse_bandwidth(config.download.max_bandwidth)
+            if config.download.max_bandwidth
+            else None
+        )
+        self.bandwidth = BandwidthLimiter(rate) if rate else None
+    
+    @property
+    def junk(self) -> Optional[JunkFilter]:
+        """The junk attachment filter, if the config turns it on"""
+        return JunkFilter(self.config.junk) if self.config.junk.enabled else None
+    
+    def build_query(self) -> str:
+        """
+        Build the Gmail search query from the configured filters.
+        
+        A raw query from the config (--query) is used as is instead.
+        """
+        return self._build_query(
+            self.config.filters.senders, self.config.filters.labels
+        )
+    
+    def build_queries(self, max_length: int = MAX_QUERY_LENGTH) -> List[str]:
+        """
+        The search as queries of at most max_length characters.
+        
+        Senders and labels are alternatives (OR), so a query too long for
+        Gmail is split into queries for halves of the longer list until
+        each fits. Together they find the same messages as the single
+        query would. A raw query (--query) is never split.
+        """
+        filters = self.config.filters
+        if filters.query:
+            return [filters.query]
+        
+        def split(senders: List[str], labels: List[str]) -> List[str]:
+            query = self._build_query(senders, labels)
+            if len(query) <= max_length:
+                return [query]
+            if len(senders) > 1 and len(senders) >= len(labels):
+                middle = len(senders) // 2
+                return split(senders[:middle], labels) + split(senders[middle:], labels)
+            if len(labels) > 1:
+                middle = len(labels) // 2
+                return split(senders, labels[:middle]) + split(senders, labels[middle:])
+            return [query]  # Nothing left to split; let Gmail judge it
+        
+        queries = split(list(filters.senders), list(filters.labels))
+        if len(queries) > 1:
+            logger.info(
+                f"Search split into {len(queries)} queries "
+                f"to stay under {max_length} characters"
+            )
+        return queries
+    
+    def _build_query(self, senders: List[str], labels: List[str]) -> str:
+        filters = self.config.filters
+        if filters.query:
+            return filters.query
+        
+        # References to Google files are attachments too, only named .gsheet
+        # and the like until converted, and too small for larger:; the
+        # converted file's extension and size are checked per file
+        extensions, min_size = filters.extensions, filters.min_size
+        if self.config.conversions:
+            if extensions:
+                extensions = list(extensions) + list(NATIVE_STUB_EXTENSIONS)
+            min_size = None
+        
+        return self.gmail_client.build_search_query(
+            senders=senders,
+            labels=labels,
+            search_scope=filters.search_scope,
+            include_spam_trash=filters.include_spam_trash,
+            after_date=filters.after_date,
+            before_date=filters.before_date,
+            has_attachment=filters.has_attachment,
+            subject_keywords=filters.subject_keywords,
+            exclude_keywords=filters.subject_exclude_keywords,
+            extensions=extensions,
+            min_size=min_size,
+            drive_links=self.config.download.drive_links,
+            date_timezone=self.config.download.timezone,
+        )
+    
+    async def throttle(self, nbytes: int) -> None:
+        """Wait for bandwidth before downloading nbytes, if a limit is set"""
+        if self.bandwidth:
+            await self.bandwidth.acquire(nbytes)
+    
+    async def plan(self,
+                   max_results: Optional[int] = None,
+                   query: Optional[str] = None,
+                   include_spam_trash: bool = False,
+                   queries: Optional[List[str]] = None) -> List[PlannedDownload]:
+        """
+        Search Gmail and decide where each matching attachment would go.
+        
+        The search defaults to the queries built from the configured
+        filters (see build_queries). Spam and Trash are searched if
+        include_spam_trash or filters.include_spam_trash says so.
+        
+        Messages come newest first, like a single Gmail search, also when
+        several queries were merged; max_results then keeps the newest
+        messages with matching attachments.
+        """
+        queries = queries or ([query] if query else self.build_queries())
+        message_ids = await self.search(
+            queries,
+            max_results=max_results,
+            include_spam_trash=include_spam_trash
+            or self.config.filters.include_spam_trash,
+        )
+        
+        planned = []
+        for message_id in message_ids:
+            planned.extend(await self.plan_message(message_id))
+        
+        if len(queries) > 1:
+            # Merged results are in query order; sorting is stable, so
+            # each message's attachments stay together and in order
+            planned.sort(key=lambda item: item.message.date, reverse=True)
+            if max_results:
+                newest = set(
+                    list(
+                        dict.fromkeys(item.message.message_id for item in planned)
+                    )[:max_results]
+                )
+                planned = [
+                    item for item in planned if item.message.message_id in newest
+                ]
+        
+        return self.finish_plan(planned)
+    
+    async def search(self,
+                     queries: List[str],
+                     max_results: Optional[int] = None,
+                     include_spam_trash: bool = False) -> List[str]:
+        """
+        Message IDs matching any of the queries, run concurrently.
+        
+        Results are merged in query order with duplicates dropped, so a
+        message matched by several queries is planned once; plan sorts
+        them by date. With several queries max_results applies to each.
+        """
+        await self.events.publish(SearchStarted(list(queries)))
+        
+        async def run(query: str) -> List[str]:
+            return [
+                message_id
+                async for message_id in self.gmail_client.search_messages(
+                    query,
+                    max_results=max_results,
+                    include_spam_trash=include_spam_trash,
+                )
+            ]
+        
+        results = await asyncio.gather(*(run(query) for query in queries))
+        message_ids = list(
+            dict.fromkeys(message_id for found in results for message_id in found)
+        )
+        return (
+            message_ids[:max_results]
+            if max_results and len(queries) == 1
+            else message_ids
+        )
+    
+    async def plan_messages(self, message_ids: List[str]) -> List[PlannedDownload]:
+        """
+        Decide where the matching attachments of known messages would go.
+        
+        Like plan(), but for messages named directly (download --message-id)
+        instead of found by a search. Extension and size limits still apply.
+        """
+        planned = []
+        for message_id in dict.fromkeys(message_ids):
+            planned.extend(await self.plan_message(message_id))
+        return self.finish_plan(planned)
+    
+    def finish_plan(self, planned: List[PlannedDownload]) -> List[PlannedDownload]:
+        """Apply the filters that look across messages"""
+        if self.config.filters.latest_per_thread:
+            latest = latest_per_thread(planned)
+            if len(latest) < len(planned):
+                logger.info(
+                    f"Skipping {len(planned) - len(latest)} older attachment(s) "
+                    "re-sent later in their thread"
+                )
+            planned = latest
+        
+        return planned
+    
+    async def backfill(self,
+                       window: timedelta,
+                       now: Optional[datetime] = None) -> List[Location]:
+        """
+        Download matching attachments from messages received within the window.
+        
+        Gmail's after: operator accepts a Unix timestamp, so the window is
+        exact to the second rather than rounded to whole days.
+        """
+        since = (now or datetime.now()) - window
+        queries = [
+            f"({query}) after:{int(since.timestamp())}"
+            for query in self.build_queries()
+        ]
+        
+        planned = await self.plan(queries=queries)
+        return await self.execute(planned)
+    
+    async def plan_message(self, message_id: str) -> List[PlannedDownload]:
+        """Decide where each matching attachment of one message would go"""
+        filters = self.config.filters
+        junk = self.junk
+        planned = []
+        
+        message = await self.gmail_client.get_message_details(message_id)
+        attachments = await self.gmail_client.get_message_attachments(message_id)
+        if attachments and self.downloader.organize_by == "thread":
+            await self.load_thread_subject(message)
+        if self.drive and self.config.conversions:
+            attachments = await self.convert_native_references(message_id, attachments)
+        if self.drive and self.config.download.drive_links:
+            known = {attachment.attachment_id for attachment in attachments}
+            attachments = attachments + [
+                linked for linked in await self.linked_drive_files(message_id)
+                if linked.attachment_id not in known
+            ]
+        filenames = disambiguate_filenames(
+            attachments, self.downloader.filename_unicode
+        )
+        
+        for attachment, filename in zip(attachments, filenames):
+            # Exported Google Docs have no size until they are exported
+            size = attachment.size
+            if not size and drive_file_id(attachment.attachment_id):
+                size = filters.min_size
+            
+            if not self.downloader.is_valid_attachment(
+                attachment.filename,
+                size,
+                filters.extensions,
+                filters.min_size,
+                filters.max_size,
+            ):
+                continue
+            
+            if not matches_filename_pattern(
+                attachment.filename, filters.filename_patterns
+            ):
+                logger.debug(
+                    f"Skipping {attachment.filename}: matches no filename pattern"
+                )
+                continue
+            
+            if filters.skip_inline_images and attachment.is_inline_image:
+                logger.debug(f"Skipping inline image {attachment.filename}")
+                continue
+            
+            reason = junk.reason(attachment) if junk else None
+            if reason:
+                logger.debug(
+                    f"Skipping junk attachment {attachment.filename}: {reason}"
+                )
+                continue
+            
+            path = self.message_path(filename, message)
+            entry = self.manifest.get(message_id, filename)
+            
+            # Saved under the extension its contents called for
+            if entry and entry.detected and self.config.download.fix_extensions:
+                path = self.message_path(
+                    fixed_filename(
+                        filename, entry.detected, self.config.download.fix_extensions
+                    ),
+                    message,
+                )
+            
+            # Saved under a numbered or dated name because another file had
+            # the name first: keep comparing against where it actually went
+            if (
+                entry
+                and is_numbered_variant(
+                    entry.path, self.downloader.storage.key_for(path)
+                )
+            ):
+                path = self.downloader.storage.locate(entry.path)
+            
+            status = self.downloader.compare_with_existing(path, attachment.size, entry)
+            planned.append(
+                PlannedDownload(message, attachment, path, status, filename)
+            )
+            if filters.max_per_message and len(planned) >= filters.max_per_message:
+                break
+        
+        return planned
+    
+    async def linked_drive_files(self, message_id: str) -> List["EmailAttachment"]:
+        """
+        Drive files linked in a message's body, as attachments of the message
+        
+        Links that cannot be read (not shared with this account, deleted)
+        are logged and skipped, like a filtered-out attachment.
+        """
+        bodies = await self.gmail_client.get_message_bodies(message_id)
+        file_ids = find_drive_links(
+            bodies.get("text", "") + "\n" + bodies.get("html", "")
+        )
+        
+        attachments = []
+        for file_id in file_ids:
+            try:
+                drive_file = await self.drive.get_file(file_id)
+            except DriveError as e:
+                logger.warning(f"Skipping Drive link in {message_id}: {e}")
+                continue
+            if drive_file:
+                attachments.append(drive_file.to_attachment(message_id))
+        return attachments
+    
+    async def convert_native_references(
+        self, message_id: str, attachments: List["EmailAttachment"]
+    ) -> List["EmailAttachment"]:
+        """
+        Swap attachments that only reference a Google Doc/Sheet/Slides file
+        for the file itself, exported as set in conversions
+        
+        References that cannot be resolved are kept as they are.
+        """
+        converted = []
+        for attachment in attachments:
+            drive_file = None
+            if (
+                attachment.attachment_id
+                and is_native_reference(attachment.filename, attachment.mime_type)
+            ):
+                try:
+                    stub = await self.gmail_client.download_attachment(
+                        message_id, attachment.attachment_id
+                    )
+                    file_id = stub_file_id(stub)
+                    drive_file = await self.drive.get_file(file_id) if file_id else None
+                except DriveError as e:
+                    logger.warning(
+                        f"Keeping {attachment.filename} "
+                        f"in {message_id} unconverted: {e}"
+                    )
+            
+            if drive_file:
+                logger.debug(
+                    f"Converting {attachment.filename} to {drive_file.filename}"
+                )
+                converted.append(drive_file.to_attachment(message_id))
+            else:
+                converted.append(attachment)
+        return converted
+    
+    async def fetch(
+        self,
+        message_id: str,
+        attachment_id: str,
+        on_progress: Optional[Callable[[int], Awaitable[Any]]] = None,
+    ) -> bytes:
+        """
+        Download an attachment, or the Drive file it stands for
+        
+        An attachment kept by a failed earlier attempt (see keep_partial)
+        is taken from the resume journal instead. on_progress is called
+        with the bytes so far after each range of a Drive file downloaded
+        in ranges; Gmail attachments arrive in one piece.
+        """
+        file_id = drive_file_id(attachment_id)
+        if file_id is not None and self.drive is None:
+            raise DriveError(f"Drive file {file_id} needs download.drive_links enabled")
+        partial = self.partial_downloads()
+        key = partial_key(message_id, attachment_id)
+        if file_id is None:
+            kept = partial.completed(key) if partial else None
+            if kept is not None:
+                logger.info(
+                    f"Resuming {attachment_id} of {message_id} from the bytes an "
+                    "earlier attempt downloaded"
+                )
+                return kept
+            download = self.gmail_client.download_attachment(message_id, attachment_id)
+        else:
+            download = self.drive.download(
+                file_id,
+                partial,
+                self.config.download.resume_chunk_size,
+                key,
+                on_progress=on_progress,
+            )
+        # A stuck download times out on its connection
+        # (network.attachment_timeout_seconds) and fails alone
+        return await download
+    
+    def keep_partial(self, item: PlannedDownload, data: bytes) -> None:
+        """
+        Keep a large Gmail attachment whose attempt failed after it was
+        downloaded, so the next attempt does not download it again
+        """
+        partial = self.partial_downloads()
+        attachment_id = item.attachment.attachment_id
+        if (
+            partial is None
+            or drive_file_id(attachment_id)
+            or len(data) <= self.config.download.resume_chunk_size
+        ):
+            return
+        try:
+            partial.keep(partial_key(item.message.message_id, attachment_id), data)
+        except ManifestError as e:
+            logger.warning(f"Cannot keep {item.filename} for the next attempt: {e}")
+    
+    def partial_downloads(self) -> Optional[PartialDownloads]:
+        """The journal of resumable downloads; None without download.enable_resume"""
+        if not self.config.download.enable_resume:
+            return None
+        if self.partial is None:
+            try:
+                self.partial = PartialDownloads(
+                    self.manifest.base_dir, self.config.download.temp_suffix
+                ).load()
+            except ManifestError as e:
+                logger.warning(f"Starting large downloads over: {e}")
+                self.partial = PartialDownloads(
+                    self.manifest.base_dir, self.config.download.temp_suffix
+                )
+        return self.partial
+    
+    async def execute(self, planned: List[PlannedDownload]) -> List[Location]:
+        """
+        Download everything in the plan that is not already present.
+        
+        Where a different file is already in the way, download.conflict_policy
+        decides (see resolve_conflict). Message bodies are saved once per
+        message that had at least one attachment downloaded.
+        
+        The run stops before a file that would go over the budget
+        (download.max_total_size, max_files) or leave less than
+        download.min_free_space on the disk, and when the disk is full
+        after all; budget_skipped then holds the rest of the plan. An
+        attachment that cannot be downloaded or saved is logged and added
+        to failed, and the run goes on; only authentication and quota
+        errors end it.
+        
+        When it went through, the messages get their post_actions labels
+        (see label_messages). Then the saved files go to DVC and git (see
+        flush_integrations), and RunDone is published.
+        """
+        saved: List[Location] = []
+        saved_messages: Set[str] = set()
+        self.failed = []
+        self.saved_bytes = 0
+        try:
+            await self._execute(planned, saved, saved_messages)
+            await self.label_messages(saved_messages)
+        finally:
+            # Whatever ended the run, the files it saved stay recorded
+            self.manifest.save()
+            self.save_schemas()
+            await self.flush_integrations()
+            await self.send_notifications()
+            await self.events.publish(
+                RunDone(len(saved), len(self.failed), self.saved_bytes)
+            )
+        return saved
+    
+    async def label_messages(self, saved_messages: Set[str]) -> None:
+        """
+        Add the post_actions labels to the messages of the last execute:
+        label_failed to those with an attachment in failed, label_saved to
+        the others that had files saved. Each loses the other outcome's
+        labels, left from an earlier run. Missing labels are created. A
+        label that cannot be added is logged; the files stay saved.
+        """
+        actions = self.config.post_actions
+        failed = {failure.item.message.message_id for failure in self.failed}
+        outcomes = [
+            (message_id, actions.label_failed, actions.label_saved)
+            for message_id in sorted(failed)
+        ]
+        outcomes += [
+            (message_id, actions.label_saved, actions.label_failed)
+            for message_id in sorted(saved_messages - failed)
+        ]
+        for message_id, labels, other in outcomes:
+            remove = [label for label in other if label not in labels]
+            if not labels and not remove:
+                continue
+            try:
+                await self.gmail_client.modify_labels(message_id, labels, remove)
+            except GmailError as e:
+                logger.error(
+                    f"Cannot label message {message_id} "
+                    f"{', '.join(labels or remove)}: {e}"
+                )
+    
+    async def _execute(self, planned: List[PlannedDownload], saved: List[Location],
+                       saved_messages: Set[str]) -> None:
+        policy = self.config.download.get_conflict_policy()
+        junk = self.junk
+        self.budget_skipped = []
+        self.budget_reason = ""
+        self.check_free_space(planned, policy)
+        
+        for index, item in enumerate(planned):
+            if item.status == STATUS_EXISTS:
+                continue
+            if item.status == STATUS_UPDATED and policy == "skip":
+                logger.warning(f"Skipping {item.path}: a different file already exists")
+                continue
+            
+            reason = self.over_budget(
+                self.spent_files + len(saved),
+                self.spent_bytes + self.saved_bytes,
+                item.attachment.size,
+            )
+            if reason:
+                self.stop(planned[index:], policy, reason)
+                break
+            
+            saved_file = False
+            fetched = None
+            try:
+                await self.events.publish(FileStarted(item))
+                await self.events.publish(FileProgress(item, 0, item.attachment.size))
+                
+                async def progress(done: int, item: PlannedDownload = item) -> None:
+                    await self.events.publish(
+                        FileProgress(item, done, max(item.attachment.size, done))
+                    )
+                
+                await self.throttle(item.attachment.size)
+                data = fetched = await self.fetch(
+                    item.message.message_id, item.attachment.attachment_id, progress
+                )
+                await progress(len(data))
+                data, anomaly = await self.check_declared_size(item, data)
+                
+                unsafe = unsafe_filename(item.attachment.filename)
+                if unsafe:
+                    entry = self.manifest_entry(item, item.path, data, anomaly)
+                    await self.quarantine(
+                        entry,
+                        data,
+                        REASON_UNSAFE_FILENAME,
+                        unsafe,
+                        item.attachment.filename,
+                    )
+                    continue
+                
+                if junk and junk.is_banner(item.attachment, data):
+                    logger.info(
+                        f"Not saving {item.filename}: banner-shaped image (junk filter)"
+                    )
+                    self.skip(
+                        self.manifest_entry(item, item.path, data, anomaly),
+                        SKIPPED_BANNER,
+                    )
+                    continue
+                
+                data, protection = await self.unlock(
+                    item.filename, data, item.message.sender, item.message.subject
+                )
+                
+                missing = self.missing_columns(item.filename, data)
+                if missing:
+                    logger.info(
+                        f"Not saving {item.filename}: no {', '.join(missing)} column "
+                        "(filters.required_columns)"
+                    )
+                    self.skip(
+                        self.manifest_entry(item, item.path, data, anomaly),
+                        SKIPPED_MISSING_COLUMNS,
+                    )
+                    continue
+                
+                verdict = await self.scan(item.filename, data)
+                if verdict is None:
+                    continue
+                if verdict not in ("", VERDICT_CLEAN):
+                    entry = self.manifest_entry(item, item.path, data, anomaly)
+                    entry.scan = verdict
+                    entry.protection = protection
+                    await self.quarantine(entry, data, REASON_MALWARE, verdict)
+                    continue
+                
+                detected = (
+                    detect_extension(item.filename, data)
+                    if self.config.download.fix_extensions
+                    else ""
+                )
+                if detected:
+                    item = self.with_detected_extension(item, detected)
+                    if item.status == STATUS_UPDATED and policy == "skip":
+                        logger.warning(
+                            f"Skipping {item.path}: a different file already exists"
+                        )
+                        continue
+                
+                if (
+                    item.status == STATUS_NEW
+                    and policy == "version"
+                    and not self.manifest.get(item.message.message_id, item.filename)
+                ):
+                    # Dated from the first copy on, so none is left undated
+                    path = await self.save_versioned(item, data)
+                    if path is None:
+                        continue
+                elif item.status == STATUS_NEW:
+                    path = await self.downloader.save_new(item.path, data)
+                else:
+                    path = await self.resolve_conflict(item, data, policy)
+                    if path is None:
+                        continue
+                
+                entry = self.manifest_entry(item, path, data, anomaly)
+                entry.scan = verdict
+                entry.protection = protection
+                entry.detected = detected
+                if protection == PROTECTION_LOCKED:
+                    self.locked.append(entry)
+                if anomaly:
+                    self.size_anomalies.append(entry)
+                await self.downloader.write_metadata(path, entry)
+                self.manifest.record(entry)
+                saved.append(path)
+                self.saved_bytes += len(data)
+                saved_file = True
+                await self.events.publish(FileDone(item, entry, path))
+                self.update_latest_link(item, entry, path)
+                await self.check_schema(entry, data)
+                
+                for listener in self.download_listeners:
+                    try:
+                        await listener(entry, path)
+                    except Exception as e:
+                        # An integration failing does not undo the download
+                        logger.error(
+                            f"Saved {item.filename}, but a "
+                            f"download listener failed: {e}"
+                        )
+                
+                if item.message.message_id not in saved_messages:
+                    saved_messages.add(item.message.message_id)
+                    await self.save_message_content(item.message)
+            except (GmailAuthenticationError, GmailQuotaExceededError):
+                raise
+            except (GmailError, StorageError, OSError) as e:
+                if saved_file:
+                    # The file is saved and recorded; it counts once, as saved
+                    logger.error(
+                        f"Saved {item.filename}, but what follows saving it failed: {e}"
+                    )
+                    continue
+                if isinstance(e, VerificationError):
+                    # Keep the downloaded data for review; the file stays
+                    # out of the manifest, so the next run tries it again
+                    entry = self.manifest_entry(item, item.path, data, anomaly)
+                    try:
+                        await self.hold(entry, data, REASON_VERIFY_FAILED, str(e))
+                    except OSError as hold_error:
+                        logger.error(f"Cannot quarantine {item.filename}: {hold_error}")
+                if isinstance(e, OSError) and e.errno == errno.ENOSPC:
+                    # Every file after this one would fail the same way
+                    logger.error(f"Cannot save {item.filename}: {e}")
+                    self.stop(planned[index:], policy, "a full disk")
+                    break
+                if fetched is not None:
+                    self.keep_partial(item, fetched)
+                # One attachment failing should not cost the rest of the run
+                logger.error(
+                    f"Failed to download {item.filename} from "
+                    f"{item.message.message_id}: {e}"
+                )
+                self.failed.append(FailedDownload(item, str(e)))
+                await self.events.publish(FileFailed(item, str(e)))
+    
+    def stop(self, rest: List[PlannedDownload], policy: str, reason: str) -> None:
+        """End the run at reason, keeping what it leaves out in budget_skipped"""
+        self.budget_reason = reason
+        self.budget_skipped = [
+            item
+            for item in rest
+            if item.status == STATUS_NEW or (
+                item.status == STATUS_UPDATED and policy != "skip"
+            )
+        ]
+        logger.warning(
+            f"Stopping at {reason}: {len(self.budget_skipped)} attachment(s) left out"
+        )
+    
+    def over_budget(self, files: int, total_bytes: int, next_size: int) -> str:
+        """
+        Which budget the next file would break after files saved so far
+        totalling total_bytes, e.g. "max_files 500"; "" when it fits
+        """
+        download = self.config.download
+        if download.max_files is not None and files >= download.max_files:
+            return f"max_files {download.max_files}"
+        if (
+            download.max_total_size is not None
+            and total_bytes + next_size > download.max_total_size
+        ):
+            return f"max_total_size {format_file_size(download.max_total_size)}"
+        free = self.free_space()
+        if free is not None and free - next_size < download.min_free_space:
+            return f"min_free_space {format_file_size(download.min_free_space)}"
+        return ""
+    
+    def free_space(self) -> Optional[int]:
+        """
+        Bytes free on the disk of the download directory; None for remote
+        storage, without download.min_free_space, or when it cannot be told
+        """
+        if (
+            self.config.download.min_free_space is None
+            or self.downloader.storage.is_remote
+        ):
+            return None
+        return free_disk_space(self.downloader.base_dir)
+    
+    def check_free_space(self, planned: List[PlannedDownload], policy: str) -> None:
+        """Warn before a run whose downloads will not fit above min_free_space"""
+        free = self.free_space()
+        if free is None:
+            return
+        needed = sum(
+            item.attachment.size
+            for item in planned
+            if item.status == STATUS_NEW or (
+                item.status == STATUS_UPDATED and policy != "skip"
+            )
+        )
+        available = max(free - self.config.download.min_free_space, 0)
+        if needed > available:
+            logger.warning(
+                f"{format_file_size(needed)} to download, but only "
+                f"{format_file_size(available)} "
+                "can be saved above min_free_space on "
+                f"{self.downloader.base_dir}; the run will stop early"
+            )
+    
+    def message_path(self, filename: str, message: "EmailMessage") -> Location:
+        """Where a file of message goes in the configured layout"""
+        subject = message.subject
+        if self.downloader.organize_by == "thread":
+            subject = self.thread_subject(message)
+        return self.downloader.get_download_path(
+            filename,
+            message.sender,
+            message.date,
+            subject,
+            message.sender_name,
+            message.thread_id,
+        )
+    
+    def thread_subject(self, message: "EmailMessage") -> str:
+        """
+        Subject naming the folder of message's thread, as looked up by
+        load_thread_subject; message's own until then
+        """
+        return self.thread_subjects.get(message.thread_id, message.subject)
+    
+    async def load_thread_subject(self, message: "EmailMessage") -> str:
+        """
+        Look up the subject of the first message of message's thread, so
+        every reply, whatever its subject says and whichever message of the
+        thread is downloaded first, lands in the same folder.
+        
+        Where the thread cannot be read, the earliest message of it in the
+        manifest stands in, then message itself.
+        """
+        thread_id = message.thread_id
+        if thread_id in self.thread_subjects:
+            return self.thread_subjects[thread_id]
+        
+        subject = None
+        try:
+            message_ids = await self.gmail_client.get_thread_message_ids(thread_id)
+            if message_ids and message_ids[0] == message.message_id:
+                subject = message.subject
+            elif message_ids:
+                subject = (
+                    await self.gmail_client.get_message_details(message_ids[0])
+                ).subject
+        except GmailError as e:
+            logger.warning(f"Cannot read the first message of thread {thread_id}: {e}")
+        if subject is None:
+            recorded = [
+                entry for entry in self.manifest if entry.thread_id == thread_id
+            ]
+            earliest = min(recorded, key=lambda entry: entry.date, default=None)
+            subject = earliest.subject if earliest else message.subject
+        self.thread_subjects[thread_id] = subject
+        return subject
+    
+    def with_detected_extension(
+        self, item: PlannedDownload, detected: str
+    ) -> PlannedDownload:
+        """
+        The planned download moved to a name with the detected extension
+        
+        The status is worked out again for the new destination; the
+        manifest still records the attachment under the name it was sent with.
+        """
+        message = item.message
+        filename = fixed_filename(
+            item.filename, detected, self.config.download.fix_extensions
+        )
+        path = self.message_path(filename, message)
+        logger.info(
+            f"{item.filename} contains {detected.lstrip('.').upper()} "
+            f"data; saving it as {filename}"
+        )
+        
+        storage = self.downloader.storage
+        status = (
+            STATUS_NEW
+            if storage.size(storage.key_for(path)) is None
+            else STATUS_UPDATED
+        )
+        return replace(item, path=path, status=status)
+    
+    def missing_columns(self, filename: str, data: bytes) -> List[str]:
+        """
+        The filters.required_columns a CSV/TSV attachment lacks; [] for
+        files that have them all and for other file types
+        """
+        filters = self.config.filters
+        if not filters.required_columns:
+            return []
+        extension = detect_extension(filename, data) or Path(filename).suffix.lower()
+        return missing_columns(
+            data, extension, filters.required_columns, filters.content_preview_size
+        )
+    
+    def update_latest_link(
+        self, item: PlannedDownload, entry: ManifestEntry, path: Location
+    ) -> None:
+        """
+        Point the sender's latest/ link for the file at path (download.latest_links)
+        
+        The link is named after the planned file, before any numbering or
+        version date the conflict policy added, in the download directory
+        (not the manifest_dir). Problems are logged; they never fail the
+        download.
+        """
+        if not self.config.download.latest_links or self.downloader.storage.is_remote:
+            return
+        link = latest_path(
+            self.downloader.base_dir,
+            self.downloader.sender_folder(entry.sender, entry.sender_name),
+            Path(item.path).name,
+        )
+        target = link_target(link)
+        current = self.manifest.find_by_path(target) if target else None
+        try:
+            if update_latest(
+                link, Path(path), entry.date, current.date if current else None
+            ):
+                logger.debug(f"{link} now points at {path}")
+        except OSError as e:
+            logger.warning(f"Cannot update {link}: {e}")
+    
+    async def check_schema(
+        self, entry: ManifestEntry, data: bytes
+    ) -> Optional[SchemaChange]:
+        """
+        Compare a saved CSV's header with the previous file of its feed
+        
+        A change is logged, kept for the summary, published as SchemaChanged
+        and, with schema.notify, posted to the notification webhook in the
+        background. Problems with the schema file are logged; they never
+        fail the download.
+        """
+        if not self.config.schema.enabled:
+            return None
+        extension = entry.detected or Path(entry.filename).suffix.lower()
+        try:
+            if self.schemas is None:
+                self.schemas = SchemaHistory(self.manifest.base_dir).load()
+            change = self.schemas.check(
+                entry.sender, entry.filename, entry.path, data, extension, entry.date
+            )
+        except ManifestError as e:
+            logger.warning(f"Schema drift check skipped for {entry.filename}: {e}")
+            return None
+        if change is None:
+            return None
+        
+        logger.warning(
+            f"Columns of {entry.filename} from "
+            f"{entry.sender} changed: {change.describe()}"
+        )
+        self.schema_changes.append(change)
+        await self.events.publish(SchemaChanged(change))
+        if self.config.schema.notify:
+            notifier = WebhookNotifier(self.config.notifications)
+            self.notifications.add(asyncio.create_task(notifier.notify_schema_change(change)))
+        return change
+    
+    def save_schemas(self) -> None:
+        """Write the header rows the run saw; a failure is logged"""
+        if self.schemas is None or not self.schemas.changed:
+            return
+        try:
+            self.schemas.save()
+        except ManifestError as e:
+            logger.warning(f"Schema history not saved: {e}")
+    
+    async def flush_integrations(self) -> None:
+        """Add the files saved in the run to DVC, then commit them to git"""
+        for integration in (self.dvc, self.git):
+            if integration is None:
+                continue
+            try:
+                await integration.flush()
+            except Exception as e:
+                # The files stay saved; the failure is only logged
+                logger.error(
+                    f"Saved files not flushed to {type(integration).__name__}: {e}"
+                )
+    
+    async def send_notifications(self) -> None:
+        """Wait for the webhook posts still being sent"""
+        pending, self.notifications = self.notifications, set()
+        for result in await asyncio.gather(*pending, return_exceptions=True):
+            if isinstance(result, Exception):
+                logger.error(f"Webhook notification failed: {result}")
+    
+    async def unlock(
+        self, filename: str, data: bytes, sender: str, subject: str
+    ) -> Tuple[bytes, str]:
+        """
+        Remove the password from a protected attachment, if one is configured
+        
+        Returns the data to save and its protection ("", "unlocked" or
+        "locked"; see unlock.Unlocker).
+        """
+        if self.unlocker is None:
+            return data, ""
+        return await asyncio.to_thread(
+            self.unlocker.unlock, filename, data, sender, subject
+        )
+    
+    async def scan(self, filename: str, data: bytes) -> Optional[str]:
+        """
+        Check data with the configured scanner before it is saved
+        
+        Returns the verdict (VERDICT_CLEAN or what was flagged), "" when
+        scanning is off, or None when the scan failed; the file is then
+        left unsaved and tried again on the next run.
+        """
+        if self.scanner is None:
+            return ""
+        try:
+            return await self.scanner.scan(data, filename)
+        except ScanError as e:
+            logger.error(f"Not saving {filename}: scan failed ({e})")
+            return None
+    
+    async def hold(self,
+                   entry: ManifestEntry,
+                   data: bytes,
+                   reason: str,
+                   detail: str,
+                   original_filename: Optional[str] = None) -> Path:
+        """
+        Write data to scan.quarantine_dir, in the folder for reason, with a reason file
+        
+        The file is named after its message; see quarantine.py for the layout.
+        With download.encrypt it is encrypted like a saved file.
+        """
+        encryptor = self.downloader.encryptor
+        if encryptor is not None:
+            data = await encryptor.encrypt(data)
+        path = quarantine_path(
+            self.config.scan.get_quarantine_path(),
+            reason,
+            entry.message_id,
+            entry.filename,
+            encryptor.suffix if encryptor is not None else "",
+        )
+        record = reason_record(entry, reason, detail, original_filename)
+        await asyncio.to_thread(write_quarantined, path, data, record)
+        logger.warning(
+            f"Quarantined {entry.filename} from {entry.sender}: {detail} ({path})"
+        )
+        return path
+    
+    async def quarantine(self,
+                         entry: ManifestEntry,
+                         data: bytes,
+                         reason: str,
+                         detail: str,
+                         original_filename: Optional[str] = None) -> Path:
+        """
+        Quarantine a file instead of saving it to its destination (see hold)
+        
+        It is recorded in the manifest with where it went, so it is not
+        downloaded again.
+        """
+        path = await self.hold(entry, data, reason, detail, original_filename)
+        entry.quarantine = str(path)
+        entry.quarantine_reason = reason
+        self.manifest.record(entry)
+        self.quarantined.append(entry)
+        return path
+    
+    def skip(self, entry: ManifestEntry, reason: str) -> None:
+        """
+        Record an attachment left out after it was downloaded, so it is
+        not downloaded again (see ManifestEntry.skipped)
+        """
+        entry.skipped = reason
+        self.manifest.record(entry)
+    
+    def manifest_entry(self,
+                       item: PlannedDownload,
+                       path: Location,
+                       data: bytes,
+                       anomaly: str) -> ManifestEntry:
+        """Manifest record for a planned attachment saved at path"""
+        return ManifestEntry(
+            message_id=item.message.message_id,
+            attachment_id=item.attachment.attachment_id,
+            filename=item.filename,
+            path=self.downloader.storage.key_for(path),
+            size=len(data),
+            sha256=hashlib.sha256(data).hexdigest(),
+            sender=item.message.sender,
+            sender_name=item.message.sender_name,
+            subject=item.message.subject,
+            date=item.message.date.isoformat(),
+            part_id=item.attachment.part_id,
+            labels=list(item.message.labels),
+            thread_id=item.message.thread_id,
+            declared_size=item.attachment.size,
+            anomaly=anomaly,
+            verified=self.downloader.verified.pop(
+                self.downloader.storage.key_for(path), ""
+            ),
+            encrypted=self.downloader.encryptor.method
+            if self.downloader.encryptor
+            else "",
+        )
+    
+    def holds(self, path: Location, data: bytes) -> bool:
+        """
+        Whether the file at path already has data's content
+        
+        The manifest's checksum of what was saved there is compared first,
+        since an encrypted file never matches its plaintext; a plain file is
+        then checked as stored too. A file the manifest does not know is
+        only compared as stored, and never matches when files are encrypted.
+        """
+        storage = self.downloader.storage
+        key = storage.key_for(path)
+        if storage.size(key) is None:
+            return False
+        recorded = self.manifest.find_by_path(key)
+        if recorded is not None and not recorded.quarantine:
+            if recorded.sha256 != hashlib.sha256(data).hexdigest():
+                return False
+            if recorded.encrypted:
+                return True
+        elif self.downloader.encryptor is not None:
+            return False
+        return storage.verify(key, data) is not None
+    
+    async def resolve_conflict(self,
+                               item: PlannedDownload,
+                               data: bytes,
+                               policy: str) -> Optional[Location]:
+        """
+        Save data whose destination already holds a file
+        
+        An identical file (same size and checksum) is just recorded in the
+        manifest, so a re-sent attachment is neither renamed nor rewritten.
+        Otherwise the policy applies: "overwrite" replaces the file,
+        "rename" saves a numbered copy next to it, "version" a copy named
+        after the email date (see save_versioned) and "ask" lets
+        ask_conflict choose. Returns where data was saved, or None when
+        nothing was written.
+        """
+        if await asyncio.to_thread(self.holds, item.path, data):
+            logger.info(
+                f"{item.path} already has this content; "
+                "recording it without saving again"
+            )
+            self.manifest.record(self.manifest_entry(item, item.path, data, ""))
+            return None
+        
+        if policy == "ask":
+            if self.ask_conflict is None:
+                logger.warning(
+                    f"Skipping {item.path}: a different "
+                    "file exists and nobody can be asked"
+                )
+                return None
+            policy = await self.ask_conflict(item)
+        
+        if policy == "rename":
+            return await self.downloader.save_new(item.path, data)
+        if policy == "version":
+            return await self.save_versioned(item, data)
+        if policy == "overwrite":
+            await self.downloader.write_file(item.path, data)
+            return item.path
+        
+        logger.warning(f"Skipping {item.path}: a different file already exists")
+        return None
+    
+    async def save_versioned(
+        self, item: PlannedDownload, data: bytes
+    ) -> Optional[Location]:
+        """
+        Save data under its email date (conflict_policy "version"), e.g.
+        sales_2024-06-01.csv, numbered when a different file has that name
+        too. Returns where data was saved, or None when the dated file
+        already has its content and is only recorded.
+        """
+        versioned = self.downloader.versioned_path(item.path, item.message.date)
+        if await asyncio.to_thread(self.holds, versioned, data):
+            logger.info(
+                f"{versioned} already has this content; "
+                "recording it without saving again"
+            )
+            self.manifest.record(self.manifest_entry(item, versioned, data, ""))
+            return None
+        return await self.downloader.save_new(versioned, data)
+    
+    async def check_declared_size(
+        self, item: PlannedDownload, data: bytes
+    ) -> Tuple[bytes, str]:
+        """
+        Compare downloaded data with the size Gmail declared for it
+        
+        A mismatch usually means a truncated or clipped message. With
+        download.raw_fallback the attachment is extracted from the raw
+        message instead, and used if that matches. Returns the data to save
+        and the anomaly to record ("" when the sizes agree).
+        """
+        declared = item.attachment.size
+        if not declared or len(data) == declared:
+            return data, ""
+        
+        logger.warning(
+            f"{item.filename} in {item.message.message_id}: Gmail declared "
+            f"{declared} bytes but sent {len(data)}"
+        )
+        
+        # Drive files are not in the raw message
+        if (
+            self.config.download.raw_fallback
+            and not drive_file_id(item.attachment.attachment_id)
+        ):
+            try:
+                raw_data = await self.gmail_client.download_attachment_from_raw(
+                    item.message.message_id,
+                    item.attachment.part_id,
+                    item.attachment.filename,
+                )
+            except Exception as e:
+                logger.warning(f"Raw message fallback failed for {item.filename}: {e}")
+                raw_data = None
+            
+            if raw_data is not None and len(raw_data) == declared:
+                logger.info(f"Recovered {item.filename} from the raw message")
+                return raw_data, ANOMALY_RECOVERED_RAW
+        
+        return data, ANOMALY_SIZE_MISMATCH
+    
+    async def save_message_content(self, message: "EmailMessage") -> List[Location]:
+        """
+        Save the message body and/or raw .eml next to its attachments
+        
+        Enabled by download.save_body and download.save_eml. Files are named
+        after the message date and ID, so messages from the same sender
+        never overwrite each other. Like attachments, they are recorded in
+        the manifest (with no attachment ID), and a message whose files are
+        recorded is not read again. With a scanner, files it flags (a .eml
+        holds every attachment) are quarantined instead.
+        """
+        download = self.config.download
+        files: Dict[str, bytes] = {}
+        stem = f"{message.date.strftime('%Y-%m-%d')}_{message.message_id}"
+        
+        def recorded(*extensions: str) -> bool:
+            return any(
+                self.manifest.get(message.message_id, stem + extension)
+                for extension in extensions
+            )
+        
+        if download.save_body and not recorded(".txt", ".html"):
+            bodies = await self.gmail_client.get_message_bodies(message.message_id)
+            for kind, extension in (("text", ".txt"), ("html", ".html")):
+                if kind in bodies:
+                    files[extension] = bodies[kind].encode("utf-8")
+        
+        if download.save_eml and not recorded(".eml"):
+            files[".eml"] = await self.gmail_client.get_raw_message(message.message_id)
+        
+        saved = []
+        for extension, data in files.items():
+            verdict = await self.scan(stem + extension, data)
+            if verdict is None:
+                continue
+            path = self.message_path(stem + extension, message)
+            entry = ManifestEntry(
+                message_id=message.message_id,
+                attachment_id="",
+                filename=stem + extension,
+                path=self.downloader.storage.key_for(path),
+                size=len(data),
+                sha256=hashlib.sha256(data).hexdigest(),
+                sender=message.sender,
+                sender_name=message.sender_name,
+                subject=message.subject,
+                date=message.date.isoformat(),
+                thread_id=message.thread_id,
+                scan=verdict,
+            )
+            if verdict not in ("", VERDICT_CLEAN):
+                await self.quarantine(entry, data, REASON_MALWARE, verdict)
+                continue
+            await self.downloader.write_file(path, data)
+            entry.verified = self.downloader.verified.pop(entry.path, "")
+            self.manifest.record(entry)
+            saved.append(path)
+        
+        return saved
+    
+    async def refetch(self, entries: List[ManifestEntry]) -> List[Location]:
+        """
+        Re-download attachments that are already recorded in the manifest.
+        
+        This skips the Gmail search entirely: each entry already knows its
+        message ID, so we only look up the message's current attachments
+        (Gmail attachment IDs can change between calls) and overwrite the
+        file at its recorded path. Attachments are matched by MIME part ID
+        when the manifest has one, otherwise by saved filename; an entry
+        whose attachment is no longer in the message is skipped.
+        
+        Files from Drive links and converted Google files keep their Drive
+        ID, so they are downloaded from Drive again directly; that needs
+        download.drive_links or conversions, as when they were first saved.
+        """
+        saved = []
+        
+        try:
+            for entry in entries:
+                if drive_file_id(entry.attachment_id):
+                    if self.drive is None:
+                        logger.warning(
+                            f"{entry.filename} came from "
+                            "Drive; not re-downloaded without "
+                            f"download.drive_links or conversions"
+                        )
+                        continue
+                    attachment_id = entry.attachment_id
+                else:
+                    attachments = await self.gmail_client.get_message_attachments(
+                        entry.message_id
+                    )
+                    names = disambiguate_filenames(
+                        attachments, self.downloader.filename_unicode
+                    )
+                    attachment_id = next(
+                        (
+                            a.attachment_id
+                            for a, name in zip(attachments, names)
+                            if (
+                                entry.part_id
+                                and getattr(a, "part_id", "") == entry.part_id
+                            )
+                            or (not entry.part_id and name == entry.filename)
+                        ),
+                        None,
+                    )
+                    if attachment_id is None:
+                        # The recorded ID is stale by now;
+                        # fetching it could save another part
+                        logger.warning(
+                            f"{entry.filename} is no longer in message "
+                            f"{entry.message_id}; not re-downloaded"
+                        )
+                        continue
+                
+                await self.throttle(entry.size)
+                data = await self.fetch(entry.message_id, attachment_id)
+                data, protection = await self.unlock(
+                    entry.filename, data, entry.sender, entry.subject
+                )
+                
+                verdict = await self.scan(entry.filename, data)
+                if verdict is None:
+                    continue
+                if verdict not in ("", VERDICT_CLEAN):
+                    await self.quarantine(
+                        replace(
+                            entry,
+                            attachment_id=attachment_id,
+                            size=len(data),
+                            sha256=hashlib.sha256(data).hexdigest(),
+                            downloaded_at=datetime.now().isoformat(),
+                            scan=verdict,
+                            protection=protection,
+                        ),
+                        data,
+                        REASON_MALWARE,
+                        verdict,
+                    )
+                    continue
+                
+                path = self.downloader.storage.locate(entry.path)
+                await self.downloader.write_file(path, data)
+                logger.info(f"Re-downloaded {path}")
+                
+                entry.attachment_id = attachment_id
+                if entry.declared_size and len(data) == entry.declared_size:
+                    # A clean re-download resolves an earlier mismatch
+                    entry.anomaly = ""
+                entry.size = len(data)
+                entry.sha256 = hashlib.sha256(data).hexdigest()
+                entry.verified = self.downloader.verified.pop(entry.path, "")
+                entry.downloaded_at = datetime.now().isoformat()
+                entry.scan = verdict
+                entry.quarantine = ""
+                entry.quarantine_reason = ""
+                entry.protection = protection
+                if protection == PROTECTION_LOCKED:
+                    self.locked.append(entry)
+                await self.downloader.write_metadata(path, entry)
+                self.manifest.record(entry)
+                saved.append(path)
+        finally:
+            # Whatever stops the loop, the entries updated so far stay recorded
+            self.manifest.save()
+        return saved
+    
+    @staticmethod
+    def summarize(planned: List[PlannedDownload]) -> Dict[str, int]:
+        """Count planned downloads per sync status"""
+        counts = {STATUS_NEW: 0, STATUS_UPDATED: 0, STATUS_EXISTS: 0}
+        for item in planned:
+            counts[item.status] += 1
+        return counts
+    
+    def estimate_quota(self, planned: List[PlannedDownload]) -> Dict[str, int]:
+        """
+        Estimate the Gmail quota units executing a plan will use
+        
+        Counts an attachments.get per attachment to fetch, plus a message
+        read per message for download.save_body and save_eml. Linked Drive
+        files are counted separately: they use Drive's quota, not Gmail's.
+        Raw-message fallbacks for clipped attachments are not foreseeable
+        and not included.
+        """
+        policy = self.config.download.get_conflict_policy()
+        to_fetch = [
+            item
+            for item in planned
+            if item.status == STATUS_NEW or (
+                item.status == STATUS_UPDATED and policy != "skip"
+            )
+        ]
+        drive_files = [
+            item for item in to_fetch if drive_file_id(item.attachment.attachment_id)
+        ]
+        attachments = len(to_fetch) - len(drive_files)
+        messages = len({item.message.message_id for item in to_fetch})
+        
+        units = attachments * QUOTA_COSTS["messages.attachments.get"]
+        if self.config.download.save_body:
+            units += messages * QUOTA_COSTS["messages.get"]
+        if self.config.download.save_eml:
+            units += messages * QUOTA_COSTS["messages.get"]
+        
+        return {
+            "attachments": attachments,
+            "messages": messages,
+            "drive_files": len(drive_files),
+            "units": units,
+        }
+
+
+class EmailWatcher:
+    """Watch for new emails in real-time"""
+    
+    def __init__(self, service: DownloadService, name: str = ""):
+        """
+        Initialize email watcher around a download service
+        
+        name is the feed in stale feed alerts: the watch rule, by default
+        the profile.
+        """
+        self.service = service
+        self.name = name or service.config.gmail.get_profile_name()
         self.is_watching = False
+        self.check_interval = service.config.watch.check_interval
+        
+        # Cron schedules (watch.schedules) replacing the fixed interval, and
+        # when the next scheduled check is due
+        self.schedules = parse_schedules(service.config.watch.schedules)
+        self.next_check: Optional[datetime] = None
+        
+        # Called after every successful mailbox check, including the
+        # baseline (e.g. systemd readiness and watchdog pings)
+        self.poll_listeners: List[Callable[[], Any]] = []
+        
+        # Reported by health()
+        self.started_at: Optional[datetime] = None
+        self.last_poll: Optional[datetime] = None
+        self.stats = {
+            "messages_processed": 0, "attachments_saved": 0, "errors": 0, "reloads": 0
+        }
+        self.last_error = ""
+        
+        # Totals of the service's events while watching, also in health()
+        self.metrics = EventMetrics()
+        
+        # Checks freshness.expected_by deadlines; what arrived before comes
+        # from the manifest, later files from the download listener
+        filters = service.config.filters
+        self.freshness = FreshnessMonitor(
+            self.name,
+            service.config,
+            service.events,
+            latest_arrival(service.manifest, filters),
+        )
+        service.download_listeners.append(self.freshness.record)
+        
+        self._poll_task: Optional[asyncio.Task] = None
+        self._freshness_task: Optional[asyncio.Task] = None
+        self._reload_requested = False
+        
+        # Tasks cancelled by a reload, awaited once they have wound down
+        self._cancelled: Set[asyncio.Task] = set()
     
-    async def start_watching(self, 
-                           filters: Dict[str, Any],
-                           check_interval: int = 30):
-        """Start watching for new emails"""
+    async def start_watching(self,
+                             check_interval: Optional[int] = None,
+                             backfill: Optional[timedelta] = None):
+        """
+        Start watching for new emails.
+        
+        Messages that already exist when watching starts form the baseline
+        and are not downloaded; every message that arrives afterwards is
+        planned and downloaded as soon as it is seen.
         
-        print(f"👀 Starting email watch mode (checking every {check_interval}s)")
+        With a backfill window, messages from that period are downloaded
+        first. The baseline is taken before the backfill runs, so mail that
+        arrives during a long backfill is still picked up by the first poll.
+        
+        reload() restarts polling with new settings without returning from
+        here; stop_watching() ends it.
+        """
+        if check_interval:
+            self.check_interval = check_interval
+        if self.schedules:
+            logger.info(
+                "Starting email watch mode (checking on schedule: "
+                f"{self.describe_schedules()})"
+            )
+        else:
+            logger.info(
+                f"Starting email watch mode (checking every {self.check_interval}s)"
+            )
         self.is_watching = True
+        self.started_at = datetime.now()
+        
+        # Uploads spooled during an outage must not wait for the next email
+        forwarder = asyncio.create_task(self.forward_spool())
+        events = self.service.events.subscribe()
+        counter = asyncio.create_task(self.metrics.consume(events))
+        self._restart_freshness()
+        
+        try:
+            while self.is_watching:
+                self._poll_task = asyncio.create_task(self._poll(backfill))
+                backfill = None
+                await asyncio.wait({self._poll_task})
+                
+                if self._reload_requested:
+                    # Cover mail that arrived while polling restarted; the
+                    # manifest skips anything already downloaded
+                    self._reload_requested = False
+                    backfill = datetime.now() - (self.last_poll or self.started_at)
+                    await self._reap()
+                    continue
+                if not self._poll_task.cancelled():
+                    self._poll_task.result()
+                break
+        finally:
+            events.close()
+            for task in (self._poll_task, self._freshness_task, forwarder, counter):
+                if task and not task.done():
+                    task.cancel()
+                    self._cancelled.add(task)
+            self._freshness_task = None
+            await self._reap()
+    
+    def _restart_freshness(self) -> None:
+        """Check the freshness deadlines of the current config from now on, if any"""
+        if self._freshness_task:
+            self._freshness_task.cancel()
+            self._cancelled.add(self._freshness_task)
+            self._freshness_task = None
+        if self.is_watching and self.freshness.config.freshness.expected_by:
+            self._freshness_task = asyncio.create_task(self.freshness.run())
+    
+    async def _reap(self) -> None:
+        """Wait for the cancelled tasks to finish"""
+        tasks, self._cancelled = self._cancelled, set()
+        results = await asyncio.gather(*tasks, return_exceptions=True)
+        for result in results:
+            if isinstance(result, Exception):
+                logger.error(f"A watch task failed: {result}")
+    
+    async def _poll(self, backfill: Optional[timedelta]):
+        """Take a baseline, run the backfill, then download new messages"""
+        query = self.service.build_query()
+        client = self.service.gmail_client
+        baseline = await client.snapshot_message_ids(query)
+        self._polled()
+        
+        if backfill:
+            logger.info(f"Backfilling messages from the last {backfill}")
+            saved = await self.service.backfill(backfill)
+            logger.info(f"Backfill downloaded {len(saved)} attachment(s)")
+        
+        scheduled = {"wait": self._until_next_check} if self.schedules else {}
+        async for message_id in client.watch_for_new_messages(
+            query,
+            self.check_interval,
+            baseline=baseline,
+            on_poll=self._polled,
+            **scheduled,
+        ):
+            if not self.is_watching:
+                break
+            
+            try:
+                planned = await self.service.plan_message(message_id)
+                saved = await self.service.execute(planned)
+                self.stats["messages_processed"] += 1
+                self.stats["attachments_saved"] += len(saved)
+                if saved:
+                    logger.info(
+                        f"Downloaded {len(saved)} new attachment(s) from {message_id}"
+                    )
+                for failure in self.service.failed:
+                    self.stats["errors"] += 1
+                    self.last_error = (
+                        f"{message_id}: {failure.item.filename}: {failure.error}"
+                    )
+            except Exception as e:
+                # Keep watching - one bad message should not end the session
+                self.stats["errors"] += 1
+                self.last_error = f"{message_id}: {e}"
+                logger.error(f"Failed to process message {message_id}: {e}")
+    
+    def describe_schedules(self) -> str:
+        """The cron expressions in use, for messages"""
+        return ", ".join(schedule.expression for schedule in self.schedules)
+    
+    def _until_next_check(self) -> float:
+        """Seconds until the next scheduled check, remembered for health()"""
+        now = datetime.now()
+        self.next_check = next_run(self.schedules, now)
+        logger.debug(f"Next scheduled check at {self.next_check:%Y-%m-%d %H:%M}")
+        return (self.next_check - now).total_seconds()
+    
+    def _polled(self) -> None:
+        """Record a successful mailbox check and tell the poll listeners"""
+        self.last_poll = datetime.now()
+        for listener in self.poll_listeners:
+            listener()
+    
+    def reload(self, config: AppConfig) -> None:
+        """
+        Apply a new configuration to the running watcher
+        
+        Filters, the search query, the check interval and freshness
+        deadlines take effect immediately: polling restarts with a fresh
+        baseline, backfilling the time since the last check. The download location and
+        organization are kept until the next restart.
+        """
+        self.service.config = config
+        self.check_interval = config.watch.check_interval
+        self.schedules = parse_schedules(config.watch.schedules)
+        self.next_check = None
+        self.stats["reloads"] += 1
+        logger.info("Configuration reloaded; restarting polling")
         
-        # TODO: Implement real-time email monitoring
-        while self.is_watching:
-            print("🔄 Checking for new emails...")
-            # Check for new emails with filters
-            # Download any new attachments
-            await asyncio.sleep(check_interval)
+        # New deadlines take effect now, not after the old next one, and
+        # deadlines added to a config that had none start being checked
+        self.freshness.config = config
+        self._restart_freshness()
+        
+        if self._poll_task and not self._poll_task.done():
+            self._reload_requested = True
+            self._poll_task.cancel()
+    
+    def health(self) -> Dict[str, Any]:
+        """Liveness and progress of the watcher, for health checks"""
+        now = datetime.now()
+        # A poll is overdue after two missed intervals (API trouble, hang),
+        # or a minute past its scheduled time
+        if self.next_check:
+            due = self.next_check + timedelta(seconds=60)
+        else:
+            due = (self.last_poll or now) + timedelta(
+                seconds=2 * self.check_interval + 60
+            )
+        status = {
+            "pid": os.getpid(),
+            "watching": self.is_watching,
+            "started_at": self.started_at.isoformat() if self.started_at else None,
+            "uptime_seconds": int((now - self.started_at).total_seconds())
+            if self.started_at
+            else 0,
+            "last_poll": self.last_poll.isoformat() if self.last_poll else None,
+            "check_interval": self.check_interval,
+            "schedules": [schedule.expression for schedule in self.schedules],
+            "next_check": self.next_check.isoformat() if self.next_check else None,
+            "healthy": bool(self.is_watching and self.last_poll and now < due),
+            "last_error": self.last_error,
+            **self.stats,
+            "events": self.metrics.snapshot(),
+        }
+        if self.freshness.config.freshness.expected_by:
+            status["freshness"] = self.freshness.status()
+        storage = self.service.downloader.storage
+        if isinstance(storage, SpoolingStorage):
+            status["spool"] = storage.status()
+        return status
+    
+    async def forward_spool(self):
+        """Periodically retry uploads waiting in the local spool"""
+        storage = self.service.downloader.storage
+        while True:
+            await asyncio.sleep(self.check_interval)
+            try:
+                await storage.flush()
+            except Exception as e:
+                logger.error(f"Failed to forward spooled uploads: {e}")
     
     def stop_watching(self):
         """Stop watching for emails"""
-        print("⏹️ Stopping email watch")
+        logger.info("Stopping email watch")
         self.is_watching = False
+        if self._poll_task and not self._poll_task.done():
+            self._poll_task.cancel()
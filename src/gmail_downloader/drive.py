@@ -0,0 +1,358 @@
+"""
+Google Drive files linked from message bodies.
+
+Large files are often shared as a Drive link instead of an attachment. With
+download.drive_links, message bodies are scanned for Drive, Docs, Sheets and
+Slides URLs, and the linked files are downloaded next to the message's
+regular attachments, through the same filters, layout and manifest.
+
+Google-native files (Docs, Sheets, Slides, Drawings) have no bytes of their
+own; they are exported in the format set in conversions. The same applies to
+attachments that merely reference one, such as the .gsheet/.gdoc stubs Drive
+for desktop creates: with conversions set, the referenced file is exported
+in place of the stub.
+
+Drive limits exports to 10MB per file. Files bigger than that are
+downloaded in ranges when a PartialDownloads journal is given, so a failed
+download resumes where it stopped (see partial).
+"""
+
+import asyncio
+import json
+import logging
+import re
+from dataclasses import dataclass
+from pathlib import Path
+from typing import Any, Awaitable, Callable, Dict, List, Optional
+
+from googleapiclient.errors import HttpError
+
+from .config import DEFAULT_DRIVE_EXPORT_FORMATS, NetworkConfig
+from .gmail_client import EmailAttachment, GmailAPI, GmailError
+from .manifest import ManifestError
+from .network import authorized_http
+from .partial import PartialDownloads
+from .utils import format_file_size
+
+logger = logging.getLogger(__name__)
+
+# Links to a single Drive file, capturing its ID:
+# drive.google.com/file/d/<id>, drive.google.com/open?id=<id>,
+# drive.google.com/uc?id=<id>, docs.google.com/<kind>/d/<id>
+DRIVE_LINK = re.compile(
+    r"https?://(?:drive|docs)\.google\.com/"
+    r"(?:(?:file|document|spreadsheets|presentation|drawings)/(?:u/\d+/)?d/"
+    r"|(?:open|uc)\?(?:[^\s\"'<>]*?&(?:amp;)?)?id=)"
+    r"([-\w]{20,})"
+)
+
+# Attachment IDs of Drive files start with this, so they can be told
+# apart from Gmail attachments in plans and the manifest
+DRIVE_ATTACHMENT_PREFIX = "drive:"
+
+GOOGLE_APPS_MIME_PREFIX = "application/vnd.google-apps."
+
+# Small JSON files standing in for Google-native files, holding their URL
+# and ID (written by Drive for desktop)
+NATIVE_STUB_EXTENSIONS = {
+    ".gdoc": "document",
+    ".gsheet": "spreadsheet",
+    ".gslides": "presentation",
+    ".gdraw": "drawing",
+}
+
+# Export format -> MIME type Drive exports to
+EXPORT_MIME_TYPES = {
+    "pdf": "application/pdf",
+    "docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+    "xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+    "pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+    "odt": "application/vnd.oasis.opendocument.text",
+    "ods": "application/vnd.oasis.opendocument.spreadsheet",
+    "odp": "application/vnd.oasis.opendocument.presentation",
+    "csv": "text/csv",
+    "txt": "text/plain",
+    "png": "image/png",
+    "svg": "image/svg+xml",
+}
+
+
+class DriveError(GmailError):
+    """Raised when a linked Drive file cannot be read."""
+
+    pass
+
+
+def find_drive_links(text: str) -> List[str]:
+    """IDs of the Drive files linked in text, in order of first appearance."""
+    return list(dict.fromkeys(DRIVE_LINK.findall(text or "")))
+
+
+def is_native_reference(filename: str, mime_type: str) -> bool:
+    """Whether an attachment is only a reference to a Google-native file."""
+    return (
+        mime_type.startswith(GOOGLE_APPS_MIME_PREFIX)
+        or Path(filename).suffix.lower() in NATIVE_STUB_EXTENSIONS
+    )
+
+
+def stub_file_id(data: bytes) -> Optional[str]:
+    """
+    The Drive file ID a reference attachment points at.
+
+    Stubs are JSON with a doc_id (or resource_id such as
+    "spreadsheet:<id>") and a url; anything else is searched for a link.
+    """
+    text = data.decode("utf-8", errors="replace")
+    try:
+        info = json.loads(text)
+    except ValueError:
+        info = None
+
+    if isinstance(info, dict):
+        if info.get("doc_id"):
+            return str(info["doc_id"])
+        _, _, resource_id = str(info.get("resource_id", "")).partition(":")
+        if resource_id:
+            return resource_id
+        text = str(info.get("url", ""))
+
+    links = find_drive_links(text)
+    return links[0] if links else None
+
+
+def drive_file_id(attachment_id: str) -> Optional[str]:
+    """The Drive file ID behind an attachment ID, or None for Gmail attachments."""
+    if attachment_id.startswith(DRIVE_ATTACHMENT_PREFIX):
+        return attachment_id[len(DRIVE_ATTACHMENT_PREFIX):]
+    return None
+
+
+@dataclass
+class DriveFile:
+    """A linked Drive file and how it will be downloaded."""
+
+    file_id: str
+    name: str
+    mime_type: str
+    size: int = 0  # Unknown (0) for exported Google-native files
+    export_format: str = ""  # Empty for files downloaded as they are
+
+    @property
+    def filename(self) -> str:
+        """Name to save under, with the export format's extension."""
+        extension = f".{self.export_format}" if self.export_format else ""
+        if extension and not self.name.lower().endswith(extension):
+            return self.name + extension
+        return self.name
+
+    @property
+    def download_mime_type(self) -> str:
+        return (
+            EXPORT_MIME_TYPES[self.export_format]
+            if self.export_format
+            else self.mime_type
+        )
+
+    def to_attachment(self, message_id: str) -> EmailAttachment:
+        """Represent the file as an attachment of the message linking to it."""
+        attachment_id = DRIVE_ATTACHMENT_PREFIX + self.file_id
+        return EmailAttachment(
+            attachment_id=attachment_id,
+            message_id=message_id,
+            filename=self.filename,
+            mime_type=self.download_mime_type,
+            size=self.size,
+            part_id=attachment_id,
+        )
+
+
+class DriveClient:
+    """
+    Reads linked files with the Gmail client's credentials.
+
+    GmailClient requests the drive.readonly scope when download.drive_links
+    is enabled; the Drive service is built on first use.
+    """
+
+    def __init__(self,
+                 gmail_client: GmailAPI,
+                 export_formats: Optional[Dict[str, str]] = None,
+                 network: Optional[NetworkConfig] = None):
+        self.gmail_client = gmail_client
+        self.export_formats = {**DEFAULT_DRIVE_EXPORT_FORMATS, **(export_formats or {})}
+        self.network = network or NetworkConfig()
+        self.service = None
+        self.media_service = None
+        self._files: Dict[str, Optional[DriveFile]] = {}
+
+    def _get_service(self, media: bool = False):
+        """
+        The Drive service; with media, one whose connections wait up to
+        network.attachment_timeout_seconds, for file contents.
+        """
+        from googleapiclient.discovery import build
+
+        if media:
+            if self.media_service is None:
+                http = authorized_http(
+                    self.gmail_client.credentials,
+                    self.network,
+                    self.network.attachment_timeout_seconds,
+                )
+                self.media_service = build(
+                    "drive", "v3", http=http, cache_discovery=False
+                )
+            return self.media_service
+        if self.service is None:
+            http = authorized_http(self.gmail_client.credentials, self.network)
+            self.service = build("drive", "v3", http=http, cache_discovery=False)
+        return self.service
+
+    async def _execute(self, request_func, action: str):
+        try:
+            return await asyncio.to_thread(request_func)
+        except HttpError as e:
+            status = getattr(e.resp, "status", None)
+            if status in (403, 404):
+                raise DriveError(
+                    f"Cannot {action}: not found or not shared with this account"
+                )
+            raise DriveError(f"Cannot {action}: {e}")
+
+    async def get_file(self, file_id: str) -> Optional[DriveFile]:
+        """
+        Look up a linked file.
+
+        Returns None for things that cannot be downloaded as a file
+        (folders, forms, shortcuts, native kinds without an export format).
+
+        Raises:
+            DriveError: If the file does not exist or is not shared with us
+        """
+        if file_id in self._files:
+            return self._files[file_id]
+
+        def make_request():
+            return self._get_service().files().get(
+                fileId=file_id, fields="id,name,mimeType,size", supportsAllDrives=True
+            ).execute()
+
+        metadata = await self._execute(make_request, f"read Drive file {file_id}")
+        mime_type = metadata.get("mimeType", "")
+        drive_file = DriveFile(
+            file_id=file_id,
+            name=metadata.get("name") or file_id,
+            mime_type=mime_type,
+            size=int(metadata.get("size", 0) or 0),
+        )
+
+        if mime_type.startswith(GOOGLE_APPS_MIME_PREFIX):
+            kind = mime_type[len(GOOGLE_APPS_MIME_PREFIX):]
+            drive_file.export_format = self.export_formats.get(kind, "")
+            if not drive_file.export_format:
+                logger.info(
+                    f"Skipping linked Drive {kind} {drive_file.name!r}: it cannot be "
+                    "downloaded as a file"
+                )
+                drive_file = None
+
+        self._files[file_id] = drive_file
+        return drive_file
+
+    async def download(
+        self,
+        file_id: str,
+        partial: Optional[PartialDownloads] = None,
+        chunk_size: int = 8 * 1024 * 1024,
+        key: str = "",
+        on_progress: Optional[Callable[[int], Awaitable[Any]]] = None,
+    ) -> bytes:
+        """
+        Download (or export) a linked file.
+
+        Args:
+            file_id: The Drive file
+            partial: Journal to download files over chunk_size through in
+                ranges, resuming earlier attempts (None = in one piece)
+            chunk_size: Bytes per range
+            key: The download's key in the journal (see partial_key);
+                the file ID by default
+            on_progress: Called with the bytes downloaded so far after
+                each range
+
+        Raises:
+            DriveError: If the file cannot be read
+        """
+        drive_file = await self.get_file(file_id)
+        if drive_file is None:
+            raise DriveError(f"Drive file {file_id} cannot be downloaded as a file")
+        if (
+            partial is not None
+            and not drive_file.export_format
+            and drive_file.size > chunk_size
+        ):
+            try:
+                return await self._download_ranges(
+                    drive_file, partial, chunk_size, key or file_id, on_progress
+                )
+            except ManifestError as e:
+                raise DriveError(f"Cannot resume Drive file {drive_file.name!r}: {e}")
+
+        def make_request():
+            files = self._get_service(media=True).files()
+            if drive_file.export_format:
+                return files.export(
+                    fileId=file_id, mimeType=drive_file.download_mime_type
+                ).execute()
+            return files.get_media(fileId=file_id, supportsAllDrives=True).execute()
+
+        return await self._execute(
+            make_request, f"download Drive file {drive_file.name!r}"
+        )
+
+    async def _download_ranges(
+        self,
+        drive_file: DriveFile,
+        partial: PartialDownloads,
+        chunk_size: int,
+        key: str,
+        on_progress: Optional[Callable[[int], Awaitable[Any]]] = None,
+    ) -> bytes:
+        """Download a file chunk_size bytes at a time, resuming the journal's key."""
+        file_id = drive_file.file_id
+        size = drive_file.size
+        offset = partial.start(key, size)
+        if offset:
+            logger.info(
+                f"Resuming Drive file {drive_file.name!r} at "
+                f"{format_file_size(offset)} of {format_file_size(size)}"
+            )
+
+        while offset < size:
+            end = min(offset + chunk_size, size) - 1
+
+            def make_request(start=offset, end=end):
+                request = self._get_service(media=True).files().get_media(
+                    fileId=file_id, supportsAllDrives=True
+                )
+                request.headers["Range"] = f"bytes={start}-{end}"
+                return request.execute()
+
+            chunk = await self._execute(
+                make_request, f"download Drive file {drive_file.name!r}"
+            )
+            if len(chunk) != end - offset + 1:
+                # A server ignoring the range sends the whole file
+                partial.discard(key)
+                if offset == 0 and len(chunk) == size:
+                    return chunk
+                raise DriveError(
+                    f"Drive sent {len(chunk)} bytes for bytes {offset}-{end} of "
+                    f"{drive_file.name!r}"
+                )
+            offset = partial.append(key, chunk)
+            if on_progress:
+                await on_progress(offset)
+
+        return partial.finish(key)
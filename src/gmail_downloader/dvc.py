@@ -0,0 +1,165 @@
+"""
+Tracking downloads with DVC.
+
+When download.base_dir is inside a DVC repository (a directory above it has
+a .dvc folder) and integrations.dvc.enabled is set, the attachments a run
+saves are added to DVC when it ends, so the data is versioned next to the
+pipelines that use it, and optionally pushed to a DVC remote:
+
+    dvc add downloads/vendor.com/2024-06/invoice.pdf downloads/...
+    dvc push downloads/vendor.com/2024-06/invoice.pdf.dvc downloads/...
+
+Where the file came from goes into the meta: field of its .dvc file, which
+DVC keeps as it is when the file is added again:
+
+    outs:
+    - md5: 3b1f0c...
+      size: 18231
+      path: invoice.pdf
+    meta:
+      source: gmail
+      sender: billing@vendor.com
+      subject: Invoice June
+      date: '2024-06-01T09:30:12+00:00'
+      message_id: 18f2a...
+      sha256: 9c2e41...
+
+The dvc program is run in the repository's root, once for all the files of
+a run (each pass of watch), so a slow push does not hold up downloads. Like
+a rule's run command, a dvc command that fails is logged and never stops the
+download; the file stays saved and in the manifest either way.
+"""
+
+import logging
+import shlex
+from pathlib import Path
+from typing import Dict, List, Optional
+
+import yaml
+
+from .config import DvcConfig
+from .manifest import ManifestEntry
+from .programs import find_root, run_program
+from .storage import Location
+
+logger = logging.getLogger(__name__)
+
+# The directory marking a DVC repository's root
+DVC_DIR = ".dvc"
+
+# Appended to a tracked file's name for its .dvc file
+DVC_FILE_SUFFIX = ".dvc"
+
+# How long one dvc command may take (a push of a run's files included)
+DVC_TIMEOUT_SECONDS = 600
+
+
+def find_repo(path: Location) -> Optional[Path]:
+    """The root of the DVC repository path is in, None outside one."""
+    return find_root(path, DVC_DIR)
+
+
+def dvc_file(path: Location) -> Path:
+    """The .dvc file dvc add writes for path."""
+    path = Path(path)
+    return path.with_name(path.name + DVC_FILE_SUFFIX)
+
+
+def provenance(entry: ManifestEntry) -> Dict[str, str]:
+    """Where a saved attachment came from, for its .dvc file's meta: field."""
+    return {
+        "source": "gmail",
+        "sender": entry.sender,
+        "subject": entry.subject,
+        "date": entry.date,
+        "message_id": entry.message_id,
+        "filename": entry.filename,
+        "sha256": entry.sha256,
+    }
+
+
+def write_meta(path: Path, meta: Dict[str, str]) -> None:
+    """Set the meta: field of the .dvc file at path, keeping the rest."""
+    data = yaml.safe_load(path.read_text(encoding="utf-8")) or {}
+    data["meta"] = meta
+    path.write_text(
+        yaml.safe_dump(data, sort_keys=False, allow_unicode=True), encoding="utf-8"
+    )
+
+
+class DvcTracker:
+    """Adds saved files to one DVC repository."""
+
+    def __init__(self, config: DvcConfig, repo: Path):
+        self.config = config
+        self.repo = repo
+
+        # Saved files waiting for the next flush, by path
+        self.pending: Dict[Path, ManifestEntry] = {}
+
+    async def run(self, arguments: List[str]) -> bool:
+        """Run dvc with arguments in the repository; False if it failed."""
+        command = shlex.split(self.config.command) + arguments
+        return await run_program("DVC", command, self.repo, DVC_TIMEOUT_SECONDS) == 0
+
+    async def queue(self, entry: ManifestEntry, path: Location) -> None:
+        """
+        Have the next flush add a saved file.
+
+        A DownloadService download listener.
+        """
+        self.pending[Path(path).resolve()] = entry
+
+    async def flush(self) -> bool:
+        """
+        Add the queued files to DVC, record their provenance and push them
+        if set to, with one dvc add and one dvc push for all of them.
+
+        Returns:
+            Whether every step succeeded
+        """
+        pending, self.pending = self.pending, {}
+        pending = {path: entry for path, entry in pending.items() if path.exists()}
+        if not pending:
+            return True
+        if not await self.run(["add"] + [str(path) for path in pending]):
+            return False
+
+        success = True
+        for path, entry in pending.items():
+            try:
+                write_meta(dvc_file(path), provenance(entry))
+            except (OSError, yaml.YAMLError) as e:
+                logger.error(
+                    f"DVC: cannot record where {path.name} came from in "
+                    f"{dvc_file(path).name}: {e}"
+                )
+                success = False
+                continue
+            logger.info(f"DVC: tracking {path.relative_to(self.repo)}")
+
+        if not self.config.push:
+            return success
+        arguments = ["push"] + [str(dvc_file(path)) for path in pending]
+        if self.config.remote:
+            arguments += ["--remote", self.config.remote]
+        return await self.run(arguments) and success
+
+
+def open_dvc(config: DvcConfig, base_dir: Location) -> Optional[DvcTracker]:
+    """
+    The tracker for downloads into base_dir, if integrations.dvc is on.
+
+    Outside a DVC repository nothing is tracked, with a warning.
+    """
+    if not config.enabled:
+        return None
+    repo = find_repo(base_dir)
+    if repo is None:
+        logger.warning(
+            "integrations.dvc is enabled, but "
+            f"{base_dir} is not inside a DVC repository "
+            f"(run dvc init in the repository); downloads are not tracked"
+        )
+        return None
+    return DvcTracker(config, repo)
@@ -0,0 +1,106 @@
+"""
+Encrypting saved files at rest.
+
+With download.encrypt set to "age" or "gpg", every file is encrypted for
+download.encrypt_recipients before it is written, so no plaintext copy of
+an attachment ever lands in the download location. Files get a .age or
+.gpg suffix and are decrypted with the recipients' private keys:
+
+    age --decrypt -i key.txt report.pdf.age > report.pdf
+    gpg --decrypt report.pdf.gpg > report.pdf
+
+Encryption runs the age or gpg program, so no Python packages are needed;
+gpg uses its usual keyring (GNUPGHOME) and only encrypts for keys it trusts
+(signed or given ownertrust), so a key slipped into the keyring is refused.
+The manifest keeps the size and checksum of the attachment itself and marks
+the entry as encrypted. Quarantined files are encrypted too; sidecar metadata
+(download.file_metadata) and quarantine reason files are not.
+"""
+
+import asyncio
+import shutil
+from pathlib import Path
+from typing import List, Optional
+
+from .config import DownloadConfig
+from .storage import StorageError
+
+# Suffix added to saved files per download.encrypt method
+ENCRYPTED_SUFFIXES = {"age": ".age", "gpg": ".gpg"}
+
+
+class EncryptionError(StorageError):
+    """Raised when a file cannot be encrypted."""
+
+    pass
+
+
+class Encryptor:
+    """Encrypts file contents for a fixed set of recipients."""
+
+    def __init__(self, method: str, recipients: List[str]):
+        """
+        Raises:
+            EncryptionError: If the method's program is not installed
+        """
+        self.method = method
+        self.recipients = recipients
+        self.suffix = ENCRYPTED_SUFFIXES[method]
+        self.program = shutil.which(method)
+        if self.program is None:
+            raise EncryptionError(
+                f"download.encrypt: {method} needs the {method} program on the PATH"
+            )
+
+    def command(self) -> List[str]:
+        """The command that reads plaintext on stdin and writes ciphertext to stdout."""
+        if self.method == "age":
+            args = [self.program, "--encrypt"]
+            for recipient in self.recipients:
+                # A recipients file (one key per line) or a key itself
+                flag = "-R" if Path(recipient).expanduser().is_file() else "-r"
+                args += [
+                    flag,
+                    str(Path(recipient).expanduser()) if flag == "-R" else recipient,
+                ]
+            return args
+
+        args = [self.program, "--batch", "--yes", "--quiet", "--encrypt"]
+        for recipient in self.recipients:
+            args += ["--recipient", recipient]
+        return args + ["--output", "-"]
+
+    async def encrypt(self, data: bytes) -> bytes:
+        """
+        Encrypt data for the recipients.
+
+        Raises:
+            EncryptionError: If the program fails, e.g. for an unknown key
+        """
+        process = await asyncio.create_subprocess_exec(
+            *self.command(),
+            stdin=asyncio.subprocess.PIPE,
+            stdout=asyncio.subprocess.PIPE,
+            stderr=asyncio.subprocess.PIPE,
+        )
+        ciphertext, errors = await process.communicate(data)
+        if process.returncode != 0 or not ciphertext:
+            message = errors.decode("utf-8", "replace").strip().splitlines()
+            hint = ""
+            if self.method == "gpg":
+                hint = (
+                    " (is each recipient's key in the keyring "
+                    "and trusted? See gpg --lsign-key)"
+                )
+            raise EncryptionError(
+                f"{self.method} could not encrypt: "
+                f"{message[-1] if message else f'exit code {process.returncode}'}{hint}"
+            )
+        return ciphertext
+
+
+def open_encryptor(config: DownloadConfig) -> Optional[Encryptor]:
+    """The encryptor download.encrypt asks for, or None when files are kept as is."""
+    if not config.encrypt:
+        return None
+    return Encryptor(config.encrypt, config.encrypt_recipients)
@@ -0,0 +1,305 @@
+"""
+Progress events of download runs.
+
+DownloadService publishes what it is doing on its event bus (service.events)
+as typed events, instead of knowing who is watching:
+
+    SearchStarted   a mailbox search began
+    FileStarted     an attachment is about to be downloaded (files then
+                    skipped, e.g. as junk or quarantined, get no FileDone)
+    FileProgress    bytes of an attachment have been downloaded (none yet
+                    at the start, then after each range and at the end)
+    FileDone        an attachment was saved and recorded in the manifest
+    FileFailed      an attachment could not be downloaded or saved
+    SchemaChanged   a saved CSV's columns differ from the previous file of
+                    its feed (schema.enabled, see schema.py)
+    FeedStale       no new file arrived by a deadline of freshness.expected_by
+                    while watching (see freshness.py)
+    RunDone         execute() finished (also when it failed)
+
+Consumers subscribe a channel and read events at their own pace, each in
+their own task: the CLI's progress bar and JSON output, EventMetrics for the
+daemon's health endpoint, webhook notifications, the library's progress
+queue. Publishing never waits for a slow consumer unless its channel has a
+size limit; a full channel then drops FileProgress events (the next one
+supersedes them) and waits for room for the others.
+
+    channel = service.events.subscribe()
+    async for event in channel:
+        if isinstance(event, FileDone):
+            print(event.path)
+"""
+
+import asyncio
+import json
+from dataclasses import dataclass, field
+from datetime import datetime
+from typing import IO, TYPE_CHECKING, Any, ClassVar, Dict, List, Optional
+
+if TYPE_CHECKING:
+    from .downloader import PlannedDownload
+    from .freshness import StaleFeed
+    from .manifest import ManifestEntry
+    from .schema import SchemaChange
+    from .storage import Location
+
+
+@dataclass
+class Event:
+    """Something a download run did; subclasses say what."""
+
+    # Name in JSON output, e.g. "file_done"
+    kind: ClassVar[str] = "event"
+
+    at: datetime = field(default_factory=datetime.now, kw_only=True)
+
+    def fields(self) -> Dict[str, Any]:
+        """Event-specific data for to_dict."""
+        return {}
+
+    def to_dict(self) -> Dict[str, Any]:
+        """The event as JSON-ready data."""
+        return {"event": self.kind, "at": self.at.isoformat(), **self.fields()}
+
+
+def _describe(item: "PlannedDownload") -> Dict[str, Any]:
+    return {
+        "message_id": item.message.message_id,
+        "filename": item.filename,
+        "sender": item.message.sender,
+        "size": item.attachment.size,
+    }
+
+
+@dataclass
+class SearchStarted(Event):
+    """A mailbox search began."""
+
+    kind: ClassVar[str] = "search_started"
+
+    queries: List[str]
+
+    def fields(self) -> Dict[str, Any]:
+        return {"queries": self.queries}
+
+
+@dataclass
+class FileStarted(Event):
+    """An attachment is about to be downloaded."""
+
+    kind: ClassVar[str] = "file_started"
+
+    item: "PlannedDownload"
+
+    def fields(self) -> Dict[str, Any]:
+        return _describe(self.item)
+
+
+@dataclass
+class FileProgress(Event):
+    """Part (or all) of an attachment has been downloaded."""
+
+    kind: ClassVar[str] = "file_progress"
+
+    item: "PlannedDownload"
+    bytes_done: int
+    bytes_total: int
+
+    def fields(self) -> Dict[str, Any]:
+        return {
+            **_describe(self.item),
+            "bytes_done": self.bytes_done,
+            "bytes_total": self.bytes_total,
+        }
+
+
+@dataclass
+class FileDone(Event):
+    """An attachment was saved and recorded in the manifest."""
+
+    kind: ClassVar[str] = "file_done"
+
+    item: "PlannedDownload"
+    entry: "ManifestEntry"
+    path: "Location"
+
+    def fields(self) -> Dict[str, Any]:
+        return {
+            **_describe(self.item), "path": str(self.path), "bytes": self.entry.size
+        }
+
+
+@dataclass
+class FileFailed(Event):
+    """An attachment could not be downloaded or saved."""
+
+    kind: ClassVar[str] = "file_failed"
+
+    item: "PlannedDownload"
+    error: str
+
+    def fields(self) -> Dict[str, Any]:
+        return {**_describe(self.item), "error": self.error}
+
+
+@dataclass
+class SchemaChanged(Event):
+    """A saved CSV's columns differ from those of the previous file of its feed."""
+
+    kind: ClassVar[str] = "schema_changed"
+
+    change: "SchemaChange"
+
+    def fields(self) -> Dict[str, Any]:
+        return self.change.to_dict()
+
+
+@dataclass
+class FeedStale(Event):
+    """No new file arrived by one of the feed's deadlines."""
+
+    kind: ClassVar[str] = "feed_stale"
+
+    stale: "StaleFeed"
+
+    def fields(self) -> Dict[str, Any]:
+        return self.stale.to_dict()
+
+
+@dataclass
+class RunDone(Event):
+    """A run of DownloadService.execute finished."""
+
+    kind: ClassVar[str] = "run_done"
+
+    saved: int
+    failed: int
+    total_bytes: int
+
+    def fields(self) -> Dict[str, Any]:
+        return {
+            "saved": self.saved, "failed": self.failed, "total_bytes": self.total_bytes
+        }
+
+
+# Put on a channel when it is closed, to wake its reader
+_CLOSED = object()
+
+
+class Channel:
+    """One subscriber's queue of events, read with get() or async for."""
+
+    def __init__(self, bus: "EventBus", maxsize: int = 0):
+        self._bus = bus
+        self._queue: asyncio.Queue = asyncio.Queue(maxsize)
+        self._closed = False
+        self.dropped = 0
+
+    async def _put(self, event: Any) -> None:
+        if self._queue.full() and isinstance(event, FileProgress):
+            self.dropped += 1
+            return
+        await self._queue.put(event)
+
+    async def get(self) -> Optional[Event]:
+        """The next event, or None once the channel is closed and read to the end."""
+        if self._closed and self._queue.empty():
+            return None
+        event = await self._queue.get()
+        return None if event is _CLOSED else event
+
+    def close(self) -> None:
+        """Stop receiving events; readers get the ones already queued, then the end."""
+        self._bus.unsubscribe(self)
+        self._closed = True
+        try:
+            # Wakes a reader waiting on an empty queue
+            self._queue.put_nowait(_CLOSED)
+        except asyncio.QueueFull:
+            pass
+
+    def __aiter__(self) -> "Channel":
+        return self
+
+    async def __anext__(self) -> Event:
+        event = await self.get()
+        if event is None:
+            raise StopAsyncIteration
+        return event
+
+
+class EventBus:
+    """Delivers each published event to every subscribed channel."""
+
+    def __init__(self):
+        self._channels: List[Channel] = []
+
+    def subscribe(self, maxsize: int = 0) -> Channel:
+        """
+        A new channel receiving events published from now on.
+
+        Args:
+            maxsize: Events the channel holds before publishing waits (or
+                drops FileProgress); 0 = no limit
+        """
+        channel = Channel(self, maxsize)
+        self._channels.append(channel)
+        return channel
+
+    def unsubscribe(self, channel: Channel) -> None:
+        """Stop delivering events to channel."""
+        if channel in self._channels:
+            self._channels.remove(channel)
+
+    async def publish(self, event: Event) -> None:
+        """Deliver event to every channel, in subscription order."""
+        # A copy: a consumer may unsubscribe while we wait for room
+        for channel in list(self._channels):
+            await channel._put(event)
+
+    def close(self) -> None:
+        """Close every channel (see Channel.close)."""
+        for channel in list(self._channels):
+            channel.close()
+
+
+class EventMetrics:
+    """Running totals of the events on a channel, e.g. for health checks."""
+
+    def __init__(self):
+        self.counts: Dict[str, int] = {}
+        self.bytes_saved = 0
+        self.last_failure = ""
+
+    def record(self, event: Event) -> None:
+        """Count one event."""
+        self.counts[event.kind] = self.counts.get(event.kind, 0) + 1
+        if isinstance(event, FileDone):
+            self.bytes_saved += event.entry.size
+        elif isinstance(event, FileFailed):
+            self.last_failure = f"{event.item.filename}: {event.error}"
+
+    async def consume(self, channel: Channel) -> None:
+        """Count events from channel until it closes."""
+        async for event in channel:
+            self.record(event)
+
+    def snapshot(self) -> Dict[str, Any]:
+        """The totals as JSON-ready data."""
+        return {
+            "files_started": self.counts.get(FileStarted.kind, 0),
+            "files_done": self.counts.get(FileDone.kind, 0),
+            "files_failed": self.counts.get(FileFailed.kind, 0),
+            "searches": self.counts.get(SearchStarted.kind, 0),
+            "runs": self.counts.get(RunDone.kind, 0),
+            "feeds_stale": self.counts.get(FeedStale.kind, 0),
+            "bytes_saved": self.bytes_saved,
+            "last_failure": self.last_failure,
+        }
+
+
+async def write_json_lines(channel: Channel, stream: IO[str]) -> None:
+    """Write each event from channel to stream as a line of JSON, until it closes."""
+    async for event in channel:
+        stream.write(json.dumps(event.to_dict(), default=str) + "\n")
+        stream.flush()
@@ -0,0 +1,78 @@
+"""
+Exit codes, for cron jobs and orchestrators to branch on.
+
+A scheduled run that fails should say why in its exit status, so an
+Airflow sensor or a wrapper script can tell "sign in again" from "try again
+tomorrow" from "nothing new today" without parsing the output:
+
+    0  success
+    1  any other error (including invalid command-line options)
+    2  authentication failed: not signed in, token revoked or lacking scopes
+    3  the daily API quota is exhausted
+    4  the run finished, but some attachments failed to download
+    5  the configuration file is invalid or unreadable
+    6  nothing matched the filters (the search found no attachments)
+
+Usage errors caught by Typer itself (an unknown option or a missing
+argument) print a "Usage:" line and exit with 1 too, not with Click's usual
+2, so 2 always means "sign in again" (see main.CommandGroup).
+"""
+
+from typing import Optional
+
+from .config import ConfigurationError
+from .gmail_client import GmailAuthenticationError, GmailQuotaExceededError
+
+EXIT_OK = 0
+EXIT_ERROR = 1
+EXIT_AUTH = 2
+EXIT_QUOTA = 3
+EXIT_PARTIAL = 4
+EXIT_CONFIG = 5
+EXIT_NOTHING_MATCHED = 6
+
+# (code, meaning) for the man page's EXIT STATUS section
+EXIT_CODE_MEANINGS = [
+    (EXIT_OK, "Success"),
+    (EXIT_ERROR, "Any other error, including invalid command-line options"),
+    (
+        EXIT_AUTH,
+        "Authentication failed: not signed in, token revoked or lacking scopes",
+    ),
+    (EXIT_QUOTA, "The daily API quota is exhausted"),
+    (EXIT_PARTIAL, "The run finished, but some attachments failed to download"),
+    (EXIT_CONFIG, "The configuration file is invalid or unreadable"),
+    (EXIT_NOTHING_MATCHED, "Nothing matched the filters"),
+]
+
+# Each code as a word, the status of run --json-summary
+EXIT_STATUS_NAMES = {
+    EXIT_OK: "success",
+    EXIT_ERROR: "error",
+    EXIT_AUTH: "auth_failed",
+    EXIT_QUOTA: "quota_exhausted",
+    EXIT_PARTIAL: "partial",
+    EXIT_CONFIG: "config_error",
+    EXIT_NOTHING_MATCHED: "nothing_matched",
+}
+
+
+def exit_code_for(error: BaseException) -> int:
+    """
+    The exit code for a run that ended with error.
+
+    Errors are often re-raised wrapped in a more general one ("Failed to
+    search messages: ..."), so the chain of causes is searched too.
+    """
+    seen = set()
+    current: Optional[BaseException] = error
+    while current is not None and id(current) not in seen:
+        seen.add(id(current))
+        if isinstance(current, GmailAuthenticationError):
+            return EXIT_AUTH
+        if isinstance(current, GmailQuotaExceededError):
+            return EXIT_QUOTA
+        if isinstance(current, ConfigurationError):
+            return EXIT_CONFIG
+        current = current.__cause__ or current.__context__
+    return EXIT_ERROR
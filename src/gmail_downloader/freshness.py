@@ -0,0 +1,190 @@
+"""
+Stale feed alerts while watching.
+
+A downloader that runs fine but receives nothing looks exactly like one
+that works, until someone notices the dashboard is a week old. With
+freshness.expected_by, watch also checks that each feed delivers on time:
+
+    rules:
+      - name: sales
+        filters:
+          senders: ["bi@vendor.com"]
+        freshness:
+          expected_by: ["0 9 * * MON-FRI"]
+
+The deadlines are cron expressions (see schedule.py). At each one, plus
+freshness.grace for the last mail to be downloaded, the feed needs a file
+sent since the previous deadline: here, one every weekday by 09:00. If
+there is none, the feed is stale: a warning is logged, a FeedStale event
+published (counted in the health report's events as feeds_stale), and with
+freshness.notify the webhook gets an alert. The feed is reported once per
+missed deadline; the next file sent clears it.
+
+What arrived before watch started is read from the manifest: the newest
+file from the configured senders with a matching name.
+"""
+
+import asyncio
+import logging
+from dataclasses import dataclass
+from datetime import datetime
+from typing import Any, Dict, Iterable, Optional
+
+from .config import AppConfig, FilterConfig
+from .events import EventBus, FeedStale
+from .manifest import ManifestEntry, entry_time
+from .notifier import WebhookNotifier
+from .schedule import next_run, parse_schedules, previous_run
+from .storage import Location
+from .utils import matches_filename_pattern, matches_sender, parse_duration
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class StaleFeed:
+    """A feed that had no new file by a deadline."""
+
+    # The watch rule, or the profile without rules
+    feed: str
+
+    deadline: datetime
+
+    # Where the window the file was due in began: the previous deadline
+    since: datetime
+
+    # When the newest file known was sent; None if there never was one
+    last_arrival: Optional[datetime]
+
+    def describe(self) -> str:
+        last = (
+            f"the last one was sent {self.last_arrival:%Y-%m-%d %H:%M}"
+            if self.last_arrival
+            else "none ever arrived"
+        )
+        return (
+            f"Feed {self.feed} is stale: no file sent between "
+            f"{self.since:%Y-%m-%d %H:%M} "
+            f"and the {self.deadline:%Y-%m-%d %H:%M} deadline; {last}"
+        )
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "feed": self.feed,
+            "deadline": self.deadline.isoformat(),
+            "since": self.since.isoformat(),
+            "last_arrival": self.last_arrival.isoformat()
+            if self.last_arrival
+            else None,
+        }
+
+
+def matches_feed(entry: ManifestEntry, filters: FilterConfig) -> bool:
+    """Whether a manifest entry is a file of the feed the filters describe."""
+    extensions = [extension.lower() for extension in filters.extensions]
+    return (
+        matches_sender(entry.sender, filters.senders)
+        and matches_filename_pattern(entry.filename, filters.filename_patterns)
+        and (
+            not extensions or any(
+                entry.filename.lower().endswith(extension) for extension in extensions
+            )
+        )
+    )
+
+
+def latest_arrival(
+    entries: Iterable[ManifestEntry], filters: FilterConfig
+) -> Optional[datetime]:
+    """When the newest file of the feed in entries was sent."""
+    times = [
+        entry_time(entry)
+        for entry in entries
+        if not entry.quarantine and matches_feed(entry, filters)
+    ]
+    return max((when for when in times if when is not None), default=None)
+
+
+class FreshnessMonitor:
+    """Checks one feed at its freshness.expected_by deadlines."""
+
+    def __init__(self, feed: str, config: AppConfig, events: EventBus,
+                 last_arrival: Optional[datetime] = None):
+        self.feed = feed
+        self.config = config
+        self.events = events
+        self.last_arrival = last_arrival
+
+        # The current alert, cleared by the next file; and how many so far
+        self.stale: Optional[StaleFeed] = None
+        self.alerts = 0
+
+        self.next_deadline: Optional[datetime] = None
+
+    async def record(self, entry: ManifestEntry, path: Location) -> None:
+        """
+        Note a saved file of the feed.
+
+        A DownloadService download listener.
+        """
+        when = entry_time(entry)
+        if when is None or (self.last_arrival and when <= self.last_arrival):
+            return
+        self.last_arrival = when
+        if self.stale and when > self.stale.since:
+            logger.info(
+                f"Feed {self.feed} is fresh again: {entry.filename} sent "
+                f"{when:%Y-%m-%d %H:%M}"
+            )
+            self.stale = None
+
+    async def check(self, deadline: datetime) -> Optional[StaleFeed]:
+        """
+        Check that a file was sent in the window ending at deadline, and
+        raise the alert if not.
+
+        Returns:
+            The stale feed, None if a file arrived in time
+        """
+        since = previous_run(
+            parse_schedules(self.config.freshness.expected_by), deadline
+        )
+        if self.last_arrival and since < self.last_arrival <= deadline:
+            return None
+        if self.last_arrival and self.last_arrival > deadline:
+            return None  # Late, but here by now
+
+        stale = StaleFeed(self.feed, deadline, since, self.last_arrival)
+        self.stale = stale
+        self.alerts += 1
+        logger.warning(stale.describe())
+        await self.events.publish(FeedStale(stale))
+        if self.config.freshness.notify:
+            await WebhookNotifier(self.config.notifications).notify_stale_feed(stale)
+        return stale
+
+    async def run(self) -> None:
+        """Check at every deadline until cancelled."""
+        while self.config.freshness.expected_by:
+            schedules = parse_schedules(self.config.freshness.expected_by)
+            now = datetime.now()
+            self.next_deadline = next_run(schedules, now)
+            grace = parse_duration(self.config.freshness.grace)
+            await asyncio.sleep((self.next_deadline + grace - now).total_seconds())
+            await self.check(self.next_deadline)
+        self.next_deadline = None
+
+    def status(self) -> Dict[str, Any]:
+        """The feed's freshness, for the health report."""
+        return {
+            "expected_by": self.config.freshness.expected_by,
+            "last_arrival": self.last_arrival.isoformat()
+            if self.last_arrival
+            else None,
+            "next_deadline": self.next_deadline.isoformat()
+            if self.next_deadline
+            else None,
+            "stale": self.stale is not None,
+            "stale_since": self.stale.deadline.isoformat() if self.stale else None,
+            "alerts": self.alerts,
+        }
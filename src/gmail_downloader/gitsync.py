@@ -0,0 +1,255 @@
+"""
+Committing downloads to git.
+
+When download.base_dir is inside a git repository and
+integrations.git.enabled is set, every saved attachment is committed, one
+commit each, when the run that downloaded it ends, so the history of the
+data is versioned without anyone remembering to do it:
+
+    git lfs track "downloads/**/*.pdf"
+    git add -- downloads/vendor.com/2024-06/invoice.pdf .gitattributes
+    git commit -m "Add invoice.pdf from ap@vendor.com: Q2 (2024-06-01T09:30:12)" -- ...
+    ...
+    git push origin HEAD
+
+With push, the commits of a run are pushed together after the last one.
+
+With lfs (the default) the files go to Git LFS, tracked by extension below
+the download directory, so the repository itself only holds pointers. Only
+the file and what was saved with it (its .meta.json sidecar, its text with
+transforms.pdf_text, and with integrations.dvc its .dvc file instead of the
+data, added by then) are committed; anything else staged in the repository
+is left alone.
+
+Like a rule's run command, a git command that fails is logged and never
+stops the download; the file stays saved and in the manifest either way.
+"""
+
+import asyncio
+import logging
+import shlex
+import weakref
+from datetime import datetime
+from pathlib import Path
+from typing import Dict, List, Optional, Set, Tuple
+
+from .config import GitConfig
+from .dvc import DVC_FILE_SUFFIX
+from .manifest import ManifestEntry
+from .programs import find_root, run_program
+from .storage import Location
+from .transforms import TEXT_SUFFIX
+
+logger = logging.getLogger(__name__)
+
+# Git's directory, or file in a worktree, marking a repository's root
+GIT_DIR = ".git"
+
+# Written by git lfs track at the repository's root
+GITATTRIBUTES = ".gitattributes"
+
+# How long one git command may take (a push of a run's files included)
+GIT_TIMEOUT_SECONDS = 600
+
+# One commit at a time per repository, even from several watch rules; by
+# event loop, as an asyncio lock only works in one
+_repo_locks: (
+    "weakref.WeakKeyDictionary[asyncio.AbstractEventLoop, Dict[Path, asyncio.Lock]]"
+) = weakref.WeakKeyDictionary()
+
+
+def find_repo(path: Location) -> Optional[Path]:
+    """The root of the git repository path is in, None outside one."""
+    return find_root(path, GIT_DIR)
+
+
+def repo_lock(repo: Path) -> asyncio.Lock:
+    """The lock serializing commits to repo in the running event loop."""
+    locks = _repo_locks.setdefault(asyncio.get_running_loop(), {})
+    return locks.setdefault(repo, asyncio.Lock())
+
+
+def lfs_pattern(path: Path, base_dir: Path, repo: Path) -> Tuple[str, bool]:
+    """
+    What git lfs track is given for a file saved below base_dir.
+
+    Returns:
+        The pattern, and whether it is a literal filename: files with an
+        extension are tracked by it below base_dir, others one by one
+    """
+    if not path.suffix:
+        return path.relative_to(repo).as_posix(), True
+    below = base_dir.relative_to(repo).as_posix()
+    if below == ".":
+        return f"*{path.suffix}", False
+    return f"{below}/**/*{path.suffix}", False
+
+
+class MessageDate(str):
+    """
+    The {date} of a commit message: the email's date as the manifest stores
+    it, or formatted by a strftime spec such as {date:%Y-%m}.
+    """
+
+    def __format__(self, spec: str) -> str:
+        if not spec:
+            return str(self)
+        try:
+            return datetime.fromisoformat(self).strftime(spec)
+        except ValueError:
+            return str(self)
+
+
+def commit_message(template: str, entry: ManifestEntry) -> str:
+    """The commit message for a saved file."""
+    return template.format_map({
+        "filename": entry.filename,
+        "path": entry.path,
+        "sender": entry.sender,
+        "subject": entry.subject,
+        "date": MessageDate(entry.date),
+        "message_id": entry.message_id,
+        "size": entry.size,
+    })
+
+
+class GitCommitter:
+    """Commits saved files to one git repository."""
+
+    def __init__(self, config: GitConfig, repo: Path, base_dir: Path):
+        self.config = config
+        self.repo = repo
+        self.base_dir = base_dir
+
+        # LFS patterns tracked so far in this session
+        self.tracked: Set[str] = set()
+
+        # Saved files waiting for the next flush, by path
+        self.pending: Dict[Path, ManifestEntry] = {}
+
+    async def run(
+        self, arguments: List[str], allowed: Tuple[int, ...] = (0,)
+    ) -> Optional[int]:
+        """
+        Run git with arguments in the repository.
+
+        Returns:
+            Its exit code, None if it could not be started or timed out;
+            codes other than allowed are logged as errors
+        """
+        command = shlex.split(self.config.command) + arguments
+        return await run_program(
+            "Git", command, self.repo, GIT_TIMEOUT_SECONDS, allowed
+        )
+
+    def files_for(self, path: Path) -> List[Path]:
+        """
+        What to commit for a saved file: the file and its sidecars, or, when
+        DVC tracks the file, its .dvc file and the .gitignore DVC updated
+        instead of the file.
+        """
+        # Imported here: the downloader imports this module
+        from .downloader import SIDECAR_SUFFIX
+
+        dvc_file = path.with_name(path.name + DVC_FILE_SUFFIX)
+        if dvc_file.exists():
+            files = [dvc_file, path.parent / ".gitignore"]
+        else:
+            files = [path]
+        files += [
+            path.with_name(path.name + suffix)
+            for suffix in (SIDECAR_SUFFIX, TEXT_SUFFIX)
+        ]
+        return [file for file in files if file.exists()]
+
+    async def track_lfs(self, path: Path) -> bool:
+        """Have LFS store path, by its extension where it has one."""
+        pattern, literal = lfs_pattern(path, self.base_dir, self.repo)
+        if pattern in self.tracked:
+            return True
+        arguments = ["lfs", "track"] + (["--filename"] if literal else []) + [pattern]
+        if await self.run(arguments) != 0:
+            return False
+        self.tracked.add(pattern)
+        return True
+
+    async def queue(self, entry: ManifestEntry, path: Location) -> None:
+        """
+        Have the next flush commit a saved file.
+
+        A DownloadService download listener.
+        """
+        self.pending[Path(path).resolve()] = entry
+
+    async def flush(self) -> bool:
+        """
+        Commit the queued files, in the order they were saved, then push
+        once if set to.
+
+        Returns:
+            Whether every file was committed (or had not changed) and pushed
+        """
+        pending, self.pending = self.pending, {}
+        pending = {path: entry for path, entry in pending.items() if path.exists()}
+        if not pending:
+            return True
+        async with repo_lock(self.repo):
+            success = True
+            for path, entry in pending.items():
+                success = await self.commit(entry, path) and success
+            if not self.config.push:
+                return success
+            pushed = await self.run(
+                ["push", "--quiet", self.config.remote or "origin", "HEAD"]
+            ) == 0
+            return pushed and success
+
+    async def commit(self, entry: ManifestEntry, path: Location) -> bool:
+        """
+        Commit a saved file.
+
+        Returns:
+            Whether the file was committed (or had not changed)
+        """
+        path = Path(path).resolve()
+        files = self.files_for(path)
+        if self.config.lfs and path in files:
+            if not await self.track_lfs(path):
+                return False
+            files.append(self.repo / GITATTRIBUTES)
+        paths = [file.relative_to(self.repo).as_posix() for file in files]
+
+        if await self.run(["add", "--"] + paths) != 0:
+            return False
+        changed = await self.run(
+            ["diff", "--cached", "--quiet", "--"] + paths, allowed=(0, 1)
+        )
+        if changed is None:
+            return False
+        if changed == 0:
+            logger.debug(f"Git: {path.name} is unchanged; nothing to commit")
+            return True
+        message = commit_message(self.config.message, entry)
+        if await self.run(["commit", "--quiet", "-m", message, "--"] + paths) != 0:
+            return False
+        logger.info(f"Git: committed {path.relative_to(self.repo)}")
+        return True
+
+
+def open_git(config: GitConfig, base_dir: Location) -> Optional[GitCommitter]:
+    """
+    The committer for downloads into base_dir, if integrations.git is on.
+
+    Outside a git repository nothing is committed, with a warning.
+    """
+    if not config.enabled:
+        return None
+    repo = find_repo(base_dir)
+    if repo is None:
+        logger.warning(
+            "integrations.git is enabled, but "
+            f"{base_dir} is not inside a git repository; "
+            f"downloads are not committed"
+        )
+        return None
+    return GitCommitter(config, repo, Path(base_dir).expanduser().resolve())
@@ -16,12 +16,30 @@ including proper authentication, rate limiting, and error handling patterns.
 
 import asyncio
 import base64
+import email
 import json
 import logging
+import os
+import re
 import time
+import urllib.parse
 from datetime import datetime, timedelta, timezone
+from email import policy
+from email.errors import HeaderParseError
+from email.header import decode_header, make_header
 from pathlib import Path
-from typing import List, Dict, Any, Optional, AsyncIterator, Tuple
+from typing import (
+    List,
+    Dict,
+    Any,
+    Optional,
+    AsyncIterator,
+    Callable,
+    Protocol,
+    Set,
+    Tuple,
+    runtime_checkable,
+)
 
 import backoff
 from google.auth.transport.requests import Request
@@ -32,14 +50,19 @@ from googleapiclient.errors import HttpError
 from google.auth.exceptions import RefreshError
 
 # Import our helper functions - ALWAYS use these instead of reimplementing
-from .config import AppConfig, load_config
+from .config import AppConfig, GmailConfig, load_config
+from .network import authorized_http, configure_session, requests_session
+from .tokenstore import TokenStoreError, open_token_store
 from .utils import (
     is_valid_email,
+    extract_all_emails,
+    extract_display_name,
     extract_email_address,
     parse_date,
+    day_start_timestamp,
+    parse_email_date,
     sanitize_filename,
     format_file_size,
-    ensure_directory,
 )
 
 
@@ -64,6 +87,11 @@ class GmailRateLimitError(GmailError):
         )
 
 
+class GmailTimeoutError(GmailError):
+    """Raised when a Gmail API request times out (network.request_timeout_seconds)."""
+    pass
+
+
 class GmailQuotaExceededError(GmailError):
     """Raised when Gmail API quota is exceeded."""
     pass
@@ -75,7 +103,7 @@ class GmailAttachmentError(GmailError):
 
 
 # Data classes for structured data
-from dataclasses import dataclass
+from dataclasses import dataclass, field
 
 
 @dataclass
@@ -92,6 +120,11 @@ class EmailMessage:
     has_attachments: bool
     attachment_count: int = 0
     raw_message: Optional[Dict[str, Any]] = None
+    labels: List[str] = field(default_factory=list)  # Label names at fetch time
+    sender_name: str = ""  # Display name from the From header, if any
+    recipients: List[str] = field(default_factory=list)  # Every To and Cc address
+    # When Gmail received it (internalDate), which after: searches
+    received: Optional[datetime] = None
 
 
 @dataclass
@@ -103,6 +136,11 @@ class EmailAttachment:
     filename: str
     mime_type: str
     size: int
+    # MIME part path such as "1" or "0.2" (stable, unlike attachment_id)
+    part_id: str = ""
+    # Content-ID without <>, set when the HTML body refers to the part
+    content_id: str = ""
+    inline: bool = False  # Content-Disposition: inline
     
     @property
     def extension(self) -> str:
@@ -118,6 +156,557 @@ class EmailAttachment:
     def size_display(self) -> str:
         """Get human-readable size - ALWAYS use utils.format_file_size()."""
         return format_file_size(self.size)
+    
+    @property
+    def is_image(self) -> bool:
+        """Whether the attachment is an image, by MIME type or extension."""
+        return (
+            self.mime_type.lower().startswith("image/")
+            or self.extension in IMAGE_EXTENSIONS
+        )
+    
+    @property
+    def is_inline_image(self) -> bool:
+        """
+        Whether this is an image embedded in the message body rather than a file.
+        
+        Logos and signature images are shown in the HTML body, so they carry
+        a Content-ID (the HTML refers to them as cid:...) or an inline
+        disposition, and they are small; a large inline image is more likely
+        a photo someone pasted in. Images under TINY_IMAGE_SIZE are tracking
+        pixels and spacers however they are attached.
+        """
+        if not self.is_image:
+            return False
+        if self.size < TINY_IMAGE_SIZE:
+            return True
+        return (
+            bool(self.content_id) or self.inline
+        ) and self.size <= INLINE_IMAGE_MAX_SIZE
+
+
+IMAGE_EXTENSIONS = {
+    ".png", ".jpg", ".jpeg", ".gif", ".bmp", ".webp", ".tif", ".tiff", ".svg"
+}
+
+# Inline images up to this size count as body decoration (see is_inline_image)
+INLINE_IMAGE_MAX_SIZE = 100 * 1024
+
+# Images below this size are never real content
+TINY_IMAGE_SIZE = 2 * 1024
+
+
+# Gmail permanently deletes messages 30 days after they go to Trash or Spam
+TRASH_RETENTION_DAYS = 30
+
+
+def days_until_purge(
+    message_date: datetime, now: Optional[datetime] = None
+) -> Optional[int]:
+    """
+    Estimate how many days a trashed message has left before Gmail purges it.
+    
+    The API does not say when a message was trashed, only when it was sent.
+    A message cannot be trashed before it arrives, so counting from the
+    message date gives a lower bound: the message has *at least* this many
+    days left.
+    
+    Returns:
+        Minimum days left, or None once the message is older than the
+        retention period (it may have been trashed at any point since)
+    """
+    now = now or datetime.now(message_date.tzinfo)
+    days_left = TRASH_RETENTION_DAYS - (now - message_date).days
+    return days_left if days_left > 0 else None
+
+
+def label_search_term(name: str) -> str:
+    """
+    Gmail search term for a label.
+    
+    Search writes label names in lower case with spaces and the "/" of
+    nested labels replaced by "-", so "Clients/Acme Corp" is
+    label:clients-acme-corp.
+    """
+    return "label:" + re.sub(r"[\s/]+", "-", name.strip()).lower()
+
+
+# Gmail API message and thread IDs are hexadecimal
+GMAIL_ID = re.compile(r"^[0-9a-f]{10,24}$", re.IGNORECASE)
+
+
+def parse_message_reference(value: str) -> Tuple[str, str]:
+    """
+    Work out which message(s) a --message-id value names.
+    
+    Accepted are a Gmail API message ID ("18ac3f0d2e7b5a91"), a Gmail web
+    URL ending in a conversation ID
+    (https://mail.google.com/mail/u/0/#inbox/18ac3f0d2e7b5a91), the URL of a message's
+    "Show original" page (...&permmsgid=msg-f:1778..., the message ID in decimal) and a
+    Message-ID header ("<CAF3x...@mail.gmail.com>", as shown by "Show original").
+    
+    Gmail's newer web URLs end in a token (#inbox/FMfcgz...) instead of the
+    conversation ID. Its encoding is undocumented and the API has no way to
+    look it up, so it is refused with a pointer to "Show original", whose
+    URL always carries the ID.
+    
+    Returns:
+        ("message", id), ("thread", id) or ("rfc822", Message-ID without <>)
+    
+    Raises:
+        ValueError: If the value is none of these
+    """
+    value = value.strip()
+    
+    if value.lower().startswith(("http://", "https://")):
+        url = urllib.parse.urlsplit(value)
+        if not url.hostname or not url.hostname.endswith("mail.google.com"):
+            raise ValueError(f"Not a Gmail URL: {value}")
+        permmsgid = urllib.parse.parse_qs(url.query).get("permmsgid", [""])[0]
+        match = re.fullmatch(r"msg-f:(\d+)", permmsgid)
+        if match:
+            return "message", format(int(match.group(1)), "x")
+        last = url.fragment.split("?")[0].rstrip("/").split("/")[-1]
+        if GMAIL_ID.match(last):
+            return "thread", last.lower()
+        raise ValueError(
+            f"This Gmail URL does not contain the message ID: {value}. "
+            "Open the message's \"Show original\" and pass "
+            "that page's URL, or its Message-ID, instead"
+        )
+    
+    if "@" in value:
+        return "rfc822", value.strip("<>")
+    
+    if GMAIL_ID.match(value):
+        return "message", value.lower()
+    
+    raise ValueError(f"Not a Gmail message ID, Gmail URL or Message-ID: {value}")
+
+
+# charset'language'percent-encoded-value, as in RFC 2231 filename*= parameters
+RFC2231_VALUE = re.compile(r"^([A-Za-z0-9_.:-]+)'[^']*'(.*)$")
+
+
+def decode_filename(value: str) -> str:
+    """
+    Decode an RFC 2047 or RFC 2231 encoded filename to plain Unicode.
+    
+    Mail clients encode non-ASCII names as "=?UTF-8?B?5aCx5ZGK5pu4LnBkZg==?="
+    (RFC 2047) or "UTF-8''%E5%A0%B1%E5%91%8A.pdf" (RFC 2231). Names that
+    are not encoded, or cannot be decoded, are returned unchanged.
+    """
+    match = RFC2231_VALUE.match(value)
+    if match and "%" in match.group(2):
+        try:
+            return urllib.parse.unquote(
+                match.group(2), encoding=match.group(1), errors="strict"
+            )
+        except (LookupError, UnicodeDecodeError):
+            return value
+    
+    if "=?" in value:
+        try:
+            return str(make_header(decode_header(value)))
+        except (LookupError, UnicodeDecodeError, HeaderParseError, ValueError):
+            return value
+    
+    return value
+
+
+def part_filename(part: Dict[str, Any]) -> str:
+    """
+    Filename of a Gmail payload part, decoded to Unicode.
+    
+    Gmail usually decodes names itself, but leaves some encoded, and gives
+    no filename at all for parts that only carry one as a Content-Type
+    name or an RFC 2231 filename*= parameter. Those are read from the
+    part's headers instead.
+    """
+    filename = part.get("filename", "")
+    if filename and "=?" not in filename and not RFC2231_VALUE.match(filename):
+        return filename
+    
+    headers = "".join(
+        f"{header['name']}: {header['value']}\r\n"
+        for header in part.get("headers", [])
+        if header.get("name", "").lower() in ("content-disposition", "content-type")
+    )
+    if headers:
+        try:
+            parsed = email.message_from_string(headers + "\r\n", policy=policy.default)
+            filename = parsed.get_filename() or filename
+        except (HeaderParseError, ValueError, LookupError):
+            pass
+    
+    return decode_filename(filename) if filename else ""
+
+
+def part_header(part: Dict[str, Any], name: str) -> str:
+    """Value of a header of a Gmail payload part, or "" if it has none."""
+    for header in part.get("headers", []):
+        if header.get("name", "").lower() == name.lower():
+            return header.get("value", "")
+    return ""
+
+
+def extract_raw_attachment(raw: bytes, part_id: str, filename: str) -> Optional[bytes]:
+    """
+    Pull one attachment out of a raw RFC 822 message.
+    
+    Gmail part IDs are paths into the MIME tree ("1", "0.2"), so the part is
+    looked up by position first and by filename if that does not match.
+    
+    Returns:
+        The decoded attachment bytes, or None if it is not in the message
+    """
+    message = email.message_from_bytes(raw, policy=policy.default)
+    
+    part = message
+    try:
+        for index in part_id.split(".") if part_id else []:
+            part = part.get_payload()[int(index)]
+    except (IndexError, ValueError, TypeError, AttributeError):
+        part = None
+    
+    def name_of(part) -> str:
+        return decode_filename(part.get_filename() or "")
+    
+    if part is None or name_of(part) != filename:
+        part = next((p for p in message.walk() if name_of(p) == filename), None)
+    
+    return part.get_payload(decode=True) if part is not None else None
+
+
+def extract_message_bodies(payload: Dict[str, Any]) -> Dict[str, str]:
+    """
+    Find the text and HTML bodies in a message payload.
+    
+    Bodies are the text/plain and text/html parts that are not attachments
+    (no filename). Gmail nests them in multipart/alternative and
+    multipart/mixed parts, so the payload is searched recursively and the
+    first part of each type wins.
+    
+    Returns:
+        {"text": ..., "html": ...} with only the types the message has
+    """
+    bodies: Dict[str, str] = {}
+    
+    def visit(part: Dict[str, Any]) -> None:
+        mime_type = part.get("mimeType", "")
+        kind = {"text/plain": "text", "text/html": "html"}.get(mime_type)
+        data = part.get("body", {}).get("data")
+        
+        if kind and kind not in bodies and data and not part.get("filename"):
+            headers = {h["name"].lower(): h["value"] for h in part.get("headers", [])}
+            match = re.search(
+                r'charset="?([\w.:-]+)', headers.get("content-type", ""), re.I
+            )
+            raw = base64.urlsafe_b64decode(data)
+            try:
+                bodies[kind] = raw.decode(
+                    match.group(1) if match else "utf-8", errors="replace"
+                )
+            except LookupError:
+                bodies[kind] = raw.decode("utf-8", errors="replace")  # Unknown charset
+        
+        for child in part.get("parts", []):
+            visit(child)
+    
+    visit(payload)
+    return bodies
+
+
+# Quota units each Gmail API method costs
+QUOTA_COSTS = {
+    "messages.list": 5,
+    "messages.get": 5,
+    "messages.attachments.get": 10,
+    "threads.get": 10,
+    "labels.list": 1,
+    "labels.create": 5,
+    "messages.modify": 5,
+    "getProfile": 1,
+}
+
+# Longest search query sent to Gmail; longer ones fail or silently drop
+# terms, so DownloadService.build_queries splits long sender/label lists
+MAX_QUERY_LENGTH = 1500
+
+# Warn once a profile has used this share of its daily quota
+QUOTA_WARNING_RATIO = 0.8
+
+
+def quota_day(now: Optional[datetime] = None) -> str:
+    """The quota day (Google resets daily quotas at midnight Pacific Time)."""
+    try:
+        from zoneinfo import ZoneInfo
+        pacific = ZoneInfo("America/Los_Angeles")
+    except Exception:
+        # No time zone database; standard time is close enough
+        pacific = timezone(timedelta(hours=-8))
+    return (now or datetime.now(timezone.utc)).astimezone(pacific).date().isoformat()
+
+
+class QuotaTracker:
+    """
+    Rate limiter and daily quota accounting for one Gmail account.
+    
+    Google enforces quotas per user, so every profile gets its own tracker.
+    Clients for the same profile within one process share a tracker (see
+    get_quota_tracker), while different profiles never throttle each other.
+    
+    stats count this run. The daily count is kept in a state file once one
+    is attached (GmailClient.authenticate does), so it adds up across runs
+    until the quota day ends.
+    """
+    
+    def __init__(self, profile: str, requests_per_minute: int, requests_per_day: int):
+        """Create a tracker with fresh counters"""
+        self.profile = profile
+        self.requests_per_day = requests_per_day
+        
+        # Concurrent requests allowed, derived from the per-minute limit
+        self.semaphore = asyncio.Semaphore(max(1, requests_per_minute // 60))
+        
+        self.quota_used = 0
+        self.day = quota_day()
+        self.state_path: Optional[Path] = None
+        self._warned = False
+        
+        self.stats = {
+            "requests_made": 0,
+            "quota_units_used": 0,
+            "rate_limit_hits": 0,
+            "authentication_refreshes": 0,
+        }
+    
+    def attach_state(self, path: Path) -> None:
+        """Keep the daily count in path, adding what earlier runs used today"""
+        if self.state_path is not None:
+            return
+        self.state_path = Path(path)
+        try:
+            with open(self.state_path, "r") as f:
+                state = json.load(f)
+            if state.get("day") == self.day:
+                self.quota_used += int(state.get("quota_used", 0))
+        except (OSError, ValueError, TypeError):
+            pass
+        self._save()
+    
+    def _save(self) -> None:
+        """Write the daily count atomically, so a crash never leaves half a file"""
+        if self.state_path is None:
+            return
+        temp_path = self.state_path.with_suffix(".tmp")
+        try:
+            temp_path.write_text(
+                json.dumps({"day": self.day, "quota_used": self.quota_used})
+            )
+            os.replace(temp_path, self.state_path)
+        except OSError as e:
+            logging.getLogger(__name__).debug(f"Could not save quota usage: {e}")
+    
+    def remaining(self) -> int:
+        """Quota units left today"""
+        return max(0, self.requests_per_day - self.quota_used)
+    
+    def check(self, quota_units: int) -> None:
+        """Raise GmailQuotaExceededError if a request would exceed the daily quota"""
+        today = quota_day()
+        if today != self.day:
+            self.quota_used = 0
+            self.day = today
+            self._warned = False
+            logging.getLogger(__name__).info(
+                f"Daily quota counter reset for {self.profile}"
+            )
+        
+        if self.quota_used + quota_units > self.requests_per_day:
+            raise GmailQuotaExceededError(
+                f"Daily quota exceeded for {self.profile}: "
+                f"{self.quota_used} + {quota_units} > {self.requests_per_day}"
+            )
+    
+    def record(self, quota_units: int) -> None:
+        """Count a completed request"""
+        self.stats["requests_made"] += 1
+        self.stats["quota_units_used"] += quota_units
+        self.quota_used += quota_units
+        self._save()
+        
+        if (
+            not self._warned
+            and self.quota_used >= self.requests_per_day * QUOTA_WARNING_RATIO
+        ):
+            self._warned = True
+            logging.getLogger(__name__).warning(
+                f"{self.profile} has used {self.quota_used} of its "
+                f"{self.requests_per_day} "
+                f"daily quota units"
+            )
+    
+    def status(self) -> Dict[str, Any]:
+        """Current quota usage and statistics for this profile"""
+        return {
+            "profile": self.profile,
+            "quota_used_today": self.quota_used,
+            "quota_limit_daily": self.requests_per_day,
+            "quota_remaining": self.remaining(),
+            "quota_day": self.day,
+            "statistics": self.stats.copy(),
+        }
+
+
+# One tracker per profile for the lifetime of the process
+_quota_trackers: Dict[str, QuotaTracker] = {}
+
+
+def get_quota_tracker(profile: str, gmail_config: GmailConfig) -> QuotaTracker:
+    """Return the shared tracker for a profile, creating it on first use"""
+    if profile not in _quota_trackers:
+        _quota_trackers[profile] = QuotaTracker(
+            profile, gmail_config.requests_per_minute, gmail_config.requests_per_day
+        )
+    return _quota_trackers[profile]
+
+
+def reset_quota_trackers() -> None:
+    """
+    Forget every profile's tracker, e.g. between tests or services that
+    should not share counters. Clients already created keep theirs.
+    """
+    _quota_trackers.clear()
+
+
+def quota_state_path(gmail_config: GmailConfig) -> Path:
+    """Where a profile's daily quota usage is kept between runs"""
+    return Path(gmail_config.token_file).with_name(
+        f".{gmail_config.get_profile_name()}-quota.json"
+    )
+
+
+def quota_summary() -> List[Dict[str, Any]]:
+    """Quota status of every profile that made requests in this process"""
+    return [
+        tracker.status()
+        for tracker in _quota_trackers.values()
+        if tracker.stats["requests_made"]
+    ]
+
+
+# OAuth scopes. Downloading only needs to read mail; broader access is
+# requested only while a feature that needs it is turned on
+READONLY_SCOPE = "https://www.googleapis.com/auth/gmail.readonly"
+MODIFY_SCOPE = "https://www.googleapis.com/auth/gmail.modify"
+FULL_MAIL_SCOPE = "https://mail.google.com/"
+DRIVE_SCOPE = "https://www.googleapis.com/auth/drive.readonly"
+
+# Scopes that grant everything others do: a token with the key needs no
+# new consent for the values
+IMPLIED_SCOPES = {
+    MODIFY_SCOPE: {READONLY_SCOPE},
+    FULL_MAIL_SCOPE: {READONLY_SCOPE, MODIFY_SCOPE},
+}
+
+
+def feature_scopes(config: AppConfig) -> Dict[str, str]:
+    """Scopes the enabled features need beyond reading mail, and which need them"""
+    scopes = {}
+    if config.download.drive_links or config.conversions:
+        scopes[DRIVE_SCOPE] = "download.drive_links, conversions"
+    if config.post_actions.labels():
+        scopes[MODIFY_SCOPE] = "post_actions labels"
+    return scopes
+
+
+def required_scopes(config: AppConfig, base: Optional[List[str]] = None) -> List[str]:
+    """
+    The narrowest scopes to sign in with for config: base (gmail.readonly
+    unless given) and those of feature_scopes, leaving out any that another
+    one implies
+    """
+    scopes = list(base or [READONLY_SCOPE])
+    scopes += [scope for scope in feature_scopes(config) if scope not in scopes]
+    return [
+        scope for scope in scopes
+        if not any(scope in IMPLIED_SCOPES.get(other, ()) for other in scopes)
+    ]
+
+
+def missing_scopes(granted: List[str], needed: List[str]) -> List[str]:
+    """The needed scopes granted does not cover, directly or implied"""
+    covered = set(granted)
+    for scope in granted:
+        covered |= IMPLIED_SCOPES.get(scope, set())
+    return [scope for scope in needed if scope not in covered]
+
+
+@runtime_checkable
+class GmailAPI(Protocol):
+    """
+    What the downloader, watcher and CLI need from a Gmail account.
+    
+    GmailClient is the real implementation. Tests can pass anything with
+    these methods instead, such as FakeGmail's client (tests/gmailtest.py),
+    which runs GmailClient itself against an in-memory mailbox.
+    """
+    
+    config: AppConfig
+    credentials: Any
+    
+    async def authenticate(self, interactive: bool = True) -> None: ...
+    
+    def build_search_query(self, **filters: Any) -> str: ...
+    
+    def search_messages(
+        self,
+        query: str,
+        max_results: Optional[int] = None,
+        include_spam_trash: bool = False,
+    ) -> AsyncIterator[str]: ...
+    
+    async def snapshot_message_ids(self, query: str) -> Set[str]: ...
+    
+    def watch_for_new_messages(
+        self,
+        query: str,
+        check_interval: Optional[int] = None,
+        baseline: Optional[Set[str]] = None,
+        on_poll: Optional[Callable[[], Any]] = None,
+        wait: Optional[Callable[[], float]] = None,
+    ) -> AsyncIterator[str]: ...
+    
+    async def get_message_details(
+        self, message_id: str, include_body: bool = False
+    ) -> "EmailMessage": ...
+    
+    async def get_label_names(self) -> Dict[str, str]: ...
+    
+    async def modify_labels(
+        self, message_id: str, add: List[str], remove: List[str]
+    ) -> None: ...
+    
+    async def resolve_message_reference(self, reference: str) -> List[str]: ...
+    
+    async def get_thread_message_ids(self, thread_id: str) -> List[str]: ...
+    
+    async def get_message_attachments(
+        self, message_id: str
+    ) -> List["EmailAttachment"]: ...
+    
+    async def download_attachment(
+        self, message_id: str, attachment_id: str
+    ) -> bytes: ...
+    
+    async def download_attachment_from_raw(
+        self, message_id: str, part_id: str, filename: str
+    ) -> Optional[bytes]: ...
+    
+    async def get_message_bodies(self, message_id: str) -> Dict[str, str]: ...
+    
+    async def get_raw_message(self, message_id: str) -> bytes: ...
 
 
 class GmailClient:
@@ -133,10 +722,16 @@ class GmailClient:
     - Real-time message monitoring
     """
     
-    # Gmail API scopes - readonly is sufficient for our use case
-    SCOPES = ["https://www.googleapis.com/auth/gmail.readonly"]
+    # Gmail API scopes - readonly is sufficient for our use case; features
+    # needing more add theirs (see required_scopes)
+    SCOPES = [READONLY_SCOPE]
     
-    def __init__(self, config_path: Optional[str] = None, config: Optional[AppConfig] = None):
+    # Added for download.drive_links and conversions, to read linked files
+    DRIVE_SCOPE = DRIVE_SCOPE
+    
+    def __init__(
+        self, config_path: Optional[str] = None, config: Optional[AppConfig] = None
+    ):
         """
         Initialize Gmail client with configuration.
         
@@ -156,24 +751,26 @@ class GmailClient:
         self.service = None
         self.credentials = None
         
-        # Rate limiting control
-        self._semaphore = asyncio.Semaphore(
-            self.config.gmail.requests_per_minute // 60
-        )  # Per second limit
-        self._quota_used = 0
-        self._quota_reset_time = datetime.now() + timedelta(days=1)
+        # The same API over connections that wait up to
+        # network.attachment_timeout_seconds, for downloading attachments
+        self.attachment_service = None
         
-        # Statistics tracking
-        self.stats = {
-            "requests_made": 0,
-            "quota_units_used": 0,
-            "rate_limit_hits": 0,
-            "authentication_refreshes": 0,
-        }
+        # Label ID -> name, fetched once per session
+        self._label_names: Optional[Dict[str, str]] = None
+        
+        # Rate limiting and statistics are tracked per profile (Google
+        # account), since that is the unit Google applies quotas to
+        self.profile = self.gmail_config.get_profile_name()
+        self.quota = get_quota_tracker(self.profile, self.gmail_config)
+        self.stats = self.quota.stats
         
         self.logger.info("Gmail client initialized")
     
-    async def authenticate(self) -> None:
+    def scopes(self) -> List[str]:
+        """OAuth scopes needed for the configured features."""
+        return required_scopes(self.config, self.SCOPES)
+    
+    async def authenticate(self, interactive: bool = True) -> None:
         """
         Handle OAuth2 authentication with Google Gmail API.
         
@@ -183,12 +780,16 @@ class GmailClient:
         3. Perform initial authentication flow if needed
         4. Save credentials for future use
         
+        Args:
+            interactive: Whether the browser sign-in may be started. Without
+                it only a saved token is used (e.g. for shell completion).
+        
         Raises:
             GmailAuthenticationError: If authentication fails
         """
         try:
             credentials_path = Path(self.gmail_config.credentials_file)
-            token_path = Path(self.gmail_config.token_file)
+            token_store = open_token_store(self.gmail_config, interactive)
             
             # Ensure credentials file exists
             if not credentials_path.exists():
@@ -197,18 +798,37 @@ class GmailClient:
                     f"Please download OAuth2 credentials from Google Cloud Console"
                 )
             
-            # Ensure the token directory exists - ALWAYS use utils.ensure_directory()
-            ensure_directory(token_path.parent)
-            
             credentials = None
+            scopes = self.scopes()
+            lacking: List[str] = []
             
             # Load existing token if available
-            if token_path.exists():
+            try:
+                token = token_store.load()
+            except TokenStoreError as e:
+                self.logger.warning(f"Failed to load existing credentials: {e}")
+                token = None
+            if token:
                 try:
-                    credentials = Credentials.from_authorized_user_file(
-                        str(token_path), self.SCOPES
-                    )
-                    self.logger.info("Loaded existing credentials from token file")
+                    token_info = json.loads(token)
+                    
+                    # A token granted before a feature needed more access
+                    # (e.g. drive_links) has to be authorized again; one
+                    # granted more than is needed now is kept as it is
+                    granted = token_info.get("scopes") or scopes
+                    lacking = missing_scopes(granted, scopes)
+                    if lacking:
+                        self.logger.warning(
+                            f"Token lacks scopes {', '.join(lacking)}; signing in "
+                            "again to grant them"
+                        )
+                    else:
+                        credentials = Credentials.from_authorized_user_info(
+                            token_info, granted
+                        )
+                        self.logger.info(
+                            f"Loaded existing credentials from {token_store.describe()}"
+                        )
                 except Exception as e:
                     self.logger.warning(f"Failed to load existing credentials: {e}")
             
@@ -217,7 +837,7 @@ class GmailClient:
                 if credentials and credentials.expired and credentials.refresh_token:
                     try:
                         self.logger.info("Refreshing expired credentials")
-                        credentials.refresh(Request())
+                        credentials.refresh(Request(requests_session(self.config.network)))
                         self.stats["authentication_refreshes"] += 1
                         self.logger.info("Successfully refreshed credentials")
                     except RefreshError as e:
@@ -225,12 +845,23 @@ class GmailClient:
                         raise GmailAuthenticationError(f"Token refresh failed: {e}")
                 
                 # Perform initial authentication flow
+                if not credentials and not interactive:
+                    if lacking:
+                        raise GmailAuthenticationError(
+                            f"The token in {token_store.describe()} lacks scopes "
+                            f"{', '.join(lacking)}; "
+                            f"sign in again with: gmail-downloader auth login"
+                        )
+                    raise GmailAuthenticationError(
+                        f"Not signed in: no usable token in {token_store.describe()}"
+                    )
                 if not credentials:
                     self.logger.info("Starting OAuth2 authentication flow")
                     try:
                         flow = InstalledAppFlow.from_client_secrets_file(
-                            str(credentials_path), self.SCOPES
+                            str(credentials_path), scopes
                         )
+                        configure_session(flow.oauth2session, self.config.network)
                         # Run local server for OAuth callback
                         credentials = flow.run_local_server(port=0)
                         self.logger.info("OAuth2 authentication completed successfully")
@@ -240,15 +871,25 @@ class GmailClient:
                 
                 # Save credentials for future use
                 try:
-                    with open(token_path, "w") as token_file:
-                        token_file.write(credentials.to_json())
-                    self.logger.info(f"Saved credentials to {token_path}")
+                    token_store.save(credentials.to_json())
+                    self.logger.info(f"Saved credentials to {token_store.describe()}")
                 except Exception as e:
                     self.logger.warning(f"Failed to save credentials: {e}")
             
             # Build Gmail service
             self.credentials = credentials
-            self.service = build("gmail", "v1", credentials=credentials)
+            network = self.config.network
+            self.service = build(
+                "gmail", "v1", http=authorized_http(credentials, network)
+            )
+            self.attachment_service = build(
+                "gmail",
+                "v1",
+                http=authorized_http(
+                    credentials, network, network.attachment_timeout_seconds
+                ),
+            )
+            self.quota.attach_state(quota_state_path(self.gmail_config))
             self.logger.info("Gmail API service initialized successfully")
             
         except GmailAuthenticationError:
@@ -262,7 +903,7 @@ class GmailClient:
     
     @backoff.on_exception(
         backoff.expo,
-        (HttpError, GmailRateLimitError),
+        (HttpError, GmailRateLimitError, GmailTimeoutError),
         max_tries=5,
         jitter=backoff.full_jitter,
         max_time=300,  # 5 minutes maximum
@@ -289,30 +930,26 @@ class GmailClient:
             GmailQuotaExceededError: If daily quota is exceeded
             GmailError: For other API errors
         """
-        async with self._semaphore:
+        async with self.quota.semaphore:
             try:
                 # Check quota limits
-                if self._quota_used + quota_units > self.gmail_config.requests_per_day:
-                    raise GmailQuotaExceededError(
-                        f"Daily quota exceeded: {self._quota_used} + {quota_units} > {self.gmail_config.requests_per_day}"
-                    )
+                self.quota.check(quota_units)
                 
                 # Execute the request (run in thread pool to avoid blocking)
                 response = await asyncio.to_thread(request_func)
                 
                 # Update statistics
-                self.stats["requests_made"] += 1
-                self.stats["quota_units_used"] += quota_units
-                self._quota_used += quota_units
-                
-                # Reset daily quota counter if needed
-                if datetime.now() >= self._quota_reset_time:
-                    self._quota_used = 0
-                    self._quota_reset_time = datetime.now() + timedelta(days=1)
-                    self.logger.info("Daily quota counter reset")
+                self.quota.record(quota_units)
                 
                 return response
                 
+            except TimeoutError as e:
+                # A hung connection; tried again with a fresh one
+                self.logger.warning(
+                    f"Gmail API request timed out for {self.profile}: {e}"
+                )
+                raise GmailTimeoutError(f"Gmail API request timed out: {e}")
+            
             except HttpError as e:
                 error_details = e.error_details[0] if e.error_details else {}
                 error_reason = error_details.get("reason", "")
@@ -324,7 +961,8 @@ class GmailClient:
                     self.stats["rate_limit_hits"] += 1
                     retry_after = int(e.resp.get("retry-after", 60))
                     self.logger.warning(
-                        f"Rate limit hit, backing off for {retry_after} seconds"
+                        f"Rate limit hit for {self.profile}, backing off for "
+                        f"{retry_after} seconds"
                     )
                     raise GmailRateLimitError(retry_after)
                 
@@ -357,6 +995,12 @@ class GmailClient:
         subject_keywords: Optional[List[str]] = None,
         exclude_keywords: Optional[List[str]] = None,
         extensions: Optional[List[str]] = None,
+        min_size: Optional[int] = None,
+        drive_links: bool = False,
+        labels: Optional[List[str]] = None,
+        search_scope: str = "all",
+        include_spam_trash: bool = False,
+        date_timezone: Optional[str] = None,
     ) -> str:
         """
         Build Gmail search query from filter parameters.
@@ -372,6 +1016,15 @@ class GmailClient:
             subject_keywords: Keywords that must appear in subject
             exclude_keywords: Keywords to exclude from results
             extensions: File extensions to search for (e.g., ['.pdf', '.xlsx'])
+            min_size: Smallest attachment size of interest, in bytes
+            drive_links: Also match messages that only link to Drive files
+            labels: Gmail labels, of which a message needs any one
+            search_scope: "all" (inbox and archive) or "inbox"
+            include_spam_trash: Also match messages in Spam and Trash
+            date_timezone: Time zone whose midnight starts after_date and
+                before_date ("UTC", "local" or an IANA name), sent as exact
+                timestamps; None leaves the days to Gmail, which reads them
+                in Pacific Time
             
         Returns:
             Gmail search query string
@@ -397,27 +1050,49 @@ class GmailClient:
                     )
                     query_parts.append(f"({sender_query})")
         
-        # Add date filters - ALWAYS use utils.parse_date()
-        if after_date:
-            parsed_date = parse_date(after_date)
-            if parsed_date:
-                query_parts.append(f"after:{parsed_date.strftime('%Y/%m/%d')}")
+        # Add label filters
+        if labels:
+            label_terms = [label_search_term(label) for label in labels]
+            if len(label_terms) == 1:
+                query_parts.append(label_terms[0])
             else:
-                self.logger.warning(f"Invalid after_date format: {after_date}")
+                query_parts.append(f"({' OR '.join(label_terms)})")
+        
+        # Add the scope. Gmail searches All Mail except Spam and Trash by
+        # default; in:anywhere widens that to everything.
+        if search_scope == "inbox" and include_spam_trash:
+            query_parts.append("(in:inbox OR in:spam OR in:trash)")
+        elif search_scope == "inbox":
+            query_parts.append("in:inbox")
+        elif include_spam_trash:
+            query_parts.append("in:anywhere")
         
-        if before_date:
-            parsed_date = parse_date(before_date)
-            if parsed_date:
-                query_parts.append(f"before:{parsed_date.strftime('%Y/%m/%d')}")
+        # Add date filters - ALWAYS use utils.parse_date()
+        for operator, date_value in (("after", after_date), ("before", before_date)):
+            if not date_value:
+                continue
+            parsed_date = parse_date(date_value)
+            if not parsed_date:
+                self.logger.warning(f"Invalid {operator}_date format: {date_value}")
+            elif date_timezone:
+                query_parts.append(
+                    f"{operator}:{day_start_timestamp(parsed_date, date_timezone)}"
+                )
             else:
-                self.logger.warning(f"Invalid before_date format: {before_date}")
+                query_parts.append(f"{operator}:{parsed_date.strftime('%Y/%m/%d')}")
         
         # Add attachment filter
-        if has_attachment:
+        if has_attachment and drive_links:
+            query_parts.append(
+                "(has:attachment OR has:drive OR has:document "
+                "OR has:spreadsheet OR has:presentation)"
+            )
+        elif has_attachment:
             query_parts.append("has:attachment")
         
-        # Add file extension filter
-        if extensions:
+        # Add file extension filter. Linked Drive files are not attachments,
+        # so with drive_links extensions and sizes are only checked per file.
+        if extensions and not drive_links:
             extension_queries = []
             for ext in extensions:
                 # Remove leading dot if present
@@ -430,6 +1105,14 @@ class GmailClient:
                 else:
                     query_parts.append(f"({' OR '.join(extension_queries)})")
         
+        # Add size filter. Gmail's larger:/smaller: look at the whole message,
+        # which is always at least as big as any attachment in it. So larger:
+        # safely narrows the search, but smaller: could hide a message whose
+        # small attachment sits next to a big one - max_size is only checked
+        # per attachment, after searching.
+        if min_size and not drive_links:
+            query_parts.append(f"larger:{min_size}")
+        
         # Add subject keyword filters
         if subject_keywords:
             for keyword in subject_keywords:
@@ -445,7 +1128,10 @@ class GmailClient:
         return query
     
     async def search_messages(
-        self, query: str, max_results: Optional[int] = None
+        self,
+        query: str,
+        max_results: Optional[int] = None,
+        include_spam_trash: bool = False,
     ) -> AsyncIterator[str]:
         """
         Search for messages using Gmail query syntax.
@@ -458,6 +1144,7 @@ class GmailClient:
         Args:
             query: Gmail search query (e.g., "from:sender@example.com has:attachment")
             max_results: Maximum number of messages to return (None = all)
+            include_spam_trash: Also search messages in Spam and Trash
             
         Yields:
             Message IDs that match the search criteria
@@ -483,12 +1170,16 @@ class GmailClient:
             if page_token:
                 request_params["pageToken"] = page_token
             
-            # Make the API request - costs 1 quota unit
+            if include_spam_trash:
+                request_params["includeSpamTrash"] = True
+            
             def make_request():
                 return self.service.users().messages().list(**request_params).execute()
             
             try:
-                response = await self._make_api_request(make_request, quota_units=1)
+                response = await self._make_api_request(
+                    make_request, quota_units=QUOTA_COSTS["messages.list"]
+                )
                 
                 # Yield message IDs
                 messages = response.get("messages", [])
@@ -534,10 +1225,9 @@ class GmailClient:
             raise GmailError("Client not authenticated. Call authenticate() first.")
         
         try:
-            # Choose format based on whether we need the body
-            # 'metadata' is lighter weight (1 quota unit) vs 'full' (5 quota units)
+            # Choose format based on whether we need the body; 'metadata'
+            # costs the same quota but transfers much less
             format_type = "full" if include_body else "metadata"
-            quota_cost = 5 if include_body else 1
             
             def make_request():
                 return (
@@ -548,7 +1238,7 @@ class GmailClient:
                 )
             
             message_data = await self._make_api_request(
-                make_request, quota_units=quota_cost
+                make_request, quota_units=QUOTA_COSTS["messages.get"]
             )
             
             # Parse message headers
@@ -566,27 +1256,39 @@ class GmailClient:
             
             # Extract other email details
             recipient = extract_email_address(headers.get("to", ""))
+            recipients = extract_all_emails(", ".join(
+                value for value in (headers.get("to"), headers.get("cc")) if value
+            ))
             subject = headers.get("subject", "No Subject")
             
-            # Parse date - ALWAYS use utils.parse_date()
+            # Parse the Date header (RFC 5322, with its time zone)
             date_str = headers.get("date", "")
-            message_date = parse_date(date_str) if date_str else None
+            message_date = parse_email_date(date_str) if date_str else None
+            
+            received = None
+            internal_date = message_data.get("internalDate")
+            if internal_date:
+                try:
+                    received = datetime.fromtimestamp(
+                        int(internal_date) / 1000, tz=timezone.utc
+                    )
+                except (ValueError, TypeError):
+                    pass
             
             if not message_date:
                 # Fallback to internal date if header parsing fails
-                internal_date = message_data.get("internalDate")
-                if internal_date:
-                    try:
-                        timestamp = int(internal_date) / 1000
-                        message_date = datetime.fromtimestamp(timestamp, tz=timezone.utc)
-                    except (ValueError, TypeError):
-                        message_date = datetime.now(tz=timezone.utc)
-                else:
-                    message_date = datetime.now(tz=timezone.utc)
+                message_date = received or datetime.now(tz=timezone.utc)
             
             # Check for attachments
             attachments = self._find_attachments(payload)
             
+            # Resolve label IDs ("Label_12") to the names users recognize
+            label_names = await self.get_label_names()
+            labels = [
+                label_names.get(label_id, label_id)
+                for label_id in message_data.get("labelIds", [])
+            ]
+            
             return EmailMessage(
                 message_id=message_id,
                 thread_id=message_data.get("threadId", ""),
@@ -598,12 +1300,185 @@ class GmailClient:
                 has_attachments=len(attachments) > 0,
                 attachment_count=len(attachments),
                 raw_message=message_data if include_body else None,
+                labels=labels,
+                sender_name=extract_display_name(sender_raw),
+                recipients=recipients,
+                received=received,
             )
             
         except Exception as e:
             self.logger.error(f"Error getting message details for {message_id}: {e}")
             raise GmailError(f"Failed to get message details: {e}")
     
+    async def get_label_names(self) -> Dict[str, str]:
+        """
+        Get a mapping of label IDs to label names.
+        
+        Labels rarely change during a run, so the result is cached for the
+        lifetime of the client. System labels such as INBOX map to themselves.
+        
+        Returns:
+            Dictionary of label ID -> label name
+        """
+        if self._label_names is not None:
+            return self._label_names
+        
+        def make_request():
+            return self.service.users().labels().list(userId="me").execute()
+        
+        try:
+            response = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["labels.list"]
+            )
+            self._label_names = {
+                label["id"]: label.get("name", label["id"])
+                for label in response.get("labels", [])
+            }
+        except Exception as e:
+            # Labels are nice-to-have metadata; fall back to raw IDs
+            self.logger.warning(f"Could not fetch label names: {e}")
+            self._label_names = {}
+        
+        return self._label_names
+    
+    async def ensure_label(self, name: str) -> str:
+        """
+        The ID of a label, created if it does not exist yet.
+        
+        Nested labels ("ingested/ok") get their missing parents created
+        first, so they show up nested in Gmail. Created labels join the
+        cached label names, so each is looked up or created once per
+        session. Gmail compares label names without case.
+        
+        Raises:
+            GmailError: If the label cannot be created
+        """
+        parts = [part.strip() for part in name.strip("/").split("/")]
+        label_id = ""
+        for depth in range(1, len(parts) + 1):
+            label_id = await self._ensure_one_label("/".join(parts[:depth]))
+        return label_id
+    
+    async def _ensure_one_label(self, name: str) -> str:
+        label_id = self._find_label(await self.get_label_names(), name)
+        if label_id:
+            return label_id
+        
+        def make_request():
+            return self.service.users().labels().create(userId="me", body={
+                "name": name,
+                "labelListVisibility": "labelShow",
+                "messageListVisibility": "show",
+            }).execute()
+        
+        try:
+            label = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["labels.create"]
+            )
+        except (GmailAuthenticationError, GmailQuotaExceededError):
+            raise
+        except GmailError:
+            # Created meanwhile (another run), or listing failed earlier and
+            # it was there all along: list again before giving up
+            self._label_names = None
+            label_id = self._find_label(await self.get_label_names(), name)
+            if label_id:
+                return label_id
+            raise
+        self.logger.info(f"Created Gmail label {name}")
+        self._label_names[label["id"]] = label.get("name", name)
+        return label["id"]
+    
+    @staticmethod
+    def _find_label(label_names: Dict[str, str], name: str) -> Optional[str]:
+        for label_id, label_name in label_names.items():
+            if label_name.lower() == name.lower():
+                return label_id
+        return None
+    
+    async def modify_labels(
+        self, message_id: str, add: List[str], remove: List[str]
+    ) -> None:
+        """
+        Add labels to a message, creating any that are missing
+        (see ensure_label), and take others off it; labels to remove that
+        do not exist are left alone. Needs the gmail.modify scope.
+        
+        Raises:
+            GmailError: If a label cannot be created or the message is gone
+        """
+        add_ids = [await self.ensure_label(name) for name in add]
+        label_names = await self.get_label_names() if remove else {}
+        remove_ids = [
+            label_id
+            for label_id in (self._find_label(label_names, name) for name in remove)
+            if label_id
+        ]
+        
+        def make_request():
+            return self.service.users().messages().modify(
+                userId="me",
+                id=message_id,
+                body={"addLabelIds": add_ids, "removeLabelIds": remove_ids},
+            ).execute()
+        
+        await self._make_api_request(
+            make_request, quota_units=QUOTA_COSTS["messages.modify"]
+        )
+    
+    async def resolve_message_reference(self, reference: str) -> List[str]:
+        """
+        Message IDs for a message ID, Gmail URL or Message-ID header.
+        
+        A URL names a whole conversation, so every message in it is
+        returned; a Message-ID is looked up with an rfc822msgid: search,
+        including Spam and Trash. See parse_message_reference.
+        
+        Raises:
+            GmailError: If the reference is not understood or names nothing
+        """
+        try:
+            kind, value = parse_message_reference(reference)
+        except ValueError as e:
+            raise GmailError(str(e))
+        
+        if kind == "message":
+            return [value]
+        
+        if kind == "rfc822":
+            message_ids = [
+                message_id async for message_id in
+                self.search_messages(f"rfc822msgid:{value}", include_spam_trash=True)
+            ]
+            if not message_ids:
+                raise GmailError(f"No message with Message-ID <{value}>")
+            return message_ids
+        
+        return await self.get_thread_message_ids(value)
+    
+    async def get_thread_message_ids(self, thread_id: str) -> List[str]:
+        """
+        IDs of the messages in a conversation, oldest first.
+        
+        Raises:
+            GmailError: If there is no such conversation
+        """
+        def make_request():
+            return (
+                self.service.users()
+                .threads()
+                .get(userId="me", id=thread_id, format="minimal")
+                .execute()
+            )
+        
+        try:
+            response = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["threads.get"]
+            )
+        except Exception as e:
+            raise GmailError(f"Conversation {thread_id} not found: {e}")
+        return [message["id"] for message in response.get("messages", [])]
+    
     def _find_attachments(self, payload: Dict[str, Any]) -> List[Dict[str, Any]]:
         """
         Recursively find all attachments in a message payload.
@@ -621,7 +1496,7 @@ class GmailClient:
         
         # Check if this part is an attachment
         body = payload.get("body", {})
-        if body.get("attachmentId") and payload.get("filename"):
+        if body.get("attachmentId") and part_filename(payload):
             attachments.append(payload)
         
         # Recursively check all parts
@@ -656,7 +1531,9 @@ class GmailClient:
                     .execute()
                 )
             
-            message_data = await self._make_api_request(make_request, quota_units=5)
+            message_data = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["messages.get"]
+            )
             payload = message_data.get("payload", {})
             
             # Find all attachment parts
@@ -668,9 +1545,10 @@ class GmailClient:
                 attachment_id = body.get("attachmentId")
                 
                 if attachment_id:
-                    filename = part.get("filename", "attachment")
+                    filename = part_filename(part) or "attachment"
                     mime_type = part.get("mimeType", "application/octet-stream")
                     size = body.get("size", 0)
+                    disposition = part_header(part, "Content-Disposition").lower()
                     
                     # Create attachment object
                     attachment = EmailAttachment(
@@ -679,11 +1557,15 @@ class GmailClient:
                         filename=filename,
                         mime_type=mime_type,
                         size=size,
+                        part_id=part.get("partId", ""),
+                        content_id=part_header(part, "Content-ID").strip().strip("<>"),
+                        inline=disposition.startswith("inline"),
                     )
                     
                     attachments.append(attachment)
                     self.logger.debug(
-                        f"Found attachment: {attachment.safe_filename} ({attachment.size_display})"
+                        f"Found attachment: {attachment.safe_filename} "
+                        f"({attachment.size_display})"
                     )
             
             self.logger.info(
@@ -714,24 +1596,29 @@ class GmailClient:
         if not self.is_authenticated():
             raise GmailError("Client not authenticated. Call authenticate() first.")
         
+        # Attachments take longer than other calls; a stalled one times out
+        # at network.attachment_timeout_seconds and is retried
+        service = self.attachment_service or self.service
         try:
             def make_request():
                 return (
-                    self.service.users()
+                    service.users()
                     .messages()
                     .attachments()
                     .get(userId="me", messageId=message_id, id=attachment_id)
                     .execute()
                 )
             
-            # Attachment downloads cost 10 quota units
-            attachment_data = await self._make_api_request(make_request, quota_units=10)
+            attachment_data = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["messages.attachments.get"]
+            )
             
             # Decode base64 data
             file_data = base64.urlsafe_b64decode(attachment_data["data"])
             
             self.logger.debug(
-                f"Downloaded attachment {attachment_id}: {format_file_size(len(file_data))}"
+                f"Downloaded attachment {attachment_id}: "
+                f"{format_file_size(len(file_data))}"
             )
             return file_data
             
@@ -739,8 +1626,95 @@ class GmailClient:
             self.logger.error(f"Error downloading attachment {attachment_id}: {e}")
             raise GmailAttachmentError(f"Failed to download attachment: {e}")
     
+    async def get_message_bodies(self, message_id: str) -> Dict[str, str]:
+        """
+        Get the text and HTML bodies of a message (see extract_message_bodies).
+        
+        Raises:
+            GmailError: If the message cannot be retrieved
+        """
+        if not self.is_authenticated():
+            raise GmailError("Client not authenticated. Call authenticate() first.")
+        
+        try:
+            def make_request():
+                return (
+                    self.service.users()
+                    .messages()
+                    .get(userId="me", id=message_id, format="full")
+                    .execute()
+                )
+            
+            message_data = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["messages.get"]
+            )
+            return extract_message_bodies(message_data.get("payload", {}))
+            
+        except Exception as e:
+            self.logger.error(f"Error getting body of message {message_id}: {e}")
+            raise GmailError(f"Failed to get message body: {e}")
+    
+    async def get_raw_message(self, message_id: str) -> bytes:
+        """
+        Get the complete message as RFC 822 bytes, suitable for a .eml file.
+        
+        Raises:
+            GmailError: If the message cannot be retrieved
+        """
+        if not self.is_authenticated():
+            raise GmailError("Client not authenticated. Call authenticate() first.")
+        
+        try:
+            def make_request():
+                return (
+                    self.service.users()
+                    .messages()
+                    .get(userId="me", id=message_id, format="raw")
+                    .execute()
+                )
+            
+            message_data = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["messages.get"]
+            )
+            return base64.urlsafe_b64decode(message_data["raw"])
+            
+        except Exception as e:
+            self.logger.error(f"Error getting raw message {message_id}: {e}")
+            raise GmailError(f"Failed to get raw message: {e}")
+    
+    async def download_attachment_from_raw(
+        self, message_id: str, part_id: str, filename: str
+    ) -> Optional[bytes]:
+        """
+        Fallback download path: fetch the whole message and extract the part.
+        
+        Used when the attachments endpoint returns a different size than Gmail
+        declared. Costs more quota, but goes through a different API path.
+        
+        Returns:
+            Attachment bytes, or None if the part cannot be found
+        """
+        raw = await self.get_raw_message(message_id)
+        return extract_raw_attachment(raw, part_id, filename)
+    
+    async def snapshot_message_ids(self, query: str) -> Set[str]:
+        """
+        Collect the IDs of the most recent messages matching the query.
+        
+        Watch mode compares each poll against this snapshot to spot new mail.
+        """
+        message_ids = set()
+        async for message_id in self.search_messages(query, max_results=100):
+            message_ids.add(message_id)
+        return message_ids
+    
     async def watch_for_new_messages(
-        self, query: str, check_interval: Optional[int] = None
+        self,
+        query: str,
+        check_interval: Optional[int] = None,
+        baseline: Optional[Set[str]] = None,
+        on_poll: Optional[Callable[[], Any]] = None,
+        wait: Optional[Callable[[], float]] = None,
     ) -> AsyncIterator[str]:
         """
         Watch for new messages matching the query (async generator).
@@ -751,6 +1725,12 @@ class GmailClient:
         Args:
             query: Gmail search query to monitor
             check_interval: Check interval in seconds (uses config default if None)
+            baseline: Message IDs to treat as already seen; taken from a fresh
+                snapshot_message_ids() call if None
+            on_poll: Called after every successful check (e.g. for health
+                reporting or a systemd watchdog)
+            wait: Seconds to sleep before each check, asked anew every time
+                (e.g. until the next scheduled check); check_interval if None
             
         Yields:
             Message IDs of new messages as they arrive
@@ -759,31 +1739,32 @@ class GmailClient:
             raise GmailError("Client not authenticated. Call authenticate() first.")
         
         interval = check_interval or self.config.watch.check_interval
-        seen_message_ids = set()
         
         self.logger.info(f"Starting message monitoring (check interval: {interval}s)")
         
         # Initial scan to establish baseline
-        try:
-            initial_count = 0
-            async for message_id in self.search_messages(query, max_results=100):
-                seen_message_ids.add(message_id)
-                initial_count += 1
-            
-            self.logger.info(f"Baseline established with {initial_count} messages")
-        except Exception as e:
-            self.logger.error(f"Failed to establish baseline: {e}")
-            return
+        if baseline is None:
+            try:
+                baseline = await self.snapshot_message_ids(query)
+            except Exception as e:
+                self.logger.error(f"Failed to establish baseline: {e}")
+                return
+        
+        seen_message_ids = set(baseline)
+        self.logger.info(f"Baseline established with {len(seen_message_ids)} messages")
         
         while True:
             try:
-                await asyncio.sleep(interval)
+                await asyncio.sleep(wait() if wait else interval)
                 
                 # Search for current messages
                 current_message_ids = set()
                 async for message_id in self.search_messages(query, max_results=100):
                     current_message_ids.add(message_id)
                 
+                if on_poll:
+                    on_poll()
+                
                 # Find new messages
                 new_message_ids = current_message_ids - seen_message_ids
                 
@@ -811,15 +1792,9 @@ class GmailClient:
         Get current quota usage and statistics.
         
         Returns:
-            Dictionary with quota and usage information
+            Dictionary with quota and usage information for this client's profile
         """
-        return {
-            "quota_used_today": self._quota_used,
-            "quota_limit_daily": self.gmail_config.requests_per_day,
-            "quota_remaining": self.gmail_config.requests_per_day - self._quota_used,
-            "quota_reset_time": self._quota_reset_time.isoformat(),
-            "statistics": self.stats.copy(),
-        }
+        return self.quota.status()
     
     async def get_user_profile(self) -> Dict[str, Any]:
         """
@@ -838,8 +1813,12 @@ class GmailClient:
             def make_request():
                 return self.service.users().getProfile(userId="me").execute()
             
-            profile = await self._make_api_request(make_request, quota_units=1)
-            self.logger.info(f"Retrieved profile for {profile.get('emailAddress', 'unknown')}")
+            profile = await self._make_api_request(
+                make_request, quota_units=QUOTA_COSTS["getProfile"]
+            )
+            self.logger.info(
+                f"Retrieved profile for {profile.get('emailAddress', 'unknown')}"
+            )
             return profile
         except Exception as e:
             self.logger.error(f"Error getting user profile: {e}")
@@ -861,4 +1840,21 @@ class GmailClient:
             
         except Exception as e:
             self.logger.error(f"Gmail connection test failed: {e}")
-            return False
\ No newline at end of file
+            return False
+
+
+def create_client(config: AppConfig) -> GmailClient:
+    """
+    The client for the configured account: the Gmail API, Gmail's IMAP
+    server with gmail.protocol: imap (see imap.py), or Microsoft Graph for
+    profiles whose provider is outlook (see outlook.py)
+    """
+    if config.gmail.get_provider() == "outlook":
+        from .outlook import OutlookMailbox
+        
+        return OutlookMailbox(config).client()
+    if config.gmail.protocol == "imap":
+        from .imap import ImapMailbox
+        
+        return ImapMailbox(config).client()
+    return GmailClient(config=config)
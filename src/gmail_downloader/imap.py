@@ -0,0 +1,505 @@
+"""
+Gmail over IMAP, for accounts that cannot use the Gmail API.
+
+Some organisations do not allow the Gmail API but do allow IMAP with app
+passwords. With gmail.protocol: imap every command reads the account
+through Gmail's IMAP server instead, signing in with an app password or
+with XOAUTH2 (the OAuth sign-in of the API, granted IMAP access).
+
+ImapMailbox is a localmail.LocalMailbox, so GmailClient - and everything
+built on it - runs unchanged. Gmail's IMAP extensions keep the results the
+same as with the API: searches are sent as Gmail queries (X-GM-RAW), and
+messages are known by their Gmail IDs (X-GM-MSGID, X-GM-THRID), so the
+manifest recognises files whichever protocol downloaded them. Servers
+without these extensions are refused rather than searched differently.
+
+Everything is read from the All Mail folder (imap.mailbox), without
+marking anything as read. Spam and Trash are separate folders over IMAP
+and are not searched.
+"""
+
+import asyncio
+import base64
+import copy
+import email
+import imaplib
+import re
+import threading
+from collections import OrderedDict
+from datetime import datetime, timezone
+from email import policy
+from email.message import Message
+from typing import Any, Dict, List, Optional, Tuple
+
+from google.auth.transport.requests import Request
+
+from .config import AppConfig
+from .gmail_client import (
+    FULL_MAIL_SCOPE,
+    GmailAuthenticationError,
+    GmailClient,
+    GmailError,
+)
+from .localmail import (
+    LocalMailbox,
+    MimeMessage,
+    not_found,
+    own_quota,
+    part_filename,
+    system_label,
+)
+
+# XOAUTH2 needs full mail access; gmail.readonly does not cover IMAP
+IMAP_SCOPE = FULL_MAIL_SCOPE
+
+# What a search fetches for each message it finds
+METADATA_ITEMS = (
+    "(UID X-GM-MSGID X-GM-THRID X-GM-LABELS FLAGS INTERNALDATE RFC822.SIZE)"
+)
+
+# Messages fetched per FETCH command
+FETCH_BATCH = 500
+
+# Full messages kept in memory, for the attachment reads that follow
+# reading a message
+CACHED_MESSAGES = 4
+
+# Folders that are Gmail's own rather than labels (RFC 6154 special use)
+SPECIAL_USE_FLAGS = {
+    "\\all",
+    "\\archive",
+    "\\drafts",
+    "\\flagged",
+    "\\important",
+    "\\junk",
+    "\\sent",
+    "\\trash",
+}
+
+_TOKEN = re.compile(rb'\(|\)|"(?:[^"\\]|\\.)*"|[^\s()"]+')
+
+
+def oauth_config(config: AppConfig) -> AppConfig:
+    """The configuration XOAUTH2 signs in with (see ImapConfig.oauth_config)."""
+    oauth = copy.copy(config)
+    oauth.gmail = config.imap.oauth_config(config.gmail)
+    return oauth
+
+
+class ImapError(GmailError):
+    """Raised when the IMAP server cannot be used."""
+
+    pass
+
+
+def _quote(text: str) -> str:
+    return '"' + text.replace("\\", "\\\\").replace('"', '\\"') + '"'
+
+
+def decode_mailbox_name(name: str) -> str:
+    """Decode IMAP's modified UTF-7 folder names ("Entw&APw-rfe" -> "Entwürfe")."""
+
+    def decode(match: "re.Match[str]") -> str:
+        if not match.group(1):
+            return "&"
+        data = match.group(1).replace(",", "/")
+        return base64.b64decode(data + "=" * (-len(data) % 4)).decode("utf-16-be")
+
+    return re.sub(r"&([^-]*)-", decode, name)
+
+
+def encode_mailbox_name(name: str) -> str:
+    """Encode a folder name in IMAP's modified UTF-7."""
+
+    def encode(match: "re.Match[str]") -> str:
+        if match.group(0) == "&":
+            return "&-"
+        data = base64.b64encode(match.group(0).encode("utf-16-be")).decode("ascii")
+        return "&" + data.rstrip("=").replace("/", ",") + "-"
+
+    return re.sub(r"&|[^\x20-\x7e]+", encode, name)
+
+
+def parse_response(text: bytes) -> List[Any]:
+    """An IMAP response line as nested lists of strings."""
+    stack: List[List[Any]] = [[]]
+    for token in _TOKEN.findall(text):
+        if token == b"(":
+            stack.append([])
+        elif token == b")":
+            if len(stack) > 1:
+                group = stack.pop()
+                stack[-1].append(group)
+        elif token.startswith(b'"'):
+            stack[-1].append(
+                re.sub(rb"\\(.)", rb"\1", token[1:-1]).decode("utf-8", "replace")
+            )
+        else:
+            stack[-1].append(token.decode("utf-8", "replace"))
+    return stack[0]
+
+
+def parse_fetch(data: List[Any]) -> List[Dict[str, Any]]:
+    """
+    The items of each message in a FETCH response, e.g. {"UID": "5", ...}.
+
+    imaplib returns literals as (prefix, data) tuples; they are put back
+    into their line as quoted strings.
+    """
+    lines: List[bytes] = []
+    for item in data:
+        if item is None:
+            continue
+        text = item[0] if isinstance(item, tuple) else item
+        if re.match(rb"\d+ \(", text) or not lines:
+            lines.append(b"")
+        if isinstance(item, tuple):
+            literal = item[1].replace(b"\\", b"\\\\").replace(b'"', b'\\"')
+            lines[-1] += re.sub(rb"\{\d+\}$", b"", item[0]) + b'"' + literal + b'"'
+        else:
+            lines[-1] += item
+
+    messages = []
+    for line in lines:
+        parsed = parse_response(line)
+        if len(parsed) < 2 or not isinstance(parsed[1], list):
+            continue
+        pairs = parsed[1]
+        messages.append(
+            {str(pairs[i]).upper(): pairs[i + 1] for i in range(0, len(pairs) - 1, 2)}
+        )
+    return messages
+
+
+def _literal(data: List[Any]) -> Optional[bytes]:
+    """The first literal (message data) in a FETCH response."""
+    for item in data:
+        if isinstance(item, tuple):
+            return item[1]
+    return None
+
+
+def _label(name: str) -> str:
+    """A label from X-GM-LABELS: "\\Inbox" -> "INBOX", user labels decoded."""
+    if name.startswith("\\"):
+        return system_label(name[1:])
+    return decode_mailbox_name(name)
+
+
+def _internal_date(value: str) -> datetime:
+    try:
+        return datetime.strptime(value.strip(), "%d-%b-%Y %H:%M:%S %z")
+    except ValueError:
+        return datetime.fromtimestamp(0, tz=timezone.utc)
+
+
+class ImapMessage(MimeMessage):
+    """
+    A message found over IMAP.
+
+    Searches fetch only its IDs, labels, date and size; the headers and the
+    full message are fetched when GmailClient asks for them.
+    """
+
+    def __init__(self, mailbox: "ImapMailbox", fields: Dict[str, Any]):
+        self._mailbox = mailbox
+        self.uid = int(fields["UID"])
+        self.id = format(int(fields["X-GM-MSGID"]), "x")
+        self.thread_id = format(
+            int(fields.get("X-GM-THRID") or fields["X-GM-MSGID"]), "x"
+        )
+        self.labels = [_label(label) for label in fields.get("X-GM-LABELS") or []]
+        if "\\Seen" not in (fields.get("FLAGS") or []):
+            self.labels.append("UNREAD")
+        self.date = _internal_date(str(fields.get("INTERNALDATE", "")))
+        self.size = int(fields.get("RFC822.SIZE") or 0)
+        self._header: Optional[Message] = None
+
+    def read(self) -> Tuple[bytes, Message]:
+        return self._mailbox.read(self.uid)
+
+    def header(self) -> Message:
+        """The message's headers, without fetching the rest of it."""
+        if self._header is None:
+            self._header = self._mailbox.read_header(self.uid)
+        return self._header
+
+    def headers(self) -> List[Dict[str, str]]:
+        return [
+            {"name": name, "value": str(value)} for name, value in self.header().items()
+        ]
+
+    @property
+    def sender(self) -> str:
+        return str(self.header().get("From", ""))
+
+    @property
+    def to(self) -> str:
+        return str(self.header().get("To", ""))
+
+    @property
+    def subject(self) -> str:
+        return str(self.header().get("Subject", ""))
+
+    @property
+    def rfc822_id(self) -> str:
+        return str(self.header().get("Message-ID", "")).strip().strip("<>")
+
+    @property
+    def body(self) -> str:
+        """The plain-text body once the message has been read (the snippet), or ""."""
+        cached = self._mailbox.cached(self.uid)
+        body = cached[1].get_body(preferencelist=("plain",)) if cached else None
+        return (
+            body.get_content() if body is not None and not body.is_multipart() else ""
+        )
+
+    @property
+    def filenames(self) -> List[str]:
+        return [
+            name
+            for name in (part_filename(part) for part in self.read()[1].walk())
+            if name
+        ]
+
+
+class ImapMailbox(LocalMailbox):
+    """A Gmail account read over IMAP, standing in for the Gmail API."""
+
+    def __init__(self, config: AppConfig):
+        super().__init__(email_address=config.imap.username or "")
+        self.config = config
+        self._connection: Optional[imaplib.IMAP4] = None
+        self._credentials: Any = None
+        self._lock = threading.RLock()
+        self._cache: "OrderedDict[int, Tuple[bytes, Message]]" = OrderedDict()
+
+    async def connect(self, interactive: bool = True) -> None:
+        """
+        Sign in and open the All Mail folder.
+
+        With auth: xoauth2 the OAuth sign-in of the API is used first, with
+        the IMAP scope and imap.token_file, so the API token is left as it is.
+
+        Raises:
+            GmailAuthenticationError: If signing in fails
+            ImapError: If the server is not Gmail or the folder cannot be opened
+        """
+        if self.config.imap.auth == "xoauth2" and self._credentials is None:
+            oauth = GmailClient(config=oauth_config(self.config))
+            oauth.SCOPES = [IMAP_SCOPE]
+            await oauth.authenticate(interactive)
+            self._credentials = oauth.credentials
+        await asyncio.to_thread(self._reconnect)
+
+    def _reconnect(self) -> None:
+        with self._lock:
+            self.close()
+            self._connection = self._open()
+
+    def close(self) -> None:
+        """Log out, if connected."""
+        with self._lock:
+            if self._connection is not None:
+                try:
+                    self._connection.logout()
+                except (imaplib.IMAP4.error, OSError):
+                    pass
+                self._connection = None
+
+    def _open(self) -> imaplib.IMAP4:
+        imap = self.config.imap
+        try:
+            connection = imaplib.IMAP4_SSL(
+                imap.host, imap.port, timeout=imap.timeout_seconds
+            )
+        except OSError as e:
+            raise ImapError(f"Cannot connect to {imap.host}:{imap.port}: {e}")
+        try:
+            self._sign_in(connection)
+            self._open_mailbox(connection)
+        except BaseException:
+            connection.shutdown()
+            raise
+        return connection
+
+    def _sign_in(self, connection: imaplib.IMAP4) -> None:
+        imap = self.config.imap
+        try:
+            if imap.auth == "xoauth2":
+                if self._credentials is None:
+                    raise GmailAuthenticationError(
+                        "Not signed in: call connect() first"
+                    )
+                if not self._credentials.valid:
+                    self._credentials.refresh(Request())
+                auth_string = (
+                    f"user={imap.username}\x01auth=Bearer "
+                    f"{self._credentials.token}\x01\x01"
+                )
+                connection.authenticate(
+                    "XOAUTH2", lambda challenge: auth_string.encode()
+                )
+            else:
+                connection.login(imap.username, imap.password)
+        except imaplib.IMAP4.error as e:
+            raise GmailAuthenticationError(
+                f"IMAP sign-in as {imap.username} failed: {e}"
+            )
+
+    def _open_mailbox(self, connection: imaplib.IMAP4) -> None:
+        imap = self.config.imap
+        try:
+            _, capabilities = connection.capability()
+            if b"X-GM-EXT-1" not in b" ".join(capabilities).upper().split():
+                raise ImapError(
+                    f"{imap.host} is not Gmail: it lacks "
+                    "Gmail's IMAP extensions (X-GM-EXT-1)"
+                )
+            status, data = connection.select(
+                _quote(encode_mailbox_name(imap.mailbox)), readonly=True
+            )
+            if status != "OK":
+                raise ImapError(
+                    f"Cannot open {imap.mailbox} on "
+                    f"{imap.host}; set imap.mailbox to the name "
+                    f"of All Mail in the account's language"
+                )
+            self._load_labels(connection)
+        except imaplib.IMAP4.error as e:
+            raise ImapError(f"IMAP error from {imap.host}: {e}")
+
+    def _load_labels(self, connection: imaplib.IMAP4) -> None:
+        """Register the account's labels (its folders), so labels.list knows all."""
+        _, lines = connection.list()
+        for line in lines:
+            parsed = parse_response(line) if isinstance(line, bytes) else []
+            if len(parsed) < 3 or not isinstance(parsed[0], list):
+                continue
+            flags = {flag.lower() for flag in parsed[0]}
+            name = decode_mailbox_name(parsed[2])
+            if (
+                "\\noselect" in flags
+                or flags & SPECIAL_USE_FLAGS
+                or name.upper() == "INBOX"
+            ):
+                continue
+            self._label_ids.setdefault(name, f"Label_{len(self._label_ids) + 1}")
+
+    def _run(
+        self, command: str, *args: str, literal: Optional[bytes] = None
+    ) -> List[Any]:
+        """Run a UID command, reconnecting once if the connection was lost."""
+        with self._lock:
+            for attempt in (1, 2):
+                if self._connection is None:
+                    self._connection = self._open()
+                try:
+                    self._connection.literal = literal
+                    status, data = self._connection.uid(command, *args)
+                except (imaplib.IMAP4.abort, OSError) as e:
+                    self._connection = None
+                    if attempt == 2:
+                        raise ImapError(
+                            f"Lost the connection to {self.config.imap.host}: {e}"
+                        )
+                    continue
+                except imaplib.IMAP4.error as e:
+                    raise ImapError(f"IMAP {command} failed: {e}")
+                if status != "OK":
+                    raise ImapError(f"IMAP {command} failed: {data}")
+                return data
+        return []
+
+    def _fetch_metadata(self, uids: List[int]) -> List[ImapMessage]:
+        found = []
+        for start in range(0, len(uids), FETCH_BATCH):
+            batch = ",".join(str(uid) for uid in uids[start:start + FETCH_BATCH])
+            for fields in parse_fetch(self._run("FETCH", batch, METADATA_ITEMS)):
+                if "UID" in fields and "X-GM-MSGID" in fields:
+                    found.append(self.add(ImapMessage(self, fields)))
+        return found
+
+    @staticmethod
+    def _uids(data: List[Any]) -> List[int]:
+        return [
+            int(uid)
+            for uid in b" ".join(
+                item for item in data if isinstance(item, bytes)
+            ).split()
+        ]
+
+    def search(self, query: str, include_spam_trash: bool = False) -> List[ImapMessage]:
+        """Messages matching a Gmail query, newest first, searched by Gmail itself."""
+        if include_spam_trash:
+            raise ImapError("Spam and Trash cannot be searched over IMAP")
+        query = query.strip()
+        if not query:
+            data = self._run("SEARCH", "ALL")
+        elif query.isascii():
+            data = self._run("SEARCH", "X-GM-RAW", _quote(query))
+        else:
+            data = self._run(
+                "SEARCH", "CHARSET", "UTF-8", "X-GM-RAW", literal=query.encode("utf-8")
+            )
+        found = self._fetch_metadata(self._uids(data))
+        return sorted(found, key=lambda message: message.date, reverse=True)
+
+    def get(self, message_id: str) -> ImapMessage:
+        """A message by Gmail ID, looked up on the server if no search found it yet."""
+        if message_id not in self.messages:
+            try:
+                decimal = str(int(message_id, 16))
+            except ValueError:
+                raise not_found(f"Message {message_id}")
+            uids = self._uids(self._run("SEARCH", "X-GM-MSGID", decimal))
+            if not uids or not self._fetch_metadata(uids[:1]):
+                raise not_found(f"Message {message_id}")
+        return self.messages[message_id]
+
+    def cached(self, uid: int) -> Optional[Tuple[bytes, Message]]:
+        with self._lock:
+            return self._cache.get(uid)
+
+    def read(self, uid: int) -> Tuple[bytes, Message]:
+        """A message's raw bytes and parsed form, keeping the last few read."""
+        with self._lock:
+            if uid in self._cache:
+                self._cache.move_to_end(uid)
+                return self._cache[uid]
+            raw = _literal(self._run("FETCH", str(uid), "(BODY.PEEK[])"))
+            if raw is None:
+                raise not_found(f"Message with UID {uid}")
+            self._cache[uid] = (
+                raw, email.message_from_bytes(raw, policy=policy.default)
+            )
+            while len(self._cache) > CACHED_MESSAGES:
+                self._cache.popitem(last=False)
+            return self._cache[uid]
+
+    def read_header(self, uid: int) -> Message:
+        """A message's headers only."""
+        cached = self.cached(uid)
+        if cached:
+            return cached[1]
+        raw = _literal(self._run("FETCH", str(uid), "(BODY.PEEK[HEADER])"))
+        if raw is None:
+            raise not_found(f"Message with UID {uid}")
+        return email.message_from_bytes(raw, policy=policy.default)
+
+    def client(self, config: Optional[AppConfig] = None) -> GmailClient:
+        """
+        A GmailClient reading this account over IMAP.
+
+        Its authenticate() signs in to the IMAP server. Requests do not count
+        towards the Gmail API quota.
+        """
+        client = own_quota(
+            super().client(config or self.config), f"imap:{self.email_address}"
+        )
+
+        async def authenticate(interactive: bool = True) -> None:
+            await self.connect(interactive)
+
+        client.authenticate = authenticate
+        return client
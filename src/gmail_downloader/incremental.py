@@ -0,0 +1,103 @@
+"""
+Incremental downloads.
+
+`download --incremental` remembers when the newest message of the last
+successful run arrived, and the next run only searches for messages
+received after it. A cron job can then run the same command every hour
+without any --after bookkeeping.
+
+Cursors are kept per profile and search, in a small JSON file next to the
+manifest: changing the filters (or the account) starts from scratch, and
+so does pointing the download at another directory. Runs overlap by a
+minute, because Gmail's after: is not exact; the manifest recognises what
+was already downloaded.
+"""
+
+import hashlib
+import json
+import os
+from datetime import datetime, timedelta
+from pathlib import Path
+from typing import Dict, Iterable, Optional, Union
+
+from .manifest import ManifestError
+
+# Where each query resumes from, kept in the download directory
+INCREMENTAL_FILENAME = ".gmail_downloader_incremental.json"
+
+# How far back each run reaches before the cursor
+OVERLAP = timedelta(minutes=1)
+
+
+def cursor_key(profile: str, query: str, include_spam_trash: bool = False) -> str:
+    """
+    Key of the cursor for a profile's search, e.g. "work:3f2a9c1b0d4e".
+
+    The query is hashed so the file stays readable however long it is.
+    """
+    search = f"{query}\n{'spam_trash' if include_spam_trash else ''}"
+    return f"{profile}:{hashlib.sha256(search.encode('utf-8')).hexdigest()[:12]}"
+
+
+def since_query(query: str, since: datetime) -> str:
+    """Narrow query to messages received after since (less OVERLAP)."""
+    return f"({query}) after:{int((since - OVERLAP).timestamp())}"
+
+
+def newest(dates: Iterable[Optional[datetime]]) -> Optional[datetime]:
+    """The latest of dates, ignoring missing ones; None if there are none."""
+    known = [date for date in dates if date is not None]
+    return max(known) if known else None
+
+
+class IncrementalState:
+    """The cursors of one download directory."""
+
+    def __init__(self, directory: Union[str, Path]):
+        self.path = Path(directory) / INCREMENTAL_FILENAME
+        self._cursors: Dict[str, Dict[str, str]] = {}
+
+    def load(self) -> "IncrementalState":
+        """
+        Read the cursors; a missing file means no run has finished yet.
+
+        Raises:
+            ManifestError: If the file exists but cannot be parsed
+        """
+        self._cursors = {}
+        if not self.path.exists():
+            return self
+        try:
+            self._cursors = json.loads(self.path.read_text(encoding="utf-8"))["cursors"]
+        except (OSError, ValueError, KeyError, TypeError) as e:
+            raise ManifestError(f"Cannot read {self.path}: {e}")
+        return self
+
+    def get(self, key: str) -> Optional[datetime]:
+        """When the newest message of the last successful run arrived."""
+        cursor = self._cursors.get(key)
+        return datetime.fromisoformat(cursor["newest"]) if cursor else None
+
+    def advance(self, key: str, newest_date: datetime, query: str = "") -> None:
+        """Move a cursor forward to newest_date (never back) and save."""
+        current = self.get(key)
+        if current is not None and current >= newest_date:
+            return
+        self._cursors[key] = {
+            "newest": newest_date.isoformat(),
+            "query": query,
+            "updated_at": datetime.now().isoformat(),
+        }
+        self.save()
+
+    def save(self) -> None:
+        """Write the cursors atomically, like the manifest."""
+        temp_path = self.path.with_suffix(".tmp")
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+            temp_path.write_text(
+                json.dumps({"cursors": self._cursors}, indent=2), encoding="utf-8"
+            )
+            os.replace(temp_path, self.path)
+        except OSError as e:
+            raise ManifestError(f"Cannot write {self.path}: {e}")
@@ -0,0 +1,126 @@
+"""
+Junk attachment filter.
+
+Mail clients attach the images of a signature or newsletter layout as
+files, so a search for attachments also finds every logo, tracking pixel
+and banner. The filter drops images that are small, have a telltale name
+(image001.png, logo.gif) or banner proportions, unless their name is on the
+allowlist (junk.allow in the config).
+
+Image sizes come from the file headers (PNG, GIF, JPEG, BMP and WebP are
+understood), so no imaging library is needed.
+"""
+
+import fnmatch
+import struct
+from typing import Optional, Tuple
+
+from .config import JunkConfig
+from .gmail_client import EmailAttachment
+
+
+def image_dimensions(data: bytes) -> Optional[Tuple[int, int]]:
+    """
+    Width and height of an image, read from its header.
+
+    Returns:
+        (width, height), or None if the format is not known or the data is
+        cut short
+    """
+    try:
+        if data.startswith(b"\x89PNG\r\n\x1a\n"):
+            return struct.unpack(">II", data[16:24])
+        if data[:6] in (b"GIF87a", b"GIF89a"):
+            return struct.unpack("<HH", data[6:10])
+        if data.startswith(b"BM"):
+            width, height = struct.unpack("<ii", data[18:26])
+            return width, abs(height)  # Negative height = stored top-down
+        if data[:4] == b"RIFF" and data[8:12] == b"WEBP":
+            return _webp_dimensions(data)
+        if data.startswith(b"\xff\xd8"):
+            return _jpeg_dimensions(data)
+    except struct.error:
+        return None
+    return None
+
+
+def _webp_dimensions(data: bytes) -> Optional[Tuple[int, int]]:
+    chunk = data[12:16]
+    if chunk == b"VP8 ":
+        width, height = struct.unpack("<HH", data[26:30])
+        return width & 0x3FFF, height & 0x3FFF
+    if chunk == b"VP8L":
+        bits = struct.unpack("<I", data[21:25])[0]
+        return (bits & 0x3FFF) + 1, ((bits >> 14) & 0x3FFF) + 1
+    if chunk == b"VP8X":
+        width = int.from_bytes(data[24:27], "little") + 1
+        height = int.from_bytes(data[27:30], "little") + 1
+        return width, height
+    return None
+
+
+# JPEG start-of-frame markers (C4, C8 and CC are other segments)
+_JPEG_SOF = {
+    0xC0, 0xC1, 0xC2, 0xC3, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF
+}
+
+
+def _jpeg_dimensions(data: bytes) -> Optional[Tuple[int, int]]:
+    offset = 2
+    while offset + 4 <= len(data):
+        if data[offset] != 0xFF:
+            return None
+        marker = data[offset + 1]
+        if marker == 0xFF:  # Fill byte
+            offset += 1
+            continue
+        length = struct.unpack(">H", data[offset + 2:offset + 4])[0]
+        if marker in _JPEG_SOF:
+            height, width = struct.unpack(">HH", data[offset + 5:offset + 9])
+            return width, height
+        offset += 2 + length
+    return None
+
+
+class JunkFilter:
+    """Decides which attachments are junk under a JunkConfig."""
+
+    def __init__(self, config: JunkConfig):
+        self.config = config
+
+    @staticmethod
+    def _matches(filename: str, patterns) -> bool:
+        name = filename.lower()
+        return any(
+            fnmatch.fnmatchcase(name, str(pattern).lower()) for pattern in patterns
+        )
+
+    def allowed(self, filename: str) -> bool:
+        """Whether the allowlist keeps filename regardless of the other checks."""
+        return self._matches(filename, self.config.allow)
+
+    def reason(self, attachment: EmailAttachment) -> Optional[str]:
+        """
+        Why an attachment is junk, judged before downloading it.
+
+        Returns:
+            A short reason for the log, or None if the attachment is kept
+        """
+        if not attachment.is_image or self.allowed(attachment.filename):
+            return None
+        if attachment.size < self.config.max_image_size:
+            return f"image under {self.config.max_image_size} bytes"
+        if self._matches(attachment.filename, self.config.names):
+            return "decoration filename"
+        return None
+
+    def is_banner(self, attachment: EmailAttachment, data: bytes) -> bool:
+        """Whether a downloaded image has banner proportions."""
+        limit = self.config.max_aspect_ratio
+        if not limit or not attachment.is_image or self.allowed(attachment.filename):
+            return False
+        dimensions = image_dimensions(data)
+        if not dimensions or not all(dimensions):
+            return False
+        width, height = dimensions
+        return max(width, height) / min(width, height) > limit
@@ -0,0 +1,96 @@
+"""
+Stable paths to the newest file of recurring attachments.
+
+A vendor that mails sales.csv every morning leaves a trail of
+sales.csv, sales_1.csv, ... or, with conflict_policy "version",
+sales_2024-06-01.csv, sales_2024-06-02.csv. A pipeline wants one path that
+always holds today's file. With download.latest_links, every saved file
+also updates
+
+    latest/<sender folder>/<filename>
+
+a symlink to it, named after the attachment and kept per sender, so the
+history stays where the layout puts it. Links are relative, and the whole
+download directory can be moved or mounted elsewhere.
+
+A file from an older message than the one the link points at (a backfill)
+leaves the link alone. Where symlinks are unavailable (Windows without
+developer mode), the link is a copy instead, dated with its message's date
+so the same check works.
+"""
+
+import logging
+import os
+import shutil
+from datetime import datetime
+from pathlib import Path
+from typing import Optional, Union
+
+logger = logging.getLogger(__name__)
+
+# Under the download base directory
+LATEST_DIRNAME = "latest"
+
+
+def latest_path(base_dir: Union[str, Path], sender_folder: str, filename: str) -> Path:
+    """Where the latest link of a sender's recurring file goes."""
+    return Path(base_dir) / LATEST_DIRNAME / sender_folder / filename
+
+
+def _timestamp(date: str) -> Optional[float]:
+    """POSIX time of an ISO 8601 date; None when it is unknown."""
+    try:
+        return datetime.fromisoformat(date).timestamp()
+    except (ValueError, TypeError):
+        return None
+
+
+def update_latest(link: Path, target: Path, date: str = "",
+                  current_date: Optional[str] = None) -> bool:
+    """
+    Point link at target, replacing what it pointed at.
+
+    Args:
+        link: The latest link, see latest_path
+        target: The file just saved
+        date: When target's message was sent (ISO 8601), if known
+        current_date: When the message of the file link points at now was
+            sent, if known; a copy's own modification time otherwise
+
+    Returns:
+        Whether the link changed: False when it already points at a file
+        from a newer message
+
+    Raises:
+        OSError: If the link cannot be written
+    """
+    new = _timestamp(date)
+    if os.path.lexists(link) and new is not None:
+        if current_date is not None:
+            current = _timestamp(current_date)
+        else:
+            current = None if link.is_symlink() else link.stat().st_mtime
+        if current is not None and new < current:
+            return False
+
+    link.parent.mkdir(parents=True, exist_ok=True)
+    temp_link = link.with_name(f".{link.name}.tmp")
+    if os.path.lexists(temp_link):
+        temp_link.unlink()
+    try:
+        temp_link.symlink_to(os.path.relpath(target, link.parent))
+    except OSError as e:
+        logger.debug(f"Copying {target} to {link}: cannot create a symlink: {e}")
+        shutil.copyfile(target, temp_link)
+        if new is not None:
+            os.utime(temp_link, (new, new))
+    # os.replace swaps the name in one step: readers see the old file or the new
+    os.replace(temp_link, link)
+    return True
+
+
+def link_target(link: Path) -> Optional[Path]:
+    """The file a symlink points at; None for copies and missing links."""
+    if not link.is_symlink():
+        return None
+    return Path(os.path.normpath(link.parent / os.readlink(link)))
@@ -0,0 +1,581 @@
+"""
+The Gmail API answered from mail held locally.
+
+LocalMailbox stands in for a Gmail account: its service() answers the
+calls GmailClient makes (messages.list/get/modify, attachments.get,
+labels.list/create, threads.get, getProfile) from messages it holds, so GmailClient, the
+downloader and the CLI's pipelines run unchanged on top of it. The fake
+account for tests (tests/gmailtest.py), mbox imports (mbox.MboxMailbox)
+and IMAP accounts (imap.ImapMailbox) are all local mailboxes. Messages that
+come as RFC 822 bytes (MimeMessage) are described to GmailClient the way
+the Gmail API describes them.
+
+Search understands the subset of Gmail's query language this project
+generates: from:, to:, subject:, label:, in:, has:attachment (and the
+has: operators for Drive links), filename:, larger:, smaller:, after:,
+before:, rfc822msgid:, free words, quoted phrases, "-" negation and
+parenthesized OR groups. Anything else raises ValueError rather than
+being ignored, so a search never quietly matches more than asked for.
+"""
+
+import base64
+import shlex
+from datetime import datetime, timezone
+from email.message import Message
+from email.utils import parseaddr
+from types import SimpleNamespace
+from typing import Any, Dict, List, Optional, Protocol, Tuple
+
+from googleapiclient.errors import HttpError
+
+from .config import AppConfig
+from .drive import DRIVE_LINK
+from .gmail_client import GmailClient, QuotaTracker, decode_filename, label_search_term
+from .utils import parse_file_size
+
+# Labels Gmail itself defines; any other label gets a Label_<n> ID
+SYSTEM_LABELS = [
+    "INBOX", "SENT", "DRAFT", "SPAM", "TRASH", "UNREAD", "STARRED", "IMPORTANT"
+]
+
+# How mail clients name the system labels (Takeout's X-Gmail-Labels,
+# IMAP's X-GM-LABELS without the leading backslash)
+SYSTEM_LABEL_NAMES = {
+    "inbox": "INBOX",
+    "sent": "SENT",
+    "draft": "DRAFT",
+    "drafts": "DRAFT",
+    "spam": "SPAM",
+    "trash": "TRASH",
+    "unread": "UNREAD",
+    "starred": "STARRED",
+    "important": "IMPORTANT",
+}
+
+
+class LocalMessage(Protocol):
+    """What a local mailbox needs from its messages."""
+
+    id: str
+    thread_id: str
+    sender: str
+    to: str
+    subject: str
+    body: str
+    date: datetime
+    labels: List[str]
+
+    @property
+    def rfc822_id(self) -> str: ...
+
+    @property
+    def filenames(self) -> List[str]: ...
+
+    @property
+    def size(self) -> int: ...
+
+    def headers(self) -> List[Dict[str, str]]: ...
+
+    def payload(self) -> Dict[str, Any]: ...
+
+    def raw(self) -> bytes: ...
+
+    def attachment_data(self, attachment_id: str) -> Optional[bytes]: ...
+
+
+def encode(data: bytes) -> str:
+    """Base64url, as the Gmail API encodes message parts."""
+    return base64.urlsafe_b64encode(data).decode("ascii")
+
+
+def system_label(name: str) -> str:
+    """Gmail's name for a system label ("Inbox" -> "INBOX"); others are unchanged."""
+    return SYSTEM_LABEL_NAMES.get(name.lower(), name)
+
+
+def own_quota(client: GmailClient, name: str) -> GmailClient:
+    """
+    Count a client's requests on a tracker of its own.
+
+    For mailboxes that are not the Gmail API: their reads neither use nor
+    report the API quota of the configured profile.
+    """
+    client.profile = name
+    client.quota = QuotaTracker(
+        name, requests_per_minute=60 * 16, requests_per_day=10**12
+    )
+    client.stats = client.quota.stats
+    return client
+
+
+def part_at(message: Message, part_id: str) -> Optional[Message]:
+    """The MIME part at a Gmail part ID such as "1" or "0.2"."""
+    part = message
+    try:
+        for index in part_id.split(".") if part_id else []:
+            part = part.get_payload()[int(index)]
+    except (IndexError, ValueError, TypeError, AttributeError):
+        return None
+    return part
+
+
+def part_filename(part: Message) -> str:
+    return decode_filename(part.get_filename() or "")
+
+
+def message_payload(part: Message, part_id: str = "") -> Dict[str, Any]:
+    """A MIME part as the Gmail API describes it with format=full."""
+    result: Dict[str, Any] = {
+        "partId": part_id,
+        "mimeType": part.get_content_type(),
+        "filename": part_filename(part),
+        "headers": [
+            {"name": name, "value": str(value)} for name, value in part.items()
+        ],
+    }
+    if part.is_multipart():
+        result["body"] = {"size": 0}
+        result["parts"] = [
+            message_payload(child, f"{part_id}.{index}" if part_id else str(index))
+            for index, child in enumerate(part.get_payload())
+        ]
+        return result
+
+    data = part.get_payload(decode=True) or b""
+    if result["filename"]:
+        # The API hands files out separately; their part ID is enough here
+        result["body"] = {"size": len(data), "attachmentId": part_id or "root"}
+    else:
+        result["body"] = {"size": len(data), "data": encode(data)}
+    return result
+
+
+class MimeMessage:
+    """
+    The parts of a LocalMessage that come from its RFC 822 bytes.
+
+    Subclasses say where the bytes are (read()); payload() and attachment
+    IDs follow the message's MIME structure.
+    """
+
+    def read(self) -> Tuple[bytes, Message]:
+        """The message's raw bytes and parsed form."""
+        raise NotImplementedError
+
+    def headers(self) -> List[Dict[str, str]]:
+        return [
+            {"name": name, "value": str(value)}
+            for name, value in self.read()[1].items()
+        ]
+
+    def payload(self) -> Dict[str, Any]:
+        return message_payload(self.read()[1])
+
+    def raw(self) -> bytes:
+        return self.read()[0]
+
+    def attachment_data(self, attachment_id: str) -> Optional[bytes]:
+        part = part_at(self.read()[1], "" if attachment_id == "root" else attachment_id)
+        if part is None or part.is_multipart():
+            return None
+        return part.get_payload(decode=True) or b""
+
+
+class _Response(dict):
+    """Enough of httplib2.Response for HttpError: the status and headers."""
+
+    def __init__(
+        self, status: int, reason: str, headers: Optional[Dict[str, str]] = None
+    ):
+        super().__init__(headers or {})
+        self.status = status
+        self.reason = reason
+
+
+def http_error(
+    status: int,
+    reason: str,
+    content: bytes = b"",
+    headers: Optional[Dict[str, str]] = None,
+) -> HttpError:
+    """
+    An API error as googleapiclient raises it, so GmailClient treats it
+    like one from Gmail (429 backs off, 401 signs in again).
+    """
+    return HttpError(_Response(status, reason, headers), content)
+
+
+def not_found(what: str) -> HttpError:
+    return http_error(404, "Not Found", f"{what} not found".encode())
+
+
+def gmail_date(value: str) -> datetime:
+    """The date of an after:/before: term (2024/06/01, 2024-06-01 or Unix time)."""
+    if value.isdigit():  # Unix timestamp, exact to the second
+        return datetime.fromtimestamp(int(value), tz=timezone.utc)
+    return datetime.strptime(
+        value.replace("-", "/"), "%Y/%m/%d"
+    ).replace(tzinfo=timezone.utc)
+
+
+def tokenize_query(query: str) -> List[str]:
+    """Split a query into terms, keeping parentheses and quoted phrases together."""
+    lexer = shlex.shlex(query.replace("(", " ( ").replace(")", " ) "), posix=True)
+    lexer.whitespace_split = True
+    lexer.quotes = '"'
+    return list(lexer)
+
+
+class LocalMailbox:
+    """
+    Messages standing in for a Gmail account.
+
+    requests records every API call as (name, params). page_size is how
+    many messages one messages.list page returns.
+    """
+
+    def __init__(self, email_address: str = "me@example.com", page_size: int = 500):
+        self.email_address = email_address
+        self.page_size = page_size
+        self.messages: Dict[str, LocalMessage] = {}
+        self.requests: List[tuple] = []
+        self._label_ids: Dict[str, str] = {name: name for name in SYSTEM_LABELS}
+        self._last_search: Tuple[Any, List[LocalMessage]] = (None, [])
+
+    def add(self, message: LocalMessage) -> LocalMessage:
+        """Hold a message, creating its user labels as needed."""
+        for label in message.labels:
+            self._label_ids.setdefault(label, f"Label_{len(self._label_ids) + 1}")
+        self.messages[message.id] = message
+        return message
+
+    def remove_message(self, message_id: str) -> None:
+        del self.messages[message_id]
+
+    def service(self) -> "LocalGmailService":
+        """A stand-in for build("gmail", "v1", ...)."""
+        return LocalGmailService(self)
+
+    def client(self, config: Optional[AppConfig] = None) -> GmailClient:
+        """
+        A GmailClient that is signed in to this mailbox.
+
+        Its authenticate() does nothing, so code that signs in first (the
+        CLI, api.Client.connect) can be run as it is.
+        """
+        client = GmailClient(config=config or AppConfig())
+        client.service = self.service()
+        client.credentials = SimpleNamespace(valid=True, token="local")
+
+        async def authenticate(interactive: bool = True) -> None:
+            pass
+
+        client.authenticate = authenticate
+        return client
+
+    def get(self, message_id: str) -> LocalMessage:
+        if message_id not in self.messages:
+            raise not_found(f"Message {message_id}")
+        return self.messages[message_id]
+
+    def label_id(self, name: str) -> str:
+        return self._label_ids[name]
+
+    def label_name(self, label_id: str) -> str:
+        for name, known_id in self._label_ids.items():
+            if known_id == label_id:
+                return name
+        raise not_found(f"Label {label_id}")
+
+    def search(
+        self, query: str, include_spam_trash: bool = False
+    ) -> List[LocalMessage]:
+        """Messages matching a Gmail query, newest first."""
+        terms = tokenize_query(query)
+        wants_hidden = include_spam_trash or any(
+            term.lower() in ("in:trash", "in:spam", "in:anywhere") for term in terms
+        )
+        found = [
+            message for message in self.messages.values()
+            if self._matches_all(message, terms)
+            and (wants_hidden or not {"TRASH", "SPAM"} & set(message.labels))
+        ]
+        return sorted(found, key=lambda message: message.date, reverse=True)
+
+    def search_pages(
+        self, query: str, include_spam_trash: bool, first_page: bool
+    ) -> List[LocalMessage]:
+        """
+        search(), keeping the results for the pages after the first.
+
+        Remote mailboxes (IMAP, Graph) then search once per messages.list
+        listing rather than once per page.
+        """
+        key = (query, include_spam_trash)
+        if first_page or self._last_search[0] != key:
+            self._last_search = (key, self.search(query, include_spam_trash))
+        return self._last_search[1]
+
+    def _matches_all(self, message: LocalMessage, terms: List[str]) -> bool:
+        position = 0
+        while position < len(terms):
+            if terms[position] == "(":
+                end = terms.index(")", position)
+                group = [
+                    term for term in terms[position + 1:end] if term.upper() != "OR"
+                ]
+                if not any(self._matches(message, term) for term in group):
+                    return False
+                position = end + 1
+            else:
+                if not self._matches(message, terms[position]):
+                    return False
+                position += 1
+        return True
+
+    def _matches(self, message: LocalMessage, term: str) -> bool:
+        if term.startswith("-") and len(term) > 1:
+            return not self._matches(message, term[1:])
+
+        operator, _, value = term.partition(":")
+        operator = operator.lower() if value else ""
+        value = value.lower()
+        filenames = [filename.lower() for filename in message.filenames]
+
+        if not operator:
+            text = f"{message.subject} {message.body} {message.sender}".lower()
+            return term.lower() in text
+        if operator == "from":
+            return (
+                value in message.sender.lower()
+                or value == parseaddr(message.sender)[1].lower()
+            )
+        if operator == "to":
+            return value in message.to.lower()
+        if operator == "subject":
+            return value in message.subject.lower()
+        if operator == "label":
+            return any(
+                label_search_term(label) == f"label:{value}" for label in message.labels
+            )
+        if operator == "in":
+            return value == "anywhere" or value.upper() in message.labels
+        if operator == "has":
+            if value == "attachment":
+                return bool(filenames)
+            if value in ("drive", "document", "spreadsheet", "presentation"):
+                return bool(DRIVE_LINK.search(message.body))
+        if operator == "filename":
+            return any(
+                name == value or name.endswith(f".{value}") for name in filenames
+            )
+        if operator in ("larger", "smaller"):
+            limit = parse_file_size(value) if not value.isdigit() else int(value)
+            if limit is None:
+                raise ValueError(f"Bad size in query term: {term}")
+            return (
+                message.size > limit if operator == "larger" else message.size < limit
+            )
+        if operator == "rfc822msgid":
+            return value.strip("<>") == message.rfc822_id.lower()
+        if operator == "after":
+            return message.date >= gmail_date(value)
+        if operator == "before":
+            return message.date < gmail_date(value)
+        raise ValueError(f"Local search does not support the query term: {term}")
+
+
+class _Request:
+    """A prepared API call; execute() answers it."""
+
+    def __init__(
+        self, mailbox: LocalMailbox, name: str, params: Dict[str, Any], answer
+    ):
+        self._mailbox = mailbox
+        self._name = name
+        self._params = params
+        self._answer = answer
+
+    def execute(self) -> Any:
+        self._mailbox.requests.append((self._name, self._params))
+        return self._answer(**self._params)
+
+
+class LocalGmailService:
+    """The users() resource tree of the Gmail API, answered from a LocalMailbox."""
+
+    def __init__(self, mailbox: LocalMailbox):
+        self._mailbox = mailbox
+
+    def users(self) -> "LocalGmailService":
+        return self
+
+    def messages(self) -> "_Messages":
+        return _Messages(self._mailbox)
+
+    def labels(self) -> "_Labels":
+        return _Labels(self._mailbox)
+
+    def threads(self) -> "_Threads":
+        return _Threads(self._mailbox)
+
+    def getProfile(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId):
+            return {
+                "emailAddress": mailbox.email_address,
+                "messagesTotal": len(mailbox.messages),
+                "threadsTotal": len(
+                    {message.thread_id for message in mailbox.messages.values()}
+                ),
+                "historyId": "1",
+            }
+
+        return _Request(mailbox, "users.getProfile", params, answer)
+
+
+class _Labels:
+    def __init__(self, mailbox: LocalMailbox):
+        self._mailbox = mailbox
+
+    def list(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId):
+            return {
+                "labels": [
+                    {
+                        "id": label_id,
+                        "name": name,
+                        "type": "system" if name in SYSTEM_LABELS else "user",
+                    }
+                    for name, label_id in mailbox._label_ids.items()
+                ]
+            }
+
+        return _Request(mailbox, "users.labels.list", params, answer)
+
+    def create(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId, body):
+            name = body["name"]
+            if any(known.lower() == name.lower() for known in mailbox._label_ids):
+                raise http_error(409, "Conflict", b"Label name exists or conflicts")
+            mailbox._label_ids[name] = f"Label_{len(mailbox._label_ids) + 1}"
+            return {"id": mailbox._label_ids[name], "name": name, "type": "user"}
+
+        return _Request(mailbox, "users.labels.create", params, answer)
+
+
+class _Threads:
+    def __init__(self, mailbox: LocalMailbox):
+        self._mailbox = mailbox
+
+    def get(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId, id, format="full"):
+            messages = sorted(
+                (m for m in mailbox.messages.values() if m.thread_id == id),
+                key=lambda m: m.date,
+            )
+            if not messages:
+                raise not_found(f"Thread {id}")
+            return {
+                "id": id,
+                "messages": [{"id": m.id, "threadId": m.thread_id} for m in messages],
+            }
+
+        return _Request(mailbox, "users.threads.get", params, answer)
+
+
+class _Messages:
+    def __init__(self, mailbox: LocalMailbox):
+        self._mailbox = mailbox
+
+    def list(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(
+            userId, q="", maxResults=100, pageToken=None, includeSpamTrash=False
+        ):
+            found = mailbox.search_pages(q, includeSpamTrash, first_page=not pageToken)
+            start = int(pageToken or 0)
+            end = start + min(maxResults, mailbox.page_size)
+            response = {
+                "messages": [
+                    {"id": m.id, "threadId": m.thread_id} for m in found[start:end]
+                ],
+                "resultSizeEstimate": len(found),
+            }
+            if end < len(found):
+                response["nextPageToken"] = str(end)
+            if not response["messages"]:
+                del response["messages"]
+            return response
+
+        return _Request(mailbox, "users.messages.list", params, answer)
+
+    def get(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId, id, format="full", metadataHeaders=None):
+            message = mailbox.get(id)
+            response = {
+                "id": message.id,
+                "threadId": message.thread_id,
+                "labelIds": [mailbox.label_id(label) for label in message.labels],
+                "snippet": message.body[:100],
+                "internalDate": str(int(message.date.timestamp() * 1000)),
+                "sizeEstimate": message.size,
+            }
+            if format == "raw":
+                response["raw"] = encode(message.raw())
+            elif format == "metadata":
+                response["payload"] = {
+                    "mimeType": "multipart/mixed", "headers": message.headers()
+                }
+            else:
+                response["payload"] = message.payload()
+            return response
+
+        return _Request(mailbox, "users.messages.get", params, answer)
+
+    def modify(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId, id, body):
+            message = mailbox.get(id)
+            for label_id in body.get("addLabelIds", []):
+                name = mailbox.label_name(label_id)
+                if name not in message.labels:
+                    message.labels.append(name)
+            for label_id in body.get("removeLabelIds", []):
+                name = mailbox.label_name(label_id)
+                if name in message.labels:
+                    message.labels.remove(name)
+            return {"id": message.id, "threadId": message.thread_id,
+                    "labelIds": [mailbox.label_id(label) for label in message.labels]}
+
+        return _Request(mailbox, "users.messages.modify", params, answer)
+
+    def attachments(self) -> "_Attachments":
+        return _Attachments(self._mailbox)
+
+
+class _Attachments:
+    def __init__(self, mailbox: LocalMailbox):
+        self._mailbox = mailbox
+
+    def get(self, **params) -> _Request:
+        mailbox = self._mailbox
+
+        def answer(userId, messageId, id):
+            data = mailbox.get(messageId).attachment_data(id)
+            if data is None:
+                raise not_found(f"Attachment {id}")
+            return {"size": len(data), "data": encode(data)}
+
+        return _Request(mailbox, "users.messages.attachments.get", params, answer)
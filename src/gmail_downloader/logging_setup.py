@@ -0,0 +1,160 @@
+"""
+Logging setup for the Gmail attachment downloader.
+
+Every module logs through ``logging.getLogger(__name__)``, which puts all of
+our loggers under the ``gmail_downloader`` package logger. This module
+configures that one logger from LoggingConfig plus the CLI verbosity flags:
+
+- Console output goes to stderr, so results printed on stdout (tables, JSON)
+  stay clean enough to pipe into other tools
+- An optional rotating log file keeps a durable record of long watch sessions
+- An optional JSON format makes the log file easy to search and ingest
+"""
+
+import json
+import logging
+import sys
+import uuid
+from datetime import datetime, timezone
+from logging.handlers import RotatingFileHandler
+from pathlib import Path
+from typing import Any, Dict, Optional
+
+from .config import LoggingConfig
+from .utils import ensure_directory, parse_file_size
+
+# Name of the package logger that all module loggers inherit from
+PACKAGE_LOGGER = "gmail_downloader"
+
+# Identifies every log line written by this process, so interleaved logs from
+# several cron runs can be told apart
+RUN_ID = uuid.uuid4().hex[:8]
+
+# Attributes every LogRecord has; anything else was passed via ``extra=``
+_STANDARD_RECORD_ATTRS = set(
+    logging.LogRecord("", 0, "", 0, "", (), None).__dict__
+) | {"message", "asctime", "run_id"}
+
+
+class RunIdFilter(logging.Filter):
+    """Attach the process run ID to every record."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        record.run_id = RUN_ID
+        return True
+
+
+class JsonFormatter(logging.Formatter):
+    """
+    Format log records as one JSON object per line.
+
+    Fields passed through ``logger.info("...", extra={"path": ...})`` are
+    included as top-level keys, which makes them searchable.
+    """
+
+    def __init__(self, include_run_id: bool = True):
+        super().__init__()
+        self.include_run_id = include_run_id
+
+    def format(self, record: logging.LogRecord) -> str:
+        data: Dict[str, Any] = {
+            "time": datetime.fromtimestamp(record.created, tz=timezone.utc).isoformat(),
+            "level": record.levelname,
+            "logger": record.name,
+            "message": record.getMessage(),
+        }
+
+        if self.include_run_id:
+            data["run_id"] = getattr(record, "run_id", RUN_ID)
+
+        for key, value in record.__dict__.items():
+            if key not in _STANDARD_RECORD_ATTRS and not key.startswith("_"):
+                data[key] = value
+
+        if record.exc_info:
+            data["exception"] = self.formatException(record.exc_info)
+
+        return json.dumps(data, default=str)
+
+
+def resolve_console_level(
+    config_level: str, verbose: bool = False, debug: bool = False, quiet: bool = False
+) -> int:
+    """
+    Work out the console log level from config and CLI flags.
+
+    Flags win over the config file: --debug beats --verbose, and --quiet
+    only shows errors.
+    """
+    if debug:
+        return logging.DEBUG
+    if verbose:
+        return logging.INFO
+    if quiet:
+        return logging.ERROR
+    return logging.getLevelName(config_level.upper())
+
+
+def setup_logging(
+    config: LoggingConfig,
+    verbose: bool = False,
+    debug: bool = False,
+    quiet: bool = False,
+    log_file: Optional[str] = None,
+) -> logging.Logger:
+    """
+    Configure the package logger. Safe to call more than once.
+
+    Args:
+        config: Logging section of the application configuration
+        verbose: Show informational messages on the console
+        debug: Show debug messages on the console and in the log file
+        quiet: Only show errors on the console
+        log_file: Overrides config.file_path when given
+
+    Returns:
+        The configured package logger
+    """
+    logger = logging.getLogger(PACKAGE_LOGGER)
+
+    # Remove handlers from a previous call so we never log twice
+    for handler in list(logger.handlers):
+        logger.removeHandler(handler)
+        handler.close()
+
+    console_level = resolve_console_level(config.level, verbose, debug, quiet)
+    file_level = logging.DEBUG if debug else logging.getLevelName(config.level.upper())
+
+    # The logger passes everything; each handler applies its own level
+    logger.setLevel(min(console_level, file_level))
+    logger.propagate = False
+
+    run_id_filter = RunIdFilter()
+
+    console_handler = logging.StreamHandler(sys.stderr)
+    console_handler.setLevel(console_level)
+    console_handler.addFilter(run_id_filter)
+    if config.json_format:
+        console_handler.setFormatter(JsonFormatter(config.include_request_id))
+    else:
+        console_handler.setFormatter(logging.Formatter("%(levelname)s %(message)s"))
+    logger.addHandler(console_handler)
+
+    file_path = log_file or config.file_path
+    if file_path:
+        ensure_directory(Path(file_path).parent)
+        file_handler = RotatingFileHandler(
+            file_path,
+            maxBytes=parse_file_size(config.max_file_size) or 0,
+            backupCount=config.backup_count,
+            encoding="utf-8",
+        )
+        file_handler.setLevel(file_level)
+        file_handler.addFilter(run_id_filter)
+        if config.json_format:
+            file_handler.setFormatter(JsonFormatter(config.include_request_id))
+        else:
+            file_handler.setFormatter(logging.Formatter(config.format_string))
+        logger.addHandler(file_handler)
+
+    return logger
@@ -2,45 +2,4002 @@
 Main CLI application using Typer
 """
 
+import asyncio
+import csv
+import json
+import logging
+import shlex
+import sys
+import time
+from contextlib import ExitStack, contextmanager, nullcontext
+from dataclasses import asdict, dataclass
+from datetime import date, datetime, timedelta
+from pathlib import Path
+from typing import Callable, Iterator, List, Optional, Union
+
+import click
 import typer
+import yaml
 from rich.console import Console
+from rich.markup import escape
 from rich.panel import Panel
+from rich.progress import Progress
+from rich.prompt import Prompt
+from rich.table import Table
+from typer.core import TyperGroup
 from typing_extensions import Annotated
 
-# TODO: Import our modules
-# from .gmail_client import GmailClient
-# from .downloader import AttachmentDownloader
-# from .config import load_config
+from . import __version__, httptrace
+from .backfill import BackfillState, parse_chunk, slice_query, time_slices
+from .checksums import sha256sums, verify
+from .completion import (
+    PROG_NAME,
+    SHELLS,
+    complete_label,
+    complete_organize_by,
+    complete_profile,
+    completion_script,
+)
+from .config import (
+    CONFLICT_POLICIES,
+    ORGANIZE_BY_OPTIONS,
+    SEARCH_SCOPES,
+    AppConfig,
+    ConfigurationError,
+    LoggingConfig,
+    NetworkConfig,
+    load_config,
+)
+from .downloader import (
+    ANOMALY_RECOVERED_RAW,
+    STATUS_EXISTS,
+    STATUS_NEW,
+    STATUS_UPDATED,
+    AttachmentDownloader,
+    DownloadService,
+    EmailWatcher,
+    SORT_KEYS,
+    AttachmentStats,
+    PlannedDownload,
+    aggregate_planned,
+    sort_planned,
+)
+from .docs import build_man_pages, examples_epilog, write_man_pages
+from .doctor import FAIL, OK, SKIP, WARN, Check, run_checks, url_probe
+from .daemon import (
+    DEFAULT_PID_FILE,
+    DaemonError,
+    PidFile,
+    install_signal_handlers,
+    parse_health_addr,
+    sd_notify,
+    serve_health,
+    watch_file,
+)
+from .exitcodes import (
+    EXIT_CODE_MEANINGS,
+    EXIT_AUTH,
+    EXIT_CONFIG,
+    EXIT_ERROR,
+    EXIT_NOTHING_MATCHED,
+    EXIT_OK,
+    EXIT_PARTIAL,
+    exit_code_for,
+)
+from .events import Channel, FileDone, FileFailed, FileStarted, write_json_lines
+from .gmail_client import (
+    FULL_MAIL_SCOPE,
+    READONLY_SCOPE,
+    TRASH_RETENTION_DAYS,
+    EmailAttachment,
+    GmailAPI,
+    GmailError,
+    create_client,
+    days_until_purge,
+    feature_scopes,
+    missing_scopes,
+    quota_summary,
+    required_scopes,
+)
+from .incremental import IncrementalState, cursor_key, newest, since_query
+from .logging_setup import setup_logging
+from .manifest import DownloadManifest, ManifestEntry, ManifestError
+from .mbox import MboxMailbox
+from .network import url_opener
+from .notifier import DownloadEvent, WebhookNotifier
+from .picker import PickerUnavailable, pick
+from .preview import (
+    PREVIEW_TABLE,
+    PREVIEW_WORKBOOK,
+    Preview,
+    describe_range,
+    preview_attachment,
+)
+from .retention import expired, remove_files
+from .runreport import (
+    ReportError,
+    RunFailure,
+    RunReport,
+    RunSummary,
+    find_report,
+    latest_report,
+    load_failures,
+    replay_settings,
+    retry_failures,
+    run_settings,
+    select_failures,
+)
+from .rules import Rule, RuleWatcher, compile_rules
+from .runlock import RunLock, RunLockError, describe_holder
+from .schedule import next_run, parse_schedules
+from .search import SearchIndex, SearchIndexError
+from .selfupdate import (
+    UpdateError,
+    download_verified,
+    is_newer,
+    is_standalone,
+    latest_release,
+    replace_executable,
+)
+from .shard import SHARD_KEYS, Shard, parse_shard
+from .storage import SpoolingStorage, Storage, StorageError
+from .tokenstore import TokenStoreError, open_token_store
+from .utils import format_file_size, parse_date, parse_duration, parse_file_size
+
+class CommandGroup(TyperGroup):
+    """
+    Typer's command group, with usage errors (an unknown option, a missing
+    argument) exiting with EXIT_ERROR rather than Click's 2, which is
+    EXIT_AUTH here. Configuration errors that only show once options are
+    applied, such as a remote --output without download.manifest_dir, exit
+    with EXIT_CONFIG as at loading.
+    """
+
+    def make_context(self, *args, **kwargs) -> click.Context:
+        try:
+            return super().make_context(*args, **kwargs)
+        except click.UsageError as e:
+            e.exit_code = EXIT_ERROR
+            raise
+
+    def invoke(self, ctx: click.Context):
+        try:
+            return super().invoke(ctx)
+        except click.UsageError as e:
+            e.exit_code = EXIT_ERROR
+            raise
+        except ConfigurationError as e:
+            console.print(f"[red]❌ {e}[/red]")
+            raise typer.Exit(code=EXIT_CONFIG)
+
 
 app = typer.Typer(
     name="gmail-downloader",
     help="Gmail Attachment Downloader - Real-time email attachment management",
-    rich_markup_mode="rich"
+    rich_markup_mode="rich",
+    cls=CommandGroup,
 )
 console = Console()
+logger = logging.getLogger(__name__)
 
-@app.command()
+# Colors used for each sync status in dry-run output
+STATUS_STYLES = {
+    STATUS_NEW: "green",
+    STATUS_UPDATED: "yellow",
+    STATUS_EXISTS: "dim",
+}
+
+# download --progress: a progress bar, one JSON event per line on stdout
+# (see events; everything else then goes to stderr), or nothing
+PROGRESS_STYLES = ["bar", "json", "none"]
+
+
+@dataclass
+class LogOptions:
+    """Logging flags given before the subcommand"""
+
+    verbose: bool = False
+    debug: bool = False
+    quiet: bool = False
+    log_file: Optional[str] = None
+    log_json: bool = False
+
+
+@app.callback()
+def main(
+    ctx: typer.Context,
+    verbose: Annotated[
+        bool, typer.Option("--verbose", "-v", help="Show informational log messages")
+    ] = False,
+    debug: Annotated[
+        bool, typer.Option("--debug", help="Show debug log messages")
+    ] = False,
+    quiet: Annotated[
+        bool, typer.Option("--quiet", "-q", help="Only show errors")
+    ] = False,
+    log_file: Annotated[
+        str, typer.Option("--log-file", help="Write logs to this file (rotated)")
+    ] = None,
+    log_json: Annotated[
+        bool, typer.Option("--log-json", help="Emit logs as JSON lines")
+    ] = False,
+    debug_http: Annotated[
+        bool,
+        typer.Option(
+            "--debug-http",
+            help="Log every API request and response, sanitized (implies --debug)",
+        ),
+    ] = False,
+):
+    """Gmail Attachment Downloader - Real-time email attachment management"""
+    if debug_http:
+        httptrace.enable()
+        debug = True
+    ctx.obj = LogOptions(verbose, debug, quiet, log_file, log_json)
+
+    # Console-only logging until the config file tells us about the log file
+    setup_logging(
+        LoggingConfig(file_path=None, json_format=log_json),
+        verbose=verbose,
+        debug=debug,
+        quiet=quiet,
+    )
+
+
+def _load_config_or_exit(config_path: str, ctx: typer.Context) -> AppConfig:
+    """
+    Load configuration and set up logging, exiting with a friendly error on failure
+
+    The running command's defaults (commands: in the file) are applied.
+    """
+    try:
+        config = load_config(config_path, command=ctx.info_name)
+    except ConfigurationError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_CONFIG)
+
+    _setup_logging(config, ctx)
+    return config
+
+
+def _setup_logging(config: AppConfig, ctx: typer.Context) -> None:
+    """Set up logging from the config and the global logging options"""
+    options = ctx.obj or LogOptions()
+    if options.log_json:
+        config.logging.json_format = True
+
+    setup_logging(
+        config.logging,
+        verbose=options.verbose,
+        debug=options.debug,
+        quiet=options.quiet,
+        log_file=options.log_file,
+    )
+
+
+@contextmanager
+def _options_or_exit() -> Iterator[None]:
+    """
+    Report an invalid option and exit
+
+    The _apply_*_options helpers raise ConfigurationError rather than
+    exit, so watch can reuse them when it reloads its configuration.
+    """
+    try:
+        yield
+    except ConfigurationError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+
+def _apply_size_options(
+    config: AppConfig, min_size: Optional[str], max_size: Optional[str]
+) -> None:
+    """Apply --min-size/--max-size ("10KB", "20MB", ...) to the filters"""
+    for flag, value, attribute in (
+        ("--min-size", min_size, "min_size"),
+        ("--max-size", max_size, "max_size"),
+    ):
+        if value is None:
+            continue
+        size = parse_file_size(value)
+        if size is None:
+            raise ConfigurationError(f"Invalid {flag}: {value} (use e.g. 10KB or 20MB)")
+        setattr(config.filters, attribute, size)
+
+    if config.filters.min_size >= config.filters.max_size:
+        raise ConfigurationError("--min-size must be smaller than --max-size")
+
+
+def _apply_budget_options(
+    config: AppConfig, max_total_size: Optional[str], max_files: Optional[int]
+) -> None:
+    """Apply --max-total-size ("2GB") and --max-files to the download budget"""
+    if max_total_size is not None:
+        size = parse_file_size(max_total_size)
+        if not size:
+            raise ConfigurationError(
+                f"Invalid --max-total-size: {max_total_size} (use e.g. 500MB or 2GB)"
+            )
+        config.download.max_total_size = size
+    if max_files is not None:
+        if max_files < 1:
+            raise ConfigurationError("--max-files must be at least 1")
+        config.download.max_files = max_files
+
+
+def _apply_per_message_options(config: AppConfig,
+                               max_per_message: Optional[int],
+                               skip_inline_images: bool) -> None:
+    """Apply --max-per-message and --skip-inline-images to the filters"""
+    if max_per_message is not None:
+        if max_per_message < 1:
+            raise ConfigurationError("--max-per-message must be at least 1")
+        config.filters.max_per_message = max_per_message
+    if skip_inline_images:
+        config.filters.skip_inline_images = True
+
+
+def _apply_scope_options(
+    config: AppConfig, scope: Optional[str], include_spam_trash: bool
+) -> None:
+    """Validate and apply --scope and --include-spam-trash"""
+    if scope is not None:
+        if scope not in SEARCH_SCOPES:
+            raise ConfigurationError(
+                f"Invalid --scope: {scope}. Use one of: {', '.join(SEARCH_SCOPES)}"
+            )
+        config.filters.search_scope = scope
+    if include_spam_trash:
+        config.filters.include_spam_trash = True
+
+
+def _apply_conflict_option(config: AppConfig, on_conflict: Optional[str]) -> None:
+    """Validate and apply --on-conflict"""
+    if on_conflict is None:
+        return
+    if on_conflict not in CONFLICT_POLICIES:
+        raise ConfigurationError(
+            f"Invalid --on-conflict: {on_conflict}. Use one of: "
+            f"{', '.join(CONFLICT_POLICIES)}"
+        )
+    config.download.conflict_policy = on_conflict
+
+
+def _apply_account_options(
+    config: AppConfig, profile: Optional[str], labels: Optional[list[str]]
+) -> None:
+    """Apply --profile and --label"""
+    if profile:
+        config.gmail.use_profile(profile)
+    if labels:
+        config.filters.labels = labels
+
+
+def _apply_organize_option(config: AppConfig, organize_by: Optional[str]) -> None:
+    """Validate and apply --organize-by"""
+    if organize_by is None:
+        return
+    if organize_by not in ORGANIZE_BY_OPTIONS:
+        raise ConfigurationError(
+            f"Invalid --organize-by: {organize_by}. Use one of: "
+            f"{', '.join(ORGANIZE_BY_OPTIONS)}"
+        )
+    config.download.organize_by = organize_by
+
+
+def _apply_shard_option(
+    config: AppConfig, shard: Optional[str], shard_by: str
+) -> Optional[Shard]:
+    """
+    Validate --shard and --shard-by, splitting the configured senders before searching
+
+    Returns the shard if the search results still need splitting, None
+    without --shard or when the narrowed senders already split the work.
+    Exits (EXIT_NOTHING_MATCHED) when none of the senders fall to the shard.
+    """
+    if shard is None:
+        return None
+    try:
+        part = parse_shard(shard, shard_by)
+    except ValueError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    if part.key != "sender" or not config.filters.senders or config.filters.query:
+        return part
+
+    senders = [sender for sender in config.filters.senders if part.owns_sender(sender)]
+    if not senders:
+        console.print(
+            f"ℹ️  None of the {len(config.filters.senders)} "
+            f"sender(s) fall to shard {part}"
+        )
+        raise typer.Exit(code=EXIT_NOTHING_MATCHED)
+    console.print(
+        f"🧩 Shard {part}: {len(senders)} of {len(config.filters.senders)} sender(s)"
+    )
+    config.filters.senders = senders
+    return None
+
+
+async def _ask_conflict(item: PlannedDownload) -> str:
+    """Let the user decide what happens to a file whose destination is taken"""
+    console.print(
+        f"⚠️  {item.path} already exists with different content "
+        f"({item.filename} from {item.message.sender}, "
+        f"{format_file_size(item.attachment.size)})"
+    )
+    return await asyncio.to_thread(
+        Prompt.ask,
+        "Skip, overwrite, rename or version?",
+        choices=["skip", "overwrite", "rename", "version"],
+        default="skip",
+    )
+
+
+def _open_destination(
+    config: AppConfig
+) -> tuple[AttachmentDownloader, DownloadManifest]:
+    """Create the downloader for the configured storage and load its manifest"""
+    downloader = AttachmentDownloader.from_config(config)
+    manifest = DownloadManifest(config.download.get_manifest_dir()).load()
+    return downloader, manifest
+
+
+@contextmanager
+def _run_locks(
+    configs: List[AppConfig], command: str, wait: bool, force: bool
+) -> Iterator[None]:
+    """Lock every download directory configs write to, e.g. those of watch rules"""
+    with ExitStack() as stack:
+        locked = set()
+        for config in configs:
+            directory = config.download.get_manifest_dir()
+            if directory not in locked:
+                locked.add(directory)
+                stack.enter_context(_run_lock(config, command, wait, force))
+        yield
+
+
+@contextmanager
+def _run_lock(
+    config: AppConfig, command: str, wait: bool, force: bool
+) -> Iterator[None]:
+    """Hold the download directory's lock for the run, or exit if another run has it"""
+    lock = RunLock(config.download.get_manifest_dir(), command)
+    try:
+        lock.acquire(
+            wait,
+            force,
+            on_wait=lambda holder: console.print(
+                f"⏳ Waiting for {describe_holder(holder)} to finish"
+            ),
+        )
+    except RunLockError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR) from e
+    try:
+        yield
+    finally:
+        lock.release()
+
+
+def _print_api_usage() -> None:
+    """Show Gmail API usage per profile, since each has its own quota"""
+    for status in quota_summary():
+        stats = status["statistics"]
+        line = (
+            f"📈 {status['profile']}: {stats['requests_made']} requests, "
+            f"{status['quota_used_today']}/{status['quota_limit_daily']} "
+            "quota units today"
+        )
+        if stats["rate_limit_hits"]:
+            line += f", {stats['rate_limit_hits']} rate limit hit(s)"
+        console.print(f"[dim]{line}[/dim]")
+
+
+def _print_size_anomalies(service: DownloadService) -> None:
+    """List attachments whose downloaded size differed from Gmail's declared size"""
+    if not service.size_anomalies:
+        return
+
+    table = Table(title="⚠️  Size anomalies (declared size differs from download)")
+    table.add_column("Filename")
+    table.add_column("Declared", justify="right")
+    table.add_column("Saved", justify="right")
+    table.add_column("Result")
+
+    for entry in service.size_anomalies:
+        result = (
+            "[green]recovered from raw message[/green]"
+            if entry.anomaly == ANOMALY_RECOVERED_RAW
+            else "[yellow]saved as received[/yellow]"
+        )
+        table.add_row(entry.path, str(entry.declared_size), str(entry.size), result)
+
+    console.print(table)
+    console.print(
+        "Find them later with: download --refetch 'anomaly=size_mismatch' --dry-run"
+    )
+
+
+def _print_quarantined(service: DownloadService) -> None:
+    """List attachments quarantined in this run: flagged or with an unsafe name"""
+    if not service.quarantined:
+        return
+
+    table = Table(
+        title=(
+            "🦠 Quarantined (not saved to the downloads; "
+            "see the .reason.json next to each)"
+        )
+    )
+    table.add_column("Sender")
+    table.add_column("Filename")
+    table.add_column("Reason")
+    table.add_column("Quarantined as")
+
+    for entry in service.quarantined:
+        reason = (
+            f"{entry.quarantine_reason}: {entry.scan}"
+            if entry.scan
+            else entry.quarantine_reason
+        )
+        table.add_row(
+            entry.sender, entry.filename, f"[red]{reason}[/red]", entry.quarantine
+        )
+
+    console.print(table)
+
+
+def _print_locked(service: DownloadService) -> None:
+    """List protected attachments that no configured password opened"""
+    if not service.locked:
+        return
+
+    console.print(
+        f"[yellow]🔒 {len(service.locked)} attachment(s) saved still "
+        "password-protected:[/yellow]"
+    )
+    for entry in service.locked:
+        console.print(f"   {entry.path} (from {entry.sender})")
+    console.print(
+        "Add their passwords to the config, then: "
+        "download --refetch 'protection=locked'"
+    )
+
+
+def _print_schema_changes(service: DownloadService) -> None:
+    """List CSV feeds whose columns changed from the previous file"""
+    if not service.schema_changes:
+        return
+
+    table = Table(
+        title="🧬 Schema drift (columns differ from the previous file of the feed)"
+    )
+    table.add_column("Sender")
+    table.add_column("File")
+    table.add_column("Previous file")
+    table.add_column("Change")
+
+    for change in service.schema_changes:
+        table.add_row(
+            change.sender,
+            change.path,
+            change.previous_file,
+            f"[yellow]{change.describe()}[/yellow]",
+        )
+
+    console.print(table)
+
+
+def _retry_options(config_path: str, profile: Optional[str], output: Optional[str],
+                   shard: Optional[Shard] = None) -> list[str]:
+    """
+    Options a printed retry command needs to reach the same account and
+    destination, and the shard whose matches the run kept
+    """
+    options = []
+    if config_path != "config/config.yaml":
+        options += ["--config", config_path]
+    if profile:
+        options += ["--profile", profile]
+    if output:
+        options += ["--output", output]
+    if shard:
+        options += ["--shard", f"{shard.index}/{shard.count}", "--shard-by", shard.key]
+    return options
+
+
+def _print_run_report(
+    config: AppConfig,
+    report: RunReport,
+    retry_options: Optional[list[str]] = None,
+    retry_command: tuple[str, ...] = ("download", "--retry-from"),
+) -> None:
+    """
+    Summarize the run and write its report
+
+    Reports go to download.report_dir when it is set, and for runs with
+    failures in any case, so the retry command (retry_command, the report
+    and retry_options) has a file to read.
+    """
+    minutes, seconds = divmod(report.elapsed_seconds, 60)
+    elapsed = f"{int(minutes)}m {int(seconds)}s" if minutes else f"{seconds:.1f}s"
+    console.print(
+        f"📋 {report.succeeded} succeeded, {report.failed} "
+        f"failed, {report.skipped} skipped; "
+        f"{format_file_size(report.total_bytes)} in {elapsed} "
+        f"({format_file_size(int(report.throughput))}/s)"
+    )
+
+    path = None
+    if config.download.report_dir or report.failures:
+        # What a retry of the run replays
+        report.settings = run_settings(config)
+        try:
+            path = report.save(config.download.get_report_dir())
+            console.print(f"[dim]Run report: {path}[/dim]")
+        except ReportError as e:
+            console.print(f"[yellow]⚠️  {e}[/yellow]")
+
+    if not report.failures:
+        return
+    console.print(f"[red]❌ {report.failed} attachment(s) failed:[/red]")
+    for failure in report.failures:
+        console.print(f"   {failure.filename} from {failure.sender}: {failure.error}")
+    if path is not None and retry_options is not None:
+        command = [PROG_NAME, *retry_command, str(path)] + retry_options
+        console.print(f"Retry them with: {shlex.join(command)}")
+
+
+def _print_budget_skipped(service: DownloadService, limit: int = 20) -> None:
+    """Report the attachments a run left out once its budget was reached"""
+    if not service.budget_reason:
+        return
+
+    skipped = service.budget_skipped
+    total_bytes = sum(item.attachment.size for item in skipped)
+    console.print(
+        f"[yellow]⏹️  Stopped at {service.budget_reason}: "
+        f"{len(skipped)} attachment(s), "
+        f"{format_file_size(total_bytes)}, not downloaded[/yellow]"
+    )
+
+    table = Table()
+    table.add_column("Date")
+    table.add_column("Sender")
+    table.add_column("Filename")
+    table.add_column("Size", justify="right")
+    for item in skipped[:limit]:
+        table.add_row(
+            item.message.date.strftime("%Y-%m-%d"),
+            item.message.sender,
+            item.filename,
+            format_file_size(item.attachment.size),
+        )
+    console.print(table)
+    if len(skipped) > limit:
+        console.print(f"... and {len(skipped) - limit} more")
+    console.print("Run again to continue; files already downloaded are skipped.")
+
+
+def _print_spool_status(storage: Storage) -> None:
+    """Report uploads still waiting in the local spool for an unreachable remote"""
+    if not isinstance(storage, SpoolingStorage):
+        return
+
+    status = storage.status()
+    if status["forwarded"]:
+        console.print(f"📤 Forwarded {status['forwarded']} spooled file(s)")
+    if status["waiting_files"]:
+        console.print(
+            f"[yellow]📦 {status['waiting_files']} file(s) "
+            f"({format_file_size(status['waiting_bytes'])}) waiting in the local spool "
+            "until the remote is reachable again[/yellow]"
+        )
+
+
+def _print_dry_run(planned: list[PlannedDownload], service: DownloadService) -> None:
+    """Show what a real run would do with each matching attachment"""
+    table = Table(title="Dry run - planned downloads")
+    table.add_column("Status")
+    table.add_column("Sender")
+    table.add_column("Filename")
+    table.add_column("Size", justify="right")
+    table.add_column("Destination")
+
+    for item in planned:
+        style = STATUS_STYLES[item.status]
+        table.add_row(
+            f"[{style}]{item.status}[/{style}]",
+            item.message.sender,
+            item.filename,
+            format_file_size(item.attachment.size),
+            str(item.path),
+        )
+
+    console.print(table)
+
+    counts = service.summarize(planned)
+    console.print(
+        f"[green]{counts[STATUS_NEW]} new[/green], "
+        f"[yellow]{counts[STATUS_UPDATED]} updated[/yellow], "
+        f"{counts[STATUS_EXISTS]} already downloaded"
+    )
+
+
+def _print_refetch_plan(
+    entries: list[ManifestEntry], title: str = "Dry run - files to re-download"
+) -> None:
+    """Show which manifest entries a refetch would re-download (or clean remove)"""
+    table = Table(title=title)
+    table.add_column("Sender")
+    table.add_column("Date")
+    table.add_column("Filename")
+    table.add_column("Size", justify="right")
+    table.add_column("Path")
+
+    for entry in entries:
+        table.add_row(
+            entry.sender,
+            entry.date,
+            entry.filename,
+            format_file_size(entry.size),
+            entry.path,
+        )
+
+    console.print(table)
+
+
+async def _run_refetch(config: AppConfig, query: str, dry_run: bool) -> int:
+    """
+    Re-download manifest entries matching a query
+    instead of searching Gmail; returns the exit code
+    """
+    downloader, manifest = _open_destination(config)
+
+    entries = manifest.query(query)
+    if not entries:
+        console.print("ℹ️  No manifest entries match the refetch query")
+        return EXIT_NOTHING_MATCHED
+
+    if dry_run:
+        _print_refetch_plan(entries)
+        return EXIT_OK
+
+    client = create_client(config)
+    await client.authenticate()
+    service = DownloadService(client, downloader, manifest, config)
+
+    saved = await service.refetch(entries)
+    console.print(f"✅ Re-downloaded {len(saved)} attachment(s)")
+    _print_quarantined(service)
+    _print_locked(service)
+    _print_schema_changes(service)
+    _print_spool_status(downloader.storage)
+    _print_api_usage()
+    return EXIT_OK
+
+
+def _print_quota_estimate(
+    service: DownloadService, planned: list[PlannedDownload]
+) -> None:
+    """Report what carrying out the plan would cost in Gmail quota"""
+    estimate = service.estimate_quota(planned)
+    quota = service.gmail_client.quota
+
+    console.print(f"🔎 Searching used {quota.stats['quota_units_used']} quota units")
+    line = (
+        f"📦 Downloading {estimate['attachments']} attachment(s) from "
+        f"{estimate['messages']} "
+        f"message(s) would use about {estimate['units']} quota units"
+    )
+    if estimate["drive_files"]:
+        line += f", plus {estimate['drive_files']} Drive file(s)"
+    console.print(line)
+
+    remaining = quota.remaining()
+    style = "red" if estimate["units"] > remaining else "dim"
+    console.print(
+        f"[{style}]{remaining} of {quota.requests_per_day} daily quota units left "
+        f"for {quota.profile}[/{style}]"
+    )
+
+
+async def _run_download(config: AppConfig,
+                        dry_run: bool,
+                        interactive: bool = False,
+                        estimate: bool = False,
+                        message_refs: Optional[list[str]] = None,
+                        incremental: bool = False,
+                        client: Optional[GmailAPI] = None,
+                        retry_from: Optional[str] = None,
+                        retry_options: Optional[list[str]] = None,
+                        progress: str = "none",
+                        shard: Optional[Shard] = None,
+                        summary: Optional[RunSummary] = None,
+                        prompts: bool = True) -> int:
+    """
+    Plan the download and either preview it or carry it out
+
+    With message_refs (message IDs, Gmail URLs or Message-IDs) only those
+    messages are looked at instead of searching. With incremental, the
+    search starts where the last successful incremental run of the same
+    profile and filters ended, and a completed download moves that point on.
+    With retry_from, a run report, only the attachments that run failed to
+    download are tried again.
+    client replaces the Gmail account, as import does with an mbox file;
+    API usage is only reported for the account.
+
+    The run ends with a summary (see runreport), and retry_options are the
+    command-line options the printed retry command repeats; None prints
+    no retry command. progress is one of PROGRESS_STYLES. With shard, only
+    the matches falling to it are kept (see shard). summary, if given, is
+    filled in as the run goes (see run). Without prompts nothing is ever
+    asked: no browser sign-in, no conflict questions.
+
+    Returns the exit code: EXIT_NOTHING_MATCHED when nothing was found,
+    EXIT_PARTIAL when some downloads failed (see exitcodes).
+    """
+    local = client is not None
+    client = client or create_client(config)
+    await client.authenticate(interactive=prompts)
+
+    downloader, manifest = _open_destination(config)
+    service = DownloadService(client, downloader, manifest, config)
+    if prompts and sys.stdin.isatty():
+        service.ask_conflict = _ask_conflict
+    if summary:
+        service.download_listeners.append(summary.record_file)
+
+    if retry_from:
+        failures = load_failures(retry_from)
+        planned = await service.plan_messages(
+            list(dict.fromkeys(failure.message_id for failure in failures))
+        )
+        planned = select_failures(planned, failures)
+    elif message_refs:
+        message_ids = []
+        for reference in message_refs:
+            message_ids.extend(await client.resolve_message_reference(reference))
+        planned = await service.plan_messages(message_ids)
+    elif incremental:
+        state = IncrementalState(config.download.get_manifest_dir()).load()
+        base_query = service.build_query()
+        key = cursor_key(
+            config.gmail.get_profile_name(),
+            base_query,
+            config.filters.include_spam_trash,
+        )
+        since = state.get(key)
+        if since:
+            console.print(
+                f"🔁 Incremental: messages received since {since:%Y-%m-%d %H:%M %Z}"
+            )
+            planned = await service.plan(
+                queries=[since_query(query, since) for query in service.build_queries()]
+            )
+        else:
+            console.print(
+                "🔁 Incremental: first run for these filters, searching everything"
+            )
+            planned = await service.plan()
+        newest_received = newest(
+            item.message.received or item.message.date for item in planned
+        )
+    else:
+        planned = await service.plan()
+    if shard:
+        found = len(planned)
+        planned = shard.select(planned)
+        console.print(f"🧩 Shard {shard}: {len(planned)} of {found} attachment(s)")
+    if summary:
+        summary.matched = len(planned)
+        summary.newest_message = newest(
+            item.message.received or item.message.date for item in planned
+        )
+    if not planned:
+        console.print("ℹ️  No matching attachments found")
+        return EXIT_NOTHING_MATCHED
+
+    if interactive:
+        planned = pick(planned)
+        if planned is None:
+            console.print("⏹️  Download cancelled")
+            return EXIT_OK
+        if not planned:
+            console.print("ℹ️  Nothing selected")
+            return EXIT_OK
+
+    if estimate:
+        _print_quota_estimate(service, planned)
+        return EXIT_OK
+
+    if dry_run:
+        _print_dry_run(planned, service)
+        return EXIT_OK
+
+    started_at = datetime.now()
+    channel = service.events.subscribe()
+    if progress == "bar":
+        reporter = asyncio.create_task(_show_progress(channel, planned))
+    elif progress == "json":
+        reporter = asyncio.create_task(write_json_lines(channel, sys.stdout))
+    else:
+        channel.close()
+        reporter = None
+    try:
+        saved = await service.execute(planned)
+    finally:
+        channel.close()
+        if reporter:
+            await reporter
+    report = RunReport.from_run(
+        planned, saved, service.failed, service.saved_bytes, started_at, datetime.now()
+    )
+    if summary:
+        summary.report = report
+    console.print(f"✅ Downloaded {len(saved)} attachment(s)")
+    if incremental:
+        if service.budget_reason or service.failed:
+            console.print(
+                "🔁 Budget reached or downloads failed: the next incremental run "
+                "starts from the same point"
+            )
+        else:
+            state.advance(key, newest_received, base_query)
+    _print_budget_skipped(service)
+    _print_size_anomalies(service)
+    _print_quarantined(service)
+    _print_locked(service)
+    _print_schema_changes(service)
+    _print_spool_status(downloader.storage)
+    _print_run_report(config, report, retry_options)
+    if not local:
+        _print_api_usage()
+    return EXIT_PARTIAL if report.failures else EXIT_OK
+
+
+async def _show_progress(channel: Channel, planned: list[PlannedDownload]) -> None:
+    """Progress bar of the files downloaded so far, from the run's events"""
+    total = sum(1 for item in planned if item.status != STATUS_EXISTS)
+    with Progress(console=console, transient=True) as bar:
+        task = bar.add_task("Downloading", total=total)
+        async for event in channel:
+            if isinstance(event, FileStarted):
+                bar.update(task, description=f"Downloading {event.item.filename}")
+            elif isinstance(event, (FileDone, FileFailed)):
+                bar.advance(task)
+
+
+def _download_option_conflict(interactive: bool = False,
+                              refetch: bool = False,
+                              message_id: bool = False,
+                              query: bool = False,
+                              incremental: bool = False,
+                              retry_from: bool = False,
+                              shard: bool = False) -> str:
+    """
+    Why the download options given cannot be used together, "" if they can
+
+    --incremental moves its starting point past everything it found, so it
+    cannot download only a picked part of that (--interactive).
+    """
+    if interactive and refetch:
+        return "--interactive cannot be combined with --refetch"
+    if message_id and (refetch or query):
+        return "--message-id cannot be combined with --refetch or --query"
+    if incremental and (message_id or refetch or interactive):
+        return (
+            "--incremental cannot be combined with "
+            "--message-id, --refetch or --interactive"
+        )
+    if retry_from and (message_id or refetch or incremental):
+        return (
+            "--retry-from cannot be combined with "
+            "--message-id, --refetch or --incremental"
+        )
+    if shard and (message_id or refetch or incremental):
+        return (
+            "--shard cannot be combined with --message-id, --refetch or --incremental"
+        )
+    return ""
+
+
+@app.command(epilog=examples_epilog("download"))
 def download(
-    sender: Annotated[list[str], typer.Option("--sender", "-s", help="Filter by sender email")] = None,
-    after: Annotated[str, typer.Option("--after", "-a", help="Download emails after date (YYYY-MM-DD)")] = None,
-    extensions: Annotated[list[str], typer.Option("--extensions", "-e", help="File extensions to download")] = None,
-    output: Annotated[str, typer.Option("--output", "-o", help="Output directory")] = None,
-    dry_run: Annotated[bool, typer.Option("--dry-run", help="Preview without downloading")] = False,
+    ctx: typer.Context,
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Filter by sender email")
+    ] = None,
+    after: Annotated[
+        str,
+        typer.Option("--after", "-a", help="Download emails after date (YYYY-MM-DD)"),
+    ] = None,
+    extensions: Annotated[
+        list[str],
+        typer.Option("--extensions", "-e", help="File extensions to download"),
+    ] = None,
+    filename_pattern: Annotated[
+        list[str],
+        typer.Option(
+            "--filename-pattern",
+            help=(
+                "Only attachment names matching this glob, "
+                "or regex anchored with ^ or $ (repeatable)"
+            ),
+        ),
+    ] = None,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", help="Raw Gmail search query, replacing the structured filters"
+        ),
+    ] = None,
+    message_id: Annotated[
+        list[str],
+        typer.Option(
+            "--message-id",
+            "-m",
+            help=(
+                "Only this message: a message ID, Gmail "
+                "URL or Message-ID header (repeatable)"
+            ),
+        ),
+    ] = None,
+    min_size: Annotated[
+        str,
+        typer.Option(
+            "--min-size", help="Skip attachments smaller than this (e.g. 10KB)"
+        ),
+    ] = None,
+    max_size: Annotated[
+        str,
+        typer.Option(
+            "--max-size", help="Skip attachments larger than this (e.g. 20MB)"
+        ),
+    ] = None,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Output directory")
+    ] = None,
+    save_body: Annotated[
+        bool,
+        typer.Option(
+            "--save-body",
+            help="Also save each email's text/HTML body next to its attachments",
+        ),
+    ] = False,
+    save_eml: Annotated[
+        bool,
+        typer.Option(
+            "--save-eml",
+            help="Also save each full email as .eml next to its attachments",
+        ),
+    ] = False,
+    drive_links: Annotated[
+        bool,
+        typer.Option(
+            "--drive-links",
+            help="Also download Drive/Docs/Sheets files linked in message bodies",
+        ),
+    ] = False,
+    on_conflict: Annotated[
+        str,
+        typer.Option(
+            "--on-conflict",
+            help=(
+                "When a different file exists: skip, "
+                "overwrite, rename, version or ask"
+            ),
+        ),
+    ] = None,
+    latest_per_thread: Annotated[
+        bool,
+        typer.Option(
+            "--latest-per-thread",
+            help="Only the newest attachment of each filename within a thread",
+        ),
+    ] = False,
+    max_per_message: Annotated[
+        int,
+        typer.Option(
+            "--max-per-message",
+            help="Keep at most this many attachments per message (1 = first only)",
+        ),
+    ] = None,
+    skip_inline_images: Annotated[
+        bool,
+        typer.Option(
+            "--skip-inline-images",
+            help="Skip logos, signatures and other images embedded in the body",
+        ),
+    ] = False,
+    skip_junk: Annotated[
+        bool,
+        typer.Option(
+            "--skip-junk",
+            help=(
+                "Drop signature images, tracking pixels "
+                "and logos (see junk: in the config)"
+            ),
+        ),
+    ] = False,
+    scope: Annotated[
+        str,
+        typer.Option("--scope", help=f"Mail to search: {', '.join(SEARCH_SCOPES)}"),
+    ] = None,
+    include_spam_trash: Annotated[
+        bool, typer.Option("--include-spam-trash", help="Also search Spam and Trash")
+    ] = False,
+    max_total_size: Annotated[
+        str,
+        typer.Option(
+            "--max-total-size",
+            help="Stop once this much has been downloaded (e.g. 2GB)",
+        ),
+    ] = None,
+    max_files: Annotated[
+        int,
+        typer.Option("--max-files", help="Stop once this many files have been saved"),
+    ] = None,
+    incremental: Annotated[
+        bool,
+        typer.Option(
+            "--incremental",
+            help=(
+                "Only messages received since the last "
+                "successful --incremental run with these filters"
+            ),
+        ),
+    ] = False,
+    interactive: Annotated[
+        bool,
+        typer.Option(
+            "--interactive",
+            "-i",
+            help="Pick the files to download from a checklist of the matches",
+        ),
+    ] = False,
+    estimate: Annotated[
+        bool,
+        typer.Option(
+            "--estimate",
+            help="Only report the Gmail quota units the download would use",
+        ),
+    ] = False,
+    dry_run: Annotated[
+        bool,
+        typer.Option(
+            "--dry-run",
+            help="Preview without downloading, showing NEW/UPDATED/EXISTS per file",
+        ),
+    ] = False,
+    refetch: Annotated[
+        str,
+        typer.Option(
+            "--refetch",
+            help=(
+                "Re-download files matching a manifest query, "
+                "e.g. 'sender=a@b.com AND date>2025-01-01'"
+            ),
+        ),
+    ] = None,
+    retry_from: Annotated[
+        str,
+        typer.Option(
+            "--retry-from",
+            help=(
+                "Retry the attachments a run failed to download, from its run report"
+            ),
+        ),
+    ] = None,
+    progress: Annotated[
+        str,
+        typer.Option(
+            "--progress",
+            help=(
+                f"Progress while downloading: {', '.join(PROGRESS_STYLES)} "
+                "(default: bar in a terminal)"
+            ),
+        ),
+    ] = None,
+    shard: Annotated[
+        str,
+        typer.Option(
+            "--shard",
+            help=(
+                "Only part K of N of the matches (e.g. 2/4), to split a large "
+                "download across processes"
+            ),
+        ),
+    ] = None,
+    shard_by: Annotated[
+        str,
+        typer.Option(
+            "--shard-by", help=f"What --shard splits on: {', '.join(SHARD_KEYS)}"
+        ),
+    ] = "sender",
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    label: Annotated[
+        list[str],
+        typer.Option(
+            "--label",
+            help="Only messages with this Gmail label",
+            autocompletion=complete_label,
+        ),
+    ] = None,
+    organize_by: Annotated[
+        str,
+        typer.Option(
+            "--organize-by",
+            help=f"Folder layout: {', '.join(ORGANIZE_BY_OPTIONS)}",
+            autocompletion=complete_organize_by,
+        ),
+    ] = None,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
 ):
     """Download attachments based on filters"""
-    console.print(Panel.fit("🔄 Download mode - [bold]Coming soon![/bold]"))
-    # TODO: Implement download logic
+    if progress and progress not in PROGRESS_STYLES:
+        console.print(
+            f"[red]❌ --progress must be one of: {', '.join(PROGRESS_STYLES)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if progress == "json":
+        # stdout carries only the events
+        console.file = sys.stderr
+    conflict = _download_option_conflict(
+        interactive=interactive,
+        refetch=bool(refetch),
+        message_id=bool(message_id),
+        query=bool(query),
+        incremental=incremental,
+        retry_from=bool(retry_from),
+        shard=bool(shard),
+    )
+    if conflict:
+        console.print(f"[red]❌ {conflict}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    if interactive and not (sys.stdin.isatty() and sys.stdout.isatty()):
+        console.print("[red]❌ --interactive needs a terminal[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
 
+    config = _load_config_or_exit(config_path, ctx)
+    if retry_from:
+        # The retried run's filters and download settings, under any given now
+        try:
+            replay_settings(config, retry_from)
+        except ReportError as e:
+            console.print(f"[red]❌ {e}[/red]")
+            raise typer.Exit(code=exit_code_for(e))
 
-@app.command()
+    # CLI arguments are the final configuration layer
+    if sender:
+        config.filters.senders = sender
+    if after:
+        config.filters.after_date = after
+    if extensions:
+        config.filters.extensions = extensions
+    if filename_pattern:
+        config.filters.filename_patterns = filename_pattern
+    if query:
+        config.filters.query = query
+    with _options_or_exit():
+        _apply_size_options(config, min_size, max_size)
+        if latest_per_thread:
+            config.filters.latest_per_thread = True
+        _apply_per_message_options(config, max_per_message, skip_inline_images)
+        if skip_junk:
+            config.junk.enabled = True
+        _apply_scope_options(config, scope, include_spam_trash)
+        _apply_account_options(config, profile, label)
+        if output:
+            config.download.base_dir = output
+        _apply_organize_option(config, organize_by)
+        if save_body:
+            config.download.save_body = True
+        if save_eml:
+            config.download.save_eml = True
+        if drive_links:
+            config.download.drive_links = True
+        _apply_conflict_option(config, on_conflict)
+        _apply_budget_options(config, max_total_size, max_files)
+    part = _apply_shard_option(config, shard, shard_by)
+
+    # Looking changes nothing, so it needs no lock
+    lock = (
+        nullcontext()
+        if dry_run or estimate
+        else _run_lock(config, "download", wait, force)
+    )
+    try:
+        with lock:
+            if refetch:
+                code = asyncio.run(_run_refetch(config, refetch, dry_run))
+            else:
+                code = asyncio.run(
+                    _run_download(
+                        config,
+                        dry_run,
+                        interactive,
+                        estimate,
+                        message_id,
+                        incremental,
+                        retry_from=retry_from,
+                        retry_options=_retry_options(
+                            config_path, profile, output, part
+                        ),
+                        progress=progress or ("bar" if sys.stdout.isatty() else "none"),
+                        shard=part,
+                    )
+                )
+    except (
+        GmailError, ManifestError, StorageError, PickerUnavailable, ReportError
+    ) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    if code:
+        raise typer.Exit(code=code)
+
+
+async def _run_retry(
+    config: AppConfig,
+    report_path: Path,
+    attempts: int,
+    backoff: float,
+    retry_options: list[str],
+) -> int:
+    """
+    Download the attachments a run report lists as failed, and only those
+
+    See runreport.retry_failures for the backoff; the result is summarized
+    and reported like a download run. Returns the exit code.
+    """
+    failures = load_failures(report_path)
+    if not failures:
+        console.print(f"ℹ️  {report_path.name}: nothing failed in that run")
+        return EXIT_OK
+    console.print(
+        f"🔁 Retrying {len(failures)} failed attachment(s) from {report_path.name}"
+    )
+
+    client = create_client(config)
+    await client.authenticate()
+    downloader, manifest = _open_destination(config)
+    service = DownloadService(client, downloader, manifest, config)
+
+    def waiting(remaining: list[RunFailure], attempt: int, delay: float) -> None:
+        console.print(
+            f"⏳ {len(remaining)} still failing; attempt "
+            f"{attempt} of {attempts} in {delay:g}s"
+        )
+
+    report = await retry_failures(service, failures, attempts, backoff, on_wait=waiting)
+    console.print(f"✅ Downloaded {report.succeeded} attachment(s)")
+    _print_size_anomalies(service)
+    _print_quarantined(service)
+    _print_locked(service)
+    _print_schema_changes(service)
+    _print_spool_status(downloader.storage)
+    _print_run_report(config, report, retry_options, retry_command=("retry",))
+    _print_api_usage()
+    return EXIT_PARTIAL if report.failures else EXIT_OK
+
+
+@app.command(epilog=examples_epilog("retry"))
+def retry(
+    ctx: typer.Context,
+    run_id: Annotated[
+        str,
+        typer.Argument(
+            help="Run to retry: its ID (run-2024-06-01-093012) or report file"
+        ),
+    ] = None,
+    last: Annotated[
+        bool, typer.Option("--last", help="Retry the most recent run")
+    ] = False,
+    attempts: Annotated[
+        int,
+        typer.Option(
+            "--attempts", help="Tries per attachment, including the first", min=1
+        ),
+    ] = 3,
+    backoff: Annotated[
+        str,
+        typer.Option(
+            "--backoff",
+            help="Wait before the second try, doubling after that (e.g. 30s, 2m)",
+        ),
+    ] = "30s",
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Output directory")
+    ] = None,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Download again only the attachments an earlier run failed to download"""
+    if bool(run_id) == last:
+        console.print("[red]❌ Name a run to retry, or use --last[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    delay = parse_duration(backoff)
+    if delay is None:
+        console.print(f"[red]❌ Invalid --backoff: {backoff}. Use e.g. 30s or 2m[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+    _apply_account_options(config, profile, None)
+    if output:
+        config.download.base_dir = output
+
+    try:
+        report_dir = config.download.get_report_dir()
+        report_path = (
+            latest_report(report_dir) if last else find_report(report_dir, run_id)
+        )
+        replay_settings(config, report_path)
+        if output:
+            config.download.base_dir = output
+        with _run_lock(config, "retry", wait, force):
+            code = asyncio.run(
+                _run_retry(
+                    config,
+                    report_path,
+                    attempts,
+                    delay.total_seconds(),
+                    _retry_options(config_path, profile, output),
+                )
+            )
+    except (GmailError, ManifestError, StorageError, ReportError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    if code:
+        raise typer.Exit(code=code)
+
+
+async def _run_backfill(config: AppConfig,
+                        slices: list[tuple[date, date]],
+                        dry_run: bool,
+                        retry_options: list[str],
+                        shard: Optional[Shard] = None) -> int:
+    """
+    Download the slices one after another, oldest first
+
+    A slice whose attachments were all downloaded is checkpointed (see
+    backfill) and skipped by later runs with the same search. One with
+    failures is left for the next run. The download budget is the whole
+    backfill's: reaching it stops the backfill there. The whole backfill
+    is summarized as one run.
+    With shard, only the matches falling to it are kept, and checkpoints
+    are the shard's own. Returns the exit code, as _run_download does.
+    """
+    client = create_client(config)
+    await client.authenticate()
+    downloader, manifest = _open_destination(config)
+    service = DownloadService(client, downloader, manifest, config)
+
+    state = BackfillState(config.download.get_manifest_dir()).load()
+    base_query = service.build_query()
+    search = f"{base_query}\nshard {shard}" if shard else base_query
+    key = cursor_key(
+        config.gmail.get_profile_name(), search, config.filters.include_spam_trash
+    )
+    queries = service.build_queries()
+
+    started_at = datetime.now()
+    planned, saved, failed, saved_bytes = [], [], [], 0
+    searched = 0
+    unsearched = 0
+    for index, (start, end) in enumerate(slices):
+        span = f"{start:%Y-%m-%d} → {end:%Y-%m-%d}"
+        if state.is_done(key, start, end):
+            console.print(f"[dim]⏭️  {span}: done in an earlier run[/dim]")
+            continue
+
+        found = await service.plan(
+            queries=[
+                slice_query(query, start, end, config.download.timezone)
+                for query in queries
+            ]
+        )
+        if shard:
+            found = shard.select(found)
+        searched += 1
+        if dry_run:
+            counts = service.summarize(found)
+            console.print(
+                f"📅 {span}: {counts[STATUS_NEW]} new, "
+                f"{counts[STATUS_UPDATED]} updated, "
+                f"{counts[STATUS_EXISTS]} already downloaded"
+            )
+            continue
+
+        service.spent_files, service.spent_bytes = len(saved), saved_bytes
+        done = await service.execute(found)
+        planned += found
+        saved += done
+        failed += service.failed
+        saved_bytes += service.saved_bytes
+        console.print(
+            f"📅 {span}: {len(done)} downloaded, {len(service.failed)} failed"
+        )
+        if service.budget_reason:
+            unsearched = len(slices) - index - 1
+            break
+        if not service.failed:
+            state.mark_done(key, start, end, base_query)
+
+    if dry_run:
+        return EXIT_OK
+    report = RunReport.from_run(
+        planned, saved, failed, saved_bytes, started_at, datetime.now()
+    )
+    console.print(
+        f"✅ Downloaded {len(saved)} attachment(s), {format_file_size(saved_bytes)}" + (
+            f"; {len(failed)} failed" if failed else ""
+        )
+    )
+    _print_budget_skipped(service)
+    if unsearched:
+        console.print(
+            f"[yellow]⏹️  {unsearched} later slice(s) not searched; run the backfill "
+            "again to go on[/yellow]"
+        )
+    _print_size_anomalies(service)
+    _print_quarantined(service)
+    _print_locked(service)
+    _print_schema_changes(service)
+    _print_spool_status(downloader.storage)
+    _print_run_report(config, report, retry_options)
+    _print_api_usage()
+    if report.failures:
+        return EXIT_PARTIAL
+    # Every slice done in earlier runs leaves nothing to match
+    return EXIT_NOTHING_MATCHED if searched and not planned else EXIT_OK
+
+
+@app.command(epilog=examples_epilog("backfill"))
+def backfill(
+    ctx: typer.Context,
+    from_date: Annotated[
+        str, typer.Option("--from", help="First day to download (YYYY-MM-DD)")
+    ],
+    to_date: Annotated[
+        str,
+        typer.Option(
+            "--to", help="Day to stop before (YYYY-MM-DD; default: through today)"
+        ),
+    ] = None,
+    chunk: Annotated[
+        str,
+        typer.Option(
+            "--chunk",
+            help="Slice length: days (7d), weeks (2w), months (1m) or years (1y)",
+        ),
+    ] = "1m",
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Filter by sender email")
+    ] = None,
+    extensions: Annotated[
+        list[str],
+        typer.Option("--extensions", "-e", help="File extensions to download"),
+    ] = None,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", help="Raw Gmail search query, replacing the structured filters"
+        ),
+    ] = None,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Output directory")
+    ] = None,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    label: Annotated[
+        list[str],
+        typer.Option(
+            "--label",
+            help="Only messages with this Gmail label",
+            autocompletion=complete_label,
+        ),
+    ] = None,
+    organize_by: Annotated[
+        str,
+        typer.Option(
+            "--organize-by",
+            help=f"Folder layout: {', '.join(ORGANIZE_BY_OPTIONS)}",
+            autocompletion=complete_organize_by,
+        ),
+    ] = None,
+    shard: Annotated[
+        str,
+        typer.Option(
+            "--shard",
+            help=(
+                "Only part K of N of the work (e.g. 2/4), "
+                "to split a backfill across machines"
+            ),
+        ),
+    ] = None,
+    shard_by: Annotated[
+        str,
+        typer.Option(
+            "--shard-by",
+            help=(
+                f"What --shard splits on: {', '.join(SHARD_KEYS)} "
+                "(date hands out whole slices)"
+            ),
+        ),
+    ] = "date",
+    dry_run: Annotated[
+        bool,
+        typer.Option("--dry-run", help="Only count what each slice would download"),
+    ] = False,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """
+    Download years of old mail one time slice at a
+    time, resuming where an interrupted run stopped
+    """
+    start = parse_date(from_date)
+    end = (
+        parse_date(to_date)
+        if to_date
+        else datetime.combine(date.today() + timedelta(days=1), datetime.min.time())
+    )
+    if start is None or end is None:
+        console.print(
+            f"[red]❌ Invalid date: {from_date if start is None else to_date} "
+            "(use YYYY-MM-DD)[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if start >= end:
+        console.print("[red]❌ --from must be before --to[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    length = parse_chunk(chunk)
+    if length is None:
+        console.print(
+            f"[red]❌ Invalid --chunk: {chunk}. Use e.g. 7d, 2w, 1m or 1y[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+
+    # --from and --to replace the configured dates; each slice adds its own
+    config.filters.after_date = None
+    config.filters.before_date = None
+    if sender:
+        config.filters.senders = sender
+    if extensions:
+        config.filters.extensions = extensions
+    if query:
+        config.filters.query = query
+    _apply_account_options(config, profile, label)
+    if output:
+        config.download.base_dir = output
+    with _options_or_exit():
+        _apply_organize_option(config, organize_by)
+    part = _apply_shard_option(config, shard, shard_by)
+
+    slices = time_slices(start.date(), end.date(), length)
+    console.print(
+        f"🗓️  Backfilling {start:%Y-%m-%d} to {end:%Y-%m-%d} "
+        f"in {len(slices)} slice(s) of {chunk}"
+    )
+    if part and part.key == "date":
+        # Whole slices per shard: each searches only its own months
+        slices = part.split(slices)
+        console.print(f"🧩 Shard {part}: {len(slices)} slice(s)")
+        part = None
+    try:
+        with nullcontext() if dry_run else _run_lock(config, "backfill", wait, force):
+            code = asyncio.run(
+                _run_backfill(
+                    config,
+                    slices,
+                    dry_run,
+                    _retry_options(config_path, profile, output, part),
+                    shard=part,
+                )
+            )
+    except (GmailError, ManifestError, StorageError, ReportError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    if code:
+        raise typer.Exit(code=code)
+
+
+# Log file for watch --daemon when neither --log-file nor logging.file_path is set
+DEFAULT_DAEMON_LOG_FILE = "logs/gmail_downloader.log"
+
+# How long stopping the watcher waits for queued webhook notifications
+NOTIFY_DRAIN_SECONDS = 10
+
+
+async def _run_watch(config: AppConfig,
+                     reload_config: Optional[Callable[[], AppConfig]] = None,
+                     config_file: Optional[str] = None,
+                     daemon: bool = False,
+                     rules: Optional[List[Rule]] = None) -> None:
+    """
+    Download attachments from new messages as they arrive
+
+    With rules, each one watches with its own configuration, all through
+    the one client of config's account. With reload_config, SIGHUP
+    reloads the configuration, and so does saving config_file when
+    watch.reload_on_change is set. As a daemon, SIGUSR1 also logs a
+    health report, SIGTERM stops the watcher, and systemd is kept
+    informed via sd_notify.
+    """
+    client = create_client(config)
+    await client.authenticate()
+
+    def open_service(rule_config: AppConfig) -> DownloadService:
+        downloader, manifest = _open_destination(rule_config)
+        return DownloadService(client, downloader, manifest, rule_config)
+
+    if rules:
+        watcher = RuleWatcher(rules, lambda rule: open_service(rule.config))
+        services = [rule_watcher.service for rule_watcher in watcher.watchers.values()]
+    else:
+        watcher = EmailWatcher(open_service(config))
+        services = [watcher.service]
+
+    notifications = []
+    for service in services:
+        notifier = WebhookNotifier(service.config.notifications)
+        if notifier.enabled:
+            async def notify(
+                channel: Channel, notifier: WebhookNotifier = notifier
+            ) -> None:
+                async for event in channel:
+                    if isinstance(event, FileDone):
+                        await notifier.notify(
+                            DownloadEvent.from_manifest_entry(
+                                event.entry, str(event.path)
+                            )
+                        )
+
+            notifications.append(
+                (service, asyncio.create_task(notify(service.events.subscribe())))
+            )
+
+    health_server = None
+    config_watch = None
+    if reload_config:
+        reload = _reloader(watcher, reload_config)
+        install_signal_handlers({"SIGHUP": reload})
+        if config_file and config.watch.reload_on_change:
+            config_watch = asyncio.create_task(watch_file(config_file, reload))
+    if daemon:
+        health_server = await _start_daemon(watcher, config.watch.health_addr)
+
+    try:
+        await watcher.start_watching(
+            config.watch.check_interval,
+            backfill=parse_duration(config.watch.backfill),
+        )
+    finally:
+        stopped = []
+        if config_watch:
+            config_watch.cancel()
+            stopped.append(config_watch)
+        if notifications:
+            # Let notifications already queued go out, within reason
+            for service, _ in notifications:
+                service.events.close()
+            await asyncio.wait(
+                {task for _, task in notifications}, timeout=NOTIFY_DRAIN_SECONDS
+            )
+            for _, task in notifications:
+                task.cancel()
+                stopped.append(task)
+        # Cancelled tasks still have to unwind before the loop closes
+        await asyncio.gather(*stopped, return_exceptions=True)
+        if health_server:
+            health_server.close()
+            await health_server.wait_closed()
+        for service in services:
+            _print_spool_status(service.downloader.storage)
+
+
+def _reloader(
+    watcher: Union[EmailWatcher, RuleWatcher], reload_config: Callable[[], AppConfig]
+) -> Callable[[], None]:
+    """Reload the configuration into the running watcher, keeping it if invalid"""
+    def reload() -> None:
+        sd_notify("RELOADING=1")
+        try:
+            watcher.reload(reload_config())
+        except (ConfigurationError, yaml.YAMLError, OSError) as e:
+            # A half-saved or unreadable file must not stop the watcher
+            logger.error(f"Reload failed, keeping the current configuration: {e}")
+        sd_notify("READY=1", "STATUS=Configuration reloaded")
+
+    return reload
+
+
+async def _start_daemon(
+    watcher: Union[EmailWatcher, RuleWatcher], health_addr: Optional[str]
+):
+    """Hook the watcher up to signals, systemd and the health endpoint"""
+    def report() -> None:
+        logger.info(f"Health: {json.dumps(watcher.health(), default=str)}")
+
+    def stop() -> None:
+        sd_notify("STOPPING=1")
+        watcher.stop_watching()
+
+    install_signal_handlers({
+        "SIGUSR1": report,
+        "SIGTERM": stop,
+        "SIGINT": stop,
+    })
+
+    def polled() -> None:
+        # The first completed check (the baseline) means we are up
+        stats = watcher.stats
+        sd_notify(
+            "READY=1",
+            "WATCHDOG=1",
+            f"STATUS=Watching; {stats['messages_processed']} message(s), "
+            f"{stats['attachments_saved']} attachment(s), {stats['errors']} error(s)",
+        )
+
+    watcher.poll_listeners.append(polled)
+
+    if health_addr:
+        return await serve_health(health_addr, watcher.health)
+    return None
+
+
+@app.command(epilog=examples_epilog("watch"))
 def watch(
-    sender: Annotated[list[str], typer.Option("--sender", "-s", help="Monitor emails from sender")] = None,
-    extensions: Annotated[list[str], typer.Option("--extensions", "-e", help="File extensions to watch")] = None,
-    interval: Annotated[int, typer.Option("--interval", "-i", help="Check interval in seconds")] = 30,
+    ctx: typer.Context,
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Monitor emails from sender")
+    ] = None,
+    extensions: Annotated[
+        list[str], typer.Option("--extensions", "-e", help="File extensions to watch")
+    ] = None,
+    filename_pattern: Annotated[
+        list[str],
+        typer.Option(
+            "--filename-pattern",
+            help=(
+                "Only attachment names matching this glob, "
+                "or regex anchored with ^ or $ (repeatable)"
+            ),
+        ),
+    ] = None,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", help="Raw Gmail search query, replacing the structured filters"
+        ),
+    ] = None,
+    min_size: Annotated[
+        str,
+        typer.Option(
+            "--min-size", help="Skip attachments smaller than this (e.g. 10KB)"
+        ),
+    ] = None,
+    max_size: Annotated[
+        str,
+        typer.Option(
+            "--max-size", help="Skip attachments larger than this (e.g. 20MB)"
+        ),
+    ] = None,
+    max_per_message: Annotated[
+        int,
+        typer.Option(
+            "--max-per-message",
+            help="Keep at most this many attachments per message (1 = first only)",
+        ),
+    ] = None,
+    skip_inline_images: Annotated[
+        bool,
+        typer.Option(
+            "--skip-inline-images",
+            help="Skip logos, signatures and other images embedded in the body",
+        ),
+    ] = False,
+    skip_junk: Annotated[
+        bool,
+        typer.Option(
+            "--skip-junk",
+            help=(
+                "Drop signature images, tracking pixels "
+                "and logos (see junk: in the config)"
+            ),
+        ),
+    ] = False,
+    scope: Annotated[
+        str,
+        typer.Option("--scope", help=f"Mail to search: {', '.join(SEARCH_SCOPES)}"),
+    ] = None,
+    include_spam_trash: Annotated[
+        bool, typer.Option("--include-spam-trash", help="Also search Spam and Trash")
+    ] = False,
+    interval: Annotated[
+        int, typer.Option("--interval", "-i", help="Check interval in seconds")
+    ] = None,
+    schedule: Annotated[
+        list[str],
+        typer.Option(
+            "--schedule",
+            help='Check at cron times instead, e.g. "0 7 * * MON-FRI" (repeatable)',
+        ),
+    ] = None,
+    backfill: Annotated[
+        str,
+        typer.Option(
+            "--backfill",
+            help="First download matching messages from this far back (e.g. 7d)",
+        ),
+    ] = None,
+    save_body: Annotated[
+        bool,
+        typer.Option(
+            "--save-body",
+            help="Also save each email's text/HTML body next to its attachments",
+        ),
+    ] = False,
+    save_eml: Annotated[
+        bool,
+        typer.Option(
+            "--save-eml",
+            help="Also save each full email as .eml next to its attachments",
+        ),
+    ] = False,
+    drive_links: Annotated[
+        bool,
+        typer.Option(
+            "--drive-links",
+            help="Also download Drive/Docs/Sheets files linked in message bodies",
+        ),
+    ] = False,
+    on_conflict: Annotated[
+        str,
+        typer.Option(
+            "--on-conflict",
+            help=(
+                "When a different file exists: skip, "
+                "overwrite, rename, version or ask"
+            ),
+        ),
+    ] = None,
+    daemon: Annotated[
+        bool,
+        typer.Option(
+            "--daemon",
+            help="Run as a service: PID file, log file, signals and systemd notify",
+        ),
+    ] = False,
+    pid_file: Annotated[
+        str,
+        typer.Option(
+            "--pid-file", help=f"PID file for --daemon (default {DEFAULT_PID_FILE})"
+        ),
+    ] = None,
+    health_addr: Annotated[
+        str,
+        typer.Option("--health-addr", help="Serve a JSON health report on host:port"),
+    ] = None,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    label: Annotated[
+        list[str],
+        typer.Option(
+            "--label",
+            help="Only messages with this Gmail label",
+            autocompletion=complete_label,
+        ),
+    ] = None,
+    organize_by: Annotated[
+        str,
+        typer.Option(
+            "--organize-by",
+            help=f"Folder layout: {', '.join(ORGANIZE_BY_OPTIONS)}",
+            autocompletion=complete_organize_by,
+        ),
+    ] = None,
+    rule: Annotated[
+        list[str],
+        typer.Option(
+            "--rule",
+            help="Run only this rule of the config's rules: section (repeatable)",
+        ),
+    ] = None,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
 ):
     """Watch for new emails and download attachments in real-time"""
-    console.print(Panel.fit("👀 Watch mode - [bold]Coming soon![/bold]"))
-    # TODO: Implement watch logic
+    config = _load_config_or_exit(config_path, ctx)
+
+    def configure(config: AppConfig) -> AppConfig:
+        # CLI arguments are the final configuration layer, also after a
+        # reload; an invalid combination raises ConfigurationError, which
+        # keeps the running configuration when reloading
+        if sender:
+            config.filters.senders = sender
+        if extensions:
+            config.filters.extensions = extensions
+        if filename_pattern:
+            config.filters.filename_patterns = filename_pattern
+        if query:
+            config.filters.query = query
+        _apply_size_options(config, min_size, max_size)
+        _apply_per_message_options(config, max_per_message, skip_inline_images)
+        if skip_junk:
+            config.junk.enabled = True
+        _apply_scope_options(config, scope, include_spam_trash)
+        _apply_account_options(config, profile, label)
+        _apply_organize_option(config, organize_by)
+        if interval:
+            # An explicit interval wins over schedules from the config file
+            config.watch.check_interval = interval
+            config.watch.schedules = []
+        if schedule:
+            try:
+                next_run(parse_schedules(schedule))
+            except ValueError as e:
+                raise ConfigurationError(str(e))
+            config.watch.schedules = schedule
+        if backfill:
+            if parse_duration(backfill) is None:
+                raise ConfigurationError(
+                    f"Invalid --backfill: {backfill} (use e.g. 7d or 12h)"
+                )
+            config.watch.backfill = backfill
+        if save_body:
+            config.download.save_body = True
+        if save_eml:
+            config.download.save_eml = True
+        if drive_links:
+            config.download.drive_links = True
+        _apply_conflict_option(config, on_conflict)
+        if pid_file:
+            config.watch.pid_file = pid_file
+        if health_addr:
+            try:
+                parse_health_addr(health_addr)
+            except ValueError as e:
+                raise ConfigurationError(str(e))
+            config.watch.health_addr = health_addr
+        return config
+
+    with _options_or_exit():
+        configure(config)
+
+    def reload_config() -> AppConfig:
+        new_config = load_config(config_path, command="watch")
+        new_config.logging = config.logging
+        return configure(new_config)
+
+    # With rules: in the config, they replace the top-level filters
+    rules = []
+    if config.rules or rule:
+        try:
+            rules = compile_rules(config, rule)
+        except ConfigurationError as e:
+            console.print(f"[red]❌ {e}[/red]")
+            raise typer.Exit(code=EXIT_CONFIG)
+    destinations = [watched.config for watched in rules] or [config]
+
+    if not daemon:
+        if config.watch.schedules:
+            when = f"on schedule {', '.join(config.watch.schedules)}"
+        else:
+            when = f"every {config.watch.check_interval}s"
+        what = (
+            f"rules {', '.join(watched.name for watched in rules)}"
+            if rules
+            else "new attachments"
+        )
+        console.print(
+            Panel.fit(f"👀 Watching for {what} {when} - press Ctrl+C to stop")
+        )
+        try:
+            with _run_locks(destinations, "watch", wait, force):
+                asyncio.run(_run_watch(config, reload_config, config_path, rules=rules))
+        except KeyboardInterrupt:
+            console.print("⏹️  Watch stopped")
+            _print_api_usage()
+        except (GmailError, ManifestError, StorageError) as e:
+            console.print(f"[red]❌ {e}[/red]")
+            raise typer.Exit(code=exit_code_for(e))
+        return
+
+    # A service keeps a durable log; stdout may go nowhere
+    options = ctx.obj or LogOptions()
+    if not options.log_file and not config.logging.file_path:
+        config.logging.file_path = DEFAULT_DAEMON_LOG_FILE
+    setup_logging(
+        config.logging,
+        verbose=True,
+        debug=options.debug,
+        quiet=options.quiet,
+        log_file=options.log_file,
+    )
+
+    try:
+        with (
+            PidFile(config.watch.pid_file or DEFAULT_PID_FILE),
+            _run_locks(destinations, "watch", wait, force),
+        ):
+            asyncio.run(
+                _run_watch(config, reload_config, config_path, daemon=True, rules=rules)
+            )
+    except DaemonError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    except (GmailError, ManifestError, StorageError) as e:
+        logger.error(str(e))
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    _print_api_usage()
+
+
+def _run_pass(
+    config: AppConfig, retry_options: list[str], wait: bool, force: bool
+) -> RunSummary:
+    """
+    One pass of the run command: an incremental download that never
+    prompts, summarized. Whatever ends the pass, the summary says how.
+    """
+    summary = RunSummary(profile=config.gmail.get_profile_name())
+    try:
+        with _run_lock(config, "run", wait, force):
+            summary.exit_code = asyncio.run(
+                _run_download(
+                    config,
+                    False,
+                    incremental=True,
+                    retry_options=retry_options,
+                    summary=summary,
+                    prompts=False,
+                )
+            )
+    except typer.Exit as e:
+        # Another run holds the lock; _run_lock said which
+        summary.exit_code, summary.error = e.exit_code, str(e.__cause__)
+    except (GmailError, ManifestError, StorageError, ReportError, OSError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        summary.exit_code, summary.error = exit_code_for(e), str(e)
+    summary.finished_at = datetime.now()
+    return summary
+
+
+def _print_summary(summary: RunSummary) -> None:
+    """Write a run summary to stdout as one line of JSON"""
+    sys.stdout.write(json.dumps(summary.to_dict(), ensure_ascii=False) + "\n")
+    sys.stdout.flush()
+
+
+@app.command("run", epilog=examples_epilog("run"))
+def run_command(
+    ctx: typer.Context,
+    once: Annotated[
+        bool,
+        typer.Option("--once", help="Run a single pass and exit with its exit code"),
+    ] = False,
+    json_summary: Annotated[
+        bool,
+        typer.Option(
+            "--json-summary",
+            help=(
+                "Print a JSON summary of each pass on "
+                "stdout; everything else goes to stderr"
+            ),
+        ),
+    ] = False,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Output directory")
+    ] = None,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """
+    Download new attachments without ever prompting, for pipelines and schedulers
+
+    Each pass is an incremental download with the config's filters: only
+    messages received since the last successful pass. Nothing is asked;
+    without a saved token the pass fails with exit code 2 rather than
+    opening a browser. With --once a single pass runs and its exit code is
+    the command's; otherwise passes repeat on watch.schedules or every
+    watch.check_interval seconds until interrupted.
+    """
+    if json_summary:
+        # stdout carries only the summaries
+        console.file = sys.stderr
+
+    try:
+        config = load_config(config_path, command=ctx.info_name)
+    except ConfigurationError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        if json_summary:
+            _print_summary(
+                RunSummary(profile=profile or "", exit_code=EXIT_CONFIG, error=str(e))
+            )
+        raise typer.Exit(code=EXIT_CONFIG)
+    _setup_logging(config, ctx)
+    _apply_account_options(config, profile, None)
+    if output:
+        config.download.base_dir = output
+    retry_options = _retry_options(config_path, profile, output)
+
+    try:
+        while True:
+            summary = _run_pass(config, retry_options, wait, force)
+            if json_summary:
+                _print_summary(summary)
+            if once:
+                break
+            if summary.exit_code in (EXIT_AUTH, EXIT_CONFIG):
+                # Repeating cannot fix these
+                break
+            if config.watch.schedules:
+                delay = (
+                    next_run(parse_schedules(config.watch.schedules)) - datetime.now()
+                ).total_seconds()
+            else:
+                delay = config.watch.check_interval
+            time.sleep(max(delay, 0))
+    except KeyboardInterrupt:
+        console.print("⏹️  Run stopped")
+        return
+    if summary.exit_code:
+        raise typer.Exit(code=summary.exit_code)
+
+
+# Output formats supported by the list command
+LIST_FORMATS = ["table", "json", "csv"]
+
+# CSV columns for the list command, a stable subset of PlannedDownload.to_dict()
+LIST_CSV_COLUMNS = [
+    "date",
+    "sender",
+    "sender_name",
+    "subject",
+    "filename",
+    "saved_as",
+    "size",
+    "mime_type",
+    "message_id",
+    "thread_id",
+    "part_id",
+    "labels",
+    "path",
+    "status",
+]
+
+
+def _write_attachment_csv(planned: list[PlannedDownload]) -> None:
+    """Write matching attachments to stdout as CSV"""
+    writer = csv.DictWriter(
+        sys.stdout,
+        fieldnames=LIST_CSV_COLUMNS,
+        extrasaction="ignore",
+        lineterminator="\n",
+    )
+    writer.writeheader()
+    for item in planned:
+        row = item.to_dict()
+        row["labels"] = ";".join(row["labels"])
+        writer.writerow(row)
+
+
+def _print_attachment_table(planned: list[PlannedDownload]) -> None:
+    """Show matching attachments as a table"""
+    table = Table(title="Matching attachments")
+    table.add_column("Sender")
+    table.add_column("Date")
+    table.add_column("Subject")
+    table.add_column("Filename")
+    table.add_column("Size", justify="right")
+    table.add_column("Message ID")
+    table.add_column("Part")
+
+    for item in planned:
+        table.add_row(
+            item.message.sender,
+            item.message.date.strftime("%Y-%m-%d"),
+            item.message.subject,
+            item.attachment.filename,
+            format_file_size(item.attachment.size),
+            item.message.message_id,
+            item.attachment.part_id,
+        )
+
+    console.print(table)
+
+
+async def _run_list(config: AppConfig) -> list[PlannedDownload]:
+    """Search Gmail and collect matching attachments without downloading"""
+    client = create_client(config)
+    await client.authenticate()
+
+    downloader, manifest = _open_destination(config)
+    service = DownloadService(client, downloader, manifest, config)
+
+    return await service.plan()
+
+
+@app.command("list", epilog=examples_epilog("list"))
+def list_attachments(
+    ctx: typer.Context,
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Filter by sender email")
+    ] = None,
+    after: Annotated[
+        str, typer.Option("--after", "-a", help="Only emails after date (YYYY-MM-DD)")
+    ] = None,
+    extensions: Annotated[
+        list[str],
+        typer.Option("--extensions", "-e", help="File extensions to include"),
+    ] = None,
+    filename_pattern: Annotated[
+        list[str],
+        typer.Option(
+            "--filename-pattern",
+            help=(
+                "Only attachment names matching this glob, "
+                "or regex anchored with ^ or $ (repeatable)"
+            ),
+        ),
+    ] = None,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", help="Raw Gmail search query, replacing the structured filters"
+        ),
+    ] = None,
+    min_size: Annotated[
+        str,
+        typer.Option(
+            "--min-size", help="Skip attachments smaller than this (e.g. 10KB)"
+        ),
+    ] = None,
+    max_size: Annotated[
+        str,
+        typer.Option(
+            "--max-size", help="Skip attachments larger than this (e.g. 20MB)"
+        ),
+    ] = None,
+    latest_per_thread: Annotated[
+        bool,
+        typer.Option(
+            "--latest-per-thread",
+            help="Only the newest attachment of each filename within a thread",
+        ),
+    ] = False,
+    max_per_message: Annotated[
+        int,
+        typer.Option(
+            "--max-per-message",
+            help="Keep at most this many attachments per message (1 = first only)",
+        ),
+    ] = None,
+    skip_inline_images: Annotated[
+        bool,
+        typer.Option(
+            "--skip-inline-images",
+            help="Skip logos, signatures and other images embedded in the body",
+        ),
+    ] = False,
+    skip_junk: Annotated[
+        bool,
+        typer.Option(
+            "--skip-junk",
+            help=(
+                "Drop signature images, tracking pixels "
+                "and logos (see junk: in the config)"
+            ),
+        ),
+    ] = False,
+    scope: Annotated[
+        str,
+        typer.Option("--scope", help=f"Mail to search: {', '.join(SEARCH_SCOPES)}"),
+    ] = None,
+    include_spam_trash: Annotated[
+        bool, typer.Option("--include-spam-trash", help="Also search Spam and Trash")
+    ] = False,
+    output_format: Annotated[
+        str,
+        typer.Option(
+            "--output-format",
+            "--output",
+            "-f",
+            help="Output format: table, json or csv",
+        ),
+    ] = "table",
+    sort_by: Annotated[
+        str,
+        typer.Option(
+            "--sort-by", help="Sort by date, sender, subject, filename or size"
+        ),
+    ] = "date",
+    reverse: Annotated[
+        bool, typer.Option("--reverse", "-r", help="Sort in descending order")
+    ] = False,
+    limit: Annotated[
+        int, typer.Option("--limit", "-n", help="Show at most this many attachments")
+    ] = None,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    label: Annotated[
+        list[str],
+        typer.Option(
+            "--label",
+            help="Only messages with this Gmail label",
+            autocompletion=complete_label,
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """List matching attachments without downloading them"""
+    if output_format not in LIST_FORMATS:
+        console.print(
+            f"[red]❌ Unknown output format: {output_format}. Use one of: "
+            f"{', '.join(LIST_FORMATS)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if sort_by not in SORT_KEYS:
+        console.print(
+            f"[red]❌ Unknown sort key: {sort_by}. Use one of: "
+            f"{', '.join(SORT_KEYS)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if limit is not None and limit <= 0:
+        console.print("[red]❌ --limit must be positive[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+
+    if sender:
+        config.filters.senders = sender
+    if after:
+        config.filters.after_date = after
+    if extensions:
+        config.filters.extensions = extensions
+    if filename_pattern:
+        config.filters.filename_patterns = filename_pattern
+    if query:
+        config.filters.query = query
+    with _options_or_exit():
+        _apply_size_options(config, min_size, max_size)
+        if latest_per_thread:
+            config.filters.latest_per_thread = True
+        _apply_per_message_options(config, max_per_message, skip_inline_images)
+        if skip_junk:
+            config.junk.enabled = True
+        _apply_scope_options(config, scope, include_spam_trash)
+    _apply_account_options(config, profile, label)
+
+    try:
+        planned = asyncio.run(_run_list(config))
+    except (GmailError, ManifestError, StorageError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+
+    planned = sort_planned(planned, sort_by, descending=reverse)[:limit]
+
+    if output_format == "json":
+        # Plain stdout so the output can be piped into jq and friends
+        typer.echo(json.dumps([item.to_dict() for item in planned], indent=2))
+    elif output_format == "csv":
+        _write_attachment_csv(planned)
+    else:
+        _print_attachment_table(planned)
+    if not planned:
+        raise typer.Exit(code=EXIT_NOTHING_MATCHED)
+
+
+# Output formats supported by the stats command
+STATS_FORMATS = ["table", "json"]
+
+SEARCH_FORMATS = ["table", "json"]
+
+MANIFEST_FORMATS = ["table", "json", "csv", "sha256sums"]
+
+VERIFY_FORMATS = ["table", "json"]
+
+# Table titles for each stats dimension
+STATS_TITLES = {
+    "sender": "By sender",
+    "extension": "By file type",
+    "month": "By month",
+}
+
+
+def _print_stats_tables(
+    stats: dict[str, dict[str, AttachmentStats]], top: Optional[int]
+) -> None:
+    """Show one table per dimension, largest groups first (all months, in order)"""
+    for dimension, groups in stats.items():
+        if dimension == "month":
+            rows = sorted(groups.items())
+            limit = None
+        else:
+            rows = sorted(
+                groups.items(), key=lambda row: row[1].total_bytes, reverse=True
+            )
+            limit = top
+
+        table = Table(title=STATS_TITLES.get(dimension, dimension))
+        table.add_column(dimension.capitalize())
+        table.add_column("Attachments", justify="right")
+        table.add_column("Total size", justify="right")
+
+        for group, group_stats in rows[:limit]:
+            table.add_row(
+                group, str(group_stats.count), format_file_size(group_stats.total_bytes)
+            )
+
+        if limit and len(rows) > limit:
+            table.caption = f"{len(rows) - limit} more not shown"
+
+        console.print(table)
+
+
+@app.command(epilog=examples_epilog("stats"))
+def stats(
+    ctx: typer.Context,
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Filter by sender email")
+    ] = None,
+    after: Annotated[
+        str, typer.Option("--after", "-a", help="Only emails after date (YYYY-MM-DD)")
+    ] = None,
+    extensions: Annotated[
+        list[str],
+        typer.Option("--extensions", "-e", help="File extensions to include"),
+    ] = None,
+    filename_pattern: Annotated[
+        list[str],
+        typer.Option(
+            "--filename-pattern",
+            help=(
+                "Only attachment names matching this glob, "
+                "or regex anchored with ^ or $ (repeatable)"
+            ),
+        ),
+    ] = None,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", help="Raw Gmail search query, replacing the structured filters"
+        ),
+    ] = None,
+    min_size: Annotated[
+        str,
+        typer.Option(
+            "--min-size", help="Skip attachments smaller than this (e.g. 10KB)"
+        ),
+    ] = None,
+    max_size: Annotated[
+        str,
+        typer.Option(
+            "--max-size", help="Skip attachments larger than this (e.g. 20MB)"
+        ),
+    ] = None,
+    top: Annotated[
+        int,
+        typer.Option("--top", help="Show only the largest N senders and file types"),
+    ] = None,
+    output_format: Annotated[
+        str,
+        typer.Option(
+            "--output-format", "--output", "-f", help="Output format: table or json"
+        ),
+    ] = "table",
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    label: Annotated[
+        list[str],
+        typer.Option(
+            "--label",
+            help="Only messages with this Gmail label",
+            autocompletion=complete_label,
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Count matching attachments and bytes per sender, file type and month"""
+    if output_format not in STATS_FORMATS:
+        console.print(
+            f"[red]❌ Unknown output format: {output_format}. Use one of: "
+            f"{', '.join(STATS_FORMATS)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+
+    if sender:
+        config.filters.senders = sender
+    if after:
+        config.filters.after_date = after
+    if extensions:
+        config.filters.extensions = extensions
+    if filename_pattern:
+        config.filters.filename_patterns = filename_pattern
+    if query:
+        config.filters.query = query
+    with _options_or_exit():
+        _apply_size_options(config, min_size, max_size)
+    _apply_account_options(config, profile, label)
+
+    try:
+        planned = asyncio.run(_run_list(config))
+    except (GmailError, ManifestError, StorageError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+
+    aggregated = aggregate_planned(planned, config.senders.aliases)
+    total_bytes = sum(item.attachment.size for item in planned)
+
+    if output_format == "json":
+        typer.echo(
+            json.dumps(
+                {
+                    "total": {"count": len(planned), "total_bytes": total_bytes},
+                    **{
+                        dimension: {
+                            group: asdict(group_stats)
+                            for group, group_stats in groups.items()
+                        }
+                        for dimension, groups in aggregated.items()
+                    },
+                },
+                indent=2,
+            )
+        )
+        return
+
+    _print_stats_tables(aggregated, top)
+    console.print(
+        f"📊 {len(planned)} attachment(s), {format_file_size(total_bytes)} in total"
+    )
+
+
+def _search_index(config: AppConfig) -> SearchIndex:
+    """The search index next to the configured manifest"""
+    return SearchIndex(config.download.get_manifest_dir())
+
+
+@app.command("index", epilog=examples_epilog("index"))
+def index_downloads(
+    ctx: typer.Context,
+    rebuild: Annotated[
+        bool,
+        typer.Option(
+            "--rebuild",
+            help="Index every file again instead of only new and changed ones",
+        ),
+    ] = False,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Download directory to index")
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Build the local full-text index of downloaded files for the search command"""
+    config = _load_config_or_exit(config_path, ctx)
+    if output:
+        config.download.base_dir = output
+
+    base_dir = (
+        None
+        if config.download.is_remote()
+        else Path(config.download.base_dir).expanduser()
+    )
+    search_index = _search_index(config)
+    try:
+        manifest = DownloadManifest(config.download.get_manifest_dir()).load()
+        indexed, removed, total = search_index.update(
+            manifest, base_dir, rebuild=rebuild
+        )
+    except (ManifestError, SearchIndexError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+    if base_dir is None:
+        console.print(
+            "[yellow]Downloads are in remote storage; only "
+            "their manifest details are indexed[/yellow]"
+        )
+    console.print(
+        f"🔎 Indexed {indexed} new or changed file(s), "
+        f"removed {removed}; {total} in {search_index.path}"
+    )
+
+
+@app.command(epilog=examples_epilog("search"))
+def search(
+    ctx: typer.Context,
+    query: Annotated[
+        str,
+        typer.Argument(
+            help='What to look for, e.g. "order 4812" or "sender:acme AND invoice"'
+        ),
+    ],
+    limit: Annotated[
+        int, typer.Option("--limit", "-n", help="Show at most this many files")
+    ] = 20,
+    output_format: Annotated[
+        str, typer.Option("--output-format", "-f", help="Output format: table or json")
+    ] = "table",
+    output: Annotated[
+        str,
+        typer.Option(
+            "--output", "-o", help="Download directory whose index to search"
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Search the downloaded files' text, columns, names, senders and subjects"""
+    if output_format not in SEARCH_FORMATS:
+        console.print(
+            f"[red]❌ Unknown output format: {output_format}. Use one of: "
+            f"{', '.join(SEARCH_FORMATS)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if not query.strip():
+        console.print("[red]❌ Give something to search for[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+    if output:
+        config.download.base_dir = output
+
+    try:
+        if output_format == "json":
+            hits = _search_index(config).search(query, limit)
+        else:
+            hits = _search_index(config).search(query, limit, markers=("\x02", "\x03"))
+    except SearchIndexError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+    if output_format == "json":
+        typer.echo(json.dumps([hit.to_dict() for hit in hits], indent=2))
+        return
+    if not hits:
+        console.print(f"No downloaded file matches {query!r}")
+        return
+
+    table = Table(title=f"Files matching {query!r}")
+    table.add_column("Path")
+    table.add_column("Sender")
+    table.add_column("Date")
+    table.add_column("Match")
+    for hit in hits:
+        snippet = escape(" ".join(hit.snippet.split()))
+        table.add_row(
+            hit.path,
+            hit.sender,
+            hit.date[:10],
+            snippet.replace("\x02", "[bold yellow]").replace("\x03", "[/bold yellow]"),
+        )
+    console.print(table)
+
+
+# CSV columns for the manifest command, the entries' main details
+MANIFEST_CSV_COLUMNS = [
+    "path",
+    "filename",
+    "size",
+    "sha256",
+    "sender",
+    "subject",
+    "date",
+    "downloaded_at",
+    "message_id",
+]
+
+
+def _manifest_entries(config: AppConfig, query: Optional[str]) -> list[ManifestEntry]:
+    """The entries of the configured manifest, those matching query if given"""
+    manifest = DownloadManifest(config.download.get_manifest_dir()).load()
+    return manifest.query(query) if query else list(manifest)
+
+
+@app.command("manifest", epilog=examples_epilog("manifest"))
+def show_manifest(
+    ctx: typer.Context,
+    output_format: Annotated[
+        str,
+        typer.Option(
+            "--format",
+            "--output-format",
+            "-f",
+            help=f"Output format: {', '.join(MANIFEST_FORMATS)}",
+        ),
+    ] = "table",
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query",
+            "-q",
+            help=(
+                "Only entries matching a manifest query, "
+                "e.g. 'sender=a@b.com AND date>2025-01-01'"
+            ),
+        ),
+    ] = None,
+    output: Annotated[
+        str,
+        typer.Option(
+            "--output", "-o", help="Download directory whose manifest to show"
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Show the downloaded files in the manifest, or their hashes for sha256sum -c"""
+    if output_format not in MANIFEST_FORMATS:
+        console.print(
+            f"[red]❌ Unknown output format: {output_format}. Use one of: "
+            f"{', '.join(MANIFEST_FORMATS)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+    if output:
+        config.download.base_dir = output
+
+    try:
+        entries = _manifest_entries(config, query)
+    except ManifestError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+    if output_format == "sha256sums":
+        sys.stdout.write(sha256sums(entries))
+    elif output_format == "json":
+        typer.echo(json.dumps([asdict(entry) for entry in entries], indent=2))
+    elif output_format == "csv":
+        writer = csv.DictWriter(
+            sys.stdout,
+            fieldnames=MANIFEST_CSV_COLUMNS,
+            extrasaction="ignore",
+            lineterminator="\n",
+        )
+        writer.writeheader()
+        for entry in entries:
+            writer.writerow(asdict(entry))
+    else:
+        table = Table(title=f"Downloaded files in {config.download.get_manifest_dir()}")
+        table.add_column("Path")
+        table.add_column("Sender")
+        table.add_column("Date")
+        table.add_column("Size", justify="right")
+        for entry in entries:
+            table.add_row(
+                entry.path, entry.sender, entry.date[:10], format_file_size(entry.size)
+            )
+        console.print(table)
+        console.print(f"{len(entries)} file(s)")
+
+
+@app.command("verify", epilog=examples_epilog("verify"))
+def verify_downloads(
+    ctx: typer.Context,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", "-q", help="Only check entries matching a manifest query"
+        ),
+    ] = None,
+    output_format: Annotated[
+        str, typer.Option("--output-format", "-f", help="Output format: table or json")
+    ] = "table",
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Download directory to check")
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Re-hash the downloaded files; report those modified or missing since saved"""
+    if output_format not in VERIFY_FORMATS:
+        console.print(
+            f"[red]❌ Unknown output format: {output_format}. Use one of: "
+            f"{', '.join(VERIFY_FORMATS)}[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+    if output:
+        config.download.base_dir = output
+    if config.download.is_remote():
+        console.print(
+            "[red]❌ verify needs a local download directory, not remote storage[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    try:
+        entries = _manifest_entries(config, query)
+    except ManifestError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    result = verify(entries, Path(config.download.base_dir).expanduser())
+
+    if output_format == "json":
+        typer.echo(json.dumps(result.to_dict(), indent=2))
+    else:
+        for path in result.modified:
+            console.print(f"[red]MODIFIED[/red] {path}")
+        for path in result.missing:
+            console.print(f"[red]MISSING[/red]  {path}")
+        for path, reason in result.unreadable.items():
+            console.print(f"[red]UNREADABLE[/red] {path}: {reason}")
+        if result.failed:
+            console.print(
+                f"[red]❌ {len(result.modified)} modified, "
+                f"{len(result.missing)} missing, "
+                f"{len(result.unreadable)} unreadable; "
+                f"{len(result.ok)} file(s) intact[/red]"
+            )
+        else:
+            console.print(
+                f"[green]✅ All {len(result.ok)} file(s) "
+                "match their manifest hashes[/green]"
+            )
+    if result.failed:
+        raise typer.Exit(code=EXIT_ERROR)
+
+
+@app.command(epilog=examples_epilog("clean"))
+def clean(
+    ctx: typer.Context,
+    older_than: Annotated[
+        str,
+        typer.Option(
+            "--older-than",
+            help=(
+                "Remove files whose email is older than this, e.g. 90d (default: "
+                "retention.older_than)"
+            ),
+        ),
+    ] = None,
+    keep_latest: Annotated[
+        int,
+        typer.Option(
+            "--keep-latest",
+            help=(
+                "Keep the newest N files of each sender "
+                "and filename pattern, however old"
+            ),
+        ),
+    ] = None,
+    dry_run: Annotated[
+        bool,
+        typer.Option(
+            "--dry-run", help="List what would be removed without removing it"
+        ),
+    ] = False,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Download directory to clean")
+    ] = None,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Remove old downloads by the retention policy, with sidecars, mirrors, links"""
+    config = _load_config_or_exit(config_path, ctx)
+    if output:
+        config.download.base_dir = output
+    if older_than is not None:
+        if parse_duration(older_than) is None:
+            console.print(
+                f"[red]❌ Invalid --older-than: {older_than}. Use e.g. 90d or 12w[/red]"
+            )
+            raise typer.Exit(code=EXIT_ERROR)
+        config.retention.older_than = older_than
+    if keep_latest is not None:
+        if keep_latest < 0:
+            console.print("[red]❌ --keep-latest cannot be negative[/red]")
+            raise typer.Exit(code=EXIT_ERROR)
+        config.retention.keep_latest = keep_latest
+    if config.download.is_remote():
+        console.print(
+            "[red]❌ clean needs a local download directory, not remote storage[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if (
+        config.retention.older_than is None
+        and not any(policy.older_than for policy in config.retention.policies)
+    ):
+        console.print(
+            "[red]❌ Nothing would ever be removed: give --older-than or set "
+            "retention.older_than[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    try:
+        with nullcontext() if dry_run else _run_lock(config, "clean", wait, force):
+            manifest = DownloadManifest(config.download.get_manifest_dir()).load()
+            entries = expired(manifest, config.retention)
+            if not entries:
+                console.print("✅ Nothing is past its retention period")
+                return
+            if dry_run:
+                _print_refetch_plan(entries, title="Dry run - files to remove")
+                console.print(
+                    f"{len(entries)} file(s), "
+                    f"{format_file_size(sum(entry.size for entry in entries))}"
+                )
+                return
+            parquet = config.transforms.csv_to_parquet
+            result = remove_files(
+                entries, manifest, Path(config.download.base_dir).expanduser(),
+                parquet.directory if parquet.enabled else None,
+            )
+            manifest.save()
+            index = _search_index(config)
+            if index.exists():
+                index.remove(entry.path for entry in result.removed)
+    except ManifestError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    except SearchIndexError as e:
+        console.print(
+            f"[yellow]⚠️  {e}: run gmail-downloader "
+            "index to bring it up to date[/yellow]"
+        )
+
+    console.print(
+        f"🧹 Removed {len(result.removed)} file(s), freeing "
+        f"{format_file_size(result.bytes_freed)}"
+    )
+    if result.failed:
+        for path, reason in result.failed.items():
+            console.print(f"[red]❌ {path}: {reason}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+
+
+def _recover_queries(
+    service: DownloadService, include_trash: bool, include_spam: bool
+) -> list[str]:
+    """Restrict the configured filters to Trash and/or Spam"""
+    folders = []
+    if include_trash:
+        folders.append("in:trash")
+    if include_spam:
+        folders.append("in:spam")
+    scope = folders[0] if len(folders) == 1 else f"({' OR '.join(folders)})"
+    # Parentheses keep a raw --query containing OR from swallowing the scope
+    return [f"({query}) {scope}" for query in service.build_queries()]
+
+
+def _print_recover_plan(planned: list[PlannedDownload]) -> None:
+    """Show trashed attachments, most urgent first"""
+    table = Table(title="Attachments in Trash/Spam")
+    table.add_column("Days left", justify="right")
+    table.add_column("Status")
+    table.add_column("Sender")
+    table.add_column("Date")
+    table.add_column("Filename")
+    table.add_column("Size", justify="right")
+
+    for item in planned:
+        days_left = days_until_purge(item.message.date)
+        if days_left is None:
+            days_display = "[red]?[/red]"
+        elif days_left <= 7:
+            days_display = f"[red]≥ {days_left}[/red]"
+        else:
+            days_display = f"≥ {days_left}"
+
+        style = STATUS_STYLES[item.status]
+        table.add_row(
+            days_display,
+            f"[{style}]{item.status}[/{style}]",
+            item.message.sender,
+            item.message.date.strftime("%Y-%m-%d"),
+            item.filename,
+            format_file_size(item.attachment.size),
+        )
+
+    console.print(table)
+    console.print(
+        "[dim]Gmail purges Trash and Spam after "
+        f"{TRASH_RETENTION_DAYS} days. It does not "
+        "report when a message was trashed, so days left are counted from the "
+        "message date and are a minimum; '?' means it could be purged any time.[/dim]"
+    )
+
+
+async def _run_recover(
+    config: AppConfig, include_trash: bool, include_spam: bool, dry_run: bool
+) -> int:
+    """
+    Find attachments in Trash/Spam and download them
+    before they are purged; returns the exit code
+    """
+    # Recover chooses the folders itself; the configured scope would clash
+    config.filters.search_scope = "all"
+    config.filters.include_spam_trash = False
+
+    client = create_client(config)
+    await client.authenticate()
+
+    downloader, manifest = _open_destination(config)
+    service = DownloadService(client, downloader, manifest, config)
+
+    planned = await service.plan(
+        queries=_recover_queries(service, include_trash, include_spam),
+        include_spam_trash=True,
+    )
+    if not planned:
+        console.print("ℹ️  No matching attachments in Trash or Spam")
+        return EXIT_NOTHING_MATCHED
+
+    # Messages closest to being purged first; unknown counts as most urgent
+    planned.sort(key=lambda item: days_until_purge(item.message.date) or 0)
+    _print_recover_plan(planned)
+
+    if dry_run:
+        return EXIT_OK
+
+    saved = await service.execute(planned)
+    console.print(f"✅ Recovered {len(saved)} attachment(s)")
+    _print_size_anomalies(service)
+    _print_quarantined(service)
+    _print_locked(service)
+    _print_schema_changes(service)
+    _print_spool_status(downloader.storage)
+    _print_api_usage()
+    return EXIT_PARTIAL if service.failed else EXIT_OK
+
+
+@app.command(epilog=examples_epilog("recover"))
+def recover(
+    ctx: typer.Context,
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Filter by sender email")
+    ] = None,
+    after: Annotated[
+        str, typer.Option("--after", "-a", help="Only emails after date (YYYY-MM-DD)")
+    ] = None,
+    extensions: Annotated[
+        list[str],
+        typer.Option("--extensions", "--ext", "-e", help="File extensions to recover"),
+    ] = None,
+    filename_pattern: Annotated[
+        list[str],
+        typer.Option(
+            "--filename-pattern",
+            help=(
+                "Only attachment names matching this glob, "
+                "or regex anchored with ^ or $ (repeatable)"
+            ),
+        ),
+    ] = None,
+    include_trash: Annotated[
+        bool, typer.Option("--include-trash", help="Search Trash")
+    ] = False,
+    include_spam: Annotated[
+        bool, typer.Option("--include-spam", help="Search Spam")
+    ] = False,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Output directory")
+    ] = None,
+    dry_run: Annotated[
+        bool,
+        typer.Option(
+            "--dry-run", help="Only show what is recoverable and how long it has left"
+        ),
+    ] = False,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    organize_by: Annotated[
+        str,
+        typer.Option(
+            "--organize-by",
+            help=f"Folder layout: {', '.join(ORGANIZE_BY_OPTIONS)}",
+            autocompletion=complete_organize_by,
+        ),
+    ] = None,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Download attachments from recently trashed messages before Gmail purges them"""
+    if not include_trash and not include_spam:
+        console.print(
+            "[red]❌ Nothing to search: use --include-trash and/or --include-spam[/red]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+    config = _load_config_or_exit(config_path, ctx)
+
+    if sender:
+        config.filters.senders = sender
+    if after:
+        config.filters.after_date = after
+    if extensions:
+        config.filters.extensions = extensions
+    if filename_pattern:
+        config.filters.filename_patterns = filename_pattern
+    _apply_account_options(config, profile, None)
+    if output:
+        config.download.base_dir = output
+    with _options_or_exit():
+        _apply_organize_option(config, organize_by)
+
+    try:
+        with nullcontext() if dry_run else _run_lock(config, "recover", wait, force):
+            code = asyncio.run(
+                _run_recover(config, include_trash, include_spam, dry_run)
+            )
+    except (GmailError, ManifestError, StorageError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    if code:
+        raise typer.Exit(code=code)
+
+
+def _select_attachment(
+    attachments: list[EmailAttachment], choice: str
+) -> Optional[EmailAttachment]:
+    """The attachment --attachment names: number (from 1), filename or ID"""
+    if choice.isdigit():
+        index = int(choice)
+        return attachments[index - 1] if 1 <= index <= len(attachments) else None
+    for attachment in attachments:
+        if (
+            attachment.filename.lower() == choice.lower()
+            or attachment.attachment_id == choice
+        ):
+            return attachment
+    return None
+
+
+def _print_preview(attachment: EmailAttachment, preview: Preview) -> None:
+    """Show a preview as a table, list of sheets or list of keys"""
+    console.print(f"📎 {attachment.filename}: {preview.description}")
+    if preview.kind == PREVIEW_TABLE and preview.rows:
+        header, *rows = preview.rows
+        table = Table()
+        for name in header:
+            table.add_column(name)
+        for row in rows:
+            table.add_row(*row[:len(header)], *[""] * (len(header) - len(row)))
+        console.print(table)
+        if preview.total_rows > len(preview.rows):
+            console.print(
+                f"[dim]… {preview.total_rows - len(preview.rows):,} more row(s)[/dim]"
+            )
+    elif preview.kind == PREVIEW_WORKBOOK:
+        table = Table()
+        table.add_column("Sheet")
+        table.add_column("Used range")
+        table.add_column("Size")
+        for name, ref in preview.sheets:
+            table.add_row(name, ref or "?", describe_range(ref) if ref else "")
+        console.print(table)
+    elif preview.keys:
+        console.print("🔑 " + ", ".join(preview.keys))
+
+
+async def _run_preview(
+    config: AppConfig, message_ref: str, choice: Optional[str], rows: int
+) -> None:
+    """
+    Download one attachment into memory and show
+    what is in it, or list the message's attachments
+    """
+    client = create_client(config)
+    await client.authenticate()
+
+    attachments = []
+    for message_id in await client.resolve_message_reference(message_ref):
+        attachments.extend(await client.get_message_attachments(message_id))
+    if not attachments:
+        console.print("ℹ️  The message has no attachments")
+        return
+
+    if choice:
+        attachment = _select_attachment(attachments, choice)
+    else:
+        attachment = attachments[0] if len(attachments) == 1 else None
+    if attachment is None:
+        if choice:
+            console.print(f"[red]❌ No attachment {choice}; the message has:[/red]")
+        table = Table(title="Attachments")
+        table.add_column("#", justify="right")
+        table.add_column("Filename")
+        table.add_column("Type")
+        table.add_column("Size", justify="right")
+        for index, item in enumerate(attachments, start=1):
+            table.add_row(str(index), item.filename, item.mime_type, item.size_display)
+        console.print(table)
+        if choice:
+            raise typer.Exit(code=EXIT_ERROR)
+        console.print("Pick one with --attachment NUMBER or --attachment FILENAME")
+        return
+
+    data = await client.download_attachment(
+        attachment.message_id, attachment.attachment_id
+    )
+    _print_preview(attachment, preview_attachment(attachment.filename, data, rows))
+    _print_api_usage()
+
+
+@app.command(epilog=examples_epilog("preview"))
+def preview(
+    ctx: typer.Context,
+    message_id: Annotated[
+        str,
+        typer.Option(
+            "--message-id",
+            "-m",
+            help="The message: a message ID, Gmail URL or Message-ID header",
+        ),
+    ],
+    attachment: Annotated[
+        str,
+        typer.Option(
+            "--attachment",
+            help=(
+                "Attachment number (from 1), filename or ID; lists them when left "
+                "out and there are several"
+            ),
+        ),
+    ] = None,
+    rows: Annotated[
+        int, typer.Option("--rows", "-n", min=1, help="Rows of a CSV/TSV to show")
+    ] = 10,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to use, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """
+    Show the first rows of a CSV, the sheets of a workbook or the keys of a JSON
+    attachment, without saving it
+    """
+    config = _load_config_or_exit(config_path, ctx)
+    _apply_account_options(config, profile, None)
+
+    try:
+        asyncio.run(_run_preview(config, message_id, attachment, rows))
+    except GmailError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+
+
+async def _run_import(config: AppConfig, mbox_path: str, dry_run: bool) -> int:
+    """Read an mbox file and download its attachments; returns the exit code"""
+    with console.status(f"Reading {mbox_path}..."):
+        mailbox = await asyncio.to_thread(MboxMailbox, mbox_path)
+    console.print(f"📬 {len(mailbox.messages)} message(s) in {mbox_path}")
+    return await _run_download(config, dry_run, client=mailbox.client(config))
+
+
+@app.command("import", epilog=examples_epilog("import"))
+def import_mbox(
+    ctx: typer.Context,
+    mbox: Annotated[
+        str,
+        typer.Option("--mbox", help="mbox file to read, e.g. a Google Takeout export"),
+    ],
+    sender: Annotated[
+        list[str], typer.Option("--sender", "-s", help="Filter by sender email")
+    ] = None,
+    after: Annotated[
+        str, typer.Option("--after", "-a", help="Only emails after date (YYYY-MM-DD)")
+    ] = None,
+    extensions: Annotated[
+        list[str],
+        typer.Option("--extensions", "-e", help="File extensions to extract"),
+    ] = None,
+    filename_pattern: Annotated[
+        list[str],
+        typer.Option(
+            "--filename-pattern",
+            help=(
+                "Only attachment names matching this glob, "
+                "or regex anchored with ^ or $ (repeatable)"
+            ),
+        ),
+    ] = None,
+    query: Annotated[
+        str,
+        typer.Option(
+            "--query", help="Gmail search query, replacing the structured filters"
+        ),
+    ] = None,
+    min_size: Annotated[
+        str,
+        typer.Option(
+            "--min-size", help="Skip attachments smaller than this (e.g. 10KB)"
+        ),
+    ] = None,
+    max_size: Annotated[
+        str,
+        typer.Option(
+            "--max-size", help="Skip attachments larger than this (e.g. 20MB)"
+        ),
+    ] = None,
+    label: Annotated[
+        list[str], typer.Option("--label", help="Only messages with this Gmail label")
+    ] = None,
+    skip_junk: Annotated[
+        bool,
+        typer.Option(
+            "--skip-junk",
+            help=(
+                "Drop signature images, tracking pixels "
+                "and logos (see junk: in the config)"
+            ),
+        ),
+    ] = False,
+    output: Annotated[
+        str, typer.Option("--output", "-o", help="Output directory")
+    ] = None,
+    organize_by: Annotated[
+        str,
+        typer.Option(
+            "--organize-by",
+            help=f"Folder layout: {', '.join(ORGANIZE_BY_OPTIONS)}",
+            autocompletion=complete_organize_by,
+        ),
+    ] = None,
+    dry_run: Annotated[
+        bool,
+        typer.Option(
+            "--dry-run",
+            help="Preview without extracting, showing NEW/UPDATED/EXISTS per file",
+        ),
+    ] = False,
+    wait: Annotated[
+        bool,
+        typer.Option(
+            "--wait",
+            help=(
+                "If another run is using the download "
+                "directory, wait for it to finish"
+            ),
+        ),
+    ] = False,
+    force: Annotated[
+        bool,
+        typer.Option(
+            "--force",
+            help="Run even if the download directory is locked by another run",
+        ),
+    ] = False,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Extract attachments from an mbox file (e.g. Google Takeout), no Gmail API"""
+    config = _load_config_or_exit(config_path, ctx)
+
+    if sender:
+        config.filters.senders = sender
+    if after:
+        config.filters.after_date = after
+    if extensions:
+        config.filters.extensions = extensions
+    if filename_pattern:
+        config.filters.filename_patterns = filename_pattern
+    if query:
+        config.filters.query = query
+    with _options_or_exit():
+        _apply_size_options(config, min_size, max_size)
+        if skip_junk:
+            config.junk.enabled = True
+        _apply_account_options(config, None, label)
+        if output:
+            config.download.base_dir = output
+        _apply_organize_option(config, organize_by)
+
+    try:
+        with nullcontext() if dry_run else _run_lock(config, "import", wait, force):
+            code = asyncio.run(_run_import(config, mbox, dry_run))
+    except (GmailError, ManifestError, StorageError, ValueError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    if code:
+        raise typer.Exit(code=code)
+
+
+@app.command(epilog=examples_epilog("doctor"))
+def doctor(
+    ctx: typer.Context,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to check, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """
+    Check credentials, token, scopes, API access, output directory, clock and network,
+    and say how to fix failures
+    """
+    checks: List[Check] = []
+    try:
+        config = load_config(config_path, command=ctx.info_name)
+        checks.append(Check("Configuration", OK, config_path))
+    except ConfigurationError as e:
+        # Carry on with the file as written, so the other checks still run
+        checks.append(Check("Configuration", FAIL, str(e), f"Correct {config_path}"))
+        try:
+            config = load_config(config_path, command=ctx.info_name, validate=False)
+        except ConfigurationError as e:
+            console.print(f"[red]❌ {e}[/red]")
+            raise typer.Exit(code=EXIT_CONFIG)
+    _setup_logging(config, ctx)
+    _apply_account_options(config, profile, None)
+
+    def probe(url: str) -> dict:
+        return url_probe(
+            url_opener(config.network), config.network.request_timeout_seconds
+        )(url)
+
+    console.print(f"🩺 Checking profile {config.gmail.get_profile_name()}")
+    checks.extend(asyncio.run(run_checks(config, list(_needed_scopes(config)), probe)))
+
+    icons = {
+        OK: "✅",
+        WARN: "[yellow]⚠️ [/yellow]",
+        FAIL: "[red]❌[/red]",
+        SKIP: "[dim]➖[/dim]",
+    }
+    for check in checks:
+        console.print(f"{icons[check.status]} {check.name}: {check.detail}")
+        if check.fix and check.status in (WARN, FAIL):
+            console.print(f"   → {check.fix}")
+
+    failed = [check for check in checks if check.failed]
+    if failed:
+        console.print(f"[red]{len(failed)} check(s) failed[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    console.print("[green]Everything needed to download is in place[/green]")
+
+
+@app.command(epilog=examples_epilog("update"))
+def update(
+    check_only: Annotated[
+        bool,
+        typer.Option(
+            "--check-only", help="Only report whether a newer release exists"
+        ),
+    ] = False,
+    public_key: Annotated[
+        str,
+        typer.Option(
+            "--public-key",
+            help=(
+                "Ed25519 public key (PEM) the release's SHA256SUMS must be signed "
+                "with, instead of the pinned release key"
+            ),
+        ),
+    ] = None,
+    config_path: Annotated[
+        str,
+        typer.Option(
+            "--config",
+            "-c",
+            help="Path to configuration file, for its network settings",
+        ),
+    ] = "config/config.yaml",
+):
+    """Update this program to the latest GitHub release, checking its signature"""
+    # Only the proxy and CA settings matter; an unusable config must not
+    # stand in the way of an update that may fix it
+    try:
+        network = load_config(config_path).network
+    except ConfigurationError:
+        network = NetworkConfig()
+
+    def fetch(url: str) -> bytes:
+        with url_opener(network).open(
+            url, timeout=network.request_timeout_seconds
+        ) as response:
+            return response.read()
+
+    try:
+        release = latest_release(fetch)
+        if not is_newer(release.version, __version__):
+            console.print(f"✅ {PROG_NAME} {__version__} is the latest release")
+            return
+        console.print(
+            f"🆕 {PROG_NAME} {release.version} is available "
+            f"(this is {__version__}): {release.url}"
+        )
+        if check_only:
+            return
+        if not is_standalone():
+            console.print(
+                "Installed with pip; upgrade with: "
+                "pip install --upgrade "
+                f"'gmail-attachment-downloader=={release.version}'"
+            )
+            return
+
+        key = Path(public_key).read_bytes() if public_key else None
+        with console.status(f"Downloading {release.version}..."):
+            data = download_verified(release, fetch, key)
+        path = replace_executable(data)
+    except (UpdateError, OSError, ValueError) as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    console.print(
+        f"✅ Updated {path} to {release.version} (checksum and signature verified)"
+    )
+
+
+@app.command(epilog=examples_epilog("completion"))
+def completion(
+    shell: Annotated[
+        str,
+        typer.Argument(
+            help=f"Shell to complete in: {', '.join(SHELLS)}",
+            autocompletion=lambda: SHELLS,
+        ),
+    ],
+):
+    """Print the shell completion script for bash, zsh, fish or PowerShell"""
+    try:
+        script = completion_script(shell, typer.main.get_command(app))
+    except ValueError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    # Plain stdout so the script can be sourced or redirected
+    typer.echo(script)
+
+
+@app.command("man", epilog=examples_epilog("man"))
+def man_pages(
+    output_dir: Annotated[
+        str,
+        typer.Option("--output-dir", "-o", help="Directory to write the .1 pages to"),
+    ] = "man",
+):
+    """Generate man pages for the program and each command"""
+    pages = build_man_pages(typer.main.get_command(app), PROG_NAME, EXIT_CODE_MEANINGS)
+    for path in write_man_pages(pages, output_dir, __version__):
+        console.print(f"📄 {path}")
+
+
+auth_app = typer.Typer(
+    help="Check and renew the sign-in of a profile", rich_markup_mode="rich"
+)
+app.add_typer(auth_app, name="auth")
+
+
+def _needed_scopes(config: AppConfig) -> dict[str, str]:
+    """The scopes the profile signs in with, and what each is for"""
+    if config.gmail.protocol == "imap":
+        base = {FULL_MAIL_SCOPE: "IMAP access (imap.auth: xoauth2)"}
+    else:
+        base = {READONLY_SCOPE: "reading mail and attachments"}
+    reasons = {**base, **feature_scopes(config)}
+    return {scope: reasons[scope] for scope in required_scopes(config, list(base))}
+
+
+@auth_app.command("status", epilog=examples_epilog("auth status"))
+def auth_status(
+    ctx: typer.Context,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to check, signed in with config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Show where the profile's token is and which scopes it grants and needs"""
+    config = _load_config_or_exit(config_path, ctx)
+    _apply_account_options(config, profile, None)
+    gmail = config.gmail
+
+    console.print(
+        f"👤 Profile: {gmail.get_profile_name()} "
+        f"({gmail.get_provider()}, {gmail.protocol})"
+    )
+    if (
+        gmail.get_provider() == "gmail"
+        and gmail.protocol == "imap"
+        and config.imap.auth == "password"
+    ):
+        console.print(
+            "🔑 Signs in to IMAP with an app password; there is no OAuth token"
+        )
+        return
+    if gmail.get_provider() == "gmail" and gmail.protocol == "imap":
+        gmail = config.imap.oauth_config(gmail)
+
+    store = open_token_store(gmail, interactive=False)
+    console.print(f"🔑 Token: {store.describe()}")
+    try:
+        token = store.load()
+    except TokenStoreError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    if not token:
+        console.print(
+            "[yellow]⚠️  Not signed in: run gmail-downloader auth login[/yellow]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+    if gmail.get_provider() == "outlook":
+        # An MSAL token cache; its scopes are Graph's, not Google's
+        console.print("✅ Signed in to Microsoft Graph (Mail.Read)")
+        return
+
+    try:
+        info = json.loads(token)
+    except ValueError as e:
+        console.print(f"[red]❌ The token is not valid JSON: {e}[/red]")
+        raise typer.Exit(code=EXIT_ERROR)
+    granted = info.get("scopes") or []
+    needed = _needed_scopes(config)
+
+    table = Table(title="OAuth scopes")
+    table.add_column("Scope")
+    table.add_column("Needed for")
+    table.add_column("Granted")
+    for scope, reason in needed.items():
+        table.add_row(
+            scope,
+            reason,
+            "✅" if not missing_scopes(granted, [scope]) else "[red]❌[/red]",
+        )
+    for scope in granted:
+        if scope not in needed:
+            table.add_row(scope, "[dim]not needed[/dim]", "✅")
+    console.print(table)
+
+    if info.get("expiry"):
+        console.print(f"⏱️  Access token expires {info['expiry']}")
+    if not info.get("refresh_token"):
+        console.print(
+            "[yellow]⚠️  No refresh token: sign-in will be needed again once the "
+            "access token expires[/yellow]"
+        )
+    lacking = missing_scopes(granted, list(needed))
+    if lacking:
+        console.print(
+            f"[yellow]⚠️  The enabled features need {', '.join(lacking)}: "
+            f"run gmail-downloader auth login to grant it[/yellow]"
+        )
+        raise typer.Exit(code=EXIT_ERROR)
+
+
+@auth_app.command("login", epilog=examples_epilog("auth login"))
+def auth_login(
+    ctx: typer.Context,
+    profile: Annotated[
+        str,
+        typer.Option(
+            "--profile",
+            help="Google account to sign in, saved as config/<profile>.json",
+            autocompletion=complete_profile,
+        ),
+    ] = None,
+    config_path: Annotated[
+        str, typer.Option("--config", "-c", help="Path to configuration file")
+    ] = "config/config.yaml",
+):
+    """Sign in in the browser unless the saved token already grants the needed scopes"""
+    config = _load_config_or_exit(config_path, ctx)
+    _apply_account_options(config, profile, None)
+
+    try:
+        asyncio.run(create_client(config).authenticate())
+    except GmailError as e:
+        console.print(f"[red]❌ {e}[/red]")
+        raise typer.Exit(code=exit_code_for(e))
+    console.print(f"✅ Signed in as profile {config.gmail.get_profile_name()}")
 
 
 @app.command()
@@ -0,0 +1,385 @@
+"""
+Download manifest for tracking which attachments have already been saved.
+
+The manifest is a small JSON file that lives in the download directory. Every
+time we write an attachment to disk we record where it came from (message,
+sender, date) and what we wrote (path, size, hash). Later runs use this to
+answer questions like "do I already have this file?" without asking Gmail.
+
+This module demonstrates:
+- Persisting dataclasses as JSON
+- Keeping a fast in-memory index keyed by a composite identifier
+- Atomic file replacement so a crash never leaves a half-written manifest
+- A tiny query language for selecting entries ("sender=a@b.com AND size>1MB")
+"""
+
+import json
+import operator
+import os
+import re
+from dataclasses import asdict, dataclass, field
+from datetime import datetime
+from pathlib import Path
+from typing import Any, Callable, Dict, Iterator, List, Optional, Union
+
+from .utils import parse_date, parse_file_size
+
+# The manifest is stored next to the downloads; the leading dot keeps it hidden
+MANIFEST_FILENAME = ".gmail_downloader_manifest.json"
+
+# Bump this when the on-disk format changes in an incompatible way
+MANIFEST_VERSION = 1
+
+
+class ManifestError(Exception):
+    """Raised when the manifest file cannot be read or written."""
+
+    pass
+
+
+@dataclass
+class ManifestEntry:
+    """A single downloaded attachment and where it came from."""
+
+    message_id: str
+    attachment_id: str
+
+    # Saved filename; differs from the original when a message contains
+    # several attachments with the same name (see part_id)
+    filename: str
+
+    # Path of the saved file, relative to the download base directory
+    path: str
+
+    size: int
+    sha256: str
+    sender: str = ""
+    subject: str = ""
+
+    # Display name from the From header ("Acme Analytics"), "" if it had none
+    sender_name: str = ""
+
+    # Email date and download time as ISO 8601 strings
+    date: str = ""
+    downloaded_at: str = field(default_factory=lambda: datetime.now().isoformat())
+
+    # MIME part of the attachment within its message
+    part_id: str = ""
+
+    # Gmail thread (conversation) the message belongs to
+    thread_id: str = ""
+
+    # Size Gmail declared for the attachment, and what went wrong if the
+    # downloaded data did not match it: "size_mismatch" (kept as received)
+    # or "recovered_raw" (re-extracted from the raw message)
+    declared_size: int = 0
+    anomaly: str = ""
+
+    # How the written file was checked against the downloaded data: "size",
+    # "md5" (size and checksum) or "" when it was not checked
+    verified: str = ""
+
+    # "age" or "gpg" when the file at path is encrypted (download.encrypt);
+    # size and sha256 are still those of the attachment itself
+    encrypted: str = ""
+
+    # Malware scan verdict: "clean", what the scanner flagged, or "" when
+    # scanning was off
+    scan: str = ""
+
+    # Where the file was quarantined instead of saved at path, and why: one
+    # of quarantine.QUARANTINE_REASONS ("malware", "unsafe_filename" or
+    # "verify_failed", though a file held for that is not recorded, so the
+    # next run tries it again)
+    quarantine: str = ""
+    quarantine_reason: str = ""
+
+    # Password protection: "unlocked" (saved without it, see unlock.py),
+    # "locked" (saved as received, no password opened it) or "" for none
+    protection: str = ""
+
+    # Extension detected from the contents when the file was saved under a
+    # corrected name (download.fix_extensions), e.g. ".csv"; filename keeps
+    # the name it was sent with
+    detected: str = ""
+
+    # Labels the message had when it was downloaded. Labels change over
+    # time, so this snapshot keeps provenance queries answerable later.
+    labels: List[str] = field(default_factory=list)
+
+    # When the clean command removed the file by the retention policy (ISO
+    # 8601). The entry stays as a tombstone, so the attachment is not
+    # downloaded again.
+    pruned_at: str = ""
+
+    # Why the attachment was left out after it was downloaded, with nothing
+    # saved: "missing_columns" (filters.required_columns) or "banner" (the
+    # junk filter's banner-shaped images). The entry is kept, like a
+    # tombstone, so the attachment is not downloaded again.
+    skipped: str = ""
+
+    @property
+    def listed(self) -> bool:
+        """Whether a file was saved for the entry and is still there."""
+        return not self.pruned_at and not self.skipped
+
+    @property
+    def key(self) -> str:
+        """Identifier used to look this entry up in the manifest."""
+        return DownloadManifest.make_key(self.message_id, self.filename)
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "ManifestEntry":
+        """Build an entry from JSON data, ignoring unknown keys."""
+        known = {name: data[name] for name in cls.__dataclass_fields__ if name in data}
+        return cls(**known)
+
+
+class DownloadManifest:
+    """
+    In-memory view of the manifest file with load/save helpers.
+
+    Entries are keyed by message ID plus original filename. Gmail attachment
+    IDs are not stable between API calls, so they are stored for reference
+    but never used as the lookup key.
+
+    Entries of pruned files are tombstones: get() still finds them, so the
+    attachments are not downloaded again, but find_by_path(), query(), len()
+    and iterating leave them out. So are those of skipped attachments.
+    """
+
+    def __init__(self, base_dir: Union[str, Path]):
+        """Create a manifest for the given download directory (not loaded yet)."""
+        self.base_dir = Path(base_dir)
+        self.path = self.base_dir / MANIFEST_FILENAME
+        self._entries: Dict[str, ManifestEntry] = {}
+
+    @staticmethod
+    def make_key(message_id: str, filename: str) -> str:
+        """Build the lookup key for an attachment."""
+        return f"{message_id}/{filename}"
+
+    def load(self) -> "DownloadManifest":
+        """
+        Load entries from disk. A missing file simply means an empty manifest.
+
+        Returns:
+            self, so callers can write ``DownloadManifest(path).load()``
+
+        Raises:
+            ManifestError: If the file exists but cannot be parsed
+        """
+        self._entries = {}
+
+        if not self.path.exists():
+            return self
+
+        try:
+            with open(self.path, "r", encoding="utf-8") as f:
+                data = json.load(f)
+        except (OSError, json.JSONDecodeError) as e:
+            raise ManifestError(f"Cannot read manifest {self.path}: {e}")
+
+        for raw_entry in data.get("entries", []):
+            entry = ManifestEntry.from_dict(raw_entry)
+            self._entries[entry.key] = entry
+
+        return self
+
+    def save(self) -> None:
+        """
+        Write the manifest to disk.
+
+        We write to a temporary file first and then rename it over the old
+        one. The rename is atomic, so readers never see a partial manifest.
+        """
+        data = {
+            "version": MANIFEST_VERSION,
+            "entries": [asdict(entry) for entry in self._entries.values()],
+        }
+
+        temp_path = self.path.with_suffix(".tmp")
+        try:
+            self.base_dir.mkdir(parents=True, exist_ok=True)
+            with open(temp_path, "w", encoding="utf-8") as f:
+                json.dump(data, f, indent=2)
+            os.replace(temp_path, self.path)
+        except OSError as e:
+            raise ManifestError(f"Cannot write manifest {self.path}: {e}")
+
+    def get(self, message_id: str, filename: str) -> Optional[ManifestEntry]:
+        """Look up the entry for an attachment, if we have downloaded it before."""
+        return self._entries.get(self.make_key(message_id, filename))
+
+    def find_by_path(self, path: Union[str, Path]) -> Optional[ManifestEntry]:
+        """Find the entry that was written to ``path`` (absolute or relative)."""
+        relative = self.relative_path(path)
+        for entry in self:
+            if entry.path == relative:
+                return entry
+        return None
+
+    def record(self, entry: ManifestEntry) -> None:
+        """Add or replace an entry. Call save() to persist."""
+        self._entries[entry.key] = entry
+
+    def remove(self, entry: ManifestEntry) -> None:
+        """Forget an entry, e.g. of a file deleted on purpose. save() persists it."""
+        self._entries.pop(entry.key, None)
+
+    def prune(self, entry: ManifestEntry) -> None:
+        """Keep an entry whose file was removed as a tombstone. save() persists it."""
+        entry.pruned_at = datetime.now().isoformat()
+        self._entries[entry.key] = entry
+
+    def relative_path(self, path: Union[str, Path]) -> str:
+        """Express ``path`` relative to the base directory, using forward slashes."""
+        path = Path(path)
+        try:
+            path = path.relative_to(self.base_dir)
+        except ValueError:
+            pass  # Already relative (or outside the base dir) - keep as is
+        return path.as_posix()
+
+    def query(self, query_string: str) -> List[ManifestEntry]:
+        """Return all entries matching a manifest query (see parse_query)."""
+        predicate = parse_query(query_string)
+        return [entry for entry in self if predicate(entry)]
+
+    def __len__(self) -> int:
+        return sum(1 for entry in self._entries.values() if entry.listed)
+
+    def __iter__(self) -> Iterator[ManifestEntry]:
+        return iter([entry for entry in self._entries.values() if entry.listed])
+
+
+# Comparison operators supported in manifest queries. Two-character operators
+# come first so ">=" is not mistaken for ">" followed by "=value".
+_QUERY_OPERATORS: Dict[str, Callable[[Any, Any], bool]] = {
+    ">=": operator.ge,
+    "<=": operator.le,
+    "!=": operator.ne,
+    "=": operator.eq,
+    ">": operator.gt,
+    "<": operator.lt,
+    "~": lambda actual, expected: expected in actual,
+}
+
+_CLAUSE_PATTERN = re.compile(
+    r"^\s*(\w+)\s*(" + "|".join(
+        re.escape(op) for op in _QUERY_OPERATORS
+    ) + r")\s*(.+?)\s*$"
+)
+
+# Fields compared as dates, sizes or lists rather than plain strings
+_DATE_FIELDS = {"date", "downloaded_at"}
+_SIZE_FIELDS = {"size", "declared_size"}
+_LIST_FIELDS = {"labels"}
+
+
+def parse_query(query_string: str) -> Callable[[ManifestEntry], bool]:
+    """
+    Compile a manifest query into a predicate function.
+
+    A query is one or more ``field<op>value`` clauses joined with ``AND``:
+
+        sender=reports@vendor.com AND date>2025-01-01
+        filename~invoice AND size>=1MB
+
+    Supported operators are = != > >= < <= and ~ (substring match). Dates
+    accept any format parse_date() understands and sizes accept "10MB" style
+    values. String comparisons are case-insensitive. Values may be quoted.
+    For list fields such as labels, = and ~ match if any item matches and
+    != matches if no item equals the value:
+
+        labels=client-X AND date>=2024-01-01
+
+    Raises:
+        ManifestError: If the query is malformed or names an unknown field
+    """
+    if not query_string or not query_string.strip():
+        raise ManifestError("Manifest query cannot be empty")
+
+    clauses = [
+        _parse_clause(clause)
+        for clause in re.split(r"\s+AND\s+", query_string.strip(), flags=re.IGNORECASE)
+    ]
+
+    def predicate(entry: ManifestEntry) -> bool:
+        return all(clause(entry) for clause in clauses)
+
+    return predicate
+
+
+def _parse_clause(clause: str) -> Callable[[ManifestEntry], bool]:
+    """Compile a single ``field<op>value`` clause."""
+    match = _CLAUSE_PATTERN.match(clause)
+    if not match:
+        raise ManifestError(f"Invalid manifest query clause: {clause!r}")
+
+    field_name, op_symbol, raw_value = match.groups()
+    field_name = field_name.lower()
+    raw_value = raw_value.strip("\"'")
+    compare = _QUERY_OPERATORS[op_symbol]
+
+    if field_name not in ManifestEntry.__dataclass_fields__:
+        raise ManifestError(f"Unknown manifest field in query: {field_name}")
+
+    if field_name in _DATE_FIELDS:
+        expected_date = parse_date(raw_value) or _parse_iso(raw_value)
+        if expected_date is None:
+            raise ManifestError(f"Invalid date in manifest query: {raw_value}")
+
+        def date_clause(entry: ManifestEntry) -> bool:
+            actual = _parse_iso(getattr(entry, field_name))
+            if actual is None:
+                return False
+            # Compare naive to naive so timezone-aware email dates still match
+            return bool(
+                compare(actual.replace(tzinfo=None), expected_date.replace(tzinfo=None))
+            )
+
+        return date_clause
+
+    if field_name in _SIZE_FIELDS:
+        expected_size = parse_file_size(raw_value)
+        if expected_size is None:
+            raise ManifestError(f"Invalid size in manifest query: {raw_value}")
+        return lambda entry: bool(compare(getattr(entry, field_name), expected_size))
+
+    expected_text = raw_value.lower()
+
+    if field_name in _LIST_FIELDS:
+        if op_symbol == "!=":
+            return lambda entry: all(
+                str(item).lower() != expected_text
+                for item in getattr(entry, field_name)
+            )
+        return lambda entry: any(
+            compare(str(item).lower(), expected_text)
+            for item in getattr(entry, field_name)
+        )
+
+    return lambda entry: bool(
+        compare(str(getattr(entry, field_name)).lower(), expected_text)
+    )
+
+
+def entry_time(entry: ManifestEntry) -> Optional[datetime]:
+    """When the entry's email was sent, or else downloaded, as local time."""
+    for value in (entry.date, entry.downloaded_at):
+        when = _parse_iso(value)
+        if when is None:
+            continue
+        if when.tzinfo is not None:
+            when = when.astimezone().replace(tzinfo=None)
+        return when
+    return None
+
+
+def _parse_iso(value: str) -> Optional[datetime]:
+    """Parse an ISO 8601 timestamp as stored in the manifest."""
+    try:
+        return datetime.fromisoformat(value)
+    except (TypeError, ValueError):
+        return None
@@ -0,0 +1,219 @@
+"""
+Proxies and TLS trust for outbound HTTP.
+
+Corporate networks often only let traffic out through a proxy, and many
+intercept TLS with a certificate authority of their own. The network section
+of the config covers both for every HTTP client the downloader uses: the
+OAuth sign-in and token refresh (requests), the Gmail and Drive APIs
+(httplib2) and Microsoft sign-in and Graph for Outlook profiles:
+
+    network:
+      proxy_url: http://proxy.corp:3128       # or socks5://host:1080
+      ca_bundle: /etc/ssl/certs/corp-ca.pem
+
+Without them the standard variables apply: HTTPS_PROXY, HTTP_PROXY,
+ALL_PROXY and NO_PROXY for the proxy, REQUESTS_CA_BUNDLE and SSL_CERT_FILE
+for the CA bundle. SOCKS proxies need PySocks (the [proxy] extra).
+insecure_skip_verify turns certificate checks off altogether; it is meant
+for trying things out, never for production.
+"""
+
+import inspect
+import logging
+import os
+import ssl
+import time
+import urllib.parse
+import urllib.request
+from typing import Any, List, Optional, Union
+
+from . import httptrace
+from .config import NetworkConfig
+
+logger = logging.getLogger(__name__)
+
+# Proxy URL schemes, and the httplib2 (PySocks) proxy type of each
+PROXY_TYPES = {"http": 3, "https": 3, "socks4": 1, "socks5": 2, "socks5h": 2}
+
+# Environment variables read when the config does not say, in order
+PROXY_VARIABLES = [
+    "HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "HTTP_PROXY", "http_proxy"
+]
+CA_BUNDLE_VARIABLES = ["REQUESTS_CA_BUNDLE", "SSL_CERT_FILE", "CURL_CA_BUNDLE"]
+
+_warned_insecure = False
+
+
+def is_configured(network: NetworkConfig) -> bool:
+    """Whether the config sets anything, beyond the standard variables."""
+    return bool(network.proxy_url or network.ca_bundle or network.insecure_skip_verify)
+
+
+def proxy_url(network: NetworkConfig) -> Optional[str]:
+    """The proxy to use: network.proxy_url, or the standard variables."""
+    if network.proxy_url:
+        return network.proxy_url
+    for variable in PROXY_VARIABLES:
+        if os.getenv(variable):
+            return os.environ[variable]
+    return None
+
+
+def no_proxy_hosts() -> List[str]:
+    """Hosts NO_PROXY exempts from the proxy."""
+    value = os.getenv("NO_PROXY") or os.getenv("no_proxy") or ""
+    return [host.strip() for host in value.split(",") if host.strip()]
+
+
+def ca_bundle(network: NetworkConfig) -> Optional[str]:
+    """The CA bundle to trust: network.ca_bundle, or the standard variables."""
+    if network.ca_bundle:
+        return os.path.expanduser(network.ca_bundle)
+    for variable in CA_BUNDLE_VARIABLES:
+        if os.getenv(variable):
+            return os.environ[variable]
+    return None
+
+
+def verify(network: NetworkConfig) -> Union[bool, str]:
+    """What requests takes as verify: a CA bundle path, True, or False."""
+    if network.insecure_skip_verify:
+        _warn_insecure()
+        return False
+    return ca_bundle(network) or True
+
+
+def _warn_insecure() -> None:
+    global _warned_insecure
+    if not _warned_insecure:
+        logger.warning(
+            "network.insecure_skip_verify is set: TLS certificates are not checked"
+        )
+        _warned_insecure = True
+
+
+def configure_session(session: Any, network: NetworkConfig) -> Any:
+    """
+    Point a requests session (or OAuth2Session) at the proxy and CA bundle,
+    with the configured timeouts on every request.
+    """
+    url = proxy_url(network)
+    if url:
+        session.proxies = {"http": url, "https": url}
+    session.verify = verify(network)
+
+    # Callers (google-auth, msal) pass timeouts of their own, or none
+    request = session.request
+    signature = inspect.signature(request)
+
+    def request_with_timeouts(*args, **kwargs):
+        kwargs["timeout"] = (
+            network.connect_timeout_seconds, network.request_timeout_seconds
+        )
+        if not httptrace.is_enabled():
+            return request(*args, **kwargs)
+        # Sign-in responses carry tokens: only the request line is traced
+        arguments = signature.bind_partial(*args, **kwargs).arguments
+        method, url = arguments.get("method"), arguments.get("url")
+        started = time.monotonic()
+        response = request(*args, **kwargs)
+        httptrace.trace(
+            str(method).upper(),
+            url,
+            response.status_code,
+            time.monotonic() - started,
+            response.headers,
+        )
+        return response
+
+    session.request = request_with_timeouts
+    return session
+
+
+def requests_session(network: NetworkConfig) -> Any:
+    """A requests session for the OAuth endpoints."""
+    import requests
+
+    return configure_session(requests.Session(), network)
+
+
+def httplib2_http(network: NetworkConfig, timeout: Optional[float] = None) -> Any:
+    """
+    An httplib2.Http for the Google API clients.
+
+    httplib2 has one socket timeout, for connecting and each read alike:
+    timeout, or network.request_timeout_seconds.
+    """
+    import httplib2
+
+    url = proxy_url(network)
+    proxy_info = None
+    if url:
+        parsed = urllib.parse.urlparse(url)
+        proxy_info = httplib2.ProxyInfo(
+            PROXY_TYPES.get(parsed.scheme, 3),
+            parsed.hostname,
+            parsed.port or (1080 if parsed.scheme.startswith("socks") else 8080),
+            proxy_rdns=parsed.scheme in ("socks5h", "http", "https"),
+            proxy_user=urllib.parse.unquote(parsed.username)
+            if parsed.username
+            else None,
+            proxy_pass=urllib.parse.unquote(parsed.password)
+            if parsed.password
+            else None,
+            proxy_headers=None,
+        )
+        proxy_info.bypass_hosts = no_proxy_hosts()
+    insecure = network.insecure_skip_verify
+    if insecure:
+        _warn_insecure()
+    return httplib2.Http(
+        timeout=timeout or network.request_timeout_seconds,
+        proxy_info=proxy_info,
+        ca_certs=None if insecure else ca_bundle(network),
+        disable_ssl_certificate_validation=insecure,
+    )
+
+
+def authorized_http(
+    credentials: Any, network: NetworkConfig, timeout: Optional[float] = None
+) -> Any:
+    """
+    An httplib2 transport signing requests with credentials, for build(http=...).
+
+    With --debug-http it traces every request (see httptrace).
+    """
+    import google_auth_httplib2
+
+    http = google_auth_httplib2.AuthorizedHttp(
+        credentials, http=httplib2_http(network, timeout)
+    )
+    return httptrace.TracingHttp(http) if httptrace.is_enabled() else http
+
+
+def ssl_context(network: NetworkConfig) -> ssl.SSLContext:
+    """A TLS context trusting the configured CA bundle (or nothing, when insecure)."""
+    if network.insecure_skip_verify:
+        _warn_insecure()
+        context = ssl.create_default_context()
+        context.check_hostname = False
+        context.verify_mode = ssl.CERT_NONE
+        return context
+    return ssl.create_default_context(cafile=ca_bundle(network))
+
+
+def url_opener(network: NetworkConfig) -> urllib.request.OpenerDirector:
+    """
+    A urllib opener going through the proxy.
+
+    Raises:
+        ValueError: If the proxy is a SOCKS proxy, which urllib cannot use
+    """
+    handlers: List[Any] = [urllib.request.HTTPSHandler(context=ssl_context(network))]
+    url = network.proxy_url
+    if url:
+        if not urllib.parse.urlparse(url).scheme.startswith("http"):
+            raise ValueError(f"This connection needs an HTTP proxy, not {url}")
+        handlers.append(urllib.request.ProxyHandler({"http": url, "https": url}))
+    # Without proxy_url, urllib's default ProxyHandler reads the variables
+    return urllib.request.build_opener(*handlers)
@@ -0,0 +1,170 @@
+"""
+Webhook notifications for newly downloaded attachments.
+
+Watch mode can run unattended for weeks, so it is useful to get a ping in
+Slack, Teams or any HTTP endpoint when a new file arrives. This module
+demonstrates:
+- Building JSON payloads for different webhook flavours
+- Running blocking HTTP calls in a thread so the event loop stays responsive
+- Retrying with exponential backoff without ever crashing the caller
+"""
+
+import asyncio
+import json
+import logging
+import urllib.error
+import urllib.request
+from dataclasses import asdict, dataclass
+from typing import TYPE_CHECKING, Any, Dict
+
+from .config import NotificationConfig
+from .manifest import ManifestEntry
+from .utils import format_file_size, format_sender
+
+if TYPE_CHECKING:
+    from .freshness import StaleFeed
+    from .schema import SchemaChange
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class DownloadEvent:
+    """Details about one downloaded attachment, as sent to the webhook."""
+
+    sender: str
+    subject: str
+    filename: str
+    path: str
+    size: int
+    sha256: str
+    message_id: str
+    sender_name: str = ""
+
+    @classmethod
+    def from_manifest_entry(cls, entry: ManifestEntry, path: str) -> "DownloadEvent":
+        """Build an event from the manifest entry recorded for the download."""
+        return cls(
+            sender=entry.sender,
+            subject=entry.subject,
+            filename=entry.filename,
+            path=path,
+            size=entry.size,
+            sha256=entry.sha256,
+            message_id=entry.message_id,
+            sender_name=entry.sender_name,
+        )
+
+    def template_fields(self) -> Dict[str, Any]:
+        """Values available to the message template."""
+        return {
+            **asdict(self),
+            "size_display": format_file_size(self.size),
+            "sender_display": format_sender(self.sender, self.sender_name),
+        }
+
+
+class WebhookNotifier:
+    """POST download events to a configured webhook URL."""
+
+    def __init__(self, config: NotificationConfig):
+        """Initialize the notifier from the notifications config section."""
+        self.config = config
+
+    @property
+    def enabled(self) -> bool:
+        """Whether a webhook URL is configured."""
+        return bool(self.config.webhook_url)
+
+    def build_payload(self, event: DownloadEvent) -> Dict[str, Any]:
+        """
+        Build the JSON body for the configured webhook format.
+
+        Slack and Teams incoming webhooks display the "text" field. The
+        generic format includes every event field for machine consumers.
+        """
+        text = self.config.template.format(**event.template_fields())
+
+        if self.config.webhook_format in ("slack", "teams"):
+            return {"text": text}
+
+        return {"text": text, **asdict(event)}
+
+    def build_schema_payload(self, change: "SchemaChange") -> Dict[str, Any]:
+        """Build the JSON body announcing a CSV feed's changed columns."""
+        text = (
+            f"Columns changed in {change.filename} "
+            f"from {change.sender}: {change.describe()}"
+        )
+
+        if self.config.webhook_format in ("slack", "teams"):
+            return {"text": text}
+
+        return {"text": text, "event": "schema_changed", **change.to_dict()}
+
+    def build_stale_payload(self, stale: "StaleFeed") -> Dict[str, Any]:
+        """Build the JSON body announcing a feed that missed its deadline."""
+        text = stale.describe()
+
+        if self.config.webhook_format in ("slack", "teams"):
+            return {"text": text}
+
+        return {"text": text, "event": "feed_stale", **stale.to_dict()}
+
+    async def notify(self, event: DownloadEvent) -> bool:
+        """
+        Send a notification, retrying with exponential backoff.
+
+        Notification failures are logged but never raised: a flaky webhook
+        must not stop attachments from being downloaded.
+
+        Returns:
+            True if the webhook accepted the notification
+        """
+        if not self.enabled:
+            return False
+        return await self._deliver(self.build_payload(event), event.filename)
+
+    async def notify_schema_change(self, change: "SchemaChange") -> bool:
+        """Send a schema change notification; like notify, never raises."""
+        if not self.enabled:
+            return False
+        return await self._deliver(self.build_schema_payload(change), change.filename)
+
+    async def notify_stale_feed(self, stale: "StaleFeed") -> bool:
+        """Send a stale feed alert; like notify, never raises."""
+        if not self.enabled:
+            return False
+        return await self._deliver(
+            self.build_stale_payload(stale), f"stale feed {stale.feed}"
+        )
+
+    async def _deliver(self, payload: Dict[str, Any], filename: str) -> bool:
+        """POST payload with retries; True if the webhook accepted it."""
+        attempts = self.config.max_retries + 1
+
+        for attempt in range(1, attempts + 1):
+            try:
+                await asyncio.to_thread(self._post, payload)
+                logger.debug(f"Webhook notified for {filename}")
+                return True
+            except (urllib.error.URLError, OSError) as e:
+                logger.warning(
+                    f"Webhook delivery failed (attempt {attempt}/{attempts}): {e}"
+                )
+                if attempt < attempts:
+                    await asyncio.sleep(2 ** (attempt - 1))
+
+        logger.error(f"Giving up on webhook notification for {filename}")
+        return False
+
+    def _post(self, payload: Dict[str, Any]) -> None:
+        """POST the payload as JSON (blocking)."""
+        request = urllib.request.Request(
+            self.config.webhook_url,
+            data=json.dumps(payload).encode("utf-8"),
+            headers={"Content-Type": "application/json"},
+            method="POST",
+        )
+        with urllib.request.urlopen(request, timeout=self.config.timeout_seconds):
+            pass  # Any 2xx is success; urlopen raises HTTPError otherwise
@@ -0,0 +1,468 @@
+"""
+Microsoft 365 / Outlook.com mailboxes, through Microsoft Graph.
+
+A profile whose provider is outlook (gmail.provider, or per profile in
+gmail.profile_providers) reads its mail from Microsoft Graph instead of
+Gmail. Everything else - filters, the downloader, folder layout and the
+manifest - stays the same, because OutlookMailbox is a
+localmail.LocalMailbox: the real GmailClient talks to it as if it were
+Gmail, and it answers from Graph.
+
+Searches keep Gmail's query language. The terms Graph can filter on
+(has:attachment, after:, before:, from: with a full address) narrow the
+request to Graph; every message it returns is then checked against the
+whole query locally, so the results are the same as Gmail's would be for
+the same mail. Outlook folders become labels ("Inbox" is INBOX, "Deleted
+Items" TRASH, "Junk Email" SPAM, other folders their path such as
+"Vendors/Acme"), and so do categories. Messages are known by Graph's
+immutable IDs, which do not change when a message moves between folders.
+
+Sign-in uses MSAL (pip install 'gmail-attachment-downloader[outlook]') in
+the browser, with the token cached like Google's (gmail.token_store, by
+default in the profile's token_file).
+"""
+
+import asyncio
+import email
+import json
+import threading
+import urllib.error
+import urllib.parse
+import urllib.request
+from collections import OrderedDict
+from datetime import datetime, timezone
+from email import policy
+from email.message import Message
+from email.utils import format_datetime
+from typing import Any, Dict, Iterator, List, Optional, Tuple
+
+from googleapiclient.errors import HttpError
+
+from .config import AppConfig
+from .gmail_client import GmailAuthenticationError, GmailClient, GmailError
+from .localmail import (
+    LocalMailbox,
+    LocalMessage,
+    MimeMessage,
+    gmail_date,
+    http_error,
+    own_quota,
+    tokenize_query,
+)
+from .network import is_configured, requests_session, url_opener
+from .tokenstore import TokenStore, TokenStoreError, open_token_store
+
+GRAPH_URL = "https://graph.microsoft.com/v1.0"
+
+# Delegated permission needed to read mail (MSAL adds sign-in scopes itself)
+GRAPH_SCOPES = ["Mail.Read"]
+
+# Well-known folders -> the Gmail label they stand for
+WELL_KNOWN_FOLDERS = {
+    "inbox": "INBOX",
+    "sentitems": "SENT",
+    "drafts": "DRAFT",
+    "deleteditems": "TRASH",
+    "junkemail": "SPAM",
+}
+
+# PR_MESSAGE_SIZE, which Graph only returns as an extended property
+MESSAGE_SIZE_PROPERTY = "Integer 0x0E08"
+
+# Metadata read for each message a search finds
+MESSAGE_FIELDS = ",".join(
+    [
+        "id",
+        "conversationId",
+        "from",
+        "toRecipients",
+        "subject",
+        "bodyPreview",
+        "sentDateTime",
+        "receivedDateTime",
+        "parentFolderId",
+        "categories",
+        "isRead",
+        "importance",
+        "flag",
+        "internetMessageId",
+    ]
+)
+
+# Messages per page of a search (Graph allows up to 1000)
+PAGE_SIZE = 250
+
+# Full messages kept in memory, for the attachment reads that follow
+# reading a message
+CACHED_MESSAGES = 4
+
+
+class OutlookError(GmailError):
+    """Raised when Microsoft Graph cannot be used."""
+
+    pass
+
+
+def _odata_string(value: str) -> str:
+    return "'" + value.replace("'", "''") + "'"
+
+
+def graph_filter(query: str) -> str:
+    """
+    The part of a Gmail query Graph can filter on, as an OData $filter.
+
+    Only top-level terms that narrow the search are translated. The whole
+    query is checked locally afterwards, so this only has to never leave
+    out a message that matches. "" if no term can be translated.
+    """
+    clauses: List[str] = []
+    depth = 0
+    for term in tokenize_query(query):
+        if term in ("(", ")"):
+            depth += 1 if term == "(" else -1
+            continue
+        operator, _, value = term.partition(":")
+        operator = operator.lower()
+        if depth or not value:
+            continue
+        if operator == "has" and value.lower() == "attachment":
+            clauses.append("hasAttachments eq true")
+        elif operator in ("after", "before"):
+            try:
+                date = gmail_date(value)
+            except ValueError:
+                continue
+            comparison = "ge" if operator == "after" else "lt"
+            clauses.append(f"receivedDateTime {comparison} {date:%Y-%m-%dT%H:%M:%SZ}")
+        elif operator == "from" and "@" in value:
+            clauses.append(
+                f"from/emailAddress/address eq {_odata_string(value.lower())}"
+            )
+        elif operator == "rfc822msgid":
+            clauses.append(
+                f"internetMessageId eq {_odata_string('<' + value.strip('<>') + '>')}"
+            )
+    return " and ".join(dict.fromkeys(clauses))
+
+
+def _address(recipient: Optional[Dict[str, Any]]) -> str:
+    """A Graph recipient as "Name <address>"."""
+    address = (recipient or {}).get("emailAddress") or {}
+    name, mail = address.get("name") or "", address.get("address") or ""
+    return f"{name} <{mail}>" if name and name != mail else mail
+
+
+def _graph_date(value: Optional[str]) -> datetime:
+    if not value:
+        return datetime.fromtimestamp(0, tz=timezone.utc)
+    return datetime.fromisoformat(value.replace("Z", "+00:00"))
+
+
+class OutlookMessage(MimeMessage):
+    """
+    A message found through Graph.
+
+    Searches read its metadata and attachment names; the full message
+    (its MIME content) is read when GmailClient asks for it.
+    """
+
+    def __init__(self, mailbox: "OutlookMailbox", data: Dict[str, Any]):
+        self._mailbox = mailbox
+        self.id = data["id"]
+        self.thread_id = data.get("conversationId") or data["id"]
+        self.sender = _address(data.get("from"))
+        self.to = ", ".join(
+            _address(recipient) for recipient in data.get("toRecipients") or []
+        )
+        self.subject = data.get("subject") or ""
+        self.body = data.get("bodyPreview") or ""
+        self.date = _graph_date(data.get("receivedDateTime"))
+        self.sent = _graph_date(
+            data.get("sentDateTime") or data.get("receivedDateTime")
+        )
+        self.rfc822_id = (data.get("internetMessageId") or "").strip("<>")
+
+        attachments = data.get("attachments") or []
+        self.filenames = [
+            attachment["name"] for attachment in attachments if attachment.get("name")
+        ]
+        sizes = [
+            prop.get("value")
+            for prop in data.get("singleValueExtendedProperties") or []
+        ]
+        self.size = int(sizes[0]) if sizes and str(sizes[0]).isdigit() else sum(
+            attachment.get("size") or 0 for attachment in attachments
+        )
+
+        self.labels = [mailbox.folder_label(data.get("parentFolderId", ""))]
+        self.labels += data.get("categories") or []
+        if not data.get("isRead", True):
+            self.labels.append("UNREAD")
+        if (data.get("flag") or {}).get("flagStatus") == "flagged":
+            self.labels.append("STARRED")
+        if data.get("importance") == "high":
+            self.labels.append("IMPORTANT")
+
+    def headers(self) -> List[Dict[str, str]]:
+        """The headers GmailClient reads, from the metadata (no extra request)."""
+        headers = {
+            "From": self.sender,
+            "To": self.to,
+            "Subject": self.subject,
+            "Date": format_datetime(self.sent),
+            "Message-ID": f"<{self.rfc822_id}>" if self.rfc822_id else "",
+        }
+        return [
+            {"name": name, "value": value} for name, value in headers.items() if value
+        ]
+
+    def read(self) -> Tuple[bytes, Message]:
+        return self._mailbox.read(self.id)
+
+
+class OutlookMailbox(LocalMailbox):
+    """A Microsoft 365 / Outlook.com mailbox, standing in for the Gmail API."""
+
+    def __init__(self, config: AppConfig):
+        super().__init__(email_address="")
+        self.config = config
+        self.token_store: Optional[TokenStore] = None
+        self._app: Any = None
+        self._cache_store: Any = None
+        self._token: Optional[str] = None
+        self._url_opener: Optional[urllib.request.OpenerDirector] = None
+        self._folders: Dict[str, str] = {}
+        self._lock = threading.RLock()
+        self._messages_cache: "OrderedDict[str, Tuple[bytes, Message]]" = OrderedDict()
+
+    async def connect(self, interactive: bool = True) -> None:
+        """
+        Sign in and learn the mailbox's folders.
+
+        Raises:
+            GmailAuthenticationError: If signing in fails
+            OutlookError: If Graph cannot be reached
+        """
+        await asyncio.to_thread(self._sign_in, interactive)
+        await asyncio.to_thread(self._load_folders)
+
+    def _msal(self) -> Any:
+        if self._app is None:
+            try:
+                import msal
+            except ImportError:
+                raise OutlookError(
+                    "Outlook mailboxes need msal: pip install "
+                    "'gmail-attachment-downloader[outlook]'"
+                )
+            outlook = self.config.outlook
+            self._cache_store = msal.SerializableTokenCache()
+            token = self.token_store.load()
+            if token:
+                self._cache_store.deserialize(token)
+            # msal's own session already follows the standard variables
+            options = (
+                {"http_client": requests_session(self.config.network)}
+                if is_configured(self.config.network)
+                else {}
+            )
+            self._app = msal.PublicClientApplication(
+                outlook.client_id,
+                authority=f"https://login.microsoftonline.com/{outlook.tenant}",
+                token_cache=self._cache_store,
+                **options,
+            )
+        return self._app
+
+    def _sign_in(self, interactive: bool) -> None:
+        if self.token_store is None:
+            self.token_store = open_token_store(self.config.gmail, interactive)
+        try:
+            self._sign_in_with_cache(interactive)
+        except TokenStoreError as e:
+            raise GmailAuthenticationError(f"Outlook sign-in failed: {e}")
+
+    def _sign_in_with_cache(self, interactive: bool) -> None:
+        app = self._msal()
+        accounts = app.get_accounts()
+        result = (
+            app.acquire_token_silent(GRAPH_SCOPES, account=accounts[0])
+            if accounts
+            else None
+        )
+        if not result:
+            if not interactive:
+                raise GmailAuthenticationError(
+                    f"Not signed in: no usable token in {self.token_store.describe()}"
+                )
+            result = app.acquire_token_interactive(GRAPH_SCOPES)
+        if "access_token" not in result:
+            raise GmailAuthenticationError(
+                "Outlook sign-in failed: "
+                f"{result.get('error_description') or result.get('error')}"
+            )
+        self._token = result["access_token"]
+        if self._cache_store.has_state_changed:
+            self.token_store.save(self._cache_store.serialize())
+        account = (result.get("id_token_claims") or {}).get("preferred_username")
+        self.email_address = account or (
+            accounts[0].get("username") if accounts else ""
+        ) or ""
+
+    def _request(self, url: str, params: Optional[Dict[str, str]] = None) -> bytes:
+        """GET from Graph, raising HttpError like the Gmail API does."""
+        if not url.startswith("https://"):
+            url = GRAPH_URL + url
+        if params:
+            url += "?" + urllib.parse.urlencode(
+                params, safe="$,()'=:", quote_via=urllib.parse.quote
+            )
+        request = urllib.request.Request(url, headers={
+            "Authorization": f"Bearer {self._token}",
+            "Prefer": 'IdType="ImmutableId"',
+        })
+        try:
+            with self._opener().open(
+                request, timeout=self.config.outlook.timeout_seconds
+            ) as response:
+                return response.read()
+        except urllib.error.HTTPError as e:
+            raise http_error(e.code, e.reason, e.read(), dict(e.headers or {}))
+        except urllib.error.URLError as e:
+            raise OutlookError(f"Cannot reach Microsoft Graph: {e.reason}")
+
+    def _opener(self) -> urllib.request.OpenerDirector:
+        """urllib opener through the configured proxy, built once."""
+        if self._url_opener is None:
+            try:
+                self._url_opener = url_opener(self.config.network)
+            except ValueError as e:
+                raise OutlookError(f"Cannot reach Microsoft Graph: {e}")
+        return self._url_opener
+
+    def _get(self, url: str, params: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        return json.loads(self._request(url, params))
+
+    def _pages(self, url: str, params: Dict[str, str]) -> Iterator[Dict[str, Any]]:
+        """Every item of a paged Graph collection."""
+        page = self._get(url, params)
+        while True:
+            yield from page.get("value", [])
+            if "@odata.nextLink" not in page:
+                return
+            page = self._get(page["@odata.nextLink"])
+
+    def _load_folders(self) -> None:
+        """Map folder IDs to labels, so labels.list knows them all."""
+        folders: Dict[str, str] = {}
+        for well_known, label in WELL_KNOWN_FOLDERS.items():
+            try:
+                folders[
+                    self._get(f"/me/mailFolders/{well_known}", {"$select": "id"})["id"]
+                ] = label
+            except HttpError as e:
+                if e.resp.status != 404:  # e.g. no Junk Email folder in this mailbox
+                    raise
+
+        pending = [("/me/mailFolders", "")]
+        while pending:
+            url, parent = pending.pop()
+            for folder in self._pages(
+                url, {"$select": "id,displayName,childFolderCount", "$top": "250"}
+            ):
+                name = (
+                    f"{parent}/{folder['displayName']}"
+                    if parent
+                    else folder["displayName"]
+                )
+                folders.setdefault(folder["id"], name)
+                if folder.get("childFolderCount"):
+                    pending.append(
+                        (
+                            f"/me/mailFolders/{folder['id']}/childFolders",
+                            folders[folder["id"]],
+                        )
+                    )
+
+        self._folders = folders
+        for label in folders.values():
+            self._label_ids.setdefault(label, f"Label_{len(self._label_ids) + 1}")
+
+    def folder_label(self, folder_id: str) -> str:
+        return self._folders.get(folder_id, "INBOX")
+
+    def _message_params(self) -> Dict[str, str]:
+        return {
+            "$select": MESSAGE_FIELDS,
+            "$expand": (
+                "attachments($select=name,size),"
+                "singleValueExtendedProperties($filter=id eq "
+                f"'{MESSAGE_SIZE_PROPERTY}')"
+            ),
+        }
+
+    def search(
+        self, query: str, include_spam_trash: bool = False
+    ) -> List[LocalMessage]:
+        """
+        Messages matching a Gmail query, newest first: narrowed by Graph, checked here.
+
+        Raises:
+            OutlookError: If Graph cannot narrow the query at all, which would
+                mean reading every message in the mailbox
+        """
+        narrowed = graph_filter(query)
+        if not narrowed:
+            raise OutlookError(
+                f"Cannot search Outlook for {query!r}: it needs has:attachment, "
+                f"a from: address, an after:/before: date or rfc822msgid: to narrow it"
+            )
+        params = {**self._message_params(), "$top": str(PAGE_SIZE), "$filter": narrowed}
+
+        # Only this search's messages are held; get() reads any other again
+        self.messages = {}
+        for data in self._pages("/me/messages", params):
+            self.add(OutlookMessage(self, data))
+        return super().search(query, include_spam_trash)
+
+    def get(self, message_id: str) -> "OutlookMessage":
+        """A message by ID, read from Graph if no search found it yet."""
+        if message_id not in self.messages:
+            data = self._get(
+                f"/me/messages/{urllib.parse.quote(message_id)}", self._message_params()
+            )
+            self.add(OutlookMessage(self, data))
+        return self.messages[message_id]
+
+    def read(self, message_id: str) -> Tuple[bytes, Message]:
+        """A message's MIME content and parsed form, keeping the last few read."""
+        with self._lock:
+            if message_id in self._messages_cache:
+                self._messages_cache.move_to_end(message_id)
+                return self._messages_cache[message_id]
+            raw = self._request(f"/me/messages/{urllib.parse.quote(message_id)}/$value")
+            self._messages_cache[message_id] = (
+                raw, email.message_from_bytes(raw, policy=policy.default)
+            )
+            while len(self._messages_cache) > CACHED_MESSAGES:
+                self._messages_cache.popitem(last=False)
+            return self._messages_cache[message_id]
+
+    def client(self, config: Optional[AppConfig] = None) -> GmailClient:
+        """
+        A GmailClient reading this mailbox.
+
+        Its authenticate() signs in to Microsoft. Requests do not count
+        towards the Gmail API quota; Graph throttling (429) is backed off
+        like Gmail's.
+        """
+        config = config or self.config
+        client = own_quota(
+            super().client(config), f"outlook:{config.gmail.get_profile_name()}"
+        )
+
+        async def authenticate(interactive: bool = True) -> None:
+            await self.connect(interactive)
+
+        client.authenticate = authenticate
+        return client
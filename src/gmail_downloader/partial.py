@@ -0,0 +1,175 @@
+"""
+Resuming large downloads.
+
+A large file that fails near its end (a dropped connection, the
+attachment timeout) should not start over on the next attempt. With
+download.enable_resume, files bigger than download.resume_chunk_size are
+fetched one range at a time: each chunk is appended to a part file, and a
+journal records how many bytes of it are complete. The next attempt, in the
+same run or a later one, truncates the part file to that offset and asks
+for the rest.
+
+Only linked Drive files can be fetched in ranges. The Gmail API returns an
+attachment in a single response (up to the 50MB Gmail accepts; bigger
+files arrive as Drive links), so a Gmail attachment resumes whole: one
+over resume_chunk_size that was downloaded by an attempt that then failed
+is kept, and the next attempt takes it from the journal instead of
+downloading it again.
+
+Downloads are journaled by message and attachment (see partial_key). Part
+files and the journal live in a hidden directory next to the manifest. A
+file whose size changed since its part file was started starts over.
+"""
+
+import hashlib
+import json
+import os
+from datetime import datetime
+from pathlib import Path
+from typing import Dict, Optional, Union
+
+from .manifest import ManifestError
+
+# Ranges of Drive files still being downloaded, and the journal of what arrived
+PARTIAL_DIRNAME = ".gmail_downloader_partial"
+JOURNAL_FILENAME = "journal.json"
+
+
+def partial_key(message_id: str, attachment_id: str) -> str:
+    """
+    The journal key of an attachment, or a Drive file linked from a message.
+
+    Gmail attachment IDs run to hundreds of characters, too long for a part
+    file's name, so the attachment is keyed by a digest of its ID.
+    """
+    return f"{message_id}-{hashlib.sha256(attachment_id.encode()).hexdigest()[:16]}"
+
+
+class PartialDownloads:
+    """The unfinished downloads of one download directory."""
+
+    def __init__(self, directory: Union[str, Path], temp_suffix: str = ".downloading"):
+        self.directory = Path(directory) / PARTIAL_DIRNAME
+        self.path = self.directory / JOURNAL_FILENAME
+        self.temp_suffix = temp_suffix
+        self._entries: Dict[str, Dict[str, object]] = {}
+
+    def load(self) -> "PartialDownloads":
+        """
+        Read the journal; a missing file means nothing is unfinished.
+
+        Raises:
+            ManifestError: If the file exists but cannot be parsed
+        """
+        self._entries = {}
+        if not self.path.exists():
+            return self
+        try:
+            self._entries = json.loads(
+                self.path.read_text(encoding="utf-8")
+            )["downloads"]
+        except (OSError, ValueError, KeyError, TypeError) as e:
+            raise ManifestError(f"Cannot read {self.path}: {e}")
+        return self
+
+    def part_path(self, key: str) -> Path:
+        """Where the bytes received so far of a download are kept."""
+        return self.directory / f"{key.replace(os.sep, '_')}{self.temp_suffix}"
+
+    def start(self, key: str, size: int) -> int:
+        """
+        Prepare to download a file of size bytes.
+
+        Returns:
+            The offset to continue from: the bytes recorded in the journal,
+            or 0 for a new download or one whose size changed
+        """
+        entry = self._entries.get(key)
+        part = self.part_path(key)
+        offset = 0
+        if entry is not None and entry.get("size") == size and part.exists():
+            offset = min(int(entry.get("offset", 0)), part.stat().st_size)
+        try:
+            self.directory.mkdir(parents=True, exist_ok=True)
+            # Bytes past the offset were written after the last journal update
+            with open(part, "r+b" if offset else "wb") as f:
+                f.truncate(offset)
+        except OSError as e:
+            raise ManifestError(f"Cannot write {part}: {e}")
+        self._entries[key] = {
+            "size": size,
+            "offset": offset,
+            "started_at": entry["started_at"] if offset else datetime.now().isoformat(),
+        }
+        self.save()
+        return offset
+
+    def offset(self, key: str) -> int:
+        """How many bytes of a download are complete."""
+        entry = self._entries.get(key)
+        return int(entry.get("offset", 0)) if entry else 0
+
+    def append(self, key: str, chunk: bytes) -> int:
+        """
+        Add the next chunk of a download, then record the new offset.
+
+        Returns:
+            The new offset
+        """
+        part = self.part_path(key)
+        try:
+            with open(part, "ab") as f:
+                f.write(chunk)
+                f.flush()
+                os.fsync(f.fileno())
+        except OSError as e:
+            raise ManifestError(f"Cannot write {part}: {e}")
+        self._entries[key]["offset"] = self.offset(key) + len(chunk)
+        self.save()
+        return self.offset(key)
+
+    def completed(self, key: str) -> Optional[bytes]:
+        """
+        A download an earlier attempt finished but did not use, taken out
+        of the journal; None if there is none.
+        """
+        entry = self._entries.get(key)
+        if entry is None or entry.get("offset") != entry.get("size"):
+            return None
+        try:
+            return self.finish(key)
+        except ManifestError:
+            return None
+
+    def keep(self, key: str, data: bytes) -> None:
+        """Record a whole download, for the next attempt to take with completed()."""
+        self.start(key, len(data))
+        self.append(key, data)
+
+    def finish(self, key: str) -> bytes:
+        """The complete file; its part file and journal entry are removed."""
+        part = self.part_path(key)
+        try:
+            data = part.read_bytes()
+        except OSError as e:
+            raise ManifestError(f"Cannot read {part}: {e}")
+        self.discard(key)
+        return data
+
+    def discard(self, key: str) -> None:
+        """Forget a download, e.g. one that will not be resumed."""
+        self.part_path(key).unlink(missing_ok=True)
+        if self._entries.pop(key, None) is not None:
+            self.save()
+
+    def save(self) -> None:
+        """Write the journal atomically, like the manifest."""
+        temp_path = self.path.with_suffix(".tmp")
+        try:
+            self.directory.mkdir(parents=True, exist_ok=True)
+            temp_path.write_text(
+                json.dumps({"downloads": self._entries}, indent=2), encoding="utf-8"
+            )
+            os.replace(temp_path, self.path)
+        except OSError as e:
+            raise ManifestError(f"Cannot write {self.path}: {e}")
@@ -0,0 +1,203 @@
+"""
+Interactive picker for `download --interactive`.
+
+Lists the planned downloads in a full-screen terminal view with a checkbox
+per file, so exactly the wanted files are fetched out of a coarse search.
+Typing filters the list fuzzily (the letters must appear in order in the
+filename, sender or subject), and the footer keeps a running total of what
+is selected. Files that are new or updated start selected. Files already
+downloaded are listed, dimmed and marked [=], but cannot be selected: the
+download would skip them anyway.
+
+Keys: arrows/PgUp/PgDn move, space toggles, Ctrl-A toggles everything shown,
+Backspace edits the filter, Enter downloads the selection and Esc cancels.
+
+The view is drawn with curses, which ships with Python on Linux and macOS.
+"""
+
+from typing import List, Optional, Set
+
+from .downloader import STATUS_EXISTS, PlannedDownload
+from .utils import format_file_size
+
+CTRL_A = "\x01"
+ESCAPE = "\x1b"
+BACKSPACE_KEYS = ("\x7f", "\b")
+
+
+class PickerUnavailable(Exception):
+    """Raised when there is no terminal UI to show (no curses, no terminal)."""
+
+    pass
+
+
+def fuzzy_match(pattern: str, text: str) -> bool:
+    """Whether the characters of pattern appear in text in order, ignoring case."""
+    remaining = iter(text.lower())
+    return all(char in remaining for char in pattern.lower())
+
+
+def _search_text(item: PlannedDownload) -> str:
+    return f"{item.filename} {item.message.sender} {item.message.subject}"
+
+
+class PickerState:
+    """What the picker shows and what is selected, independent of drawing."""
+
+    def __init__(self, items: List[PlannedDownload]):
+        self.items = items
+        self.selected: Set[int] = {
+            index for index in range(len(items)) if self.selectable(index)
+        }
+        self.query = ""
+        # Position within visible()
+        self.cursor = 0
+
+    def selectable(self, index: int) -> bool:
+        """Whether an item can be selected: it is not downloaded already."""
+        return self.items[index].status != STATUS_EXISTS
+
+    def visible(self) -> List[int]:
+        """Indices of the items matching the filter, in plan order."""
+        return [
+            index for index, item in enumerate(self.items)
+            if fuzzy_match(self.query, _search_text(item))
+        ]
+
+    def current(self) -> Optional[int]:
+        visible = self.visible()
+        return visible[self.cursor] if visible else None
+
+    def move(self, delta: int) -> None:
+        count = len(self.visible())
+        self.cursor = max(0, min(self.cursor + delta, count - 1)) if count else 0
+
+    def toggle(self) -> None:
+        """Select or unselect the item under the cursor."""
+        index = self.current()
+        if index is not None and self.selectable(index):
+            self.selected ^= {index}
+
+    def toggle_all(self) -> None:
+        """Select everything shown, or unselect it if it already is."""
+        visible = {index for index in self.visible() if self.selectable(index)}
+        if visible <= self.selected:
+            self.selected -= visible
+        else:
+            self.selected |= visible
+
+    def type(self, text: str) -> None:
+        self.query += text
+        self.cursor = 0
+
+    def backspace(self) -> None:
+        self.query = self.query[:-1]
+        self.cursor = 0
+
+    def chosen(self) -> List[PlannedDownload]:
+        """The selected items, in plan order (hidden ones included)."""
+        return [item for index, item in enumerate(self.items) if index in self.selected]
+
+    def total_size(self) -> int:
+        return sum(item.attachment.size for item in self.chosen())
+
+
+def _draw(screen, state: PickerState, curses) -> None:
+    height, width = screen.getmaxyx()
+    screen.erase()
+
+    def put(row: int, text: str, attr: int = 0) -> None:
+        if 0 <= row < height:
+            screen.addnstr(row, 0, text, max(width - 1, 0), attr)
+
+    put(0, f"Filter: {state.query}", curses.A_BOLD)
+
+    visible = state.visible()
+    rows = max(height - 3, 1)
+    # Scroll so the cursor stays on screen
+    top = max(0, state.cursor - rows + 1)
+    for row, index in enumerate(visible[top:top + rows], start=1):
+        item = state.items[index]
+        mark = (
+            "x" if index in state.selected else " " if state.selectable(index) else "="
+        )
+        line = (
+            f"[{mark}] {item.filename}  {format_file_size(item.attachment.size)}"
+            f"  {item.message.sender}  {item.status}"
+        )
+        attr = 0 if state.selectable(index) else curses.A_DIM
+        put(
+            row,
+            line,
+            attr | curses.A_REVERSE if top + row - 1 == state.cursor else attr,
+        )
+
+    downloaded = sum(
+        1 for index in range(len(state.items)) if not state.selectable(index)
+    )
+    put(
+        height - 1,
+        f"{len(state.selected)} of {len(state.items) - downloaded} selected "
+        f"({downloaded} already downloaded), "
+        f"{format_file_size(state.total_size())} - "
+        "space toggle, ^A all, enter download, esc cancel",
+        curses.A_DIM,
+    )
+    screen.refresh()
+
+
+def _run(screen, state: PickerState, curses) -> Optional[List[PlannedDownload]]:
+    try:
+        curses.curs_set(0)
+    except curses.error:
+        pass
+
+    while True:
+        _draw(screen, state, curses)
+        page = max(screen.getmaxyx()[0] - 3, 1)
+        key = screen.get_wch()
+
+        if key in ("\n", "\r", curses.KEY_ENTER):
+            return state.chosen()
+        if key == ESCAPE:
+            return None
+        if key == curses.KEY_UP:
+            state.move(-1)
+        elif key == curses.KEY_DOWN:
+            state.move(1)
+        elif key == curses.KEY_PPAGE:
+            state.move(-page)
+        elif key == curses.KEY_NPAGE:
+            state.move(page)
+        elif key == " ":
+            state.toggle()
+        elif key == CTRL_A:
+            state.toggle_all()
+        elif key in BACKSPACE_KEYS or key == curses.KEY_BACKSPACE:
+            state.backspace()
+        elif isinstance(key, str) and key.isprintable():
+            state.type(key)
+
+
+def pick(items: List[PlannedDownload]) -> Optional[List[PlannedDownload]]:
+    """
+    Let the user choose which planned downloads to carry out.
+
+    Returns:
+        The chosen items, or None if the user cancelled
+
+    Raises:
+        PickerUnavailable: If curses is missing or the terminal cannot be used
+    """
+    try:
+        import curses
+    except ImportError:
+        raise PickerUnavailable(
+            "The interactive picker needs curses (install windows-curses on Windows)"
+        )
+
+    state = PickerState(items)
+    try:
+        return curses.wrapper(_run, state, curses)
+    except curses.error as e:
+        raise PickerUnavailable(f"Cannot start the interactive picker: {e}")
@@ -0,0 +1,224 @@
+"""
+Looking inside an attachment without saving it.
+
+`gmail-downloader preview` downloads one attachment into memory and shows
+enough of it to tell whether it is the right file before a large batch is
+downloaded:
+
+    CSV/TSV   the header and first rows, and how many rows there are
+    XLSX      the name and size of each sheet
+    JSON      the top-level keys (of the first item, for an array)
+
+The format is recognised from the contents where possible (see sniff.py),
+so a CSV named export.dat is still shown as a table. Anything else is
+described by its type and size.
+"""
+
+import csv
+import io
+import json
+import re
+import zipfile
+import xml.etree.ElementTree as ElementTree
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import List, Optional, Tuple
+
+from .sniff import detect_delimiter, sniff_extension
+from .utils import format_file_size
+
+# Preview kinds
+PREVIEW_TABLE = "table"
+PREVIEW_WORKBOOK = "workbook"
+PREVIEW_JSON = "json"
+PREVIEW_OTHER = "other"
+
+# JSON keys shown at most
+MAX_KEYS = 50
+
+# How tables are described, by delimiter
+DELIMITER_NAMES = {
+    "\t": "TSV",
+    ",": "CSV",
+    ";": "CSV (semicolon-separated)",
+    "|": "CSV (pipe-separated)",
+}
+
+# Delimiters of files named as tables whose lines do not show one, such as
+# single-column CSVs
+DEFAULT_DELIMITERS = {".csv": ",", ".tsv": "\t", ".tab": "\t"}
+
+# Namespaces of the workbook parts of an XLSX file
+SPREADSHEET_NS = "{http://schemas.openxmlformats.org/spreadsheetml/2006/main}"
+RELATIONSHIP_NS = (
+    "{http://schemas.openxmlformats.org/officeDocument/2006/relationships}"
+)
+PACKAGE_RELATIONSHIP_NS = (
+    "{http://schemas.openxmlformats.org/package/2006/relationships}"
+)
+
+# A sheet's used range, declared near the start of its XML
+DIMENSION = re.compile(rb'<(?:\w+:)?dimension\s+ref="([A-Z]+\d+)(?::([A-Z]+\d+))?"')
+
+
+@dataclass
+class Preview:
+    """What an attachment contains, as far as a preview shows."""
+
+    kind: str
+    description: str
+    # PREVIEW_TABLE: the first rows, header included, and how many rows
+    # there are in all
+    rows: List[List[str]] = field(default_factory=list)
+    total_rows: int = 0
+    # PREVIEW_WORKBOOK: (sheet name, used range such as "A1:F120")
+    sheets: List[Tuple[str, str]] = field(default_factory=list)
+    # PREVIEW_JSON: top-level keys
+    keys: List[str] = field(default_factory=list)
+
+
+def _table(
+    data: bytes, rows: int, default_delimiter: Optional[str]
+) -> Optional[Preview]:
+    try:
+        text = data.decode("utf-8-sig")
+    except UnicodeDecodeError:
+        text = data.decode("latin-1")
+    delimiter = detect_delimiter(text.splitlines()) or default_delimiter
+    if delimiter is None:
+        return None
+
+    records = [
+        record
+        for record in csv.reader(io.StringIO(text), delimiter=delimiter)
+        if record
+    ]
+    columns = len(records[0]) if records else 0
+    return Preview(
+        kind=PREVIEW_TABLE,
+        description=(
+            f"{DELIMITER_NAMES[delimiter]}, {max(len(records) - 1, 0):,} data row(s) "
+            f"of {columns} column(s)"
+        ),
+        rows=records[:rows + 1],
+        total_rows=len(records),
+    )
+
+
+def column_number(letters: str) -> int:
+    """1 for A, 27 for AA."""
+    number = 0
+    for letter in letters:
+        number = number * 26 + ord(letter) - ord("A") + 1
+    return number
+
+
+def describe_range(ref: str) -> str:
+    """A used range such as "A1:F120" as "120 rows x 6 columns"."""
+    cells = re.findall(r"([A-Z]+)(\d+)", ref)
+    if not cells:
+        return ref
+    (first_column, first_row), (last_column, last_row) = cells[0], cells[-1]
+    rows = int(last_row) - int(first_row) + 1
+    columns = column_number(last_column) - column_number(first_column) + 1
+    return f"{rows:,} rows x {columns} columns"
+
+
+def workbook_sheets(data: bytes) -> List[Tuple[str, str]]:
+    """
+    The sheets of an XLSX workbook and their used ranges ("" when a sheet
+    does not declare one).
+
+    Raises:
+        ValueError: If data is not a readable XLSX workbook
+    """
+    try:
+        with zipfile.ZipFile(io.BytesIO(data)) as archive:
+            workbook = ElementTree.fromstring(archive.read("xl/workbook.xml"))
+            relationships = ElementTree.fromstring(
+                archive.read("xl/_rels/workbook.xml.rels")
+            )
+            targets = {
+                relation.get("Id"): relation.get("Target", "")
+                for relation in relationships.iter(
+                    f"{PACKAGE_RELATIONSHIP_NS}Relationship"
+                )
+            }
+
+            sheets = []
+            for sheet in workbook.iter(f"{SPREADSHEET_NS}sheet"):
+                target = targets.get(sheet.get(f"{RELATIONSHIP_NS}id"), "")
+                path = target.lstrip("/") if target.startswith("/") else f"xl/{target}"
+                ref = ""
+                if path in archive.namelist():
+                    with archive.open(path) as part:
+                        match = DIMENSION.search(part.read(4096))
+                    if match:
+                        ref = b":".join(
+                            group for group in match.groups() if group
+                        ).decode("ascii")
+                sheets.append((sheet.get("name", ""), ref))
+            return sheets
+    except (zipfile.BadZipFile, KeyError, ElementTree.ParseError, RuntimeError) as e:
+        raise ValueError(f"not a readable XLSX workbook: {e}")
+
+
+def _json(data: bytes) -> Optional[Preview]:
+    try:
+        document = json.loads(data.decode("utf-8-sig"))
+    except (UnicodeDecodeError, ValueError):
+        return None
+
+    if isinstance(document, dict):
+        return Preview(
+            kind=PREVIEW_JSON,
+            description=f"JSON object with {len(document)} key(s)",
+            keys=list(document)[:MAX_KEYS],
+        )
+    if isinstance(document, list):
+        first = document[0] if document else None
+        keys = list(first)[:MAX_KEYS] if isinstance(first, dict) else []
+        described = ", items with these keys" if keys else ""
+        return Preview(
+            kind=PREVIEW_JSON,
+            description=f"JSON array of {len(document):,} item(s){described}",
+            keys=keys,
+        )
+    return Preview(kind=PREVIEW_JSON, description=f"JSON {type(document).__name__}")
+
+
+def preview_attachment(filename: str, data: bytes, rows: int = 10) -> Preview:
+    """
+    A preview of an attachment's contents.
+
+    Args:
+        filename: The attachment's name, used when the contents are not recognised
+        data: The attachment
+        rows: Data rows of a table to include (besides the header)
+    """
+    suffix = Path(filename).suffix.lower()
+    extension = sniff_extension(data) or suffix
+    size = format_file_size(len(data))
+
+    if extension == ".xlsx":
+        try:
+            sheets = workbook_sheets(data)
+        except ValueError as e:
+            return Preview(kind=PREVIEW_OTHER, description=f"XLSX, {size}, {e}")
+        return Preview(
+            kind=PREVIEW_WORKBOOK,
+            description=f"XLSX workbook, {size}, {len(sheets)} sheet(s)",
+            sheets=sheets,
+        )
+    if extension in (".json", ".geojson"):
+        preview = _json(data)
+        if preview:
+            return preview
+    if extension in (".csv", ".tsv") or suffix in DEFAULT_DELIMITERS:
+        preview = _table(data, rows, DEFAULT_DELIMITERS.get(suffix))
+        if preview:
+            return preview
+    return Preview(
+        kind=PREVIEW_OTHER,
+        description=f"{extension.lstrip('.').upper() or 'Unknown type'}, {size}",
+    )
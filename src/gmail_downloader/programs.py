@@ -0,0 +1,65 @@
+"""
+Running the version control programs integrations use (dvc, git).
+
+Both work the same way: the repository is the nearest directory above the
+downloads with the program's marker folder, the program runs in its root
+with no input, and a failure is logged under the integration's name rather
+than raised, so it never stops a download.
+"""
+
+import asyncio
+import logging
+import shlex
+from pathlib import Path
+from typing import List, Optional, Tuple
+
+from .storage import Location
+
+logger = logging.getLogger(__name__)
+
+
+def find_root(path: Location, marker: str) -> Optional[Path]:
+    """The nearest directory at or above path holding marker, None if none does."""
+    current = Path(path).expanduser().resolve()
+    for directory in (current, *current.parents):
+        if (directory / marker).exists():
+            return directory
+    return None
+
+
+async def run_program(name: str, command: List[str], repo: Path, timeout: float,
+                      allowed: Tuple[int, ...] = (0,)) -> Optional[int]:
+    """
+    Run command in repo, for the integration called name.
+
+    Returns:
+        Its exit code, None if it could not be started or took over timeout
+        seconds; codes other than allowed are logged as errors
+    """
+    try:
+        process = await asyncio.create_subprocess_exec(
+            *command,
+            cwd=repo,
+            stdin=asyncio.subprocess.DEVNULL,
+            stdout=asyncio.subprocess.PIPE,
+            stderr=asyncio.subprocess.STDOUT,
+        )
+    except OSError as e:
+        logger.error(f"{name}: cannot start {command[0]}: {e}")
+        return None
+    try:
+        output, _ = await asyncio.wait_for(process.communicate(), timeout)
+    except asyncio.TimeoutError:
+        process.kill()
+        await process.wait()
+        logger.error(f"{name}: {shlex.join(command)} took over {timeout}s; stopped")
+        return None
+
+    text = output.decode(errors="replace").strip()
+    if process.returncode not in allowed:
+        logger.error(
+            f"{name}: {shlex.join(command)} exited with {process.returncode}: {text}"
+        )
+    elif text:
+        logger.debug(f"{name}: {text}")
+    return process.returncode
@@ -0,0 +1,102 @@
+"""
+Holding back attachments that should not go to the downloads.
+
+Some attachments are fetched but must not be saved where people and
+pipelines pick files up: the malware scanner flagged them, their name
+cannot be trusted (a direction override disguising an .exe as a .pdf, a
+path reaching out of its folder) or the stored copy never matched the
+downloaded data. Rather than dropping them, they are written to
+scan.quarantine_dir, one folder per reason, each with a reason file next
+to it saying what was wrong and where the file came from:
+
+    quarantine/
+        malware/m2_invoice.pdf
+        malware/m2_invoice.pdf.reason.json
+        unsafe_filename/m7_report.pdf
+        unsafe_filename/m7_report.pdf.reason.json
+
+Quarantined files are readable only by their owner. Someone reviewing them
+can release a file by moving it to the downloads; the manifest already
+knows it, so it is not downloaded again either way.
+"""
+
+import json
+import os
+from datetime import datetime
+from pathlib import Path
+from typing import Any, Dict, Optional, Union
+
+from .manifest import ManifestEntry
+from .utils import sanitize_filename
+
+# Why a file was quarantined; also the name of its folder
+REASON_MALWARE = "malware"
+REASON_UNSAFE_FILENAME = "unsafe_filename"
+REASON_VERIFY_FAILED = "verify_failed"
+QUARANTINE_REASONS = [REASON_MALWARE, REASON_UNSAFE_FILENAME, REASON_VERIFY_FAILED]
+
+# Appended to a quarantined file's name for its reason file
+REASON_SUFFIX = ".reason.json"
+
+
+def quarantine_path(
+    directory: Union[str, Path],
+    reason: str,
+    message_id: str,
+    filename: str,
+    suffix: str = "",
+) -> Path:
+    """
+    Where a file is quarantined: named after its message, in its reason's folder.
+
+    The name is sanitized like any other, so an untrusted one cannot place
+    the file elsewhere. suffix is added to it (an encrypted file's ".age").
+    A name already in use, by the file of an earlier hit, is numbered:
+    m2_invoice_1.pdf.
+    """
+    name = Path(f"{message_id}_{sanitize_filename(filename, 'keep')}")
+    folder = Path(directory) / reason
+    path = folder / (name.name + suffix)
+    number = 0
+    while path.exists() or path.with_name(path.name + REASON_SUFFIX).exists():
+        number += 1
+        path = folder / f"{name.stem}_{number}{name.suffix}{suffix}"
+    return path
+
+
+def reason_record(entry: ManifestEntry,
+                  reason: str,
+                  detail: str,
+                  original_filename: Optional[str] = None) -> Dict[str, Any]:
+    """What the reason file says about a quarantined attachment."""
+    return {
+        "reason": reason,
+        "detail": detail,
+        "filename": entry.filename,
+        "original_filename": original_filename
+        if original_filename is not None
+        else entry.filename,
+        "message_id": entry.message_id,
+        "attachment_id": entry.attachment_id,
+        "sender": entry.sender,
+        "subject": entry.subject,
+        "date": entry.date,
+        "size": entry.size,
+        "sha256": entry.sha256,
+        "destination": entry.path,
+        "quarantined_at": datetime.now().isoformat(),
+    }
+
+
+def write_quarantined(path: Path, data: bytes, record: Dict[str, Any]) -> None:
+    """Write a quarantined file and its reason file, both readable only by the owner."""
+    path.parent.mkdir(parents=True, exist_ok=True)
+    reason_file = path.with_name(path.name + REASON_SUFFIX)
+    for target, content in (
+        (path, data),
+        (reason_file, json.dumps(record, indent=2, ensure_ascii=False).encode("utf-8")),
+    ):
+        fd = os.open(target, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+        with os.fdopen(fd, "wb") as f:
+            f.write(content)
+
@@ -0,0 +1,173 @@
+"""
+Pruning old downloads by a retention policy.
+
+A daily feed on a shared server grows without bound unless someone deletes
+the old files, and deleting them by hand leaves the manifest claiming they
+are there. The clean command removes what the retention: section (or
+--older-than and --keep-latest) says has aged out:
+
+    gmail-downloader clean --older-than 90d --keep-latest 3
+
+A file is old when its email is older than older_than (the download time
+for entries without a date). keep_latest keeps the newest files of each
+feed, a sender plus a filename pattern as in schema.py, however old, so a
+feed that stopped sending still has its last files. Policies give senders
+or filenames their own terms; the first one matching a file applies.
+
+A removed file goes with what was derived from it: its .meta.json, .txt
+and .dvc sidecars, its Parquet mirror, the latest/ links pointing at it and
+its row in the search index. The folders it leaves empty are removed too.
+Its manifest entry stays as a tombstone (pruned_at), so the attachment is
+not downloaded again on the next run.
+"""
+
+import logging
+from dataclasses import dataclass, field
+from datetime import datetime
+from itertools import groupby
+from pathlib import Path
+from typing import Dict, Iterable, List, Optional
+
+from .config import RetentionConfig, RetentionPolicy
+from .downloader import SIDECAR_SUFFIX
+from .dvc import dvc_file
+from .latest import LATEST_DIRNAME, link_target
+from .manifest import DownloadManifest, ManifestEntry, entry_time
+from .schema import TABLE_EXTENSIONS, feed_key
+from .transforms import PARQUET_SUFFIX, TEXT_SUFFIX, mirror_path
+from .utils import matches_filename_pattern, matches_sender, parse_duration
+
+logger = logging.getLogger(__name__)
+
+
+def policy_for(entry: ManifestEntry, config: RetentionConfig) -> RetentionPolicy:
+    """The first policy matching the entry's sender and filename, or the default one."""
+    for policy in config.policies:
+        if (
+            matches_sender(entry.sender, policy.senders)
+            and matches_filename_pattern(entry.filename, policy.patterns)
+        ):
+            return policy
+    return config.default_policy()
+
+
+def expired(entries: Iterable[ManifestEntry], config: RetentionConfig,
+            now: Optional[datetime] = None) -> List[ManifestEntry]:
+    """The entries whose files the retention policies say to remove, oldest first."""
+    now = now or datetime.now()
+    entries = list(entries)
+    # Quarantined files are not in the download tree, and entries without
+    # a readable date are never removed
+    dated = [
+        (entry_time(entry), entry)
+        for entry in entries
+        if not entry.quarantine and not entry.pruned_at
+    ]
+    dated = [(when, entry) for when, entry in dated if when is not None]
+
+    def feed(item) -> str:
+        return feed_key(item[1].sender, item[1].filename)
+
+    removable = []
+    for _, items in groupby(sorted(dated, key=feed), key=feed):
+        newest_first = sorted(items, key=lambda item: item[0], reverse=True)
+        for position, (when, entry) in enumerate(newest_first):
+            policy = policy_for(entry, config)
+            if policy.older_than is None or position < policy.keep_latest:
+                continue
+            if now - when > parse_duration(policy.older_than):
+                removable.append((when, entry))
+
+    # A path written again by a newer download (conflict_policy overwrite)
+    # holds the file that is kept
+    removed_keys = {entry.key for _, entry in removable}
+    kept_paths = {entry.path for entry in entries if entry.key not in removed_keys}
+    removable = [
+        (when, entry) for when, entry in removable if entry.path not in kept_paths
+    ]
+    return [entry for _, entry in sorted(removable, key=lambda item: item[0])]
+
+
+@dataclass
+class CleanResult:
+    """What clean removed."""
+
+    removed: List[ManifestEntry] = field(default_factory=list)
+    bytes_freed: int = 0
+
+    # Files that could not be deleted, with why; their entries are kept as they are
+    failed: Dict[str, str] = field(default_factory=dict)
+
+
+def _remove_empty_parents(path: Path, base_dir: Path) -> None:
+    for directory in path.parents:
+        if directory == base_dir or base_dir not in directory.parents:
+            return
+        try:
+            directory.rmdir()
+        except OSError:
+            return  # Not empty
+
+
+def derived_files(
+    entry: ManifestEntry, base_dir: Path, parquet_dir: Optional[str] = None
+) -> List[Path]:
+    """The sidecars and mirror written for an entry's file, existing or not."""
+    path = base_dir / entry.path
+    files = [
+        path.with_name(path.name + suffix) for suffix in (SIDECAR_SUFFIX, TEXT_SUFFIX)
+    ]
+    files.append(dvc_file(path))
+    if parquet_dir and path.suffix.lower() in TABLE_EXTENSIONS:
+        files.append(mirror_path(base_dir, parquet_dir, entry.path, PARQUET_SUFFIX))
+    return files
+
+
+def latest_links(base_dir: Path) -> Dict[Path, List[Path]]:
+    """The symlinks below latest/, by the file each points at."""
+    links: Dict[Path, List[Path]] = {}
+    latest_dir = base_dir / LATEST_DIRNAME
+    if latest_dir.is_dir():
+        for link in latest_dir.rglob("*"):
+            target = link_target(link)
+            if target is not None:
+                links.setdefault(target, []).append(link)
+    return links
+
+
+def remove_files(
+    entries: Iterable[ManifestEntry],
+    manifest: DownloadManifest,
+    base_dir: Path,
+    parquet_dir: Optional[str] = None,
+) -> CleanResult:
+    """
+    Delete the entries' files and what was derived from them below base_dir,
+    keeping the entries as tombstones.
+
+    parquet_dir is the mirror of transforms.csv_to_parquet, when it is on.
+    latest/ copies (where symlinks are unavailable) are left alone. Files
+    already gone are only marked. The manifest is not saved, and the search
+    index is not updated (see SearchIndex.remove).
+    """
+    result = CleanResult()
+    base_dir = base_dir.resolve()
+    links = latest_links(base_dir)
+    for entry in entries:
+        path = base_dir / entry.path
+        derived = derived_files(entry, base_dir, parquet_dir) + links.get(path, [])
+        try:
+            size = path.stat().st_size if path.exists() else 0
+            for file in (path, *derived):
+                file.unlink(missing_ok=True)
+        except OSError as e:
+            logger.error(f"Cannot remove {path}: {e}")
+            result.failed[entry.path] = str(e)
+            continue
+        logger.info(f"Removed {entry.path} by the retention policy")
+        manifest.prune(entry)
+        result.removed.append(entry)
+        result.bytes_freed += size
+        for file in (path, *derived):
+            _remove_empty_parents(file, base_dir)
+    return result
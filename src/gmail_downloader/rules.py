@@ -0,0 +1,348 @@
+"""
+Several independent watches in one process.
+
+One vendor's CSVs go to the warehouse loader, payroll PDFs to a locked-down
+folder, everything from the bank to a bucket. Instead of a watch process
+per feed, the rules: section of the config lists them, and watch runs them
+all side by side:
+
+    rules:
+      - name: finance
+        filters:
+          senders: ["billing@vendor.com"]
+          extensions: [".csv"]
+        download:
+          base_dir: ./finance
+        run: ["python", "load_invoices.py", "{path}"]
+      - name: hr
+        filters:
+          senders: ["payroll@example.com"]
+        download:
+          base_dir: ./hr
+
+Each rule is layered over the rest of the file (config.apply_rule), so it
+only names what differs: filters, destination, layout, storage, its own
+webhook. Every rule gets its own search, manifest and state; the Gmail
+account, its quota and the watch timing are shared.
+
+run is the rule's post-action: a command started for every file the rule
+saves, as a list of arguments or one string split like a shell would (no
+shell is involved). Placeholders fill in the file's details. Commands run
+one at a time in the background (ActionQueue), so a slow one does not hold
+up the downloads. A failing command is logged and never stops the watch.
+"""
+
+import asyncio
+import logging
+import os
+import shlex
+from dataclasses import dataclass, field
+from datetime import timedelta
+from typing import Any, Callable, Dict, List, Optional, Tuple
+
+from .config import AppConfig, ConfigurationError, apply_rule
+from .downloader import DownloadService, EmailWatcher
+from .manifest import ManifestEntry
+from .storage import Location
+
+logger = logging.getLogger(__name__)
+
+# Placeholders a run command can use
+RUN_PLACEHOLDERS = [
+    "path", "filename", "sender", "subject", "message_id", "date", "rule"
+]
+
+# How long a run command may take before it is stopped
+RUN_TIMEOUT_SECONDS = 600
+
+
+@dataclass
+class Rule:
+    """One compiled watch rule."""
+
+    name: str
+    config: AppConfig
+
+    # Command started for every saved file, before placeholders are filled in
+    run: List[str] = field(default_factory=list)
+
+    def command(self, entry: ManifestEntry, path: Location) -> List[str]:
+        """The run command for a saved file."""
+        values = {
+            "path": str(path),
+            "filename": entry.filename,
+            "sender": entry.sender,
+            "subject": entry.subject,
+            "message_id": entry.message_id,
+            "date": entry.date,
+            "rule": self.name,
+        }
+        return [argument.format_map(values) for argument in self.run]
+
+    async def run_action(self, entry: ManifestEntry, path: Location) -> Optional[int]:
+        """
+        Start the run command for a saved file and wait for it.
+
+        Returns:
+            Its exit code; None without a command, or when it could not be
+            started or took longer than RUN_TIMEOUT_SECONDS
+        """
+        if not self.run:
+            return None
+        command = self.command(entry, path)
+        try:
+            process = await asyncio.create_subprocess_exec(
+                *command,
+                stdin=asyncio.subprocess.DEVNULL,
+                stdout=asyncio.subprocess.PIPE,
+                stderr=asyncio.subprocess.STDOUT,
+            )
+        except OSError as e:
+            logger.error(f"Rule {self.name}: cannot start {command[0]}: {e}")
+            return None
+        try:
+            output, _ = await asyncio.wait_for(
+                process.communicate(), RUN_TIMEOUT_SECONDS
+            )
+        except asyncio.TimeoutError:
+            process.kill()
+            await process.wait()
+            logger.error(
+                f"Rule {self.name}: {shlex.join(command)} took over "
+                f"{RUN_TIMEOUT_SECONDS}s; stopped"
+            )
+            return None
+
+        text = output.decode(errors="replace").strip()
+        if process.returncode:
+            logger.error(
+                f"Rule {self.name}: {shlex.join(command)} exited with "
+                f"{process.returncode}: {text}"
+            )
+        elif text:
+            logger.debug(f"Rule {self.name}: {text}")
+        return process.returncode
+
+
+class ActionQueue:
+    """
+    A rule's run commands, waiting to be run one after another.
+
+    add is the rule's download listener and returns at once; run works
+    through the queue in the background.
+    """
+
+    def __init__(self, rule: Rule):
+        self.rule = rule
+        self.pending: "asyncio.Queue[Tuple[ManifestEntry, Location]]" = asyncio.Queue()
+
+    async def add(self, entry: ManifestEntry, path: Location) -> None:
+        """Queue the run command for a saved file."""
+        if self.rule.run:
+            self.pending.put_nowait((entry, path))
+
+    async def run(self) -> None:
+        """Run queued commands until cancelled."""
+        while True:
+            await self._run_next(await self.pending.get())
+
+    async def drain(self) -> None:
+        """Run the commands queued so far, and return."""
+        while not self.pending.empty():
+            await self._run_next(self.pending.get_nowait())
+
+    async def _run_next(self, item: Tuple[ManifestEntry, Location]) -> None:
+        try:
+            await self.rule.run_action(*item)
+        except Exception as e:
+            logger.error(
+                f"Rule {self.rule.name}: run command failed for {item[0].filename}: {e}"
+            )
+        finally:
+            self.pending.task_done()
+
+
+def parse_run(name: str, run: Any) -> List[str]:
+    """
+    A rule's run setting as arguments, checked for unknown placeholders.
+
+    Raises:
+        ConfigurationError: If it is neither a string nor a list, or uses a
+            placeholder not in RUN_PLACEHOLDERS
+    """
+    if not run:
+        return []
+    if isinstance(run, str):
+        arguments = shlex.split(run, posix=os.name != "nt")
+    elif isinstance(run, list):
+        arguments = [str(argument) for argument in run]
+    else:
+        raise ConfigurationError(
+            f"rules.{name}.run must be a command string or a list of arguments"
+        )
+    for argument in arguments:
+        try:
+            argument.format_map({placeholder: "" for placeholder in RUN_PLACEHOLDERS})
+        except (KeyError, ValueError, IndexError) as e:
+            raise ConfigurationError(
+                f"Invalid rules.{name}.run argument {argument!r}: {e}. "
+                f"Placeholders: {', '.join('{' + p + '}' for p in RUN_PLACEHOLDERS)}"
+            )
+    return arguments
+
+
+def compile_rules(config: AppConfig, names: Optional[List[str]] = None) -> List[Rule]:
+    """
+    The rules of config, each with the configuration it runs with.
+
+    Args:
+        config: The loaded configuration, command-line options included
+        names: Only these rules, in the file's order; None for all
+
+    Raises:
+        ConfigurationError: If a rule is invalid or names one that does not exist
+    """
+    known = [str(rule["name"]).strip() for rule in config.rules]
+    for name in names or []:
+        if name not in known:
+            raise ConfigurationError(
+                f"Unknown rule: {name}. Rules: {', '.join(known) or 'none'}"
+            )
+
+    rules = []
+    for name, settings in zip(known, config.rules):
+        if names and name not in names:
+            continue
+        rules.append(
+            Rule(
+                name, apply_rule(config, settings), parse_run(name, settings.get("run"))
+            )
+        )
+    return rules
+
+
+class RuleWatcher:
+    """
+    A watcher per rule, run and reported on as one.
+
+    Offers what the daemon needs of an EmailWatcher: start_watching,
+    stop_watching, reload, health, stats and poll_listeners.
+    """
+
+    def __init__(
+        self, rules: List[Rule], open_service: Callable[[Rule], DownloadService]
+    ):
+        """
+        Args:
+            rules: The rules to run, see compile_rules
+            open_service: Creates the download service of a rule, writing
+                where the rule's configuration says
+        """
+        self.rules = {rule.name: rule for rule in rules}
+        self.watchers: Dict[str, EmailWatcher] = {}
+        self.actions: Dict[str, ActionQueue] = {}
+        for rule in rules:
+            service = open_service(rule)
+            self.actions[rule.name] = ActionQueue(rule)
+            service.download_listeners.append(self.actions[rule.name].add)
+            self.watchers[rule.name] = EmailWatcher(service, name=rule.name)
+
+        # Called after a successful mailbox check of any rule
+        self.poll_listeners: List[Callable[[], Any]] = []
+        for watcher in self.watchers.values():
+            watcher.poll_listeners.append(self._polled)
+
+    def _polled(self) -> None:
+        for listener in self.poll_listeners:
+            listener()
+
+    @property
+    def stats(self) -> Dict[str, int]:
+        """The counts of all rules added up."""
+        totals: Dict[str, int] = {}
+        for watcher in self.watchers.values():
+            for key, value in watcher.stats.items():
+                totals[key] = totals.get(key, 0) + value
+        return totals
+
+    async def start_watching(self,
+                             check_interval: Optional[int] = None,
+                             backfill: Optional[timedelta] = None) -> None:
+        """
+        Watch with every rule until stop_watching, or until one fails.
+
+        A rule's own errors (a message that cannot be processed) are handled
+        by its watcher; what ends one, such as an authentication error,
+        ends them all. Run commands still queued then are not started.
+        """
+        tasks = [
+            asyncio.create_task(watcher.start_watching(check_interval, backfill))
+            for watcher in self.watchers.values()
+        ]
+        runners = [
+            asyncio.create_task(actions.run()) for actions in self.actions.values()
+        ]
+        try:
+            await asyncio.gather(*tasks)
+        finally:
+            for task in tasks + runners:
+                task.cancel()
+            await asyncio.gather(*tasks, *runners, return_exceptions=True)
+            for name, actions in self.actions.items():
+                if not actions.pending.empty():
+                    logger.warning(
+                        f"Rule {name}: {actions.pending.qsize()} "
+                        "run command(s) not started"
+                    )
+
+    def stop_watching(self) -> None:
+        """Stop every rule."""
+        for watcher in self.watchers.values():
+            watcher.stop_watching()
+
+    def reload(self, config: AppConfig) -> None:
+        """
+        Apply a new configuration to the rules already running.
+
+        Rules added to or removed from the file take effect with the next
+        restart.
+
+        Raises:
+            ConfigurationError: If a running rule became invalid; no rule
+                is changed then
+        """
+        rules = {rule.name: rule for rule in compile_rules(config)}
+        for name in self.rules.keys() - rules.keys():
+            logger.warning(
+                f"Rule {name} was removed from the "
+                "config; it keeps running until a restart"
+            )
+        for name, rule in self.rules.items():
+            if name in rules:
+                rule.config, rule.run = rules[name].config, rules[name].run
+                self.watchers[name].reload(rule.config)
+
+    def health(self) -> Dict[str, Any]:
+        """
+        Each rule's health, and whether all of them are healthy.
+
+        A stale feed (freshness.expected_by) is listed, but does not make
+        the watcher unhealthy: the sender is late, not the downloader.
+        """
+        rules = {name: watcher.health() for name, watcher in self.watchers.items()}
+        polls = [
+            status["last_poll"] for status in rules.values() if status["last_poll"]
+        ]
+        return {
+            "pid": os.getpid(),
+            "watching": any(status["watching"] for status in rules.values()),
+            "healthy": all(status["healthy"] for status in rules.values()),
+            "last_poll": max(polls) if polls else None,
+            **self.stats,
+            "stale_feeds": [
+                name
+                for name, status in rules.items()
+                if status.get("freshness", {}).get("stale")
+            ],
+            "rules": rules,
+        }
@@ -0,0 +1,206 @@
+"""
+One run at a time per download directory.
+
+When cron starts a download while the previous one is still going, or a
+download runs next to a watcher on the same directory, both write the same
+files, manifest and state. Every command that downloads therefore holds a
+lock file next to the manifest for as long as it runs; a second run finds it
+and stops with a message naming the holder, or waits for it (--wait).
+
+The lock is advisory: it only keeps out other gmail-downloader runs. It
+records the holder's PID, host and command. A lock left behind by a crashed
+run on this host (its PID is gone) is taken over; one from another host
+(a shared network directory) cannot be checked and needs --force. Taking
+over renames the old lock aside before a new one is created exclusively, so
+of two runs finding the same stale lock only one gets the directory.
+"""
+
+import json
+import logging
+import os
+import socket
+import time
+from datetime import datetime
+from pathlib import Path
+from typing import Any, Callable, Dict, Optional, Union
+
+from .daemon import process_alive
+from .utils import ensure_directory
+
+logger = logging.getLogger(__name__)
+
+# Held by the running process, in the download directory like the manifest
+LOCK_FILENAME = ".gmail_downloader.lock"
+
+# Seconds between checks while waiting for a lock
+POLL_SECONDS = 2.0
+
+
+class RunLockError(Exception):
+    """Raised when another run holds the lock."""
+
+    pass
+
+
+def describe_holder(holder: Dict[str, Any]) -> str:
+    """Who holds a lock, e.g. "download (PID 4242 on nas, since 2024-06-01T08:00)"."""
+    return (
+        f"{holder.get('command') or 'a run'} (PID {holder.get('pid', '?')} on "
+        f"{holder.get('host', '?')}, "
+        f"since {holder.get('started_at', '?')})"
+    )
+
+
+class RunLock:
+    """
+    The lock file of one download directory.
+
+    Used as a context manager around a run; release only removes a lock
+    this process wrote.
+    """
+
+    def __init__(self, directory: Union[str, Path], command: str = ""):
+        self.path = Path(directory) / LOCK_FILENAME
+        self.command = command
+        self.acquired = False
+
+    def holder(self) -> Optional[Dict[str, Any]]:
+        """What the lock file says about its holder; None without a lock."""
+        try:
+            holder = json.loads(self.path.read_text(encoding="utf-8"))
+        except FileNotFoundError:
+            return None
+        except (OSError, ValueError):
+            return {}  # Being written, or damaged
+        return holder if isinstance(holder, dict) else {}
+
+    def is_stale(self, holder: Dict[str, Any]) -> bool:
+        """Whether a lock was left by a run on this host that no longer exists."""
+        if holder.get("host") != socket.gethostname():
+            return False
+        pid = holder.get("pid")
+        return not (isinstance(pid, int) and (pid == os.getpid() or process_alive(pid)))
+
+    def try_acquire(self, force: bool = False) -> Optional[Dict[str, Any]]:
+        """
+        Take the lock if it is free, stale or force is set.
+
+        Returns:
+            None once the lock is ours, otherwise its current holder
+        """
+        ensure_directory(self.path.parent)
+        for _ in range(2):
+            try:
+                fd = os.open(self.path, os.O_CREAT | os.O_EXCL | os.O_WRONLY, 0o644)
+            except FileExistsError:
+                holder = self.holder()
+                if holder is None:
+                    continue  # Released meanwhile
+                if not holder:
+                    # Give a run that is writing its lock a moment
+                    time.sleep(0.1)
+                    holder = self.holder()
+                    if holder is None:
+                        continue
+                if force:
+                    logger.warning(
+                        "Taking over the lock of "
+                        f"{describe_holder(holder)}: {self.path}"
+                    )
+                elif holder and not self.is_stale(holder):
+                    return holder
+                else:
+                    logger.warning(
+                        f"Removing stale lock {self.path} of {describe_holder(holder)}"
+                    )
+                self.remove(holder)
+                continue
+
+            with os.fdopen(fd, "w", encoding="utf-8") as f:
+                json.dump({
+                    "pid": os.getpid(),
+                    "host": socket.gethostname(),
+                    "command": self.command,
+                    "started_at": datetime.now().isoformat(timespec="seconds"),
+                }, f)
+            self.acquired = True
+            return None
+        return self.holder() or {}
+
+    def remove(self, holder: Dict[str, Any]) -> None:
+        """
+        Remove the lock of holder, found stale or taken over by force.
+
+        The lock is renamed aside, which only one run can do, then checked:
+        if it is no longer holder's (another run took over first and wrote
+        its own), it is put back.
+        """
+        aside = self.path.with_name(
+            f"{self.path.name}.{os.getpid()}.{time.time_ns()}.stale"
+        )
+        try:
+            os.rename(self.path, aside)
+        except FileNotFoundError:
+            return  # Removed by another run meanwhile
+        try:
+            removed = json.loads(aside.read_text(encoding="utf-8"))
+        except (OSError, ValueError):
+            removed = {}
+        if not isinstance(removed, dict):
+            removed = {}
+        if removed != holder:
+            try:
+                os.link(aside, self.path)
+            except OSError as e:
+                logger.warning(
+                    f"Cannot put back the lock of {describe_holder(removed)}: {e}"
+                )
+        aside.unlink(missing_ok=True)
+
+    def acquire(self,
+                wait: bool = False,
+                force: bool = False,
+                on_wait: Optional[Callable[[Dict[str, Any]], None]] = None) -> None:
+        """
+        Take the lock.
+
+        Args:
+            wait: Wait for the holder to finish instead of failing
+            force: Take the lock whoever holds it
+            on_wait: Called once with the holder when waiting starts
+
+        Raises:
+            RunLockError: If another run holds the lock and wait is not set
+        """
+        holder = self.try_acquire(force)
+        if holder is None:
+            return
+        if not wait:
+            raise RunLockError(
+                "Another run is using this download directory: "
+                f"{describe_holder(holder)}. "
+                "Use --wait to wait for it, or --force "
+                f"if it is not running (lock: {self.path})"
+            )
+        if on_wait:
+            on_wait(holder)
+        while self.try_acquire() is not None:
+            time.sleep(POLL_SECONDS)
+
+    def release(self) -> None:
+        """Remove the lock file if we hold it."""
+        if self.acquired:
+            holder = self.holder() or {}
+            if (
+                holder.get("pid") == os.getpid()
+                and holder.get("host") == socket.gethostname()
+            ):
+                self.path.unlink(missing_ok=True)
+        self.acquired = False
+
+    def __enter__(self) -> "RunLock":
+        self.acquire()
+        return self
+
+    def __exit__(self, *exc_info) -> None:
+        self.release()
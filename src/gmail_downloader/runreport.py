@@ -0,0 +1,386 @@
+"""
+Summaries of download runs.
+
+Every download run ends with a summary: how many attachments were saved,
+failed or skipped, how many bytes that was, how long it took and at what
+throughput. The same summary can be written as JSON, one file per run
+(run-2024-06-01-093012.json), to download.report_dir. Runs with failures
+always write it, next to the manifest if report_dir is not set, so the
+failed attachments can be retried, and nothing else:
+
+    gmail-downloader download --retry-from reports/run-2024-06-01-093012.json
+    gmail-downloader retry --last
+
+For pipeline tools, `run --json-summary` prints a RunSummary instead: the
+report plus the files saved, the newest message seen and how the run ended.
+
+Failures are recorded by message ID and the name the attachment is saved
+under, the manifest's key for it, so a retry finds the same attachments
+even though Gmail's attachment IDs change between calls. The report also
+keeps the run's filters and download settings, command-line options
+included, and a retry replays them: the attachments pass the same filters
+and are saved to the same places.
+"""
+
+import asyncio
+import json
+import os
+from dataclasses import asdict, dataclass, field
+from datetime import datetime
+from pathlib import Path
+from typing import Any, Callable, Dict, List, Optional, Union
+
+from .config import AppConfig, apply_settings
+from .downloader import STATUS_EXISTS, DownloadService, FailedDownload, PlannedDownload
+from .exitcodes import EXIT_OK, EXIT_STATUS_NAMES
+from .manifest import ManifestEntry
+from .storage import Location
+
+# Report files are named run-<start time>.json; the name without .json is
+# the run ID the retry command takes
+REPORT_PREFIX = "run-"
+
+# Config sections a report keeps for a retry to replay
+REPLAYED_SECTIONS = ["filters", "download", "junk"]
+
+
+class ReportError(Exception):
+    """Raised when a run report cannot be read or written."""
+
+    pass
+
+
+@dataclass
+class RunFailure:
+    """One attachment a run could not download."""
+
+    message_id: str
+    filename: str
+    sender: str = ""
+    subject: str = ""
+    error: str = ""
+
+    @classmethod
+    def from_failed(cls, failed: FailedDownload) -> "RunFailure":
+        """Record a failed download from DownloadService.failed."""
+        item = failed.item
+        return cls(
+            message_id=item.message.message_id,
+            filename=item.filename,
+            sender=item.message.sender,
+            subject=item.message.subject,
+            error=failed.error,
+        )
+
+
+@dataclass
+class RunReport:
+    """What one download run did."""
+
+    started_at: datetime
+    finished_at: datetime
+    succeeded: int = 0
+    skipped: int = 0
+    total_bytes: int = 0
+    failures: List[RunFailure] = field(default_factory=list)
+
+    # The run's REPLAYED_SECTIONS, as in the config file (see run_settings)
+    settings: Dict[str, Any] = field(default_factory=dict)
+
+    @classmethod
+    def from_run(cls,
+                 planned: List[PlannedDownload],
+                 saved: List[Any],
+                 failed: List[FailedDownload],
+                 total_bytes: int,
+                 started_at: datetime,
+                 finished_at: datetime) -> "RunReport":
+        """
+        Summarize a run of DownloadService.execute over planned.
+
+        Everything planned that was neither saved nor failed counts as
+        skipped: already downloaded, left out by the budget or conflict
+        policy, junk, or flagged by the scanner.
+        """
+        return cls(
+            started_at=started_at,
+            finished_at=finished_at,
+            succeeded=len(saved),
+            skipped=len(planned) - len(saved) - len(failed),
+            total_bytes=total_bytes,
+            failures=[RunFailure.from_failed(failure) for failure in failed],
+        )
+
+    @property
+    def failed(self) -> int:
+        """Number of attachments that could not be downloaded."""
+        return len(self.failures)
+
+    @property
+    def elapsed_seconds(self) -> float:
+        """How long the run took."""
+        return max((self.finished_at - self.started_at).total_seconds(), 0.0)
+
+    @property
+    def throughput(self) -> float:
+        """Bytes saved per second."""
+        return self.total_bytes / self.elapsed_seconds if self.elapsed_seconds else 0.0
+
+    def filename(self) -> str:
+        """File name for this report, e.g. run-2024-06-01-093012.json."""
+        return f"{REPORT_PREFIX}{self.started_at:%Y-%m-%d-%H%M%S}.json"
+
+    def to_dict(self) -> Dict[str, Any]:
+        """The report as JSON-ready data."""
+        return {
+            "started_at": self.started_at.isoformat(),
+            "finished_at": self.finished_at.isoformat(),
+            "elapsed_seconds": round(self.elapsed_seconds, 3),
+            "succeeded": self.succeeded,
+            "failed": self.failed,
+            "skipped": self.skipped,
+            "total_bytes": self.total_bytes,
+            "bytes_per_second": round(self.throughput),
+            "failures": [asdict(failure) for failure in self.failures],
+            "settings": self.settings,
+        }
+
+    def save(self, directory: Union[str, Path]) -> Path:
+        """
+        Write the report into directory, atomically like the manifest.
+
+        Raises:
+            ReportError: If the file cannot be written
+        """
+        path = Path(directory) / self.filename()
+        temp_path = path.with_suffix(".tmp")
+        try:
+            path.parent.mkdir(parents=True, exist_ok=True)
+            temp_path.write_text(json.dumps(self.to_dict(), indent=2), encoding="utf-8")
+            os.replace(temp_path, path)
+        except OSError as e:
+            raise ReportError(f"Cannot write {path}: {e}")
+        return path
+
+
+@dataclass
+class RunSummary:
+    """
+    What a run did, as one JSON document for Airflow, Prefect and the like.
+
+    Filled in as the run goes: record_file is a download listener, and the
+    report is set once the downloads are done. Runs that end early (nothing
+    matched, an error) have no report; their counts are zero.
+    """
+
+    profile: str = ""
+    started_at: datetime = field(default_factory=datetime.now)
+    finished_at: Optional[datetime] = None
+    exit_code: int = EXIT_OK
+    error: str = ""
+
+    # Attachments the search found, including those already downloaded
+    matched: int = 0
+
+    # Newest date among the matched messages, a watermark for the next task
+    newest_message: Optional[datetime] = None
+    report: Optional[RunReport] = None
+    files: List[ManifestEntry] = field(default_factory=list)
+
+    async def record_file(self, entry: ManifestEntry, path: Location) -> None:
+        """Note a saved file (a DownloadService download listener)."""
+        self.files.append(entry)
+
+    def to_dict(self) -> Dict[str, Any]:
+        """The summary as JSON-ready data."""
+        finished_at = self.finished_at or datetime.now()
+        report = self.report or RunReport(
+            started_at=self.started_at, finished_at=finished_at
+        )
+        return {
+            "status": EXIT_STATUS_NAMES.get(self.exit_code, "error"),
+            "exit_code": self.exit_code,
+            "error": self.error or None,
+            "profile": self.profile,
+            "started_at": self.started_at.isoformat(),
+            "finished_at": finished_at.isoformat(),
+            "elapsed_seconds": round(
+                max((finished_at - self.started_at).total_seconds(), 0.0), 3
+            ),
+            "matched": self.matched,
+            "downloaded": report.succeeded,
+            "skipped": report.skipped,
+            "failed": report.failed,
+            "bytes": report.total_bytes,
+            "newest_message": self.newest_message.isoformat()
+            if self.newest_message
+            else None,
+            "files": [
+                {
+                    "path": entry.path,
+                    "filename": entry.filename,
+                    "size": entry.size,
+                    "sha256": entry.sha256,
+                    "message_id": entry.message_id,
+                    "sender": entry.sender,
+                    "subject": entry.subject,
+                    "date": entry.date,
+                }
+                for entry in self.files
+            ],
+            "failures": [asdict(failure) for failure in report.failures],
+        }
+
+
+def load_failures(path: Union[str, Path]) -> List[RunFailure]:
+    """
+    The failed attachments recorded in a run report.
+
+    Raises:
+        ReportError: If the file is missing or is not a run report
+    """
+    try:
+        data = json.loads(Path(path).read_text(encoding="utf-8"))
+        return [
+            RunFailure(
+                **{
+                    name: failure[name]
+                    for name in RunFailure.__dataclass_fields__
+                    if name in failure
+                }
+            )
+            for failure in data["failures"]
+        ]
+    except (OSError, ValueError, KeyError, TypeError) as e:
+        raise ReportError(f"Cannot read run report {path}: {e}")
+
+
+def run_settings(config: AppConfig) -> Dict[str, Any]:
+    """The settings of a run that a retry replays."""
+    settings = config.to_dict()
+    return {section: settings[section] for section in REPLAYED_SECTIONS}
+
+
+def replay_settings(config: AppConfig, path: Union[str, Path]) -> AppConfig:
+    """
+    Apply the settings recorded in a run report to config. Reports from
+    before settings were recorded change nothing.
+
+    Raises:
+        ReportError: If the file is missing or is not a run report
+    """
+    try:
+        settings = json.loads(
+            Path(path).read_text(encoding="utf-8")
+        ).get("settings") or {}
+    except (OSError, ValueError, AttributeError) as e:
+        raise ReportError(f"Cannot read run report {path}: {e}")
+    return apply_settings(
+        config,
+        {
+            section: settings[section]
+            for section in REPLAYED_SECTIONS
+            if section in settings
+        },
+    )
+
+
+def find_report(directory: Union[str, Path], run_id: str) -> Path:
+    """
+    The report of a run: a path to a report, or a run ID such as
+    run-2024-06-01-093012 (the "run-" may be left out) in directory.
+
+    Raises:
+        ReportError: If there is no such report
+    """
+    if Path(run_id).is_file():
+        return Path(run_id)
+
+    name = run_id if run_id.startswith(REPORT_PREFIX) else REPORT_PREFIX + run_id
+    path = Path(directory) / (name if name.endswith(".json") else f"{name}.json")
+    if not path.is_file():
+        raise ReportError(f"No run report {run_id} in {directory}")
+    return path
+
+
+def latest_report(directory: Union[str, Path]) -> Path:
+    """
+    The report of the most recent run in directory.
+
+    Raises:
+        ReportError: If directory has no reports
+    """
+    # Names sort by start time
+    reports = sorted(Path(directory).glob(f"{REPORT_PREFIX}*.json"))
+    if not reports:
+        raise ReportError(f"No run reports in {directory}")
+    return reports[-1]
+
+
+def select_failures(
+    planned: List[PlannedDownload], failures: List[RunFailure]
+) -> List[PlannedDownload]:
+    """
+    The planned downloads a report's failures stand for.
+
+    Attachments that have been saved since (status EXISTS) are left out.
+    """
+    keys = {(failure.message_id, failure.filename) for failure in failures}
+    return [
+        item
+        for item in planned
+        if (
+            item.message.message_id, item.filename
+        ) in keys and item.status != STATUS_EXISTS
+    ]
+
+
+async def retry_failures(
+    service: DownloadService,
+    failures: List[RunFailure],
+    attempts: int = 3,
+    backoff: float = 30.0,
+    on_wait: Optional[Callable[[List[RunFailure], int, float], None]] = None,
+) -> RunReport:
+    """
+    Download the attachments of failures again, and only those.
+
+    Attachments that fail again are tried again after backoff seconds,
+    doubling each time, up to attempts tries in all. on_wait is told
+    before each wait what is still failing, which attempt comes next and
+    how long the wait is.
+
+    Returns:
+        The report of the retry; attachments gone from the mailbox or saved
+        by another run in the meantime count as skipped
+    """
+    started_at = datetime.now()
+    saved: List[Any] = []
+    saved_bytes = 0
+    remaining = failures
+    for attempt in range(1, attempts + 1):
+        message_ids = list(dict.fromkeys(failure.message_id for failure in remaining))
+        planned = select_failures(await service.plan_messages(message_ids), remaining)
+        if not planned:
+            remaining = []
+            break
+
+        saved += await service.execute(planned)
+        saved_bytes += service.saved_bytes
+        remaining = [RunFailure.from_failed(failed) for failed in service.failed]
+        if not remaining or attempt == attempts:
+            break
+
+        delay = backoff * 2 ** (attempt - 1)
+        if on_wait:
+            on_wait(remaining, attempt + 1, delay)
+        await asyncio.sleep(delay)
+
+    return RunReport(
+        started_at=started_at,
+        finished_at=datetime.now(),
+        succeeded=len(saved),
+        skipped=len(failures) - len(saved) - len(remaining),
+        total_bytes=saved_bytes,
+        failures=remaining,
+    )
@@ -0,0 +1,175 @@
+"""
+Virus and malware scanning of attachments before they are saved.
+
+With scan.scanner set, every downloaded attachment is checked before it is
+written to its destination. Clean files are saved as usual; flagged files
+are written to scan.quarantine_dir instead, and the manifest records the
+verdict for both, so a flagged file is not downloaded again on the next run.
+
+Two scanners are built in:
+
+- "clamav" streams the bytes to a running clamd (INSTREAM command) over its
+  Unix socket or TCP, so no temporary file is needed.
+- "command" runs any program, passing the file on stdin or as a temporary
+  file where the command line says {path}. Exit code 0 means clean and 1
+  flagged, as with clamscan and clamdscan.
+
+A scan that fails (clamd not running, a timeout, an unexpected exit code)
+raises ScanError; the file is then not saved at all, so nothing unscanned
+ends up in the downloads.
+"""
+
+import asyncio
+import os
+import shlex
+import struct
+import tempfile
+from pathlib import Path
+from typing import Optional
+
+from .config import ScanConfig
+
+# Verdict recorded for files the scanner found nothing in
+VERDICT_CLEAN = "clean"
+
+# clamd reads INSTREAM data in chunks, each prefixed with its length
+CLAMAV_CHUNK_SIZE = 64 * 1024
+
+
+class ScanError(Exception):
+    """Raised when a file could not be scanned."""
+
+    pass
+
+
+class Scanner:
+    """Checks attachment bytes; subclasses talk to one kind of scanner."""
+
+    def __init__(self, config: ScanConfig):
+        self.config = config
+
+    async def scan(self, data: bytes, filename: str) -> str:
+        """
+        Scan data, an attachment named filename.
+
+        Returns:
+            VERDICT_CLEAN, or what the scanner flagged (e.g. a signature name)
+
+        Raises:
+            ScanError: If the scan could not be completed
+        """
+        try:
+            return await asyncio.wait_for(
+                self._scan(data, filename), self.config.timeout_seconds
+            )
+        except asyncio.TimeoutError:
+            raise ScanError(f"no verdict within {self.config.timeout_seconds}s")
+
+    async def _scan(self, data: bytes, filename: str) -> str:
+        raise NotImplementedError
+
+
+class ClamAVScanner(Scanner):
+    """Streams files to clamd."""
+
+    async def _connect(self):
+        address = self.config.clamav_socket
+        host, _, port = address.rpartition(":")
+        try:
+            if host and port.isdigit() and not address.startswith("/"):
+                return await asyncio.open_connection(host, int(port))
+            return await asyncio.open_unix_connection(address)
+        except OSError as e:
+            raise ScanError(f"cannot reach clamd at {address}: {e}")
+
+    async def _scan(self, data: bytes, filename: str) -> str:
+        reader, writer = await self._connect()
+        try:
+            writer.write(b"zINSTREAM\0")
+            for start in range(0, len(data), CLAMAV_CHUNK_SIZE):
+                chunk = data[start:start + CLAMAV_CHUNK_SIZE]
+                writer.write(struct.pack(">I", len(chunk)) + chunk)
+                await writer.drain()
+            writer.write(struct.pack(">I", 0))
+            await writer.drain()
+            reply = (await reader.read()).rstrip(b"\0\n").decode("utf-8", "replace")
+        except OSError as e:
+            raise ScanError(f"clamd connection failed: {e}")
+        finally:
+            writer.close()
+
+        # "stream: OK", "stream: Win.Test.EICAR_HDB-1 FOUND" or "... ERROR"
+        result = reply.split(": ", 1)[-1]
+        if result == "OK":
+            return VERDICT_CLEAN
+        if result.endswith(" FOUND"):
+            return result[:-len(" FOUND")]
+        raise ScanError(f"clamd: {reply or 'no reply'}")
+
+
+class CommandScanner(Scanner):
+    """Runs an external scanner program."""
+
+    async def _scan(self, data: bytes, filename: str) -> str:
+        args = shlex.split(self.config.command)
+        if not any("{path}" in arg for arg in args):
+            return await self._run(args, data)
+
+        # Keep the extension; some scanners decide what to check by it
+        handle, path = tempfile.mkstemp(suffix=Path(filename).suffix)
+        try:
+            with os.fdopen(handle, "wb") as f:
+                f.write(data)
+            return await self._run([arg.replace("{path}", path) for arg in args], None)
+        finally:
+            os.unlink(path)
+
+    async def _run(self, args, stdin: Optional[bytes]) -> str:
+        try:
+            process = await asyncio.create_subprocess_exec(
+                *args,
+                stdin=asyncio.subprocess.PIPE
+                if stdin is not None
+                else asyncio.subprocess.DEVNULL,
+                stdout=asyncio.subprocess.PIPE,
+                stderr=asyncio.subprocess.STDOUT,
+            )
+        except OSError as e:
+            raise ScanError(f"cannot run {args[0]}: {e}")
+
+        try:
+            output, _ = await process.communicate(stdin)
+        except asyncio.CancelledError:
+            # Timed out: do not leave the scanner running
+            process.kill()
+            await process.wait()
+            raise
+
+        lines = [
+            line.strip()
+            for line in output.decode("utf-8", "replace").splitlines()
+            if line.strip()
+        ]
+        if process.returncode == 0:
+            return VERDICT_CLEAN
+        if process.returncode == 1:
+            # clamscan prints "<file>: <signature> FOUND"
+            verdict = (
+                lines[0].split(": ", 1)[-1]
+                if lines
+                else f"flagged by {Path(args[0]).name}"
+            )
+            return verdict.removesuffix(" FOUND")
+        raise ScanError(
+            f"{Path(args[0]).name} exited with {process.returncode}: "
+            f"{' '.join(lines[:1])}"
+        )
+
+
+def open_scanner(config: ScanConfig) -> Optional[Scanner]:
+    """The scanner scan.scanner names, or None when scanning is off."""
+    if config.scanner == "clamav":
+        return ClamAVScanner(config)
+    if config.scanner == "command":
+        return CommandScanner(config)
+    return None
@@ -0,0 +1,167 @@
+"""
+Cron schedules for watch mode.
+
+By default the watcher checks Gmail every check_interval seconds, day and
+night. With watch.schedules (or watch --schedule) it only checks at the
+times cron expressions name, such as "*/15 7-18 * * MON-FRI" for every
+quarter hour of the working day, and sleeps in between.
+
+Expressions have the five standard fields: minute, hour, day of month,
+month and day of week. Fields take *, numbers, ranges (1-5), steps (*/15,
+8-18/2), lists (1,15) and the names JAN-DEC and SUN-SAT; 0 and 7 are both
+Sunday. As in cron, when both day fields are restricted a day matching
+either one is enough. Times are the machine's local time.
+"""
+
+from datetime import datetime, timedelta
+from typing import Iterable, List, Optional, Set
+
+MONTH_NAMES = [
+    "JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"
+]
+DAY_NAMES = ["SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"]
+
+# Shortcuts accepted instead of five fields
+ALIASES = {
+    "@hourly": "0 * * * *",
+    "@daily": "0 0 * * *",
+    "@weekly": "0 0 * * SUN",
+    "@monthly": "0 0 1 * *",
+}
+
+# Far enough to reach any valid expression (Feb 29 on a given weekday
+# recurs within 28 years)
+_SEARCH_LIMIT = timedelta(days=366 * 28)
+
+
+def _parse_value(text: str, names: Optional[List[str]], offset: int) -> int:
+    upper = text.upper()
+    if names and upper in names:
+        return names.index(upper) + offset
+    if not text.isdigit():
+        raise ValueError(f"not a number: {text!r}")
+    return int(text)
+
+
+def _parse_field(
+    text: str, low: int, high: int, names: Optional[List[str]] = None, offset: int = 0
+) -> Set[int]:
+    """The values a cron field allows, within low..high"""
+    values: Set[int] = set()
+    for part in text.split(","):
+        part, _, step_text = part.partition("/")
+        step = int(step_text) if step_text.isdigit() else None
+        if step_text and not step:
+            raise ValueError(f"bad step in {text!r}")
+        if part == "*":
+            start, end = low, high
+        elif "-" in part:
+            start_text, end_text = part.split("-", 1)
+            start = _parse_value(start_text, names, offset)
+            end = _parse_value(end_text, names, offset)
+        else:
+            start = _parse_value(part, names, offset)
+            end = high if step else start
+        if not (low <= start <= high and low <= end <= high) or start > end:
+            raise ValueError(f"{part!r} is outside {low}-{high}")
+        values.update(range(start, end + 1, step or 1))
+    return values
+
+
+class CronSchedule:
+    """One cron expression, e.g. CronSchedule("0 7 * * MON-FRI")."""
+
+    def __init__(self, expression: str):
+        """
+        Raises:
+            ValueError: If the expression is not a valid cron expression
+        """
+        self.expression = expression.strip()
+        fields = ALIASES.get(self.expression.lower(), self.expression).split()
+        if len(fields) != 5:
+            raise ValueError(
+                f"Invalid schedule {expression!r}: expected 5 fields, got {len(fields)}"
+            )
+        try:
+            self.minutes = _parse_field(fields[0], 0, 59)
+            self.hours = _parse_field(fields[1], 0, 23)
+            self.days = _parse_field(fields[2], 1, 31)
+            self.months = _parse_field(fields[3], 1, 12, MONTH_NAMES, 1)
+            weekdays = _parse_field(fields[4], 0, 7, DAY_NAMES, 0)
+        except ValueError as e:
+            raise ValueError(f"Invalid schedule {expression!r}: {e}")
+        # Cron counts from Sunday = 0 (or 7), Python from Monday = 0
+        self.weekdays = {(day - 1) % 7 for day in weekdays}
+        self._any_day = fields[2] == "*"
+        self._any_weekday = fields[4] == "*"
+
+    def __repr__(self) -> str:
+        return f"CronSchedule({self.expression!r})"
+
+    def _day_matches(self, moment: datetime) -> bool:
+        in_days = moment.day in self.days
+        in_weekdays = moment.weekday() in self.weekdays
+        if self._any_day or self._any_weekday:
+            return in_days and in_weekdays
+        return in_days or in_weekdays
+
+    def next_after(self, moment: datetime) -> datetime:
+        """The first scheduled minute after moment."""
+        candidate = moment.replace(second=0, microsecond=0) + timedelta(minutes=1)
+        limit = candidate + _SEARCH_LIMIT
+        while candidate < limit:
+            if candidate.month not in self.months:
+                # Jump to the first day of the next month
+                candidate = (
+                    candidate.replace(day=1, hour=0, minute=0) + timedelta(days=32)
+                ).replace(day=1)
+                continue
+            if not self._day_matches(candidate):
+                candidate = candidate.replace(hour=0, minute=0) + timedelta(days=1)
+                continue
+            if candidate.hour not in self.hours:
+                candidate = candidate.replace(minute=0) + timedelta(hours=1)
+                continue
+            if candidate.minute not in self.minutes:
+                candidate += timedelta(minutes=1)
+                continue
+            return candidate
+        raise ValueError(f"Schedule {self.expression!r} never runs")
+
+
+def parse_schedules(expressions: Iterable[str]) -> List[CronSchedule]:
+    """
+    Parse several expressions.
+
+    Raises:
+        ValueError: If any of them is invalid
+    """
+    return [CronSchedule(expression) for expression in expressions]
+
+
+def next_run(
+    schedules: List[CronSchedule], moment: Optional[datetime] = None
+) -> datetime:
+    """The earliest time after moment (default: now) any schedule runs."""
+    moment = moment or datetime.now()
+    return min(schedule.next_after(moment) for schedule in schedules)
+
+
+def previous_run(
+    schedules: List[CronSchedule], moment: Optional[datetime] = None
+) -> datetime:
+    """The latest time before moment (default: now) any schedule ran."""
+    moment = moment or datetime.now()
+    lookback = timedelta(days=1)
+    while lookback <= _SEARCH_LIMIT:
+        latest = None
+        candidate = next_run(schedules, moment - lookback)
+        while candidate < moment:
+            latest = candidate
+            candidate = next_run(schedules, candidate)
+        if latest:
+            return latest
+        lookback *= 2
+    raise ValueError(
+        f"Schedules {', '.join(s.expression for s in schedules)} never ran"
+    )
@@ -0,0 +1,287 @@
+"""
+Schema drift detection for CSV data feeds.
+
+A vendor that adds, drops or renames a column in its daily export breaks
+whatever loads the file next, usually hours later and far from the cause.
+With schema.enabled, the header row of each downloaded CSV/TSV is compared
+with the one of the previous file of the same feed, and a change is
+reported at the door: in the run summary, on the event bus and, with
+schema.notify, through the notification webhook.
+
+A feed is a sender plus a filename pattern: digits in the name stand for
+any number, so sales_2024-06-01.csv and sales_2024-06-02.csv from the same
+sender are one feed ("sales_#-#-#.csv"). The header of each feed's newest
+file is kept in a small JSON file next to the manifest; a file from an
+older message than that (a backfill) is not compared.
+
+The same header row serves filters.required_columns: a CSV without the
+columns a feed needs (the "template.csv" a vendor attaches to every mail)
+is not saved at all.
+"""
+
+import csv
+import json
+import os
+import re
+from dataclasses import dataclass, field
+from datetime import datetime
+from pathlib import Path
+from typing import Dict, List, Optional, Tuple, Union
+
+from .manifest import ManifestError
+from .sniff import detect_delimiter
+
+# The columns last seen for each sender feed, beside MANIFEST_FILENAME
+SCHEMA_FILENAME = ".gmail_downloader_schemas.json"
+
+# Files whose header rows are compared, and their delimiter when the
+# contents do not show one (a single-column file)
+TABLE_EXTENSIONS = {".csv": ",", ".tsv": "\t", ".tab": "\t"}
+
+# Bytes read to find the header row
+HEADER_BYTES = 64 * 1024
+
+DIGITS = re.compile(r"\d+")
+
+
+def feed_pattern(filename: str) -> str:
+    """filename with each run of digits as "#", e.g. "sales_#-#-#.csv"."""
+    return DIGITS.sub("#", filename.lower())
+
+
+def feed_key(sender: str, filename: str) -> str:
+    """Key of the feed a file belongs to, e.g. "bi@acme.com/sales_#.csv"."""
+    return f"{sender.lower()}/{feed_pattern(filename)}"
+
+
+def read_header(
+    data: bytes, extension: str, limit: int = HEADER_BYTES
+) -> Optional[List[str]]:
+    """
+    The column names in the first row of a CSV/TSV file.
+
+    Only the first limit bytes are read.
+
+    Returns:
+        The names, or None if data has no header row to compare
+    """
+    try:
+        text = data[:limit].decode("utf-8-sig")
+    except UnicodeDecodeError:
+        text = data[:limit].decode("latin-1")
+    lines = text.splitlines()
+    if len(data) > limit:
+        lines = lines[:-1]  # Probably cut short
+    delimiter = detect_delimiter(lines) or TABLE_EXTENSIONS.get(extension)
+    if delimiter is None:
+        return None
+    for row in csv.reader(lines, delimiter=delimiter):
+        if any(column.strip() for column in row):
+            return [column.strip() for column in row]
+    return None
+
+
+def missing_columns(data: bytes, extension: str, required: List[str],
+                    limit: int = HEADER_BYTES) -> List[str]:
+    """
+    The required columns a CSV/TSV file's header row lacks, compared
+    case-insensitively.
+
+    Files that are not tables are not checked; a table without a header row
+    within the first limit bytes lacks every column.
+    """
+    if extension not in TABLE_EXTENSIONS or not required:
+        return []
+    columns = {column.lower() for column in read_header(data, extension, limit) or []}
+    return [column for column in required if column.strip().lower() not in columns]
+
+
+@dataclass
+class SchemaChange:
+    """How a file's columns differ from those of the previous file of its feed."""
+
+    sender: str
+    filename: str
+    path: str
+    pattern: str
+    previous_file: str
+    previous_columns: List[str]
+    columns: List[str]
+    added: List[str] = field(default_factory=list)
+    removed: List[str] = field(default_factory=list)
+    # (old name, new name): a column that changed name in place
+    renamed: List[Tuple[str, str]] = field(default_factory=list)
+    # The same columns in another order
+    reordered: bool = False
+
+    def describe(self) -> str:
+        """The change in a few words, e.g. "added: region; renamed: amt -> amount"."""
+        parts = []
+        if self.added:
+            parts.append(f"added: {', '.join(self.added)}")
+        if self.removed:
+            parts.append(f"removed: {', '.join(self.removed)}")
+        if self.renamed:
+            parts.append(
+                "renamed: " + ", ".join(f"{old} -> {new}" for old, new in self.renamed)
+            )
+        if self.reordered:
+            parts.append("columns reordered")
+        return "; ".join(parts)
+
+    def to_dict(self) -> Dict[str, object]:
+        """The change as JSON-ready data."""
+        return {
+            "sender": self.sender,
+            "filename": self.filename,
+            "path": self.path,
+            "pattern": self.pattern,
+            "previous_file": self.previous_file,
+            "added": self.added,
+            "removed": self.removed,
+            "renamed": [list(pair) for pair in self.renamed],
+            "reordered": self.reordered,
+            "change": self.describe(),
+        }
+
+
+def compare_columns(
+    previous: List[str], current: List[str]
+) -> Optional[Tuple[List[str], List[str], List[Tuple[str, str]], bool]]:
+    """
+    How current differs from previous: (added, removed, renamed, reordered).
+
+    A column missing from current whose position is taken by a column new
+    to it counts as renamed rather than removed and added. The columns in
+    both (renamed ones under their new name) are reordered if they are not
+    in the same order, whatever else changed.
+
+    Returns:
+        The differences, or None if the columns are the same
+    """
+    if previous == current:
+        return None
+
+    removed = [column for column in previous if column not in current]
+    added = [column for column in current if column not in previous]
+    renamed = []
+    for column in list(removed):
+        index = previous.index(column)
+        if index < len(current) and current[index] in added:
+            renamed.append((column, current[index]))
+            removed.remove(column)
+            added.remove(current[index])
+
+    names = dict(renamed)
+    kept = [names.get(column, column) for column in previous if column not in removed]
+    reordered = kept != [column for column in current if column not in added]
+    return added, removed, renamed, reordered
+
+
+def _older(date: str, than: str) -> bool:
+    """Whether ISO 8601 date is before than; False when either is unknown."""
+    try:
+        return datetime.fromisoformat(date) < datetime.fromisoformat(than)
+    except (ValueError, TypeError):
+        return False
+
+
+class SchemaHistory:
+    """The last header row seen of each feed downloaded into one directory."""
+
+    def __init__(self, directory: Union[str, Path]):
+        self.path = Path(directory) / SCHEMA_FILENAME
+        self._feeds: Dict[str, Dict[str, object]] = {}
+        # Whether check changed a header since the last save
+        self.changed = False
+
+    def load(self) -> "SchemaHistory":
+        """
+        Read the known headers; a missing file means none yet.
+
+        Raises:
+            ManifestError: If the file exists but cannot be parsed
+        """
+        self._feeds = {}
+        if not self.path.exists():
+            return self
+        try:
+            self._feeds = json.loads(self.path.read_text(encoding="utf-8"))["feeds"]
+        except (OSError, ValueError, KeyError, TypeError) as e:
+            raise ManifestError(f"Cannot read {self.path}: {e}")
+        return self
+
+    def columns(self, key: str) -> Optional[List[str]]:
+        """The last header row of a feed, if one was seen."""
+        feed = self._feeds.get(key)
+        return list(feed["columns"]) if feed else None
+
+    def check(self, sender: str, filename: str, path: str, data: bytes,
+              extension: str, date: str = "") -> Optional[SchemaChange]:
+        """
+        Compare a downloaded file's header with the last one of its feed,
+        and remember it for the next file. The headers are written by save,
+        once per run.
+
+        Args:
+            sender: Who sent the file
+            filename: Name the file was sent with
+            path: Where it was saved, for messages
+            data: The file
+            extension: Its extension (or the detected one), e.g. ".csv"
+            date: When its message was sent (ISO 8601), if known
+
+        Returns:
+            The change, or None if the columns are the same, the feed is
+            new, the file is older than the feed's last one or not a table
+        """
+        if extension not in TABLE_EXTENSIONS:
+            return None
+        columns = read_header(data, extension)
+        if columns is None:
+            return None
+
+        key = feed_key(sender, filename)
+        previous = self._feeds.get(key)
+        if previous is not None and _older(date, str(previous.get("date", ""))):
+            return None
+        self._feeds[key] = {
+            "columns": columns,
+            "file": path,
+            "date": date,
+            "seen_at": datetime.now().isoformat(),
+        }
+        self.changed = True
+
+        if previous is None:
+            return None
+        differences = compare_columns(list(previous["columns"]), columns)
+        if differences is None:
+            return None
+        added, removed, renamed, reordered = differences
+        return SchemaChange(
+            sender=sender,
+            filename=filename,
+            path=path,
+            pattern=feed_pattern(filename),
+            previous_file=str(previous.get("file", "")),
+            previous_columns=list(previous["columns"]),
+            columns=columns,
+            added=added,
+            removed=removed,
+            renamed=renamed,
+            reordered=reordered,
+        )
+
+    def save(self) -> None:
+        """Write the headers atomically, like the manifest."""
+        temp_path = self.path.with_suffix(".tmp")
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+            temp_path.write_text(
+                json.dumps({"feeds": self._feeds}, indent=2), encoding="utf-8"
+            )
+            os.replace(temp_path, self.path)
+        except OSError as e:
+            raise ManifestError(f"Cannot write {self.path}: {e}")
+        self.changed = False
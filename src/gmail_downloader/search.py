@@ -0,0 +1,300 @@
+"""
+Full-text search over the downloaded attachments.
+
+Months of feeds pile up quickly, and "which file mentions order 4812?" is
+hard to answer with grep alone: PDFs are binary, and who sent a file is in
+the manifest, not in the file. The index command builds a local full-text
+index of every manifest entry:
+
+- its filename, sender, subject, date and labels,
+- the column names of CSV/TSV files and the text of text files,
+- the text of PDFs, from their .txt sidecar (transforms.pdf_text) or, with
+  pypdf installed, read from the PDF itself.
+
+The index is an SQLite FTS5 database next to the manifest, so it needs
+nothing beyond Python. Indexing again only reads files that are new or
+changed since, and drops those no longer in the manifest. The search
+command queries it with FTS5 syntax ("order 4812", "sender:acme",
+"invoice NOT draft"); a query that is not valid FTS5 is searched for word
+by word instead.
+"""
+
+import logging
+import sqlite3
+from dataclasses import asdict, dataclass
+from pathlib import Path
+from typing import Any, Dict, Iterable, List, Optional, Tuple, Union
+
+from .manifest import ManifestEntry
+from .schema import TABLE_EXTENSIONS, read_header
+from .transforms import PDF_EXTENSIONS, TEXT_SUFFIX, pdf_text
+
+logger = logging.getLogger(__name__)
+
+# SQLite full-text index of the downloaded files, kept up to date by the index command
+INDEX_FILENAME = ".gmail_downloader_index.sqlite"
+
+# Files whose contents are indexed as they are
+TEXT_EXTENSIONS = {
+    ".txt", ".md", ".log", ".json", ".xml", ".html", ".htm", ".eml", ".ics"
+} | set(TABLE_EXTENSIONS)
+
+# How much text of one file is indexed; the start of a large export is
+# enough to find it
+TEXT_BYTES = 1024 * 1024
+
+# Pages read of a PDF without a text sidecar; more rarely fit in TEXT_BYTES
+PDF_PAGES = 200
+
+# The searchable fields of a file, in FTS5 column order
+FIELDS = ("filename", "sender", "subject", "date", "labels", "columns", "content")
+
+
+class SearchIndexError(Exception):
+    """Raised when the search index cannot be read, written or queried."""
+
+    pass
+
+
+@dataclass
+class SearchHit:
+    """A file matching a search."""
+
+    path: str
+    filename: str
+    sender: str
+    subject: str
+    date: str
+
+    # Where it matched, with the matching words between the markers
+    snippet: str
+
+    def to_dict(self) -> Dict[str, Any]:
+        return asdict(self)
+
+
+def _read_text(path: Path, limit: int = TEXT_BYTES) -> str:
+    with open(path, "rb") as f:
+        data = f.read(limit)
+    try:
+        return data.decode("utf-8-sig")
+    except UnicodeDecodeError:
+        return data.decode("latin-1")
+
+
+def file_text(
+    path: Path, max_bytes: int = TEXT_BYTES, max_pages: int = PDF_PAGES
+) -> Tuple[str, str]:
+    """
+    What is indexed of the saved file at path.
+
+    A PDF without a text sidecar is read up to max_pages; one pypdf cannot
+    read is indexed without its text.
+
+    Returns:
+        Its column names (for CSV/TSV files) and its text, "" for what it
+        has none of or what cannot be read
+    """
+    extension = path.suffix.lower()
+    columns, text = "", ""
+    try:
+        if extension in PDF_EXTENSIONS:
+            sidecar = path.with_name(path.name + TEXT_SUFFIX)
+            if sidecar.exists():
+                text = _read_text(sidecar, max_bytes)
+            else:
+                try:
+                    text = pdf_text(path, max_pages)[:max_bytes]
+                except Exception as e:
+                    # pypdf raises its own errors, and others, on damaged PDFs
+                    logger.debug(f"Not indexing the text of {path.name}: {e}")
+        elif extension in TEXT_EXTENSIONS:
+            text = _read_text(path, max_bytes)
+            if extension in TABLE_EXTENSIONS:
+                columns = " ".join(read_header(text.encode("utf-8"), extension) or [])
+    except OSError as e:
+        logger.warning(f"Cannot read {path} for the search index: {e}")
+    return columns, text
+
+
+def fallback_query(query: str) -> str:
+    """query as FTS5 phrases, one per word, for queries that are not valid FTS5."""
+    return " ".join('"' + word.replace('"', '""') + '"' for word in query.split())
+
+
+class SearchIndex:
+    """The full-text index of the files in one manifest directory."""
+
+    def __init__(self, directory: Union[str, Path]):
+        self.path = Path(directory) / INDEX_FILENAME
+
+    def exists(self) -> bool:
+        return self.path.exists()
+
+    def connect(self) -> sqlite3.Connection:
+        """
+        Open the index, creating its tables if needed.
+
+        Raises:
+            SearchIndexError: If it cannot be opened
+        """
+        try:
+            self.path.parent.mkdir(parents=True, exist_ok=True)
+            connection = sqlite3.connect(self.path)
+            connection.execute(
+                "CREATE VIRTUAL TABLE IF NOT EXISTS documents USING fts5(path "
+                f"UNINDEXED, {', '.join(FIELDS)})"
+            )
+            # What each path was indexed from, to skip files that did not change
+            connection.execute(
+                "CREATE TABLE IF NOT EXISTS sources (path "
+                "TEXT PRIMARY KEY, version TEXT NOT NULL)"
+            )
+        except sqlite3.Error as e:
+            raise SearchIndexError(f"Cannot open search index {self.path}: {e}")
+        return connection
+
+    @staticmethod
+    def version(entry: ManifestEntry, path: Optional[Path]) -> str:
+        """What changes when the indexed file or its text sidecar does."""
+        parts = [entry.sha256, entry.subject, ",".join(entry.labels)]
+        if path is not None:
+            sidecar = path.with_name(path.name + TEXT_SUFFIX)
+            if sidecar.exists():
+                parts.append(str(sidecar.stat().st_mtime_ns))
+        return "|".join(parts)
+
+    def update(self, entries: Iterable[ManifestEntry], base_dir: Optional[Path],
+               rebuild: bool = False) -> Tuple[int, int, int]:
+        """
+        Bring the index up to date with the manifest entries.
+
+        base_dir is where the files are saved; None (remote storage) indexes
+        only what the manifest says about them. Encrypted and quarantined
+        files are indexed the same way.
+
+        Returns:
+            How many files were indexed, removed, and are in the index
+
+        Raises:
+            SearchIndexError: If the index cannot be written
+        """
+        connection = self.connect()
+        indexed = removed = 0
+        try:
+            with connection:
+                if rebuild:
+                    connection.execute("DELETE FROM documents")
+                    connection.execute("DELETE FROM sources")
+                known = dict(connection.execute("SELECT path, version FROM sources"))
+                current = set()
+                for entry in entries:
+                    current.add(entry.path)
+                    path = None
+                    if (
+                        base_dir is not None
+                        and not entry.encrypted
+                        and not entry.quarantine
+                    ):
+                        path = base_dir / entry.path
+                    version = self.version(entry, path)
+                    if known.get(entry.path) == version:
+                        continue
+                    columns, text = (
+                        file_text(path)
+                        if path is not None and path.exists()
+                        else ("", "")
+                    )
+                    connection.execute(
+                        "DELETE FROM documents WHERE path = ?", (entry.path,)
+                    )
+                    connection.execute(
+                        f"INSERT INTO documents (path, {', '.join(FIELDS)}) VALUES "
+                        f"(?{', ?' * len(FIELDS)})",
+                        (
+                            entry.path,
+                            entry.filename,
+                            f"{entry.sender_name} {entry.sender}".strip(),
+                            entry.subject,
+                            entry.date,
+                            " ".join(entry.labels),
+                            columns,
+                            text,
+                        ),
+                    )
+                    connection.execute(
+                        "INSERT OR REPLACE INTO sources VALUES (?, ?)",
+                        (entry.path, version),
+                    )
+                    indexed += 1
+
+                for path in set(known) - current:
+                    connection.execute("DELETE FROM documents WHERE path = ?", (path,))
+                    connection.execute("DELETE FROM sources WHERE path = ?", (path,))
+                    removed += 1
+                total = connection.execute("SELECT COUNT(*) FROM sources").fetchone()[0]
+        except sqlite3.Error as e:
+            raise SearchIndexError(f"Cannot update search index {self.path}: {e}")
+        finally:
+            connection.close()
+        return indexed, removed, total
+
+    def remove(self, paths: Iterable[str]) -> int:
+        """
+        Drop files from the index, e.g. ones clean removed.
+
+        Returns:
+            How many of them were in it
+
+        Raises:
+            SearchIndexError: If the index cannot be written
+        """
+        connection = self.connect()
+        removed = 0
+        try:
+            with connection:
+                for path in paths:
+                    connection.execute("DELETE FROM documents WHERE path = ?", (path,))
+                    removed += connection.execute(
+                        "DELETE FROM sources WHERE path = ?", (path,)
+                    ).rowcount
+        except sqlite3.Error as e:
+            raise SearchIndexError(f"Cannot update search index {self.path}: {e}")
+        finally:
+            connection.close()
+        return removed
+
+    def search(
+        self, query: str, limit: int = 20, markers: Tuple[str, str] = ("**", "**")
+    ) -> List[SearchHit]:
+        """
+        The files matching query, best match first.
+
+        Raises:
+            SearchIndexError: If there is no index yet or it cannot be read
+        """
+        if not self.exists():
+            raise SearchIndexError(
+                f"No search index in {self.path.parent}; "
+                "run gmail-downloader index first"
+            )
+        connection = self.connect()
+        sql = (
+            "SELECT path, filename, sender, subject, "
+            "date, snippet(documents, -1, ?, ?, '…', 12) "
+            "FROM documents WHERE documents MATCH ? ORDER BY rank LIMIT ?"
+        )
+        try:
+            try:
+                rows = connection.execute(sql, (*markers, query, limit)).fetchall()
+            except sqlite3.OperationalError as e:
+                if "syntax error" not in str(e) and "no such column" not in str(e):
+                    raise
+                rows = connection.execute(
+                    sql, (*markers, fallback_query(query), limit)
+                ).fetchall()
+        except sqlite3.Error as e:
+            raise SearchIndexError(f"Cannot search {self.path}: {e}")
+        finally:
+            connection.close()
+        return [SearchHit(*row) for row in rows]
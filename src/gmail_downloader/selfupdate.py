@@ -0,0 +1,263 @@
+"""
+Updating a standalone build of the downloader in place.
+
+Headless boxes often run the single-file build from the GitHub releases
+page, with no package manager to keep it current. `gmail-downloader update`
+looks up the latest release, downloads the build for this platform, checks
+it against the release's SHA256SUMS and swaps it in for the running file.
+SHA256SUMS itself must carry a valid Ed25519 signature (SHA256SUMS.sig)
+made with the release key pinned in the package (release_key.pem, or the
+key given with --public-key), so a compromised release page cannot pass
+off a build of its own.
+
+Installs made with pip are left to pip: update only reports the new version
+and the command to upgrade with.
+"""
+
+import hashlib
+import json
+import os
+import platform
+import re
+import sys
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import Callable, Dict, Optional, Tuple
+
+# GitHub repository the releases are published in
+RELEASE_REPO = "FarhadManiCodes/gmail-attachment-downloader"
+LATEST_RELEASE_URL = f"https://api.github.com/repos/{RELEASE_REPO}/releases/latest"
+
+# Checksum file every release carries, and its detached signature
+CHECKSUMS_ASSET = "SHA256SUMS"
+SIGNATURE_ASSET = "SHA256SUMS.sig"
+
+# The public key releases are signed with, packaged with the build
+RELEASE_KEY_FILE = Path(__file__).with_name("release_key.pem")
+
+# Fetches a URL and returns the response body
+Fetch = Callable[[str], bytes]
+
+
+class UpdateError(Exception):
+    """Raised when the latest release cannot be found, verified or installed."""
+
+    pass
+
+
+@dataclass
+class Release:
+    """A published release: its version and downloadable files by name."""
+
+    version: str
+    assets: Dict[str, str] = field(default_factory=dict)
+    url: str = ""
+
+    @classmethod
+    def from_github(cls, data: Dict) -> "Release":
+        """Read a release from the GitHub API's JSON."""
+        return cls(
+            version=str(data.get("tag_name") or "").lstrip("v"),
+            assets={
+                asset["name"]: asset["browser_download_url"]
+                for asset in data.get("assets") or []
+            },
+            url=data.get("html_url") or "",
+        )
+
+
+def parse_version(version: str) -> Tuple[int, ...]:
+    """
+    A version as numbers for comparing, e.g. "v1.10.2" -> (1, 10, 2).
+
+    Anything after the numbers (a pre-release suffix) is ignored.
+    """
+    match = re.match(r'^v?(\d+(?:\.\d+)*)', version.strip())
+    if not match:
+        raise UpdateError(f"Not a version number: {version}")
+    return tuple(int(part) for part in match.group(1).split("."))
+
+
+def is_newer(latest: str, current: str) -> bool:
+    """Whether latest is a later version than current."""
+    return parse_version(latest) > parse_version(current)
+
+
+def is_standalone() -> bool:
+    """Whether this is a single-file build (PyInstaller) rather than a pip install."""
+    return bool(getattr(sys, "frozen", False))
+
+
+def asset_name(system: Optional[str] = None, machine: Optional[str] = None) -> str:
+    """
+    The release file built for a platform, e.g. gmail-downloader-linux-x86_64.
+
+    Defaults to the platform this runs on.
+    """
+    system = (system or platform.system()).lower()
+    system = {"darwin": "macos"}.get(system, system)
+    machine = (machine or platform.machine()).lower()
+    machine = {"amd64": "x86_64", "aarch64": "arm64"}.get(machine, machine)
+    return f"gmail-downloader-{system}-{machine}" + (
+        ".exe" if system == "windows" else ""
+    )
+
+
+def parse_checksums(text: str) -> Dict[str, str]:
+    """Filename -> SHA-256 from a SHA256SUMS file (sha256sum output)."""
+    checksums = {}
+    for line in text.splitlines():
+        parts = line.strip().split(None, 1)
+        if len(parts) == 2:
+            checksums[parts[1].lstrip("*")] = parts[0].lower()
+    return checksums
+
+
+def verify_signature(data: bytes, signature: bytes, public_key_pem: bytes) -> None:
+    """
+    Check an Ed25519 signature over data.
+
+    Raises:
+        UpdateError: If the signature does not match, or the cryptography
+            package (the [secrets] extra) is missing
+    """
+    try:
+        from cryptography.exceptions import InvalidSignature
+        from cryptography.hazmat.primitives.asymmetric.ed25519 import Ed25519PublicKey
+        from cryptography.hazmat.primitives.serialization import load_pem_public_key
+    except ImportError:
+        raise UpdateError(
+            "Checking signatures needs cryptography: pip install "
+            "'gmail-attachment-downloader[secrets]'"
+        )
+    try:
+        key = load_pem_public_key(public_key_pem)
+    except ValueError as e:
+        raise UpdateError(f"Cannot read the public key: {e}")
+    if not isinstance(key, Ed25519PublicKey):
+        raise UpdateError("The public key must be an Ed25519 key")
+    try:
+        key.verify(signature, data)
+    except InvalidSignature:
+        raise UpdateError(f"{CHECKSUMS_ASSET} is not signed by the given key")
+
+
+def release_key() -> bytes:
+    """
+    The pinned public key of the releases.
+
+    Raises:
+        UpdateError: If this build has no release key packaged
+    """
+    try:
+        return RELEASE_KEY_FILE.read_bytes()
+    except OSError:
+        raise UpdateError(
+            f"This build has no release key ({RELEASE_KEY_FILE.name}) to check "
+            f"{SIGNATURE_ASSET} with; "
+            "pass the key with --public-key"
+        )
+
+
+def latest_release(fetch: Fetch) -> Release:
+    """
+    The latest published release.
+
+    Raises:
+        UpdateError: If GitHub cannot be reached or answers nonsense
+    """
+    try:
+        return Release.from_github(json.loads(fetch(LATEST_RELEASE_URL)))
+    except (OSError, ValueError, KeyError, TypeError) as e:
+        raise UpdateError(f"Cannot look up the latest release: {e}")
+
+
+def download_verified(
+    release: Release, fetch: Fetch, public_key_pem: Optional[bytes] = None
+) -> bytes:
+    """
+    This platform's build of release, checked against its SHA256SUMS and
+    their signature by public_key_pem (the pinned release key by default).
+
+    Raises:
+        UpdateError: If the release has no build for this platform, no
+            checksum or valid signature for it, or the download does not
+            match
+    """
+    name = asset_name()
+    if name not in release.assets:
+        raise UpdateError(
+            f"Release {release.version} has no build for this platform ({name})"
+        )
+    if CHECKSUMS_ASSET not in release.assets:
+        raise UpdateError(
+            f"Release {release.version} has no {CHECKSUMS_ASSET}; "
+            "not installing an unverified build"
+        )
+
+    try:
+        checksums_data = fetch(release.assets[CHECKSUMS_ASSET])
+        if SIGNATURE_ASSET not in release.assets:
+            raise UpdateError(
+                f"Release {release.version} is not signed ({SIGNATURE_ASSET} missing)"
+            )
+        verify_signature(
+            checksums_data,
+            fetch(release.assets[SIGNATURE_ASSET]),
+            public_key_pem or release_key(),
+        )
+        expected = parse_checksums(
+            checksums_data.decode("utf-8", errors="replace")
+        ).get(name)
+        if not expected:
+            raise UpdateError(
+                f"{CHECKSUMS_ASSET} of release {release.version} does not list {name}"
+            )
+        data = fetch(release.assets[name])
+    except OSError as e:
+        raise UpdateError(f"Cannot download release {release.version}: {e}")
+
+    actual = hashlib.sha256(data).hexdigest()
+    if actual != expected:
+        raise UpdateError(
+            f"Checksum mismatch for {name}: expected {expected}, got {actual}"
+        )
+    return data
+
+
+def replace_executable(data: bytes, executable: Optional[Path] = None) -> Path:
+    """
+    Swap data in for the running executable.
+
+    The new file is written next to it and moved over it, so a failure
+    leaves the old build in place. Windows cannot overwrite a running
+    program, so there the old one is moved aside to <name>.old first,
+    and moved back if the new one cannot take its place.
+
+    Raises:
+        UpdateError: If the file cannot be written, e.g. for lack of
+            permission
+    """
+    target = Path(executable or sys.executable).resolve()
+    temp_path = target.with_name(f".{target.name}.update")
+    old_path = target.with_name(target.name + ".old")
+    moved_aside = False
+    try:
+        temp_path.write_bytes(data)
+        os.chmod(temp_path, target.stat().st_mode | 0o111)
+        if sys.platform == "win32":
+            os.replace(target, old_path)
+            moved_aside = True
+        os.replace(temp_path, target)
+    except OSError as e:
+        temp_path.unlink(missing_ok=True)
+        if moved_aside:
+            try:
+                os.replace(old_path, target)
+            except OSError as restore_error:
+                raise UpdateError(
+                    f"Cannot replace {target}: {e}; the old build is left at "
+                    f"{old_path}: {restore_error}"
+                )
+        raise UpdateError(f"Cannot replace {target}: {e}")
+    return target
@@ -0,0 +1,99 @@
+"""
+Splitting one large download across several processes or machines.
+
+`--shard 2/4` makes a run do the second of four disjoint parts of the work,
+so four machines can share a backfill without two of them downloading the
+same file. No coordination is needed: every shard computes the same split
+from the same search, and each keeps only its own part.
+
+The split is by sender (each address belongs to exactly one shard, so a
+sender's files all land in the same place) or by date (each day belongs to
+one shard; a backfill hands out whole time slices instead). Where senders
+are named in the filters they are split before searching, so a shard only
+asks Gmail about its own senders; otherwise the search is the same for
+every shard and the split happens on its results.
+
+The shards share no state: there is no common database in which they claim
+work, so each needs its own --output (its own manifest, checkpoints and run
+lock). Shards given the same --output take turns on its run lock and so run
+one after another, not in parallel. A retry of a shard's failures keeps to
+the shard (see main._retry_options).
+"""
+
+import hashlib
+import re
+from dataclasses import dataclass
+from datetime import date
+from typing import List, Sequence, TypeVar
+
+from .downloader import PlannedDownload
+from .utils import extract_email_address
+
+# What --shard-by can split the work on
+SHARD_KEYS = ["sender", "date"]
+
+T = TypeVar("T")
+
+
+@dataclass(frozen=True)
+class Shard:
+    """Part index of count (1-based), split by key."""
+
+    index: int
+    count: int
+    key: str = "sender"
+
+    def __str__(self) -> str:
+        return f"{self.index}/{self.count} by {self.key}"
+
+    def owns(self, value: str) -> bool:
+        """
+        Whether value (a sender address or a day) falls to this shard.
+
+        A hash rather than Python's hash(), which changes between processes.
+        """
+        digest = hashlib.sha256(value.strip().lower().encode("utf-8")).digest()
+        return int.from_bytes(digest[:8], "big") % self.count == self.index - 1
+
+    def owns_sender(self, sender: str) -> bool:
+        """Whether mail from sender falls to this shard."""
+        return self.owns(extract_email_address(sender) or sender)
+
+    def owns_day(self, day: date) -> bool:
+        """Whether mail from day falls to this shard."""
+        return self.owns(day.isoformat())
+
+    def split(self, items: Sequence[T]) -> List[T]:
+        """This shard's share of items handed out in turn, e.g. backfill slices."""
+        return [
+            item
+            for position, item in enumerate(items)
+            if position % self.count == self.index - 1
+        ]
+
+    def select(self, planned: List[PlannedDownload]) -> List[PlannedDownload]:
+        """The planned downloads that fall to this shard."""
+        if self.key == "date":
+            return [item for item in planned if self.owns_day(item.message.date.date())]
+        return [item for item in planned if self.owns_sender(item.message.sender)]
+
+
+def parse_shard(shard_string: str, key: str = "sender") -> Shard:
+    """
+    Parse --shard ("2/4": the second of four parts) and --shard-by.
+
+    Raises:
+        ValueError: If it is not K/N with 1 <= K <= N, or key is not one
+            of SHARD_KEYS
+    """
+    match = re.match(r'^\s*(\d+)\s*/\s*(\d+)\s*$', str(shard_string))
+    if not match:
+        raise ValueError(f"Invalid shard: {shard_string}. Use K/N, e.g. 2/4")
+    index, count = int(match.group(1)), int(match.group(2))
+    if not 1 <= index <= count:
+        raise ValueError(f"Invalid shard: {shard_string}. K must be between 1 and N")
+    if key not in SHARD_KEYS:
+        raise ValueError(
+            f"Invalid shard key: {key}. Use one of: {', '.join(SHARD_KEYS)}"
+        )
+    return Shard(index, count, key)
@@ -0,0 +1,185 @@
+"""
+Recognising what an attachment is from its contents.
+
+Vendors do not always name files for what they are: CSV exports arrive as
+export.dat, workbooks as report.tmp. With download.fix_extensions set, the
+bytes of each download are checked before it is saved, and a file whose
+name does not match its contents gets the right extension, so pipelines
+that pick files up by glob (*.csv, *.xlsx) find it:
+
+    fix_extensions: append    # export.dat -> export.dat.csv
+    fix_extensions: replace   # export.dat -> export.csv
+
+Binary formats are recognised by their magic bytes; ZIP-based Office and
+OpenDocument files by the members inside. Text is JSON if it parses as
+JSON, and CSV (or TSV) if its first lines split into the same number of
+fields. Anything else, including old binary Office files (.xls, .doc,
+which cannot be told apart reliably), is saved under its own name.
+"""
+
+import csv
+import io
+import json
+import zipfile
+from pathlib import Path
+from typing import List, Optional
+
+# Leading bytes of binary formats, and the extension they get
+MAGIC_NUMBERS = [
+    (b"%PDF-", ".pdf"),
+    (b"\x89PNG\r\n\x1a\n", ".png"),
+    (b"\xff\xd8\xff", ".jpg"),
+    (b"GIF87a", ".gif"),
+    (b"GIF89a", ".gif"),
+    (b"II*\x00", ".tif"),
+    (b"MM\x00*", ".tif"),
+    (b"\x1f\x8b", ".gz"),
+    (b"7z\xbc\xaf\x27\x1c", ".7z"),
+    (b"Rar!\x1a\x07", ".rar"),
+    (b"PAR1", ".parquet"),
+    (b"{\\rtf", ".rtf"),
+]
+
+# ZIP-based formats, recognised by a member folder or the mimetype member
+OFFICE_FOLDERS = {"xl/": ".xlsx", "word/": ".docx", "ppt/": ".pptx"}
+OPENDOCUMENT_TYPES = {
+    "application/vnd.oasis.opendocument.spreadsheet": ".ods",
+    "application/vnd.oasis.opendocument.text": ".odt",
+    "application/vnd.oasis.opendocument.presentation": ".odp",
+}
+
+# Names that already fit a detected type, besides the type itself
+EQUIVALENT_EXTENSIONS = {
+    ".jpg": {".jpeg", ".jpe"},
+    ".tif": {".tiff"},
+    ".gz": {".tgz"},
+    ".xlsx": {".xlsm", ".xltx", ".xltm"},
+    ".docx": {".docm", ".dotx", ".dotm"},
+    ".pptx": {".pptm", ".potx", ".ppsx"},
+    ".zip": {".jar", ".war", ".apk", ".epub", ".whl", ".kmz", ".xpi", ".nupkg"},
+    ".tsv": {".tab"},
+    ".json": {".geojson"},
+}
+
+# Text files are often CSV- or JSON-shaped; their names are left alone
+TEXT_EXTENSIONS = {
+    ".txt", ".text", ".log", ".md", ".csv", ".tsv", ".tab", ".json", ".jsonl",
+    ".ndjson", ".xml", ".html", ".htm", ".yaml", ".yml", ".ini", ".cfg", ".sql", ".psv",
+}
+TEXT_TYPES = {".csv", ".tsv", ".json"}
+
+# How much of a text file the CSV check looks at
+SNIFF_BYTES = 64 * 1024
+SNIFF_LINES = 50
+
+# Field delimiters of CSV-like text, most specific first
+DELIMITERS = ["\t", ",", ";", "|"]
+
+
+def _sniff_zip(data: bytes) -> Optional[str]:
+    try:
+        with zipfile.ZipFile(io.BytesIO(data)) as archive:
+            names = archive.namelist()
+            if "mimetype" in names:
+                mimetype = archive.read("mimetype").decode("ascii", "replace").strip()
+                if mimetype in OPENDOCUMENT_TYPES:
+                    return OPENDOCUMENT_TYPES[mimetype]
+    except (zipfile.BadZipFile, RuntimeError, ValueError):
+        return None
+
+    if "[Content_Types].xml" in names:
+        for folder, extension in OFFICE_FOLDERS.items():
+            if any(name.startswith(folder) for name in names):
+                return extension
+    return ".zip"
+
+
+def _sniff_text(data: bytes) -> Optional[str]:
+    sample = data[:SNIFF_BYTES]
+    if b"\x00" in sample:
+        return None
+    try:
+        text = sample.decode("utf-8-sig")
+    except UnicodeDecodeError as e:
+        # A multi-byte character cut off at the end of the sample is fine
+        if len(data) <= SNIFF_BYTES or e.start < len(sample) - 3:
+            return None
+        text = sample[:e.start].decode("utf-8-sig")
+
+    stripped = text.strip()
+    if stripped[:1] in ("{", "[") and len(data) <= SNIFF_BYTES:
+        try:
+            json.loads(stripped)
+            return ".json"
+        except ValueError:
+            pass
+
+    lines = [line for line in text.splitlines() if line.strip()]
+    if len(data) > SNIFF_BYTES:
+        lines = lines[:-1]  # Probably cut off
+    delimiter = detect_delimiter(lines)
+    if delimiter is None:
+        return None
+    return ".tsv" if delimiter == "\t" else ".csv"
+
+
+def detect_delimiter(lines: List[str]) -> Optional[str]:
+    """
+    The delimiter that splits the first lines of a table into the same
+    number of fields (at least two), trying tab, comma, semicolon and pipe.
+
+    Returns:
+        The delimiter, or None if the lines do not look like a table
+    """
+    lines = [line for line in lines if line.strip()][:SNIFF_LINES]
+    if len(lines) < 2:
+        return None
+    for delimiter in DELIMITERS:
+        widths = {len(row) for row in csv.reader(lines, delimiter=delimiter)}
+        if len(widths) == 1 and widths.pop() >= 2:
+            return delimiter
+    return None
+
+
+def sniff_extension(data: bytes) -> Optional[str]:
+    """
+    The extension data's contents call for, e.g. ".csv".
+
+    Returns:
+        The extension with its dot, or None when the format is not recognised
+    """
+    for magic, extension in MAGIC_NUMBERS:
+        if data.startswith(magic):
+            return extension
+    if data.startswith(b"PK\x03\x04"):
+        return _sniff_zip(data)
+    return _sniff_text(data)
+
+
+def detect_extension(filename: str, data: bytes) -> str:
+    """
+    The extension filename should have instead, judging by data.
+
+    Returns:
+        The detected extension, or "" when the name already fits (or the
+        contents are not recognised)
+    """
+    detected = sniff_extension(data)
+    suffix = Path(filename).suffix.lower()
+    if (
+        detected is None
+        or suffix == detected
+        or suffix in EQUIVALENT_EXTENSIONS.get(detected, ())
+    ):
+        return ""
+    if detected in TEXT_TYPES and suffix in TEXT_EXTENSIONS:
+        return ""
+    return detected
+
+
+def fixed_filename(filename: str, extension: str, mode: str) -> str:
+    """filename with extension appended ("append") or replacing its own ("replace")."""
+    suffix = Path(filename).suffix
+    if mode == "replace" and suffix:
+        return filename[:-len(suffix)] + extension
+    return filename + extension
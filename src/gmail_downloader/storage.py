@@ -0,0 +1,839 @@
+"""
+Storage backends for saved attachments.
+
+The downloader decides *where* inside the download location a file belongs
+(sender folder, date folder, ...). A Storage backend decides what "saving a
+file there" means: writing to local disk, uploading straight to an object
+storage bucket, or pushing to an on-prem file drop.
+
+Locations are given as ``download.base_dir``:
+
+    ./downloads                 local directory
+    s3://bucket/prefix          Amazon S3
+    gs://bucket/prefix          Google Cloud Storage
+    az://account/container/pfx  Azure Blob Storage
+    sftp://user@host:22/path    SFTP server (absolute path)
+    webdav://host/path          WebDAV over HTTP (webdavs:// for HTTPS)
+
+Cloud credentials come from each SDK's standard chain (environment
+variables, shared config files, instance metadata), so nothing secret has to
+live in our config file. SFTP and WebDAV logins come from the ``storage``
+config section. The SDKs are optional dependencies and are only imported
+when a remote URL is actually used.
+
+This module demonstrates:
+- An abstract base class as an extension point
+- Lazy imports for optional dependencies
+- Running blocking SDK calls in a thread so the event loop stays responsive
+- Verifying uploads against the backend's own size and checksum
+- Store-and-forward: spooling to local disk while a remote is unreachable
+"""
+
+import asyncio
+import base64
+import errno
+import hashlib
+import io
+import logging
+import os
+import posixpath
+import re
+import threading
+import urllib.error
+import urllib.parse
+import urllib.request
+from abc import ABC, abstractmethod
+from pathlib import Path
+from typing import TYPE_CHECKING, Any, Dict, List, Optional, Tuple, Type, Union
+
+import aiofiles
+
+from .utils import ensure_directory, long_path
+
+if TYPE_CHECKING:
+    from .config import StorageConfig
+
+logger = logging.getLogger(__name__)
+
+# Where a file lives: a Path for local storage, a URL string for remote storage
+Location = Union[Path, str]
+
+
+class StorageError(Exception):
+    """Raised when a storage backend cannot be created or used."""
+
+    pass
+
+
+def is_remote_url(location: str) -> bool:
+    """Check whether a download location is a remote URL rather than a directory."""
+    return "://" in str(location)
+
+
+def parse_storage_url(url: str) -> Tuple[str, str, str]:
+    """
+    Split a storage URL into scheme, bucket and key prefix.
+
+    For Azure the "bucket" is ``account/container``; for SFTP and WebDAV it
+    is the server (``user@host:port``).
+
+    Examples:
+        >>> parse_storage_url("s3://my-bucket/mail/attachments/")
+        ('s3', 'my-bucket', 'mail/attachments')
+
+    Raises:
+        StorageError: If the URL has no bucket
+    """
+    scheme, _, rest = url.partition("://")
+    scheme = scheme.lower()
+    parts = [part for part in rest.split("/") if part]
+
+    bucket_parts = 2 if scheme == "az" else 1
+    if len(parts) < bucket_parts:
+        raise StorageError(f"Storage URL is missing a bucket: {url}")
+
+    bucket = "/".join(parts[:bucket_parts])
+    prefix = "/".join(parts[bucket_parts:])
+    return scheme, bucket, prefix
+
+
+class Storage(ABC):
+    """
+    Where downloaded attachments are written.
+
+    Backends address files by *key*: a relative, forward-slash path such as
+    ``reports/invoice.pdf``. This is also what the manifest records.
+    """
+
+    @abstractmethod
+    def locate(self, key: str) -> Location:
+        """Full location of a key, for display and for download listeners."""
+
+    @abstractmethod
+    def key_for(self, location: Location) -> str:
+        """Inverse of locate(): the key of a full location."""
+
+    @abstractmethod
+    def size(self, key: str) -> Optional[int]:
+        """Size in bytes of the stored file, or None if it does not exist."""
+
+    @abstractmethod
+    async def write(self, key: str, data: bytes) -> None:
+        """Store data under key, replacing any existing file."""
+
+    def checksum(self, key: str) -> Optional[str]:
+        """Hex MD5 of the stored file as reported by the backend, if it reports one."""
+        return None
+
+    def verify(self, key: str, data: bytes, mode: str = "hash") -> Optional[str]:
+        """
+        Check the stored file has the size of data and, with mode "hash",
+        its MD5 where the backend reports one.
+
+        Returns:
+            How it was checked ("size" or "md5"), None if it does not match
+        """
+        if self.size(key) != len(data):
+            return None
+        if mode != "hash":
+            return "size"
+        checksum = self.checksum(key)
+        if checksum is None:
+            logger.debug(
+                f"No MD5 reported for {self.locate(key)}; checked by size only"
+            )
+            return "size"
+        return "md5" if checksum == hashlib.md5(data).hexdigest() else None
+
+    async def write_verified(self, key: str, data: bytes) -> str:
+        """
+        Store data under key; remote backends also check the upload arrived intact.
+
+        Returns:
+            How the stored file was checked (see verify), "" if it was not
+        """
+        await self.write(key, data)
+        return ""
+
+    async def flush(self) -> int:
+        """Forward files held back locally; returns how many were sent."""
+        return 0
+
+    def claim(self, key: str) -> bool:
+        """
+        Claim key for a new file; False if something is already stored there.
+
+        Remote backends can only check that nothing exists yet, so two
+        processes could still claim the same key; callers also keep their
+        own registry (see AttachmentDownloader.reserve_path).
+        """
+        return self.size(key) is None
+
+    def release(self, key: str) -> None:
+        """Give up a claim whose file was never written."""
+
+    @property
+    def is_remote(self) -> bool:
+        """Whether files leave the local machine."""
+        return False
+
+
+class LocalStorage(Storage):
+    """
+    Files on the local file system, below a base directory.
+
+    The base directory may be a UNC path (\\\\server\\share\\downloads). File
+    access goes through utils.long_path, so deep trees work on Windows.
+    """
+
+    def __init__(self, base_dir: Union[str, Path]):
+        self.base_dir = Path(base_dir)
+        ensure_directory(self.base_dir)
+        # Directories created (or found) during this run. Many files share a
+        # folder, so each one is ensured once instead of once per file; the
+        # lock covers writes running in threads as well as tasks.
+        self._ensured_dirs = {self.base_dir}
+        self._ensured_lock = threading.Lock()
+
+    def _ensure_parent(self, path: Path) -> None:
+        """Create the folder of path unless this storage already did."""
+        folder = path.parent
+        with self._ensured_lock:
+            if folder in self._ensured_dirs:
+                return
+        ensure_directory(folder)
+        with self._ensured_lock:
+            self._ensured_dirs.add(folder)
+
+    def _forget_parent(self, path: Path) -> None:
+        """Drop the folder of path from the cache, e.g. after it was deleted."""
+        with self._ensured_lock:
+            self._ensured_dirs.discard(path.parent)
+
+    def locate(self, key: str) -> Path:
+        return self.base_dir / key
+
+    def key_for(self, location: Location) -> str:
+        path = Path(location)
+        try:
+            path = path.relative_to(self.base_dir)
+        except ValueError:
+            pass  # Already relative - keep as is
+        return path.as_posix()
+
+    def size(self, key: str) -> Optional[int]:
+        path = Path(long_path(self.locate(key)))
+        return path.stat().st_size if path.exists() else None
+
+    def checksum(self, key: str) -> Optional[str]:
+        path = Path(long_path(self.locate(key)))
+        if not path.exists():
+            return None
+
+        digest = hashlib.md5()
+        with open(path, "rb") as f:
+            for chunk in iter(lambda: f.read(1024 * 1024), b""):
+                digest.update(chunk)
+        return digest.hexdigest()
+
+    async def write(self, key: str, data: bytes) -> None:
+        path = self.locate(key)
+        self._ensure_parent(path)
+
+        try:
+            await self._write_file(path, data)
+        except FileNotFoundError:
+            # The folder was removed after we created it; create it again
+            self._forget_parent(path)
+            self._ensure_parent(path)
+            await self._write_file(path, data)
+
+    @staticmethod
+    async def _write_file(path: Path, data: bytes) -> None:
+        try:
+            async with aiofiles.open(long_path(path), "wb") as f:
+                await f.write(data)
+        except OSError as e:
+            # Never leave a truncated file behind on a full disk
+            if e.errno == errno.ENOSPC:
+                Path(long_path(path)).unlink(missing_ok=True)
+            raise
+
+    def claim(self, key: str) -> bool:
+        """
+        Atomically create an empty placeholder file for key.
+
+        O_EXCL makes the check and the create one step, so of several
+        processes racing for the same name exactly one succeeds.
+        """
+        path = self.locate(key)
+        self._ensure_parent(path)
+        flags = os.O_CREAT | os.O_EXCL | os.O_WRONLY
+        try:
+            try:
+                os.close(os.open(long_path(path), flags))
+            except FileNotFoundError:
+                self._forget_parent(path)
+                self._ensure_parent(path)
+                os.close(os.open(long_path(path), flags))
+        except FileExistsError:
+            return False
+        return True
+
+    def release(self, key: str) -> None:
+        path = Path(long_path(self.locate(key)))
+        if path.exists() and path.stat().st_size == 0:
+            path.unlink()
+
+
+class RemoteStorage(Storage):
+    """Shared URL handling for remote backends."""
+
+    scheme = ""
+
+    def __init__(
+        self, bucket: str, prefix: str = "", options: Optional["StorageConfig"] = None
+    ):
+        self.bucket = bucket
+        self.prefix = prefix.strip("/")
+        self.options = options
+
+    @property
+    def is_remote(self) -> bool:
+        return True
+
+    def object_name(self, key: str) -> str:
+        """Name of the object in the bucket, including the prefix."""
+        return f"{self.prefix}/{key}" if self.prefix else key
+
+    def locate(self, key: str) -> str:
+        return f"{self.scheme}://{self.bucket}/{self.object_name(key)}"
+
+    def key_for(self, location: Location) -> str:
+        base = f"{self.scheme}://{self.bucket}/{self.prefix}".rstrip("/") + "/"
+        location = str(location)
+        return location[len(base):] if location.startswith(base) else location
+
+    async def write_verified(self, key: str, data: bytes) -> str:
+        """
+        Upload data, then compare the stored object with what we sent.
+
+        A mismatch (truncated upload, proxy mangling, ...) triggers another
+        upload, up to storage.upload_attempts in total. Callers only record
+        the file as downloaded once this returns.
+
+        Raises:
+            StorageError: If no attempt could be verified
+        """
+        verify = self.options.verify_uploads if self.options else True
+        attempts = self.options.upload_attempts if self.options else 3
+
+        for attempt in range(1, attempts + 1):
+            await self.write(key, data)
+            if not verify:
+                return ""
+            verified = await asyncio.to_thread(self.verify, key, data)
+            if verified:
+                return verified
+            logger.warning(
+                f"Upload of {self.locate(key)} does not match the data sent "
+                f"(attempt {attempt}/{attempts})"
+            )
+
+        raise StorageError(
+            f"Upload of {self.locate(key)} could not "
+            f"be verified after {attempts} attempts"
+        )
+
+
+def s3_md5(head: Dict[str, Any]) -> Optional[str]:
+    """
+    The MD5 in an S3 head_object response, None where the ETag is not one:
+    multipart uploads ("<hash>-<parts>") and SSE-KMS or SSE-C encryption.
+    """
+    if str(
+        head.get("ServerSideEncryption", "")
+    ).startswith("aws:kms") or head.get("SSECustomerAlgorithm"):
+        return None
+    etag = str(head.get("ETag", "")).strip('"').lower()
+    return etag if re.fullmatch(r"[0-9a-f]{32}", etag) else None
+
+
+class S3Storage(RemoteStorage):
+    """Amazon S3 (or any S3-compatible service boto3 is configured for)."""
+
+    scheme = "s3"
+
+    def __init__(
+        self, bucket: str, prefix: str = "", options: Optional["StorageConfig"] = None
+    ):
+        super().__init__(bucket, prefix, options)
+        try:
+            import boto3
+        except ImportError:
+            raise StorageError(
+                "S3 storage needs boto3: pip install 'gmail-attachment-downloader[s3]'"
+            )
+        self.client = boto3.client("s3")
+
+    def size(self, key: str) -> Optional[int]:
+        try:
+            response = self.client.head_object(
+                Bucket=self.bucket, Key=self.object_name(key)
+            )
+        except self.client.exceptions.ClientError as e:
+            if e.response.get("Error", {}).get("Code") in (
+                "404", "NoSuchKey", "NotFound"
+            ):
+                return None
+            raise StorageError(f"Cannot check {self.locate(key)}: {e}")
+        return response["ContentLength"]
+
+    def checksum(self, key: str) -> Optional[str]:
+        return s3_md5(
+            self.client.head_object(Bucket=self.bucket, Key=self.object_name(key))
+        )
+
+    async def write(self, key: str, data: bytes) -> None:
+        await asyncio.to_thread(
+            self.client.put_object,
+            Bucket=self.bucket,
+            Key=self.object_name(key),
+            Body=data,
+        )
+
+
+class GCSStorage(RemoteStorage):
+    """Google Cloud Storage."""
+
+    scheme = "gs"
+
+    def __init__(
+        self, bucket: str, prefix: str = "", options: Optional["StorageConfig"] = None
+    ):
+        super().__init__(bucket, prefix, options)
+        try:
+            from google.cloud import storage as gcs
+        except ImportError:
+            raise StorageError(
+                "GCS storage needs google-cloud-storage: "
+                "pip install 'gmail-attachment-downloader[gcs]'"
+            )
+        self.client = gcs.Client()
+        self.gcs_bucket = self.client.bucket(bucket)
+
+    def size(self, key: str) -> Optional[int]:
+        blob = self.gcs_bucket.get_blob(self.object_name(key))
+        return blob.size if blob is not None else None
+
+    def checksum(self, key: str) -> Optional[str]:
+        blob = self.gcs_bucket.get_blob(self.object_name(key))
+        if blob is None or not blob.md5_hash:
+            return None
+        return base64.b64decode(blob.md5_hash).hex()
+
+    async def write(self, key: str, data: bytes) -> None:
+        blob = self.gcs_bucket.blob(self.object_name(key))
+        await asyncio.to_thread(blob.upload_from_string, data)
+
+
+class AzureBlobStorage(RemoteStorage):
+    """Azure Blob Storage; the bucket is ``account/container``."""
+
+    scheme = "az"
+
+    def __init__(
+        self, bucket: str, prefix: str = "", options: Optional["StorageConfig"] = None
+    ):
+        super().__init__(bucket, prefix, options)
+        try:
+            from azure.identity import DefaultAzureCredential
+            from azure.storage.blob import BlobServiceClient
+        except ImportError:
+            raise StorageError(
+                "Azure storage needs azure-storage-blob and azure-identity: "
+                "pip install 'gmail-attachment-downloader[azure]'"
+            )
+        account, container = bucket.split("/", 1)
+        service = BlobServiceClient(
+            account_url=f"https://{account}.blob.core.windows.net",
+            credential=DefaultAzureCredential(),
+        )
+        self.container = service.get_container_client(container)
+
+    def size(self, key: str) -> Optional[int]:
+        blob = self.container.get_blob_client(self.object_name(key))
+        if not blob.exists():
+            return None
+        return blob.get_blob_properties().size
+
+    def checksum(self, key: str) -> Optional[str]:
+        blob = self.container.get_blob_client(self.object_name(key))
+        content_md5 = blob.get_blob_properties().content_settings.content_md5
+        return bytes(content_md5).hex() if content_md5 else None
+
+    async def write(self, key: str, data: bytes) -> None:
+        await asyncio.to_thread(
+            self.container.upload_blob, self.object_name(key), data, overwrite=True
+        )
+
+
+class SpoolingStorage(Storage):
+    """
+    Store-and-forward wrapper around a remote backend.
+
+    When an upload fails (network down, bucket unreachable, verification
+    failing), the file goes to a local spool directory instead. Spooled files
+    are forwarded after the next successful upload or on flush(), and they
+    survive restarts, so an outage delays uploads but never loses data.
+
+    The spool directory is listed once; after that the files this process
+    spools and forwards are tracked in memory, so uploads do not walk it.
+    """
+
+    def __init__(
+        self, remote: RemoteStorage, spool_dir: Union[str, Path], max_bytes: int
+    ):
+        self.remote = remote
+        self.max_bytes = max_bytes
+
+        # One spool folder per remote location, so changing base_dir never
+        # forwards files to the wrong bucket
+        folder = re.sub(r"[^A-Za-z0-9.-]+", "_", remote.locate("")).strip("_")
+        self.spool = LocalStorage(Path(spool_dir).expanduser() / folder)
+
+        # Spooled key -> size, oldest first; None until first needed
+        self._spooled: Optional[Dict[str, int]] = None
+
+        self.stats = {"spooled": 0, "forwarded": 0}
+
+    @property
+    def is_remote(self) -> bool:
+        return True
+
+    def locate(self, key: str) -> str:
+        return self.remote.locate(key)
+
+    def key_for(self, location: Location) -> str:
+        return self.remote.key_for(location)
+
+    def _index(self) -> Dict[str, int]:
+        """The spooled files, listed from the spool directory on first use."""
+        if self._spooled is None:
+            files = [path for path in self.spool.base_dir.rglob("*") if path.is_file()]
+            files.sort(key=lambda path: path.stat().st_mtime)
+            self._spooled = {
+                self.spool.key_for(path): path.stat().st_size for path in files
+            }
+        return self._spooled
+
+    def spooled_keys(self) -> List[str]:
+        """Keys of files waiting in the spool, oldest first."""
+        return list(self._index())
+
+    def spool_size(self) -> int:
+        """Total bytes waiting in the spool."""
+        return sum(self._index().values())
+
+    def size(self, key: str) -> Optional[int]:
+        spooled = self._index().get(key)
+        if spooled is not None:
+            return spooled
+        try:
+            return self.remote.size(key)
+        except Exception:
+            return None  # Unreachable: treat as missing, a download will be spooled
+
+    async def write(self, key: str, data: bytes) -> None:
+        await self.write_verified(key, data)
+
+    async def write_verified(self, key: str, data: bytes) -> str:
+        """
+        Upload data, or spool it if the remote cannot take it right now.
+
+        Raises:
+            StorageError: If the upload fails and the spool is full
+        """
+        try:
+            verified = await self.remote.write_verified(key, data)
+        except Exception as e:
+            logger.warning(
+                f"Cannot upload {self.locate(key)} ({e}); spooling it locally"
+            )
+            await self._spool(key, data)
+            return ""
+
+        # A fresh upload supersedes any older spooled copy of the same file
+        if self._index().pop(key, None) is not None:
+            self.spool.locate(key).unlink(missing_ok=True)
+
+        # The remote is reachable again, so forward what piled up meanwhile
+        if self._index():
+            await self.flush()
+        return verified
+
+    async def _spool(self, key: str, data: bytes) -> None:
+        """Keep data in the spool, within the size limit."""
+        index = self._index()
+        used = self.spool_size() - index.get(key, 0)
+        if used + len(data) > self.max_bytes:
+            raise StorageError(
+                f"Cannot upload {self.locate(key)} and the local spool is full "
+                f"({used} of {self.max_bytes} bytes used)"
+            )
+        await self.spool.write(key, data)
+        # Newest now, whether or not an older copy was waiting
+        index.pop(key, None)
+        index[key] = len(data)
+        self.stats["spooled"] += 1
+
+    async def flush(self) -> int:
+        """
+        Forward spooled files to the remote, oldest first.
+
+        Stops at the first failure, since the remote is most likely still
+        unreachable. Returns the number of files forwarded.
+        """
+        forwarded = 0
+        for key in self.spooled_keys():
+            path = self.spool.locate(key)
+            try:
+                data = path.read_bytes()
+            except FileNotFoundError:
+                self._index().pop(key, None)  # Removed by hand meanwhile
+                continue
+            try:
+                await self.remote.write_verified(key, data)
+            except Exception as e:
+                logger.info(f"Spool not forwarded yet: {e}")
+                break
+            path.unlink()
+            self._index().pop(key, None)
+            forwarded += 1
+            self.stats["forwarded"] += 1
+
+        if forwarded:
+            logger.info(
+                f"Forwarded {forwarded} spooled file(s) to {self.remote.locate('')}"
+            )
+        return forwarded
+
+    def status(self) -> Dict[str, Any]:
+        """Spool metrics for summaries."""
+        return {
+            "waiting_files": len(self.spooled_keys()),
+            "waiting_bytes": self.spool_size(),
+            "max_bytes": self.max_bytes,
+            **self.stats,
+        }
+
+
+def split_server(server: str) -> Tuple[Optional[str], str, Optional[int]]:
+    """
+    Split ``user@host:port`` into its parts; user and port are optional.
+
+    Raises:
+        StorageError: If the port is not a number
+    """
+    user, _, host_port = server.rpartition("@")
+    host, _, port = host_port.partition(":")
+    try:
+        return user or None, host, int(port) if port else None
+    except ValueError:
+        raise StorageError(f"Invalid port in storage URL: {server}")
+
+
+class SFTPStorage(RemoteStorage):
+    """
+    SFTP server, common for on-prem data drops.
+
+    Authenticates with storage.private_key_file or storage.password (or the
+    SSH agent). Host keys must be known: unknown servers are rejected rather
+    than trusted on first use.
+    """
+
+    scheme = "sftp"
+
+    def __init__(
+        self, bucket: str, prefix: str = "", options: Optional["StorageConfig"] = None
+    ):
+        super().__init__(bucket, prefix, options)
+        try:
+            import paramiko
+        except ImportError:
+            raise StorageError(
+                "SFTP storage needs paramiko: pip install "
+                "'gmail-attachment-downloader[sftp]'"
+            )
+
+        user, host, port = split_server(bucket)
+        ssh = paramiko.SSHClient()
+        ssh.load_system_host_keys()
+        if options and options.known_hosts_file:
+            ssh.load_host_keys(str(Path(options.known_hosts_file).expanduser()))
+        ssh.set_missing_host_key_policy(paramiko.RejectPolicy())
+
+        key_file = options.private_key_file if options else None
+        try:
+            ssh.connect(
+                host,
+                port=port or 22,
+                username=user or (options.username if options else None),
+                password=options.password if options else None,
+                key_filename=str(Path(key_file).expanduser()) if key_file else None,
+                timeout=options.timeout_seconds if options else None,
+            )
+        except (paramiko.SSHException, OSError) as e:
+            raise StorageError(f"Cannot connect to SFTP server {host}: {e}")
+
+        self.ssh = ssh
+        self.sftp = ssh.open_sftp()
+
+    def remote_path(self, key: str) -> str:
+        """Absolute path of a key on the server."""
+        return "/" + self.object_name(key)
+
+    def size(self, key: str) -> Optional[int]:
+        try:
+            return self.sftp.stat(self.remote_path(key)).st_size
+        except FileNotFoundError:
+            return None
+
+    async def write(self, key: str, data: bytes) -> None:
+        await asyncio.to_thread(self._put, self.remote_path(key), data)
+
+    def _put(self, path: str, data: bytes) -> None:
+        """Create missing folders, then upload."""
+        folder = posixpath.dirname(path)
+        missing = []
+        while folder not in ("", "/"):
+            try:
+                self.sftp.stat(folder)
+                break
+            except FileNotFoundError:
+                missing.append(folder)
+                folder = posixpath.dirname(folder)
+
+        for folder in reversed(missing):
+            self.sftp.mkdir(folder)
+
+        self.sftp.putfo(io.BytesIO(data), path)
+
+
+class WebDAVStorage(RemoteStorage):
+    """
+    WebDAV server (Nextcloud, SharePoint, IIS, Apache mod_dav, ...).
+
+    webdav:// talks plain HTTP and webdavs:// talks HTTPS. Uses HTTP Basic
+    authentication with storage.username and storage.password.
+    """
+
+    scheme = "webdav"
+
+    def __init__(
+        self, bucket: str, prefix: str = "", options: Optional["StorageConfig"] = None
+    ):
+        super().__init__(bucket, prefix, options)
+        self.timeout = options.timeout_seconds if options else 30
+
+        self.headers: Dict[str, str] = {}
+        user, _, _ = split_server(bucket)
+        username = user or (options.username if options else None)
+        if username:
+            password = (options.password if options else None) or ""
+            token = base64.b64encode(f"{username}:{password}".encode()).decode()
+            self.headers["Authorization"] = f"Basic {token}"
+
+        # Credentials travel in a header, never in the request URL
+        self.host = bucket.rpartition("@")[2]
+
+    @property
+    def http_scheme(self) -> str:
+        return "https" if self.scheme == "webdavs" else "http"
+
+    def http_url(self, path: str) -> str:
+        """HTTP URL of a path on the server."""
+        return f"{self.http_scheme}://{self.host}/{urllib.parse.quote(path)}"
+
+    def _request(self, method: str, path: str, data: Optional[bytes] = None):
+        request = urllib.request.Request(
+            self.http_url(path), data=data, method=method, headers=self.headers
+        )
+        return urllib.request.urlopen(request, timeout=self.timeout)
+
+    def size(self, key: str) -> Optional[int]:
+        try:
+            with self._request("HEAD", self.object_name(key)) as response:
+                return int(response.headers.get("Content-Length", 0))
+        except urllib.error.HTTPError as e:
+            if e.code == 404:
+                return None
+            raise StorageError(f"Cannot check {self.locate(key)}: {e}")
+        except urllib.error.URLError as e:
+            raise StorageError(f"Cannot reach WebDAV server {self.host}: {e.reason}")
+
+    async def write(self, key: str, data: bytes) -> None:
+        await asyncio.to_thread(self._put, self.object_name(key), data)
+
+    def _put(self, path: str, data: bytes) -> None:
+        """Create missing collections (folders), then upload."""
+        parts = path.split("/")[:-1]
+        for depth in range(1, len(parts) + 1):
+            try:
+                self._request("MKCOL", "/".join(parts[:depth]) + "/").close()
+            except urllib.error.HTTPError as e:
+                # 405 means the collection already exists
+                if e.code != 405:
+                    raise StorageError(f"Cannot create folder on WebDAV server: {e}")
+
+        try:
+            self._request("PUT", path, data).close()
+        except urllib.error.URLError as e:
+            raise StorageError(f"Cannot upload to WebDAV server {self.host}: {e}")
+
+
+class WebDAVSStorage(WebDAVStorage):
+    """WebDAV over HTTPS."""
+
+    scheme = "webdavs"
+
+
+# URL scheme -> backend class
+STORAGE_BACKENDS: Dict[str, Type[RemoteStorage]] = {
+    "s3": S3Storage,
+    "gs": GCSStorage,
+    "az": AzureBlobStorage,
+    "sftp": SFTPStorage,
+    "webdav": WebDAVStorage,
+    "webdavs": WebDAVSStorage,
+}
+
+
+def open_storage(location: str, options: Optional["StorageConfig"] = None) -> Storage:
+    """
+    Create the storage backend for a download location.
+
+    Args:
+        location: Local directory or remote URL (see module docstring)
+        options: Credentials for SFTP and WebDAV, upload verification and
+            the local spool
+
+    Raises:
+        StorageError: If the URL scheme is unknown, the SDK is missing or
+            the server cannot be reached
+    """
+    if not is_remote_url(location):
+        return LocalStorage(location)
+
+    scheme, bucket, prefix = parse_storage_url(location)
+    backend = STORAGE_BACKENDS.get(scheme)
+    if backend is None:
+        raise StorageError(
+            f"Unsupported storage URL: {location}. "
+            f"Must start with one of: {', '.join(s + '://' for s in STORAGE_BACKENDS)}"
+        )
+    remote = backend(bucket, prefix, options)
+
+    if options and options.spool_dir:
+        return SpoolingStorage(remote, options.spool_dir, options.spool_max_size)
+    return remote
@@ -0,0 +1,318 @@
+"""
+Where OAuth tokens are kept.
+
+Signing in (Google, or Microsoft for Outlook profiles) yields a token that
+grants access to the mailbox until it is revoked, so it deserves better than
+a plain JSON file next to the config. gmail.token_store picks the backend:
+
+    file        token_file as plain JSON (the default)
+    encrypted   token_file encrypted with a passphrase, taken from
+                GMAIL_DOWNLOADER_TOKEN_PASSPHRASE or asked for in a terminal
+    keyring     the OS keychain: macOS Keychain, Windows Credential Manager
+                or the Secret Service (GNOME Keyring, KWallet)
+    env         GMAIL_DOWNLOADER_TOKEN_<PROFILE> or GMAIL_DOWNLOADER_TOKEN,
+                e.g. injected by a secret manager; never written, so a
+                refreshed token only lives as long as the process
+
+encrypted and keyring need the [secrets] extra. Both take over a plain
+token_file left from the file store, so switching needs no new sign-in: it
+is used until the token is next refreshed, then saved the new way and (for
+keyring) deleted.
+"""
+
+import base64
+import getpass
+import hashlib
+import json
+import logging
+import os
+import re
+import secrets
+import sys
+from pathlib import Path
+from typing import List, Optional
+
+from .config import GmailConfig
+from .utils import ensure_directory
+
+logger = logging.getLogger(__name__)
+
+# Name the tokens are filed under in the OS keychain, one entry per profile
+KEYRING_SERVICE = "gmail-attachment-downloader"
+
+# Environment variables of the env and encrypted stores
+TOKEN_VARIABLE = "GMAIL_DOWNLOADER_TOKEN"
+PASSPHRASE_VARIABLE = "GMAIL_DOWNLOADER_TOKEN_PASSPHRASE"
+
+# Marks an encrypted token file, whose key is derived from the passphrase
+# with scrypt (the parameters are stored alongside)
+ENCRYPTED_FORMAT = "gmail-downloader-encrypted-token"
+SCRYPT_N = 2 ** 15
+SCRYPT_R = 8
+SCRYPT_P = 1
+
+
+class TokenStoreError(Exception):
+    """Raised when a token cannot be read or saved."""
+
+    pass
+
+
+class TokenStore:
+    """Keeps one profile's token, an opaque string (usually JSON)."""
+
+    def describe(self) -> str:
+        """Where the token is, for messages."""
+        raise NotImplementedError
+
+    def load(self) -> Optional[str]:
+        """
+        The saved token, or None when there is none yet.
+
+        Raises:
+            TokenStoreError: If a token is there but cannot be read
+        """
+        raise NotImplementedError
+
+    def save(self, token: str) -> None:
+        """
+        Keep token for the next run.
+
+        Raises:
+            TokenStoreError: If it cannot be saved
+        """
+        raise NotImplementedError
+
+
+class FileTokenStore(TokenStore):
+    """The token as it is, in a file."""
+
+    def __init__(self, path: Path):
+        self.path = path
+
+    def describe(self) -> str:
+        return str(self.path)
+
+    def load(self) -> Optional[str]:
+        if not self.path.exists():
+            return None
+        try:
+            return self.path.read_text(encoding="utf-8")
+        except OSError as e:
+            raise TokenStoreError(f"Cannot read {self.path}: {e}")
+
+    def save(self, token: str) -> None:
+        try:
+            ensure_directory(self.path.parent)
+            # Created owner-only, so the token is never readable by others
+            fd = os.open(self.path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+            with os.fdopen(fd, "w", encoding="utf-8") as f:
+                if os.name == "posix":
+                    # A file that already existed keeps its mode otherwise
+                    os.fchmod(fd, 0o600)
+                f.write(token)
+        except OSError as e:
+            raise TokenStoreError(f"Cannot write {self.path}: {e}")
+
+
+def _fernet(passphrase: str, salt: bytes, n: int, r: int, p: int):
+    try:
+        from cryptography.fernet import Fernet
+    except ImportError:
+        raise TokenStoreError(
+            "token_store: encrypted needs cryptography: pip install "
+            "'gmail-attachment-downloader[secrets]'"
+        )
+    key = hashlib.scrypt(
+        passphrase.encode("utf-8"),
+        salt=salt,
+        n=n,
+        r=r,
+        p=p,
+        maxmem=128 * n * r * 2,
+        dklen=32,
+    )
+    return Fernet(base64.urlsafe_b64encode(key))
+
+
+def encrypt_token(token: str, passphrase: str) -> str:
+    """token encrypted with passphrase, as the JSON an encrypted token file holds."""
+    salt = secrets.token_bytes(16)
+    data = _fernet(
+        passphrase, salt, SCRYPT_N, SCRYPT_R, SCRYPT_P
+    ).encrypt(token.encode("utf-8"))
+    return json.dumps({
+        "format": ENCRYPTED_FORMAT,
+        "kdf": {"name": "scrypt", "salt": base64.b64encode(salt).decode("ascii"),
+                "n": SCRYPT_N, "r": SCRYPT_R, "p": SCRYPT_P},
+        "data": data.decode("ascii"),
+    }, indent=2)
+
+
+def decrypt_token(content: str, passphrase: str) -> str:
+    """
+    The token in an encrypted token file's content.
+
+    Raises:
+        TokenStoreError: If the passphrase is wrong or the content damaged
+    """
+    try:
+        document = json.loads(content)
+        kdf = document["kdf"]
+        fernet = _fernet(
+            passphrase, base64.b64decode(kdf["salt"]), kdf["n"], kdf["r"], kdf["p"]
+        )
+    except (ValueError, KeyError, TypeError) as e:
+        raise TokenStoreError(f"Damaged encrypted token: {e}")
+
+    from cryptography.fernet import InvalidToken
+
+    try:
+        return fernet.decrypt(document["data"].encode("ascii")).decode("utf-8")
+    except InvalidToken:
+        raise TokenStoreError("Wrong passphrase for the encrypted token")
+    except (ValueError, KeyError, TypeError) as e:
+        raise TokenStoreError(f"Damaged encrypted token: {e}")
+
+
+def is_encrypted(content: str) -> bool:
+    """Whether a token file's content is encrypted (rather than a plain token)."""
+    try:
+        return json.loads(content).get("format") == ENCRYPTED_FORMAT
+    except (ValueError, AttributeError):
+        return False
+
+
+class EncryptedFileTokenStore(FileTokenStore):
+    """The token in a file, encrypted with a passphrase."""
+
+    def __init__(self, path: Path, interactive: bool = True):
+        super().__init__(path)
+        self.interactive = interactive
+        self._passphrase: Optional[str] = None
+
+    def describe(self) -> str:
+        return f"{self.path} (encrypted)"
+
+    def passphrase(self, confirm: bool = False) -> str:
+        """The passphrase, from the environment or asked for once."""
+        if self._passphrase is None:
+            self._passphrase = os.getenv(PASSPHRASE_VARIABLE)
+        if self._passphrase is None:
+            if not (self.interactive and sys.stdin.isatty()):
+                raise TokenStoreError(
+                    f"token_store: encrypted needs {PASSPHRASE_VARIABLE} set"
+                )
+            passphrase = getpass.getpass(f"Passphrase for {self.path}: ")
+            if confirm and getpass.getpass("Repeat the passphrase: ") != passphrase:
+                raise TokenStoreError("The passphrases do not match")
+            self._passphrase = passphrase
+        if not self._passphrase:
+            raise TokenStoreError("The token passphrase cannot be empty")
+        return self._passphrase
+
+    def load(self) -> Optional[str]:
+        content = super().load()
+        if content is None:
+            return None
+        if not is_encrypted(content):
+            # A plain token from the file store, encrypted on the next save
+            logger.info(
+                f"{self.path} is not encrypted yet; it will be when the token is saved"
+            )
+            return content
+        return decrypt_token(content, self.passphrase())
+
+    def save(self, token: str) -> None:
+        # A passphrase typed for the first time is asked for twice
+        first = not is_encrypted(super().load() or "")
+        super().save(encrypt_token(token, self.passphrase(confirm=first)))
+
+
+class KeyringTokenStore(TokenStore):
+    """The token in the OS keychain, under the profile's name."""
+
+    def __init__(self, profile: str, legacy_path: Optional[Path] = None):
+        self.profile = profile
+        self.legacy_path = legacy_path
+
+    def describe(self) -> str:
+        return f"the OS keychain ({KEYRING_SERVICE}/{self.profile})"
+
+    def _keyring(self):
+        try:
+            import keyring
+        except ImportError:
+            raise TokenStoreError(
+                "token_store: keyring needs keyring: pip install "
+                "'gmail-attachment-downloader[secrets]'"
+            )
+        return keyring
+
+    def load(self) -> Optional[str]:
+        keyring = self._keyring()
+        try:
+            token = keyring.get_password(KEYRING_SERVICE, self.profile)
+        except keyring.errors.KeyringError as e:
+            raise TokenStoreError(f"Cannot read from the OS keychain: {e}")
+        if token is None and self.legacy_path and self.legacy_path.exists():
+            logger.info(
+                f"Moving the token in {self.legacy_path} "
+                "to the OS keychain when it is saved"
+            )
+            return FileTokenStore(self.legacy_path).load()
+        return token
+
+    def save(self, token: str) -> None:
+        keyring = self._keyring()
+        try:
+            keyring.set_password(KEYRING_SERVICE, self.profile, token)
+        except keyring.errors.KeyringError as e:
+            raise TokenStoreError(f"Cannot write to the OS keychain: {e}")
+        if self.legacy_path and self.legacy_path.exists():
+            # The keychain has it now; no plaintext copy should stay behind
+            self.legacy_path.unlink()
+            logger.info(f"Deleted {self.legacy_path}; the token is in the OS keychain")
+
+
+def token_variables(profile: str) -> List[str]:
+    """The variables the env store reads, most specific first."""
+    suffix = re.sub(r"[^A-Z0-9]+", "_", profile.upper()).strip("_")
+    return (
+        [f"{TOKEN_VARIABLE}_{suffix}", TOKEN_VARIABLE] if suffix else [TOKEN_VARIABLE]
+    )
+
+
+class EnvTokenStore(TokenStore):
+    """A token handed in through the environment; read-only."""
+
+    def __init__(self, profile: str):
+        self.variables = token_variables(profile)
+
+    def describe(self) -> str:
+        return " or ".join(f"${variable}" for variable in self.variables)
+
+    def load(self) -> Optional[str]:
+        for variable in self.variables:
+            token = os.getenv(variable)
+            if token:
+                return token
+        return None
+
+    def save(self, token: str) -> None:
+        # Refreshed access tokens are short-lived; the refresh token in the
+        # variable keeps working, so there is nothing to lose
+        logger.debug(f"Not saving the token: it comes from {self.describe()}")
+
+
+def open_token_store(gmail_config: GmailConfig, interactive: bool = True) -> TokenStore:
+    """The token store gmail.token_store selects for the current profile."""
+    path = Path(gmail_config.token_file)
+    profile = gmail_config.get_profile_name()
+    if gmail_config.token_store == "encrypted":
+        return EncryptedFileTokenStore(path, interactive)
+    if gmail_config.token_store == "keyring":
+        return KeyringTokenStore(profile, legacy_path=path)
+    if gmail_config.token_store == "env":
+        return EnvTokenStore(profile)
+    return FileTokenStore(path)
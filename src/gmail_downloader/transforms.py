@@ -0,0 +1,248 @@
+"""
+Files derived from the attachments as they are saved.
+
+Downstream tools often want a different format than the one a sender
+mails. The transforms: section turns on conversions that run for every
+saved file they apply to. The original always stays untouched:
+
+    downloads/vendor.com/2024-06/sales.csv
+    downloads/parquet/vendor.com/2024-06/sales.csv.parquet
+    downloads/vendor.com/2024-06/invoice.pdf
+    downloads/vendor.com/2024-06/invoice.pdf.txt
+
+csv_to_parquet converts CSV and TSV files with pyarrow, detecting the
+delimiter (comma, semicolon, tab or pipe) and the encoding, and with
+infer_schema the column types, into a mirror of the download tree. The
+mirror keeps the source's extension, so sales.csv and sales.tsv from the
+same feed do not overwrite each other.
+
+pdf_text extracts the text layer of PDFs with pypdf into a sidecar next to
+each, so invoices and reports can be grepped and indexed. There is no OCR:
+a scanned PDF has no text layer and gets no sidecar.
+
+Like the integrations, a transform that fails is logged and never stops
+the download.
+"""
+
+import asyncio
+import logging
+import os
+from pathlib import Path
+from typing import Any, Callable, List, Optional
+
+from .config import CsvToParquetConfig, TransformsConfig
+from .manifest import ManifestEntry
+from .schema import HEADER_BYTES, TABLE_EXTENSIONS
+from .sniff import detect_delimiter
+from .storage import Location
+
+logger = logging.getLogger(__name__)
+
+PARQUET_SUFFIX = ".parquet"
+
+# Appended to a PDF's name for its text sidecar
+TEXT_SUFFIX = ".txt"
+
+PDF_EXTENSIONS = {".pdf"}
+
+
+class TransformError(Exception):
+    """Raised when a saved file cannot be transformed."""
+
+    pass
+
+
+def mirror_path(
+    base_dir: Path, directory: str, relative_path: str, suffix: str
+) -> Path:
+    """
+    Where the file derived from base_dir/relative_path goes: the same place
+    below directory, with suffix appended to its name.
+    """
+    path = base_dir / directory / relative_path
+    return path.with_name(path.name + suffix)
+
+
+def _write_atomically(target: Path, write: Callable[[Path], Any]) -> None:
+    """Call write with a temporary path, then move it to target."""
+    target.parent.mkdir(parents=True, exist_ok=True)
+    temp_path = target.with_name(target.name + ".tmp")
+    try:
+        write(temp_path)
+        os.replace(temp_path, target)
+    finally:
+        if temp_path.exists():
+            temp_path.unlink()
+
+
+def csv_to_parquet(
+    source: Path, target: Path, compression: str = "snappy", infer_schema: bool = True
+) -> None:
+    """
+    Convert the CSV/TSV file source to the Parquet file target.
+
+    Raises:
+        TransformError: If pyarrow is missing or the file cannot be read
+            as a table
+    """
+    try:
+        import pyarrow as pa
+        import pyarrow.csv as pa_csv
+        import pyarrow.parquet as pa_parquet
+    except ImportError:
+        raise TransformError(
+            "csv_to_parquet needs pyarrow: pip install "
+            "'gmail-attachment-downloader[parquet]'"
+        )
+
+    with open(source, "rb") as f:
+        head = f.read(HEADER_BYTES)
+    try:
+        text = head.decode("utf-8-sig")
+        encoding = "utf8"
+    except UnicodeDecodeError:
+        text = head.decode("latin-1")
+        encoding = "latin1"
+    lines = text.splitlines()[:-1] if len(head) == HEADER_BYTES else text.splitlines()
+    delimiter = detect_delimiter(lines) or TABLE_EXTENSIONS.get(
+        source.suffix.lower(), ","
+    )
+
+    read_options = pa_csv.ReadOptions(encoding=encoding)
+    parse_options = pa_csv.ParseOptions(delimiter=delimiter)
+    try:
+        convert_options = pa_csv.ConvertOptions()
+        if not infer_schema:
+            # The header as pyarrow reads it, so every column can be text
+            with pa_csv.open_csv(
+                source, read_options=read_options, parse_options=parse_options
+            ) as reader:
+                names = reader.schema.names
+            convert_options = pa_csv.ConvertOptions(
+                column_types={name: pa.string() for name in names}
+            )
+        table = pa_csv.read_csv(
+            source,
+            read_options=read_options,
+            parse_options=parse_options,
+            convert_options=convert_options,
+        )
+    except (pa.ArrowException, OSError) as e:
+        raise TransformError(f"Cannot read {source.name} as a table: {e}")
+
+    _write_atomically(target, lambda path: pa_parquet.write_table(
+        table, path, compression=None if compression == "none" else compression
+    ))
+
+
+def pdf_text(source: Path, max_pages: Optional[int] = None) -> str:
+    """
+    The text of the PDF file source, page after page.
+
+    Raises:
+        TransformError: If pypdf is missing, or the PDF is damaged or needs
+            a password
+    """
+    try:
+        import pypdf
+    except ImportError:
+        raise TransformError(
+            "pdf_text needs pypdf: pip install 'gmail-attachment-downloader[pdf]'"
+        )
+
+    try:
+        reader = pypdf.PdfReader(source)
+        if reader.is_encrypted and not reader.decrypt(""):
+            raise TransformError(f"{source.name} needs a password")
+        pages = reader.pages[:max_pages] if max_pages else reader.pages
+        texts = [(page.extract_text() or "").strip() for page in pages]
+    except (pypdf.errors.PyPdfError, ValueError) as e:
+        raise TransformError(f"Cannot read {source.name} as a PDF: {e}")
+    return "\n\f\n".join(texts).strip()
+
+
+class Transforms:
+    """Runs the transforms: section for files saved below one base directory."""
+
+    def __init__(self, config: TransformsConfig, base_dir: Location):
+        self.config = config
+        self.base_dir = Path(base_dir).expanduser()
+
+    async def to_parquet(
+        self, settings: CsvToParquetConfig, entry: ManifestEntry, path: Path
+    ) -> Optional[Path]:
+        """The CSV/TSV file at path as Parquet, in the mirror; None if it failed."""
+        target = mirror_path(
+            self.base_dir, settings.directory, entry.path, PARQUET_SUFFIX
+        )
+        try:
+            await asyncio.to_thread(
+                csv_to_parquet,
+                path,
+                target,
+                settings.compression,
+                settings.infer_schema,
+            )
+        except (TransformError, OSError) as e:
+            logger.error(f"Cannot convert {entry.filename} to Parquet: {e}")
+            return None
+        logger.info(f"Converted {entry.filename} to {target}")
+        return target
+
+    async def extract_text(self, entry: ManifestEntry, path: Path) -> Optional[Path]:
+        """The text of the PDF at path in its sidecar; None if it has none or failed."""
+        try:
+            text = await asyncio.to_thread(
+                pdf_text, path, self.config.pdf_text.max_pages
+            )
+        except Exception as e:
+            # pypdf raises its own errors, and others, on damaged PDFs
+            logger.error(f"Cannot extract the text of {entry.filename}: {e}")
+            return None
+        if not text:
+            logger.info(
+                f"{entry.filename} has no text layer (a scan?); no text sidecar written"
+            )
+            return None
+        target = path.with_name(path.name + TEXT_SUFFIX)
+        try:
+            _write_atomically(
+                target,
+                lambda temp_path: temp_path.write_text(text + "\n", encoding="utf-8"),
+            )
+        except OSError as e:
+            logger.error(f"Cannot write {target}: {e}")
+            return None
+        logger.info(f"Extracted the text of {entry.filename} to {target.name}")
+        return target
+
+    async def apply(self, entry: ManifestEntry, path: Location) -> List[Path]:
+        """
+        Run every transform that applies to a saved file.
+
+        A DownloadService download listener.
+
+        Returns:
+            The files written
+        """
+        path = Path(path)
+        written = []
+        extension = path.suffix.lower()
+        if self.config.csv_to_parquet.enabled and extension in TABLE_EXTENSIONS:
+            target = await self.to_parquet(self.config.csv_to_parquet, entry, path)
+            if target:
+                written.append(target)
+        if self.config.pdf_text.enabled and extension in PDF_EXTENSIONS:
+            target = await self.extract_text(entry, path)
+            if target:
+                written.append(target)
+        return written
+
+
+def open_transforms(
+    config: TransformsConfig, base_dir: Location
+) -> Optional[Transforms]:
+    """The transforms for downloads into base_dir; None when none is on."""
+    if not config.enabled():
+        return None
+    return Transforms(config, base_dir)
@@ -0,0 +1,243 @@
+"""
+Removing password protection from attachments.
+
+Vendors often send password-protected ZIP archives or Excel workbooks, with
+the password agreed once and reused. The `passwords` section of the config
+lists them per sender or subject:
+
+    passwords:
+      "reports@vendor-a.com": "s3cret"        # one sender
+      "@vendor-b.io": ["2024pass", "2025pass"]  # a whole domain, tried in order
+      "subject:Payroll*": "payroll-pw"        # subjects, as a glob
+
+When a protected attachment arrives from a matching message, the matching
+passwords are tried in turn and the file is saved without the protection: a
+ZIP is written again as a plain ZIP with the same members, an Office file
+(xlsx, docx, pptx) is saved decrypted. Files no password opens are saved
+as they are and logged as locked; the manifest records which is which
+("unlocked" or "locked"), so `--refetch 'protection=locked'` retries them
+after a password has been added.
+
+The standard library reads ZIPs protected with the classic ZipCrypto
+scheme. AES-encrypted ZIPs need pyzipper, Office files msoffcrypto-tool:
+
+    pip install 'gmail-attachment-downloader[unlock]'
+"""
+
+import fnmatch
+import io
+import logging
+import zipfile
+import zlib
+from pathlib import Path
+from typing import Any, Dict, List, Optional, Tuple, Union
+
+from .utils import extract_email_address
+
+logger = logging.getLogger(__name__)
+
+# Protection recorded in the manifest: "" for files that had none
+PROTECTION_UNLOCKED = "unlocked"
+PROTECTION_LOCKED = "locked"
+
+# Office formats that are ZIPs unless encrypted, when they become OLE files
+OFFICE_EXTENSIONS = {".xlsx", ".xlsm", ".docx", ".docm", ".pptx", ".pptm"}
+OLE_MAGIC = b"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"
+
+# Key prefix for subject patterns in the passwords section
+SUBJECT_PREFIX = "subject:"
+
+# ZIP flag bit set on encrypted members
+ZIP_ENCRYPTED_FLAG = 0x1
+
+# Most bytes a ZIP is unpacked to when written again; larger ones (or ZIP
+# bombs) stay locked
+MAX_UNZIPPED_BYTES = 512 * 1024 * 1024
+
+
+class UnzipLimitError(Exception):
+    """Raised when a ZIP's members add up to more than MAX_UNZIPPED_BYTES."""
+
+
+def matching_passwords(
+    passwords: Dict[str, Union[str, List[str]]], sender: str, subject: str
+) -> List[str]:
+    """
+    Passwords to try for a message, most specific first.
+
+    Keys are a sender address, "@domain", or "subject:<glob>"
+    (case-insensitive). Values are one password or a list of them.
+    """
+    address = extract_email_address(sender).lower()
+    domain = "@" + address.rpartition("@")[2] if "@" in address else None
+    by_address, by_domain, by_subject = [], [], []
+
+    for key, value in passwords.items():
+        key = str(key).strip()
+        values = [
+            str(password)
+            for password in (value if isinstance(value, list) else [value])
+        ]
+        if key.lower().startswith(SUBJECT_PREFIX):
+            if fnmatch.fnmatch(
+                subject.lower(), key[len(SUBJECT_PREFIX):].strip().lower()
+            ):
+                by_subject += values
+        elif key.lower() == address:
+            by_address += values
+        elif key.lower() == domain:
+            by_domain += values
+
+    return list(dict.fromkeys(by_address + by_domain + by_subject))
+
+
+def is_protected(filename: str, data: bytes) -> bool:
+    """Whether data is a password-protected ZIP or Office file."""
+    if Path(filename).suffix.lower() in OFFICE_EXTENSIONS:
+        return data.startswith(OLE_MAGIC)
+    if not zipfile.is_zipfile(io.BytesIO(data)):
+        return False
+    try:
+        with zipfile.ZipFile(io.BytesIO(data)) as archive:
+            return any(
+                info.flag_bits & ZIP_ENCRYPTED_FLAG for info in archive.infolist()
+            )
+    except zipfile.BadZipFile:
+        return False
+
+
+def _open_zip(data: bytes) -> Any:
+    """A ZIP reader, able to read AES-encrypted members when pyzipper is installed."""
+    try:
+        import pyzipper
+    except ImportError:
+        return zipfile.ZipFile(io.BytesIO(data))
+    return pyzipper.AESZipFile(io.BytesIO(data))
+
+
+def _read_member(
+    archive: Any, info: zipfile.ZipInfo, password: str, limit: int
+) -> bytes:
+    """A member's bytes, reading no more than limit of them."""
+    with archive.open(info, pwd=password.encode("utf-8")) as member:
+        data = member.read(limit + 1)
+    if len(data) > limit:
+        raise UnzipLimitError(f"{info.filename} unpacks to more than {limit} bytes")
+    return data
+
+
+def unlock_zip(
+    data: bytes, passwords: List[str], max_bytes: int = MAX_UNZIPPED_BYTES
+) -> Optional[bytes]:
+    """
+    data written again as a ZIP without a password.
+
+    Members are unpacked up to max_bytes in all, whatever their headers
+    claim, so a ZIP bomb cannot fill the memory.
+
+    Returns:
+        The unprotected ZIP, or None if no password opens every member
+        or it unpacks to more than max_bytes
+    """
+    for password in passwords:
+        try:
+            output = io.BytesIO()
+            remaining = max_bytes
+            with _open_zip(data) as archive, zipfile.ZipFile(
+                output, "w", zipfile.ZIP_DEFLATED
+            ) as plain:
+                for info in archive.infolist():
+                    member = _read_member(archive, info, password, remaining)
+                    remaining -= len(member)
+                    copy = zipfile.ZipInfo(info.filename, date_time=info.date_time)
+                    copy.external_attr = info.external_attr
+                    copy.compress_type = zipfile.ZIP_DEFLATED
+                    plain.writestr(copy, member)
+            return output.getvalue()
+        except NotImplementedError:
+            # AES (compression type 99) without pyzipper
+            logger.warning(
+                "This ZIP uses AES encryption: pip install "
+                "'gmail-attachment-downloader[unlock]'"
+            )
+            return None
+        except UnzipLimitError as e:
+            logger.warning(f"Not unlocking the ZIP: {e}")
+            return None
+        except (RuntimeError, ValueError, zipfile.BadZipFile, zlib.error):
+            continue  # Wrong password
+    return None
+
+
+def unlock_office(data: bytes, passwords: List[str]) -> Optional[bytes]:
+    """
+    A decrypted copy of an encrypted Office file.
+
+    Returns:
+        The decrypted file, or None if no password works or
+        msoffcrypto-tool is not installed
+    """
+    try:
+        import msoffcrypto
+    except ImportError:
+        logger.warning(
+            "Encrypted Office files need msoffcrypto-tool: pip install "
+            "'gmail-attachment-downloader[unlock]'"
+        )
+        return None
+
+    for password in passwords:
+        try:
+            office_file = msoffcrypto.OfficeFile(io.BytesIO(data))
+            office_file.load_key(password=password)
+            output = io.BytesIO()
+            office_file.decrypt(output)
+            return output.getvalue()
+        except Exception:
+            # msoffcrypto raises its own errors for wrong passwords and
+            # files it does not understand; either way this one did not work
+            continue
+    return None
+
+
+class Unlocker:
+    """Removes password protection using the configured passwords."""
+
+    def __init__(self, passwords: Dict[str, Union[str, List[str]]]):
+        self.passwords = passwords
+
+    def unlock(
+        self, filename: str, data: bytes, sender: str, subject: str
+    ) -> Tuple[bytes, str]:
+        """
+        Unprotected data for an attachment, where a password opens it.
+
+        Returns:
+            The data to save and its protection: "" (none), "unlocked" or
+            "locked" (saved as received)
+        """
+        if not is_protected(filename, data):
+            return data, ""
+
+        passwords = matching_passwords(self.passwords, sender, subject)
+        if Path(filename).suffix.lower() in OFFICE_EXTENSIONS:
+            unlocked = unlock_office(data, passwords) if passwords else None
+        else:
+            unlocked = unlock_zip(data, passwords) if passwords else None
+
+        if unlocked is None:
+            reason = (
+                "no password opens it"
+                if passwords
+                else "no password configured for this sender or subject"
+            )
+            logger.warning(f"{filename} from {sender} remains locked: {reason}")
+            return data, PROTECTION_LOCKED
+
+        logger.info(f"Removed the password from {filename}")
+        return unlocked, PROTECTION_UNLOCKED
+
+
+def open_unlocker(passwords: Dict[str, Union[str, List[str]]]) -> Optional[Unlocker]:
+    """An Unlocker for the passwords section, or None when it is empty."""
+    return Unlocker(passwords) if passwords else None
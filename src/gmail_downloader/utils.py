@@ -11,11 +11,18 @@ This module demonstrates several important Python concepts:
 
 """
 
+import fnmatch
+import ntpath
+import os
 import re
+import shutil
 import unicodedata
-from datetime import datetime
+from datetime import datetime, timedelta, timezone, tzinfo
+from email.errors import HeaderParseError
+from email.header import decode_header, make_header
+from email.utils import getaddresses, parsedate_to_datetime
 from pathlib import Path
-from typing import Optional, Union
+from typing import Dict, List, Optional, Tuple, Union
 
 
 def parse_date(date_string: str) -> Optional[datetime]:
@@ -75,6 +82,106 @@ def parse_date(date_string: str) -> Optional[datetime]:
     return None
 
 
+def parse_email_date(date_header: str) -> Optional[datetime]:
+    """
+    Parse an email Date header (RFC 5322), keeping its time zone.
+    
+    Example:
+        >>> parse_email_date("Mon, 3 Jun 2024 09:12:00 +0200")
+        datetime.datetime(2024, 6, 3, 9, 12,
+        tzinfo=datetime.timezone(datetime.timedelta(seconds=7200)))
+        
+    Returns:
+        A timezone-aware datetime (UTC when the header says -0000), or None
+        if the header is not a valid date
+    """
+    try:
+        parsed = parsedate_to_datetime(date_header.strip())
+    except (TypeError, ValueError, IndexError):
+        return None
+    if parsed is None:
+        return None
+    return parsed if parsed.tzinfo else parsed.replace(tzinfo=timezone.utc)
+
+
+def get_timezone(name: str) -> Optional[tzinfo]:
+    """
+    Time zone for a name: "UTC", "local" (this machine's) or an IANA name
+    such as "Europe/Berlin".
+    
+    Returns:
+        The time zone, None for "local", which datetime.astimezone() takes
+        to mean the machine's
+        
+    Raises:
+        ValueError: If the name is not a known time zone
+    """
+    if name.lower() == "local":
+        return None
+    if name.upper() == "UTC":
+        return timezone.utc
+    try:
+        from zoneinfo import ZoneInfo
+        return ZoneInfo(name)
+    except Exception:
+        raise ValueError(f"Unknown time zone: {name}")
+
+
+def day_start_timestamp(date: datetime, tz: str = "UTC") -> int:
+    """
+    Unix time of the midnight that starts date's day in a time zone.
+    
+    Only the calendar day of date counts, so "2024-06-01" means the same
+    moment as midnight in Berlin whatever zone date itself carries.
+    
+    Example:
+        >>> day_start_timestamp(datetime(2024, 6, 1), "Europe/Berlin")
+        1717192800
+    
+    Raises:
+        ValueError: If tz is not a known time zone
+    """
+    midnight = datetime(date.year, date.month, date.day)
+    zone = get_timezone(tz)
+    # A naive datetime's timestamp() is taken in the machine's zone ("local")
+    return int((midnight.replace(tzinfo=zone) if zone else midnight).timestamp())
+
+
+# Named date folder layouts (download.date_format). Anything else with a %
+# is used as a strftime pattern; "/" nests folders and {quarter} is 1-4.
+DATE_FOLDER_FORMATS = {
+    "day": "%Y-%m-%d",           # 2024-06-03
+    "month": "%Y/%m",            # 2024/06
+    "year": "%Y",                # 2024
+    "week": "%G-W%V",            # 2024-W23 (ISO week and its year)
+    "quarter": "%Y-Q{quarter}",  # 2024-Q2
+}
+
+
+def format_date_folder(
+    date: datetime, date_format: str = "day", tz: str = "UTC"
+) -> List[str]:
+    """
+    Folder names for a date.
+    
+    Timezone-aware dates are converted to tz first, so a message sent late
+    in the evening lands on the day it was where the files are kept.
+    
+    Args:
+        date: The message date
+        date_format: A key of DATE_FOLDER_FORMATS or a strftime pattern
+        tz: Time zone for get_timezone
+        
+    Returns:
+        One folder per "/"-separated part, e.g. ["2024", "06"] for "month"
+    """
+    if date.tzinfo is not None:
+        date = date.astimezone(get_timezone(tz))
+    pattern = DATE_FOLDER_FORMATS.get(date_format, date_format)
+    text = date.strftime(pattern).replace("{quarter}", str((date.month - 1) // 3 + 1))
+    return [part for part in text.split("/") if part]
+
+
 def format_file_size(size_bytes: int) -> str:
     """
     Convert a file size in bytes to a human-readable string.
@@ -129,7 +236,109 @@ def format_file_size(size_bytes: int) -> str:
     return f"{size:.1f} {size_units[unit_index]}"
 
 
-def sanitize_filename(filename: str) -> str:
+def parse_file_size(size_string: Union[str, int]) -> Optional[int]:
+    """
+    Parse a human-readable file size like "10MB" into a number of bytes.
+    
+    This is the reverse of format_file_size(). Configuration files and CLI
+    flags are much nicer to write as "10MB" than as 10485760.
+    
+    Args:
+        size_string: Size such as "512", "1.5 KB", "10MB" or "2gb".
+            Plain integers are treated as bytes.
+        
+    Returns:
+        Number of bytes, or None if the string cannot be parsed
+        
+    Example:
+        >>> parse_file_size("10MB")
+        10485760
+        >>> parse_file_size("1.5 KB")
+        1536
+        >>> parse_file_size("lots")
+        None
+    """
+    if isinstance(size_string, int):
+        return size_string if size_string >= 0 else None
+    
+    # Number followed by an optional unit, with optional space in between
+    match = re.match(r'^\s*(\d+(?:\.\d+)?)\s*([a-zA-Z]*)\s*$', str(size_string))
+    if not match:
+        return None
+    
+    number, unit = match.groups()
+    
+    # Same binary units as format_file_size() so the two round-trip cleanly
+    multipliers = {
+        "": 1, "B": 1,
+        "K": 1024, "KB": 1024,
+        "M": 1024 ** 2, "MB": 1024 ** 2,
+        "G": 1024 ** 3, "GB": 1024 ** 3,
+        "T": 1024 ** 4, "TB": 1024 ** 4,
+    }
+    multiplier = multipliers.get(unit.upper())
+    if multiplier is None:
+        return None
+    
+    return int(float(number) * multiplier)
+
+
+def parse_bandwidth(bandwidth_string: str) -> Optional[int]:
+    """
+    Parse a transfer rate like "5MB/s" into bytes per second.
+    
+    The "/s" suffix is optional, so "500KB" means the same as "500KB/s".
+    
+    Returns:
+        Bytes per second (always positive), or None if the string cannot be parsed
+        
+    Example:
+        >>> parse_bandwidth("5MB/s")
+        5242880
+    """
+    text = str(bandwidth_string).strip()
+    if text.lower().endswith("/s"):
+        text = text[:-2]
+    
+    rate = parse_file_size(text)
+    return rate if rate else None
+
+
+def parse_duration(duration_string: str) -> Optional[timedelta]:
+    """
+    Parse a short duration like "7d" or "12h" into a timedelta.
+    
+    Args:
+        duration_string: A whole number followed by s (seconds), m (minutes),
+            h (hours), d (days) or w (weeks)
+        
+    Returns:
+        The duration, or None if the string cannot be parsed
+        
+    Example:
+        >>> parse_duration("7d")
+        datetime.timedelta(days=7)
+        >>> parse_duration("soon")
+        None
+    """
+    match = re.match(r'^\s*(\d+)\s*([smhdw])\s*$', str(duration_string).lower())
+    if not match:
+        return None
+    
+    number, unit = match.groups()
+    units = {"s": "seconds", "m": "minutes", "h": "hours", "d": "days", "w": "weeks"}
+    return timedelta(**{units[unit]: int(number)})
+
+
+# How sanitize_filename treats non-ASCII characters (download.filename_unicode)
+FILENAME_UNICODE_MODES = ["keep", "ascii"]
+
+# Longest sanitized name in UTF-8 bytes; most filesystems allow 255 bytes,
+# and some room is left for suffixes such as _part2 or .meta.json
+MAX_FILENAME_BYTES = 200
+
+
+def sanitize_filename(filename: str, unicode: str = "keep") -> str:
     """
     Clean a filename to make it safe for file system operations.
     
@@ -146,8 +355,15 @@ def sanitize_filename(filename: str) -> str:
     
     We need to make these safe while keeping them readable.
     
+    By default (unicode="keep") names are only normalized to NFC, so
+    "報告書.pdf" or "Отчёт.pdf" stay as they are. With unicode="ascii"
+    names are decomposed with NFKD and the accents dropped ("résumé"
+    becomes "resume"), and other scripts are dropped too. Invisible control
+    and direction-override characters are removed in both modes.
+    
     Args:
         filename: The original filename from the email
+        unicode: "ascii" or "keep" (see FILENAME_UNICODE_MODES)
         
     Returns:
         A cleaned filename that's safe to use on all operating systems
@@ -176,55 +392,125 @@ def sanitize_filename(filename: str) -> str:
     for char in illegal_chars:
         clean_name = clean_name.replace(char, '_')
     
-    # Handle Unicode characters by normalizing them
-    # This converts accented characters to their closest ASCII equivalents
-    # For example: "résumé" becomes "resume"
-    clean_name = unicodedata.normalize('NFKD', clean_name)
-    
-    # Keep only ASCII characters (removes accent marks, etc.)
-    # This ensures compatibility across all systems
-    clean_name = clean_name.encode('ascii', 'ignore').decode('ascii')
+    if unicode == "keep":
+        # NFC: one code point per accented letter, the form macOS, Windows
+        # and Linux tools all display and compare correctly
+        clean_name = unicodedata.normalize('NFC', clean_name)
+        
+        # Drop invisible control, format and unassigned characters; they can
+        # disguise a name (a right-to-left override makes an .exe display as
+        # ending in .pdf). Zero-width joiners stay: emoji sequences need them.
+        clean_name = ''.join(
+            char for char in clean_name
+            if not unicodedata.category(char).startswith('C') or char in '\u200c\u200d'
+        )
+    else:
+        # Handle Unicode characters by normalizing them
+        # This converts accented characters to their closest ASCII equivalents
+        # For example: "résumé" becomes "resume"
+        clean_name = unicodedata.normalize('NFKD', clean_name)
+        
+        # Keep only ASCII characters (removes accent marks, etc.)
+        # This ensures compatibility across all systems
+        clean_name = clean_name.encode('ascii', 'ignore').decode('ascii')
     
     # Replace multiple consecutive underscores with a single one
     # This prevents ugly filenames like "file___name.txt"
     clean_name = re.sub(r'_+', '_', clean_name)
     
-    # Remove leading/trailing underscores and dots
-    # Leading dots make files hidden on Unix systems
-    clean_name = clean_name.strip('_.')
+    # Remove leading/trailing underscores, dots and spaces
+    # Leading dots make files hidden on Unix systems; spaces can be left
+    # over where characters were dropped
+    clean_name = clean_name.strip('_. ')
     
     # Ensure we still have something left
     if not clean_name:
         return "unnamed_file"
     
-    # Limit length to prevent filesystem issues (most support 255 chars)
-    # Keep some buffer for extensions and path length
-    max_length = 200
-    if len(clean_name) > max_length:
+    # Limit length to prevent filesystem issues (most support 255 bytes)
+    # Keep some buffer for extensions and path length. Limits count bytes,
+    # and non-ASCII characters take 2-4 bytes each in UTF-8.
+    max_length = MAX_FILENAME_BYTES
+    if len(clean_name.encode('utf-8')) > max_length:
         # Try to preserve the file extension
         if '.' in clean_name:
             name_part, ext_part = clean_name.rsplit('.', 1)
-            available_length = max_length - len(ext_part) - 1
-            clean_name = name_part[:available_length] + '.' + ext_part
+            available_length = max_length - len(ext_part.encode('utf-8')) - 1
+            clean_name = _truncate_utf8(name_part, available_length) + '.' + ext_part
         else:
-            clean_name = clean_name[:max_length]
+            clean_name = _truncate_utf8(clean_name, max_length)
     
     return clean_name
 
 
+def _truncate_utf8(text: str, max_bytes: int) -> str:
+    """Cut text to at most max_bytes of UTF-8 without splitting a character"""
+    return text.encode('utf-8')[:max(max_bytes, 0)].decode('utf-8', 'ignore')
+
+
+# Characters that reorder how text displays; in a filename they serve to
+# disguise its extension ("invoice\u202efdp.exe" displays as "invoiceexe.pdf")
+DIRECTION_OVERRIDES = set('\u202a\u202b\u202c\u202d\u202e\u2066\u2067\u2068\u2069')
+
+
+def unsafe_filename(filename: str) -> str:
+    """
+    Why an attachment's name cannot be trusted, or "" when it can.
+    
+    sanitize_filename makes any name writable, but some names are a sign
+    of a crafted attachment rather than a clumsy sender: a direction
+    override disguising the extension, a path reaching out of its folder
+    or a NUL byte truncating the name. Such files are quarantined rather
+    than saved under a cleaned-up name that hides what they were.
+    
+    Example:
+        >>> unsafe_filename("invoice\u202efdp.exe")
+        'direction override character disguises the extension'
+        >>> unsafe_filename("report.pdf")
+        ''
+    """
+    if any(char in DIRECTION_OVERRIDES for char in filename):
+        return "direction override character disguises the extension"
+    if "\0" in filename:
+        return "NUL byte in the name"
+    parts = re.split(r'[/\\]', filename)
+    if ".." in (part.strip() for part in parts):
+        return "path traversal (..) in the name"
+    if len(parts) > 1 and (
+        filename.startswith(("/", "\\")) or ntpath.splitdrive(filename)[0]
+    ):
+        return "absolute path as the name"
+    return ""
+
+
+# RFC 5322 local part: a dot-atom ("first.last", "user+tag") or a quoted
+# string ('"john doe"')
+_ATEXT = r"[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]"
+_LOCAL_PART = re.compile(rf'^(?:{_ATEXT}+(?:\.{_ATEXT}+)*|"(?:[^"\\\r\n]|\\.)*")$')
+
+# Domain: dot-separated labels that neither start nor end with a hyphen,
+# ending in a top-level domain of at least two letters (or an IDN "xn--" one)
+_DOMAIN = re.compile(
+    r"^(?:[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)+(?:[A-Za-z]{2,63}|xn--[A-Za-z0-9-]{1,59})$"
+)
+
+
 def is_valid_email(email: str) -> bool:
     """
-    Validate if a string looks like a proper email address.
+    Validate if a string is a bare email address (an RFC 5322 addr-spec).
     
     This function teaches us about:
-    1. Regular expressions for pattern matching
+    1. Splitting a problem into parts (local part and domain)
     2. Input validation (never trust user input!)
     3. The difference between simple validation and RFC-compliant validation
     4. Balancing simplicity with accuracy
     
-    Note: This is a simple validation. Perfect email validation is incredibly
-    complex (the full RFC 5322 specification is thousands of lines). For our
-    use case, we just need to catch obvious mistakes and malformed addresses.
+    The local part may be a dot-atom (letters, digits and !#$%&'*+/=?^_`{|}~-
+    separated by single dots) or a quoted string. The domain must be a
+    hostname with a real top-level domain: mail is not sent to "localhost"
+    or to IP literals in practice, so those are rejected. Display names and
+    comments ("John <john@example.com>") are not part of an address; see
+    extract_email_address.
     
     Args:
         email: The email address string to validate
@@ -251,21 +537,12 @@ def is_valid_email(email: str) -> bool:
     if len(email) < 5 or len(email) > 254:  # RFC 5321 limit
         return False
     
-    # Simple but effective email pattern
-    # Let's break this down piece by piece:
-    pattern = r'^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$'
-    
-    # Pattern explanation:
-    # ^                    - Start of string
-    # [a-zA-Z0-9._%+-]+   - Local part: letters, numbers, and common symbols
-    # @                    - The @ symbol (required)
-    # [a-zA-Z0-9.-]+      - Domain name: letters, numbers, dots, hyphens
-    # \.                   - A literal dot (escaped because . means "any char")
-    # [a-zA-Z]{2,}        - Top-level domain: at least 2 letters
-    # $                    - End of string
+    # The domain follows the last @; a quoted local part may contain others
+    local_part, at, domain = email.rpartition("@")
+    if not at or len(local_part) > 64:  # RFC 5321 limit
+        return False
     
-    # Use the re.match function to test our pattern
-    return bool(re.match(pattern, email))
+    return bool(_LOCAL_PART.match(local_part) and _DOMAIN.match(domain))
 
 
 def extract_email_address(full_email: str) -> str:
@@ -276,8 +553,13 @@ def extract_email_address(full_email: str) -> str:
     - "john@example.com" (simple)
     - "John Doe <john@example.com>" (with display name)
     - "<john@example.com>" (just brackets)
+    - '"Doe, John" <john@example.com>' (quoted display name)
+    - "john@example.com (John Doe)" (comment)
+    - "a@example.com, b@example.com" (several addresses; the first is used)
     
-    This function demonstrates string parsing and handling real-world data messiness.
+    This function demonstrates why parsing beats pattern matching for
+    real-world data: the standard library's RFC 5322 parser copes with
+    quotes, comments and lists that a regular expression gets wrong.
     
     Args:
         full_email: Email string in any format
@@ -295,30 +577,112 @@ def extract_email_address(full_email: str) -> str:
     if not full_email:
         return ""
     
-    # Clean up whitespace
-    clean_email = full_email.strip()
+    # The first valid address in the header, lowercased for consistency
+    addresses = extract_all_emails(full_email)
+    if addresses:
+        return addresses[0]
     
-    # Look for email address inside angle brackets < >
-    # This handles the "Name <email@domain.com>" format
-    bracket_match = re.search(r'<(.+?)>', clean_email)
-    if bracket_match:
-        extracted = bracket_match.group(1).strip()
-        # Return the extracted email if it looks valid
-        if is_valid_email(extracted):
-            return extracted.lower()
-    
-    # If no brackets, assume the whole string is the email
-    # Convert to lowercase for consistency
-    potential_email = clean_email.lower()
-    
-    # Return it if it looks like a valid email
-    if is_valid_email(potential_email):
-        return potential_email
+    # A header too malformed for the parser (an unclosed quote, say) may
+    # still have an address in angle brackets, or be one
+    bracket_match = re.search(r'<(.+?)>', full_email)
+    candidate = (
+        bracket_match.group(1) if bracket_match else full_email
+    ).strip().lower()
+    if is_valid_email(candidate):
+        return candidate
     
     # If nothing worked, return the original (let caller decide what to do)
     return full_email
 
 
+def _getaddresses(header: str) -> List[Tuple[str, str]]:
+    """
+    (name, address) pairs of a header, parsed leniently.
+    
+    Newer Pythons (3.13, and security releases of older ones) parse
+    strictly by default and return nothing usable for headers real mail
+    clients send, such as ones with an unclosed quote; strict=False keeps
+    the behaviour of the others.
+    """
+    try:
+        return getaddresses([header], strict=False)
+    except TypeError:  # Before strict= existed
+        return getaddresses([header])
+
+
+def extract_all_emails(header: str) -> List[str]:
+    """
+    Extract every email address from a header such as To or Cc.
+    
+    Args:
+        header: One or more addresses, separated by commas, in any of the
+            formats extract_email_address accepts
+        
+    Returns:
+        The valid addresses, lowercased, in order and without repeats
+        
+    Example:
+        >>> extract_all_emails('"Doe, John" <john@example.com>, ops@example.com')
+        ["john@example.com", "ops@example.com"]
+    """
+    if not header:
+        return []
+    
+    addresses = [
+        address.strip().lower() for _, address in _getaddresses(header.strip())
+    ]
+    return list(
+        dict.fromkeys(address for address in addresses if is_valid_email(address))
+    )
+
+
+def extract_display_name(header: str) -> str:
+    """
+    Extract the display name of a From header.
+    
+    Names may be quoted ('"Müller, Jan" <jan@example.de>') or encoded as
+    RFC 2047 words ("=?UTF-8?B?5bGx55Sw?=" is 山田), and a comment after a bare
+    address ("billing@acme.com (Acme Billing)") counts as one too.
+    
+    Args:
+        header: The From header
+        
+    Returns:
+        The name of the first address, or "" if it has none
+        
+    Example:
+        >>> extract_display_name("Acme Billing <billing@acme.com>")
+        "Acme Billing"
+    """
+    try:
+        decoded = str(make_header(decode_header(header)))
+    except (LookupError, UnicodeDecodeError, HeaderParseError, ValueError):
+        decoded = header
+    addresses = _getaddresses(decoded)
+    return addresses[0][0].strip() if addresses else ""
+
+
+def format_sender(address: str, name: str = "") -> str:
+    """
+    Put a display name and address back together for people to read.
+    
+    Names with commas or other special characters are quoted, as in a
+    From header, but never encoded: "Müller" stays readable. Without a
+    name, the address is returned alone.
+    
+    Example:
+        >>> format_sender("reports@acme.com", "Acme Analytics")
+        "Acme Analytics <reports@acme.com>"
+        >>> format_sender("reports@acme.com")
+        "reports@acme.com"
+    """
+    if not name:
+        return address
+    if re.search(r'[()<>@,;:\\".\[\]]', name):
+        name = '"' + name.replace("\\", "\\\\").replace('"', '\\"') + '"'
+    return f"{name} <{address}>"
+
+
 def ensure_directory(path: Union[str, Path]) -> Path:
     """
     Ensure a directory exists, creating it if necessary.
@@ -346,11 +710,18 @@ def ensure_directory(path: Union[str, Path]) -> Path:
     # pathlib.Path is the modern, cross-platform way to handle file paths
     directory = Path(path)
     
+    # A network share cannot be created, only folders inside it. Check the
+    # share itself first so an offline server gives a clear message.
+    share = unc_share(str(directory))
+    if share and not os.path.isdir(share):
+        raise OSError(f"Network share not reachable: '{share}'")
+    
     try:
         # Create the directory and any necessary parent directories
         # parents=True means "create parent directories if they don't exist"
         # exist_ok=True means "don't raise an error if directory already exists"
-        directory.mkdir(parents=True, exist_ok=True)
+        # On Windows the long-path form lets this go past 260 characters
+        Path(long_path(directory)).mkdir(parents=True, exist_ok=True)
         
         # Return the Path object for further use
         return directory
@@ -363,6 +734,84 @@ def ensure_directory(path: Union[str, Path]) -> Path:
         raise OSError(f"Failed to create directory '{directory}': {e}")
 
 
+def free_disk_space(path: Union[str, Path]) -> Optional[int]:
+    """
+    Bytes available on the filesystem that holds path.
+    
+    A path that does not exist yet is measured at its nearest existing
+    parent, where it would be created.
+    
+    Returns:
+        The free bytes, or None if the filesystem cannot be asked
+    """
+    directory = Path(path).absolute()
+    while not directory.exists() and directory != directory.parent:
+        directory = directory.parent
+    try:
+        return shutil.disk_usage(directory).free
+    except OSError:
+        return None
+
+
+# Prefix that lifts the 260-character MAX_PATH limit of Windows file APIs
+LONG_PATH_PREFIX = "\\\\?\\"
+
+
+def unc_share(path: str) -> Optional[str]:
+    r"""
+    Return the share root of a UNC path, or None for other paths.
+    
+    Example:
+        >>> unc_share(r"\\server\share\downloads\reports")
+        '\\\\server\\share'
+    """
+    if path.startswith(LONG_PATH_PREFIX):
+        if not path[len(LONG_PATH_PREFIX):].upper().startswith("UNC\\"):
+            return None
+        path = "\\\\" + path[len(LONG_PATH_PREFIX) + 4:]
+    
+    if not (path.startswith("\\\\") or path.startswith("//")):
+        return None
+    
+    parts = re.split(r"[\\/]+", path.lstrip("\\/"))
+    if len(parts) < 2 or not parts[0] or not parts[1]:
+        return None
+    return f"\\\\{parts[0]}\\{parts[1]}"
+
+
+def long_path(path: Union[str, Path], windows: Optional[bool] = None) -> str:
+    r"""
+    Return a path that Windows file APIs accept beyond 260 characters.
+    
+    Windows only lifts MAX_PATH for absolute paths with the \\?\ prefix;
+    UNC paths use the \\?\UNC\server\share form. Prefixed paths skip
+    Windows' own normalization, so the path is made absolute and uses
+    backslashes first. On other systems the path is returned unchanged.
+    
+    Args:
+        path: File or directory path
+        windows: Force Windows behaviour (default: detect from the OS)
+        
+    Example:
+        >>> long_path(r"\\server\share\downloads", windows=True)
+        '\\\\?\\UNC\\server\\share\\downloads'
+    """
+    if windows is None:
+        windows = os.name == "nt"
+    
+    path = str(path)
+    if not windows or path.startswith(LONG_PATH_PREFIX):
+        return path
+    
+    path = path.replace("/", "\\")
+    if unc_share(path):
+        return LONG_PATH_PREFIX + "UNC\\" + ntpath.normpath(path).lstrip("\\")
+    
+    if not ntpath.isabs(path):
+        path = ntpath.join(os.getcwd(), path)
+    return LONG_PATH_PREFIX + ntpath.normpath(path)
+
+
 def truncate_string(text: str, max_length: int = 50, suffix: str = "...") -> str:
     """
     Truncate a string to a maximum length, adding a suffix if truncated.
@@ -404,6 +853,195 @@ def truncate_string(text: str, max_length: int = 50, suffix: str = "...") -> str
     return text[:available_length] + suffix
 
 
+def resolve_sender_alias(
+    sender: str, aliases: Optional[Dict[str, str]]
+) -> Optional[str]:
+    """
+    Look up the alias for a sender address.
+    
+    Partners often send from several addresses; aliases collapse them into
+    one name. Keys are email addresses, or "@domain" to match every address
+    at that domain. An exact address wins over its domain. Matching is
+    case-insensitive.
+    
+    Args:
+        sender: Sender as it appears in the email ("Name <a@b.com>" is fine)
+        aliases: Mapping of address or "@domain" to alias
+        
+    Returns:
+        The alias, or None if the sender has none
+        
+    Example:
+        >>> resolve_sender_alias("Reports <reports@vendor-a.io>",
+        ...                      {"@vendor-a.io": "vendor_a"})
+        "vendor_a"
+    """
+    if not aliases:
+        return None
+    
+    address = extract_email_address(sender).lower()
+    lowered = {key.lower(): value for key, value in aliases.items()}
+    
+    if address in lowered:
+        return lowered[address]
+    
+    domain = address.rpartition("@")[2]
+    return lowered.get(f"@{domain}") if domain else None
+
+
+# Default patterns removed from subjects before they become folder names.
+# Each one is a regular expression; matches are deleted.
+DEFAULT_SUBJECT_CLEANUP_PATTERNS = [
+    # Reply/forward prefixes, including stacked and localized ones:
+    # "Re: Fwd: ", "RE[2]: ", "AW: ", "WG: ", "SV: "
+    r"(?i)^\s*((re|fw|fwd|aw|wg|sv|tr)\s*(\[\d+\])?\s*:\s*)+",
+    # Dates: 2024-06-01, 2024/06/01, 01.06.2024, 6/1/24
+    r"\b\d{4}[-/.]\d{1,2}[-/.]\d{1,2}\b",
+    r"\b\d{1,2}[-/.]\d{1,2}[-/.]\d{2,4}\b",
+    # Ticket and case numbers: ABC-1234, #12345, [Ticket 9876]
+    r"\b[A-Z][A-Z0-9]+-\d+\b",
+    r"#\d+",
+    r"(?i)\[\s*(ticket|case|ref)?\s*#?\d+\s*\]",
+]
+
+
+def clean_subject(subject: str, patterns: Optional[List[str]] = None) -> str:
+    """
+    Reduce an email subject to a stable name for grouping related messages.
+    
+    Recurring threads tend to differ only in noise - "Re:" prefixes, dates,
+    ticket numbers. Removing that noise lets them share one folder instead
+    of producing dozens of near-duplicates.
+    
+    Args:
+        subject: The email subject line
+        patterns: Regular expressions to delete (default:
+            DEFAULT_SUBJECT_CLEANUP_PATTERNS)
+        
+    Returns:
+        The cleaned subject, or "no-subject" if nothing is left
+        
+    Example:
+        >>> clean_subject("Re: FW: Daily sales report 2024-06-01 [#4411]")
+        "Daily sales report"
+    """
+    if patterns is None:
+        patterns = DEFAULT_SUBJECT_CLEANUP_PATTERNS
+    
+    cleaned = subject or ""
+    for pattern in patterns:
+        cleaned = re.sub(pattern, " ", cleaned)
+    
+    # Tidy up what the removed parts leave behind: empty brackets, runs of
+    # spaces, and separators dangling at either end
+    cleaned = re.sub(r"[\[(]\s*[\])]", " ", cleaned)
+    cleaned = re.sub(r"\s+", " ", cleaned)
+    cleaned = re.sub(r" ([:;,.])", r"\1", cleaned)
+    cleaned = cleaned.strip(" -_:,;.|/")
+    
+    return cleaned or "no-subject"
+
+
+# Folder -> file extensions for organize_by "type". Extensions in no group
+# get a folder of their own, named without the dot ("xml").
+DEFAULT_TYPE_GROUPS = {
+    "docs": ["pdf", "doc", "docx", "odt", "rtf", "txt", "md"],
+    "tabular": ["csv", "tsv", "xls", "xlsx", "ods", "parquet"],
+    "slides": ["ppt", "pptx", "odp", "key"],
+    "code": ["ipynb", "py", "r", "sql", "sh", "js", "json", "yaml", "yml"],
+    "images": ["png", "jpg", "jpeg", "gif", "webp", "svg", "tif", "tiff", "heic"],
+    "archives": ["zip", "gz", "tgz", "tar", "7z", "rar"],
+}
+
+
+def type_folder(filename: str, groups: Optional[Dict[str, List[str]]] = None) -> str:
+    """
+    Folder for a file in the "type" layout.
+    
+    Args:
+        filename: Name of the file
+        groups: Folder -> extensions, consulted before DEFAULT_TYPE_GROUPS,
+            so a group can take over extensions from a built-in one
+        
+    Returns:
+        The group folder, the extension without its dot if no group has
+        it, or "other" for files without an extension
+        
+    Example:
+        >>> type_folder("export.TSV")
+        "tabular"
+    """
+    extension = Path(filename).suffix.lower().lstrip(".")
+    if not extension:
+        return "other"
+    
+    for mapping in (groups or {}, DEFAULT_TYPE_GROUPS):
+        for folder, extensions in mapping.items():
+            if extension in (ext.lower().lstrip(".") for ext in extensions):
+                return folder
+    return extension
+
+
+def is_regex_pattern(pattern: str) -> bool:
+    """
+    Whether a filename pattern is a regular expression
+    (anchored with ^ or $) rather than a glob
+    """
+    return pattern.startswith("^") or pattern.endswith("$")
+
+
+def matches_filename_pattern(filename: str, patterns: Optional[List[str]]) -> bool:
+    """
+    Check an attachment name against filename patterns.
+    
+    Patterns starting with ^ or ending with $ are regular expressions,
+    anything else is a glob ("report_*.csv"). Both ignore case.
+    
+    Args:
+        filename: Attachment name as sent
+        patterns: Patterns of which any one must match; empty or None
+            matches every name
+        
+    Example:
+        >>> matches_filename_pattern(
+        ...     "metrics_20240601.xlsx", [r"^metrics_\d{8}\.xlsx$"]
+        ... )
+        True
+    """
+    if not patterns:
+        return True
+    
+    for pattern in patterns:
+        if is_regex_pattern(pattern):
+            if re.search(pattern, filename, re.IGNORECASE):
+                return True
+        elif fnmatch.fnmatch(filename.lower(), pattern.lower()):
+            return True
+    return False
+
+
+def matches_sender(sender: str, senders: Optional[List[str]]) -> bool:
+    """
+    Check a sender address against addresses and "@domain" entries.
+    
+    Args:
+        sender: The sending address
+        senders: Addresses or "@domain" of which any one must match; empty
+            or None matches every sender
+    """
+    if not senders:
+        return True
+    
+    sender = sender.lower()
+    for candidate in senders:
+        candidate = str(candidate).lower()
+        if sender == candidate or (
+            candidate.startswith("@") and sender.endswith(candidate)
+        ):
+            return True
+    return False
+
+
 # Example usage and testing section
 # This shows how professional code often includes examples for learning
 if __name__ == "__main__":
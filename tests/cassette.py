@@ -0,0 +1,129 @@
+"""
+Record and replay Gmail API calls for integration tests.
+
+GmailClient talks to Gmail through a googleapiclient service object:
+``service.users().messages().list(userId="me", q=...).execute()``. A
+cassette stands in for that object. In replay mode every ``execute()`` is
+answered from a JSON file; in record mode calls go to a real service and
+the responses are written to the file. Tests using a cassette run the whole
+pipeline (search, filter, download, organize, manifest) without network
+access or credentials.
+
+Record a cassette against a real account (use a test account - responses,
+including attachment data, are stored as is):
+
+    GMAIL_CASSETTE_RECORD=1 pytest tests/test_integration.py
+
+Cassette files hold a list of interactions:
+
+    {"request": "users.messages.list",
+     "params": {"userId": "me", "q": "has:attachment", "maxResults": 500},
+     "response": {"messages": [{"id": "m1"}]}}
+"""
+
+import json
+import os
+from pathlib import Path
+from typing import Any, Dict, List, Optional, Tuple
+
+# Directory holding the recorded cassettes
+CASSETTE_DIR = Path(__file__).parent / "cassettes"
+
+# Set to record new cassettes against the real Gmail API
+RECORD_ENV = "GMAIL_CASSETTE_RECORD"
+
+
+class CassetteError(Exception):
+    """Raised when a replayed request has no recorded response."""
+
+
+class Cassette:
+    """Recorded Gmail API interactions, stored as JSON."""
+    
+    def __init__(self, path: Path):
+        self.path = Path(path)
+        self.interactions: List[Dict[str, Any]] = []
+        self._played: set = set()
+    
+    @classmethod
+    def load(cls, path: Path) -> "Cassette":
+        cassette = cls(path)
+        with open(path, "r", encoding="utf-8") as f:
+            cassette.interactions = json.load(f)
+        return cassette
+    
+    def save(self) -> None:
+        self.path.parent.mkdir(parents=True, exist_ok=True)
+        with open(self.path, "w", encoding="utf-8") as f:
+            json.dump(self.interactions, f, indent=2, sort_keys=True)
+    
+    def record(self, request: str, params: Dict[str, Any], response: Any) -> None:
+        self.interactions.append(
+            {"request": request, "params": params, "response": response}
+        )
+    
+    def play(self, request: str, params: Dict[str, Any]) -> Any:
+        """
+        Answer a request from the recording.
+        
+        Matching interactions are used in recorded order; once all have been
+        played the last one repeats, so polling loops keep getting answers.
+        """
+        matches = [
+            index for index, interaction in enumerate(self.interactions)
+            if interaction["request"] == request and interaction["params"] == params
+        ]
+        if not matches:
+            raise CassetteError(
+                f"No recorded response in {self.path.name} for {request} {params}"
+            )
+        
+        index = next((i for i in matches if i not in self._played), matches[-1])
+        self._played.add(index)
+        return json.loads(json.dumps(self.interactions[index]["response"]))
+
+
+class CassetteService:
+    """
+    Drop-in for a googleapiclient service that replays or records calls.
+    
+    Resource calls (``users()``, ``messages()``) build up the request name;
+    the last call with arguments supplies its parameters; ``execute()``
+    answers it. Pass ``target`` (a real service) to record instead of replay.
+    """
+    
+    def __init__(self, cassette: Cassette, target: Optional[Any] = None,
+                 path: Tuple[str, ...] = (), params: Optional[Dict[str, Any]] = None):
+        self._cassette = cassette
+        self._target = target
+        self._path = path
+        self._params = params or {}
+    
+    def __getattr__(self, name: str):
+        def call(**params):
+            if name == "execute":
+                return self._execute()
+            target = (
+                getattr(self._target, name)(**params)
+                if self._target is not None
+                else None
+            )
+            return CassetteService(
+                self._cassette, target, self._path + (name,), params or self._params
+            )
+        
+        return call
+    
+    def _execute(self) -> Any:
+        request = ".".join(self._path)
+        if self._target is None:
+            return self._cassette.play(request, self._params)
+        
+        response = self._target.execute()
+        self._cassette.record(request, self._params, response)
+        return response
+
+
+def recording() -> bool:
+    """Whether tests should record new cassettes instead of replaying."""
+    return bool(os.getenv(RECORD_ENV))
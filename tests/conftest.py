@@ -0,0 +1,66 @@
+"""
+Fixtures shared by the tests
+"""
+
+import hashlib
+
+import pytest
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import AttachmentDownloader, DownloadService
+from gmail_downloader.gmail_client import reset_quota_trackers
+from gmail_downloader.manifest import DownloadManifest, ManifestEntry
+
+
+@pytest.fixture(autouse=True)
+def fresh_quota_trackers():
+    """Start every test without the quota counts of earlier ones"""
+    reset_quota_trackers()
+    yield
+    reset_quota_trackers()
+
+
+@pytest.fixture
+def fake_config(tmp_path):
+    """Config for a FakeGmail account: its CSV files, saved into tmp_path"""
+    config = AppConfig()
+    config.filters.extensions = [".csv"]
+    config.filters.min_size = 1
+    config.filters.subject_exclude_keywords = []
+    config.download.base_dir = str(tmp_path)
+    return config
+
+
+@pytest.fixture
+def make_service(fake_config):
+    """
+    Factory of DownloadServices for a FakeGmail account: make_service(gmail)
+    uses fake_config, make_service(gmail, config) another config. The
+    manifest is kept in the config's download directory.
+    """
+    def make(gmail, config=None, downloader=None):
+        config = config or fake_config
+        base_dir = config.download.base_dir
+        return DownloadService(
+            gmail.client(config),
+            downloader or AttachmentDownloader(base_dir),
+            DownloadManifest(base_dir),
+            config,
+        )
+    return make
+
+
+@pytest.fixture
+def save_file(tmp_path):
+    """
+    Factory of files saved below tmp_path: save_file(relative_path,
+    data, **details) is their manifest entry
+    """
+    def save(relative_path, data, **details):
+        path = tmp_path / relative_path
+        path.parent.mkdir(parents=True, exist_ok=True)
+        path.write_bytes(data)
+        return ManifestEntry(
+            message_id="m1", attachment_id="a1", filename=path.name, path=relative_path,
+            size=len(data), sha256=hashlib.sha256(data).hexdigest(), **details,
+        )
+    return save
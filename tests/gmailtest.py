@@ -0,0 +1,202 @@
+"""
+A fake Gmail account for tests.
+
+FakeGmail is an in-memory mailbox behind a stand-in for the googleapiclient
+Gmail service. GmailClient runs unchanged against it - searching with
+pagination, reading message metadata and MIME parts, downloading
+attachments and raw messages - so the downloader, the watch loop and the
+CLI's pipelines can be tested end to end without credentials or network:
+
+    gmail = FakeGmail()
+    gmail.add_message("ap@vendor.com", "Export", attachments={"export.csv": b"a,b"})
+    client = gmail.client(config)       # an authenticated GmailClient
+    planned = await DownloadService(client, ...).plan()
+
+Messages added while a watcher is polling show up on its next check.
+
+FakeGmail is a localmail.LocalMailbox, whose search understands the subset
+of Gmail's query language this project generates. Anything else raises
+ValueError, so a test cannot pass by accidentally ignoring part of a query.
+
+Unlike cassettes (tests/cassette.py), which replay what a real account
+answered, the mailbox is built in the test, so each test states exactly
+the mail it needs.
+"""
+
+import itertools
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from email.message import EmailMessage as MimeMessage
+from email.utils import format_datetime
+from typing import Any, Dict, List, Optional
+
+from gmail_downloader.localmail import LocalGmailService, LocalMailbox, encode
+
+# Messages listed per page, low enough that tests exercise pagination
+DEFAULT_PAGE_SIZE = 50
+
+
+@dataclass
+class FakeAttachment:
+    """A file attached to a fake message."""
+
+    filename: str
+    data: bytes
+    mime_type: str = "application/octet-stream"
+    # Set for images shown in the body (Content-ID, inline disposition)
+    content_id: str = ""
+
+
+@dataclass
+class FakeMessage:
+    """A message in the fake mailbox."""
+
+    id: str
+    thread_id: str
+    sender: str
+    subject: str
+    date: datetime
+    body: str = ""
+    to: str = "me@example.com"
+    labels: List[str] = field(default_factory=lambda: ["INBOX"])
+    attachments: List[FakeAttachment] = field(default_factory=list)
+
+    def attachment_id(self, index: int) -> str:
+        return f"{self.id}-att{index}"
+
+    def attachment_data(self, attachment_id: str) -> Optional[bytes]:
+        for index, attachment in enumerate(self.attachments, start=1):
+            if self.attachment_id(index) == attachment_id:
+                return attachment.data
+        return None
+
+    @property
+    def filenames(self) -> List[str]:
+        return [attachment.filename for attachment in self.attachments]
+
+    @property
+    def rfc822_id(self) -> str:
+        """The Message-ID header, without <>."""
+        return f"{self.id}@fake.gmail"
+
+    def headers(self) -> List[Dict[str, str]]:
+        return [
+            {"name": "From", "value": self.sender},
+            {"name": "To", "value": self.to},
+            {"name": "Subject", "value": self.subject},
+            {"name": "Date", "value": format_datetime(self.date)},
+            {"name": "Message-ID", "value": f"<{self.rfc822_id}>"},
+        ]
+
+    def payload(self) -> Dict[str, Any]:
+        """The MIME structure as the Gmail API returns it with format=full."""
+        text = self.body.encode("utf-8")
+        parts = [
+            {
+                "partId": "0",
+                "mimeType": "text/plain",
+                "filename": "",
+                "headers": [
+                    {"name": "Content-Type", "value": 'text/plain; charset="utf-8"'}
+                ],
+                "body": {"size": len(text), "data": encode(text)},
+            }
+        ]
+        for index, attachment in enumerate(self.attachments, start=1):
+            disposition = "inline" if attachment.content_id else "attachment"
+            headers = [{
+                "name": "Content-Disposition",
+                "value": f'{disposition}; filename="{attachment.filename}"',
+            }]
+            if attachment.content_id:
+                headers.append(
+                    {"name": "Content-ID", "value": f"<{attachment.content_id}>"}
+                )
+            parts.append(
+                {
+                    "partId": str(index),
+                    "mimeType": attachment.mime_type,
+                    "filename": attachment.filename,
+                    "headers": headers,
+                    "body": {
+                        "size": len(attachment.data),
+                        "attachmentId": self.attachment_id(index),
+                    },
+                }
+            )
+        return {"partId": "", "mimeType": "multipart/mixed", "filename": "",
+                "headers": self.headers(), "body": {"size": 0}, "parts": parts}
+
+    def raw(self) -> bytes:
+        """The complete message in RFC 822 form (format=raw)."""
+        mime = MimeMessage()
+        for header in self.headers():
+            mime[header["name"]] = header["value"]
+        mime.set_content(self.body)
+        for attachment in self.attachments:
+            maintype, _, subtype = attachment.mime_type.partition("/")
+            if attachment.content_id:
+                mime.add_attachment(attachment.data, maintype=maintype, subtype=subtype,
+                                    filename=attachment.filename, disposition="inline",
+                                    cid=f"<{attachment.content_id}>")
+            else:
+                mime.add_attachment(attachment.data, maintype=maintype, subtype=subtype,
+                                    filename=attachment.filename)
+        return mime.as_bytes()
+
+    @property
+    def size(self) -> int:
+        return len(self.raw())
+
+
+class FakeGmail(LocalMailbox):
+    """
+    An in-memory Gmail account.
+
+    Add messages with add_message, then hand client() (or service() for a
+    GmailClient of your own) to the code under test. requests records every
+    API call as (name, params) for assertions such as "no attachment was
+    downloaded twice".
+    """
+
+    def __init__(
+        self, email_address: str = "me@example.com", page_size: int = DEFAULT_PAGE_SIZE
+    ):
+        super().__init__(email_address, page_size)
+        self._ids = itertools.count(1)
+
+    def add_message(self,
+                    sender: str,
+                    subject: str = "",
+                    attachments: Optional[Dict[str, bytes]] = None,
+                    body: str = "",
+                    date: Optional[datetime] = None,
+                    labels: Optional[List[str]] = None,
+                    thread_id: Optional[str] = None) -> FakeMessage:
+        """
+        Add a message; attachments maps filenames to their data.
+
+        Messages are listed newest first, like Gmail, using date (default:
+        now). labels are label names; user labels are created as needed.
+        """
+        message_id = f"m{next(self._ids)}"
+        message = FakeMessage(
+            id=message_id,
+            thread_id=thread_id or f"t-{message_id}",
+            sender=sender,
+            subject=subject,
+            date=date or datetime.now(timezone.utc),
+            body=body,
+            labels=list(labels) if labels is not None else ["INBOX"],
+            attachments=[
+                FakeAttachment(filename, data)
+                for filename, data in (attachments or {}).items()
+            ],
+        )
+        if message.date.tzinfo is None:
+            message.date = message.date.replace(tzinfo=timezone.utc)
+        return self.add(message)
+
+
+# The Gmail service stand-in, under the name earlier tests used
+FakeGmailService = LocalGmailService
@@ -0,0 +1,62 @@
+"""
+Tests for the library API
+"""
+
+import asyncio
+
+from gmail_downloader.api import (
+    STATUS_EXISTS,
+    STATUS_NEW,
+    AppConfig,
+    Client,
+    Filters,
+    Progress,
+)
+
+from tests.gmailtest import FakeGmail
+
+
+def make_client(tmp_path):
+    """Client downloading into tmp_path from a fake Gmail account"""
+    config = AppConfig()
+    config.download.base_dir = str(tmp_path)
+    config.filters.min_size = 1
+    gmail = FakeGmail()
+    gmail.add_message("reports@company.com", "Daily export",
+                      {"report.pdf": b"pdf bytes", "data.csv": b"a,b\n1,2\n"})
+    return Client(config=config, gmail=gmail.client(config))
+
+
+class TestClient:
+    """Test searching and downloading through the library"""
+
+    async def test_search_and_download(self, tmp_path):
+        """Matches are downloaded once, with progress ending in None"""
+        client = make_client(tmp_path)
+
+        matches = await client.search()
+        assert [match.status for match in matches] == [STATUS_NEW, STATUS_NEW]
+
+        progress = asyncio.Queue()
+        saved = await client.download(matches, progress=progress)
+
+        assert len(saved) == 2
+        events = [progress.get_nowait() for _ in range(3)]
+        assert all(isinstance(event, Progress) for event in events[:2])
+        assert [
+            (event.completed, event.total) for event in events[:2]
+        ] == [(1, 2), (2, 2)]
+        assert events[2] is None
+
+        # The manifest is shared with later searches, as with the CLI
+        matches = await client.search()
+        assert [match.status for match in matches] == [STATUS_EXISTS, STATUS_EXISTS]
+
+    async def test_search_filters(self, tmp_path):
+        """Filters passed to search replace the configured ones for that search only"""
+        client = make_client(tmp_path)
+
+        matches = await client.search(Filters(extensions=[".csv"], min_size=1))
+
+        assert [match.filename for match in matches] == ["data.csv"]
+        assert client.config.filters.extensions != [".csv"]
@@ -0,0 +1,126 @@
+"""
+Tests for backfill module
+"""
+
+from datetime import date, datetime
+
+import pytest
+from dateutil.relativedelta import relativedelta
+from gmail_downloader.backfill import (
+    BACKFILL_FILENAME,
+    BackfillState,
+    parse_chunk,
+    slice_query,
+    time_slices,
+)
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import AttachmentDownloader, DownloadService
+from gmail_downloader.manifest import DownloadManifest, ManifestError
+
+from tests.gmailtest import FakeGmail
+
+
+class TestSlices:
+    """Test cutting a date range into slices"""
+
+    @pytest.mark.parametrize("chunk,expected", [
+        ("1m", relativedelta(months=1)),
+        ("2w", relativedelta(weeks=2)),
+        (" 7D ", relativedelta(days=7)),
+        ("1y", relativedelta(years=1)),
+        ("0m", None),
+        ("1h", None),
+        ("month", None),
+    ])
+    def test_parse_chunk(self, chunk, expected):
+        """Days, weeks, months and years; m means months"""
+        assert parse_chunk(chunk) == expected
+
+    def test_months_follow_the_calendar(self):
+        """
+        Slices are whole months from the start, without
+        drifting, and the last one stops at the end
+        """
+        slices = time_slices(
+            date(2024, 1, 31), date(2024, 5, 15), relativedelta(months=1)
+        )
+
+        assert slices == [
+            (date(2024, 1, 31), date(2024, 2, 29)),
+            (date(2024, 2, 29), date(2024, 3, 31)),
+            (date(2024, 3, 31), date(2024, 4, 30)),
+            (date(2024, 4, 30), date(2024, 5, 15)),
+        ]
+        assert time_slices(
+            date(2024, 1, 1), date(2024, 1, 1), relativedelta(months=1)
+        ) == []
+
+    def test_slice_query(self):
+        """Slices are sent as exact timestamps of midnight in the time zone"""
+        query = slice_query(
+            "from:a@vendor.com", date(2024, 6, 1), date(2024, 7, 1), "UTC"
+        )
+
+        assert query == "(from:a@vendor.com) after:1717200000 before:1719792000"
+
+
+class TestBackfillState:
+    """Test checkpointing finished slices next to the manifest"""
+
+    def test_round_trip(self, tmp_path):
+        """Finished slices survive a reload, per search"""
+        state = BackfillState(tmp_path).load()
+        assert not state.is_done("work:abc", date(2024, 1, 1), date(2024, 2, 1))
+
+        state.mark_done(
+            "work:abc", date(2024, 1, 1), date(2024, 2, 1), "from:a@vendor.com"
+        )
+        state.mark_done("work:abc", date(2024, 1, 1), date(2024, 2, 1))
+
+        reloaded = BackfillState(tmp_path).load()
+        assert reloaded.is_done("work:abc", date(2024, 1, 1), date(2024, 2, 1))
+        assert not reloaded.is_done("work:abc", date(2024, 2, 1), date(2024, 3, 1))
+        assert not reloaded.is_done("home:abc", date(2024, 1, 1), date(2024, 2, 1))
+        assert (tmp_path / BACKFILL_FILENAME).exists()
+
+    def test_corrupt_file(self, tmp_path):
+        """An unreadable file is an error rather than a silent restart"""
+        (tmp_path / BACKFILL_FILENAME).write_text("{not json")
+
+        with pytest.raises(ManifestError):
+            BackfillState(tmp_path).load()
+
+
+class TestSliceSearch:
+    """Test slice queries against the fake account"""
+
+    async def test_each_message_in_one_slice(self, tmp_path):
+        """Neighbouring slices find their own messages and none twice"""
+        gmail = FakeGmail()
+        for day in (datetime(2024, 1, 15), datetime(2024, 2, 1), datetime(2024, 3, 10)):
+            gmail.add_message(
+                "reports@vendor.com",
+                f"{day:%B}",
+                {f"{day:%Y-%m-%d}.csv": b"a,b"},
+                date=day,
+            )
+        config = AppConfig()
+        config.filters.extensions = [".csv"]
+        config.filters.min_size = 1
+        service = DownloadService(
+            gmail.client(config),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+
+        found = []
+        for start, end in time_slices(
+            date(2024, 1, 1), date(2024, 4, 1), relativedelta(months=1)
+        ):
+            planned = await service.plan(
+                queries=[slice_query(service.build_query(), start, end)]
+            )
+            found.append([item.filename for item in planned])
+
+        assert found == [["2024-01-15.csv"], ["2024-02-01.csv"], ["2024-03-10.csv"]]
@@ -0,0 +1,81 @@
+"""
+Tests for checksums module
+"""
+
+import shutil
+import subprocess
+
+import pytest
+
+from gmail_downloader.checksums import checkable, sha256sums, sha256sums_line, verify
+
+
+class TestSha256sums:
+    """Test the sha256sum -c export"""
+
+    def test_lines(self, save_file):
+        """One line per file, sorted by path, encrypted and quarantined ones left out"""
+        entries = [
+            save_file("b/report.csv", b"1,2"),
+            save_file("a/invoice.pdf", b"%PDF"),
+            save_file("c/secret.pdf.age", b"age", encrypted="age"),
+            save_file("d/virus.exe", b"MZ", quarantine="quarantine/virus.exe"),
+        ]
+
+        lines = sha256sums(entries).splitlines()
+
+        assert [
+            line.split("  ")[1] for line in lines
+        ] == ["a/invoice.pdf", "b/report.csv"]
+
+    def test_escaped_names(self):
+        """Like sha256sum, odd names are escaped"""
+        assert sha256sums_line("ab", "a\\b.txt") == "\\ab  a\\\\b.txt\n"
+        assert sha256sums_line("ab", "a b.txt") == "ab  a b.txt\n"
+
+    def test_newest_download_per_path(self, save_file):
+        """A path written twice is checked against its newest download"""
+        old = save_file("a.csv", b"old", downloaded_at="2024-01-01T00:00:00")
+        new = save_file("a.csv", b"new", downloaded_at="2024-02-01T00:00:00")
+
+        assert checkable([new, old]) == [new]
+
+    @pytest.mark.skipif(shutil.which("sha256sum") is None, reason="needs GNU sha256sum")
+    def test_sha256sum_accepts_it(self, tmp_path, save_file):
+        """The standard tool checks the exported file"""
+        entries = [save_file("acme.com/a b.csv", b"1,2"), save_file("x.txt", b"x")]
+        (tmp_path / "SHA256SUMS").write_text(sha256sums(entries))
+
+        result = subprocess.run(
+            ["sha256sum", "-c", "SHA256SUMS"], cwd=tmp_path, capture_output=True
+        )
+
+        assert result.returncode == 0
+
+
+class TestVerify:
+    """Test re-hashing the tree"""
+
+    def test_modified_and_missing(self, tmp_path, save_file):
+        """Changed and deleted files are reported"""
+        intact = save_file("a.csv", b"1,2")
+        modified = save_file("b.csv", b"3,4")
+        missing = save_file("c.csv", b"5,6")
+        (tmp_path / "b.csv").write_bytes(b"3,5")
+        (tmp_path / "c.csv").unlink()
+
+        result = verify([intact, modified, missing], tmp_path)
+
+        assert result.ok == ["a.csv"]
+        assert result.modified == ["b.csv"]
+        assert result.missing == ["c.csv"]
+        assert result.failed
+
+    def test_all_intact(self, tmp_path, save_file):
+        """An untouched tree passes"""
+        result = verify([save_file("a.csv", b"1,2")], tmp_path)
+
+        assert not result.failed
+        assert result.to_dict() == {
+            "ok": 1, "modified": [], "missing": [], "unreadable": {}
+        }
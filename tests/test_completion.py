@@ -0,0 +1,80 @@
+"""
+Tests for completion module
+"""
+
+import json
+import time
+
+from gmail_downloader.completion import (
+    cached_label_names,
+    complete_organize_by,
+    label_cache_path,
+    profile_names,
+)
+from gmail_downloader.config import GmailConfig
+
+
+class TestCompleteOrganizeBy:
+    """Test completing --organize-by"""
+
+    def test_prefix(self):
+        """Layouts starting with the typed text are offered"""
+        assert complete_organize_by("sender_") == ["sender_date", "sender_subject"]
+        assert complete_organize_by("x") == []
+
+
+class TestProfileNames:
+    """Test finding saved accounts"""
+
+    def test_only_tokens(self, tmp_path):
+        """Token files are profiles; credentials and broken files are not"""
+        (tmp_path / "work.json").write_text(
+            json.dumps({"token": "t", "refresh_token": "r"})
+        )
+        (tmp_path / "home.json").write_text(json.dumps({"refresh_token": "r"}))
+        (tmp_path / "credentials.json").write_text(json.dumps({"installed": {}}))
+        (tmp_path / "broken.json").write_text("{")
+
+        assert profile_names(tmp_path) == ["home", "work"]
+
+    def test_missing_directory(self, tmp_path):
+        """A token directory that does not exist yet has no profiles"""
+        assert profile_names(tmp_path / "missing") == []
+
+
+class TestCachedLabelNames:
+    """Test caching label names between completions"""
+
+    def make_config(self, tmp_path):
+        """Gmail settings with the token in tmp_path"""
+        return GmailConfig(token_file=str(tmp_path / "work.json"))
+
+    def test_fetched_once(self, tmp_path):
+        """Labels are fetched, sorted, and reused while fresh"""
+        config = self.make_config(tmp_path)
+        calls = []
+
+        def fetch():
+            calls.append(1)
+            return ["receipts", "INBOX", "Invoices"]
+
+        assert cached_label_names(config, fetch) == ["INBOX", "Invoices", "receipts"]
+        assert cached_label_names(config, fetch) == ["INBOX", "Invoices", "receipts"]
+        assert calls == [1]
+        assert label_cache_path(config).name == ".work-labels.json"
+
+    def test_expired_cache_refetched(self, tmp_path):
+        """A cache older than the TTL is replaced"""
+        config = self.make_config(tmp_path)
+        label_cache_path(config).write_text(
+            json.dumps({"fetched_at": time.time() - 7200, "labels": ["Old"]})
+        )
+
+        assert cached_label_names(config, lambda: ["New"], ttl=3600) == ["New"]
+
+    def test_failed_fetch_not_cached(self, tmp_path):
+        """No labels (e.g. not signed in) are retried next time"""
+        config = self.make_config(tmp_path)
+
+        assert cached_label_names(config, lambda: []) == []
+        assert not label_cache_path(config).exists()
@@ -0,0 +1,155 @@
+"""
+Tests for daemon module
+"""
+
+import asyncio
+import json
+import os
+import socket
+
+import pytest
+
+from gmail_downloader.daemon import (
+    DaemonError,
+    PidFile,
+    parse_health_addr,
+    sd_notify,
+    serve_health,
+    watch_file,
+)
+
+
+class TestPidFile:
+    """Test the single-instance PID file."""
+
+    def test_acquire_and_release(self, tmp_path):
+        """The PID file holds our PID while running and is removed afterwards."""
+        path = tmp_path / "run" / "watch.pid"
+
+        with PidFile(path):
+            assert path.read_text().strip() == str(os.getpid())
+
+        assert not path.exists()
+
+    def test_running_process_blocks(self, tmp_path):
+        """A PID file of a live process refuses a second watcher."""
+        path = tmp_path / "watch.pid"
+        path.write_text(f"{os.getppid()}\n")
+
+        with pytest.raises(DaemonError) as exc_info:
+            PidFile(path).acquire()
+        assert str(os.getppid()) in str(exc_info.value)
+        assert path.read_text().strip() == str(os.getppid())
+
+    def test_stale_file_taken_over(self, tmp_path):
+        """A PID file left by a dead process is replaced."""
+        path = tmp_path / "watch.pid"
+        path.write_text("999999999\n")
+
+        pid_file = PidFile(path)
+        pid_file.acquire()
+
+        assert pid_file.read_pid() == os.getpid()
+        pid_file.release()
+
+
+class TestSdNotify:
+    """Test systemd notifications."""
+
+    def test_without_socket(self, monkeypatch):
+        """Outside a Type=notify unit nothing is sent."""
+        monkeypatch.delenv("NOTIFY_SOCKET", raising=False)
+
+        assert sd_notify("READY=1") is False
+
+    def test_sends_states(self, tmp_path, monkeypatch):
+        """States are sent as one newline-separated datagram."""
+        address = str(tmp_path / "notify.sock")
+        with socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM) as sock:
+            sock.bind(address)
+            monkeypatch.setenv("NOTIFY_SOCKET", address)
+
+            assert sd_notify("READY=1", "STATUS=Watching") is True
+            assert sock.recv(1024) == b"READY=1\nSTATUS=Watching"
+
+
+class TestHealthEndpoint:
+    """Test the HTTP health report."""
+
+    def test_parse_health_addr(self):
+        """Addresses are host:port, defaulting to localhost."""
+        assert parse_health_addr("0.0.0.0:8765") == ("0.0.0.0", 8765)
+        assert parse_health_addr(":8765") == ("127.0.0.1", 8765)
+        assert parse_health_addr("[::1]:8765") == ("::1", 8765)
+
+        for invalid in ("8765x", "host", "host:0", "host:70000"):
+            with pytest.raises(ValueError):
+                parse_health_addr(invalid)
+
+    async def test_serves_status(self):
+        """Any GET returns the report, with 503 while unhealthy."""
+        report = {"healthy": True, "messages_processed": 3}
+        # Bind to a free port chosen by the OS
+        with socket.socket() as probe:
+            probe.bind(("127.0.0.1", 0))
+            port = probe.getsockname()[1]
+        server = await serve_health(f"127.0.0.1:{port}", lambda: report)
+
+        async def get():
+            reader, writer = await asyncio.open_connection("127.0.0.1", port)
+            writer.write(b"GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n")
+            response = await reader.read()
+            writer.close()
+            head, _, body = response.partition(b"\r\n\r\n")
+            return head.split(b"\r\n")[0], json.loads(body)
+
+        try:
+            status, body = await get()
+            assert status == b"HTTP/1.1 200 OK"
+            assert body["messages_processed"] == 3
+
+            report["healthy"] = False
+            status, _ = await get()
+            assert status == b"HTTP/1.1 503 Service Unavailable"
+        finally:
+            server.close()
+            await server.wait_closed()
+
+
+class TestWatchFile:
+    """Test noticing config file edits."""
+
+    async def test_change_reported_once(self, tmp_path):
+        """Saving the file triggers one callback; an untouched file none."""
+        path = tmp_path / "config.yaml"
+        path.write_text("watch:\n  check_interval: 30\n")
+        changes = []
+
+        task = asyncio.create_task(
+            watch_file(path, lambda: changes.append(1), interval=0.01)
+        )
+        try:
+            await asyncio.sleep(0.05)
+            assert changes == []
+
+            path.write_text("watch:\n  check_interval: 60\n")
+            await asyncio.sleep(0.1)
+            assert changes == [1]
+        finally:
+            task.cancel()
+
+    async def test_missing_file_ignored(self, tmp_path):
+        """A file that is briefly missing (editor swap) is not a change."""
+        path = tmp_path / "config.yaml"
+        path.write_text("a")
+        changes = []
+
+        task = asyncio.create_task(
+            watch_file(path, lambda: changes.append(1), interval=0.01)
+        )
+        try:
+            path.unlink()
+            await asyncio.sleep(0.05)
+            assert changes == []
+        finally:
+            task.cancel()
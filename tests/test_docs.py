@@ -0,0 +1,77 @@
+"""
+Tests for docs module
+"""
+
+from datetime import date
+
+from gmail_downloader.docs import EXAMPLES, ManPage, examples_epilog, roff_escape
+
+
+class TestExamplesEpilog:
+    """Test examples at the end of --help"""
+
+    def test_lists_examples(self):
+        """Each example is shown with its command line"""
+        epilog = examples_epilog("download")
+
+        assert epilog.startswith("Examples:")
+        for description, command_line in EXAMPLES["download"]:
+            assert f"{description}:" in epilog
+            assert f"$ {command_line}" in epilog
+
+    def test_no_examples(self):
+        """Commands without examples get no epilog"""
+        assert examples_epilog("status") is None
+
+
+class TestManPage:
+    """Test rendering man pages"""
+
+    def test_roff_escape(self):
+        """Hyphens, backslashes and leading dots cannot be read as roff"""
+        assert roff_escape("--dry-run") == "\\-\\-dry\\-run"
+        assert roff_escape("C:\\mail") == "C:\\email"
+        assert roff_escape(".hidden") == "\\&.hidden"
+
+    def test_render(self):
+        """Sections appear in man page order"""
+        page = ManPage(
+            name="gmail-downloader-list",
+            summary="List matching attachments",
+            synopsis="gmail-downloader list [OPTIONS]",
+            options=[("-n, --limit INTEGER", "Show at most this many")],
+            examples=[("Ten newest", "gmail-downloader list -n 10")],
+            see_also=["gmail-downloader"],
+        )
+
+        text = page.render("1.2.3", when=date(2025, 1, 2))
+
+        assert page.filename == "gmail-downloader-list.1"
+        assert text.startswith(
+            '.TH "GMAIL-DOWNLOADER-LIST" "1" "2025-01-02" "gmail-downloader 1.2.3"'
+        )
+        assert "gmail\\-downloader\\-list \\- List matching attachments" in text
+        assert ".B \\-n, \\-\\-limit INTEGER" in text
+        assert "gmail\\-downloader list \\-n 10" in text
+        assert (
+            text.index(".SH SYNOPSIS") < text.index(".SH OPTIONS")
+            < text.index(".SH EXAMPLES")
+        )
+        assert "\\fBgmail\\-downloader\\fR(1)" in text
+
+    def test_exit_status(self):
+        """Exit codes get their own section"""
+        page = ManPage(
+            name="gmail-downloader",
+            summary="Download attachments",
+            synopsis="gmail-downloader COMMAND",
+            exit_status=[(0, "Success"), (6, "Nothing matched the filters")],
+        )
+
+        text = page.render("1.2.3")
+
+        assert (
+            ".SH EXIT STATUS\n.TP\n.B 0\nSuccess\n.TP\n.B "
+            "6\nNothing matched the filters"
+            in text
+        )
@@ -0,0 +1,220 @@
+"""
+Tests for doctor module
+"""
+
+import json
+from datetime import datetime, timedelta, timezone
+from unittest.mock import patch
+
+from gmail_downloader.config import AppConfig, DownloadConfig, GmailConfig
+from gmail_downloader.doctor import (
+    FAIL,
+    OK,
+    SKIP,
+    WARN,
+    check_api,
+    check_credentials,
+    check_network,
+    check_output_dir,
+    check_scopes,
+    check_token,
+)
+from gmail_downloader.gmail_client import READONLY_SCOPE, GmailError
+
+from tests.gmailtest import FakeGmail
+
+NOW = datetime(2026, 3, 2, 12, 0, tzinfo=timezone.utc)
+
+
+def make_config(tmp_path, token=None):
+    """A config whose token file holds token (as JSON), if given"""
+    config = AppConfig()
+    config.gmail = GmailConfig(
+        credentials_file=str(tmp_path / "credentials.json"),
+        token_file=str(tmp_path / "token.json"),
+    )
+    if token is not None:
+        (tmp_path / "token.json").write_text(json.dumps(token))
+    return config
+
+
+class TestCredentials:
+    """Test checking the OAuth client file"""
+
+    def test_missing(self, tmp_path):
+        """A missing file says where to get one"""
+        check = check_credentials(
+            GmailConfig(credentials_file=str(tmp_path / "credentials.json"))
+        )
+
+        assert check.status == FAIL
+        assert "Desktop app" in check.fix
+
+    def test_desktop_client(self, tmp_path):
+        """An installed-app client passes"""
+        path = tmp_path / "credentials.json"
+        path.write_text(
+            json.dumps({"installed": {"client_id": "123.apps.googleusercontent.com"}})
+        )
+
+        check = check_credentials(GmailConfig(credentials_file=str(path)))
+
+        assert check.status == OK
+        assert "123.apps.googleusercontent.com" in check.detail
+
+    def test_service_account_key(self, tmp_path):
+        """A service account key is not mistaken for a client"""
+        path = tmp_path / "credentials.json"
+        path.write_text(
+            json.dumps(
+                {
+                    "type": "service_account",
+                    "client_email": "x@y.iam.gserviceaccount.com",
+                }
+            )
+        )
+
+        check = check_credentials(GmailConfig(credentials_file=str(path)))
+
+        assert check.status == FAIL
+        assert "not an OAuth client" in check.detail
+
+
+class TestToken:
+    """Test checking the saved token and its scopes"""
+
+    def test_not_signed_in(self, tmp_path):
+        """No token fails with the sign-in command"""
+        check = check_token(make_config(tmp_path), NOW)
+
+        assert check.status == FAIL
+        assert "auth login" in check.fix
+
+    def test_expired_refreshable(self, tmp_path):
+        """An expired access token with a refresh token is fine"""
+        config = make_config(
+            tmp_path, {"refresh_token": "r", "expiry": "2026-03-01T00:00:00Z"}
+        )
+
+        assert check_token(config, NOW).status == OK
+
+    def test_expired_without_refresh_token(self, tmp_path):
+        """An expired token that cannot be refreshed fails"""
+        config = make_config(tmp_path, {"expiry": "2026-03-01T00:00:00.000000Z"})
+
+        check = check_token(config, NOW)
+
+        assert check.status == FAIL
+        assert "no refresh token" in check.detail
+
+    def test_missing_scopes(self, tmp_path):
+        """Scopes the features need but the token lacks fail"""
+        config = make_config(
+            tmp_path, {"refresh_token": "r", "scopes": [READONLY_SCOPE]}
+        )
+        modify = "https://www.googleapis.com/auth/gmail.modify"
+
+        assert check_scopes(config, [READONLY_SCOPE]).status == OK
+        check = check_scopes(config, [READONLY_SCOPE, modify])
+        assert check.status == FAIL
+        assert modify in check.detail
+
+
+class TestOutputDir:
+    """Test checking the download directory"""
+
+    def test_writable(self, tmp_path):
+        """A writable directory passes, even before it is created"""
+        check = check_output_dir(
+            DownloadConfig(base_dir=str(tmp_path / "downloads"), min_free_space=0)
+        )
+
+        assert check.status == OK
+        assert "created on the first download" in check.detail
+
+    def test_not_a_directory(self, tmp_path):
+        """A file where the directory should be fails"""
+        (tmp_path / "downloads").write_text("")
+
+        check = check_output_dir(
+            DownloadConfig(base_dir=str(tmp_path / "downloads" / "sub"))
+        )
+
+        assert check.status == FAIL
+
+    def test_remote(self):
+        """Remote storage is not checked"""
+        assert (
+            check_output_dir(DownloadConfig(base_dir="s3://bucket/prefix")).status
+            == SKIP
+        )
+
+
+class TestNetwork:
+    """Test reachability and clock skew"""
+
+    def date_probe(self, skew):
+        """A probe answering with Google's clock skew seconds behind NOW"""
+        google_time = NOW - timedelta(seconds=skew)
+        return lambda url: {"Date": google_time.strftime("%a, %d %b %Y %H:%M:%S GMT")}
+
+    def test_clock_in_sync(self):
+        """A reachable host with a matching clock passes both"""
+        network, clock = check_network(self.date_probe(2), lambda: NOW)
+
+        assert network.status == OK
+        assert clock.status == OK
+
+    def test_clock_skew(self):
+        """Skew warns past 30 seconds and fails past 5 minutes"""
+        assert check_network(self.date_probe(60), lambda: NOW)[1].status == WARN
+        clock = check_network(self.date_probe(-600), lambda: NOW)[1]
+        assert clock.status == FAIL
+        assert "600s behind Google" in clock.detail
+
+    def test_unreachable(self):
+        """A connection error fails, pointing at the proxy settings"""
+
+        def probe(url):
+            raise OSError("Network is unreachable")
+
+        network, clock = check_network(probe)
+
+        assert network.status == FAIL
+        assert "proxy_url" in network.fix
+        assert clock.status == SKIP
+
+
+class TestApi:
+    """Test the live API check"""
+
+    async def test_signed_in(self):
+        """A working client reports the account"""
+        fake = FakeGmail("me@example.com")
+
+        with patch("gmail_downloader.doctor.create_client", return_value=fake.client()):
+            check = await check_api(AppConfig())
+
+        assert check.status == OK
+        assert "me@example.com" in check.detail
+
+    async def test_api_disabled(self):
+        """A project without the Gmail API gets the link to enable it"""
+
+        class DisabledClient:
+            async def authenticate(self, interactive=True):
+                pass
+
+            async def get_user_profile(self):
+                raise GmailError(
+                    "Failed to get user profile: <HttpError 403 ... reason: "
+                    "accessNotConfigured>"
+                )
+
+        with patch(
+            "gmail_downloader.doctor.create_client", return_value=DisabledClient()
+        ):
+            check = await check_api(AppConfig())
+
+        assert check.status == FAIL
+        assert "console.cloud.google.com/apis/library/gmail.googleapis.com" in check.fix
@@ -2,8 +2,48 @@
 Tests for downloader module
 """
 
+import asyncio
+import errno
+import hashlib
+import json
+import os
+from datetime import datetime, timedelta, timezone
+from pathlib import Path
+
 import pytest
-from gmail_downloader.downloader import *
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import (
+    ANOMALY_RECOVERED_RAW,
+    ANOMALY_SIZE_MISMATCH,
+    STATUS_EXISTS,
+    STATUS_NEW,
+    STATUS_UPDATED,
+    XATTR_PREFIX,
+    AttachmentDownloader,
+    AttachmentStats,
+    BandwidthLimiter,
+    DownloadService,
+    EmailWatcher,
+    PlannedDownload,
+    aggregate_planned,
+    disambiguate_filenames,
+    file_metadata,
+    fit_path_length,
+    is_numbered_variant,
+    latest_per_thread,
+    limit_path_depth,
+    numbered_variants,
+    sort_planned,
+    versioned_key,
+)
+from gmail_downloader.drive import DriveError
+from gmail_downloader.gmail_client import GmailAttachmentError
+from gmail_downloader.manifest import DownloadManifest, ManifestEntry
+from gmail_downloader.scanner import VERDICT_CLEAN, ScanError
+from gmail_downloader.storage import LocalStorage, StorageError
+
+from tests.gmailtest import FakeGmail
+
 
 class TestDownloader:
     """Test cases for downloader"""
@@ -13,3 +53,2401 @@ class TestDownloader:
         assert True
         
     # TODO: Add more tests
+
+
+class TestCompareWithExisting:
+    """Test dry-run sync status classification"""
+    
+    def make_entry(self, path, size):
+        """Build a manifest entry for the given relative path"""
+        return ManifestEntry(
+            message_id="msg1",
+            attachment_id="att1",
+            filename="report.pdf",
+            path=path,
+            size=size,
+            sha256="",
+        )
+    
+    def test_missing_file_is_new(self, tmp_path):
+        """Nothing on disk means the file is new"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        assert downloader.compare_with_existing(tmp_path / "a.pdf", 10) == STATUS_NEW
+    
+    def test_same_size_without_manifest_exists(self, tmp_path):
+        """Without a manifest, a matching size counts as already downloaded"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        path = tmp_path / "a.pdf"
+        path.write_bytes(b"x" * 10)
+        
+        assert downloader.compare_with_existing(path, 10) == STATUS_EXISTS
+        assert downloader.compare_with_existing(path, 11) == STATUS_UPDATED
+    
+    def test_manifest_entry_matches(self, tmp_path):
+        """A manifest entry for the same path and size means EXISTS"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        path = tmp_path / "a.pdf"
+        path.write_bytes(b"x" * 10)
+        
+        entry = self.make_entry("a.pdf", 10)
+        assert downloader.compare_with_existing(path, 999, entry) == STATUS_EXISTS
+    
+    def test_manifest_entry_changed_on_disk(self, tmp_path):
+        """A local file that no longer matches the manifest is UPDATED"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        path = tmp_path / "a.pdf"
+        path.write_bytes(b"x" * 12)
+        
+        entry = self.make_entry("a.pdf", 10)
+        assert downloader.compare_with_existing(path, 10, entry) == STATUS_UPDATED
+    
+    def test_summarize_counts(self):
+        """Summary counts each status"""
+        planned = [
+            PlannedDownload(None, None, Path("a"), STATUS_NEW),
+            PlannedDownload(None, None, Path("b"), STATUS_NEW),
+            PlannedDownload(None, None, Path("c"), STATUS_EXISTS),
+        ]
+        counts = DownloadService.summarize(planned)
+        
+        assert counts == {STATUS_NEW: 2, STATUS_UPDATED: 0, STATUS_EXISTS: 1}
+
+
+class FakeAttachment:
+    """Minimal stand-in for gmail_client.EmailAttachment"""
+    
+    def __init__(self, attachment_id, filename, size=0, part_id=""):
+        self.attachment_id = attachment_id
+        self.filename = filename
+        self.size = size
+        self.part_id = part_id
+        self.mime_type = "application/octet-stream"
+
+
+class FakeMessage:
+    """Minimal stand-in for gmail_client.EmailMessage"""
+    
+    def __init__(self, message_id, sender="reports@company.com"):
+        self.message_id = message_id
+        self.thread_id = f"thread-{message_id}"
+        self.sender = sender
+        self.sender_name = ""
+        self.subject = "Daily export"
+        self.date = datetime(2024, 6, 1)
+        self.labels = ["INBOX", "client-X"]
+
+
+class FakeGmailClient:
+    """Serves fixed attachment data without talking to Gmail"""
+    
+    def __init__(self, files):
+        # {(message_id, attachment_id): (filename, data)}, in part order
+        self.files = files
+        self.searches = []
+    
+    def build_search_query(self, **kwargs):
+        return "has:attachment"
+    
+    async def snapshot_message_ids(self, query):
+        return {message_id async for message_id in self.search_messages(query)}
+    
+    async def search_messages(self, query, max_results=None, include_spam_trash=False):
+        self.searches.append((query, include_spam_trash))
+        for message_id in dict.fromkeys(mid for mid, _ in self.files):
+            yield message_id
+    
+    async def get_message_details(self, message_id):
+        return FakeMessage(message_id)
+    
+    async def get_message_attachments(self, message_id):
+        return [
+            FakeAttachment(attachment_id, filename, len(data), str(index))
+            for index, (
+                (mid, attachment_id), (filename, data)
+            ) in enumerate(self.files.items())
+            if mid == message_id
+        ]
+    
+    async def download_attachment(self, message_id, attachment_id):
+        return self.files[(message_id, attachment_id)][1]
+    
+    async def get_message_bodies(self, message_id):
+        return {"text": f"Body of {message_id}", "html": f"<p>Body of {message_id}</p>"}
+    
+    async def get_raw_message(self, message_id):
+        return f"Subject: Daily export\r\n\r\nBody of {message_id}".encode()
+
+
+class FakeDrive:
+    """Serves linked Drive files without talking to Drive"""
+    
+    def __init__(self, files):
+        # {file_id: (DriveFile or None, data)}
+        self.files = files
+    
+    async def get_file(self, file_id):
+        if file_id not in self.files:
+            raise DriveError(f"Cannot read Drive file {file_id}")
+        return self.files[file_id][0]
+    
+    async def download(
+        self, file_id, partial=None, chunk_size=None, key="", on_progress=None
+    ):
+        return self.files[file_id][1]
+
+
+class TestDriveLinks:
+    """Test downloading Drive files linked in message bodies"""
+    
+    DOC_ID = "1AbCdEfGhIjKlMnOpQrStUvWxYz012345"
+    PDF_ID = "1ZyXwVuTsRqPoNmLkJiHgFeDcBa543210"
+    
+    def make_service(self, tmp_path, body):
+        """Service for one message whose body is given, with drive_links on"""
+        from gmail_downloader.drive import DriveFile
+        
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.drive_links = True
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        
+        async def get_message_bodies(message_id):
+            return {"text": body}
+        
+        client.get_message_bodies = get_message_bodies
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        service.drive = FakeDrive(
+            {
+                self.DOC_ID: (
+                    DriveFile(
+                        self.DOC_ID,
+                        "Q3 plan",
+                        "application/vnd.google-apps.document",
+                        export_format="docx",
+                    ),
+                    b"docx bytes",
+                ),
+                self.PDF_ID: (
+                    DriveFile(self.PDF_ID, "scan.pdf", "application/pdf", size=9),
+                    b"scan data",
+                ),
+            }
+        )
+        return service
+    
+    async def test_linked_files_downloaded_with_attachments(self, tmp_path):
+        """Linked files land in the same folder and are recorded as drive: entries"""
+        service = self.make_service(tmp_path, (
+            f"Plan: https://docs.google.com/document/d/{self.DOC_ID}/edit\n"
+            f"Scan: https://drive.google.com/file/d/{self.PDF_ID}/view?usp=sharing"
+        ))
+        
+        planned = await service.plan()
+        assert [item.filename for item in planned] == [
+            "report.pdf", "Q3 plan.docx", "scan.pdf"
+        ]
+        
+        await service.execute(planned)
+        
+        assert (tmp_path / "reports" / "Q3 plan.docx").read_bytes() == b"docx bytes"
+        assert (tmp_path / "reports" / "scan.pdf").read_bytes() == b"scan data"
+        entry = DownloadManifest(tmp_path).load().get("m1", "Q3 plan.docx")
+        assert entry.attachment_id == f"drive:{self.DOC_ID}"
+    
+    async def test_unreadable_link_skipped(self, tmp_path):
+        """A link not shared with the account does not stop the message"""
+        service = self.make_service(
+            tmp_path, "https://drive.google.com/open?id=1NotSharedWithThisAccount000000"
+        )
+        
+        planned = await service.plan()
+        
+        assert [item.filename for item in planned] == ["report.pdf"]
+    
+    async def test_extension_filter_applies(self, tmp_path):
+        """Linked files go through the same extension filter as attachments"""
+        service = self.make_service(tmp_path, (
+            f"https://docs.google.com/document/d/{self.DOC_ID}/edit "
+            f"https://drive.google.com/file/d/{self.PDF_ID}/view"
+        ))
+        service.config.filters.extensions = [".pdf"]
+        
+        planned = await service.plan()
+        
+        assert [item.filename for item in planned] == ["report.pdf", "scan.pdf"]
+
+
+class TestConversions:
+    """Test exporting attachments that only reference a Google file"""
+    
+    async def test_stub_replaced_by_export(self, tmp_path):
+        """A .gsheet stub is saved as the sheet exported to CSV"""
+        from gmail_downloader.drive import DriveFile
+        
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.filters.extensions = [".csv"]
+        config.conversions = {"spreadsheet": "csv"}
+        stub = (
+            b'{"url": "https://docs.google.com/spreadsheets/d/x", "doc_id": "sheet1"}'
+        )
+        client = FakeGmailClient({
+            ("m1", "a1"): ("Budget.gsheet", stub),
+            ("m1", "a2"): ("notes.csv", b"a,b"),
+        })
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        service.drive = FakeDrive(
+            {
+                "sheet1": (
+                    DriveFile(
+                        "sheet1",
+                        "Budget",
+                        "application/vnd.google-apps.spreadsheet",
+                        export_format="csv",
+                    ),
+                    b"q,amount\n3,100",
+                ),
+            }
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert len(saved) == 2
+        assert (tmp_path / "reports" / "Budget.csv").read_bytes() == b"q,amount\n3,100"
+        assert not (tmp_path / "reports" / "Budget.gsheet").exists()
+    
+    async def test_unresolvable_stub_kept(self, tmp_path):
+        """A stub whose file cannot be read is kept as it is"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.filters.extensions = []
+        config.conversions = {"spreadsheet": "csv"}
+        client = FakeGmailClient(
+            {("m1", "a1"): ("Budget.gsheet", b'{"doc_id": "gone"}')}
+        )
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        service.drive = FakeDrive({})
+        
+        planned = await service.plan()
+        
+        assert [item.filename for item in planned] == ["Budget.gsheet"]
+    
+    def test_search_finds_stubs_without_widening(self, tmp_path):
+        """Conversions add the stub names to the search, not messages linking files"""
+        config = AppConfig()
+        config.filters.extensions = [".csv"]
+        config.filters.min_size = 1024
+        config.conversions = {"spreadsheet": "csv"}
+        client = FakeGmailClient({})
+        searched = {}
+        client.build_search_query = lambda **kwargs: searched.update(kwargs) or ""
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        service.build_query()
+        
+        assert not searched["drive_links"]
+        assert ".csv" in searched["extensions"] and ".gsheet" in searched["extensions"]
+        assert searched["min_size"] is None
+    
+    def test_drive_export_formats_still_used(self, tmp_path):
+        """drive_export_formats apply to linked files, under conversions"""
+        config = AppConfig()
+        config.download.drive_links = True
+        config.download.drive_export_formats = {"spreadsheet": "ods", "document": "odt"}
+        config.conversions = {"document": "pdf"}
+        service = DownloadService(
+            FakeGmailClient({}),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        assert service.drive.export_formats["spreadsheet"] == "ods"
+        assert service.drive.export_formats["document"] == "pdf"
+
+
+class TestRefetch:
+    """Test re-downloading entries selected from the manifest"""
+    
+    async def test_refetch_overwrites_recorded_path(self, tmp_path):
+        """Refetch uses the fresh attachment ID and updates size and hash"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(ManifestEntry(
+            message_id="m1",
+            attachment_id="stale-id",
+            filename="data.csv",
+            path="vendor/data.csv",
+            size=3,
+            sha256="old",
+        ))
+        (tmp_path / "vendor").mkdir()
+        (tmp_path / "vendor" / "data.csv").write_bytes(b"bad")
+        
+        client = FakeGmailClient({("m1", "fresh-id"): ("data.csv", b"good data")})
+        service = DownloadService(client, downloader, manifest, AppConfig())
+        
+        saved = await service.refetch(list(manifest))
+        
+        assert saved == [tmp_path / "vendor" / "data.csv"]
+        assert saved[0].read_bytes() == b"good data"
+        entry = DownloadManifest(tmp_path).load().get("m1", "data.csv")
+        assert entry.attachment_id == "fresh-id"
+        assert entry.size == len(b"good data")
+    
+    async def test_refetch_drive_file(self, tmp_path):
+        """A file saved from a Drive link is downloaded from Drive again by its ID"""
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(ManifestEntry(
+            message_id="m1", attachment_id="drive:doc-1", filename="Budget.xlsx",
+            path="vendor/Budget.xlsx", size=3, sha256="old",
+        ))
+        config = AppConfig()
+        config.download.drive_links = True
+        service = DownloadService(
+            FakeGmailClient({}), AttachmentDownloader(str(tmp_path)), manifest, config
+        )
+        service.drive = FakeDrive({"doc-1": (None, b"sheet data")})
+        
+        saved = await service.refetch(list(manifest))
+        
+        assert saved == [tmp_path / "vendor" / "Budget.xlsx"]
+        assert saved[0].read_bytes() == b"sheet data"
+        assert (
+            DownloadManifest(tmp_path).load().get("m1", "Budget.xlsx").attachment_id
+            == "drive:doc-1"
+        )
+    
+    async def test_refetch_drive_file_needs_drive(self, tmp_path):
+        """Without Drive access a Drive file is reported as not re-downloaded"""
+        import logging
+        from unittest.mock import patch
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(ManifestEntry(
+            message_id="m1", attachment_id="drive:doc-1", filename="Budget.xlsx",
+            path="vendor/Budget.xlsx", size=3, sha256="old",
+        ))
+        service = DownloadService(
+            FakeGmailClient({}),
+            AttachmentDownloader(str(tmp_path)),
+            manifest,
+            AppConfig(),
+        )
+        
+        with patch.object(
+            logging.getLogger("gmail_downloader.downloader"), "warning"
+        ) as warning:
+            saved = await service.refetch(list(manifest))
+        
+        assert saved == []
+        assert "came from Drive" in warning.call_args[0][0]
+    
+    async def test_refetch_skips_missing_attachment(self, tmp_path):
+        """
+        An attachment gone from its message is not fetched
+        by its stale ID; earlier entries stay saved
+        """
+        downloader = AttachmentDownloader(str(tmp_path))
+        manifest = DownloadManifest(tmp_path)
+        for message_id in ("m1", "m2", "m3"):
+            manifest.record(ManifestEntry(
+                message_id=message_id, attachment_id="stale-id", filename="data.csv",
+                path=f"vendor/{message_id}.csv", size=3, sha256="old",
+            ))
+        client = FakeGmailClient({
+            ("m1", "fresh-id"): ("data.csv", b"good data"),
+            ("m2", "stale-id"): ("other.csv", b"other"),
+            ("m3", "a3"): ("data.csv", b"x"),
+        })
+        service = DownloadService(client, downloader, manifest, AppConfig())
+        fetch = service.fetch
+        
+        async def failing_fetch(message_id, attachment_id):
+            if message_id == "m3":
+                raise GmailAttachmentError("Failed to download attachment: timed out")
+            return await fetch(message_id, attachment_id)
+        
+        service.fetch = failing_fetch
+        with pytest.raises(GmailAttachmentError):
+            await service.refetch(list(manifest))
+        
+        assert not (tmp_path / "vendor" / "m2.csv").exists()
+        assert (
+            DownloadManifest(tmp_path).load().get("m1", "data.csv").attachment_id
+            == "fresh-id"
+        )
+
+
+class TestDisambiguateFilenames:
+    """Test unique naming of same-named attachments within one message"""
+    
+    def test_unique_names_unchanged(self):
+        """Distinct names are left alone"""
+        attachments = [FakeAttachment("a", "a.csv"), FakeAttachment("b", "b.csv")]
+        assert disambiguate_filenames(attachments) == ["a.csv", "b.csv"]
+    
+    def test_duplicates_get_part_suffix(self):
+        """Later duplicates are suffixed with their MIME part ID"""
+        attachments = [
+            FakeAttachment("a", "data.csv", part_id="1"),
+            FakeAttachment("b", "data.csv", part_id="2"),
+            FakeAttachment("c", "data.csv", part_id="3.1"),
+        ]
+        assert disambiguate_filenames(attachments) == [
+            "data.csv", "data_part2.csv", "data_part3-1.csv"
+        ]
+    
+    def test_falls_back_to_position(self):
+        """Without part IDs the attachment position is used"""
+        attachments = [FakeAttachment("a", "data.csv"), FakeAttachment("b", "data.csv")]
+        assert disambiguate_filenames(attachments) == ["data.csv", "data_part1.csv"]
+    
+    def test_names_that_sanitize_alike_collide(self):
+        """Names that would land on the same path are treated as duplicates"""
+        attachments = [
+            FakeAttachment("a", "Report:Q1.pdf", part_id="1"),
+            FakeAttachment("b", "report_q1.pdf", part_id="2"),
+        ]
+        assert disambiguate_filenames(attachments)[1] == "report_q1_part2.pdf"
+    
+    def test_native_names_distinct_when_kept(self):
+        """Names in other scripts only collide when ASCII folding erases them"""
+        attachments = [
+            FakeAttachment("a", "報告.pdf", part_id="1"),
+            FakeAttachment("b", "契約.pdf", part_id="2"),
+        ]
+        
+        assert disambiguate_filenames(attachments, "keep") == ["報告.pdf", "契約.pdf"]
+        assert disambiguate_filenames(attachments, "ascii")[1] == "契約_part2.pdf"
+
+
+class TestPlanAndExecute:
+    """Test planning and downloading through the service"""
+    
+    async def test_same_name_attachments_both_saved(self, tmp_path):
+        """Two data.csv files in one message are saved side by side"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        downloader = AttachmentDownloader(str(tmp_path))
+        manifest = DownloadManifest(tmp_path)
+        client = FakeGmailClient({
+            ("m1", "a1"): ("data.csv", b"first file"),
+            ("m1", "a2"): ("data.csv", b"second file"),
+        })
+        service = DownloadService(client, downloader, manifest, config)
+        
+        planned = await service.plan()
+        assert [item.filename for item in planned] == ["data.csv", "data_part1.csv"]
+        
+        saved = await service.execute(planned)
+        
+        assert sorted(p.read_bytes() for p in saved) == [b"first file", b"second file"]
+        assert len(DownloadManifest(tmp_path).load()) == 2
+    
+    async def test_download_listeners_called(self, tmp_path):
+        """Listeners receive the manifest entry and path of each saved file"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        received = []
+        
+        async def listener(entry, path):
+            received.append((entry.filename, path))
+        
+        service.download_listeners.append(listener)
+        await service.execute(await service.plan())
+        
+        assert received == [("report.pdf", tmp_path / "reports" / "report.pdf")]
+    
+    async def test_failing_listener(self, tmp_path):
+        """
+        A listener that fails neither fails the file
+        nor the others, and the manifest is saved
+        """
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        received = []
+        
+        async def broken(entry, path):
+            raise RuntimeError("integration down")
+        
+        async def listener(entry, path):
+            received.append(entry.filename)
+        
+        service.download_listeners.extend([broken, listener])
+        saved = await service.execute(await service.plan())
+        
+        assert [path.name for path in saved] == ["report.pdf"]
+        assert service.failed == []
+        assert received == ["report.pdf"]
+        assert len(DownloadManifest(tmp_path).load()) == 1
+    
+    async def test_failed_large_attachment_kept(self, tmp_path):
+        """A large attachment whose save failed is not downloaded again next time"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.resume_chunk_size = 4
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        downloads = []
+        download_attachment = client.download_attachment
+        
+        async def counting(message_id, attachment_id):
+            downloads.append(attachment_id)
+            return await download_attachment(message_id, attachment_id)
+        
+        client.download_attachment = counting
+        downloader = AttachmentDownloader(str(tmp_path))
+        service = DownloadService(
+            client, downloader, DownloadManifest(tmp_path), config
+        )
+        save_new = downloader.save_new
+        
+        async def failing(path, data):
+            raise OSError("storage unavailable")
+        
+        downloader.save_new = failing
+        await service.execute(await service.plan())
+        downloader.save_new = save_new
+        saved = await service.execute(await service.plan())
+        
+        assert [path.read_bytes() for path in saved] == [b"pdf bytes"]
+        assert downloads == ["a1"]
+        assert not list((tmp_path / ".gmail_downloader_partial").glob("*.downloading"))
+    
+    async def test_timed_out_attachment_fails_alone(self, tmp_path):
+        """An attachment whose connection timed out fails; the others are saved"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({
+            ("m1", "a1"): ("report.pdf", b"pdf bytes"),
+            ("m2", "a2"): ("other.pdf", b"other bytes"),
+        })
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        download_attachment = client.download_attachment
+        
+        async def stuck_once(message_id, attachment_id):
+            if attachment_id == "a1":
+                raise GmailAttachmentError("Failed to download attachment: timed out")
+            return await download_attachment(message_id, attachment_id)
+        
+        client.download_attachment = stuck_once
+        saved = await service.execute(await service.plan())
+        
+        assert [path.name for path in saved] == ["other.pdf"]
+        assert "timed out" in service.failed[0].error
+    
+    def test_raw_query_replaces_filters(self, tmp_path):
+        """A configured raw query is used instead of the structured filters"""
+        config = AppConfig()
+        config.filters.query = 'from:reports@vendor.com subject:"daily export"'
+        service = DownloadService(
+            FakeGmailClient({}),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        assert service.build_query() == 'from:reports@vendor.com subject:"daily export"'
+    
+    async def test_raw_query_keeps_client_side_filters(self, tmp_path):
+        """Extension and size limits still apply to results of a raw query"""
+        config = AppConfig()
+        config.filters.query = "from:reports@vendor.com"
+        config.filters.extensions = [".pdf"]
+        config.filters.min_size = 1
+        client = FakeGmailClient({
+            ("m1", "a1"): ("report.pdf", b"pdf bytes"),
+            ("m1", "a2"): ("notes.txt", b"text"),
+        })
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        planned = await service.plan()
+        
+        assert client.searches == [("from:reports@vendor.com", False)]
+        assert [item.filename for item in planned] == ["report.pdf"]
+    
+    async def test_plan_with_custom_query(self, tmp_path):
+        """A custom query and Spam/Trash scope are passed through to the search"""
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            AppConfig(),
+        )
+        
+        await service.plan(query="has:attachment in:trash", include_spam_trash=True)
+        
+        assert client.searches == [("has:attachment in:trash", True)]
+    
+    async def test_label_snapshot_recorded(self, tmp_path):
+        """The message's labels at download time are stored in the manifest"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        await service.execute(await service.plan())
+        
+        manifest = DownloadManifest(tmp_path).load()
+        assert manifest.get("m1", "report.pdf").labels == ["INBOX", "client-X"]
+        assert len(manifest.query("labels=client-x")) == 1
+
+
+class TestUniqueNames:
+    """Test that concurrent and repeated downloads never overwrite each other"""
+    
+    def test_numbered_variants(self):
+        """Variants count up before the extension"""
+        variants = numbered_variants("reports/a.pdf")
+        
+        assert [next(variants) for _ in range(3)] == [
+            "reports/a.pdf", "reports/a_1.pdf", "reports/a_2.pdf"
+        ]
+        assert is_numbered_variant("reports/a_12.pdf", "reports/a.pdf")
+        assert not is_numbered_variant("reports/a_b.pdf", "reports/a.pdf")
+        assert not is_numbered_variant("other/a_1.pdf", "reports/a.pdf")
+    
+    def test_versioned_keys(self):
+        """Version dates go before the extension and count as variants"""
+        assert versioned_key(
+            "reports/sales.csv", "2024-06-01"
+        ) == "reports/sales_2024-06-01.csv"
+        assert is_numbered_variant("reports/sales_2024-06-01.csv", "reports/sales.csv")
+        assert is_numbered_variant(
+            "reports/sales_2024-06-01_1.csv", "reports/sales.csv"
+        )
+        assert not is_numbered_variant("reports/sales_June.csv", "reports/sales.csv")
+    
+    async def test_concurrent_reservations_are_distinct(self, tmp_path):
+        """Workers racing for one name each get their own"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        path = tmp_path / "reports" / "a.pdf"
+        
+        reserved = await asyncio.gather(
+            *(downloader.reserve_path(path) for _ in range(5))
+        )
+        
+        assert len(set(reserved)) == 5
+        assert reserved[0] == path
+    
+    async def test_file_created_by_another_process(self, tmp_path):
+        """A file that appeared after planning is not overwritten"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        (tmp_path / "a.pdf").write_bytes(b"theirs")
+        
+        saved = await downloader.save_new(tmp_path / "a.pdf", b"ours")
+        
+        assert saved == tmp_path / "a_1.pdf"
+        assert (tmp_path / "a.pdf").read_bytes() == b"theirs"
+    
+    async def test_failed_write_releases_name(self, tmp_path):
+        """No empty placeholder is left behind when writing fails"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        
+        async def broken(path, data):
+            raise OSError("disk full")
+        
+        downloader.write_file = broken
+        with pytest.raises(OSError):
+            await downloader.save_new(tmp_path / "a.pdf", b"data")
+        
+        assert not (tmp_path / "a.pdf").exists()
+    
+    async def test_cancelled_write_releases_name(self, tmp_path):
+        """A download cancelled before writing leaves no empty placeholder"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        
+        async def interrupted(path, data):
+            raise asyncio.CancelledError()
+        
+        downloader.write_file = interrupted
+        with pytest.raises(asyncio.CancelledError):
+            await downloader.save_new(tmp_path / "a.pdf", b"data")
+        
+        assert not (tmp_path / "a.pdf").exists()
+        assert not downloader._reserved
+    
+    async def test_saved_names_leave_registry(self, tmp_path):
+        """Once written, a name is guarded by the file itself, not the registry"""
+        downloader = AttachmentDownloader(str(tmp_path))
+        
+        first = await downloader.save_new(tmp_path / "a.pdf", b"one")
+        second = await downloader.save_new(tmp_path / "a.pdf", b"two")
+        
+        assert (first, second) == (tmp_path / "a.pdf", tmp_path / "a_1.pdf")
+        assert not downloader._reserved
+    
+    async def test_same_name_from_different_messages(self, tmp_path):
+        """Two messages sending report.pdf both keep their file, and stay downloaded"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({
+            ("m1", "a1"): ("report.pdf", b"first report"),
+            ("m2", "a2"): ("report.pdf", b"second report"),
+        })
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert [p.name for p in saved] == ["report.pdf", "report_1.pdf"]
+        assert (tmp_path / "reports" / "report_1.pdf").read_bytes() == b"second report"
+        
+        again = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path).load(),
+            config,
+        )
+        assert [
+            item.status for item in await again.plan()
+        ] == [STATUS_EXISTS, STATUS_EXISTS]
+
+
+class TestConflictPolicy:
+    """Test what happens when a different file is already at the destination"""
+    
+    async def run(self, tmp_path, policy, existing=b"older version", ask=None):
+        """Download report.pdf over an existing file; returns the saved paths"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.conflict_policy = policy
+        (tmp_path / "reports").mkdir()
+        (tmp_path / "reports" / "report.pdf").write_bytes(existing)
+        
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"new report")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        service.ask_conflict = ask
+        return await service.execute(await service.plan())
+    
+    async def test_skip(self, tmp_path):
+        """The existing file is left alone"""
+        assert await self.run(tmp_path, "skip") == []
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"older version"
+    
+    async def test_overwrite(self, tmp_path):
+        """The existing file is replaced"""
+        await self.run(tmp_path, "overwrite")
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"new report"
+    
+    async def test_rename(self, tmp_path):
+        """The download is saved next to the existing file"""
+        saved = await self.run(tmp_path, "rename")
+        
+        assert saved == [tmp_path / "reports" / "report_1.pdf"]
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"older version"
+    
+    async def test_version(self, tmp_path):
+        """The download is saved under its email date, and found there next time"""
+        saved = await self.run(tmp_path, "version")
+        
+        assert saved == [tmp_path / "reports" / "report_2024-06-01.pdf"]
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"older version"
+        
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"new report")})
+        again = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path).load(),
+            config,
+        )
+        assert [item.status for item in await again.plan()] == [STATUS_EXISTS]
+    
+    async def test_first_version_dated(self, tmp_path):
+        """The first copy is saved under its email date too, and found there later"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.conflict_policy = "version"
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"new report")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert saved == [tmp_path / "reports" / "report_2024-06-01.pdf"]
+        assert not (tmp_path / "reports" / "report.pdf").exists()
+        assert [item.status for item in await service.plan()] == [STATUS_EXISTS]
+    
+    async def test_identical_file_not_renamed(self, tmp_path):
+        """A re-sent identical file is recorded instead of saved again"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.conflict_policy = "rename"
+        (tmp_path / "reports").mkdir()
+        (tmp_path / "reports" / "report.pdf").write_bytes(b"new report")
+        
+        # The manifest knows the attachment from elsewhere, so the plan
+        # cannot tell the file is the same one
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(ManifestEntry(
+            message_id="m1", attachment_id="a1", filename="report.pdf",
+            path="archive/report.pdf", size=10, sha256="",
+        ))
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"new report")})
+        service = DownloadService(
+            client, AttachmentDownloader(str(tmp_path)), manifest, config
+        )
+        
+        planned = await service.plan()
+        assert planned[0].status == STATUS_UPDATED
+        
+        assert await service.execute(planned) == []
+        assert not (tmp_path / "reports" / "report_1.pdf").exists()
+        assert (
+            DownloadManifest(tmp_path).load().get("m1", "report.pdf").path
+            == "reports/report.pdf"
+        )
+    
+    async def test_ask(self, tmp_path):
+        """Under the ask policy the callback chooses"""
+        asked = []
+        
+        async def ask(item):
+            asked.append(item.filename)
+            return "rename"
+        
+        saved = await self.run(tmp_path, "ask", ask=ask)
+        
+        assert asked == ["report.pdf"]
+        assert saved == [tmp_path / "reports" / "report_1.pdf"]
+    
+    async def test_ask_without_anyone_to_ask(self, tmp_path):
+        """Non-interactive runs skip conflicts under the ask policy"""
+        assert await self.run(tmp_path, "ask") == []
+
+
+class TestSizeAnomalies:
+    """Test attachments whose downloaded size differs from the declared size"""
+    
+    def make_service(self, tmp_path, raw_data, raw_fallback=True):
+        """Service whose attachment API sends 5 of 9 declared bytes"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.raw_fallback = raw_fallback
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf b")})
+        
+        async def get_message_attachments(message_id):
+            return [FakeAttachment("a1", "report.pdf", 9, "1")]
+        
+        async def download_attachment_from_raw(message_id, part_id, filename):
+            return raw_data
+        
+        client.get_message_attachments = get_message_attachments
+        client.download_attachment_from_raw = download_attachment_from_raw
+        return DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+    
+    async def test_recovered_from_raw_message(self, tmp_path):
+        """A matching copy from the raw message replaces the clipped download"""
+        service = self.make_service(tmp_path, b"pdf bytes")
+        
+        await service.execute(await service.plan())
+        
+        entry = DownloadManifest(tmp_path).load().get("m1", "report.pdf")
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"pdf bytes"
+        assert entry.anomaly == ANOMALY_RECOVERED_RAW
+        assert entry.declared_size == 9
+        assert service.size_anomalies == [entry]
+    
+    async def test_unresolved_mismatch_recorded(self, tmp_path):
+        """Without a usable fallback the file is kept and flagged in the manifest"""
+        service = self.make_service(tmp_path, None)
+        
+        await service.execute(await service.plan())
+        
+        manifest = DownloadManifest(tmp_path).load()
+        assert manifest.get("m1", "report.pdf").size == 5
+        assert len(manifest.query("anomaly=size_mismatch")) == 1
+    
+    async def test_fallback_disabled(self, tmp_path):
+        """raw_fallback off skips the extra fetch"""
+        service = self.make_service(tmp_path, b"pdf bytes", raw_fallback=False)
+        
+        await service.execute(await service.plan())
+        
+        assert service.size_anomalies[0].anomaly == ANOMALY_SIZE_MISMATCH
+
+
+class TestBandwidthLimiter:
+    """Test the shared download throttle"""
+    
+    def make_limiter(self, rate):
+        """Limiter on a fake clock that records sleeps instead of waiting"""
+        clock = {"now": 0.0}
+        sleeps = []
+        
+        async def sleep(seconds):
+            sleeps.append(seconds)
+            clock["now"] += seconds
+        
+        limiter = BandwidthLimiter(rate, clock=lambda: clock["now"], sleep=sleep)
+        return limiter, clock, sleeps
+    
+    async def test_spaces_out_downloads(self):
+        """Back-to-back downloads wait for the bytes before them"""
+        limiter, clock, sleeps = self.make_limiter(100)
+        
+        await limiter.acquire(50)
+        await limiter.acquire(100)
+        await limiter.acquire(10)
+        
+        assert sleeps == [0.5, 1.0]
+    
+    async def test_idle_time_is_not_banked(self):
+        """After a quiet period the next download starts immediately"""
+        limiter, clock, sleeps = self.make_limiter(100)
+        
+        await limiter.acquire(100)
+        clock["now"] += 10
+        await limiter.acquire(100)
+        
+        assert sleeps == []
+    
+    async def test_concurrent_workers_share_the_limit(self):
+        """Reservations are made before sleeping, so workers queue behind each other"""
+        sleeps = []
+        
+        async def sleep(seconds):
+            sleeps.append(seconds)  # All workers start at the same moment
+        
+        limiter = BandwidthLimiter(100, clock=lambda: 0.0, sleep=sleep)
+        await asyncio.gather(*(limiter.acquire(100) for _ in range(3)))
+        
+        assert sorted(sleeps) == [1.0, 2.0]
+    
+    def test_service_uses_config(self, tmp_path):
+        """download.max_bandwidth enables the limiter"""
+        config = AppConfig()
+        config.download.max_bandwidth = "1KB/s"
+        service = DownloadService(
+            FakeGmailClient({}),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        assert service.bandwidth.bytes_per_second == 1024
+
+
+class TestSaveMessageContent:
+    """Test saving email bodies and .eml files with the attachments"""
+    
+    async def test_body_and_eml_saved_once_per_message(self, tmp_path):
+        """Two attachments from one message produce one set of body files"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.save_body = True
+        config.download.save_eml = True
+        client = FakeGmailClient({
+            ("m1", "a1"): ("data.csv", b"first"),
+            ("m1", "a2"): ("schema.pdf", b"second"),
+        })
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        await service.execute(await service.plan())
+        folder = tmp_path / "reports"
+        
+        assert sorted(p.name for p in folder.iterdir()) == [
+            "2024-06-01_m1.eml", "2024-06-01_m1.html", "2024-06-01_m1.txt",
+            "data.csv", "schema.pdf",
+        ]
+        assert (folder / "2024-06-01_m1.txt").read_text() == "Body of m1"
+        assert (folder / "2024-06-01_m1.eml").read_bytes().startswith(b"Subject:")
+    
+    async def test_recorded_and_not_read_again(self, tmp_path):
+        """
+        Saved bodies are in the manifest, so a later
+        attachment of the message does not fetch them again
+        """
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.save_body = True
+        config.download.save_eml = True
+        client = FakeGmailClient({("m1", "a1"): ("data.csv", b"first")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        await service.execute(await service.plan())
+        
+        entry = service.manifest.get("m1", "2024-06-01_m1.eml")
+        assert entry.path == "reports/2024-06-01_m1.eml"
+        assert entry.attachment_id == ""
+        
+        reads = []
+        client.get_raw_message = lambda message_id: reads.append(message_id)
+        client.get_message_bodies = lambda message_id: reads.append(message_id)
+        client.files[("m1", "a2")] = ("late.pdf", b"second")
+        saved = await service.execute(await service.plan())
+        
+        assert saved == [tmp_path / "reports" / "late.pdf"]
+        assert reads == []
+    
+    async def test_disabled_by_default(self, tmp_path):
+        """Without the options only attachments are saved"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("data.csv", b"first")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        await service.execute(await service.plan())
+        
+        assert [p.name for p in (tmp_path / "reports").iterdir()] == ["data.csv"]
+
+
+class FakeScanner:
+    """Flags data containing EICAR and fails on data containing broken"""
+    
+    async def scan(self, data, filename):
+        if b"broken" in data:
+            raise ScanError("clamd is not running")
+        return "Eicar-Signature" if b"EICAR" in data else VERDICT_CLEAN
+
+
+class TestScanning:
+    """Test malware scanning before files are saved"""
+    
+    def make_service(self, tmp_path, files):
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.save_eml = True
+        config.scan.quarantine_dir = str(tmp_path / "quarantine")
+        service = DownloadService(
+            FakeGmailClient(files), AttachmentDownloader(str(tmp_path / "out")),
+            DownloadManifest(tmp_path / "out"), config
+        )
+        service.scanner = FakeScanner()
+        return service
+    
+    async def test_flagged_file_quarantined(self, tmp_path):
+        """
+        Flagged files go to quarantine instead of the
+        downloads, with the verdict in the manifest
+        """
+        service = self.make_service(tmp_path, {
+            ("m1", "a1"): ("report.pdf", b"pdf bytes"),
+            ("m2", "a1"): ("invoice.pdf", b"EICAR"),
+        })
+        
+        saved = await service.execute(await service.plan())
+        
+        assert saved == [tmp_path / "out" / "reports" / "report.pdf"]
+        quarantined = tmp_path / "quarantine" / "malware" / "m2_invoice.pdf"
+        assert quarantined.read_bytes() == b"EICAR"
+        reason = json.loads(
+            (
+                tmp_path / "quarantine" / "malware" / "m2_invoice.pdf.reason.json"
+            ).read_text()
+        )
+        assert reason["reason"] == "malware"
+        assert reason["detail"] == "Eicar-Signature"
+        assert reason["message_id"] == "m2"
+        manifest = DownloadManifest(tmp_path / "out").load()
+        assert manifest.get("m1", "report.pdf").scan == VERDICT_CLEAN
+        flagged = manifest.get("m2", "invoice.pdf")
+        assert flagged.scan == "Eicar-Signature"
+        assert flagged.quarantine == str(quarantined)
+        assert flagged.quarantine_reason == "malware"
+        assert service.quarantined == [flagged]
+    
+    async def test_quarantined_not_downloaded_again(self, tmp_path):
+        """The next run treats a quarantined file as already handled"""
+        service = self.make_service(tmp_path, {("m1", "a1"): ("invoice.pdf", b"EICAR")})
+        await service.execute(await service.plan())
+        
+        again = self.make_service(tmp_path, {("m1", "a1"): ("invoice.pdf", b"EICAR")})
+        again.manifest.load()
+        
+        assert [item.status for item in await again.plan()] == [STATUS_EXISTS]
+    
+    async def test_flagged_eml_recorded(self, tmp_path):
+        """
+        A flagged .eml is quarantined and recorded
+        like an attachment, so it is not fetched again
+        """
+        service = self.make_service(
+            tmp_path, {("m1", "a1"): ("report.pdf", b"pdf bytes")}
+        )
+        
+        async def get_raw_message(message_id):
+            return b"Subject: report\r\n\r\nEICAR"
+        
+        service.gmail_client.get_raw_message = get_raw_message
+        await service.execute(await service.plan())
+        
+        [flagged] = service.quarantined
+        assert flagged.filename.endswith("_m1.eml")
+        assert flagged.quarantine_reason == "malware"
+        entry = DownloadManifest(tmp_path / "out").load().get("m1", flagged.filename)
+        assert entry.quarantine == flagged.quarantine
+    
+    async def test_second_hit_numbered(self, tmp_path):
+        """Quarantining a file of the same name again keeps the first"""
+        service = self.make_service(tmp_path, {})
+        entry = ManifestEntry(
+            message_id="m1",
+            attachment_id="a1",
+            filename="invoice.pdf",
+            path="reports/invoice.pdf",
+            size=5,
+            sha256="",
+        )
+        
+        first = await service.hold(entry, b"EICAR", "malware", "Eicar-Signature")
+        second = await service.hold(entry, b"EICAR again", "malware", "Eicar-Signature")
+        
+        assert (first.name, second.name) == ("m1_invoice.pdf", "m1_invoice_1.pdf")
+        assert first.read_bytes() == b"EICAR"
+        assert second.with_name(second.name + ".reason.json").exists()
+    
+    async def test_failed_scan_saves_nothing(self, tmp_path):
+        """
+        A file that could not be scanned is neither
+        saved nor recorded, so the next run retries it
+        """
+        service = self.make_service(tmp_path, {("m1", "a1"): ("report.pdf", b"broken")})
+        
+        assert await service.execute(await service.plan()) == []
+        assert len(service.manifest) == 0
+        assert not (tmp_path / "quarantine").exists()
+
+
+class TestQuarantine:
+    """Test holding back files that fail checks other than the scanner's"""
+    
+    def make_config(self, tmp_path, fake_config):
+        fake_config.filters.extensions = [".pdf"]
+        fake_config.download.base_dir = str(tmp_path / "out")
+        fake_config.scan.quarantine_dir = str(tmp_path / "quarantine")
+        return fake_config
+    
+    async def test_unsafe_filename(self, tmp_path, fake_config, make_service):
+        """
+        A name reaching out of its folder is quarantined with
+        the name it was sent with, and not fetched again
+        """
+        gmail = FakeGmail()
+        gmail.add_message("bi@acme.com", "Reports", {"../../report.pdf": b"pdf bytes"})
+        config = self.make_config(tmp_path, fake_config)
+        service = make_service(gmail, config)
+        
+        assert await service.execute(await service.plan()) == []
+        
+        folder = tmp_path / "quarantine" / "unsafe_filename"
+        assert [
+            path.name for path in sorted(folder.iterdir())
+        ] == ["m1_report.pdf", "m1_report.pdf.reason.json"]
+        reason = json.loads((folder / "m1_report.pdf.reason.json").read_text())
+        assert reason["original_filename"] == "../../report.pdf"
+        assert "traversal" in reason["detail"]
+        assert not (tmp_path / "out" / "reports").exists()
+        
+        again = make_service(gmail, config)
+        again.manifest.load()
+        assert [item.status for item in await again.plan()] == [STATUS_EXISTS]
+    
+    async def test_verification_failure_kept(self, tmp_path, fake_config, make_service):
+        """The data of a file that never verifies is kept, but the file is retried"""
+        gmail = FakeGmail()
+        gmail.add_message("bi@acme.com", "Reports", {"report.pdf": b"pdf bytes"})
+        storage = FlakyStorage(tmp_path / "out", bad_writes=5)
+        downloader = AttachmentDownloader(
+            str(tmp_path / "out"),
+            storage=storage,
+            verify_writes="size",
+            write_attempts=2,
+        )
+        service = make_service(
+            gmail, self.make_config(tmp_path, fake_config), downloader
+        )
+        
+        assert await service.execute(await service.plan()) == []
+        
+        assert len(service.failed) == 1
+        assert (
+            tmp_path / "quarantine" / "verify_failed" / "m1_report.pdf"
+        ).read_bytes() == b"pdf bytes"
+        assert len(service.manifest) == 0
+
+
+class FakeEncryptor:
+    """Stands in for encryption.Encryptor without running age"""
+    
+    method = "age"
+    suffix = ".age"
+    
+    async def encrypt(self, data):
+        return b"age:" + data[::-1]
+
+
+class TestEncryption:
+    """Test encrypting files before they are written"""
+    
+    async def test_saved_encrypted(self, tmp_path):
+        """
+        Files get the suffix and only ciphertext is
+        written; the manifest keeps the plaintext's size
+        """
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.save_body = True
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path), encryptor=FakeEncryptor()),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert saved == [tmp_path / "reports" / "report.pdf.age"]
+        assert saved[0].read_bytes() == b"age:setyb fdp"
+        assert (tmp_path / "reports" / "2024-06-01_m1.txt.age").exists()
+        entry = service.manifest.get("m1", "report.pdf")
+        assert (entry.size, entry.encrypted) == (9, "age")
+    
+    async def test_not_downloaded_again(self, tmp_path):
+        """An encrypted file counts as present despite its size, till Gmail's changes"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path), encryptor=FakeEncryptor()),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        await service.execute(await service.plan())
+        
+        assert [item.status for item in await service.plan()] == [STATUS_EXISTS]
+        
+        client.files[("m1", "a1")] = ("report.pdf", b"longer pdf bytes")
+        assert [item.status for item in await service.plan()] == [STATUS_UPDATED]
+    
+    async def test_first_version_dated(self, tmp_path):
+        """The first copy is saved under its email date too, and found there later"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.conflict_policy = "version"
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"new report")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert saved == [tmp_path / "reports" / "report_2024-06-01.pdf"]
+        assert not (tmp_path / "reports" / "report.pdf").exists()
+        assert [item.status for item in await service.plan()] == [STATUS_EXISTS]
+    
+    async def test_identical_file_not_renamed(self, tmp_path):
+        """A re-sent identical file is matched by manifest checksum, not ciphertext"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.conflict_policy = "rename"
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path), encryptor=FakeEncryptor()),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        await service.execute(await service.plan())
+        
+        client.files = {("m2", "a1"): ("report.pdf", b"pdf bytes")}
+        assert await service.execute(await service.plan()) == []
+        assert service.manifest.get("m2", "report.pdf").path == "reports/report.pdf.age"
+        
+        client.files = {("m3", "a1"): ("report.pdf", b"new report")}
+        assert len(await service.execute(await service.plan())) == 1
+        assert service.manifest.get("m3", "report.pdf").path != "reports/report.pdf.age"
+    
+    async def test_quarantined_encrypted(self, tmp_path):
+        """Quarantined files are encrypted too"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.scan.quarantine_dir = str(tmp_path / "quarantine")
+        client = FakeGmailClient({("m1", "a1"): ("../../report.pdf", b"pdf bytes")})
+        downloader = AttachmentDownloader(
+            str(tmp_path / "out"), encryptor=FakeEncryptor()
+        )
+        service = DownloadService(
+            client, downloader, DownloadManifest(tmp_path / "out"), config
+        )
+        
+        await service.execute(await service.plan())
+        
+        held = tmp_path / "quarantine" / "unsafe_filename" / "m1_report.pdf.age"
+        assert held.read_bytes() == b"age:setyb fdp"
+        assert not (
+            tmp_path / "quarantine" / "unsafe_filename" / "m1_report.pdf"
+        ).exists()
+
+
+class TestExtensionFixes:
+    """Test renaming files whose contents say they are something else"""
+    
+    def make_service(self, tmp_path, mode):
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.filters.extensions = [".dat", ".pdf"]
+        config.download.fix_extensions = mode
+        client = FakeGmailClient({
+            ("m1", "a1"): ("export.dat", b"id,amount\n1,10\n2,20\n"),
+            ("m1", "a2"): ("invoice.pdf", b"%PDF-1.7"),
+        })
+        return DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+    
+    async def test_renamed(self, tmp_path):
+        """
+        The detected extension is appended or replaces
+        the old one; the manifest keeps the sent name
+        """
+        service = self.make_service(tmp_path / "append", "append")
+        assert [
+            path.name for path in await service.execute(await service.plan())
+        ] == ["export.dat.csv", "invoice.pdf"]
+        
+        service = self.make_service(tmp_path / "replace", "replace")
+        saved = await service.execute(await service.plan())
+        
+        assert [path.name for path in saved] == ["export.csv", "invoice.pdf"]
+        entry = service.manifest.get("m1", "export.dat")
+        assert (entry.path, entry.detected) == ("reports/export.csv", ".csv")
+        assert service.manifest.get("m1", "invoice.pdf").detected == ""
+    
+    async def test_not_downloaded_again(self, tmp_path):
+        """The next run finds the renamed file"""
+        service = self.make_service(tmp_path, "replace")
+        await service.execute(await service.plan())
+        
+        assert [
+            item.status for item in await service.plan()
+        ] == [STATUS_EXISTS, STATUS_EXISTS]
+    
+    async def test_off_by_default(self, tmp_path):
+        """Without download.fix_extensions files keep the name they were sent with"""
+        service = self.make_service(tmp_path, None)
+        
+        assert [
+            path.name for path in await service.execute(await service.plan())
+        ] == ["export.dat", "invoice.pdf"]
+
+
+class TestFileMetadata:
+    """Test provenance stored alongside downloaded files"""
+    
+    async def download(self, tmp_path, file_metadata):
+        """Download one attachment with the given metadata mode"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        downloader = AttachmentDownloader(str(tmp_path), file_metadata=file_metadata)
+        service = DownloadService(
+            client, downloader, DownloadManifest(tmp_path), config
+        )
+        return await service.execute(await service.plan())
+    
+    async def test_sidecar(self, tmp_path):
+        """A .meta.json next to the file carries message, thread, sender and hash"""
+        await self.download(tmp_path, "sidecar")
+        
+        metadata = json.loads(
+            (tmp_path / "reports" / "report.pdf.meta.json").read_text()
+        )
+        
+        assert metadata["message_id"] == "m1"
+        assert metadata["thread_id"] == "thread-m1"
+        assert metadata["sender"] == "reports@company.com"
+        assert metadata["subject"] == "Daily export"
+        assert metadata["sha256"] == hashlib.sha256(b"pdf bytes").hexdigest()
+    
+    async def test_none_writes_nothing_extra(self, tmp_path):
+        """The default leaves only the attachment itself"""
+        await self.download(tmp_path, "none")
+        
+        assert [p.name for p in (tmp_path / "reports").iterdir()] == ["report.pdf"]
+    
+    async def test_xattr_falls_back_to_sidecar(self, tmp_path, monkeypatch):
+        """Filesystems without xattr support get a sidecar instead"""
+        def unsupported(path, metadata):
+            raise OSError(95, "Operation not supported")
+        
+        monkeypatch.setattr("gmail_downloader.downloader.set_xattrs", unsupported)
+        await self.download(tmp_path, "xattr")
+        
+        assert (tmp_path / "reports" / "report.pdf.meta.json").exists()
+    
+    async def test_xattr(self, tmp_path):
+        """Extended attributes are set where the filesystem supports them"""
+        probe = tmp_path / "probe"
+        probe.write_bytes(b"")
+        try:
+            os.setxattr(probe, "user.test", b"1")
+        except (AttributeError, OSError):
+            pytest.skip("extended attributes not supported here")
+        
+        await self.download(tmp_path, "xattr")
+        path = tmp_path / "reports" / "report.pdf"
+        
+        assert os.getxattr(path, XATTR_PREFIX + "message_id") == b"m1"
+        assert not (tmp_path / "reports" / "report.pdf.meta.json").exists()
+
+
+class TestLatestLinks:
+    """Test latest/ links to the newest file of recurring attachments"""
+    
+    async def test_newest_message_wins(self, tmp_path):
+        """The link follows the newest message, whatever order files are saved in"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.conflict_policy = "version"
+        config.download.latest_links = True
+        dates = {"m1": datetime(2024, 6, 2), "m2": datetime(2024, 6, 1)}
+        
+        async def get_message_details(message_id):
+            message = FakeMessage(message_id)
+            message.date = dates[message_id]
+            return message
+        
+        # June 2 first, then a backfill of June 1
+        for message_id, data in (("m1", b"june 2"), ("m2", b"june 1")):
+            client = FakeGmailClient({(message_id, "a1"): ("sales.csv", data)})
+            client.get_message_details = get_message_details
+            service = DownloadService(
+                client,
+                AttachmentDownloader(str(tmp_path)),
+                DownloadManifest(tmp_path).load(),
+                config,
+            )
+            await service.execute(await service.plan())
+        
+        link = tmp_path / "latest" / "reports" / "sales.csv"
+        assert link.is_symlink()
+        assert link.read_bytes() == b"june 2"
+    
+    async def test_separate_manifest_dir(self, tmp_path):
+        """latest/ is made in the download directory, not next to the manifest"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.download.latest_links = True
+        client = FakeGmailClient({("m1", "a1"): ("sales.csv", b"june 1")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path / "out")),
+            DownloadManifest(tmp_path / "state"),
+            config,
+        )
+        
+        await service.execute(await service.plan())
+        
+        assert (
+            tmp_path / "out" / "latest" / "reports" / "sales.csv"
+        ).read_bytes() == b"june 1"
+        assert not (tmp_path / "state" / "latest").exists()
+    
+    async def test_off_by_default(self, tmp_path):
+        """Without download.latest_links there is no latest/ directory"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("sales.csv", b"june 1")})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        await service.execute(await service.plan())
+        
+        assert not (tmp_path / "latest").exists()
+
+
+class TestEmailWatcher:
+    """Test the watch loop"""
+    
+    async def test_downloads_new_messages(self, tmp_path):
+        """Each new message reported by the client is downloaded"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        
+        async def watch_for_new_messages(
+            query, check_interval=None, baseline=None, on_poll=None
+        ):
+            yield "m1"
+        
+        client.watch_for_new_messages = watch_for_new_messages
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        await EmailWatcher(service).start_watching(check_interval=10)
+        
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"pdf bytes"
+    
+    async def test_backfill_before_watching(self, tmp_path):
+        """A backfill window downloads recent history, then polls from the baseline"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        baselines = []
+        
+        async def watch_for_new_messages(
+            query, check_interval=None, baseline=None, on_poll=None
+        ):
+            baselines.append(baseline)
+            return
+            yield
+        
+        client.watch_for_new_messages = watch_for_new_messages
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        await EmailWatcher(service).start_watching(10, backfill=timedelta(days=7))
+        
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"pdf bytes"
+        assert baselines == [{"m1"}]
+        assert "after:" in client.searches[-1][0]
+    
+    async def test_reload_restarts_polling(self, tmp_path):
+        """A reload applies the new interval and backfills since the last poll"""
+        client = FakeGmailClient({})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            AppConfig(),
+        )
+        watcher = EmailWatcher(service)
+        intervals = []
+        
+        async def watch_for_new_messages(
+            query, check_interval=None, baseline=None, on_poll=None
+        ):
+            intervals.append(check_interval)
+            if len(intervals) == 1:
+                new_config = AppConfig()
+                new_config.watch.check_interval = 5
+                watcher.reload(new_config)
+                await asyncio.sleep(60)
+            return
+            yield
+        
+        client.watch_for_new_messages = watch_for_new_messages
+        
+        await watcher.start_watching(10)
+        
+        assert intervals == [10, 5]
+        assert watcher.stats["reloads"] == 1
+        assert "after:" in client.searches[-1][0]
+    
+    async def test_reload_adds_freshness_deadlines(self, tmp_path):
+        """
+        Deadlines added by a reload are checked, and
+        every task is awaited when watching ends
+        """
+        client = FakeGmailClient({})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            AppConfig(),
+        )
+        watcher = EmailWatcher(service)
+        checking = []
+        
+        async def watch_for_new_messages(
+            query, check_interval=None, baseline=None, on_poll=None
+        ):
+            checking.append(watcher._freshness_task is not None)
+            if len(checking) == 1:
+                new_config = AppConfig()
+                new_config.freshness.expected_by = ["0 9 * * *"]
+                watcher.reload(new_config)
+                await asyncio.sleep(60)
+            return
+            yield
+        
+        client.watch_for_new_messages = watch_for_new_messages
+        
+        await watcher.start_watching(10)
+        
+        assert checking == [False, True]
+        assert watcher._freshness_task is None
+        assert not watcher._cancelled
+    
+    async def test_health(self, tmp_path):
+        """Health reports polls and turns unhealthy once polls are overdue"""
+        service = DownloadService(
+            FakeGmailClient({}), AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path), AppConfig()
+        )
+        watcher = EmailWatcher(service)
+        pings = []
+        watcher.poll_listeners.append(lambda: pings.append(1))
+        
+        assert watcher.health()["healthy"] is False
+        
+        watcher.is_watching = True
+        watcher.started_at = datetime.now()
+        watcher._polled()
+        assert pings == [1]
+        assert watcher.health()["healthy"] is True
+        
+        watcher.last_poll = datetime.now() - timedelta(hours=1)
+        assert watcher.health()["healthy"] is False
+    
+    async def test_schedule(self, tmp_path):
+        """With schedules the client waits for the next cron time; health knows it"""
+        config = AppConfig()
+        config.watch.schedules = ["0 7 * * MON-FRI"]
+        client = FakeGmailClient({})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        watcher = EmailWatcher(service)
+        waits = []
+        
+        async def watch_for_new_messages(
+            query, check_interval=None, baseline=None, on_poll=None, wait=None
+        ):
+            waits.append(wait())
+            return
+            yield
+        
+        client.watch_for_new_messages = watch_for_new_messages
+        
+        await watcher.start_watching()
+        
+        assert 0 < waits[0] <= 4 * 24 * 3600
+        assert (watcher.next_check.hour, watcher.next_check.minute) == (7, 0)
+        assert watcher.next_check.weekday() < 5
+        
+        watcher.is_watching = True
+        watcher.last_poll = datetime.now() - timedelta(hours=12)
+        assert watcher.health()["healthy"] is True
+        assert watcher.health()["schedules"] == ["0 7 * * MON-FRI"]
+    
+    async def test_backfill_query_window(self, tmp_path):
+        """The backfill query wraps the filters and adds an exact after: timestamp"""
+        client = FakeGmailClient({})
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            AppConfig(),
+        )
+        now = datetime(2024, 6, 8, 12, 0)
+        
+        await service.backfill(timedelta(days=7), now=now)
+        
+        since = int(datetime(2024, 6, 1, 12, 0).timestamp())
+        assert client.searches == [(f"(has:attachment) after:{since}", False)]
+
+
+class FlakyStorage(LocalStorage):
+    """Local storage whose first writes are truncated, like a failing disk"""
+    
+    def __init__(self, base_dir, bad_writes=1):
+        super().__init__(base_dir)
+        self.bad_writes = bad_writes
+        self.writes = 0
+    
+    async def write(self, key, data):
+        self.writes += 1
+        if self.writes <= self.bad_writes:
+            data = data[:-1]
+        await super().write(key, data)
+
+
+class FullDiskStorage(LocalStorage):
+    """Local storage on a disk that fills up after a number of writes"""
+    
+    def __init__(self, base_dir, room=1):
+        super().__init__(base_dir)
+        self.room = room
+    
+    async def write(self, key, data):
+        if self.room == 0:
+            raise OSError(errno.ENOSPC, "No space left on device")
+        self.room -= 1
+        await super().write(key, data)
+
+
+class TestFullDisk:
+    """Test running out of disk space during a run"""
+    
+    async def test_run_stops(self, tmp_path):
+        """The rest of the plan is left out instead of failing one by one"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({
+            ("m1", "a1"): ("a.pdf", b"first"),
+            ("m1", "a2"): ("b.pdf", b"second"),
+            ("m1", "a3"): ("c.pdf", b"third"),
+        })
+        downloader = AttachmentDownloader(
+            str(tmp_path), storage=FullDiskStorage(tmp_path)
+        )
+        service = DownloadService(
+            client, downloader, DownloadManifest(tmp_path), config
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert [path.name for path in saved] == ["a.pdf"]
+        assert service.failed == []
+        assert service.budget_reason == "a full disk"
+        assert [item.filename for item in service.budget_skipped] == ["b.pdf", "c.pdf"]
+        assert not (tmp_path / "reports" / "b.pdf").exists()
+        assert [
+            entry.filename for entry in DownloadManifest(tmp_path).load()
+        ] == ["a.pdf"]
+
+
+class TestWriteVerification:
+    """Test checking files after writing them"""
+    
+    async def test_truncated_write_retried(self, tmp_path):
+        """A short write is written again and the check is recorded in the manifest"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({("m1", "a1"): ("report.pdf", b"pdf bytes")})
+        storage = FlakyStorage(tmp_path)
+        downloader = AttachmentDownloader(
+            str(tmp_path), storage=storage, verify_writes="hash", write_attempts=3
+        )
+        service = DownloadService(
+            client, downloader, DownloadManifest(tmp_path), config
+        )
+        
+        await service.execute(await service.plan())
+        
+        assert storage.writes == 2
+        assert (tmp_path / "reports" / "report.pdf").read_bytes() == b"pdf bytes"
+        assert (
+            DownloadManifest(tmp_path).load().get("m1", "report.pdf").verified == "md5"
+        )
+    
+    async def test_gives_up_after_attempts(self, tmp_path):
+        """A file that never verifies is an error, not a download"""
+        downloader = AttachmentDownloader(
+            str(tmp_path), storage=FlakyStorage(tmp_path, bad_writes=5),
+            verify_writes="size", write_attempts=2
+        )
+        
+        with pytest.raises(StorageError):
+            await downloader.write_file(tmp_path / "a.pdf", b"data")
+    
+    async def test_unverified_by_default(self, tmp_path):
+        """Without verify_writes nothing is read back"""
+        storage = FlakyStorage(tmp_path)
+        downloader = AttachmentDownloader(str(tmp_path), storage=storage)
+        
+        assert await downloader.write_file(tmp_path / "a.pdf", b"data") == ""
+        assert storage.writes == 1
+
+
+class TestLatestPerThread:
+    """Test keeping only the newest copy of a file within a thread"""
+    
+    def make_planned(self, message_id, thread_id, day, filename):
+        """Planned download of filename from a message in a thread"""
+        message = FakeMessage(message_id)
+        message.thread_id = thread_id
+        message.date = datetime(2024, 6, day)
+        return PlannedDownload(
+            message, FakeAttachment("a", filename), Path(filename), STATUS_NEW, filename
+        )
+    
+    def test_newest_wins_per_thread_and_filename(self):
+        """Resent files replace older ones; other threads and names are kept"""
+        planned = [
+            self.make_planned("m3", "t1", 3, "report.csv"),
+            self.make_planned("m1", "t1", 1, "report.csv"),
+            self.make_planned("m1", "t1", 1, "notes.txt"),
+            self.make_planned("m2", "t2", 2, "report.csv"),
+            self.make_planned("m4", "t1", 2, "REPORT.csv"),
+        ]
+        
+        kept = latest_per_thread(planned)
+        
+        assert [(item.message.message_id, item.filename) for item in kept] == [
+            ("m3", "report.csv"),
+            ("m1", "notes.txt"),
+            ("m2", "report.csv"),
+        ]
+    
+    async def test_plan_applies_filter(self, tmp_path):
+        """With filters.latest_per_thread, plan() drops superseded copies"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.filters.latest_per_thread = True
+        client = FakeGmailClient({
+            ("m1", "a1"): ("report.pdf", b"first"),
+            ("m2", "a2"): ("report.pdf", b"corrected"),
+        })
+        dates = {"m1": datetime(2024, 6, 1), "m2": datetime(2024, 6, 2)}
+        
+        async def get_message_details(message_id):
+            message = FakeMessage(message_id)
+            message.thread_id = "t1"
+            message.date = dates[message_id]
+            return message
+        
+        client.get_message_details = get_message_details
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        planned = await service.plan()
+        
+        assert [item.message.message_id for item in planned] == ["m2"]
+
+
+class TestPlannedDownloadToDict:
+    """Test machine-readable attachment descriptions"""
+    
+    async def test_exposes_part_and_attachment_ids(self, tmp_path):
+        """JSON output lets scripts target one attachment precisely"""
+        config = AppConfig()
+        config.filters.min_size = 1
+        client = FakeGmailClient({
+            ("m1", "a1"): ("data.csv", b"first"),
+            ("m1", "a2"): ("data.csv", b"second"),
+        })
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        
+        planned = await service.plan()
+        data = [item.to_dict() for item in planned]
+        
+        assert [d["part_id"] for d in data] == ["0", "1"]
+        assert [d["attachment_id"] for d in data] == ["a1", "a2"]
+        assert data[1]["filename"] == "data.csv"
+        assert data[1]["saved_as"] == "data_part1.csv"
+        assert data[0]["status"] == STATUS_NEW
+
+
+class TestSortPlanned:
+    """Test ordering planned downloads for the list command"""
+    
+    def make_planned(self, sender, day, filename, size):
+        """Build a planned download with just the fields sorting looks at"""
+        message = FakeMessage("m", sender)
+        message.date = datetime(2024, 6, day)
+        return PlannedDownload(
+            message,
+            FakeAttachment("a", filename, size),
+            Path(filename),
+            STATUS_NEW,
+            filename,
+        )
+    
+    def test_sort_keys(self):
+        """Each sort key orders by the matching field"""
+        planned = [
+            self.make_planned("b@x.com", 3, "Zeta.pdf", 10),
+            self.make_planned("A@x.com", 1, "alpha.pdf", 30),
+            self.make_planned("c@x.com", 2, "beta.pdf", 20),
+        ]
+        
+        assert [p.message.date.day for p in sort_planned(planned)] == [1, 2, 3]
+        assert [p.filename for p in sort_planned(planned, "filename")] == [
+            "alpha.pdf", "beta.pdf", "Zeta.pdf"
+        ]
+        assert [p.message.sender for p in sort_planned(planned, "sender")] == [
+            "A@x.com", "b@x.com", "c@x.com"
+        ]
+        assert [
+            p.attachment.size for p in sort_planned(planned, "size", descending=True)
+        ] == [30, 20, 10]
+    
+    def test_unknown_key(self):
+        """Unknown sort keys are rejected"""
+        with pytest.raises(ValueError):
+            sort_planned([], "colour")
+
+
+class TestPathDepth:
+    """Test organization folders and the depth safeguard"""
+    
+    def test_sender_date(self, tmp_path):
+        """sender_date nests date folders inside sender folders"""
+        downloader = AttachmentDownloader(str(tmp_path), "sender_date")
+        key = downloader.get_storage_key(
+            "a.pdf", "reports@vendor.com", datetime(2024, 6, 1)
+        )
+        
+        assert key == "reports/2024-06-01/a.pdf"
+    
+    def test_shallow_paths_unchanged(self):
+        """Paths within the limit are left alone"""
+        assert limit_path_depth(["a", "b"], 2) == ["a", "b"]
+        assert limit_path_depth(["a", "b", "c"], 0) == ["a", "b", "c"]
+    
+    def test_deep_paths_flattened(self):
+        """The remainder beyond the limit becomes one stable hashed folder"""
+        flattened = limit_path_depth(["a", "b", "c", "d"], 2)
+        
+        assert len(flattened) == 2
+        assert flattened[0] == "a"
+        assert flattened == limit_path_depth(["a", "b", "c", "d"], 2)
+        assert flattened != limit_path_depth(["a", "b", "c", "e"], 2)
+    
+    def test_downloader_applies_limit(self, tmp_path):
+        """The downloader never builds paths deeper than max_path_depth"""
+        downloader = AttachmentDownloader(
+            str(tmp_path), "sender_date", max_path_depth=1
+        )
+        key = downloader.get_storage_key(
+            "a.pdf", "reports@vendor.com", datetime(2024, 6, 1)
+        )
+        
+        assert key.count("/") == 1
+        assert key.endswith("/a.pdf")
+
+    def test_sender_aliases_share_folder(self, tmp_path):
+        """Aliased addresses of one partner land in the same folder"""
+        downloader = AttachmentDownloader(
+            str(tmp_path),
+            sender_aliases={
+                "no-reply@vendor-a.com": "vendor_a", "@vendor-a.io": "vendor_a"
+            },
+        )
+        date = datetime(2024, 6, 1)
+        
+        assert downloader.get_storage_key(
+            "a.pdf", "no-reply@vendor-a.com", date
+        ) == "vendor_a/a.pdf"
+        assert downloader.get_storage_key(
+            "b.pdf", "reports@vendor-a.io", date
+        ) == "vendor_a/b.pdf"
+        assert downloader.get_storage_key("c.pdf", "hr@company.com", date) == "hr/c.pdf"
+    
+    def test_subject_folders(self, tmp_path):
+        """Subject folders drop reply prefixes and dates so threads share one folder"""
+        downloader = AttachmentDownloader(str(tmp_path), "sender_subject")
+        first = downloader.get_storage_key(
+            "a.pdf",
+            "reports@vendor.com",
+            datetime(2024, 6, 1),
+            "Daily report 2024-06-01",
+        )
+        reply = downloader.get_storage_key(
+            "a.pdf",
+            "reports@vendor.com",
+            datetime(2024, 6, 2),
+            "Re: Daily report 2024-06-02",
+        )
+        
+        assert first == reply == "reports/Daily report/a.pdf"
+    
+    def test_thread_folders(self, tmp_path):
+        """Thread folders are the subject plus the end of the thread ID"""
+        downloader = AttachmentDownloader(str(tmp_path), "thread")
+        key = downloader.get_storage_key(
+            "model.ipynb",
+            "ds@acme.com",
+            datetime(2024, 6, 1),
+            "Re: Churn model v2",
+            thread_id="18f2c3d4e5a6b7c8",
+        )
+        
+        assert key == "Churn model v2_e5a6b7c8/model.ipynb"
+    
+    async def test_thread_keeps_first_subject(self, tmp_path):
+        """Replies with an edited subject still go to the thread's folder"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "ds@acme.com",
+            "Churn model",
+            {"model_v1.ipynb": b"{}"},
+            thread_id="18f2c3d4e5a6b7c8",
+        )
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.filters.extensions = [".ipynb"]
+        config.download.organize_by = "thread"
+        
+        def make_service():
+            return DownloadService(
+                gmail.client(config), AttachmentDownloader(str(tmp_path), "thread"),
+                DownloadManifest(tmp_path).load(), config,
+            )
+        
+        service = make_service()
+        first = await service.execute(await service.plan())
+        gmail.add_message(
+            "ds@acme.com",
+            "Re: Churn model (v2 attached)",
+            {"model_v2.ipynb": b"{}"},
+            thread_id="18f2c3d4e5a6b7c8",
+        )
+        service = make_service()
+        second = await service.execute(await service.plan())
+        
+        assert [path.name for path in second] == ["model_v2.ipynb"]
+        assert {path.parent.name for path in first + second} == {"Churn model_e5a6b7c8"}
+    
+    async def test_thread_subject_from_first_message(self, tmp_path):
+        """
+        The folder is named after the thread's first
+        message, even one with nothing to download
+        """
+        gmail = FakeGmail()
+        gmail.add_message("ds@acme.com", "Churn model", {"notes.txt": b"see next mail"},
+                          thread_id="18f2c3d4e5a6b7c8", date=datetime(2024, 6, 1))
+        gmail.add_message(
+            "ds@acme.com",
+            "Re: Churn model (v2 attached)",
+            {"model_v2.ipynb": b"{}"},
+            thread_id="18f2c3d4e5a6b7c8",
+            date=datetime(2024, 6, 2),
+        )
+        config = AppConfig()
+        config.filters.min_size = 1
+        config.filters.extensions = [".ipynb"]
+        config.download.organize_by = "thread"
+        service = DownloadService(
+            gmail.client(config), AttachmentDownloader(str(tmp_path), "thread"),
+            DownloadManifest(tmp_path).load(), config,
+        )
+        
+        saved = await service.execute(await service.plan())
+        
+        assert [path.parent.name for path in saved] == ["Churn model_e5a6b7c8"]
+    
+    @pytest.mark.parametrize("sender_key,expected", [
+        ("local", "reports/a.pdf"),
+        ("address", "reports@mail.vendor.com/a.pdf"),
+        ("name", "Vendor Reports/a.pdf"),
+        ("domain", "mail.vendor.com/a.pdf"),
+    ])
+    def test_sender_key(self, tmp_path, sender_key, expected):
+        """sender_key picks what names the sender folder"""
+        downloader = AttachmentDownloader(str(tmp_path), sender_key=sender_key)
+        key = downloader.get_storage_key(
+            "a.pdf",
+            "reports@mail.vendor.com",
+            datetime(2024, 6, 1),
+            sender_name="Vendor Reports",
+        )
+        
+        assert key == expected
+    
+    def test_sender_name_falls_back_to_local_part(self, tmp_path):
+        """Senders without a display name keep the local-part folder"""
+        downloader = AttachmentDownloader(str(tmp_path), sender_key="name")
+        
+        assert downloader.get_storage_key(
+            "a.pdf", "reports@vendor.com", datetime(2024, 6, 1)
+        ) == "reports/a.pdf"
+    
+    def test_type_folders(self, tmp_path):
+        """The type layout groups files by kind, with user groups first"""
+        downloader = AttachmentDownloader(
+            str(tmp_path), "type", type_groups={"notebooks": ["ipynb"]}
+        )
+        date = datetime(2024, 6, 1)
+        
+        assert downloader.get_storage_key(
+            "q2.csv", "a@vendor.com", date
+        ) == "tabular/q2.csv"
+        assert downloader.get_storage_key(
+            "model.ipynb", "a@vendor.com", date
+        ) == "notebooks/model.ipynb"
+        assert downloader.get_storage_key(
+            "feed.xml", "a@vendor.com", date
+        ) == "xml/feed.xml"
+    
+    def test_date_format(self, tmp_path):
+        """date_format and timezone shape the date folders"""
+        date = datetime(2024, 12, 31, 23, 30, tzinfo=timezone.utc)
+        
+        monthly = AttachmentDownloader(
+            str(tmp_path), "sender_date", date_format="month"
+        )
+        quarterly = AttachmentDownloader(
+            str(tmp_path), "date", date_format="quarter", timezone="Asia/Tokyo"
+        )
+        
+        assert monthly.get_storage_key(
+            "a.pdf", "reports@vendor.com", date
+        ) == "reports/2024/12/a.pdf"
+        assert quarterly.get_storage_key(
+            "a.pdf", "reports@vendor.com", date
+        ) == "2025-Q1/a.pdf"
+    
+    def test_filename_unicode(self, tmp_path):
+        """Native characters are kept by default and folded in ascii mode"""
+        date = datetime(2024, 6, 1)
+        
+        keep = AttachmentDownloader(str(tmp_path), "sender_subject")
+        ascii_only = AttachmentDownloader(
+            str(tmp_path), "sender_subject", filename_unicode="ascii"
+        )
+        
+        assert keep.get_storage_key(
+            "Résumé.pdf", "hr@company.com", date, "Отчёт"
+        ) == "hr/Отчёт/Résumé.pdf"
+        assert ascii_only.get_storage_key(
+            "Résumé.pdf", "hr@company.com", date, "Отчёт"
+        ) == "hr/unnamed_file/Resume.pdf"
+
+
+class TestPathLength:
+    """Test shortening paths to a maximum length"""
+    
+    def test_short_paths_unchanged(self):
+        """Paths within the limit are left alone"""
+        assert fit_path_length(["reports", "2024-06-01"], "a.pdf", 100) == (
+            ["reports", "2024-06-01"], "a.pdf"
+        )
+    
+    def test_folders_shortened_before_filename(self):
+        """The longest folder is cut first and keeps a distinguishing hash"""
+        subject = "Quarterly financial results for the northern region " * 2
+        folders, filename = fit_path_length(["reports", subject], "results.pdf", 60)
+        
+        assert len("/".join(folders + [filename])) <= 60
+        assert folders[0] == "reports"
+        assert filename == "results.pdf"
+        assert folders[1] != fit_path_length(
+            ["reports", subject + "x"], "results.pdf", 60
+        )[0][1]
+    
+    def test_filename_cut_as_last_resort(self):
+        """
+        When folders cannot shrink further, the name
+        is cut but keeps its extension and a hash
+        """
+        folders, filename = fit_path_length(["reports"], "a" * 100 + ".pdf", 40)
+        
+        assert len("/".join(folders + [filename])) <= 40
+        assert filename.endswith(".pdf")
+        assert filename != fit_path_length(["reports"], "a" * 100 + "b.pdf", 40)[1]
+    
+    def test_downloader_counts_base_dir(self, tmp_path):
+        """The download folder itself counts towards max_path_length"""
+        limit = len(str(tmp_path)) + 60
+        downloader = AttachmentDownloader(
+            str(tmp_path), "sender_subject", max_path_length=limit
+        )
+        key = downloader.get_storage_key(
+            "report.pdf",
+            "reports@vendor.com",
+            datetime(2024, 6, 1),
+            "Weekly numbers " * 10,
+        )
+        
+        assert len(str(tmp_path / key)) <= limit
+        assert key.startswith("reports/")
+        assert key.endswith("/report.pdf")
+
+
+class TestAggregatePlanned:
+    """Test per-sender, per-type and per-month statistics"""
+    
+    def make_planned(self, sender, month, filename, size):
+        """Build a planned download with just the fields stats look at"""
+        message = FakeMessage("m", sender)
+        message.date = datetime(2024, month, 1)
+        return PlannedDownload(
+            message,
+            FakeAttachment("a", filename, size),
+            Path(filename),
+            STATUS_NEW,
+            filename,
+        )
+    
+    def test_groups_counts_and_bytes(self):
+        """Each dimension counts attachments and adds up their sizes"""
+        stats = aggregate_planned([
+            self.make_planned("Vendor <reports@vendor.com>", 1, "a.PDF", 100),
+            self.make_planned("reports@vendor.com", 2, "b.csv", 50),
+            self.make_planned("hr@company.com", 2, "README", 7),
+        ])
+        
+        assert stats["sender"]["reports@vendor.com"] == AttachmentStats(2, 150)
+        assert stats["sender"]["hr@company.com"] == AttachmentStats(1, 7)
+        assert stats["extension"][".pdf"] == AttachmentStats(1, 100)
+        assert stats["extension"]["(none)"] == AttachmentStats(1, 7)
+        assert stats["month"]["2024-02"] == AttachmentStats(2, 57)
+    
+    def test_sender_aliases(self):
+        """Aliased senders are counted together"""
+        stats = aggregate_planned(
+            [
+                self.make_planned("no-reply@vendor-a.com", 1, "a.pdf", 100),
+                self.make_planned("reports@vendor-a.io", 1, "b.pdf", 50),
+            ],
+            {"no-reply@vendor-a.com": "vendor_a", "@vendor-a.io": "vendor_a"},
+        )
+        
+        assert stats["sender"] == {"vendor_a": AttachmentStats(2, 150)}
+    
+    def test_empty(self):
+        """No attachments gives empty groups for every dimension"""
+        assert aggregate_planned([]) == {"sender": {}, "extension": {}, "month": {}}
+
+
+class TestEstimateQuota:
+    """Test the quota estimate for download --estimate"""
+    
+    def make_planned(self, message_id, attachment_id, status=STATUS_NEW):
+        """Planned download of one attachment"""
+        return PlannedDownload(
+            FakeMessage(message_id),
+            FakeAttachment(attachment_id, "f.pdf"),
+            Path("f.pdf"),
+            status,
+            "f.pdf",
+        )
+    
+    def make_service(self, tmp_path, **download_settings):
+        """Service with the given download settings"""
+        config = AppConfig()
+        for name, value in download_settings.items():
+            setattr(config.download, name, value)
+        return DownloadService(
+            FakeGmailClient({}),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+    
+    def test_counts_fetches(self, tmp_path):
+        """Attachments to fetch cost 10 units; existing and Drive files cost none"""
+        planned = [
+            self.make_planned("m1", "a1"),
+            self.make_planned("m1", "a2", STATUS_UPDATED),
+            self.make_planned("m2", "a3", STATUS_EXISTS),
+            self.make_planned("m3", "drive:1AbC"),
+        ]
+        
+        estimate = self.make_service(
+            tmp_path, conflict_policy="rename"
+        ).estimate_quota(planned)
+        
+        assert estimate == {
+            "attachments": 2, "messages": 2, "drive_files": 1, "units": 20
+        }
+    
+    def test_skip_policy_and_message_content(self, tmp_path):
+        """Skipped updates are free; bodies and .eml cost a read per message"""
+        planned = [
+            self.make_planned("m1", "a1"), self.make_planned("m1", "a2", STATUS_UPDATED)
+        ]
+        service = self.make_service(
+            tmp_path, conflict_policy="skip", save_body=True, save_eml=True
+        )
+        
+        assert service.estimate_quota(planned)["units"] == 10 + 5 + 5
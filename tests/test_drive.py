@@ -0,0 +1,282 @@
+"""
+Tests for drive module
+"""
+
+import pytest
+
+from gmail_downloader.drive import (
+    DriveClient,
+    DriveFile,
+    drive_file_id,
+    find_drive_links,
+    is_native_reference,
+    stub_file_id,
+)
+from gmail_downloader.partial import PartialDownloads
+
+FILE_ID = "1AbCdEfGhIjKlMnOpQrStUvWxYz012345"
+
+
+class TestFindDriveLinks:
+    """Test spotting Drive file links in message bodies."""
+
+    @pytest.mark.parametrize("url", [
+        f"https://drive.google.com/file/d/{FILE_ID}/view?usp=sharing",
+        f"https://drive.google.com/file/u/1/d/{FILE_ID}/view",
+        f"https://drive.google.com/open?id={FILE_ID}",
+        f"https://drive.google.com/uc?export=download&amp;id={FILE_ID}",
+        f"https://docs.google.com/document/d/{FILE_ID}/edit",
+        f"https://docs.google.com/spreadsheets/d/{FILE_ID}/edit#gid=0",
+        f"https://docs.google.com/presentation/d/{FILE_ID}/edit",
+    ])
+    def test_link_forms(self, url):
+        """Every common sharing URL yields the file ID."""
+        assert find_drive_links(f'<a href="{url}">report</a>') == [FILE_ID]
+
+    def test_duplicates_and_other_links(self):
+        """Each file is listed once; folders and other sites are ignored."""
+        text = (
+            f"https://docs.google.com/document/d/{FILE_ID}/edit and again "
+            f"https://docs.google.com/document/d/{FILE_ID}/edit, "
+            "https://drive.google.com/drive/folders/1FolderIdFolderIdFolderId00, "
+            "https://example.com/file/d/1NotDriveNotDriveNotDrive00/view"
+        )
+        assert find_drive_links(text) == [FILE_ID]
+
+    def test_drive_file_id(self):
+        """Drive attachment IDs carry the file ID; Gmail ones do not."""
+        assert drive_file_id(f"drive:{FILE_ID}") == FILE_ID
+        assert drive_file_id("ANGjdJ8abc") is None
+
+
+class TestNativeReferences:
+    """Test recognizing attachments that only point at a Google file."""
+
+    def test_is_native_reference(self):
+        """Stub extensions and Google-native MIME types are references."""
+        assert is_native_reference("Budget.gsheet", "application/octet-stream")
+        assert is_native_reference("Plan", "application/vnd.google-apps.document")
+        assert not is_native_reference("Budget.xlsx", "application/vnd.ms-excel")
+
+    def test_stub_file_id(self):
+        """The file ID comes from doc_id, resource_id or the URL."""
+        assert stub_file_id(b'{"doc_id": "abc", "url": "x"}') == "abc"
+        assert stub_file_id(b'{"resource_id": "spreadsheet:def"}') == "def"
+        url = f"https://docs.google.com/spreadsheets/d/{FILE_ID}/edit"
+        assert stub_file_id(f'{{"url": "{url}"}}'.encode()) == FILE_ID
+        assert stub_file_id(url.encode()) == FILE_ID
+        assert stub_file_id(b"not a reference") is None
+
+
+class TestDriveFile:
+    """Test how linked files are named."""
+
+    def test_export_adds_extension(self):
+        """Exported Google Docs get the export format's extension once."""
+        assert DriveFile(
+            "x", "Q3 plan", "", export_format="docx"
+        ).filename == "Q3 plan.docx"
+        assert DriveFile(
+            "x", "data.csv", "", export_format="csv"
+        ).filename == "data.csv"
+        assert DriveFile("x", "scan.pdf", "application/pdf").filename == "scan.pdf"
+
+    def test_to_attachment(self):
+        """Linked files become attachments with drive: IDs."""
+        attachment = DriveFile(
+            FILE_ID, "Budget", "", export_format="xlsx"
+        ).to_attachment("m1")
+
+        assert attachment.attachment_id == f"drive:{FILE_ID}"
+        assert attachment.part_id == f"drive:{FILE_ID}"
+        assert attachment.filename == "Budget.xlsx"
+        assert attachment.mime_type.endswith("spreadsheetml.sheet")
+
+
+class FakeRequest:
+    def __init__(self, response):
+        self.response = response
+        self.headers = {}
+
+    def execute(self):
+        if callable(self.response):
+            return self.response(self.headers.get("Range"))
+        return self.response
+
+
+class FakeFiles:
+    """Stand-in for the Drive service's files() resource."""
+
+    def __init__(self, metadata):
+        self.metadata = metadata
+        self.calls = []
+
+    def get(self, fileId, **kwargs):
+        return FakeRequest(self.metadata[fileId])
+
+    def export(self, fileId, mimeType):
+        self.calls.append(("export", fileId, mimeType))
+        return FakeRequest(b"exported")
+
+    def get_media(self, fileId, **kwargs):
+        self.calls.append(("get_media", fileId))
+        return FakeRequest(b"content")
+
+
+class FakeDriveService:
+    def __init__(self, files):
+        self._files = files
+
+    def files(self):
+        return self._files
+
+
+class TestDriveClient:
+    """Test reading linked files through the Drive API."""
+
+    def make_client(self, metadata, export_formats=None):
+        client = DriveClient(gmail_client=None, export_formats=export_formats)
+        files = FakeFiles(metadata)
+        client.service = client.media_service = FakeDriveService(files)
+        return client, files
+
+    async def test_native_file_exported(self):
+        """Google Docs are exported in the configured format."""
+        client, files = self.make_client(
+            {
+                "doc": {
+                    "name": "Plan", "mimeType": "application/vnd.google-apps.document"
+                }
+            },
+            export_formats={"document": "pdf"},
+        )
+
+        assert await client.download("doc") == b"exported"
+        assert files.calls == [("export", "doc", "application/pdf")]
+
+    async def test_binary_file_downloaded(self):
+        """Uploaded files are downloaded as they are, with their size."""
+        client, files = self.make_client(
+            {"pdf": {"name": "scan.pdf", "mimeType": "application/pdf", "size": "9"}}
+        )
+
+        drive_file = await client.get_file("pdf")
+        assert drive_file.size == 9
+        assert await client.download("pdf") == b"content"
+        assert files.calls == [("get_media", "pdf")]
+
+    async def test_folders_skipped(self):
+        """Folders and forms cannot be downloaded as files."""
+        client, _ = self.make_client(
+            {
+                "dir": {
+                    "name": "Shared", "mimeType": "application/vnd.google-apps.folder"
+                }
+            }
+        )
+
+        assert await client.get_file("dir") is None
+
+
+class RangedFiles(FakeFiles):
+    """Serves content by Range header, failing the chosen request numbers."""
+
+    def __init__(self, metadata, content, fail_on=()):
+        super().__init__(metadata)
+        self.content = content
+        self.fail_on = set(fail_on)
+        self.ranges = []
+
+    def get_media(self, fileId, **kwargs):
+        def respond(header):
+            self.ranges.append(header)
+            if len(self.ranges) in self.fail_on:
+                raise ConnectionResetError("connection dropped")
+            start, end = header[len("bytes="):].split("-")
+            return self.content[int(start):int(end) + 1]
+        return FakeRequest(respond)
+
+
+class TestRangedDownload:
+    """Test downloading large files in ranges and resuming them."""
+
+    def make_client(self, files):
+        client = DriveClient(gmail_client=None)
+        client.service = client.media_service = FakeDriveService(files)
+        return client
+
+    async def test_ranges(self, tmp_path):
+        """A file over the chunk size arrives in ranges, and the journal is cleared."""
+        files = RangedFiles(
+            {
+                "big": {
+                    "name": "dump.bin",
+                    "mimeType": "application/octet-stream",
+                    "size": "10",
+                }
+            },
+            b"0123456789",
+        )
+        partial = PartialDownloads(tmp_path)
+
+        data = await self.make_client(files).download("big", partial, chunk_size=4)
+
+        assert data == b"0123456789"
+        assert files.ranges == ["bytes=0-3", "bytes=4-7", "bytes=8-9"]
+        assert not partial.part_path("big").exists()
+        assert PartialDownloads(tmp_path).load().offset("big") == 0
+
+    async def test_ranges_report_progress(self, tmp_path):
+        """Each range downloaded is reported with the bytes so far."""
+        files = RangedFiles(
+            {
+                "big": {
+                    "name": "dump.bin",
+                    "mimeType": "application/octet-stream",
+                    "size": "10",
+                }
+            },
+            b"0123456789",
+        )
+        reported = []
+
+        async def on_progress(done):
+            reported.append(done)
+
+        await self.make_client(files).download(
+            "big", PartialDownloads(tmp_path), chunk_size=4, on_progress=on_progress
+        )
+
+        assert reported == [4, 8, 10]
+
+    async def test_resume_after_failure(self, tmp_path):
+        """A later attempt only asks for what the failed one did not get."""
+        metadata = {
+            "big": {
+                "name": "dump.bin", "mimeType": "application/octet-stream", "size": "10"
+            }
+        }
+        files = RangedFiles(metadata, b"0123456789", fail_on=[3])
+        with pytest.raises(ConnectionResetError):
+            await self.make_client(files).download(
+                "big", PartialDownloads(tmp_path), chunk_size=4
+            )
+
+        retry = RangedFiles(metadata, b"0123456789")
+        data = await self.make_client(retry).download(
+            "big", PartialDownloads(tmp_path).load(), chunk_size=4
+        )
+
+        assert data == b"0123456789"
+        assert retry.ranges == ["bytes=8-9"]
+
+    async def test_small_file_in_one_piece(self, tmp_path):
+        """Files within one chunk are not journaled."""
+        files = FakeFiles(
+            {"pdf": {"name": "scan.pdf", "mimeType": "application/pdf", "size": "7"}}
+        )
+
+        assert await self.make_client(files).download(
+            "pdf", PartialDownloads(tmp_path), chunk_size=8
+        ) == b"content"
+        assert not (tmp_path / ".gmail_downloader_partial").exists()
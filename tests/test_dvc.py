@@ -0,0 +1,154 @@
+"""
+Tests for dvc module
+"""
+
+import json
+import sys
+
+import yaml
+
+from gmail_downloader.config import DvcConfig
+from gmail_downloader.dvc import dvc_file, find_repo, open_dvc, write_meta
+from gmail_downloader.manifest import ManifestEntry
+
+# Stands in for dvc: logs its arguments, and "add" writes a .dvc file
+FAKE_DVC = """
+import json, pathlib, sys
+with open("calls.jsonl", "a") as log:
+    log.write(json.dumps(sys.argv[1:]) + "\\n")
+if sys.argv[1] == "add":
+    for path in map(pathlib.Path, sys.argv[2:]):
+        path.with_name(path.name + ".dvc").write_text(
+            "outs:\\n- md5: abc\\n  size: 3\\n  path: " + path.name + "\\n"
+        )
+sys.exit(1 if "fail" in sys.argv[-1] else 0)
+"""
+
+
+def make_repo(tmp_path):
+    """A DVC repository in tmp_path with the fake dvc, and a saved file"""
+    (tmp_path / ".dvc").mkdir()
+    script = tmp_path / "fake_dvc.py"
+    script.write_text(FAKE_DVC)
+    saved = tmp_path / "downloads" / "acme.com" / "a.csv"
+    saved.parent.mkdir(parents=True)
+    saved.write_bytes(b"1,2")
+    return f"{sys.executable} {script}", saved
+
+
+def make_entry():
+    return ManifestEntry(
+        message_id="m1",
+        attachment_id="a1",
+        filename="a.csv",
+        path="acme.com/a.csv",
+        size=3,
+        sha256="f" * 64,
+        sender="bi@acme.com",
+        subject="Exports",
+        date="2024-06-01T09:30:12",
+    )
+
+
+def calls(tmp_path):
+    return [
+        json.loads(line) for line in (tmp_path / "calls.jsonl").read_text().splitlines()
+    ]
+
+
+class TestRepo:
+    """Test finding the repository"""
+
+    def test_find_repo(self, tmp_path):
+        """The nearest directory with a .dvc folder is the root"""
+        (tmp_path / ".dvc").mkdir()
+
+        assert (
+            find_repo(tmp_path / "downloads" / "not-created-yet") == tmp_path.resolve()
+        )
+
+    def test_outside_repo(self, tmp_path):
+        """Outside a repository nothing is tracked"""
+        assert open_dvc(DvcConfig(enabled=True), tmp_path / "downloads") is None
+        assert open_dvc(DvcConfig(), tmp_path) is None
+
+    def test_write_meta_keeps_outs(self, tmp_path):
+        """Only meta: is replaced"""
+        path = tmp_path / "a.csv.dvc"
+        path.write_text("outs:\n- md5: abc\n  path: a.csv\nmeta:\n  old: 1\n")
+
+        write_meta(path, {"sender": "bi@acme.com"})
+
+        assert yaml.safe_load(path.read_text()) == {
+            "outs": [{"md5": "abc", "path": "a.csv"}],
+            "meta": {"sender": "bi@acme.com"},
+        }
+
+
+class TestTrack:
+    """Test adding saved files"""
+
+    async def test_add_with_provenance(self, tmp_path):
+        """The file is added and its .dvc file says where it came from"""
+        command, saved = make_repo(tmp_path)
+        tracker = open_dvc(
+            DvcConfig(enabled=True, command=command), tmp_path / "downloads"
+        )
+
+        await tracker.queue(make_entry(), saved)
+        assert not (tmp_path / "calls.jsonl").exists()
+        assert await tracker.flush()
+
+        assert calls(tmp_path) == [["add", str(saved.resolve())]]
+        meta = yaml.safe_load(dvc_file(saved).read_text())["meta"]
+        assert meta["sender"] == "bi@acme.com"
+        assert meta["message_id"] == "m1"
+        assert meta["sha256"] == "f" * 64
+
+    async def test_push_to_remote(self, tmp_path):
+        """With push, the .dvc file is pushed to the configured remote"""
+        command, saved = make_repo(tmp_path)
+        tracker = open_dvc(
+            DvcConfig(enabled=True, push=True, remote="s3", command=command), tmp_path
+        )
+
+        await tracker.queue(make_entry(), saved)
+        assert await tracker.flush()
+
+        assert calls(tmp_path)[1] == [
+            "push", str(dvc_file(saved.resolve())), "--remote", "s3"
+        ]
+
+    async def test_failure_is_reported(self, tmp_path):
+        """A failing dvc command is not an exception"""
+        command, saved = make_repo(tmp_path)
+        failing = saved.with_name("fail.csv")
+        failing.write_bytes(b"x")
+        tracker = open_dvc(DvcConfig(enabled=True, command=command), tmp_path)
+
+        await tracker.queue(make_entry(), failing)
+        assert not await tracker.flush()
+        missing = open_dvc(
+            DvcConfig(enabled=True, command="no-such-dvc-program"), tmp_path
+        )
+        await missing.queue(make_entry(), saved)
+        assert not await missing.flush()
+
+    async def test_one_command_per_run(self, tmp_path):
+        """The files of a run are added and pushed together, then the queue is empty"""
+        command, saved = make_repo(tmp_path)
+        other = saved.with_name("b.csv")
+        other.write_bytes(b"3,4")
+        tracker = open_dvc(
+            DvcConfig(enabled=True, push=True, command=command), tmp_path
+        )
+
+        await tracker.queue(make_entry(), saved)
+        await tracker.queue(make_entry(), other)
+        assert await tracker.flush()
+        assert await tracker.flush()
+
+        assert calls(tmp_path) == [
+            ["add", str(saved.resolve()), str(other.resolve())],
+            ["push", str(dvc_file(saved.resolve())), str(dvc_file(other.resolve()))],
+        ]
@@ -0,0 +1,75 @@
+"""
+Tests for encryption module
+"""
+
+import shutil
+import subprocess
+
+import pytest
+from gmail_downloader.config import DownloadConfig
+from gmail_downloader.encryption import EncryptionError, Encryptor, open_encryptor
+
+
+class TestEncryptor:
+    """Test building and running the encryption command"""
+
+    def test_age_recipients(self, monkeypatch, tmp_path):
+        """Keys are passed with -r, recipient files with -R"""
+        monkeypatch.setattr(shutil, "which", lambda name: f"/usr/bin/{name}")
+        recipients_file = tmp_path / "team.txt"
+        recipients_file.write_text("age1abc\nage1def\n")
+
+        encryptor = Encryptor("age", ["age1xyz", str(recipients_file)])
+
+        assert encryptor.suffix == ".age"
+        assert encryptor.command() == [
+            "/usr/bin/age", "--encrypt", "-r", "age1xyz", "-R", str(recipients_file)
+        ]
+
+    def test_missing_program(self, monkeypatch):
+        """A missing age or gpg fails before anything is downloaded"""
+        monkeypatch.setattr(shutil, "which", lambda name: None)
+
+        with pytest.raises(EncryptionError, match="age program"):
+            Encryptor("age", ["age1xyz"])
+
+    def test_off_by_default(self):
+        """Without download.encrypt files are saved as they are"""
+        assert open_encryptor(DownloadConfig()) is None
+
+    @pytest.mark.skipif(shutil.which("gpg") is None, reason="gpg is not installed")
+    async def test_gpg_round_trip(self, monkeypatch, tmp_path):
+        """gpg output decrypts back to the attachment; unknown keys fail"""
+        home = tmp_path / "gnupg"
+        home.mkdir(mode=0o700)
+        monkeypatch.setenv("GNUPGHOME", str(home))
+        subprocess.run(
+            [
+                "gpg",
+                "--batch",
+                "--passphrase",
+                "",
+                "--quick-gen-key",
+                "Exports <exports@example.com>",
+                "default",
+                "default",
+                "never",
+            ],
+            check=True,
+            capture_output=True,
+        )
+
+        ciphertext = await Encryptor(
+            "gpg", ["exports@example.com"]
+        ).encrypt(b"customer data")
+        plaintext = subprocess.run(
+            ["gpg", "--batch", "--quiet", "--decrypt"],
+            input=ciphertext,
+            check=True,
+            capture_output=True,
+        ).stdout
+
+        assert b"customer data" not in ciphertext
+        assert plaintext == b"customer data"
+        with pytest.raises(EncryptionError, match="gpg could not encrypt"):
+            await Encryptor("gpg", ["nobody@example.com"]).encrypt(b"customer data")
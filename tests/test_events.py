@@ -0,0 +1,168 @@
+"""
+Tests for events module
+"""
+
+import asyncio
+import io
+import json
+
+from gmail_downloader.events import (
+    EventBus,
+    EventMetrics,
+    FileDone,
+    FileFailed,
+    FileProgress,
+    RunDone,
+    SearchStarted,
+    write_json_lines,
+)
+from gmail_downloader.gmail_client import GmailAttachmentError
+
+from tests.gmailtest import FakeGmail
+
+
+async def drain(channel):
+    """Every event left on a closed channel"""
+    return [event async for event in channel]
+
+
+class TestEventBus:
+    """Test delivering events to subscribers"""
+
+    async def test_every_channel_gets_every_event(self):
+        """Each subscriber sees all events, in order"""
+        bus = EventBus()
+        first, second = bus.subscribe(), bus.subscribe()
+
+        await bus.publish(SearchStarted(["from:a"]))
+        await bus.publish(RunDone(1, 0, 10))
+        bus.close()
+
+        assert [
+            event.kind for event in await drain(first)
+        ] == ["search_started", "run_done"]
+        assert [
+            event.kind for event in await drain(second)
+        ] == ["search_started", "run_done"]
+
+    async def test_close_wakes_waiting_reader(self):
+        """A reader blocked on an empty channel ends when it is closed"""
+        bus = EventBus()
+        channel = bus.subscribe()
+        reader = asyncio.create_task(drain(channel))
+        await asyncio.sleep(0)
+
+        channel.close()
+
+        assert await reader == []
+        await bus.publish(RunDone(0, 0, 0))  # No longer delivered
+
+    async def test_full_channel_drops_progress(self):
+        """A slow consumer loses progress events, not the others"""
+        bus = EventBus()
+        channel = bus.subscribe(maxsize=1)
+        await bus.publish(SearchStarted([]))
+
+        await bus.publish(FileProgress(None, 1, 2))
+        await bus.publish(FileProgress(None, 2, 2))
+
+        assert channel.dropped == 2
+        assert isinstance(await channel.get(), SearchStarted)
+
+
+class TestServiceEvents:
+    """Test the events DownloadService publishes"""
+
+    async def test_run_events(self, make_service):
+        """A run reports its search, each file and its end"""
+        gmail = FakeGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2"})
+        service = make_service(gmail)
+        channel = service.events.subscribe()
+
+        await service.execute(await service.plan())
+        channel.close()
+        events = await drain(channel)
+
+        assert [event.kind for event in events] == [
+            "search_started",
+            "file_started",
+            "file_progress",
+            "file_progress",
+            "file_done",
+            "run_done",
+        ]
+        assert [
+            (event.bytes_done, event.bytes_total) for event in events[2:4]
+        ] == [(0, 3), (3, 3)]
+        done = events[4]
+        assert done.item.filename == "a.csv"
+        assert done.path.name == "a.csv"
+        assert (
+            events[-1].saved, events[-1].failed, events[-1].total_bytes
+        ) == (1, 0, 3)
+
+    async def test_failed_file(self, make_service):
+        """A failed download is published and the run still ends"""
+        gmail = FakeGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2"})
+        service = make_service(gmail)
+
+        async def broken(message_id, attachment_id):
+            raise GmailAttachmentError("HTTP 500 from Gmail")
+
+        service.gmail_client.download_attachment = broken
+        channel = service.events.subscribe()
+        await service.execute(await service.plan())
+        channel.close()
+        events = await drain(channel)
+
+        failed = [event for event in events if isinstance(event, FileFailed)]
+        assert [event.error for event in failed] == ["HTTP 500 from Gmail"]
+        assert not any(isinstance(event, FileDone) for event in events)
+        assert events[-1].failed == 1
+
+
+class TestConsumers:
+    """Test the ready-made event consumers"""
+
+    async def test_metrics(self, make_service):
+        """EventMetrics totals a run's events"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "bi@acme.com", "Exports", {"a.csv": b"1,2", "b.csv": b"3,4,5"}
+        )
+        service = make_service(gmail)
+        metrics = EventMetrics()
+        consumer = asyncio.create_task(metrics.consume(service.events.subscribe()))
+
+        await service.execute(await service.plan())
+        service.events.close()
+        await consumer
+
+        snapshot = metrics.snapshot()
+        assert (
+            snapshot["files_started"], snapshot["files_done"], snapshot["files_failed"]
+        ) == (2, 2, 0)
+        assert (
+            snapshot["searches"], snapshot["runs"], snapshot["bytes_saved"]
+        ) == (1, 1, 8)
+
+    async def test_json_lines(self):
+        """Each event becomes one line of JSON"""
+        bus = EventBus()
+        channel = bus.subscribe()
+        stream = io.StringIO()
+
+        await bus.publish(SearchStarted(["from:a"]))
+        await bus.publish(RunDone(2, 1, 30))
+        bus.close()
+        await write_json_lines(channel, stream)
+
+        lines = [json.loads(line) for line in stream.getvalue().splitlines()]
+        assert [line["event"] for line in lines] == ["search_started", "run_done"]
+        assert lines[0]["queries"] == ["from:a"]
+        assert (
+            lines[1]["saved"], lines[1]["failed"], lines[1]["total_bytes"]
+        ) == (2, 1, 30)
+        assert "at" in lines[1]
@@ -0,0 +1,55 @@
+"""
+Tests for exitcodes module
+"""
+
+from gmail_downloader.config import ConfigurationError
+from gmail_downloader.exitcodes import (
+    EXIT_AUTH,
+    EXIT_CONFIG,
+    EXIT_ERROR,
+    EXIT_QUOTA,
+    exit_code_for,
+)
+from gmail_downloader.gmail_client import (
+    GmailAuthenticationError,
+    GmailError,
+    GmailQuotaExceededError,
+)
+
+
+def wrapped(error):
+    """error re-raised as a plain GmailError, the way the client reports failures"""
+    try:
+        try:
+            raise error
+        except Exception as e:
+            raise GmailError(f"Failed to search messages: {e}")
+    except GmailError as outer:
+        return outer
+
+
+class TestExitCodeFor:
+    """Test picking the exit code for an error"""
+
+    def test_direct_errors(self):
+        """Each kind of error has its own code"""
+        assert exit_code_for(GmailAuthenticationError("Not signed in")) == EXIT_AUTH
+        assert (
+            exit_code_for(GmailQuotaExceededError("Daily API quota exceeded"))
+            == EXIT_QUOTA
+        )
+        assert exit_code_for(ConfigurationError("Invalid YAML")) == EXIT_CONFIG
+        assert exit_code_for(GmailError("Not found")) == EXIT_ERROR
+        assert exit_code_for(OSError("Disk full")) == EXIT_ERROR
+
+    def test_wrapped_errors(self):
+        """The cause of a wrapping error decides"""
+        assert (
+            exit_code_for(wrapped(GmailQuotaExceededError("Daily API quota exceeded")))
+            == EXIT_QUOTA
+        )
+        assert (
+            exit_code_for(wrapped(GmailAuthenticationError("Token refresh failed")))
+            == EXIT_AUTH
+        )
+        assert exit_code_for(wrapped(ValueError("bad"))) == EXIT_ERROR
@@ -0,0 +1,108 @@
+"""
+Tests for freshness module
+"""
+
+import asyncio
+from datetime import datetime
+from unittest.mock import AsyncMock, patch
+
+from gmail_downloader.config import AppConfig, FilterConfig, FreshnessConfig
+from gmail_downloader.events import EventBus, EventMetrics, FeedStale
+from gmail_downloader.freshness import FreshnessMonitor, StaleFeed, latest_arrival
+from gmail_downloader.manifest import ManifestEntry
+
+# A Monday; files are due by 09:00 on weekdays
+DEADLINE = datetime(2024, 6, 10, 9, 0)
+
+
+def make_entry(filename, date, sender="bi@acme.com"):
+    return ManifestEntry(
+        message_id=f"m-{filename}", attachment_id="a1", filename=filename,
+        path=filename, size=3, sha256="f" * 64, sender=sender, date=date,
+    )
+
+
+def make_monitor(last_arrival=None, notify=False):
+    config = AppConfig()
+    config.freshness = FreshnessConfig(expected_by=["0 9 * * MON-FRI"], notify=notify)
+    return FreshnessMonitor("sales", config, EventBus(), last_arrival)
+
+
+class TestLatestArrival:
+    """Test what the manifest says arrived last"""
+
+    def test_newest_matching_file(self):
+        """Only files from the feed's senders with matching names count"""
+        entries = [
+            make_entry("sales_1.csv", "2024-06-06T08:00:00"),
+            make_entry("sales_2.csv", "2024-06-07T08:00:00"),
+            make_entry("other.csv", "2024-06-09T08:00:00", sender="x@other.com"),
+            make_entry("notes.txt", "2024-06-09T08:00:00"),
+        ]
+        filters = FilterConfig(
+            senders=["@acme.com"], extensions=[".csv"], filename_patterns=["sales_*"]
+        )
+
+        assert latest_arrival(entries, filters) == datetime(2024, 6, 7, 8, 0)
+        assert latest_arrival([], filters) is None
+
+
+class TestCheck:
+    """Test the deadline checks"""
+
+    def test_on_time(self):
+        """A file sent since the previous deadline keeps the feed fresh"""
+        monitor = make_monitor(last_arrival=datetime(2024, 6, 10, 7, 30))
+
+        assert asyncio.run(monitor.check(DEADLINE)) is None
+        assert monitor.alerts == 0
+
+    def test_missed_deadline(self):
+        """No file since Friday's deadline is stale, and published"""
+        monitor = make_monitor(last_arrival=datetime(2024, 6, 7, 8, 0))
+        metrics = EventMetrics()
+
+        async def check():
+            channel = monitor.events.subscribe()
+            stale = await monitor.check(DEADLINE)
+            channel.close()
+            await metrics.consume(channel)
+            return stale
+
+        stale = asyncio.run(check())
+
+        assert stale.since == datetime(2024, 6, 7, 9, 0)
+        assert stale.describe().startswith("Feed sales is stale")
+        assert metrics.snapshot()["feeds_stale"] == 1
+        assert monitor.status()["stale"]
+
+    def test_next_file_clears(self):
+        """The next file sent after the window began clears the alert"""
+        monitor = make_monitor(last_arrival=datetime(2024, 6, 7, 8, 0))
+        asyncio.run(monitor.check(DEADLINE))
+
+        asyncio.run(
+            monitor.record(make_entry("late.csv", "2024-06-10T10:00:00"), "late.csv")
+        )
+
+        assert monitor.stale is None
+        assert monitor.alerts == 1
+
+    def test_webhook(self):
+        """With notify, the stale feed is posted to the webhook"""
+        monitor = make_monitor(notify=True)
+        with patch("gmail_downloader.freshness.WebhookNotifier") as notifier:
+            notifier.return_value.notify_stale_feed = AsyncMock()
+            asyncio.run(monitor.check(DEADLINE))
+
+        sent = notifier.return_value.notify_stale_feed.call_args[0][0]
+        assert isinstance(sent, StaleFeed)
+        assert sent.last_arrival is None
+        assert "none ever arrived" in sent.describe()
+
+
+def test_event_fields():
+    """The event carries the stale feed"""
+    stale = StaleFeed("sales", DEADLINE, datetime(2024, 6, 7, 9, 0), None)
+
+    assert FeedStale(stale).fields()["feed"] == "sales"
@@ -0,0 +1,141 @@
+"""
+Tests for gitsync module
+"""
+
+import subprocess
+import sys
+from pathlib import Path
+
+from gmail_downloader.config import GitConfig
+from gmail_downloader.gitsync import commit_message, find_repo, lfs_pattern, open_git
+from gmail_downloader.manifest import ManifestEntry
+
+# Stands in for git where git lfs is not installed
+NO_LFS = """
+import subprocess, sys
+sys.exit(1 if sys.argv[1] == "lfs" else subprocess.call(["git", *sys.argv[1:]]))
+"""
+
+
+def git(repo, *arguments):
+    """Run git in repo and return its output"""
+    return subprocess.run(
+        ["git", *arguments], cwd=repo, check=True, capture_output=True, text=True
+    ).stdout
+
+
+def make_repo(tmp_path):
+    """A git repository in tmp_path with a saved file below downloads/"""
+    git(tmp_path, "init", "--quiet")
+    git(tmp_path, "config", "user.email", "downloader@example.com")
+    git(tmp_path, "config", "user.name", "Downloader")
+    saved = tmp_path / "downloads" / "acme.com" / "a.csv"
+    saved.parent.mkdir(parents=True)
+    saved.write_bytes(b"1,2")
+    return saved
+
+
+def make_entry():
+    return ManifestEntry(
+        message_id="m1",
+        attachment_id="a1",
+        filename="a.csv",
+        path="acme.com/a.csv",
+        size=3,
+        sha256="f" * 64,
+        sender="bi@acme.com",
+        subject="Exports",
+        date="2024-06-01T09:30:12",
+    )
+
+
+class TestPatterns:
+    """Test the pure helpers"""
+
+    def test_find_repo(self, tmp_path):
+        """The nearest directory with .git is the root"""
+        (tmp_path / ".git").mkdir()
+
+        assert find_repo(tmp_path / "downloads" / "later") == tmp_path.resolve()
+
+    def test_lfs_pattern(self):
+        """Files are tracked by extension below the download directory"""
+        repo = Path("/repo")
+
+        assert lfs_pattern(
+            repo / "data" / "x" / "a.pdf", repo / "data", repo
+        ) == ("data/**/*.pdf", False)
+        assert lfs_pattern(repo / "x" / "a.pdf", repo, repo) == ("*.pdf", False)
+        assert lfs_pattern(
+            repo / "data" / "README", repo / "data", repo
+        ) == ("data/README", True)
+
+    def test_commit_message(self):
+        """The template gets the file's details"""
+        message = commit_message(GitConfig().message, make_entry())
+
+        assert message == "Add a.csv from bi@acme.com: Exports (2024-06-01T09:30:12)"
+        assert commit_message(
+            "{date:%Y-%m} {filename}", make_entry()
+        ) == "2024-06 a.csv"
+
+
+class TestCommit:
+    """Test committing saved files to a real repository"""
+
+    async def test_commits_only_the_file(self, tmp_path):
+        """The file is committed with the templated message; other staged work stays"""
+        saved = make_repo(tmp_path)
+        (tmp_path / "notes.txt").write_text("work in progress")
+        git(tmp_path, "add", "notes.txt")
+        committer = open_git(GitConfig(enabled=True, lfs=False), tmp_path / "downloads")
+
+        assert await committer.commit(make_entry(), saved)
+
+        assert git(
+            tmp_path, "log", "--format=%s"
+        ).strip() == "Add a.csv from bi@acme.com: Exports (2024-06-01T09:30:12)"
+        assert git(
+            tmp_path, "show", "--name-only", "--format="
+        ).split() == ["downloads/acme.com/a.csv"]
+        assert git(tmp_path, "diff", "--cached", "--name-only").split() == ["notes.txt"]
+
+    async def test_unchanged_file(self, tmp_path):
+        """Saving the same file again makes no empty commit"""
+        saved = make_repo(tmp_path)
+        committer = open_git(GitConfig(enabled=True, lfs=False), tmp_path)
+
+        assert await committer.commit(make_entry(), saved)
+        assert await committer.commit(make_entry(), saved)
+
+        assert len(git(tmp_path, "log", "--format=%h").split()) == 1
+
+    async def test_flush_commits_queued(self, tmp_path):
+        """Queued files are committed by the flush, once"""
+        saved = make_repo(tmp_path)
+        committer = open_git(GitConfig(enabled=True, lfs=False), tmp_path)
+
+        await committer.queue(make_entry(), saved)
+        assert git(tmp_path, "log", "--all", "--format=%h") == ""
+        assert await committer.flush()
+        assert await committer.flush()
+
+        assert len(git(tmp_path, "log", "--format=%h").split()) == 1
+
+    def test_outside_repo(self, tmp_path):
+        """Outside a repository nothing is committed"""
+        assert open_git(GitConfig(enabled=True), tmp_path) is None
+        assert open_git(GitConfig(), tmp_path) is None
+
+    async def test_lfs_failure(self, tmp_path):
+        """Without a working git lfs the file is not committed, and that is reported"""
+        saved = make_repo(tmp_path)
+        script = tmp_path / "no_lfs.py"
+        script.write_text(NO_LFS)
+        committer = open_git(
+            GitConfig(enabled=True, command=f"{sys.executable} {script}"), tmp_path
+        )
+
+        assert not await committer.commit(make_entry(), saved)
+        assert "downloads/" not in git(tmp_path, "diff", "--cached", "--name-only")
+        assert git(tmp_path, "log", "--all", "--format=%h") == ""
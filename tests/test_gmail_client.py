@@ -2,7 +2,11 @@
 Tests for gmail_client module
 """
 
+import base64
+import json
+
 import pytest
+from datetime import datetime, timezone
 from gmail_downloader.gmail_client import *
 
 class TestGmailClient:
@@ -13,3 +17,458 @@ class TestGmailClient:
         assert True
         
     # TODO: Add more tests
+
+
+class TestDaysUntilPurge:
+    """Test the trash retention estimate"""
+    
+    def test_recent_message(self):
+        """A message sent 10 days ago has at least 20 days left"""
+        now = datetime(2024, 6, 30)
+        assert days_until_purge(datetime(2024, 6, 20), now) == 20
+    
+    def test_timezone_aware_dates(self):
+        """Timezone-aware message dates work with the default clock"""
+        sent = datetime.now(timezone.utc)
+        assert days_until_purge(sent) == TRASH_RETENTION_DAYS
+    
+    def test_old_message_is_unknown(self):
+        """Past the retention period the trash date is unknown"""
+        now = datetime(2024, 6, 30)
+        assert days_until_purge(datetime(2024, 1, 1), now) is None
+
+
+class TestParseMessageReference:
+    """Test understanding --message-id values"""
+    
+    @pytest.mark.parametrize("value,expected", [
+        ("18AC3F0D2E7B5A91", ("message", "18ac3f0d2e7b5a91")),
+        (
+            "https://mail.google.com/mail/u/0/#inbox/18ac3f0d2e7b5a91",
+            ("thread", "18ac3f0d2e7b5a91"),
+        ),
+        ("https://mail.google.com/mail/u/1/#label/Clients%2FAcme/18ac3f0d2e7b5a91?projector=1",
+         ("thread", "18ac3f0d2e7b5a91")),
+        ("https://mail.google.com/mail/u/0/?ik=0f3a&view=om&permmsgid=msg-f:1778481211421448849",
+         ("message", "18ae6f3d2e7b5a91")),
+        ("<CAF3xk9p2@mail.gmail.com>", ("rfc822", "CAF3xk9p2@mail.gmail.com")),
+    ])
+    def test_accepted_forms(self, value, expected):
+        """IDs, legacy web URLs and Message-ID headers are recognised"""
+        assert parse_message_reference(value) == expected
+    
+    @pytest.mark.parametrize("value", [
+        "https://mail.google.com/mail/u/0/#inbox/FMfcgzGtwqHdKQbxkjBhLpZmwJtCqRsV",
+        "https://example.com/#inbox/18ac3f0d2e7b5a91",
+        "invoice.pdf",
+    ])
+    def test_rejected_forms(self, value):
+        """Opaque new-style URLs and anything else are refused"""
+        with pytest.raises(ValueError):
+            parse_message_reference(value)
+    
+    def test_new_style_url_points_to_show_original(self):
+        """
+        The undocumented #inbox/FMfcg... token cannot
+        be looked up; the error says what to pass
+        """
+        with pytest.raises(ValueError, match="Show original"):
+            parse_message_reference("https://mail.google.com/mail/u/0/#inbox/FMfcgzGtwqHdKQbxkjBhLpZmwJtCqRsV")
+
+
+class TestInlineImages:
+    """Test telling embedded images from attached files"""
+    
+    def make_attachment(
+        self, filename, size, mime_type="image/png", content_id="", inline=False
+    ):
+        """Attachment with the given part details"""
+        return EmailAttachment("a1", "m1", filename, mime_type, size,
+                               content_id=content_id, inline=inline)
+    
+    def test_referenced_logo(self):
+        """A small image with a Content-ID or inline disposition is inline"""
+        assert self.make_attachment(
+            "logo.png", 8000, content_id="logo@x"
+        ).is_inline_image
+        assert self.make_attachment(
+            "image001.jpg", 8000, "image/jpeg", inline=True
+        ).is_inline_image
+    
+    def test_large_inline_photo_is_kept(self):
+        """A pasted-in photo above INLINE_IMAGE_MAX_SIZE counts as content"""
+        photo = self.make_attachment(
+            "IMG_2041.jpg", INLINE_IMAGE_MAX_SIZE + 1, "image/jpeg", content_id="p"
+        )
+        assert not photo.is_inline_image
+    
+    def test_tiny_images_always_inline(self):
+        """Tracking pixels are inline even when attached as files"""
+        assert self.make_attachment(
+            "pixel.gif", 43, "application/octet-stream"
+        ).is_inline_image
+    
+    def test_attached_image_and_documents(self):
+        """Regular attached images and non-images are not inline"""
+        assert not self.make_attachment("scan.png", 8000).is_inline_image
+        assert not self.make_attachment(
+            "terms.pdf", 500, "application/pdf", inline=True
+        ).is_inline_image
+
+
+class TestBuildSearchQuery:
+    """Test Gmail query construction"""
+    
+    def make_client(self):
+        """Client with default config; no authentication needed to build queries"""
+        from gmail_downloader.config import AppConfig
+        return GmailClient(config=AppConfig())
+    
+    def test_min_size_uses_larger(self):
+        """The minimum size narrows the search with larger:"""
+        query = self.make_client().build_search_query(min_size=10240)
+        assert "larger:10240" in query
+    
+    def test_no_smaller_operator(self):
+        """smaller: is never used because it applies to the whole message"""
+        query = self.make_client().build_search_query(min_size=0)
+        assert "larger:" not in query
+        assert "smaller:" not in query
+    
+    def test_drive_links_widen_search(self):
+        """Messages that only link to Drive files match too"""
+        query = self.make_client().build_search_query(
+            extensions=[".pdf"], min_size=10240, drive_links=True
+        )
+        assert "has:drive" in query
+        assert "has:attachment" in query
+        assert "filename:" not in query
+        assert "larger:" not in query
+    
+    def test_labels(self):
+        """Labels use Gmail's search spelling and any one of them matches"""
+        client = self.make_client()
+        assert "label:invoices" in client.build_search_query(labels=["Invoices"])
+        
+        query = client.build_search_query(labels=["Clients/Acme Corp", "Receipts"])
+        assert "(label:clients-acme-corp OR label:receipts)" in query
+    
+    def test_dates_in_time_zone(self):
+        """With a time zone, dates become the timestamps of its midnights"""
+        client = self.make_client()
+        assert "after:2024/06/01" in client.build_search_query(after_date="2024-06-01")
+        
+        query = client.build_search_query(
+            after_date="2024-06-01",
+            before_date="2024-06-02",
+            date_timezone="Europe/Berlin",
+        )
+        assert "after:1717192800 before:1717279200" in query
+        assert "after:1717200000" in client.build_search_query(
+            after_date="2024-06-01", date_timezone="UTC"
+        )
+    
+    @pytest.mark.parametrize("scope,spam_trash,expected", [
+        ("all", False, None),
+        ("all", True, "in:anywhere"),
+        ("inbox", False, "in:inbox"),
+        ("inbox", True, "(in:inbox OR in:spam OR in:trash)"),
+    ])
+    def test_search_scope(self, scope, spam_trash, expected):
+        """The scope and Spam/Trash inclusion become in: terms"""
+        query = self.make_client().build_search_query(
+            search_scope=scope, include_spam_trash=spam_trash
+        )
+        if expected:
+            assert expected in query
+        else:
+            assert "in:" not in query
+    
+    def test_drive_scope_only_when_needed(self):
+        """The Drive scope is requested only with drive_links"""
+        from gmail_downloader.config import AppConfig
+        config = AppConfig()
+        assert GmailClient.DRIVE_SCOPE not in GmailClient(config=config).scopes()
+        
+        config.download.drive_links = True
+        assert GmailClient.DRIVE_SCOPE in GmailClient(config=config).scopes()
+    
+    def test_narrowest_scopes(self):
+        """Scopes implied by another requested one are left out"""
+        from gmail_downloader.config import AppConfig
+        config = AppConfig()
+        
+        assert required_scopes(config) == [READONLY_SCOPE]
+        assert required_scopes(config, [READONLY_SCOPE, MODIFY_SCOPE]) == [MODIFY_SCOPE]
+        config.conversions = {"spreadsheet": "csv"}
+        assert required_scopes(config, [FULL_MAIL_SCOPE]) == [
+            FULL_MAIL_SCOPE, DRIVE_SCOPE
+        ]
+    
+    def test_label_scope(self):
+        """Post-action labels sign in with gmail.modify instead of read-only"""
+        from gmail_downloader.config import AppConfig
+        config = AppConfig()
+        config.post_actions.label_saved = ["ingested/ok"]
+        
+        assert required_scopes(config) == [MODIFY_SCOPE]
+    
+    def test_missing_scopes(self):
+        """Broader granted scopes cover narrower needed ones"""
+        assert missing_scopes([MODIFY_SCOPE], [READONLY_SCOPE]) == []
+        assert missing_scopes([FULL_MAIL_SCOPE], [MODIFY_SCOPE]) == []
+        assert missing_scopes(
+            [READONLY_SCOPE], [READONLY_SCOPE, DRIVE_SCOPE]
+        ) == [DRIVE_SCOPE]
+        assert missing_scopes([READONLY_SCOPE], [MODIFY_SCOPE]) == [MODIFY_SCOPE]
+
+
+class TestQuotaTracking:
+    """Test that rate limits and quotas are kept per profile"""
+    
+    def make_client(self, profile, requests_per_day=1000000):
+        """Client for a named profile; no authentication needed"""
+        from gmail_downloader.config import AppConfig
+        config = AppConfig()
+        config.gmail.profile = profile
+        config.gmail.requests_per_day = requests_per_day
+        return GmailClient(config=config)
+    
+    def test_profiles_are_independent(self):
+        """Each profile has its own tracker; clients of one profile share it"""
+        first = self.make_client("quota-test-a")
+        second = self.make_client("quota-test-b")
+        again = self.make_client("quota-test-a")
+        
+        assert first.quota is not second.quota
+        assert first.quota is again.quota
+        assert first.quota.semaphore is not second.quota.semaphore
+    
+    def test_reset_forgets_trackers(self):
+        """After a reset a profile starts over with fresh counters"""
+        before = self.make_client("quota-test-reset")
+        before.quota.record(3)
+        
+        reset_quota_trackers()
+        after = self.make_client("quota-test-reset")
+        
+        assert after.quota is not before.quota
+        assert after.quota.quota_used == 0
+        assert quota_summary() == []
+    
+    def test_quota_exhaustion_is_per_profile(self):
+        """Using up one profile's quota does not block another profile"""
+        busy = self.make_client("quota-test-busy", requests_per_day=5)
+        idle = self.make_client("quota-test-idle", requests_per_day=5)
+        
+        busy.quota.record(5)
+        
+        with pytest.raises(GmailQuotaExceededError):
+            busy.quota.check(1)
+        idle.quota.check(1)
+    
+    def test_summary_lists_each_profile(self):
+        """The quota summary reports usage separately per profile"""
+        client = self.make_client("quota-test-summary")
+        client.quota.record(3)
+        
+        status = {s["profile"]: s for s in quota_summary()}["quota-test-summary"]
+        
+        assert status["quota_used_today"] == 3
+        assert status["statistics"]["requests_made"] == 1
+        assert client.get_quota_status() == status
+    
+    def test_daily_usage_adds_up_across_runs(self, tmp_path):
+        """Units used earlier the same quota day count; older days do not"""
+        state = tmp_path / ".work-quota.json"
+        first_run = QuotaTracker("work", 250, 1000)
+        first_run.attach_state(state)
+        first_run.record(300)
+        
+        second_run = QuotaTracker("work", 250, 1000)
+        second_run.attach_state(state)
+        assert second_run.quota_used == 300
+        assert second_run.remaining() == 700
+        assert second_run.stats["quota_units_used"] == 0
+        
+        state.write_text('{"day": "2000-01-01", "quota_used": 900}')
+        next_day = QuotaTracker("work", 250, 1000)
+        next_day.attach_state(state)
+        assert next_day.quota_used == 0
+    
+    def test_daily_usage_saved_atomically(self, tmp_path):
+        """The state file is replaced whole, with no temporary file left behind"""
+        state = tmp_path / ".work-quota.json"
+        tracker = QuotaTracker("work", 250, 1000)
+        tracker.attach_state(state)
+        tracker.record(5)
+        tracker.record(7)
+        
+        assert json.loads(state.read_text())["quota_used"] == 12
+        assert [path.name for path in tmp_path.iterdir()] == [".work-quota.json"]
+    
+    def test_warns_near_daily_limit(self):
+        """One warning once most of the daily quota is used"""
+        import logging
+        from unittest.mock import patch
+        tracker = QuotaTracker("quota-test-warn", 250, 100)
+        
+        with patch.object(
+            logging.getLogger("gmail_downloader.gmail_client"), "warning"
+        ) as warning:
+            tracker.record(70)
+            assert not warning.called
+            tracker.record(15)
+            tracker.record(5)
+        
+        warning.assert_called_once()
+        assert "85 of its 100" in warning.call_args[0][0]
+    
+    def test_quota_day_is_pacific(self):
+        """The quota day turns over at midnight Pacific Time, not UTC"""
+        assert quota_day(
+            datetime(2024, 6, 2, 3, 0, tzinfo=timezone.utc)
+        ) == "2024-06-01"
+        assert quota_day(
+            datetime(2024, 6, 2, 9, 0, tzinfo=timezone.utc)
+        ) == "2024-06-02"
+
+
+class TestAttachmentService:
+    """Test that attachments are downloaded over their own connections"""
+    
+    async def test_attachment_timeout_service(self):
+        """Attachments use the service with network.attachment_timeout_seconds"""
+        from gmail_downloader.config import AppConfig
+        from tests.gmailtest import FakeGmail
+        
+        gmail = FakeGmail()
+        message = gmail.add_message("a@example.com", "Report", {"a.pdf": b"data"})
+        client = GmailClient(config=AppConfig())
+        client.credentials = object()
+        client.service = object()  # Not an API: using it would fail
+        client.attachment_service = gmail.service()
+        
+        data = await client.download_attachment(message.id, message.attachment_id(1))
+        
+        assert data == b"data"
+
+
+class TestExtractMessageBodies:
+    """Test finding text and HTML bodies in nested payloads"""
+    
+    def part(self, mime_type, text, filename="", charset="utf-8"):
+        """Build a payload part with base64url body data"""
+        return {
+            "mimeType": mime_type,
+            "filename": filename,
+            "headers": [
+                {"name": "Content-Type", "value": f'{mime_type}; charset="{charset}"'}
+            ],
+            "body": {"data": base64.urlsafe_b64encode(text.encode(charset)).decode()},
+        }
+    
+    def test_nested_alternative(self):
+        """Bodies inside multipart/alternative are found; attachments are not bodies"""
+        payload = {
+            "mimeType": "multipart/mixed",
+            "parts": [
+                {
+                    "mimeType": "multipart/alternative",
+                    "parts": [
+                        self.part("text/plain", "Rows: 1200"),
+                        self.part("text/html", "<p>Rows: 1200</p>"),
+                    ],
+                },
+                self.part("text/plain", "id,value", filename="data.csv"),
+            ],
+        }
+        
+        assert extract_message_bodies(payload) == {
+            "text": "Rows: 1200",
+            "html": "<p>Rows: 1200</p>",
+        }
+    
+    def test_charset(self):
+        """The part's declared charset is used to decode it"""
+        payload = self.part("text/plain", "Größe: 5 MB", charset="iso-8859-1")
+        
+        assert extract_message_bodies(payload) == {"text": "Größe: 5 MB"}
+
+
+class TestExtractRawAttachment:
+    """Test pulling an attachment out of a raw RFC 822 message"""
+    
+    def raw_message(self):
+        """A multipart message with a body and two attachments"""
+        from email.message import EmailMessage as MimeMessage
+        message = MimeMessage()
+        message["Subject"] = "Export"
+        message.set_content("See attached")
+        message.add_attachment(
+            b"first", maintype="application", subtype="pdf", filename="a.pdf"
+        )
+        message.add_attachment(
+            b"second", maintype="text", subtype="csv", filename="b.csv"
+        )
+        return message.as_bytes()
+    
+    def test_by_part_id(self):
+        """Gmail part IDs index into the MIME tree"""
+        assert extract_raw_attachment(self.raw_message(), "2", "b.csv") == b"second"
+    
+    def test_falls_back_to_filename(self):
+        """A part ID that does not match is resolved by filename"""
+        assert extract_raw_attachment(self.raw_message(), "7", "a.pdf") == b"first"
+    
+    def test_missing(self):
+        """Unknown attachments give None"""
+        assert extract_raw_attachment(self.raw_message(), "", "c.zip") is None
+
+
+class TestDecodeFilename:
+    """Test decoding RFC 2047/2231 encoded attachment names"""
+    
+    def test_rfc2047(self):
+        """Encoded words (base64 and quoted-printable) are decoded"""
+        assert decode_filename("=?UTF-8?B?5aCx5ZGK5pu4LnBkZg==?=") == "報告書.pdf"
+        assert decode_filename("=?ISO-8859-1?Q?R=E9sum=E9.pdf?=") == "Résumé.pdf"
+    
+    def test_rfc2231(self):
+        """charset'language'percent-encoding is decoded"""
+        assert (
+            decode_filename("UTF-8''%D0%9E%D1%82%D1%87%D1%91%D1%82.xlsx")
+            == "Отчёт.xlsx"
+        )
+    
+    def test_plain_and_broken_names_unchanged(self):
+        """Plain names and undecodable values are returned as they are"""
+        assert decode_filename("report.pdf") == "report.pdf"
+        assert (
+            decode_filename("=?NO-SUCH-CHARSET?B?YWJj?=")
+            == "=?NO-SUCH-CHARSET?B?YWJj?="
+        )
+    
+    def test_part_filename_from_headers(self):
+        """Parts without a Gmail filename get theirs from filename*= continuations"""
+        part = {
+            "filename": "",
+            "headers": [
+                {"name": "Content-Type", "value": "application/pdf"},
+                {
+                    "name": "Content-Disposition",
+                    "value": (
+                        "attachment; filename*0*=UTF-8''%E5%A0%B1%E5%91%8A; "
+                        "filename*1*=%E6%9B%B8.pdf"
+                    ),
+                },
+            ],
+        }
+        
+        assert part_filename(part) == "報告書.pdf"
+    
+    def test_part_filename_left_encoded_by_gmail(self):
+        """An encoded filename field is decoded before it reaches sanitization"""
+        part = {"filename": "=?UTF-8?B?5aCx5ZGK5pu4LnBkZg==?=", "headers": []}
+        
+        assert part_filename(part) == "報告書.pdf"
@@ -0,0 +1,435 @@
+"""
+Tests for the fake Gmail account, and the pipeline run against it
+"""
+
+import asyncio
+from datetime import datetime
+
+import pytest
+from gmail_downloader.downloader import (
+    AttachmentDownloader,
+    DownloadService,
+    EmailWatcher,
+)
+from gmail_downloader.events import RunDone
+from gmail_downloader.gmail_client import GmailAPI, GmailError
+from gmail_downloader.manifest import DownloadManifest
+
+from tests.gmailtest import FakeAttachment, FakeGmail
+
+
+class TestSearch:
+    """Test the supported Gmail query terms"""
+
+    def make_gmail(self):
+        """Mailbox with three messages from two senders"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "Vendor <reports@vendor.com>",
+            "Daily export",
+            {"export.csv": b"a,b"},
+            date=datetime(2024, 6, 1),
+            labels=["INBOX", "Clients/Acme Corp"],
+        )
+        gmail.add_message("billing@acme.com", "Invoice 42", {"invoice.pdf": b"%PDF"},
+                          date=datetime(2024, 6, 3))
+        gmail.add_message("friend@mail.com", "Lunch?", body="See you at noon",
+                          date=datetime(2024, 6, 5), labels=["TRASH"])
+        return gmail
+
+    @pytest.mark.parametrize("query, expected", [
+        ("", ["m2", "m1"]),
+        ("has:attachment from:reports@vendor.com", ["m1"]),
+        ("(from:reports@vendor.com OR from:billing@acme.com) filename:pdf", ["m2"]),
+        ("label:clients-acme-corp", ["m1"]),
+        ("after:2024/06/02 before:2024/06/04", ["m2"]),
+        ('subject:"invoice 42"', ["m2"]),
+        ("-invoice", ["m1"]),
+        ("in:trash noon", ["m3"]),
+    ])
+    def test_query_terms(self, query, expected):
+        """Queries built by the project match like Gmail, newest first"""
+        assert [m.id for m in self.make_gmail().search(query)] == expected
+
+    def test_unsupported_term(self):
+        """Unknown operators fail instead of being ignored"""
+        with pytest.raises(ValueError):
+            self.make_gmail().search("older_than:1y")
+
+
+class TestPipeline:
+    """Test the downloader and watcher against the fake account"""
+
+    def test_client_is_gmail_api(self):
+        """The fake account's client satisfies the GmailAPI interface"""
+        assert isinstance(FakeGmail().client(), GmailAPI)
+
+    async def test_download(self, tmp_path, make_service, fake_config):
+        """Attachments are found across result pages, saved and recorded"""
+        gmail = FakeGmail(page_size=1)
+        gmail.add_message(
+            "reports@vendor.com",
+            "Export",
+            {"export.csv": b"a,b\n1,2\n", "logo.png": b"png"},
+        )
+        gmail.add_message("billing@acme.com", "Invoice", {"invoice.pdf": b"%PDF-1.4"})
+        fake_config.filters.extensions = [".pdf", ".csv"]
+        service = make_service(gmail)
+
+        saved = await service.execute(await service.plan())
+
+        assert sorted(p.relative_to(tmp_path).as_posix() for p in saved) == [
+            "billing/invoice.pdf",
+            "reports/export.csv",
+        ]
+        assert (tmp_path / "reports" / "export.csv").read_bytes() == b"a,b\n1,2\n"
+        downloads = [
+            r for r in gmail.requests if r[0] == "users.messages.attachments.get"
+        ]
+        assert len(downloads) == 2
+
+    async def test_split_queries(self, make_service):
+        """Long sender and label lists are split, and the results merged once each"""
+        gmail = FakeGmail()
+        senders = [f"sender{n}@vendor.com" for n in range(8)]
+        for sender in senders:
+            gmail.add_message(
+                sender, "Export", {"export.csv": b"a,b"}, labels=["INBOX", "Reports"]
+            )
+        gmail.add_message(
+            "other@vendor.com", "Export", {"export.csv": b"a,b"}, labels=["Reports"]
+        )
+        service = make_service(gmail)
+        service.config.filters.senders = senders
+        service.config.filters.labels = ["Reports", "INBOX"]
+
+        queries = service.build_queries(max_length=120)
+        planned = await service.plan(queries=queries)
+
+        assert len(queries) > 2
+        assert all(len(query) <= 120 for query in queries)
+        assert service.build_queries() == [service.build_query()]
+        assert sorted(item.message.sender for item in planned) == sorted(senders)
+
+    async def test_split_queries_newest_first(self, make_service):
+        """Merged results come newest first; max_results keeps the newest messages"""
+        gmail = FakeGmail()
+        senders = [f"sender{n}@vendor.com" for n in range(6)]
+        for n, sender in enumerate(senders):
+            gmail.add_message(
+                sender, "Export", {"export.csv": b"a,b"}, date=datetime(2024, 6, 1 + n)
+            )
+        service = make_service(gmail)
+        service.config.filters.senders = senders
+
+        queries = service.build_queries(max_length=120)
+        planned = await service.plan(queries=queries)
+        newest = await service.plan(queries=queries, max_results=2)
+
+        assert len(queries) > 1
+        assert [item.message.sender for item in planned] == senders[::-1]
+        assert [item.message.sender for item in newest] == senders[:-3:-1]
+
+    async def test_budget(self, make_service):
+        """A run stops before the file over budget and the next run continues"""
+        gmail = FakeGmail()
+        for day in range(1, 5):
+            gmail.add_message(
+                "reports@vendor.com",
+                f"Export {day}",
+                {f"export-{day}.csv": b"x" * 100},
+                date=datetime(2024, 6, day),
+            )
+        service = make_service(gmail)
+        service.config.download.max_total_size = 250
+
+        saved = await service.execute(await service.plan())
+
+        assert [path.name for path in saved] == ["export-4.csv", "export-3.csv"]
+        assert service.budget_reason == "max_total_size 250.0 B"
+        assert [
+            item.filename for item in service.budget_skipped
+        ] == ["export-2.csv", "export-1.csv"]
+
+        service.config.download.max_total_size = None
+        service.config.download.max_files = 1
+        saved = await service.execute(await service.plan())
+
+        assert [path.name for path in saved] == ["export-2.csv"]
+        assert service.budget_reason == "max_files 1"
+        assert [item.filename for item in service.budget_skipped] == ["export-1.csv"]
+
+    async def test_budget_spent_earlier(self, make_service):
+        """What earlier slices of a run saved counts against the budget"""
+        gmail = FakeGmail()
+        for day in range(1, 3):
+            gmail.add_message(
+                "reports@vendor.com",
+                f"Export {day}",
+                {f"export-{day}.csv": b"x" * 100},
+                date=datetime(2024, 6, day),
+            )
+        service = make_service(gmail)
+        service.config.download.max_files = 3
+        service.spent_files, service.spent_bytes = 2, 200
+
+        saved = await service.execute(await service.plan())
+
+        assert [path.name for path in saved] == ["export-2.csv"]
+        assert service.budget_reason == "max_files 3"
+
+    async def test_min_free_space(self, tmp_path, monkeypatch, make_service):
+        """A run stops before the file that would leave the disk too full"""
+        gmail = FakeGmail()
+        for day in range(1, 5):
+            gmail.add_message(
+                "reports@vendor.com",
+                f"Export {day}",
+                {f"export-{day}.csv": b"x" * 100},
+                date=datetime(2024, 6, day),
+            )
+        service = make_service(gmail)
+        service.config.download.min_free_space = 1000
+        # A disk with 1250 bytes free before the run
+        monkeypatch.setattr(
+            "gmail_downloader.downloader.free_disk_space",
+            lambda path: 1250 - sum(f.stat().st_size for f in tmp_path.rglob("*.csv")),
+        )
+
+        saved = await service.execute(await service.plan())
+
+        assert [path.name for path in saved] == ["export-4.csv", "export-3.csv"]
+        assert service.budget_reason == "min_free_space 1000.0 B"
+        assert [
+            item.filename for item in service.budget_skipped
+        ] == ["export-2.csv", "export-1.csv"]
+
+    async def test_free_space_of_download_directory(
+        self, tmp_path, monkeypatch, fake_config
+    ):
+        """The disk measured is the download directory's, not the manifest_dir's"""
+        gmail = FakeGmail()
+        gmail.add_message("reports@vendor.com", "Export", {"export.csv": b"x" * 100})
+        fake_config.download.base_dir = str(tmp_path / "out")
+        service = DownloadService(
+            gmail.client(fake_config),
+            AttachmentDownloader(fake_config.download.base_dir),
+            DownloadManifest(tmp_path / "state"),
+            fake_config,
+        )
+        measured = []
+        monkeypatch.setattr(
+            "gmail_downloader.downloader.free_disk_space",
+            lambda path: measured.append(path) or 10 ** 12,
+        )
+
+        await service.execute(await service.plan())
+
+        assert set(measured) == {tmp_path / "out"}
+
+    async def test_per_message_filters(self, make_service):
+        """Inline images are skipped and max_per_message keeps the first matches"""
+        gmail = FakeGmail()
+        message = gmail.add_message(
+            "news@vendor.com", "Newsletter", {"issue.pdf": b"%PDF" * 1000}
+        )
+        message.attachments += [
+            FakeAttachment(
+                "logo.png", b"png" * 1000, "image/png", content_id="logo@vendor"
+            ),
+            FakeAttachment("chart.png", b"png" * 1000, "image/png"),
+            FakeAttachment("appendix.pdf", b"%PDF" * 1000, "application/pdf"),
+        ]
+        service = make_service(gmail)
+        service.config.filters.extensions = [".pdf", ".png"]
+        service.config.filters.skip_inline_images = True
+
+        assert [
+            item.filename for item in await service.plan()
+        ] == ["issue.pdf", "chart.png", "appendix.pdf"]
+
+        service.config.filters.max_per_message = 2
+        assert [
+            item.filename for item in await service.plan()
+        ] == ["issue.pdf", "chart.png"]
+
+    async def test_filename_patterns(self, make_service):
+        """Only attachments named like a glob or regex pattern are planned"""
+        gmail = FakeGmail()
+        gmail.add_message("bi@acme.com", "Exports", {
+            "Report_June.csv": b"a,b",
+            "summary.csv": b"a,b",
+            "metrics_20240601.xlsx": b"xlsx",
+            "metrics_june.xlsx": b"xlsx",
+        })
+        service = make_service(gmail)
+        service.config.filters.extensions = [".csv", ".xlsx"]
+        service.config.filters.filename_patterns = [
+            "report_*.csv", r"^metrics_\d{8}\.xlsx$"
+        ]
+
+        assert [
+            item.filename for item in await service.plan()
+        ] == ["Report_June.csv", "metrics_20240601.xlsx"]
+
+    async def test_download_by_reference(self, make_service, fake_config):
+        """A Gmail URL covers its conversation; a Message-ID its one message"""
+        gmail = FakeGmail()
+        first = gmail.add_message(
+            "a@vendor.com", "Q2", {"q2.pdf": b"%PDF"}, thread_id="18ac3f0d2e7b5a91"
+        )
+        gmail.add_message(
+            "a@vendor.com",
+            "Re: Q2",
+            {"q2-fixed.pdf": b"%PDF"},
+            thread_id="18ac3f0d2e7b5a91",
+        )
+        other = gmail.add_message("b@acme.com", "Export", {"export.csv": b"a,b"})
+        fake_config.filters.extensions = [".pdf", ".csv"]
+        service = make_service(gmail)
+        client = service.gmail_client
+
+        thread = await client.resolve_message_reference(
+            "https://mail.google.com/mail/u/0/#inbox/18ac3f0d2e7b5a91"
+        )
+        reply = await client.resolve_message_reference(f"<{other.rfc822_id}>")
+        planned = await service.plan_messages(thread + reply + [first.id])
+
+        assert [item.filename for item in planned] == [
+            "q2.pdf", "q2-fixed.pdf", "export.csv"
+        ]
+        with pytest.raises(GmailError):
+            await client.resolve_message_reference("<nobody@nowhere>")
+
+    async def test_spam_and_trash(self, make_service, fake_config):
+        """Misfiled mail is only found with include_spam_trash"""
+        gmail = FakeGmail()
+        gmail.add_message("a@vendor.com", "Report", {"inbox.pdf": b"%PDF"})
+        gmail.add_message(
+            "a@vendor.com", "Report", {"spam.pdf": b"%PDF"}, labels=["SPAM"]
+        )
+        gmail.add_message(
+            "a@vendor.com", "Report", {"archived.pdf": b"%PDF"}, labels=[]
+        )
+        fake_config.filters.extensions = [".pdf", ".csv"]
+        service = make_service(gmail)
+
+        async def found():
+            return sorted(item.filename for item in await service.plan())
+
+        assert await found() == ["archived.pdf", "inbox.pdf"]
+        service.config.filters.include_spam_trash = True
+        assert await found() == ["archived.pdf", "inbox.pdf", "spam.pdf"]
+        service.config.filters.search_scope = "inbox"
+        assert await found() == ["inbox.pdf", "spam.pdf"]
+
+    async def test_addresses_parsed(self):
+        """Quoted display names and recipient lists come apart cleanly"""
+        gmail = FakeGmail()
+        message = gmail.add_message('"Billing, Acme" <Billing@acme.com>', "Invoice")
+        message.to = '"Ops, Team" <ops@example.com>, finance@example.com'
+
+        details = await gmail.client().get_message_details(message.id)
+
+        assert (
+            details.sender, details.sender_name
+        ) == ("billing@acme.com", "Billing, Acme")
+        assert details.recipient == "ops@example.com"
+        assert details.recipients == ["ops@example.com", "finance@example.com"]
+
+    async def test_display_name_in_manifest(self, tmp_path, make_service):
+        """The sender's display name is recorded next to the address"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "Acme Analytics <reports@acme.com>", "Export", {"export.csv": b"a,b\n1,2\n"}
+        )
+        service = make_service(gmail)
+
+        await service.execute(await service.plan())
+
+        [entry] = list(DownloadManifest(tmp_path).load())
+        assert (entry.sender, entry.sender_name) == (
+            "reports@acme.com", "Acme Analytics"
+        )
+
+    async def test_post_action_labels(self, make_service):
+        """Handled messages are labelled, missing labels created with their parents"""
+        gmail = FakeGmail()
+        ok = gmail.add_message("reports@vendor.com", "Export", {"export.csv": b"a,b"})
+        broken = gmail.add_message(
+            "reports@vendor.com", "Export", {"broken.csv": b"a,b"}, labels=["Ingested"]
+        )
+        service = make_service(gmail)
+        service.config.post_actions.label_saved = ["ingested/ok"]
+        service.config.post_actions.label_failed = ["ingested/error"]
+        fetch = service.fetch
+
+        async def failing_fetch(message_id, attachment_id, on_progress=None):
+            if message_id == broken.id:
+                raise GmailError("attachment gone")
+            return await fetch(message_id, attachment_id, on_progress)
+
+        service.fetch = failing_fetch
+        await service.execute(await service.plan())
+        gmail.add_message("reports@vendor.com", "Export", {"later.csv": b"a,b"})
+        await service.execute(await service.plan())
+
+        assert ok.labels == ["INBOX", "ingested/ok"]
+        assert broken.labels == ["Ingested", "ingested/error"]
+        created = [
+            params["body"]["name"]
+            for name, params in gmail.requests
+            if name == "users.labels.create"
+        ]
+        assert created == ["ingested/error", "ingested/ok"]
+        assert len([r for r in gmail.requests if r[0] == "users.labels.list"]) == 1
+
+    async def test_post_action_labels_replace_other_outcome(self, make_service):
+        """A failed message loses its error label once saved, before RunDone"""
+        gmail = FakeGmail()
+        retried = gmail.add_message(
+            "reports@vendor.com",
+            "Export",
+            {"export.csv": b"a,b"},
+            labels=["ingested/error"],
+        )
+        service = make_service(gmail)
+        service.config.post_actions.label_saved = ["ingested/ok"]
+        service.config.post_actions.label_failed = ["ingested/error"]
+        labels_at_run_done = []
+        publish = service.events.publish
+
+        async def record(event):
+            if isinstance(event, RunDone):
+                labels_at_run_done.extend(retried.labels)
+            await publish(event)
+
+        service.events.publish = record
+        await service.execute(await service.plan())
+
+        assert retried.labels == ["ingested/ok"]
+        assert labels_at_run_done == ["ingested/ok"]
+
+    async def test_missing_message(self):
+        """Unknown IDs fail like the real API"""
+        with pytest.raises(GmailError):
+            await FakeGmail().client().get_message_details("nope")
+
+    async def test_watch_picks_up_new_mail(self, tmp_path, make_service):
+        """Mail already there is the baseline; new mail is downloaded"""
+        gmail = FakeGmail()
+        gmail.add_message("reports@vendor.com", "Old", {"old.csv": b"old"})
+        watcher = EmailWatcher(make_service(gmail))
+
+        task = asyncio.create_task(watcher.start_watching(check_interval=0.01))
+        try:
+            await asyncio.sleep(0.05)
+            gmail.add_message("reports@vendor.com", "New", {"new.csv": b"new"})
+            await asyncio.sleep(0.1)
+        finally:
+            watcher.stop_watching()
+            task.cancel()
+
+        assert (tmp_path / "reports" / "new.csv").read_bytes() == b"new"
+        assert not (tmp_path / "reports" / "old.csv").exists()
+        assert watcher.stats["attachments_saved"] == 1
@@ -0,0 +1,129 @@
+"""
+Tests for httptrace module
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from gmail_downloader.httptrace import (
+    TracingHttp,
+    quota_headers,
+    sanitize_url,
+    summarize_body,
+)
+
+
+class FakeResponse(dict):
+    """An httplib2 response: headers as a dict, plus the status"""
+
+    def __init__(self, status, headers):
+        super().__init__(headers)
+        self.status = status
+
+
+class FakeHttp:
+    """Answers every request with one response, or raises"""
+
+    def __init__(self, response=None, content=b"", error=None):
+        self.response, self.content, self.error = response, content, error
+        self.credentials = "creds"
+
+    def request(self, uri, method="GET", body=None, headers=None, **kwargs):
+        if self.error:
+            raise self.error
+        return self.response, self.content
+
+
+class TestSanitize:
+    """Test what traces leave out"""
+
+    def test_secret_params_masked(self):
+        """Tokens in query strings are masked; the search stays readable"""
+        url = sanitize_url(
+            "https://oauth2.googleapis.com/x?access_token=ya29.secret&q=from%3Aa%40b.com"
+        )
+
+        assert "ya29.secret" not in url
+        assert "access_token=%2A%2A%2A" in url
+        assert "q=from%3Aa%40b.com" in url
+        assert (
+            sanitize_url("https://gmail.googleapis.com/gmail/v1/users/me/labels")
+            == "https://gmail.googleapis.com/gmail/v1/users/me/labels"
+        )
+
+    def test_attachment_data_elided(self):
+        """Base64 data is replaced by its length, at any depth"""
+        body = json.dumps(
+            {"payload": {"parts": [{"body": {"data": "QUJD" * 100}}]}, "size": 3}
+        ).encode()
+
+        text = summarize_body(body, "application/json; charset=UTF-8")
+
+        assert "QUJD" not in text
+        assert "<400 chars elided>" in text
+        assert '"size": 3' in text
+
+    def test_non_json_bodies(self):
+        """Downloads are only described by their size"""
+        assert summarize_body(b"%PDF-1.7 ...", "application/pdf") == "<12 bytes elided>"
+        assert summarize_body(b"", "application/json") == ""
+
+    def test_quota_headers(self):
+        """Only quota and rate-limit headers are kept"""
+        assert quota_headers(
+            {"Retry-After": "30", "Content-Type": "application/json"}
+        ) == {"retry-after": "30"}
+
+
+def logged(logger):
+    """The messages a mocked logger was given"""
+    return "\n".join(call.args[0] for call in logger.debug.call_args_list)
+
+
+class TestTracingHttp:
+    """Test the traced transport"""
+
+    def test_logs_request_and_response(self):
+        """Method, URL, status and body are logged; attributes pass through"""
+        http = TracingHttp(
+            FakeHttp(
+                FakeResponse(
+                    200,
+                    {
+                        "content-type": "application/json",
+                        "x-ratelimit-remaining": "99",
+                    },
+                ),
+                b'{"resultSizeEstimate": 0}',
+            )
+        )
+
+        with patch("gmail_downloader.httptrace.logger") as logger:
+            response, content = http.request(
+                "https://gmail.googleapis.com/gmail/v1/users/me/messages?q=x"
+            )
+
+        assert response.status == 200 and content == b'{"resultSizeEstimate": 0}'
+        assert (
+            "HTTP GET https://gmail.googleapis.com/gmail/v1/users/me/messages?q=x "
+            "-> 200 in"
+            in logged(logger)
+        )
+        assert "x-ratelimit-remaining: 99" in logged(logger)
+        assert '{"resultSizeEstimate": 0}' in logged(logger)
+        assert http.credentials == "creds"
+
+    def test_logs_failures(self):
+        """A request that raises is traced, then the error goes on"""
+        http = TracingHttp(FakeHttp(error=TimeoutError("timed out")))
+
+        with patch("gmail_downloader.httptrace.logger") as logger:
+            with pytest.raises(TimeoutError):
+                http.request("https://gmail.googleapis.com/x", "POST")
+
+        assert (
+            "HTTP POST https://gmail.googleapis.com/x -> TimeoutError: timed out"
+            in logged(logger)
+        )
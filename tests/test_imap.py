@@ -0,0 +1,267 @@
+"""
+Tests for imap module
+"""
+
+import imaplib
+import re
+from email.message import EmailMessage
+
+import pytest
+from gmail_downloader.downloader import STATUS_NEW
+from gmail_downloader.gmail_client import GmailAuthenticationError, create_client
+from gmail_downloader.imap import (
+    ImapError,
+    ImapMailbox,
+    decode_mailbox_name,
+    encode_mailbox_name,
+    parse_fetch,
+)
+
+
+def make_message(sender, subject, files):
+    """An RFC 822 message with attachments"""
+    message = EmailMessage()
+    message["From"] = sender
+    message["To"] = "me@example.com"
+    message["Subject"] = subject
+    message["Date"] = "Mon, 03 Jun 2024 08:00:00 +0000"
+    message.set_content("See attached.")
+    for filename, data in files.items():
+        message.add_attachment(
+            data, maintype="application", subtype="octet-stream", filename=filename
+        )
+    return message.as_bytes()
+
+
+class FakeImapServer:
+    """
+    Gmail's IMAP server as imaplib sees it.
+
+    X-GM-RAW searches are answered from results (query -> UIDs), every
+    message matching when the query is not listed.
+    """
+
+    def __init__(
+        self, capabilities=b"IMAP4rev1 X-GM-EXT-1 AUTH=XOAUTH2", password="app-password"
+    ):
+        self.capabilities = capabilities
+        self.password = password
+        self.messages = {}
+        self.results = {}
+        self.commands = []
+        self.connections = 0
+        self.drop_next = False
+        self.literal = None
+
+    def add(self, uid, gmail_id, raw, labels='"\\\\Inbox" Reports', flags="\\Seen"):
+        self.messages[uid] = (gmail_id, raw, labels, flags)
+
+    # imaplib.IMAP4_SSL(host, port, timeout=...)
+    def __call__(self, host, port, timeout=None):
+        self.connections += 1
+        return self
+
+    def login(self, user, password):
+        if password != self.password:
+            raise imaplib.IMAP4.error("[AUTHENTICATIONFAILED] Invalid credentials")
+        return "OK", [b"Logged in"]
+
+    def capability(self):
+        return "OK", [self.capabilities]
+
+    def select(self, mailbox, readonly=False):
+        self.commands.append(("SELECT", mailbox, readonly))
+        return "OK", [str(len(self.messages)).encode()]
+
+    def list(self):
+        return "OK", [
+            b'(\\HasNoChildren) "/" "INBOX"',
+            b'(\\HasNoChildren) "/" "Reports"',
+            b'(\\HasNoChildren) "/" "Entw&APw-rfe"',
+            b'(\\HasChildren \\Noselect) "/" "[Gmail]"',
+            b'(\\All \\HasNoChildren) "/" "[Gmail]/All Mail"',
+        ]
+
+    def uid(self, command, *args):
+        self.commands.append((command, *args))
+        if self.drop_next:
+            self.drop_next = False
+            raise imaplib.IMAP4.abort("socket error: EOF")
+        if command == "SEARCH":
+            if args[0] == "X-GM-MSGID":
+                uids = [
+                    uid
+                    for uid, message in self.messages.items()
+                    if message[0] == int(args[1])
+                ]
+            elif args[0] == "X-GM-RAW":
+                uids = self.results.get(args[1].strip('"'), list(self.messages))
+            else:
+                uids = list(self.messages)
+            return "OK", [" ".join(str(uid) for uid in uids).encode()]
+        if command == "FETCH":
+            return "OK", self.fetch([int(uid) for uid in args[0].split(",")], args[1])
+        raise imaplib.IMAP4.error(f"unexpected command {command}")
+
+    def fetch(self, uids, items):
+        response = []
+        for sequence, uid in enumerate(uids, 1):
+            gmail_id, raw, labels, flags = self.messages[uid]
+            if items == "(BODY.PEEK[])":
+                response += [
+                    (f"{sequence} (UID {uid} BODY[] {{{len(raw)}}}".encode(), raw), b")"
+                ]
+            elif items == "(BODY.PEEK[HEADER])":
+                header = raw.split(b"\n\n", 1)[0] + b"\n\n"
+                prefix = f"{sequence} (UID {uid} BODY[HEADER] {{{len(header)}}}"
+                response += [(prefix.encode(), header), b")"]
+            else:
+                response.append(
+                    f'{sequence} (X-GM-THRID {gmail_id} X-GM-MSGID {gmail_id} '
+                    f'X-GM-LABELS ({labels}) '
+                    f'UID {uid} FLAGS ({flags}) INTERNALDATE '
+                    '"03-Jun-2024 08:00:00 +0000" '
+                    f'RFC822.SIZE {len(raw)})'.encode()
+                )
+        return response
+
+    def logout(self):
+        return "BYE", []
+
+    def shutdown(self):
+        pass
+
+
+@pytest.fixture
+def server(monkeypatch):
+    server = FakeImapServer()
+    monkeypatch.setattr(imaplib, "IMAP4_SSL", server)
+    return server
+
+
+@pytest.fixture
+def imap_config(fake_config):
+    """fake_config signing in to IMAP with an app password"""
+    fake_config.gmail.protocol = "imap"
+    fake_config.imap.username = "me@example.com"
+    fake_config.imap.password = "app-password"
+    return fake_config
+
+
+class TestParsing:
+    """Test reading IMAP responses"""
+
+    def test_mailbox_names(self):
+        """Folder names round-trip through modified UTF-7"""
+        assert decode_mailbox_name("Entw&APw-rfe") == "Entwürfe"
+        assert decode_mailbox_name("Q&-A") == "Q&A"
+        assert encode_mailbox_name("Entwürfe") == "Entw&APw-rfe"
+        assert encode_mailbox_name("Q&A") == "Q&-A"
+
+    def test_fetch(self):
+        """Items are paired up, quoted strings unescaped and literals put back"""
+        fields = parse_fetch(
+            [
+                b'1 (UID 7 X-GM-MSGID 123 X-GM-LABELS '
+                b'("\\\\Inbox" "Clients \\"A\\"") FLAGS ())',
+                (b"2 (UID 8 X-GM-LABELS ({5}", b"Notes"),
+                b") X-GM-MSGID 456)",
+            ]
+        )
+
+        assert fields == [
+            {
+                "UID": "7",
+                "X-GM-MSGID": "123",
+                "X-GM-LABELS": ["\\Inbox", 'Clients "A"'],
+                "FLAGS": [],
+            },
+            {"UID": "8", "X-GM-LABELS": ["Notes"], "X-GM-MSGID": "456"},
+        ]
+
+
+class TestImapMailbox:
+    """Test the pipeline over a fake Gmail IMAP server"""
+
+    async def test_download(self, server, imap_config, make_service):
+        """Searches go to Gmail as queries; files are saved under Gmail's message IDs"""
+        server.add(
+            11,
+            1800000000000000002,
+            make_message("reports@vendor.com", "June", {"june.csv": b"a,b"}),
+        )
+        service = make_service(ImapMailbox(imap_config))
+
+        assert create_client(imap_config).profile == "imap:me@example.com"
+        await service.gmail_client.authenticate()
+        planned = await service.plan()
+        saved = await service.execute(planned)
+
+        assert [
+            (item.filename, item.status) for item in planned
+        ] == [("june.csv", STATUS_NEW)]
+        assert planned[0].message.message_id == format(1800000000000000002, "x")
+        assert [path.read_bytes() for path in saved] == [b"a,b"]
+        searches = [
+            command
+            for command in server.commands
+            if command[:2] == ("SEARCH", "X-GM-RAW")
+        ]
+        assert searches and "has:attachment" in searches[0][2]
+        # Nothing is marked as read
+        assert server.commands[0] == ("SELECT", '"[Gmail]/All Mail"', True)
+        assert all(
+            "BODY[]" not in " ".join(command[1:])
+            for command in server.commands
+            if command[0] == "FETCH"
+        )
+
+    async def test_labels(self, server, imap_config):
+        """Labels come from X-GM-LABELS and the account's folders"""
+        server.add(
+            11,
+            1800000000000000002,
+            make_message("a@vendor.com", "June", {"a.csv": b"a"}),
+            flags="",
+        )
+        mailbox = ImapMailbox(imap_config)
+        client = mailbox.client()
+        await client.authenticate()
+
+        message = await client.get_message_details(format(1800000000000000002, "x"))
+
+        assert sorted(message.labels) == ["INBOX", "Reports", "UNREAD"]
+        assert "Entwürfe" in (await client.get_label_names()).values()
+
+    async def test_reconnects(self, server, imap_config):
+        """A dropped connection is opened again once"""
+        server.add(
+            11,
+            1800000000000000002,
+            make_message("a@vendor.com", "June", {"a.csv": b"a"}),
+        )
+        mailbox = ImapMailbox(imap_config)
+        await mailbox.connect()
+        server.drop_next = True
+
+        assert [message.uid for message in mailbox.search("has:attachment")] == [11]
+        assert server.connections == 2
+
+    async def test_wrong_password(self, server, imap_config):
+        """A rejected app password is a sign-in error"""
+        server.password = "other"
+
+        with pytest.raises(GmailAuthenticationError):
+            await ImapMailbox(imap_config).connect()
+
+    async def test_not_gmail(self, server, imap_config):
+        """Servers without Gmail's extensions are refused"""
+        server.capabilities = b"IMAP4rev1 IDLE"
+
+        with pytest.raises(ImapError, match="X-GM-EXT-1"):
+            await ImapMailbox(imap_config).connect()
+
+    def test_spam_and_trash(self, server, imap_config):
+        """Spam and Trash are other folders over IMAP, so asking for them fails"""
+        with pytest.raises(ImapError):
+            ImapMailbox(imap_config).search("has:attachment", include_spam_trash=True)
@@ -0,0 +1,115 @@
+"""
+Tests for incremental module
+"""
+
+from datetime import datetime, timezone
+
+import pytest
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import (
+    STATUS_EXISTS,
+    STATUS_NEW,
+    AttachmentDownloader,
+    DownloadService,
+)
+from gmail_downloader.incremental import (
+    INCREMENTAL_FILENAME,
+    IncrementalState,
+    cursor_key,
+    newest,
+    since_query,
+)
+from gmail_downloader.manifest import DownloadManifest, ManifestError
+
+from tests.gmailtest import FakeGmail
+
+
+class TestCursorKey:
+    """Test keying cursors by profile and search"""
+
+    def test_profile_and_filters_matter(self):
+        """Another profile, query or Spam/Trash setting gets its own cursor"""
+        key = cursor_key("work", "from:a@vendor.com")
+
+        assert key.startswith("work:")
+        assert key == cursor_key("work", "from:a@vendor.com")
+        assert key != cursor_key("home", "from:a@vendor.com")
+        assert key != cursor_key("work", "from:b@vendor.com")
+        assert key != cursor_key("work", "from:a@vendor.com", include_spam_trash=True)
+
+    def test_since_query(self):
+        """The query is narrowed to a timestamp a minute before the cursor"""
+        since = datetime(2024, 6, 1, 12, 0, tzinfo=timezone.utc)
+
+        assert (
+            since_query("from:a@vendor.com", since)
+            == f"(from:a@vendor.com) after:{int(since.timestamp()) - 60}"
+        )
+
+    def test_newest(self):
+        """Missing dates are ignored"""
+        assert newest(
+            [None, datetime(2024, 6, 2), datetime(2024, 6, 1)]
+        ) == datetime(2024, 6, 2)
+        assert newest([]) is None
+
+
+class TestIncrementalState:
+    """Test storing cursors next to the manifest"""
+
+    def test_round_trip_and_only_forward(self, tmp_path):
+        """Cursors survive a reload and never move back"""
+        state = IncrementalState(tmp_path).load()
+        assert state.get("work:abc") is None
+
+        state.advance(
+            "work:abc", datetime(2024, 6, 2, tzinfo=timezone.utc), "from:a@vendor.com"
+        )
+        state.advance("work:abc", datetime(2024, 6, 1, tzinfo=timezone.utc))
+
+        reloaded = IncrementalState(tmp_path).load()
+        assert reloaded.get("work:abc") == datetime(2024, 6, 2, tzinfo=timezone.utc)
+        assert (tmp_path / INCREMENTAL_FILENAME).exists()
+
+    def test_corrupt_file(self, tmp_path):
+        """An unreadable file is an error rather than a silent full search"""
+        (tmp_path / INCREMENTAL_FILENAME).write_text("{not json")
+
+        with pytest.raises(ManifestError):
+            IncrementalState(tmp_path).load()
+
+
+class TestIncrementalSearch:
+    """Test the cursor against the fake account"""
+
+    async def test_only_newer_messages(self, tmp_path):
+        """After a run, the next search only finds mail since then, plus the overlap"""
+        gmail = FakeGmail()
+        gmail.add_message("reports@vendor.com", "June 1", {"june-1.csv": b"a,b"},
+                          date=datetime(2024, 6, 1, 8, 0))
+        config = AppConfig()
+        config.filters.extensions = [".csv"]
+        config.filters.min_size = 1
+        service = DownloadService(
+            gmail.client(config),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        state = IncrementalState(tmp_path).load()
+        key = cursor_key("default", service.build_query())
+
+        planned = await service.plan()
+        await service.execute(planned)
+        state.advance(key, newest(item.message.received for item in planned))
+
+        gmail.add_message("reports@vendor.com", "June 2", {"june-2.csv": b"c,d"},
+                          date=datetime(2024, 6, 2, 8, 0))
+        planned = await service.plan(
+            query=since_query(service.build_query(), state.get(key))
+        )
+
+        assert [(item.filename, item.status) for item in planned] == [
+            ("june-2.csv", STATUS_NEW),
+            ("june-1.csv", STATUS_EXISTS),
+        ]
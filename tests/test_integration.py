@@ -0,0 +1,114 @@
+"""
+End-to-end tests of the download pipeline against recorded Gmail API responses
+"""
+
+import pytest
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import AttachmentDownloader, DownloadService
+from gmail_downloader.gmail_client import GmailClient
+from gmail_downloader.manifest import DownloadManifest
+
+from tests.cassette import (
+    CASSETTE_DIR,
+    Cassette,
+    CassetteError,
+    CassetteService,
+    recording,
+)
+
+# Query the download_pipeline cassette was recorded with
+PIPELINE_QUERY = "has:attachment from:(reports@vendor.com OR billing@acme.com)"
+
+
+def pipeline_config(tmp_path):
+    """Config matching the download_pipeline cassette"""
+    config = AppConfig()
+    config.gmail.profile = "cassette"
+    config.filters.query = PIPELINE_QUERY
+    config.filters.extensions = [".pdf", ".csv"]
+    config.filters.min_size = 1
+    config.download.base_dir = str(tmp_path)
+    return config
+
+
+@pytest.fixture
+def gmail(tmp_path):
+    """
+    GmailClient answering from the download_pipeline cassette
+    
+    With GMAIL_CASSETTE_RECORD set, the client authenticates for real and
+    the cassette is rewritten from the live responses.
+    """
+    path = CASSETTE_DIR / "download_pipeline.json"
+    client = GmailClient(config=pipeline_config(tmp_path))
+    
+    if recording():
+        import asyncio
+        asyncio.run(client.authenticate())
+        cassette = Cassette(path)
+        client.service = CassetteService(cassette, target=client.service)
+        yield client
+        cassette.save()
+        return
+    
+    client.service = CassetteService(Cassette.load(path))
+    client.credentials = object()
+    yield client
+
+
+class TestDownloadPipeline:
+    """Search, filter, download, organize and record from a cassette"""
+    
+    def make_service(self, gmail, tmp_path):
+        """DownloadService writing into tmp_path"""
+        return DownloadService(
+            gmail,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            gmail.config,
+        )
+    
+    async def test_plan_follows_pagination_and_filters(self, gmail, tmp_path):
+        """Both result pages are searched; extensions filter out the logo"""
+        planned = await self.make_service(gmail, tmp_path).plan()
+        
+        assert [item.filename for item in planned] == ["report.pdf", "invoice.csv"]
+    
+    async def test_full_download(self, gmail, tmp_path):
+        """Attachments are saved into sender folders and recorded in the manifest"""
+        service = self.make_service(gmail, tmp_path)
+        
+        saved = await service.execute(await service.plan())
+        
+        assert sorted(p.relative_to(tmp_path).as_posix() for p in saved) == [
+            "billing/invoice.csv",
+            "reports/report.pdf",
+        ]
+        assert (
+            tmp_path / "reports" / "report.pdf"
+        ).read_bytes() == b"%PDF-1.4 quarterly report"
+        
+        manifest = DownloadManifest(tmp_path).load()
+        invoice = manifest.get("m2", "invoice.csv")
+        assert invoice.path == "billing/invoice.csv"
+        assert invoice.labels == ["INBOX", "Finance"]
+        assert invoice.thread_id == "t-m2"
+        assert invoice.anomaly == ""
+        assert len(manifest.query("sender=reports@vendor.com")) == 1
+    
+    async def test_second_run_downloads_nothing(self, gmail, tmp_path):
+        """Replaying the same search against a filled folder finds nothing new"""
+        service = self.make_service(gmail, tmp_path)
+        await service.execute(await service.plan())
+        
+        saved = await service.execute(await service.plan())
+        
+        assert saved == []
+    
+    async def test_unrecorded_request_fails(self, gmail, tmp_path):
+        """Requests missing from the cassette fail loudly, not by returning nothing"""
+        if recording():
+            pytest.skip("only meaningful when replaying")
+        
+        with pytest.raises(CassetteError):
+            gmail.service.users().messages().get(userId="me", id="unknown").execute()
@@ -0,0 +1,137 @@
+"""
+Tests for junk module
+"""
+
+import struct
+
+import pytest
+from gmail_downloader.config import AppConfig, ConfigurationError, JunkConfig
+from gmail_downloader.downloader import (
+    STATUS_EXISTS,
+    AttachmentDownloader,
+    DownloadService,
+)
+from gmail_downloader.gmail_client import EmailAttachment
+from gmail_downloader.junk import JunkFilter, image_dimensions
+from gmail_downloader.manifest import DownloadManifest
+
+from tests.gmailtest import FakeAttachment, FakeGmail
+
+
+def png(width, height, padding=0):
+    """PNG header of the given size, padded to make the file bigger"""
+    return (b"\x89PNG\r\n\x1a\n" + struct.pack(">I", 13) + b"IHDR"
+            + struct.pack(">II", width, height) + b"\0" * (5 + padding))
+
+
+def jpeg(width, height):
+    """JPEG with an APP0 segment before the frame header"""
+    app0 = b"\xff\xe0" + struct.pack(">H", 16) + b"JFIF\0" + b"\0" * 9
+    sof = b"\xff\xc0" + struct.pack(">HBHH", 17, 8, height, width) + b"\0" * 10
+    return b"\xff\xd8" + app0 + sof
+
+
+def attachment(filename, size, mime_type="image/png"):
+    """Attachment metadata as Gmail reports it"""
+    return EmailAttachment("a1", "m1", filename, mime_type, size)
+
+
+class TestImageDimensions:
+    """Test reading image sizes from file headers"""
+
+    @pytest.mark.parametrize(
+        "data,expected",
+        [
+            (png(600, 100), (600, 100)),
+            (b"GIF89a" + struct.pack("<HH", 1, 1) + b"\0" * 4, (1, 1)),
+            (jpeg(1024, 768), (1024, 768)),
+            (b"BM" + b"\0" * 16 + struct.pack("<ii", 40, -20), (40, 20)),
+            (
+                b"RIFF\0\0\0\0WEBPVP8X"
+                + b"\0" * 8
+                + (99).to_bytes(3, "little")
+                + (9).to_bytes(3, "little"),
+                (100, 10),
+            ),
+        ],
+    )
+    def test_formats(self, data, expected):
+        """PNG, GIF, JPEG, BMP and WebP headers are understood"""
+        assert image_dimensions(data) == expected
+
+    def test_unknown_or_truncated(self):
+        """Other files and cut-off headers give None"""
+        assert image_dimensions(b"%PDF-1.4") is None
+        assert image_dimensions(b"\x89PNG\r\n\x1a\n\0\0") is None
+
+
+class TestJunkFilter:
+    """Test the junk decisions"""
+
+    def test_small_images_and_decoration_names(self):
+        """Small images and names like image001.png are junk, documents never"""
+        junk = JunkFilter(JunkConfig())
+
+        assert junk.reason(attachment("photo.png", 2000))
+        assert junk.reason(attachment("image001.PNG", 50000))
+        assert junk.reason(attachment("Logo_small.gif", 50000, "image/gif"))
+        assert junk.reason(attachment("chart.png", 50000)) is None
+        assert junk.reason(attachment("notes.txt", 100, "text/plain")) is None
+
+    def test_allowlist_overrides(self):
+        """Allowed names are kept even when small or banner-shaped"""
+        junk = JunkFilter(JunkConfig(allow=["stamp*.png"]))
+
+        assert junk.reason(attachment("stamp.png", 500)) is None
+        assert not junk.is_banner(attachment("stamp-wide.png", 500), png(800, 50))
+
+    def test_banner_proportions(self):
+        """Images far wider than tall are banners unless the check is off"""
+        junk = JunkFilter(JunkConfig())
+
+        assert junk.is_banner(attachment("header.png", 50000), png(800, 100))
+        assert not junk.is_banner(attachment("chart.png", 50000), png(800, 600))
+        assert not JunkFilter(JunkConfig(max_aspect_ratio=0)).is_banner(
+            attachment("header.png", 50000), png(800, 100)
+        )
+
+    def test_validation(self):
+        """Aspect ratios below 1 make no sense"""
+        with pytest.raises(ConfigurationError):
+            JunkConfig(max_aspect_ratio=0.5).validate()
+
+
+class TestJunkInDownloads:
+    """Test the filter in a download against the fake account"""
+
+    async def test_drops_junk(self, tmp_path):
+        """Logos are not planned and banners not saved; real files are"""
+        gmail = FakeGmail()
+        message = gmail.add_message("news@vendor.com", "Newsletter")
+        message.attachments += [
+            FakeAttachment("report.pdf", b"%PDF" * 1000, "application/pdf"),
+            FakeAttachment("image001.png", png(120, 60, 20000), "image/png"),
+            FakeAttachment("header.png", png(800, 100, 20000), "image/png"),
+            FakeAttachment("chart.png", png(800, 600, 20000), "image/png"),
+        ]
+        config = AppConfig()
+        config.filters.extensions = [".pdf", ".png"]
+        config.filters.min_size = 1
+        config.junk.enabled = True
+        service = DownloadService(
+            gmail.client(config),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+
+        planned = await service.plan()
+        saved = await service.execute(planned)
+
+        assert [item.filename for item in planned] == [
+            "report.pdf", "header.png", "chart.png"
+        ]
+        assert sorted(path.name for path in saved) == ["chart.png", "report.pdf"]
+
+        # The banner is recorded as skipped, so it is not fetched again
+        assert [item.status for item in await service.plan()] == [STATUS_EXISTS] * 3
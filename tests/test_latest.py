@@ -0,0 +1,68 @@
+"""
+Tests for latest module
+"""
+
+import os
+from pathlib import Path
+
+from gmail_downloader.latest import latest_path, link_target, update_latest
+
+
+def test_latest_path(tmp_path):
+    """Links are kept per sender folder under latest/"""
+    assert latest_path(
+        tmp_path, "acme", "sales.csv"
+    ) == tmp_path / "latest" / "acme" / "sales.csv"
+
+
+class TestUpdateLatest:
+    """Test pointing a latest link at the newest file"""
+    
+    def test_relative_symlink(self, tmp_path):
+        """The link is relative and follows the newest file"""
+        first = tmp_path / "acme" / "sales.csv"
+        first.parent.mkdir()
+        first.write_text("june 1")
+        link = latest_path(tmp_path, "acme", "sales.csv")
+        
+        assert update_latest(link, first, "2024-06-01T08:00:00")
+        assert os.readlink(link) == os.path.join("..", "..", "acme", "sales.csv")
+        assert link_target(link) == first
+        
+        second = tmp_path / "acme" / "sales_2024-06-02.csv"
+        second.write_text("june 2")
+        assert update_latest(link, second, "2024-06-02T08:00:00", "2024-06-01T08:00:00")
+        assert link.read_text() == "june 2"
+    
+    def test_older_file_leaves_link(self, tmp_path):
+        """A backfilled file from an older message does not take the link"""
+        newer = tmp_path / "sales_2024-06-02.csv"
+        newer.write_text("june 2")
+        older = tmp_path / "sales.csv"
+        older.write_text("june 1")
+        link = latest_path(tmp_path, "acme", "sales.csv")
+        update_latest(link, newer, "2024-06-02T08:00:00")
+        
+        assert not update_latest(
+            link, older, "2024-06-01T08:00:00", "2024-06-02T08:00:00"
+        )
+        assert link.read_text() == "june 2"
+    
+    def test_copy_without_symlinks(self, tmp_path, monkeypatch):
+        """Where symlinks fail the link is a copy, dated like its message"""
+        def no_symlinks(self, target):
+            raise OSError("symbolic links are not available")
+        
+        monkeypatch.setattr(Path, "symlink_to", no_symlinks)
+        newer = tmp_path / "sales_2024-06-02.csv"
+        newer.write_text("june 2")
+        link = latest_path(tmp_path, "acme", "sales.csv")
+        
+        assert update_latest(link, newer, "2024-06-02T08:00:00")
+        assert not link.is_symlink()
+        assert link_target(link) is None
+        assert link.read_text() == "june 2"
+        
+        older = tmp_path / "sales.csv"
+        older.write_text("june 1")
+        assert not update_latest(link, older, "2024-06-01T08:00:00")
@@ -0,0 +1,88 @@
+"""
+Tests for logging_setup module
+"""
+
+import json
+import logging
+
+import pytest
+
+from gmail_downloader.config import LoggingConfig
+from gmail_downloader.logging_setup import (
+    PACKAGE_LOGGER,
+    JsonFormatter,
+    resolve_console_level,
+    setup_logging,
+)
+
+
+class TestResolveConsoleLevel:
+    """Test how CLI flags combine with the configured level."""
+
+    def test_config_level_used_by_default(self):
+        """Without flags the configured level applies."""
+        assert resolve_console_level("WARNING") == logging.WARNING
+
+    def test_flag_precedence(self):
+        """--debug beats --verbose, which beats --quiet."""
+        assert resolve_console_level("INFO", quiet=True) == logging.ERROR
+        assert resolve_console_level("ERROR", verbose=True) == logging.INFO
+        assert resolve_console_level("ERROR", verbose=True, debug=True) == logging.DEBUG
+
+
+class TestJsonFormatter:
+    """Test structured JSON log output."""
+
+    def test_includes_extra_fields(self):
+        """Fields passed via extra= become top-level JSON keys."""
+        record = logging.LogRecord(
+            "gmail_downloader.test",
+            logging.INFO,
+            __file__,
+            1,
+            "saved %s",
+            ("a.pdf",),
+            None,
+        )
+        record.path = "/tmp/a.pdf"
+
+        data = json.loads(JsonFormatter().format(record))
+
+        assert data["message"] == "saved a.pdf"
+        assert data["level"] == "INFO"
+        assert data["path"] == "/tmp/a.pdf"
+        assert "run_id" in data
+
+    def test_run_id_optional(self):
+        """The run ID can be left out."""
+        record = logging.LogRecord("x", logging.INFO, __file__, 1, "hi", (), None)
+        data = json.loads(JsonFormatter(include_run_id=False).format(record))
+        assert "run_id" not in data
+
+
+class TestSetupLogging:
+    """Test handler configuration."""
+
+    def test_writes_log_file(self, tmp_path):
+        """Messages reach the rotating log file."""
+        log_file = tmp_path / "logs" / "app.log"
+        logger = setup_logging(LoggingConfig(file_path=str(log_file)))
+
+        logging.getLogger(f"{PACKAGE_LOGGER}.test").info("hello file")
+        for handler in logger.handlers:
+            handler.flush()
+
+        assert "hello file" in log_file.read_text()
+
+    def test_repeated_setup_does_not_duplicate_handlers(self):
+        """Calling setup twice replaces the previous handlers."""
+        setup_logging(LoggingConfig(file_path=None))
+        logger = setup_logging(LoggingConfig(file_path=None))
+        assert len(logger.handlers) == 1
+
+    def test_log_file_override(self, tmp_path):
+        """The --log-file flag overrides the configured path."""
+        override = tmp_path / "override.log"
+        logger = setup_logging(LoggingConfig(file_path=None), log_file=str(override))
+        assert len(logger.handlers) == 2
+        assert override.exists()
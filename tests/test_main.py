@@ -0,0 +1,77 @@
+"""
+Tests for main module
+"""
+
+import pytest
+
+from gmail_downloader.config import AppConfig, ConfigurationError
+from gmail_downloader.main import (
+    _apply_size_options,
+    _download_option_conflict,
+    _reloader,
+)
+
+
+class TestDownloadOptions:
+    """Test which download options can be used together"""
+
+    def test_compatible(self):
+        """Options that combine are accepted"""
+        assert _download_option_conflict() == ""
+        assert _download_option_conflict(incremental=True, query=True) == ""
+        assert _download_option_conflict(interactive=True, message_id=True) == ""
+
+    def test_incremental_refuses_interactive(self):
+        """A picked part of an incremental run would move its start past the rest"""
+        conflict = _download_option_conflict(incremental=True, interactive=True)
+
+        assert "--incremental" in conflict and "--interactive" in conflict
+
+    def test_refetch_conflicts(self):
+        """--refetch replaces the search, so search-shaping options are refused"""
+        assert _download_option_conflict(refetch=True, interactive=True)
+        assert _download_option_conflict(refetch=True, message_id=True)
+        assert _download_option_conflict(refetch=True, incremental=True)
+        assert _download_option_conflict(shard=True, incremental=True)
+
+
+class FakeWatcher:
+    """Records the configurations it is given"""
+
+    def __init__(self):
+        self.configs = []
+
+    def reload(self, config):
+        self.configs.append(config)
+
+
+class TestReload:
+    """Test reloading the watch configuration"""
+
+    def test_invalid_options_keep_running(self):
+        """A reloaded file clashing with the command-line options is refused"""
+        watcher = FakeWatcher()
+
+        def reload_config():
+            config = AppConfig()
+            config.filters.max_size = 1024
+            _apply_size_options(config, "10KB", None)
+            return config
+
+        _reloader(watcher, reload_config)()
+
+        assert watcher.configs == []
+
+    def test_valid_reload_applied(self):
+        """A valid configuration reaches the watcher"""
+        watcher = FakeWatcher()
+        config = AppConfig()
+
+        _reloader(watcher, lambda: config)()
+
+        assert watcher.configs == [config]
+
+    def test_options_raise_configuration_error(self):
+        """Option helpers raise instead of exiting, so a reload can recover"""
+        with pytest.raises(ConfigurationError, match="--min-size must be smaller"):
+            _apply_size_options(AppConfig(), "20MB", "10MB")
@@ -0,0 +1,155 @@
+"""
+Tests for manifest module
+"""
+
+import json
+
+import pytest
+
+from gmail_downloader.manifest import (
+    MANIFEST_FILENAME,
+    DownloadManifest,
+    ManifestEntry,
+    ManifestError,
+)
+
+
+def make_entry(**overrides):
+    """Build a manifest entry with sensible defaults for tests."""
+    values = {
+        "message_id": "msg1",
+        "attachment_id": "att1",
+        "filename": "report.pdf",
+        "path": "reports/report.pdf",
+        "size": 2048,
+        "sha256": "abc123",
+        "sender": "reports@company.com",
+    }
+    values.update(overrides)
+    return ManifestEntry(**values)
+
+
+class TestDownloadManifest:
+    """Test loading, saving and looking up manifest entries."""
+
+    def test_missing_file_is_empty(self, tmp_path):
+        """A directory without a manifest yields an empty manifest."""
+        manifest = DownloadManifest(tmp_path).load()
+        assert len(manifest) == 0
+
+    def test_round_trip(self, tmp_path):
+        """Entries survive a save/load cycle."""
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(make_entry())
+        manifest.save()
+
+        assert (tmp_path / MANIFEST_FILENAME).exists()
+
+        loaded = DownloadManifest(tmp_path).load()
+        entry = loaded.get("msg1", "report.pdf")
+        assert entry is not None
+        assert entry.size == 2048
+        assert entry.sender == "reports@company.com"
+
+    def test_record_replaces_same_key(self, tmp_path):
+        """Recording the same attachment twice keeps only the latest entry."""
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(make_entry(size=1))
+        manifest.record(make_entry(size=2))
+
+        assert len(manifest) == 1
+        assert manifest.get("msg1", "report.pdf").size == 2
+
+    def test_find_by_path(self, tmp_path):
+        """Entries can be found by absolute or relative path."""
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(make_entry())
+
+        assert manifest.find_by_path("reports/report.pdf") is not None
+        assert manifest.find_by_path(tmp_path / "reports" / "report.pdf") is not None
+        assert manifest.find_by_path("other.pdf") is None
+
+    def test_unknown_keys_ignored(self, tmp_path):
+        """Newer manifest fields do not break older readers."""
+        data = {"version": 1, "entries": [{**make_entry().__dict__, "extra": 1}]}
+        (tmp_path / MANIFEST_FILENAME).write_text(json.dumps(data))
+
+        manifest = DownloadManifest(tmp_path).load()
+        assert manifest.get("msg1", "report.pdf") is not None
+
+    def test_corrupt_file_raises(self, tmp_path):
+        """A manifest that is not valid JSON raises ManifestError."""
+        (tmp_path / MANIFEST_FILENAME).write_text("{not json")
+
+        with pytest.raises(ManifestError):
+            DownloadManifest(tmp_path).load()
+
+
+class TestManifestQuery:
+    """Test the manifest query language used by --refetch."""
+
+    @pytest.fixture
+    def manifest(self, tmp_path):
+        """A manifest with a few entries from different senders and dates."""
+        manifest = DownloadManifest(tmp_path)
+        manifest.record(make_entry(
+            message_id="m1", filename="a.csv", sender="foo@bar.com",
+            date="2024-12-31T10:00:00+00:00", size=100, labels=["INBOX", "client-X"],
+        ))
+        manifest.record(make_entry(
+            message_id="m2", filename="b.csv", sender="foo@bar.com",
+            date="2025-02-01T10:00:00+00:00", size=5 * 1024 * 1024,
+        ))
+        manifest.record(make_entry(
+            message_id="m3", filename="invoice_march.pdf", sender="other@bar.com",
+            date="2025-03-01T10:00:00", size=100,
+        ))
+        return manifest
+
+    def test_equality_and_date(self, manifest):
+        """The example from the docs selects only newer files from one sender."""
+        results = manifest.query("sender=foo@bar.com AND date>2025-01-01")
+        assert [e.message_id for e in results] == ["m2"]
+
+    def test_case_insensitive_and(self, manifest):
+        """AND is case-insensitive and string matching ignores case."""
+        results = manifest.query("sender=FOO@bar.com and size>=1MB")
+        assert [e.message_id for e in results] == ["m2"]
+
+    def test_declared_size(self, manifest):
+        """The size Gmail declared compares as a size, like the saved one."""
+        manifest.record(make_entry(
+            message_id="m4", filename="c.csv", size=100, declared_size=2 * 1024 * 1024,
+            anomaly="size_mismatch",
+        ))
+
+        assert [e.message_id for e in manifest.query("declared_size>=512KB")] == ["m4"]
+        with pytest.raises(ManifestError):
+            manifest.query("declared_size>lots")
+
+    def test_substring_and_not_equal(self, manifest):
+        """~ matches substrings and != excludes."""
+        assert [e.message_id for e in manifest.query("filename~invoice")] == ["m3"]
+        assert len(manifest.query("sender!=foo@bar.com")) == 1
+
+    def test_list_fields(self, manifest):
+        """Label queries match any label; != requires no match."""
+        assert [e.message_id for e in manifest.query("labels=client-x")] == ["m1"]
+        assert [e.message_id for e in manifest.query("labels~client")] == ["m1"]
+        assert len(manifest.query("labels!=client-X")) == 2
+
+    def test_quoted_values(self, manifest):
+        """Values may be wrapped in quotes."""
+        assert len(manifest.query("sender='foo@bar.com'")) == 2
+
+    @pytest.mark.parametrize("query", [
+        "",
+        "sender",
+        "unknown=1",
+        "date>not-a-date",
+        "size>lots",
+    ])
+    def test_invalid_queries(self, manifest, query):
+        """Malformed queries raise ManifestError."""
+        with pytest.raises(ManifestError):
+            manifest.query(query)
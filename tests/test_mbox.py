@@ -0,0 +1,175 @@
+"""
+Tests for mbox module
+"""
+
+import mailbox
+from email.message import EmailMessage
+
+import pytest
+from gmail_downloader.downloader import STATUS_EXISTS, STATUS_NEW
+from gmail_downloader.mbox import MboxError, MboxMailbox, parse_takeout_labels
+
+
+def make_message(sender, subject, files, date="Mon, 03 Jun 2024 08:00:00 +0000",
+                 labels="Inbox,Reports", thread_id="1800000000000000001"):
+    """A message as Google Takeout writes it"""
+    message = EmailMessage()
+    message["From"] = sender
+    message["To"] = "me@example.com"
+    message["Subject"] = subject
+    message["Date"] = date
+    message["Message-ID"] = f"<{subject.replace(' ', '-')}@vendor.com>"
+    message["X-GM-THRID"] = thread_id
+    message["X-Gmail-Labels"] = labels
+    message.set_content("See attached.")
+    for filename, data in files.items():
+        message.add_attachment(
+            data, maintype="application", subtype="octet-stream", filename=filename
+        )
+    return message
+
+
+def write_mbox(path, messages):
+    """Write messages with Takeout's "From <gmail id>@xxx <date>" lines"""
+    box = mailbox.mbox(str(path))
+    for gmail_id, message in messages:
+        entry = mailbox.mboxMessage(message)
+        entry.set_from(f"{gmail_id}@xxx Mon Jun  3 08:00:00 2024")
+        box.add(entry)
+    box.flush()
+    box.close()
+    return path
+
+
+class TestTakeoutHeaders:
+    """Test reading Gmail's IDs and labels from a Takeout export"""
+
+    def test_labels(self):
+        """System labels get Gmail's names, quoted user labels keep their commas"""
+        assert parse_takeout_labels('Inbox,Important,"Clients, Acme",Opened') == [
+            "INBOX", "IMPORTANT", "Clients, Acme", "Opened",
+        ]
+        assert parse_takeout_labels("") == []
+
+    def test_ids_and_metadata(self, tmp_path):
+        """Message and thread IDs are converted from decimal to Gmail's hex"""
+        path = write_mbox(
+            tmp_path / "mail.mbox",
+            [
+                (
+                    "1800000000000000002",
+                    make_message(
+                        "Vendor <reports@vendor.com>",
+                        "June report",
+                        {"june.csv": b"a,b"},
+                    ),
+                ),
+            ],
+        )
+
+        mailbox = MboxMailbox(path)
+        message = mailbox.get(format(1800000000000000002, "x"))
+
+        assert message.thread_id == format(1800000000000000001, "x")
+        assert message.labels == ["INBOX", "Reports"]
+        assert message.filenames == ["june.csv"]
+        assert message.rfc822_id == "June-report@vendor.com"
+        assert message.date.year == 2024 and message.date.month == 6
+
+    def test_plain_mbox(self, tmp_path):
+        """Messages without Takeout headers get a stable ID and the inbox"""
+        message = make_message("a@example.com", "Hello", {"a.pdf": b"%PDF"})
+        del message["X-Gmail-Labels"]
+        del message["X-GM-THRID"]
+        path = write_mbox(tmp_path / "mail.mbox", [("MAILER-DAEMON", message)])
+
+        first = list(MboxMailbox(path).messages.values())[0]
+
+        assert first.id == list(MboxMailbox(path).messages)[0]
+        assert first.labels == ["INBOX"]
+
+    def test_missing_file(self, tmp_path):
+        """A wrong path is reported rather than read as an empty mailbox"""
+        with pytest.raises(MboxError):
+            MboxMailbox(tmp_path / "missing.mbox")
+
+
+@pytest.fixture
+def import_mbox(tmp_path, make_service):
+    """Factory of DownloadServices over an mbox file holding the given messages"""
+    def make(messages):
+        return make_service(MboxMailbox(write_mbox(tmp_path / "mail.mbox", messages)))
+    return make
+
+
+class TestImport:
+    """Test the download pipeline over an mbox file"""
+
+    async def test_filters_and_files(self, import_mbox):
+        """Filters apply as they would to Gmail; files are saved with their contents"""
+        service = import_mbox(
+            [
+                (
+                    "1800000000000000002",
+                    make_message(
+                        "reports@vendor.com",
+                        "June report",
+                        {"june.csv": b"a,b", "notes.txt": b"skip"},
+                    ),
+                ),
+                (
+                    "1800000000000000003",
+                    make_message(
+                        "other@example.com", "Invoice", {"invoice.pdf": b"%PDF-1.4"}
+                    ),
+                ),
+            ]
+        )
+        service.config.filters.senders = ["reports@vendor.com"]
+
+        planned = await service.plan()
+        saved = await service.execute(planned)
+
+        assert [item.filename for item in planned] == ["june.csv"]
+        assert [path.read_bytes() for path in saved] == [b"a,b"]
+
+    async def test_manifest(self, import_mbox):
+        """A second import finds the files already extracted"""
+        service = import_mbox(
+            [
+                (
+                    "1800000000000000002",
+                    make_message(
+                        "reports@vendor.com", "June report", {"june.csv": b"a,b"}
+                    ),
+                ),
+            ]
+        )
+
+        await service.execute(await service.plan())
+        planned = await service.plan()
+
+        assert [item.status for item in planned] == [STATUS_EXISTS]
+
+    async def test_spam_and_trash_skipped(self, import_mbox):
+        """Like Gmail, search leaves out Spam and Trash unless asked"""
+        service = import_mbox(
+            [
+                (
+                    "1800000000000000002",
+                    make_message("a@vendor.com", "Kept", {"kept.csv": b"a"}),
+                ),
+                (
+                    "1800000000000000003",
+                    make_message(
+                        "b@vendor.com", "Binned", {"binned.csv": b"b"}, labels="Trash"
+                    ),
+                ),
+            ]
+        )
+
+        planned = await service.plan()
+
+        assert [
+            (item.filename, item.status) for item in planned
+        ] == [("kept.csv", STATUS_NEW)]
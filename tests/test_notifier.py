@@ -0,0 +1,175 @@
+"""
+Tests for notifier module
+"""
+
+import urllib.error
+from datetime import datetime
+
+import pytest
+
+from gmail_downloader.config import NotificationConfig
+from gmail_downloader.freshness import StaleFeed
+from gmail_downloader.manifest import ManifestEntry
+from gmail_downloader.notifier import DownloadEvent, WebhookNotifier
+from gmail_downloader.schema import SchemaChange
+
+
+def make_event():
+    """Build a download event for tests."""
+    return DownloadEvent(
+        sender="reports@vendor.com",
+        subject="Daily export",
+        filename="sales.csv",
+        path="/data/vendor/sales.csv",
+        size=2048,
+        sha256="deadbeef",
+        message_id="m1",
+    )
+
+
+class TestBuildPayload:
+    """Test webhook payloads for each format."""
+
+    def test_generic_includes_all_fields(self):
+        """The generic format carries every field plus the rendered text."""
+        notifier = WebhookNotifier(NotificationConfig(webhook_url="https://x"))
+        payload = notifier.build_payload(make_event())
+
+        assert payload["sender"] == "reports@vendor.com"
+        assert payload["sha256"] == "deadbeef"
+        assert payload["size"] == 2048
+        assert "sales.csv" in payload["text"]
+        assert "2.0 KB" in payload["text"]
+
+    @pytest.mark.parametrize("webhook_format", ["slack", "teams"])
+    def test_chat_formats_only_send_text(self, webhook_format):
+        """Slack and Teams get a plain text message."""
+        config = NotificationConfig(
+            webhook_url="https://x",
+            webhook_format=webhook_format,
+            template="{filename} from {sender}",
+        )
+        payload = WebhookNotifier(config).build_payload(make_event())
+
+        assert payload == {"text": "sales.csv from reports@vendor.com"}
+
+    def test_event_from_manifest_entry(self):
+        """Events are built from the recorded manifest entry."""
+        entry = ManifestEntry(
+            message_id="m1", attachment_id="a1", filename="x.pdf",
+            path="vendor/x.pdf", size=10, sha256="abc", sender="a@b.com",
+        )
+        event = DownloadEvent.from_manifest_entry(entry, "/data/vendor/x.pdf")
+
+        assert event.path == "/data/vendor/x.pdf"
+        assert event.sha256 == "abc"
+
+    def test_sender_display(self):
+        """The default template names the sender as in a From header."""
+        entry = ManifestEntry(
+            message_id="m1",
+            attachment_id="a1",
+            filename="x.pdf",
+            path="acme/x.pdf",
+            size=10,
+            sha256="abc",
+            sender="reports@acme.com",
+            sender_name="Acme Analytics",
+        )
+        notifier = WebhookNotifier(
+            NotificationConfig(webhook_url="https://x", webhook_format="slack")
+        )
+
+        text = notifier.build_payload(
+            DownloadEvent.from_manifest_entry(entry, "/data/acme/x.pdf")
+        )["text"]
+
+        assert text.startswith(
+            "New attachment from Acme Analytics <reports@acme.com>: x.pdf"
+        )
+        assert (
+            "from reports@vendor.com:" in notifier.build_payload(make_event())["text"]
+        )
+
+    def test_schema_change(self):
+        """Schema changes say which columns changed."""
+        change = SchemaChange(
+            sender="reports@vendor.com",
+            filename="sales_0602.csv",
+            path="vendor/sales_0602.csv",
+            pattern="sales_#.csv",
+            previous_file="vendor/sales_0601.csv",
+            previous_columns=["date", "amt"],
+            columns=["date", "amount"],
+            renamed=[("amt", "amount")],
+        )
+        notifier = WebhookNotifier(NotificationConfig(webhook_url="https://x"))
+        payload = notifier.build_schema_payload(change)
+
+        assert payload["event"] == "schema_changed"
+        assert payload["renamed"] == [["amt", "amount"]]
+        assert "renamed: amt -> amount" in payload["text"]
+
+    def test_stale_feed(self):
+        """Stale feed alerts say which deadline was missed."""
+        stale = StaleFeed(
+            "sales", datetime(2024, 6, 10, 9, 0), datetime(2024, 6, 7, 9, 0), None
+        )
+
+        payload = WebhookNotifier(
+            NotificationConfig(webhook_url="https://x")
+        ).build_stale_payload(stale)
+        slack = WebhookNotifier(
+            NotificationConfig(webhook_url="https://x", webhook_format="slack")
+        ).build_stale_payload(stale)
+
+        assert payload["event"] == "feed_stale"
+        assert payload["deadline"] == "2024-06-10T09:00:00"
+        assert slack == {"text": stale.describe()}
+
+
+class TestNotify:
+    """Test delivery and retries."""
+
+    async def test_disabled_without_url(self):
+        """Nothing is sent when no URL is configured."""
+        notifier = WebhookNotifier(NotificationConfig())
+        assert await notifier.notify(make_event()) is False
+
+    async def test_retries_then_succeeds(self, monkeypatch):
+        """Transient failures are retried."""
+        notifier = WebhookNotifier(
+            NotificationConfig(webhook_url="https://x", max_retries=2)
+        )
+        calls = []
+
+        def flaky_post(payload):
+            calls.append(payload)
+            if len(calls) < 2:
+                raise urllib.error.URLError("connection refused")
+
+        async def no_sleep(seconds):
+            pass
+
+        monkeypatch.setattr(notifier, "_post", flaky_post)
+        monkeypatch.setattr("asyncio.sleep", no_sleep)
+
+        assert await notifier.notify(make_event()) is True
+        assert len(calls) == 2
+
+    async def test_gives_up_without_raising(self, monkeypatch):
+        """Permanent failures are logged, not raised."""
+        notifier = WebhookNotifier(
+            NotificationConfig(webhook_url="https://x", max_retries=1)
+        )
+
+        def failing_post(payload):
+            raise urllib.error.URLError("down")
+
+        async def no_sleep(seconds):
+            pass
+
+        monkeypatch.setattr(notifier, "_post", failing_post)
+        monkeypatch.setattr("asyncio.sleep", no_sleep)
+
+        assert await notifier.notify(make_event()) is False
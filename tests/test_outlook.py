@@ -0,0 +1,303 @@
+"""
+Tests for outlook module
+"""
+
+import io
+import json
+import sys
+import urllib.error
+import urllib.parse
+import urllib.request
+from email.message import EmailMessage
+
+import pytest
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import STATUS_NEW
+from gmail_downloader.gmail_client import GmailAuthenticationError, create_client
+from gmail_downloader.outlook import OutlookError, OutlookMailbox, graph_filter
+
+
+def make_mime(sender, subject, files):
+    """A message's MIME content, as Graph returns it from $value"""
+    message = EmailMessage()
+    message["From"] = sender
+    message["Subject"] = subject
+    message["Date"] = "Mon, 03 Jun 2024 08:00:00 +0000"
+    message.set_content("See attached.")
+    for filename, data in files.items():
+        message.add_attachment(
+            data, maintype="application", subtype="octet-stream", filename=filename
+        )
+    return message.as_bytes()
+
+
+class FakeGraph:
+    """Microsoft Graph's mail endpoints, answering urllib requests"""
+
+    FOLDERS = {
+        "inbox": "AAInbox",
+        "sentitems": "AASent",
+        "drafts": "AADrafts",
+        "deleteditems": "AATrash",
+    }
+
+    def __init__(self):
+        self.messages = []
+        self.mime = {}
+        self.requests = []
+
+    def add(self, message_id, sender, subject, files, folder="AAInbox", categories=()):
+        self.messages.append({
+            "id": message_id,
+            "conversationId": f"conv-{message_id}",
+            "from": {"emailAddress": {"name": "Vendor", "address": sender}},
+            "toRecipients": [{"emailAddress": {"address": "me@contoso.com"}}],
+            "subject": subject,
+            "bodyPreview": "See attached.",
+            "sentDateTime": "2024-06-03T08:00:00Z",
+            "receivedDateTime": "2024-06-03T08:00:05Z",
+            "parentFolderId": folder,
+            "categories": list(categories),
+            "isRead": True,
+            "importance": "normal",
+            "internetMessageId": f"<{message_id}@vendor.com>",
+            "attachments": [
+                {"name": name, "size": len(data)} for name, data in files.items()
+            ],
+            "singleValueExtendedProperties": [
+                {"id": "Integer 0x0e08", "value": "2048"}
+            ],
+        })
+        self.mime[message_id] = make_mime(sender, subject, files)
+
+    def __call__(self, request, timeout=None):
+        url = urllib.parse.urlsplit(request.full_url)
+        params = dict(urllib.parse.parse_qsl(url.query))
+        path = url.path.removeprefix("/v1.0")
+        self.requests.append((path, params))
+        assert request.headers["Authorization"] == "Bearer graph-token"
+
+        if path.startswith("/me/mailFolders/") and path.count("/") == 3:
+            name = path.rsplit("/", 1)[1]
+            if name not in self.FOLDERS:
+                raise urllib.error.HTTPError(
+                    request.full_url, 404, "Not Found", {}, io.BytesIO(b"{}")
+                )
+            return self.json({"id": self.FOLDERS[name]})
+        if path == "/me/mailFolders":
+            return self.json({"value": [
+                {"id": "AAInbox", "displayName": "Inbox", "childFolderCount": 0},
+                {"id": "AAVendors", "displayName": "Vendors", "childFolderCount": 1},
+            ]})
+        if path == "/me/mailFolders/AAVendors/childFolders":
+            return self.json(
+                {
+                    "value": [
+                        {"id": "AAAcme", "displayName": "Acme", "childFolderCount": 0}
+                    ]
+                }
+            )
+        if path == "/me/messages":
+            return self.json({"value": self.messages})
+        if path.endswith("/$value"):
+            return io.BytesIO(self.mime[urllib.parse.unquote(path.split("/")[3])])
+        if path.startswith("/me/messages/"):
+            message_id = urllib.parse.unquote(path.rsplit("/", 1)[1])
+            return self.json(
+                next(
+                    message for message in self.messages if message["id"] == message_id
+                )
+            )
+        raise AssertionError(f"unexpected request {path}")
+
+    @staticmethod
+    def json(data):
+        return io.BytesIO(json.dumps(data).encode())
+
+
+class FakeMsal:
+    """The parts of msal used to sign in"""
+
+    class SerializableTokenCache:
+        has_state_changed = True
+
+        def deserialize(self, text):
+            pass
+
+        def serialize(self):
+            return '{"cached": true}'
+
+    class PublicClientApplication:
+        signed_in = False
+
+        def __init__(self, client_id, authority, token_cache):
+            self.client_id = client_id
+
+        def get_accounts(self):
+            return (
+                [{"username": "me@contoso.com"}]
+                if FakeMsal.PublicClientApplication.signed_in
+                else []
+            )
+
+        def acquire_token_silent(self, scopes, account):
+            return {"access_token": "graph-token"}
+
+        def acquire_token_interactive(self, scopes):
+            FakeMsal.PublicClientApplication.signed_in = True
+            return {
+                "access_token": "graph-token",
+                "id_token_claims": {"preferred_username": "me@contoso.com"},
+            }
+
+
+@pytest.fixture
+def graph(monkeypatch):
+    graph = FakeGraph()
+    FakeMsal.PublicClientApplication.signed_in = False
+    monkeypatch.setattr(
+        urllib.request.OpenerDirector,
+        "open",
+        lambda opener,
+        request,
+        timeout=None: graph(request, timeout),
+    )
+    monkeypatch.setitem(sys.modules, "msal", FakeMsal)
+    return graph
+
+
+@pytest.fixture
+def outlook_config(fake_config, tmp_path):
+    """fake_config for an Outlook profile, its sign-in cached under tmp_path/config"""
+    fake_config.gmail.provider = "outlook"
+    fake_config.gmail.token_file = str(tmp_path / "config" / "work.json")
+    fake_config.outlook.client_id = "00000000-0000-0000-0000-000000000000"
+    return fake_config
+
+
+class TestGraphFilter:
+    """Test narrowing Gmail queries for Graph"""
+
+    def test_top_level_terms(self):
+        """
+        Terms Graph understands are translated, groups
+        and negations are left to the local check
+        """
+        query = (
+            "(from:a@x.com OR from:b@x.com) "
+            "has:attachment after:2024/06/01 -subject:spam"
+        )
+
+        assert (
+            graph_filter(query)
+            == "hasAttachments eq true and receivedDateTime ge 2024-06-01T00:00:00Z"
+        )
+
+    def test_sender(self):
+        """A full address is matched exactly, quotes escaped"""
+        assert (
+            graph_filter("from:O'Brien@Vendor.com")
+            == "from/emailAddress/address eq 'o''brien@vendor.com'"
+        )
+        assert graph_filter("from:vendor") == ""
+
+    def test_message_id(self):
+        """A Message-ID lookup is an exact match on internetMessageId"""
+        assert (
+            graph_filter("rfc822msgid:abc@vendor.com")
+            == "internetMessageId eq '<abc@vendor.com>'"
+        )
+
+
+class TestOutlookMailbox:
+    """Test the pipeline over a fake Graph"""
+
+    async def test_download(self, graph, outlook_config, make_service, tmp_path):
+        """
+        Files are saved from the MIME content, Deleted
+        Items are left out and sign-in is cached
+        """
+        graph.add("AAMkAD1", "reports@vendor.com", "June", {"june.csv": b"a,b"})
+        graph.add(
+            "AAMkAD2",
+            "reports@vendor.com",
+            "Old",
+            {"old.csv": b"c,d"},
+            folder="AATrash",
+        )
+        service = make_service(OutlookMailbox(outlook_config))
+
+        assert create_client(outlook_config).profile == "outlook:work"
+        await service.gmail_client.authenticate()
+        planned = await service.plan()
+        saved = await service.execute(planned)
+
+        assert [
+            (item.filename, item.status) for item in planned
+        ] == [("june.csv", STATUS_NEW)]
+        assert [path.read_bytes() for path in saved] == [b"a,b"]
+        assert (tmp_path / "config" / "work.json").read_text() == '{"cached": true}'
+        searches = [params for path, params in graph.requests if path == "/me/messages"]
+        assert searches[0]["$filter"] == "hasAttachments eq true"
+
+    async def test_labels(self, graph, outlook_config):
+        """Folders (with their path) and categories are labels"""
+        graph.add(
+            "AAMkAD1",
+            "a@vendor.com",
+            "June",
+            {"a.csv": b"a"},
+            folder="AAAcme",
+            categories=["Finance"],
+        )
+        client = OutlookMailbox(outlook_config).client()
+        await client.authenticate()
+
+        message = await client.get_message_details("AAMkAD1")
+
+        assert message.labels == ["Vendors/Acme", "Finance"]
+        assert message.date.isoformat() == "2024-06-03T08:00:00+00:00"
+
+    async def test_search_needs_narrowing(self, graph, outlook_config):
+        """A query Graph cannot filter on is refused, not run over the whole mailbox"""
+        mailbox = OutlookMailbox(outlook_config)
+        await mailbox.connect()
+
+        with pytest.raises(OutlookError, match="narrow"):
+            mailbox.search("subject:invoice")
+        assert not [path for path, params in graph.requests if path == "/me/messages"]
+
+    async def test_search_holds_only_its_messages(self, graph, outlook_config):
+        """Messages found by an earlier search are not kept once a new one runs"""
+        graph.add("AAMkAD1", "a@vendor.com", "June", {"a.csv": b"a"})
+        graph.add("AAMkAD2", "b@vendor.com", "July", {"b.csv": b"b"})
+        mailbox = OutlookMailbox(outlook_config)
+        await mailbox.connect()
+
+        assert len(mailbox.search("has:attachment")) == 2
+        graph.messages = graph.messages[1:]
+        assert [
+            message.id for message in mailbox.search("has:attachment")
+        ] == ["AAMkAD2"]
+        assert list(mailbox.messages) == ["AAMkAD2"]
+
+    async def test_not_signed_in(self, graph, outlook_config):
+        """Without a cached sign-in, non-interactive use fails, opening no browser"""
+        with pytest.raises(GmailAuthenticationError):
+            await OutlookMailbox(outlook_config).connect(interactive=False)
+
+    async def test_needs_msal(self, graph, monkeypatch, outlook_config):
+        """A missing msal package says how to install it"""
+        monkeypatch.setitem(sys.modules, "msal", None)
+
+        with pytest.raises(OutlookError, match="outlook"):
+            await OutlookMailbox(outlook_config).connect()
+
+    def test_provider_per_profile(self, tmp_path):
+        """Only the profiles mapped to outlook use Graph"""
+        config = AppConfig()
+        config.gmail.profile_providers = {"work": "outlook"}
+
+        assert create_client(config).service is None
+        config.gmail.use_profile("work")
+        assert create_client(config).profile == "outlook:work"
@@ -0,0 +1,82 @@
+"""
+Tests for partial module
+"""
+
+import pytest
+from gmail_downloader.manifest import ManifestError
+from gmail_downloader.partial import PartialDownloads, partial_key
+
+
+class TestPartialDownloads:
+    """Test the journal of resumable downloads"""
+
+    def test_new_download_starts_at_zero(self, tmp_path):
+        """A file never seen before starts from the first byte"""
+        partial = PartialDownloads(tmp_path)
+
+        assert partial.start("f1", 100) == 0
+        assert partial.append("f1", b"abcd") == 4
+        assert PartialDownloads(tmp_path).load().offset("f1") == 4
+
+    def test_unrecorded_bytes_dropped(self, tmp_path):
+        """Bytes written after the last journal update are cut off on resume"""
+        partial = PartialDownloads(tmp_path)
+        partial.start("f1", 100)
+        partial.append("f1", b"abcd")
+        with open(partial.part_path("f1"), "ab") as f:
+            f.write(b"half a chunk")
+
+        resumed = PartialDownloads(tmp_path).load()
+
+        assert resumed.start("f1", 100) == 4
+        assert resumed.part_path("f1").read_bytes() == b"abcd"
+
+    def test_changed_size_starts_over(self, tmp_path):
+        """A file whose size changed is downloaded from scratch"""
+        partial = PartialDownloads(tmp_path)
+        partial.start("f1", 100)
+        partial.append("f1", b"abcd")
+
+        assert PartialDownloads(tmp_path).load().start("f1", 120) == 0
+        assert partial.part_path("f1").read_bytes() == b""
+
+    def test_finish_returns_data(self, tmp_path):
+        """Finishing hands back the bytes and forgets the download"""
+        partial = PartialDownloads(tmp_path, temp_suffix=".part")
+        partial.start("f1", 6)
+        partial.append("f1", b"abc")
+        partial.append("f1", b"def")
+
+        assert partial.part_path("f1").name == "f1.part"
+        assert partial.finish("f1") == b"abcdef"
+        assert not partial.part_path("f1").exists()
+        assert PartialDownloads(tmp_path).load().offset("f1") == 0
+
+    def test_kept_download(self, tmp_path):
+        """A whole download kept for the next attempt is handed over once"""
+        partial = PartialDownloads(tmp_path)
+        partial.start("f2", 6)
+        partial.append("f2", b"abc")
+        partial.keep("f1", b"abcdef")
+
+        resumed = PartialDownloads(tmp_path).load()
+        assert resumed.completed("f1") == b"abcdef"
+        assert resumed.completed("f1") is None
+        assert resumed.completed("f2") is None
+
+    def test_partial_key(self):
+        """Downloads are keyed by message and attachment, in a short name"""
+        key = partial_key("m1", "ANGjdJ" + "x" * 400)
+
+        assert key.startswith("m1-") and len(key) < 32
+        assert key != partial_key("m2", "ANGjdJ" + "x" * 400)
+        assert key != partial_key("m1", "other")
+
+    def test_damaged_journal(self, tmp_path):
+        """A journal that cannot be parsed is a ManifestError"""
+        partial = PartialDownloads(tmp_path)
+        partial.directory.mkdir()
+        partial.path.write_text("{not json")
+
+        with pytest.raises(ManifestError):
+            partial.load()
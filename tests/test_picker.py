@@ -0,0 +1,109 @@
+"""
+Tests for picker module
+"""
+
+from pathlib import Path
+from types import SimpleNamespace
+
+from gmail_downloader.downloader import (
+    STATUS_EXISTS,
+    STATUS_NEW,
+    STATUS_UPDATED,
+    PlannedDownload,
+)
+from gmail_downloader.picker import PickerState, fuzzy_match
+
+
+def make_planned(filename, sender="me@host.org", size=100, status=STATUS_NEW):
+    """Planned download with the fields the picker shows"""
+    message = SimpleNamespace(sender=sender, subject="Report")
+    attachment = SimpleNamespace(size=size)
+    return PlannedDownload(message, attachment, Path(filename), status, filename)
+
+
+class TestFuzzyMatch:
+    """Test the list filter"""
+
+    def test_letters_in_order(self):
+        """Letters may be spread out but must keep their order"""
+        assert fuzzy_match("inv24", "Invoice_2024.pdf")
+        assert fuzzy_match("", "anything")
+        assert not fuzzy_match("42inv", "Invoice_2024.pdf")
+
+
+class TestPickerState:
+    """Test selecting files in the picker"""
+
+    def test_initial_selection(self):
+        """New and updated files start selected, downloaded ones do not"""
+        state = PickerState([
+            make_planned("a.pdf", status=STATUS_NEW),
+            make_planned("b.pdf", status=STATUS_EXISTS),
+            make_planned("c.pdf", status=STATUS_UPDATED),
+        ])
+
+        assert [item.filename for item in state.chosen()] == ["a.pdf", "c.pdf"]
+
+    def test_filter_and_toggle(self):
+        """Toggling acts on the item under the cursor within the filtered list"""
+        state = PickerState([
+            make_planned("invoice.pdf", size=100),
+            make_planned("photo.jpg", size=50),
+            make_planned("invoice.xlsx", size=25),
+        ])
+
+        state.type("inxl")
+        assert state.visible() == [2]
+        state.toggle()
+        assert [
+            item.filename for item in state.chosen()
+        ] == ["invoice.pdf", "photo.jpg"]
+        assert state.total_size() == 150
+
+        state.backspace()
+        state.backspace()
+        assert state.visible() == [0, 2]
+        assert state.cursor == 0
+
+    def test_toggle_all_visible(self):
+        """Ctrl-A unselects everything shown, then selects it again"""
+        state = PickerState([
+            make_planned("a.pdf"),
+            make_planned("b.csv"),
+            make_planned("c.pdf"),
+        ])
+        state.type("pdf")
+
+        state.toggle_all()
+        assert [item.filename for item in state.chosen()] == ["b.csv"]
+
+        state.toggle_all()
+        assert [item.filename for item in state.chosen()] == ["a.pdf", "b.csv", "c.pdf"]
+
+    def test_downloaded_files_not_selectable(self):
+        """Files already downloaded stay unselected, toggled alone or with Ctrl-A"""
+        state = PickerState([
+            make_planned("a.pdf", status=STATUS_EXISTS),
+            make_planned("b.pdf", status=STATUS_NEW),
+        ])
+
+        state.toggle()
+        assert [item.filename for item in state.chosen()] == ["b.pdf"]
+
+        state.toggle_all()
+        assert state.chosen() == []
+        state.toggle_all()
+        assert [item.filename for item in state.chosen()] == ["b.pdf"]
+
+    def test_cursor_stays_in_range(self):
+        """Moving past either end stops at the first or last item"""
+        state = PickerState([make_planned("a.pdf"), make_planned("b.pdf")])
+
+        state.move(10)
+        assert state.current() == 1
+        state.move(-10)
+        assert state.current() == 0
+
+        state.type("zzz")
+        state.move(1)
+        assert state.current() is None
@@ -0,0 +1,146 @@
+"""
+Tests for preview module
+"""
+
+import io
+import json
+import zipfile
+
+import pytest
+from gmail_downloader.preview import (
+    PREVIEW_JSON,
+    PREVIEW_OTHER,
+    PREVIEW_TABLE,
+    PREVIEW_WORKBOOK,
+    describe_range,
+    preview_attachment,
+    workbook_sheets,
+)
+
+
+def make_xlsx(sheets):
+    """A minimal XLSX with the given {name: used range} sheets"""
+    output = io.BytesIO()
+    with zipfile.ZipFile(output, "w") as archive:
+        archive.writestr("[Content_Types].xml", "<Types/>")
+        entries = "".join(
+            f'<sheet name="{name}" sheetId="{index}" r:id="rId{index}"/>'
+            for index, name in enumerate(sheets, start=1)
+        )
+        archive.writestr("xl/workbook.xml", (
+            '<workbook '
+            'xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" '
+            'xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">'
+            f"<sheets>{entries}</sheets></workbook>"
+        ))
+        relationships = "".join(
+            f'<Relationship Id="rId{index}" Target="worksheets/sheet{index}.xml"/>'
+            for index in range(1, len(sheets) + 1)
+        )
+        archive.writestr(
+            "xl/_rels/workbook.xml.rels",
+            (
+                '<Relationships '
+                'xmlns="http://schemas.openxmlformats.org/package/2006/relationships">'
+                f"{relationships}</Relationships>"
+            ),
+        )
+        for index, ref in enumerate(sheets.values(), start=1):
+            archive.writestr(
+                f"xl/worksheets/sheet{index}.xml",
+                (
+                    '<worksheet '
+                    'xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">'
+                    f'<dimension ref="{ref}"/><sheetData/></worksheet>'
+                ),
+            )
+    return output.getvalue()
+
+
+class TestTables:
+    """Test previewing CSV and TSV"""
+
+    def test_csv_head(self):
+        """The header and first rows are kept, with the total count"""
+        data = b"date,amount\n" + b"".join(
+            f"2024-06-{day:02d},{day}\n".encode() for day in range(1, 31)
+        )
+
+        preview = preview_attachment("export.csv", data, rows=3)
+
+        assert preview.kind == PREVIEW_TABLE
+        assert preview.rows == [
+            ["date", "amount"],
+            ["2024-06-01", "1"],
+            ["2024-06-02", "2"],
+            ["2024-06-03", "3"],
+        ]
+        assert preview.total_rows == 31
+        assert preview.description == "CSV, 30 data row(s) of 2 column(s)"
+
+    def test_misnamed_tsv(self):
+        """Contents decide, not the name"""
+        preview = preview_attachment("export.dat", b"a\tb\n1\t2\n3\t4\n")
+
+        assert preview.kind == PREVIEW_TABLE
+        assert preview.description.startswith("TSV")
+
+    def test_single_column_csv(self):
+        """A .csv with one column is still a table"""
+        preview = preview_attachment("ids.csv", b"id\n1\n2\n")
+
+        assert preview.kind == PREVIEW_TABLE
+        assert preview.rows == [["id"], ["1"], ["2"]]
+
+
+class TestWorkbooks:
+    """Test previewing XLSX"""
+
+    def test_sheets(self):
+        """Each sheet is listed with its used range"""
+        preview = preview_attachment(
+            "report.xlsx", make_xlsx({"Summary": "A1:F120", "Notes": "A1"})
+        )
+
+        assert preview.kind == PREVIEW_WORKBOOK
+        assert preview.sheets == [("Summary", "A1:F120"), ("Notes", "A1")]
+
+    def test_describe_range(self):
+        """Ranges become rows and columns"""
+        assert describe_range("A1:F120") == "120 rows x 6 columns"
+        assert describe_range("B2:AA3") == "2 rows x 26 columns"
+        assert describe_range("A1") == "1 rows x 1 columns"
+
+    def test_not_a_workbook(self):
+        """Anything but a workbook is a ValueError"""
+        with pytest.raises(ValueError):
+            workbook_sheets(b"PK\x03\x04 not really")
+
+
+class TestOther:
+    """Test JSON and unrecognised files"""
+
+    def test_json_object(self):
+        """An object shows its keys"""
+        preview = preview_attachment(
+            "data.json", json.dumps({"rows": [], "total": 0}).encode()
+        )
+
+        assert preview.kind == PREVIEW_JSON
+        assert preview.keys == ["rows", "total"]
+
+    def test_json_array(self):
+        """An array shows the keys of its first item"""
+        preview = preview_attachment(
+            "data.json", json.dumps([{"id": 1, "name": "a"}, {"id": 2}]).encode()
+        )
+
+        assert preview.keys == ["id", "name"]
+        assert preview.description.startswith("JSON array of 2 item(s)")
+
+    def test_pdf(self):
+        """Other files get their type and size"""
+        preview = preview_attachment("invoice.pdf", b"%PDF-1.7 ...")
+
+        assert preview.kind == PREVIEW_OTHER
+        assert preview.description == "PDF, 12.0 B"
@@ -0,0 +1,171 @@
+"""
+Tests for retention module
+"""
+
+from datetime import datetime
+
+from gmail_downloader.config import RetentionConfig, RetentionPolicy
+from gmail_downloader.downloader import STATUS_EXISTS, AttachmentDownloader
+from gmail_downloader.manifest import DownloadManifest, ManifestEntry
+from gmail_downloader.retention import expired, matches_sender, policy_for, remove_files
+
+NOW = datetime(2024, 7, 1, 12, 0)
+
+
+def make_entry(filename, date, sender="bi@acme.com", path=None, **details):
+    return ManifestEntry(
+        message_id=f"m-{filename}", attachment_id="a1", filename=filename,
+        path=path or f"{sender.split('@')[1]}/{filename}", size=3, sha256="f" * 64,
+        sender=sender, date=date, **details,
+    )
+
+
+def names(entries):
+    return [entry.filename for entry in entries]
+
+
+class TestPolicies:
+    """Test which policy applies"""
+
+    def test_matches_sender(self):
+        """Addresses match exactly, @domains any address there"""
+        assert matches_sender("BI@acme.com", ["bi@acme.com"])
+        assert matches_sender("bi@acme.com", ["@acme.com"])
+        assert not matches_sender("bi@acme.com.evil", ["@acme.com"])
+        assert matches_sender("anyone@x.com", [])
+
+    def test_first_matching_policy(self):
+        """The first policy matching sender and name applies, the defaults otherwise"""
+        config = RetentionConfig(
+            older_than="90d",
+            policies=[
+                RetentionPolicy(
+                    senders=["@acme.com"], patterns=["daily_*.csv"], older_than="7d"
+                ),
+                RetentionPolicy(senders=["@acme.com"], older_than="30d"),
+            ],
+        )
+
+        assert policy_for(make_entry("daily_1.csv", ""), config).older_than == "7d"
+        assert policy_for(make_entry("monthly.pdf", ""), config).older_than == "30d"
+        assert policy_for(
+            make_entry("a.csv", "", sender="x@other.com"), config
+        ).older_than == "90d"
+
+
+class TestExpired:
+    """Test what has aged out"""
+
+    def test_older_than_keeping_latest(self):
+        """Old files go, except each feed's newest"""
+        entries = [
+            make_entry("sales_01.csv", "2024-01-01T09:00:00"),
+            make_entry("sales_02.csv", "2024-02-01T09:00:00"),
+            make_entry("sales_03.csv", "2024-03-01T09:00:00"),
+            make_entry("sales_06.csv", "2024-06-25T09:00:00"),
+            make_entry("stopped_01.csv", "2023-01-01T09:00:00", sender="x@other.com"),
+        ]
+        config = RetentionConfig(older_than="90d", keep_latest=2)
+
+        assert names(
+            expired(entries, config, now=NOW)
+        ) == ["sales_01.csv", "sales_02.csv"]
+
+    def test_nothing_without_older_than(self):
+        """Files of a policy without older_than are kept forever"""
+        entries = [
+            make_entry(
+                "statement.pdf", "2020-01-01T00:00:00+01:00", sender="x@bank.com"
+            )
+        ]
+        config = RetentionConfig(
+            older_than="1d",
+            policies=[RetentionPolicy(senders=["@bank.com"], older_than=None)],
+        )
+
+        assert expired(entries, config, now=NOW) == []
+        assert names(
+            expired(entries, RetentionConfig(older_than="1d"), now=NOW)
+        ) == ["statement.pdf"]
+
+    def test_overwritten_path_is_kept(self):
+        """A file overwritten by a newer download is not removed with the old entry"""
+        old = make_entry("report.csv", "2024-01-01T09:00:00", path="report.csv")
+        new = make_entry("report.csv", "2024-06-30T09:00:00", path="report.csv")
+        new.message_id = "m-newer"
+
+        assert expired([old, new], RetentionConfig(older_than="30d"), now=NOW) == []
+
+
+class TestRemove:
+    """Test deleting the files"""
+
+    def test_files_sidecars_and_entries(self, tmp_path):
+        """The file, its sidecars, empty folders and its manifest entry go"""
+        manifest = DownloadManifest(tmp_path)
+        old = make_entry("a.pdf", "2024-01-01T09:00:00")
+        kept = make_entry("b.pdf", "2024-06-01T09:00:00", path="other/b.pdf")
+        for entry in (old, kept):
+            path = tmp_path / entry.path
+            path.parent.mkdir(parents=True, exist_ok=True)
+            path.write_bytes(b"pdf")
+            manifest.record(entry)
+        (tmp_path / "acme.com" / "a.pdf.meta.json").write_text("{}")
+        (tmp_path / "acme.com" / "a.pdf.txt").write_text("text")
+
+        result = remove_files([old], manifest, tmp_path)
+
+        assert names(result.removed) == ["a.pdf"]
+        assert result.bytes_freed == 3
+        assert not (tmp_path / "acme.com").exists()
+        assert (tmp_path / "other" / "b.pdf").exists()
+        assert names(manifest) == ["b.pdf"]
+        assert manifest.get(old.message_id, old.filename).pruned_at
+
+    def test_derived_files(self, tmp_path):
+        """The .dvc file, Parquet mirror and latest/ links of a removed file go too"""
+        manifest = DownloadManifest(tmp_path)
+        old = make_entry("sales.csv", "2024-01-01T09:00:00")
+        path = tmp_path / old.path
+        path.parent.mkdir(parents=True)
+        path.write_text("a,b")
+        (tmp_path / "acme.com" / "sales.csv.dvc").write_text("outs: []")
+        mirror = tmp_path / "parquet" / "acme.com" / "sales.csv.parquet"
+        mirror.parent.mkdir(parents=True)
+        mirror.write_bytes(b"PAR1")
+        link = tmp_path / "latest" / "acme.com" / "sales.csv"
+        link.parent.mkdir(parents=True)
+        link.symlink_to("../../acme.com/sales.csv")
+        manifest.record(old)
+
+        remove_files([old], manifest, tmp_path, parquet_dir="parquet")
+
+        assert list(tmp_path.iterdir()) == []
+
+    def test_removed_files_are_not_downloaded_again(self, tmp_path):
+        """The entry stays as a tombstone, which the next run counts as downloaded"""
+        manifest = DownloadManifest(tmp_path)
+        entry = make_entry("gone.csv", "2024-01-01T09:00:00")
+        manifest.record(entry)
+        remove_files([entry], manifest, tmp_path)
+        manifest.save()
+
+        reloaded = DownloadManifest(tmp_path).load()
+        tombstone = reloaded.get(entry.message_id, entry.filename)
+        downloader = AttachmentDownloader(str(tmp_path))
+
+        assert len(reloaded) == 0 and reloaded.query("size>0") == []
+        assert downloader.compare_with_existing(
+            tmp_path / entry.path, entry.size, tombstone
+        ) == STATUS_EXISTS
+
+    def test_missing_file_is_forgotten(self, tmp_path):
+        """An entry whose file is already gone is only removed from the manifest"""
+        manifest = DownloadManifest(tmp_path)
+        entry = make_entry("gone.csv", "2024-01-01T09:00:00")
+        manifest.record(entry)
+
+        result = remove_files([entry], manifest, tmp_path)
+
+        assert names(result.removed) == ["gone.csv"]
+        assert len(manifest) == 0
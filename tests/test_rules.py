@@ -0,0 +1,219 @@
+"""
+Tests for rules module
+"""
+
+import sys
+from datetime import datetime
+
+import pytest
+from gmail_downloader.config import AppConfig, ConfigurationError
+from gmail_downloader.downloader import AttachmentDownloader, DownloadService
+from gmail_downloader.manifest import DownloadManifest, ManifestEntry
+from gmail_downloader.rules import Rule, RuleWatcher, compile_rules, parse_run
+
+from tests.gmailtest import FakeGmail
+
+
+@pytest.fixture
+def rules_config(tmp_path, fake_config):
+    """Config with a finance and an hr rule writing below tmp_path"""
+    config = fake_config
+    # Each rule's configuration is validated in full, sign-in included
+    config.gmail.credentials_file = str(tmp_path / "credentials.json")
+    (tmp_path / "credentials.json").write_text("{}")
+    config.filters.extensions = [".pdf", ".csv"]
+    config.download.base_dir = str(tmp_path / "all")
+    config.rules = [
+        {
+            "name": "finance",
+            "filters": {"senders": ["billing@vendor.com"], "extensions": [".csv"]},
+            "download": {"base_dir": str(tmp_path / "finance")},
+            "run": [
+                sys.executable,
+                "-c",
+                "import sys; open(sys.argv[1] + '.done', 'w')",
+                "{path}",
+            ],
+        },
+        {
+            "name": "hr",
+            "filters": {"senders": ["payroll@example.com"]},
+            "download": {"base_dir": str(tmp_path / "hr"), "organize_by": "date"},
+        },
+    ]
+    return config
+
+
+class TestCompileRules:
+    """Test turning the rules: section into configurations"""
+
+    def test_rules_layer_over_config(self, tmp_path, rules_config):
+        """A rule changes what it names and keeps the rest"""
+        finance, hr = compile_rules(rules_config)
+
+        assert finance.name == "finance"
+        assert finance.config.filters.senders == ["billing@vendor.com"]
+        assert finance.config.filters.extensions == [".csv"]
+        assert finance.config.filters.min_size == 1
+        assert finance.config.download.base_dir == str(tmp_path / "finance")
+        assert hr.config.filters.extensions == [".pdf", ".csv"]
+        assert hr.config.download.organize_by == "date"
+        assert hr.run == []
+
+    def test_mappings_merge(self, rules_config):
+        """A rule's passwords add to the file's; secrets reach the rule directly"""
+        config = rules_config
+        config.passwords = {"@bank.com": "s3cret"}
+        config.storage.password = "dav-secret"
+        config.rules[0]["passwords"] = {"@vendor.com": "other"}
+
+        finance, hr = compile_rules(config)
+
+        assert finance.config.passwords == {
+            "@bank.com": "s3cret", "@vendor.com": "other"
+        }
+        assert hr.config.storage.password == "dav-secret"
+        assert hr.config.rules == []
+
+    def test_select_by_name(self, rules_config):
+        """Only the named rules are compiled; unknown names are an error"""
+        config = rules_config
+
+        assert [rule.name for rule in compile_rules(config, ["hr"])] == ["hr"]
+        with pytest.raises(ConfigurationError) as exc_info:
+            compile_rules(config, ["sales"])
+        assert "finance, hr" in str(exc_info.value)
+
+    def test_invalid_rule_named(self, rules_config):
+        """Errors in a rule's settings say which rule"""
+        config = rules_config
+        config.rules[1]["download"]["organize_by"] = "colour"
+
+        with pytest.raises(ConfigurationError) as exc_info:
+            compile_rules(config)
+        assert "rules.hr" in str(exc_info.value)
+
+    def test_parse_run(self):
+        """Strings are split like a shell would; placeholders are checked"""
+        assert parse_run(
+            "finance", "load.py --file '{path}'"
+        ) == ["load.py", "--file", "{path}"]
+        assert parse_run("finance", None) == []
+
+        with pytest.raises(ConfigurationError):
+            parse_run("finance", ["load.py", "{folder}"])
+        with pytest.raises(ConfigurationError):
+            parse_run("finance", {"command": "load.py"})
+
+
+class TestRunAction:
+    """Test the command run for each saved file"""
+
+    def make_entry(self):
+        return ManifestEntry(
+            message_id="m1",
+            attachment_id="a1",
+            filename="invoice.csv",
+            path="invoice.csv",
+            size=3,
+            sha256="",
+            sender="billing@vendor.com",
+            subject="June",
+        )
+
+    def test_placeholders(self, tmp_path):
+        """Placeholders are filled in per argument"""
+        rule = Rule(
+            "finance", AppConfig(), ["load.py", "--from={sender}", "{path}", "{rule}"]
+        )
+
+        assert rule.command(self.make_entry(), tmp_path / "invoice.csv") == [
+            "load.py",
+            "--from=billing@vendor.com",
+            str(tmp_path / "invoice.csv"),
+            "finance",
+        ]
+
+    async def test_exit_code(self, tmp_path):
+        """The command's exit code is returned; failures do not raise"""
+        entry = self.make_entry()
+
+        assert await Rule(
+            "ok", AppConfig(), [sys.executable, "-c", "pass"]
+        ).run_action(entry, "x") == 0
+        assert await Rule(
+            "bad", AppConfig(), [sys.executable, "-c", "exit(3)"]
+        ).run_action(entry, "x") == 3
+        assert await Rule(
+            "gone", AppConfig(), [str(tmp_path / "missing")]
+        ).run_action(entry, "x") is None
+        assert await Rule("none", AppConfig()).run_action(entry, "x") is None
+
+
+class TestRuleWatcher:
+    """Test running several rules against one mailbox"""
+
+    def make_watcher(self, config):
+        gmail = FakeGmail()
+        gmail.add_message(
+            "billing@vendor.com",
+            "June invoices",
+            {"invoices.csv": b"id,amount\n1,2\n"},
+            date=datetime(2024, 6, 1),
+        )
+        gmail.add_message(
+            "payroll@example.com",
+            "Payslips",
+            {"payslips.pdf": b"%PDF-1.7"},
+            date=datetime(2024, 6, 2),
+        )
+        client = gmail.client(config)
+
+        def open_service(rule):
+            return DownloadService(
+                client, AttachmentDownloader.from_config(rule.config),
+                DownloadManifest(rule.config.download.base_dir), rule.config,
+            )
+
+        return RuleWatcher(compile_rules(config), open_service), config
+
+    async def test_each_rule_downloads_its_mail(self, tmp_path, rules_config):
+        """Each rule saves its own messages where it says, and queues its command"""
+        watcher, _ = self.make_watcher(rules_config)
+
+        for rule_watcher in watcher.watchers.values():
+            service = rule_watcher.service
+            await service.execute(await service.plan())
+
+        finance = list((tmp_path / "finance").rglob("invoices.csv"))
+        assert len(finance) == 1
+        # The command runs in the background, not in the download loop
+        assert not finance[0].with_name("invoices.csv.done").exists()
+        await watcher.actions["finance"].drain()
+        assert finance[0].with_name("invoices.csv.done").exists()
+        assert list((tmp_path / "hr").rglob("payslips.pdf"))
+        assert not list((tmp_path / "hr").rglob("invoices.csv"))
+        assert not (tmp_path / "all").exists()
+
+    def test_health_per_rule(self, rules_config):
+        """Health lists every rule, and is healthy only when all are"""
+        watcher, _ = self.make_watcher(rules_config)
+
+        health = watcher.health()
+
+        assert set(health["rules"]) == {"finance", "hr"}
+        assert health["healthy"] is False
+        assert health["messages_processed"] == 0
+
+    def test_reload(self, rules_config):
+        """A reload changes the running rules' settings and commands"""
+        watcher, config = self.make_watcher(rules_config)
+        config.rules[0]["filters"]["extensions"] = [".xlsx"]
+        config.rules[0]["run"] = ["true"]
+
+        watcher.reload(config)
+
+        assert (
+            watcher.watchers["finance"].service.config.filters.extensions == [".xlsx"]
+        )
+        assert watcher.rules["finance"].run == ["true"]
@@ -0,0 +1,98 @@
+"""
+Tests for runlock module
+"""
+
+import json
+import os
+import socket
+import threading
+
+import pytest
+
+from gmail_downloader import runlock
+from gmail_downloader.runlock import LOCK_FILENAME, RunLock, RunLockError
+
+
+def write_lock(directory, pid, host=None):
+    """A lock file as another run would leave it"""
+    path = directory / LOCK_FILENAME
+    path.write_text(json.dumps({
+        "pid": pid, "host": host or socket.gethostname(),
+        "command": "download", "started_at": "2024-06-01T08:00:00",
+    }))
+    return path
+
+
+class TestRunLock:
+    """Test the download directory's lock"""
+
+    def test_acquire_and_release(self, tmp_path):
+        """The lock names this process while held and is removed afterwards"""
+        with RunLock(tmp_path / "state", "download"):
+            holder = json.loads((tmp_path / "state" / LOCK_FILENAME).read_text())
+            assert (holder["pid"], holder["command"]) == (os.getpid(), "download")
+
+        assert not (tmp_path / "state" / LOCK_FILENAME).exists()
+
+    def test_running_holder_blocks(self, tmp_path):
+        """A lock of a live process stops a second run"""
+        path = write_lock(tmp_path, os.getppid())
+
+        with pytest.raises(RunLockError) as exc_info:
+            RunLock(tmp_path).acquire()
+
+        assert f"PID {os.getppid()}" in str(exc_info.value)
+        assert json.loads(path.read_text())["pid"] == os.getppid()
+
+    def test_stale_lock_taken_over(self, tmp_path):
+        """A lock left by a dead process on this host is replaced"""
+        write_lock(tmp_path, 999999999)
+
+        lock = RunLock(tmp_path)
+        lock.acquire()
+
+        assert lock.holder()["pid"] == os.getpid()
+        lock.release()
+
+    def test_stale_lock_taken_over_once(self, tmp_path):
+        """
+        Of two runs finding the same stale lock, the
+        slower one leaves the winner's lock alone
+        """
+        write_lock(tmp_path, 999999999)
+        slower = RunLock(tmp_path)
+        stale = slower.holder()
+
+        winner = RunLock(tmp_path)
+        winner.acquire()
+        slower.remove(stale)
+
+        assert winner.holder()["pid"] == os.getpid()
+        assert [path.name for path in tmp_path.iterdir()] == [LOCK_FILENAME]
+        winner.release()
+
+    def test_other_host_needs_force(self, tmp_path):
+        """A lock from another host cannot be checked, but can be forced"""
+        write_lock(tmp_path, 1, host="elsewhere")
+
+        with pytest.raises(RunLockError):
+            RunLock(tmp_path).acquire()
+
+        lock = RunLock(tmp_path)
+        lock.acquire(force=True)
+        assert lock.holder()["host"] == socket.gethostname()
+        lock.release()
+
+    def test_wait(self, tmp_path, monkeypatch):
+        """With wait, the run starts once the holder is gone"""
+        path = write_lock(tmp_path, os.getppid())
+        monkeypatch.setattr(runlock, "POLL_SECONDS", 0.01)
+        waited = []
+        threading.Timer(0.1, path.unlink).start()
+
+        lock = RunLock(tmp_path)
+        lock.acquire(wait=True, on_wait=waited.append)
+
+        assert waited[0]["pid"] == os.getppid()
+        assert lock.acquired
+        lock.release()
@@ -0,0 +1,282 @@
+"""
+Tests for runreport module
+"""
+
+import asyncio
+import json
+from datetime import datetime, timedelta
+
+import pytest
+from gmail_downloader.config import AppConfig
+from gmail_downloader.exitcodes import EXIT_AUTH, EXIT_PARTIAL
+from gmail_downloader.gmail_client import GmailAttachmentError
+from gmail_downloader.runreport import (
+    ReportError,
+    RunFailure,
+    RunReport,
+    RunSummary,
+    find_report,
+    latest_report,
+    load_failures,
+    replay_settings,
+    retry_failures,
+    run_settings,
+    select_failures,
+)
+
+from tests.gmailtest import FakeGmail
+
+
+class FlakyGmail(FakeGmail):
+    """A fake account whose attachment downloads fail for chosen filenames"""
+
+    def __init__(self):
+        super().__init__()
+        self.failing = set()
+
+    def client(self, config):
+        client = super().client(config)
+        download_attachment = client.download_attachment
+
+        async def flaky(message_id, attachment_id):
+            message = self.messages[message_id]
+            names = {
+                message.attachment_id(index): name
+                for index, name in enumerate(message.filenames, start=1)
+            }
+            if names.get(attachment_id) in self.failing:
+                raise GmailAttachmentError("HTTP 500 from Gmail")
+            return await download_attachment(message_id, attachment_id)
+
+        client.download_attachment = flaky
+        return client
+
+
+class TestRunReport:
+    """Test summarizing runs and retrying their failures"""
+
+    async def test_failures_do_not_stop_the_run(self, make_service):
+        """A failed attachment is reported and the others are still saved"""
+        gmail = FlakyGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2", "b.csv": b"3,4"})
+        gmail.add_message("bi@acme.com", "More", {"c.csv": b"5,6"})
+        gmail.failing = {"b.csv"}
+        service = make_service(gmail)
+        planned = await service.plan()
+        started = datetime(2024, 6, 1, 9, 30, 12)
+
+        saved = await service.execute(planned)
+        report = RunReport.from_run(
+            planned,
+            saved,
+            service.failed,
+            service.saved_bytes,
+            started,
+            started + timedelta(seconds=2),
+        )
+
+        assert sorted(path.name for path in saved) == ["a.csv", "c.csv"]
+        assert (
+            report.succeeded, report.failed, report.skipped, report.total_bytes
+        ) == (2, 1, 0, 6)
+        assert report.throughput == 3
+        assert report.failures[0].filename == "b.csv"
+        assert "HTTP 500" in report.failures[0].error
+
+    async def test_retry_selects_failures(self, tmp_path, make_service):
+        """A saved report brings back exactly the failed attachments"""
+        gmail = FlakyGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2", "b.csv": b"3,4"})
+        gmail.failing = {"b.csv"}
+        service = make_service(gmail)
+        planned = await service.plan()
+        saved = await service.execute(planned)
+        now = datetime(2024, 6, 1, 9, 30, 12)
+        path = RunReport.from_run(
+            planned, saved, service.failed, service.saved_bytes, now, now
+        ).save(tmp_path / "reports")
+
+        assert path.name == "run-2024-06-01-093012.json"
+        assert json.loads(path.read_text())["failed"] == 1
+
+        gmail.failing = set()
+        failures = load_failures(path)
+        retry = select_failures(
+            await service.plan_messages([failure.message_id for failure in failures]),
+            failures,
+        )
+
+        assert [item.filename for item in retry] == ["b.csv"]
+        assert [p.name for p in await service.execute(retry)] == ["b.csv"]
+        assert service.failed == []
+
+    async def test_settings_are_replayed(self, tmp_path):
+        """A retry searches and saves with the filters and layout of its run"""
+        config = AppConfig()
+        config.filters.extensions = [".csv"]
+        config.download.organize_by = "date"
+        now = datetime(2024, 6, 1, 9, 30, 12)
+        report = RunReport(
+            started_at=now, finished_at=now, settings=run_settings(config)
+        )
+        path = report.save(tmp_path)
+
+        retried = replay_settings(AppConfig(), path)
+
+        assert retried.filters.extensions == [".csv"]
+        assert retried.download.organize_by == "date"
+        assert (
+            json.loads(path.read_text())["settings"]["filters"]["extensions"]
+            == [".csv"]
+        )
+
+    async def test_saved_file_is_not_also_failed(self, make_service):
+        """A failure after the file is saved leaves it counted as saved only"""
+        gmail = FlakyGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2"})
+        service = make_service(gmail)
+
+        async def broken(entry, path):
+            raise OSError("disk gone")
+
+        service.download_listeners.append(broken)
+        planned = await service.plan()
+        saved = await service.execute(planned)
+
+        assert [path.name for path in saved] == ["a.csv"]
+        assert service.failed == []
+
+    def test_unreadable_report(self, tmp_path):
+        """Missing files and other JSON are rejected"""
+        (tmp_path / "other.json").write_text('{"cursors": {}}')
+
+        with pytest.raises(ReportError):
+            load_failures(tmp_path / "missing.json")
+        with pytest.raises(ReportError):
+            load_failures(tmp_path / "other.json")
+
+
+class TestRunSummary:
+    """Test the JSON summary of run --json-summary"""
+
+    async def test_files_and_failures(self, make_service):
+        """Saved files come from the listener, counts and failures from the report"""
+        gmail = FlakyGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2", "b.csv": b"3,4"})
+        gmail.failing = {"b.csv"}
+        service = make_service(gmail)
+        started = datetime(2024, 6, 1, 9, 30, 12)
+        summary = RunSummary(
+            profile="default",
+            started_at=started,
+            newest_message=started - timedelta(hours=1),
+        )
+        service.download_listeners.append(summary.record_file)
+        planned = await service.plan()
+
+        saved = await service.execute(planned)
+        summary.matched = len(planned)
+        summary.report = RunReport.from_run(
+            planned,
+            saved,
+            service.failed,
+            service.saved_bytes,
+            started,
+            started + timedelta(seconds=2),
+        )
+        summary.exit_code = EXIT_PARTIAL
+        summary.finished_at = started + timedelta(seconds=3)
+        data = json.loads(json.dumps(summary.to_dict()))
+
+        assert data["status"] == "partial"
+        assert (
+            data["matched"], data["downloaded"], data["failed"], data["bytes"]
+        ) == (2, 1, 1, 3)
+        assert data["elapsed_seconds"] == 3
+        assert data["newest_message"] == "2024-06-01T08:30:12"
+        assert [file["filename"] for file in data["files"]] == ["a.csv"]
+        assert data["files"][0]["sender"] == "bi@acme.com"
+        assert data["failures"][0]["filename"] == "b.csv"
+
+    def test_ended_early(self):
+        """A run that ended before downloading has zero counts and its error"""
+        summary = RunSummary(exit_code=EXIT_AUTH, error="Not signed in")
+
+        data = summary.to_dict()
+
+        assert data["status"] == "auth_failed"
+        assert (
+            data["downloaded"], data["bytes"], data["files"], data["newest_message"]
+        ) == (0, 0, [], None)
+        assert data["error"] == "Not signed in"
+
+
+class TestRetry:
+    """Test the retry command's building blocks"""
+
+    async def test_backs_off_until_it_works(self, monkeypatch, make_service):
+        """Attachments failing again are retried after doubling waits"""
+        gmail = FlakyGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2", "b.csv": b"3,4"})
+        gmail.failing = {"a.csv", "b.csv"}
+        service = make_service(gmail)
+        await service.execute(await service.plan())
+        failures = [RunFailure.from_failed(failed) for failed in service.failed]
+        sleeps, waits = [], []
+
+        async def sleep(delay):
+            sleeps.append(delay)
+            gmail.failing.discard("a.csv" if len(sleeps) == 1 else "b.csv")
+
+        monkeypatch.setattr(asyncio, "sleep", sleep)
+        report = await retry_failures(
+            service,
+            failures,
+            attempts=3,
+            backoff=10,
+            on_wait=lambda left,
+            attempt,
+            delay: waits.append(attempt),
+        )
+
+        assert sleeps == [10, 20]
+        assert waits == [2, 3]
+        assert (report.succeeded, report.failed, report.skipped) == (2, 0, 0)
+
+    async def test_gives_up(self, monkeypatch, make_service):
+        """After the last attempt the remaining failures are reported"""
+        gmail = FlakyGmail()
+        gmail.add_message("bi@acme.com", "Exports", {"a.csv": b"1,2"})
+        gmail.failing = {"a.csv"}
+        service = make_service(gmail)
+        await service.execute(await service.plan())
+        failures = [RunFailure.from_failed(failed) for failed in service.failed]
+
+        async def sleep(delay):
+            pass
+
+        monkeypatch.setattr(asyncio, "sleep", sleep)
+        report = await retry_failures(service, failures, attempts=2, backoff=1)
+
+        assert [failure.filename for failure in report.failures] == ["a.csv"]
+        assert report.succeeded == 0
+
+    def test_find_report(self, tmp_path):
+        """Runs are found by ID, with or without the prefix, by path, or as latest"""
+        for name in ("run-2024-06-01-093012.json", "run-2024-06-02-080000.json"):
+            (tmp_path / name).write_text('{"failures": []}')
+
+        assert find_report(
+            tmp_path, "run-2024-06-01-093012"
+        ) == tmp_path / "run-2024-06-01-093012.json"
+        assert find_report(
+            tmp_path, "2024-06-01-093012"
+        ) == tmp_path / "run-2024-06-01-093012.json"
+        assert find_report(
+            tmp_path, str(tmp_path / "run-2024-06-02-080000.json")
+        ).name == "run-2024-06-02-080000.json"
+        assert latest_report(tmp_path).name == "run-2024-06-02-080000.json"
+        with pytest.raises(ReportError):
+            find_report(tmp_path, "run-2023-01-01-000000")
+        with pytest.raises(ReportError):
+            latest_report(tmp_path / "empty")
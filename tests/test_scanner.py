@@ -0,0 +1,147 @@
+"""
+Tests for scanner module
+"""
+
+import asyncio
+import shlex
+import struct
+import sys
+
+import pytest
+from gmail_downloader.config import ScanConfig
+from gmail_downloader.scanner import (
+    VERDICT_CLEAN,
+    ClamAVScanner,
+    CommandScanner,
+    ScanError,
+    open_scanner,
+)
+
+EICAR = b"X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"
+
+
+class FakeClamd:
+    """clamd's INSTREAM command on a Unix socket"""
+
+    def __init__(self, reply=None):
+        self.reply = reply
+        self.received = []
+
+    async def handle(self, reader, writer):
+        command = await reader.readuntil(b"\0")
+        assert command == b"zINSTREAM\0"
+        data = b""
+        while True:
+            size = struct.unpack(">I", await reader.readexactly(4))[0]
+            if not size:
+                break
+            data += await reader.readexactly(size)
+        self.received.append(data)
+
+        reply = self.reply or (
+            b"stream: Eicar-Signature FOUND" if b"EICAR" in data else b"stream: OK"
+        )
+        writer.write(reply + b"\0")
+        await writer.drain()
+        writer.close()
+
+
+def command(script):
+    """A scanner command running a Python script"""
+    return shlex.join([sys.executable, "-c", script])
+
+
+# Exits like clamscan: 1 with "<file>: <signature> FOUND" for EICAR
+FAKE_CLAMSCAN = (
+    "import sys\n"
+    "data = open(sys.argv[1], 'rb').read() if len(sys.argv) > 1 else "
+    "sys.stdin.buffer.read()\n"
+    "if b'EICAR' in data:\n"
+    "    print('stream: Eicar-Signature FOUND')\n"
+    "    sys.exit(1)\n"
+)
+
+
+class TestClamAVScanner:
+    """Test scanning through clamd"""
+
+    async def scan(self, tmp_path, data, reply=None):
+        clamd = FakeClamd(reply)
+        socket_path = str(tmp_path / "clamd.ctl")
+        server = await asyncio.start_unix_server(clamd.handle, socket_path)
+        try:
+            return await ClamAVScanner(
+                ScanConfig(scanner="clamav", clamav_socket=socket_path)
+            ).scan(data, "a.pdf"), clamd
+        finally:
+            server.close()
+
+    async def test_clean_and_found(self, tmp_path):
+        """OK is clean, FOUND gives the signature name"""
+        verdict, clamd = await self.scan(tmp_path, b"x" * 200_000)
+
+        assert verdict == VERDICT_CLEAN
+        assert clamd.received == [b"x" * 200_000]
+        assert (await self.scan(tmp_path, EICAR))[0] == "Eicar-Signature"
+
+    async def test_error_reply(self, tmp_path):
+        """clamd's errors fail the scan"""
+        with pytest.raises(ScanError, match="size limit"):
+            await self.scan(
+                tmp_path, b"data", reply=b"INSTREAM size limit exceeded. ERROR"
+            )
+
+    async def test_not_running(self, tmp_path):
+        """A missing socket fails the scan"""
+        scanner = ClamAVScanner(
+            ScanConfig(scanner="clamav", clamav_socket=str(tmp_path / "missing.ctl"))
+        )
+
+        with pytest.raises(ScanError, match="cannot reach clamd"):
+            await scanner.scan(b"data", "a.pdf")
+
+
+class TestCommandScanner:
+    """Test scanning with an external program"""
+
+    async def test_stdin(self):
+        """Exit code 0 is clean, 1 is flagged with the scanner's message"""
+        scanner = CommandScanner(
+            ScanConfig(scanner="command", command=command(FAKE_CLAMSCAN))
+        )
+
+        assert await scanner.scan(b"report", "a.pdf") == VERDICT_CLEAN
+        assert await scanner.scan(EICAR, "a.pdf") == "Eicar-Signature"
+
+    async def test_path(self):
+        """{path} is replaced with a temporary file holding the data"""
+        scanner = CommandScanner(
+            ScanConfig(scanner="command", command=command(FAKE_CLAMSCAN) + " {path}")
+        )
+
+        assert await scanner.scan(EICAR, "a.pdf") == "Eicar-Signature"
+
+    async def test_errors(self):
+        """Other exit codes, missing programs and timeouts fail the scan"""
+        failing = CommandScanner(
+            ScanConfig(scanner="command", command=command("import sys; sys.exit(2)"))
+        )
+        missing = CommandScanner(
+            ScanConfig(scanner="command", command="/nonexistent/scanner")
+        )
+        slow = CommandScanner(
+            ScanConfig(
+                scanner="command",
+                command=command("import time; time.sleep(5)"),
+                timeout_seconds=0.2,
+            )
+        )
+
+        for scanner in (failing, missing, slow):
+            with pytest.raises(ScanError):
+                await scanner.scan(b"data", "a.pdf")
+
+    def test_open_scanner(self):
+        """Scanning is off unless a scanner is configured"""
+        assert open_scanner(ScanConfig()) is None
+        assert isinstance(open_scanner(ScanConfig(scanner="clamav")), ClamAVScanner)
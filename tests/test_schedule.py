@@ -0,0 +1,87 @@
+"""
+Tests for schedule module
+"""
+
+from datetime import datetime
+
+import pytest
+from gmail_downloader.schedule import (
+    CronSchedule,
+    next_run,
+    parse_schedules,
+    previous_run,
+)
+
+
+class TestCronSchedule:
+    """Test parsing cron expressions and finding the next run"""
+
+    @pytest.mark.parametrize("expression,moment,expected", [
+        # Friday evening -> Monday morning
+        ("0 7 * * MON-FRI", datetime(2024, 6, 7, 18, 0), datetime(2024, 6, 10, 7, 0)),
+        ("*/15 7-18 * * 1-5", datetime(2024, 6, 3, 9, 7), datetime(2024, 6, 3, 9, 15)),
+        ("*/15 7-18 * * 1-5", datetime(2024, 6, 3, 18, 45), datetime(2024, 6, 4, 7, 0)),
+        ("30 8 1,15 * *", datetime(2024, 6, 2, 0, 0), datetime(2024, 6, 15, 8, 30)),
+        ("0 0 1 JAN,jul *", datetime(2024, 2, 1), datetime(2024, 7, 1, 0, 0)),
+        ("0 12 * * 7", datetime(2024, 6, 3), datetime(2024, 6, 9, 12, 0)),
+        ("@daily", datetime(2024, 6, 3, 0, 0, 30), datetime(2024, 6, 4, 0, 0)),
+        ("0 0 29 2 *", datetime(2024, 3, 1), datetime(2028, 2, 29, 0, 0)),
+    ])
+    def test_next_after(self, expression, moment, expected):
+        """The next run is the first matching minute strictly after the moment"""
+        assert CronSchedule(expression).next_after(moment) == expected
+
+    def test_either_day_field(self):
+        """When both day fields are restricted, matching one of them is enough"""
+        schedule = CronSchedule("0 9 13 * FRI")
+
+        # Monday the 3rd -> Friday the 7th comes before the 13th
+        assert schedule.next_after(datetime(2024, 6, 3)) == datetime(2024, 6, 7, 9, 0)
+        assert (
+            schedule.next_after(datetime(2024, 6, 7, 10, 0))
+            == datetime(2024, 6, 13, 9, 0)
+        )
+
+    @pytest.mark.parametrize("expression", [
+        "0 7 * *",
+        "60 * * * *",
+        "0 7 * * FUNDAY",
+        "*/0 * * * *",
+        "0 18-7 * * *",
+    ])
+    def test_invalid(self, expression):
+        """Wrong field counts, out-of-range values and bad steps are rejected"""
+        with pytest.raises(ValueError):
+            CronSchedule(expression)
+
+    def test_never_runs(self):
+        """A date that does not exist is an error rather than an endless wait"""
+        with pytest.raises(ValueError):
+            CronSchedule("0 0 31 2 *").next_after(datetime(2024, 1, 1))
+
+
+class TestNextRun:
+    """Test combining several schedules"""
+
+    def test_earliest_wins(self):
+        """The soonest of the schedules is the next check"""
+        schedules = parse_schedules(["0 7 * * MON-FRI", "0 9 * * SAT"])
+
+        assert next_run(
+            schedules, datetime(2024, 6, 7, 18, 0)
+        ) == datetime(2024, 6, 8, 9, 0)
+
+
+class TestPreviousRun:
+    """Test finding the last run before a moment"""
+
+    def test_latest_before(self):
+        """The latest run strictly before the moment, however far back"""
+        schedules = parse_schedules(["0 9 * * MON-FRI"])
+
+        assert previous_run(
+            schedules, datetime(2024, 6, 10, 9, 0)
+        ) == datetime(2024, 6, 7, 9, 0)
+        assert previous_run(
+            parse_schedules(["0 0 1 1 *"]), datetime(2024, 6, 1)
+        ) == datetime(2024, 1, 1)
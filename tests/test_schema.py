@@ -0,0 +1,226 @@
+"""
+Tests for schema module
+"""
+
+from gmail_downloader.config import NotificationConfig
+from gmail_downloader.notifier import WebhookNotifier
+from gmail_downloader.schema import (
+    SCHEMA_FILENAME,
+    SchemaHistory,
+    compare_columns,
+    feed_key,
+    feed_pattern,
+    missing_columns,
+    read_header,
+)
+
+from tests.gmailtest import FakeGmail
+
+
+class TestFeeds:
+    """Test telling which files belong to the same feed"""
+
+    def test_digits_are_wildcards(self):
+        """Dated names of one feed share a pattern"""
+        assert feed_pattern("Sales_2024-06-01.CSV") == "sales_#-#-#.csv"
+        assert feed_key(
+            "BI@acme.com", "sales_0601.csv"
+        ) == feed_key("bi@acme.com", "sales_0602.csv")
+        assert (
+            feed_key("bi@acme.com", "sales.csv") != feed_key("bi@acme.com", "costs.csv")
+        )
+
+
+class TestHeaders:
+    """Test reading and comparing header rows"""
+
+    def test_read_header(self):
+        """The first row, trimmed, with the delimiter from the contents"""
+        assert read_header(
+            b"\xef\xbb\xbfdate; amount \n2024-06-01;3\n", ".csv"
+        ) == ["date", "amount"]
+        assert read_header(b"id\n1\n2\n", ".csv") == ["id"]
+        assert read_header(b"", ".csv") is None
+
+    def test_compare(self):
+        """Added, removed, renamed and reordered columns are told apart"""
+        assert compare_columns(["a", "b"], ["a", "b"]) is None
+        assert compare_columns(["a", "b"], ["a", "b", "c"]) == (["c"], [], [], False)
+        assert compare_columns(["a", "b", "c"], ["a", "c"]) == ([], ["b"], [], False)
+        assert compare_columns(
+            ["date", "amt"], ["date", "amount"]
+        ) == ([], [], [("amt", "amount")], False)
+        assert compare_columns(["a", "b"], ["b", "a"]) == ([], [], [], True)
+        assert compare_columns(["id", "amt", "region"], ["region", "amount", "id"]) == (
+            [], [], [("amt", "amount")], True
+        )
+
+    def test_missing_columns(self):
+        """Required columns are matched without regard to case; other files pass"""
+        assert missing_columns(b"Order_ID,amount\n1,2\n", ".csv", ["order_id"]) == []
+        assert missing_columns(
+            b"name,notes\n", ".csv", ["order_id", "name"]
+        ) == ["order_id"]
+        assert missing_columns(b"%PDF-1.7", ".pdf", ["order_id"]) == []
+
+    def test_header_beyond_preview(self):
+        """Only the preview is read, so a header past it counts as missing"""
+        data = b"\n" * 100 + b"order_id\n1\n"
+
+        assert missing_columns(data, ".csv", ["order_id"], limit=50) == ["order_id"]
+        assert missing_columns(data, ".csv", ["order_id"]) == []
+
+
+class TestSchemaHistory:
+    """Test remembering the last header of each feed"""
+
+    def test_first_file_sets_the_schema(self, tmp_path):
+        """A new feed is no change; the next file is compared with it"""
+        history = SchemaHistory(tmp_path).load()
+
+        assert history.check(
+            "bi@acme.com",
+            "sales_0601.csv",
+            "a/sales_0601.csv",
+            b"date,amount\n1,2\n",
+            ".csv",
+        ) is None
+        change = history.check("bi@acme.com", "sales_0602.csv", "a/sales_0602.csv",
+                               b"date,amount,region\n1,2,eu\n", ".csv")
+
+        assert change.added == ["region"]
+        assert change.previous_file == "a/sales_0601.csv"
+        assert change.describe() == "added: region"
+
+    def test_kept_between_runs(self, tmp_path):
+        """The headers are saved next to the manifest"""
+        history = SchemaHistory(tmp_path).load()
+        history.check("bi@acme.com", "x.csv", "x.csv", b"a,b\n1,2\n", ".csv")
+        history.save()
+
+        assert (tmp_path / SCHEMA_FILENAME).exists()
+        assert SchemaHistory(tmp_path).load().columns(
+            feed_key("bi@acme.com", "x.csv")
+        ) == ["a", "b"]
+
+    def test_other_files_ignored(self, tmp_path):
+        """Only tables are compared"""
+        history = SchemaHistory(tmp_path).load()
+
+        assert history.check(
+            "bi@acme.com", "x.pdf", "x.pdf", b"%PDF-1.7", ".pdf"
+        ) is None
+        assert not (tmp_path / SCHEMA_FILENAME).exists()
+
+    def test_older_files_not_compared(self, tmp_path):
+        """A backfilled file does not replace the newest header"""
+        history = SchemaHistory(tmp_path).load()
+        history.check(
+            "bi@acme.com",
+            "s_2.csv",
+            "s_2.csv",
+            b"a,b,c\n1,2,3\n",
+            ".csv",
+            "2024-06-02T08:00:00",
+        )
+
+        assert history.check(
+            "bi@acme.com",
+            "s_1.csv",
+            "s_1.csv",
+            b"a,b\n1,2\n",
+            ".csv",
+            "2024-06-01T08:00:00",
+        ) is None
+        assert history.columns(feed_key("bi@acme.com", "s_2.csv")) == ["a", "b", "c"]
+
+
+class TestServiceDrift:
+    """Test drift detection during downloads"""
+
+    async def test_change_reported(self, make_service):
+        """A changed header is kept for the summary and published"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "bi@acme.com", "Export", {"sales_0601.csv": b"date,amount\n1,2\n"}
+        )
+        service = make_service(gmail)
+        service.config.schema.enabled = True
+        await service.execute(await service.plan())
+
+        gmail.add_message(
+            "bi@acme.com", "Export", {"sales_0602.csv": b"date,total\n1,2\n"}
+        )
+        channel = service.events.subscribe()
+        await service.execute(await service.plan())
+        channel.close()
+        events = [event async for event in channel]
+
+        assert [
+            change.describe() for change in service.schema_changes
+        ] == ["renamed: amount -> total"]
+        assert "schema_changed" in [event.kind for event in events]
+
+    async def test_webhook(self, monkeypatch, make_service):
+        """With a webhook configured, changes are posted to it"""
+        gmail = FakeGmail()
+        gmail.add_message("bi@acme.com", "Export", {"sales_0601.csv": b"a,b\n1,2\n"})
+        service = make_service(gmail)
+        service.config.schema.enabled = True
+        service.config.notifications = NotificationConfig(webhook_url="https://x")
+        posted = []
+        monkeypatch.setattr(
+            WebhookNotifier, "_post", lambda self, payload: posted.append(payload)
+        )
+        await service.execute(await service.plan())
+
+        gmail.add_message("bi@acme.com", "Export", {"sales_0602.csv": b"a\n1\n"})
+        await service.execute(await service.plan())
+
+        assert [payload["removed"] for payload in posted] == [["b"]]
+
+    async def test_saved_once_per_run(self, monkeypatch, make_service):
+        """The history is written at the end of the run, not after every file"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "bi@acme.com",
+            "Export",
+            {"sales.csv": b"a,b\n1,2\n", "costs.csv": b"c,d\n3,4\n"},
+        )
+        service = make_service(gmail)
+        service.config.schema.enabled = True
+        saves = []
+        save = SchemaHistory.save
+        monkeypatch.setattr(
+            SchemaHistory, "save", lambda self: saves.append(save(self))
+        )
+
+        await service.execute(await service.plan())
+
+        assert len(saves) == 1
+        assert SchemaHistory(service.manifest.base_dir).load().columns(
+            feed_key("bi@acme.com", "costs.csv")
+        ) == ["c", "d"]
+
+
+class TestRequiredColumns:
+    """Test skipping CSVs without the required columns"""
+
+    async def test_template_not_saved(self, make_service):
+        """A template without order_id is left out; the export is saved"""
+        gmail = FakeGmail()
+        message = gmail.add_message("bi@acme.com", "Orders", {
+            "orders_0601.csv": b"order_id,amount\n1,2\n",
+            "template.csv": b"field,description\norder_id,Order number\n",
+        })
+        service = make_service(gmail)
+        service.config.filters.required_columns = ["order_id"]
+
+        saved = await service.execute(await service.plan())
+
+        assert [path.name for path in saved] == ["orders_0601.csv"]
+        entry = service.manifest.get(message.id, "template.csv")
+        assert entry.skipped == "missing_columns"
+        assert [
+            item.filename for item in await service.plan() if item.status != "EXISTS"
+        ] == []
@@ -0,0 +1,129 @@
+"""
+Tests for search module
+"""
+
+import pytest
+
+from gmail_downloader.search import (
+    PDF_PAGES,
+    SearchIndex,
+    SearchIndexError,
+    fallback_query,
+    file_text,
+)
+
+
+class TestFileText:
+    """Test what is read from saved files"""
+
+    def test_csv_columns(self, tmp_path, save_file):
+        """A CSV's header is its columns, and its rows are text"""
+        save_file("orders.csv", b"order_id;amount\n4812;10\n")
+
+        columns, text = file_text(tmp_path / "orders.csv")
+
+        assert columns == "order_id amount"
+        assert "4812" in text
+
+    def test_pdf_sidecar(self, tmp_path, save_file):
+        """A PDF's text comes from its sidecar"""
+        save_file("invoice.pdf", b"%PDF-1.4")
+        save_file("invoice.pdf.txt", b"Order 4812\n")
+
+        assert file_text(tmp_path / "invoice.pdf") == ("", "Order 4812\n")
+
+    def test_damaged_pdf(self, tmp_path, monkeypatch, save_file):
+        """A PDF pypdf fails on is indexed without text; only first pages are read"""
+        save_file("invoice.pdf", b"%PDF-1.4")
+        pages = []
+
+        def damaged(path, max_pages=None):
+            pages.append(max_pages)
+            raise KeyError("/Root")
+
+        monkeypatch.setattr("gmail_downloader.search.pdf_text", damaged)
+
+        assert file_text(tmp_path / "invoice.pdf") == ("", "")
+        assert pages == [PDF_PAGES]
+
+    def test_other_files(self, tmp_path, save_file):
+        """Binary formats are only indexed by their details"""
+        save_file("photo.jpg", b"\xff\xd8\xff")
+
+        assert file_text(tmp_path / "photo.jpg") == ("", "")
+
+    def test_fallback_query(self):
+        """Every word becomes a phrase"""
+        assert fallback_query('bi@acme.com 4"x') == '"bi@acme.com" "4""x"'
+
+
+class TestSearchIndex:
+    """Test indexing and searching"""
+
+    def test_find_by_content_and_sender(self, tmp_path, save_file):
+        """Files are found by what they contain and who sent them"""
+        entries = [
+            save_file(
+                "acme.com/orders.csv",
+                b"order_id,amount\n4812,10\n",
+                sender="bi@acme.com",
+            ),
+            save_file(
+                "other.com/notes.txt",
+                b"Nothing to see",
+                sender="x@other.com",
+                subject="Weekly",
+            ),
+        ]
+        index = SearchIndex(tmp_path)
+
+        assert index.update(entries, tmp_path) == (2, 0, 2)
+
+        hits = index.search("4812")
+        assert [hit.path for hit in hits] == ["acme.com/orders.csv"]
+        assert "**4812**" in hits[0].snippet
+        assert [
+            hit.path for hit in index.search("sender:other")
+        ] == ["other.com/notes.txt"]
+        assert [
+            hit.path for hit in index.search("bi@acme.com")
+        ] == ["acme.com/orders.csv"]
+
+    def test_only_changes_are_indexed(self, tmp_path, save_file):
+        """Unchanged files are skipped, and files gone from the manifest removed"""
+        first = save_file("a.txt", b"alpha")
+        second = save_file("b.txt", b"beta")
+        index = SearchIndex(tmp_path)
+        index.update([first, second], tmp_path)
+
+        changed = save_file("a.txt", b"gamma")
+
+        assert index.update([changed], tmp_path) == (1, 1, 1)
+        assert index.search("alpha") == []
+        assert [hit.path for hit in index.search("gamma")] == ["a.txt"]
+        assert index.update([changed], tmp_path, rebuild=True) == (1, 0, 1)
+
+    def test_remove(self, tmp_path, save_file):
+        """Removed files are no longer found"""
+        first = save_file("a.txt", b"alpha")
+        second = save_file("b.txt", b"beta")
+        index = SearchIndex(tmp_path)
+        index.update([first, second], tmp_path)
+
+        assert index.remove(["a.txt", "gone.txt"]) == 1
+        assert index.search("alpha") == []
+        assert len(index.search("beta")) == 1
+
+    def test_without_files(self, tmp_path, save_file):
+        """Without the files (remote storage), manifest details are searchable"""
+        entry = save_file("a.txt", b"alpha", subject="Quarterly numbers")
+        index = SearchIndex(tmp_path)
+        index.update([entry], None)
+
+        assert index.search("alpha") == []
+        assert len(index.search("quarterly")) == 1
+
+    def test_no_index(self, tmp_path):
+        """Searching before indexing says what to run"""
+        with pytest.raises(SearchIndexError, match="gmail-downloader index"):
+            SearchIndex(tmp_path).search("anything")
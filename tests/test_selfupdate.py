@@ -0,0 +1,223 @@
+"""
+Tests for selfupdate module
+"""
+
+import hashlib
+import json
+import os
+from pathlib import Path
+
+import pytest
+
+from gmail_downloader import selfupdate
+from gmail_downloader.selfupdate import (
+    CHECKSUMS_ASSET,
+    LATEST_RELEASE_URL,
+    SIGNATURE_ASSET,
+    Release,
+    UpdateError,
+    asset_name,
+    download_verified,
+    is_newer,
+    latest_release,
+    parse_checksums,
+    replace_executable,
+)
+
+BUILD = b"new build"
+
+
+def make_release(checksum=None, with_checksums=True, sign=None):
+    """
+    A release with this platform's build, and a fetch serving its files.
+
+    sign, given, makes the signature of SHA256SUMS.
+    """
+    name = asset_name()
+    files = {f"https://example.com/{name}": BUILD}
+    assets = {name: f"https://example.com/{name}"}
+    if with_checksums:
+        files["https://example.com/SHA256SUMS"] = (
+            f"{checksum or hashlib.sha256(BUILD).hexdigest()}  {name}\n"
+            f"{'0' * 64}  gmail-downloader-other-arch\n"
+        ).encode()
+        assets[CHECKSUMS_ASSET] = "https://example.com/SHA256SUMS"
+        if sign:
+            files["https://example.com/SHA256SUMS.sig"] = sign(
+                files["https://example.com/SHA256SUMS"]
+            )
+            assets[SIGNATURE_ASSET] = "https://example.com/SHA256SUMS.sig"
+    return Release("1.2.0", assets), files.__getitem__
+
+
+def make_key():
+    """A new Ed25519 key: its signing function and public key PEM"""
+    ed25519 = pytest.importorskip("cryptography.hazmat.primitives.asymmetric.ed25519")
+    serialization = pytest.importorskip("cryptography.hazmat.primitives.serialization")
+    key = ed25519.Ed25519PrivateKey.generate()
+    pem = key.public_key().public_bytes(
+        serialization.Encoding.PEM, serialization.PublicFormat.SubjectPublicKeyInfo
+    )
+    return key.sign, pem
+
+
+class TestVersions:
+    """Test finding and comparing releases"""
+
+    def test_is_newer(self):
+        """Numbers compare numerically; a leading v and suffixes are ignored"""
+        assert is_newer("0.10.0", "0.9.1")
+        assert is_newer("v1.0.0", "0.1.0")
+        assert not is_newer("0.1.0", "0.1.0")
+        assert not is_newer("0.1.0-rc1", "0.1.0")
+        with pytest.raises(UpdateError):
+            is_newer("latest", "0.1.0")
+
+    def test_latest_release(self):
+        """The GitHub API answer is read into a release"""
+        answer = {
+            "tag_name": "v1.2.0",
+            "html_url": "https://github.com/x/releases/v1.2.0",
+            "assets": [
+                {
+                    "name": "SHA256SUMS",
+                    "browser_download_url": "https://example.com/SHA256SUMS",
+                }
+            ],
+        }
+
+        release = latest_release(
+            {LATEST_RELEASE_URL: json.dumps(answer).encode()}.__getitem__
+        )
+
+        assert release.version == "1.2.0"
+        assert release.assets == {"SHA256SUMS": "https://example.com/SHA256SUMS"}
+        with pytest.raises(UpdateError):
+            latest_release(lambda url: b"<html>")
+
+    def test_asset_name(self):
+        """Platform names are normalized"""
+        assert asset_name("Linux", "x86_64") == "gmail-downloader-linux-x86_64"
+        assert asset_name("Darwin", "arm64") == "gmail-downloader-macos-arm64"
+        assert asset_name("Windows", "AMD64") == "gmail-downloader-windows-x86_64.exe"
+
+    def test_parse_checksums(self):
+        """Both text and binary (*) sha256sum lines are read"""
+        assert parse_checksums("ABC  one\ndef *two\n\n") == {"one": "abc", "two": "def"}
+
+
+class TestDownloadVerified:
+    """Test that only builds matching SHA256SUMS are accepted"""
+
+    def test_matching_build(self):
+        """A build matching its signed checksum is returned"""
+        sign, pem = make_key()
+        release, fetch = make_release(sign=sign)
+
+        assert download_verified(release, fetch, pem) == BUILD
+
+    def test_mismatch(self):
+        """A build that does not match is refused"""
+        sign, pem = make_key()
+        release, fetch = make_release(checksum="0" * 64, sign=sign)
+
+        with pytest.raises(UpdateError, match="Checksum mismatch"):
+            download_verified(release, fetch, pem)
+
+    def test_bad_signature(self):
+        """SHA256SUMS signed with another key is refused"""
+        sign, _ = make_key()
+        _, other_pem = make_key()
+        release, fetch = make_release(sign=sign)
+
+        with pytest.raises(UpdateError, match="not signed by"):
+            download_verified(release, fetch, other_pem)
+
+    def test_pinned_key_by_default(self, tmp_path, monkeypatch):
+        """Without a key given, the packaged release key is used, and needed"""
+        monkeypatch.setattr(
+            selfupdate, "RELEASE_KEY_FILE", tmp_path / "release_key.pem"
+        )
+        release, fetch = make_release(sign=lambda data: b"signature")
+
+        with pytest.raises(UpdateError, match="no release key"):
+            download_verified(release, fetch)
+
+        sign, pem = make_key()
+        (tmp_path / "release_key.pem").write_bytes(pem)
+        release, fetch = make_release(sign=sign)
+        assert download_verified(release, fetch) == BUILD
+
+    def test_packaged_key(self):
+        """The release key ships in the package, the wheel and the standalone build"""
+        pem = selfupdate.release_key()
+        assert pem.startswith(b"-----BEGIN PUBLIC KEY-----")
+
+        root = Path(__file__).parent.parent
+        assert (
+            "src/gmail_downloader/release_key.pem"
+            in (root / "pyproject.toml").read_text()
+        )
+        assert "src/gmail_downloader/release_key.pem" in (
+            root / "gmail-downloader.spec"
+        ).read_text()
+
+        serialization = pytest.importorskip(
+            "cryptography.hazmat.primitives.serialization"
+        )
+        ed25519 = pytest.importorskip(
+            "cryptography.hazmat.primitives.asymmetric.ed25519"
+        )
+        assert isinstance(
+            serialization.load_pem_public_key(pem), ed25519.Ed25519PublicKey
+        )
+
+    def test_no_checksums(self):
+        """A release without SHA256SUMS is refused"""
+        release, fetch = make_release(with_checksums=False)
+
+        with pytest.raises(UpdateError, match="unverified"):
+            download_verified(release, fetch)
+
+    def test_signature_required(self):
+        """An unsigned release is refused"""
+        release, fetch = make_release()
+
+        with pytest.raises(UpdateError, match="not signed"):
+            download_verified(release, fetch, b"-----BEGIN PUBLIC KEY-----")
+
+
+class TestReplaceExecutable:
+    """Test swapping the build in"""
+
+    def test_replaces_and_keeps_executable(self, tmp_path):
+        """The file is replaced and stays executable"""
+        executable = tmp_path / "gmail-downloader"
+        executable.write_bytes(b"old build")
+        executable.chmod(0o755)
+
+        assert replace_executable(BUILD, executable) == executable.resolve()
+
+        assert executable.read_bytes() == BUILD
+        assert executable.stat().st_mode & 0o111
+        assert [path.name for path in tmp_path.iterdir()] == ["gmail-downloader"]
+
+    def test_old_build_restored_on_windows(self, tmp_path, monkeypatch):
+        """When the new build cannot be moved in, the one moved aside goes back"""
+        executable = tmp_path / "gmail-downloader.exe"
+        executable.write_bytes(b"old build")
+        real_replace = os.replace
+
+        def replace(source, target):
+            if str(source).endswith(".update"):
+                raise PermissionError("in use")
+            real_replace(source, target)
+
+        monkeypatch.setattr(selfupdate.sys, "platform", "win32")
+        monkeypatch.setattr(selfupdate.os, "replace", replace)
+
+        with pytest.raises(UpdateError, match="in use"):
+            replace_executable(BUILD, executable)
+
+        assert executable.read_bytes() == b"old build"
+        assert [path.name for path in tmp_path.iterdir()] == ["gmail-downloader.exe"]
@@ -0,0 +1,89 @@
+"""
+Tests for shard module
+"""
+
+from datetime import date, datetime
+
+import pytest
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import AttachmentDownloader, DownloadService
+from gmail_downloader.manifest import DownloadManifest
+from gmail_downloader.shard import Shard, parse_shard
+
+from tests.gmailtest import FakeGmail
+
+
+class TestParseShard:
+    """Test reading --shard and --shard-by"""
+
+    def test_valid(self):
+        """K/N with spaces allowed, and the key"""
+        assert parse_shard("2/4") == Shard(2, 4, "sender")
+        assert parse_shard(" 1 / 3 ", "date") == Shard(1, 3, "date")
+
+    @pytest.mark.parametrize("shard,key", [
+        ("0/4", "sender"),
+        ("5/4", "sender"),
+        ("2", "sender"),
+        ("half", "sender"),
+        ("1/2", "subject"),
+    ])
+    def test_invalid(self, shard, key):
+        """Parts outside 1..N and unknown keys are rejected"""
+        with pytest.raises(ValueError):
+            parse_shard(shard, key)
+
+
+class TestSplit:
+    """Test that shards split the work without gaps or overlap"""
+
+    def test_every_value_in_one_shard(self):
+        """Each sender and day falls to exactly one of the shards"""
+        shards = [Shard(index, 3) for index in (1, 2, 3)]
+
+        for number in range(50):
+            sender = f"sender{number}@example.com"
+            assert sum(shard.owns_sender(sender) for shard in shards) == 1
+            assert sum(
+                shard.owns_day(date(2024, 1, 1).replace(day=number % 28 + 1))
+                for shard in shards
+            ) == 1
+
+    def test_sender_address_only(self):
+        """Display names and case do not move a sender to another shard"""
+        shard = Shard(1, 2)
+
+        assert (
+            shard.owns_sender("Billing <Billing@Vendor.com>")
+            == shard.owns_sender("billing@vendor.com")
+        )
+
+    def test_split_in_turn(self):
+        """Items are handed out round-robin"""
+        assert Shard(2, 3).split(list(range(8))) == [1, 4, 7]
+
+    async def test_select_planned(self, tmp_path):
+        """The shards' selections of a plan add up to the whole plan"""
+        gmail = FakeGmail()
+        for number in range(12):
+            gmail.add_message(
+                f"sender{number}@example.com",
+                f"Report {number}",
+                {f"report-{number}.csv": b"a,b"},
+                date=datetime(2024, 6, number + 1),
+            )
+        config = AppConfig()
+        config.filters.extensions = [".csv"]
+        config.filters.min_size = 1
+        service = DownloadService(
+            gmail.client(config),
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+        planned = await service.plan()
+
+        for key in ("sender", "date"):
+            parts = [Shard(index, 3, key).select(planned) for index in (1, 2, 3)]
+            names = [item.filename for part in parts for item in part]
+            assert sorted(names) == sorted(item.filename for item in planned)
@@ -0,0 +1,92 @@
+"""
+Tests for sniff module
+"""
+
+import io
+import zipfile
+
+import pytest
+from gmail_downloader.sniff import detect_extension, fixed_filename, sniff_extension
+
+
+def zip_of(members):
+    """A ZIP with the given member names and contents"""
+    output = io.BytesIO()
+    with zipfile.ZipFile(output, "w") as archive:
+        for name, data in members.items():
+            archive.writestr(name, data)
+    return output.getvalue()
+
+
+class TestSniffExtension:
+    """Test recognising formats from their contents"""
+
+    @pytest.mark.parametrize("data,expected", [
+        (b"%PDF-1.7\n", ".pdf"),
+        (b"\x89PNG\r\n\x1a\n....", ".png"),
+        (b"\x1f\x8b\x08\x00", ".gz"),
+        (
+            zip_of(
+                {"[Content_Types].xml": "<Types/>", "xl/workbook.xml": "<workbook/>"}
+            ),
+            ".xlsx",
+        ),
+        (
+            zip_of(
+                {
+                    "[Content_Types].xml": "<Types/>",
+                    "word/document.xml": "<document/>",
+                }
+            ),
+            ".docx",
+        ),
+        (
+            zip_of({"mimetype": "application/vnd.oasis.opendocument.spreadsheet"}),
+            ".ods",
+        ),
+        (zip_of({"a.csv": "1,2"}), ".zip"),
+        (b'{"rows": [1, 2]}', ".json"),
+        (b'id,name,amount\n1,"Acme, Inc.",10\n2,Globex,20\n', ".csv"),
+        (b"id;name\n1;Acme\n2;Globex\n", ".csv"),
+        (b"id\tname\n1\tAcme\n", ".tsv"),
+        (b"Dear customer,\nplease find attached\nthe report.\n", None),
+        (b"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1" + bytes(100), None),
+    ])
+    def test_formats(self, data, expected):
+        """Magic bytes, ZIP members and text shape decide the format"""
+        assert sniff_extension(data) == expected
+
+    def test_long_csv(self):
+        """Only the start of a large file is read, and its cut-off last line ignored"""
+        data = b"date,value\n" + b"2024-06-01,1234.5\n" * 10000
+
+        assert sniff_extension(data) == ".csv"
+
+
+class TestDetectExtension:
+    """Test deciding whether a name needs another extension"""
+
+    def test_mismatched_names(self):
+        """Names that hide their format get the detected extension"""
+        workbook = zip_of(
+            {"[Content_Types].xml": "<Types/>", "xl/workbook.xml": "<workbook/>"}
+        )
+
+        assert detect_extension("export.dat", b"a,b\n1,2\n") == ".csv"
+        assert detect_extension("report.tmp", workbook) == ".xlsx"
+        assert detect_extension("scan", b"%PDF-1.4") == ".pdf"
+
+    def test_fitting_names_kept(self):
+        """Matching, equivalent and text extensions are left alone"""
+        assert detect_extension("photo.JPEG", b"\xff\xd8\xff\xe0") == ""
+        assert detect_extension(
+            "macro.xlsm", zip_of({"[Content_Types].xml": "", "xl/a.xml": ""})
+        ) == ""
+        assert detect_extension("notes.txt", b"a,b\n1,2\n") == ""
+        assert detect_extension("mystery.bin", bytes(range(256))) == ""
+
+    def test_fixed_filename(self):
+        """append keeps the old extension, replace swaps it"""
+        assert fixed_filename("export.dat", ".csv", "append") == "export.dat.csv"
+        assert fixed_filename("export.dat", ".csv", "replace") == "export.csv"
+        assert fixed_filename("export", ".csv", "replace") == "export.csv"
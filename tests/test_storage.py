@@ -0,0 +1,479 @@
+"""
+Tests for storage module
+"""
+
+import asyncio
+import hashlib
+import shutil
+import threading
+from datetime import datetime
+from http.server import BaseHTTPRequestHandler, HTTPServer
+from pathlib import Path
+from unittest.mock import patch
+
+import pytest
+
+from gmail_downloader import storage as storage_module
+from gmail_downloader.config import StorageConfig
+from gmail_downloader.downloader import AttachmentDownloader, STATUS_EXISTS, STATUS_NEW
+from gmail_downloader.storage import (
+    LocalStorage,
+    RemoteStorage,
+    SpoolingStorage,
+    StorageError,
+    WebDAVStorage,
+    open_storage,
+    parse_storage_url,
+    s3_md5,
+    split_server,
+)
+
+
+class MemoryStorage(RemoteStorage):
+    """Bucket-style storage that keeps objects in a dict."""
+
+    scheme = "mem"
+
+    def __init__(self, bucket="bucket", prefix="", options=None):
+        super().__init__(bucket, prefix, options)
+        self.objects = {}
+
+    def size(self, key):
+        data = self.objects.get(self.object_name(key))
+        return len(data) if data is not None else None
+
+    async def write(self, key, data):
+        self.objects[self.object_name(key)] = data
+
+
+@pytest.mark.parametrize(
+    "url,expected",
+    [
+        ("s3://bucket", ("s3", "bucket", "")),
+        ("s3://bucket/mail/attachments/", ("s3", "bucket", "mail/attachments")),
+        ("GS://bucket/prefix", ("gs", "bucket", "prefix")),
+        ("az://account/container/prefix", ("az", "account/container", "prefix")),
+        (
+            "sftp://drop@files.example.com:2222/incoming",
+            ("sftp", "drop@files.example.com:2222", "incoming"),
+        ),
+    ],
+)
+def test_parse_storage_url(url, expected):
+    """Storage URLs split into scheme, bucket and prefix."""
+    assert parse_storage_url(url) == expected
+
+
+@pytest.mark.parametrize("server,expected", [
+    ("files.example.com", (None, "files.example.com", None)),
+    ("drop@files.example.com:2222", ("drop", "files.example.com", 2222)),
+])
+def test_split_server(server, expected):
+    """Server strings split into user, host and port."""
+    assert split_server(server) == expected
+
+
+def test_split_server_invalid_port():
+    """A non-numeric port is rejected."""
+    with pytest.raises(StorageError):
+        split_server("host:ssh")
+
+
+class TestOpenStorage:
+    """Test backend selection."""
+
+    def test_local_directory(self, tmp_path):
+        """Plain paths use local storage."""
+        storage = open_storage(str(tmp_path / "downloads"))
+
+        assert isinstance(storage, LocalStorage)
+        assert not storage.is_remote
+        assert (tmp_path / "downloads").is_dir()
+
+    def test_unknown_scheme(self):
+        """Unsupported URL schemes are rejected."""
+        with pytest.raises(StorageError):
+            open_storage("ftp://host/dir")
+
+    def test_missing_bucket(self):
+        """A URL without a bucket is rejected."""
+        with pytest.raises(StorageError):
+            open_storage("s3://")
+
+
+class TestLocalStorage:
+    """Test the local file system backend."""
+
+    async def test_write_and_size(self, tmp_path):
+        """Written files can be found again by key."""
+        storage = LocalStorage(tmp_path)
+
+        assert storage.size("vendor/a.pdf") is None
+        await storage.write("vendor/a.pdf", b"12345")
+
+        assert (tmp_path / "vendor" / "a.pdf").read_bytes() == b"12345"
+        assert storage.size("vendor/a.pdf") == 5
+
+    def test_locate_and_key_for(self, tmp_path):
+        """Keys and locations convert both ways."""
+        storage = LocalStorage(tmp_path)
+
+        assert storage.locate("vendor/a.pdf") == tmp_path / "vendor" / "a.pdf"
+        assert storage.key_for(tmp_path / "vendor" / "a.pdf") == "vendor/a.pdf"
+
+    def test_claim_is_exclusive(self, tmp_path):
+        """Only one of two storages (e.g. two processes) can claim a key."""
+        first = LocalStorage(tmp_path)
+        second = LocalStorage(tmp_path)
+
+        assert first.claim("vendor/a.pdf")
+        assert not second.claim("vendor/a.pdf")
+
+    def test_release_removes_placeholder(self, tmp_path):
+        """Releasing an unwritten claim removes the empty file, never real data."""
+        storage = LocalStorage(tmp_path)
+        storage.claim("a.pdf")
+        storage.release("a.pdf")
+        (tmp_path / "b.pdf").write_bytes(b"data")
+        storage.release("b.pdf")
+
+        assert not (tmp_path / "a.pdf").exists()
+        assert (tmp_path / "b.pdf").read_bytes() == b"data"
+
+    async def test_each_directory_ensured_once(self, tmp_path):
+        """Concurrent writes into the same folders create each folder only once."""
+        storage = LocalStorage(tmp_path)
+        keys = [f"{folder}/{n}.pdf" for folder in ("a", "b/c") for n in range(10)]
+
+        with patch.object(storage_module, "ensure_directory",
+                          wraps=storage_module.ensure_directory) as ensure:
+            await asyncio.gather(*(storage.write(key, b"x") for key in keys))
+            for key in keys:
+                storage.claim(key + ".part")
+
+        ensured = sorted(call.args[0] for call in ensure.call_args_list)
+        assert ensured == [tmp_path / "a", tmp_path / "b" / "c"]
+        assert all(storage.size(key) == 1 for key in keys)
+
+    async def test_recreates_removed_directory(self, tmp_path):
+        """A folder deleted during the run is created again on the next write."""
+        storage = LocalStorage(tmp_path)
+        await storage.write("vendor/a.pdf", b"1")
+        shutil.rmtree(tmp_path / "vendor")
+
+        await storage.write("vendor/b.pdf", b"2")
+        shutil.rmtree(tmp_path / "vendor")
+
+        assert storage.claim("vendor/c.pdf")
+        assert (tmp_path / "vendor" / "c.pdf").exists()
+
+
+class TestRemoteStorage:
+    """Test bucket-style backends through the downloader."""
+
+    def test_locate_and_key_for(self):
+        """Keys map to URLs below the prefix and back."""
+        storage = MemoryStorage("bucket", "mail/")
+
+        assert storage.locate("vendor/a.pdf") == "mem://bucket/mail/vendor/a.pdf"
+        assert storage.key_for("mem://bucket/mail/vendor/a.pdf") == "vendor/a.pdf"
+
+    async def test_downloader_writes_to_bucket(self):
+        """Organized paths become object names and nothing touches local disk."""
+        storage = MemoryStorage("bucket", "mail")
+        downloader = AttachmentDownloader("mem://bucket/mail", storage=storage)
+
+        location = await downloader.download_attachment(
+            b"pdf bytes", "report.pdf", "reports@vendor.com", datetime(2024, 6, 1)
+        )
+
+        assert location == "mem://bucket/mail/reports/report.pdf"
+        assert storage.objects == {"mail/reports/report.pdf": b"pdf bytes"}
+        assert downloader.base_dir is None
+
+    async def test_compare_with_existing(self):
+        """Sync status is worked out from object sizes."""
+        storage = MemoryStorage()
+        downloader = AttachmentDownloader("mem://bucket", storage=storage)
+        location = storage.locate("a.pdf")
+
+        assert downloader.compare_with_existing(location, 3) == STATUS_NEW
+        await storage.write("a.pdf", b"abc")
+        assert downloader.compare_with_existing(location, 3) == STATUS_EXISTS
+
+
+class FlakyStorage(MemoryStorage):
+    """Memory storage whose first uploads arrive damaged."""
+
+    def __init__(self, failures, damage="truncate", options=None):
+        super().__init__(options=options)
+        self.failures = failures
+        self.damage = damage
+        self.uploads = 0
+        self.md5 = {}
+
+    async def write(self, key, data):
+        self.uploads += 1
+        self.md5[key] = hashlib.md5(data).hexdigest()
+        if self.uploads <= self.failures:
+            if self.damage == "truncate":
+                data = data[:-1]
+            else:
+                # Same length, different bytes: only the checksum can tell
+                data = bytes(reversed(data))
+                self.md5[key] = hashlib.md5(data).hexdigest()
+        await super().write(key, data)
+
+    def checksum(self, key):
+        return self.md5.get(key)
+
+
+class TestUploadVerification:
+    """Test that remote uploads are checked and retried."""
+
+    async def test_reupload_after_size_mismatch(self):
+        """A truncated upload is sent again and then accepted."""
+        storage = FlakyStorage(failures=1)
+
+        await storage.write_verified("a.pdf", b"pdf bytes")
+
+        assert storage.uploads == 2
+        assert storage.objects["a.pdf"] == b"pdf bytes"
+
+    async def test_checksum_mismatch_detected(self):
+        """Damage that keeps the size is caught by the MD5 comparison."""
+        storage = FlakyStorage(failures=1, damage="scramble")
+
+        await storage.write_verified("a.pdf", b"pdf bytes")
+
+        assert storage.uploads == 2
+        assert storage.objects["a.pdf"] == b"pdf bytes"
+
+    async def test_reports_how_upload_was_checked(self):
+        """The check made on upload is returned, so it is not repeated by the caller."""
+        storage = FlakyStorage(failures=0)
+
+        assert await storage.write_verified("a.pdf", b"pdf bytes") == "md5"
+        assert storage.verify("a.pdf", b"pdf bytes", mode="size") == "size"
+        assert storage.verify("a.pdf", b"other") is None
+
+    def test_s3_etag_only_trusted_as_md5_when_it_is_one(self):
+        """Multipart and KMS-encrypted ETags are not MD5s; those are size-checked."""
+        md5 = hashlib.md5(b"pdf bytes").hexdigest()
+
+        assert s3_md5({"ETag": f'"{md5}"'}) == md5
+        assert s3_md5({"ETag": f'"{md5}-3"'}) is None
+        assert s3_md5({"ETag": f'"{md5}"', "ServerSideEncryption": "aws:kms"}) is None
+        assert s3_md5({"ETag": f'"{md5}"', "SSECustomerAlgorithm": "AES256"}) is None
+        assert s3_md5({"ETag": f'"{md5}"', "ServerSideEncryption": "AES256"}) == md5
+
+    async def test_gives_up_after_attempts(self):
+        """Persistent mismatches fail instead of being recorded as downloaded."""
+        storage = FlakyStorage(failures=10, options=StorageConfig(upload_attempts=2))
+
+        with pytest.raises(StorageError):
+            await storage.write_verified("a.pdf", b"pdf bytes")
+        assert storage.uploads == 2
+
+    async def test_verification_disabled(self):
+        """With verify_uploads off, each file is uploaded once and trusted."""
+        storage = FlakyStorage(failures=1, options=StorageConfig(verify_uploads=False))
+
+        await storage.write_verified("a.pdf", b"pdf bytes")
+
+        assert storage.uploads == 1
+
+
+class OutageStorage(MemoryStorage):
+    """Memory storage that can be switched off like a network outage."""
+
+    def __init__(self):
+        super().__init__()
+        self.online = True
+
+    def size(self, key):
+        if not self.online:
+            raise StorageError("connection refused")
+        return super().size(key)
+
+    async def write(self, key, data):
+        if not self.online:
+            raise StorageError("connection refused")
+        await super().write(key, data)
+
+
+class TestSpoolingStorage:
+    """Test store-and-forward during remote outages."""
+
+    async def test_spools_while_offline_and_forwards_later(self, tmp_path):
+        """Files written during an outage are uploaded after the next success."""
+        remote = OutageStorage()
+        storage = SpoolingStorage(remote, tmp_path, max_bytes=1024)
+
+        remote.online = False
+        await storage.write_verified("vendor/a.pdf", b"first")
+        assert remote.objects == {}
+        assert storage.spooled_keys() == ["vendor/a.pdf"]
+        assert storage.size("vendor/a.pdf") == 5
+
+        remote.online = True
+        await storage.write_verified("vendor/b.pdf", b"second")
+
+        assert remote.objects == {"vendor/a.pdf": b"first", "vendor/b.pdf": b"second"}
+        assert storage.spooled_keys() == []
+        assert storage.status()["forwarded"] == 1
+
+    async def test_flush_stops_while_offline(self, tmp_path):
+        """flush() keeps files spooled until the remote is back."""
+        remote = OutageStorage()
+        storage = SpoolingStorage(remote, tmp_path, max_bytes=1024)
+        remote.online = False
+        await storage.write_verified("a.pdf", b"abc")
+
+        assert await storage.flush() == 0
+        remote.online = True
+        assert await storage.flush() == 1
+        assert remote.objects == {"a.pdf": b"abc"}
+
+    async def test_spool_survives_restart(self, tmp_path):
+        """A new process picks up files spooled by the previous one."""
+        remote = OutageStorage()
+        remote.online = False
+        await SpoolingStorage(
+            remote, tmp_path, max_bytes=1024
+        ).write_verified("a.pdf", b"abc")
+
+        remote.online = True
+        assert await SpoolingStorage(remote, tmp_path, max_bytes=1024).flush() == 1
+
+    async def test_uploads_do_not_list_spool(self, tmp_path, monkeypatch):
+        """The spool directory is listed once, not on every upload."""
+        remote = OutageStorage()
+        storage = SpoolingStorage(remote, tmp_path, max_bytes=1024)
+        listings = []
+        rglob = Path.rglob
+        monkeypatch.setattr(
+            Path,
+            "rglob",
+            lambda path,
+            pattern: listings.append(path) or rglob(path, pattern),
+        )
+
+        for name in ("a.pdf", "b.pdf", "c.pdf"):
+            await storage.write_verified(name, b"abc")
+
+        assert len(listings) == 1
+        assert storage.spooled_keys() == []
+
+    async def test_spool_size_limit(self, tmp_path):
+        """A full spool turns the outage into an error instead of filling the disk."""
+        remote = OutageStorage()
+        remote.online = False
+        storage = SpoolingStorage(remote, tmp_path, max_bytes=5)
+        await storage.write_verified("a.pdf", b"abc")
+
+        with pytest.raises(StorageError) as exc_info:
+            await storage.write_verified("b.pdf", b"abc")
+
+        assert "spool is full" in str(exc_info.value)
+        assert storage.status()["waiting_bytes"] == 3
+
+    def test_open_storage_wraps_remote(self, tmp_path):
+        """Configuring a spool directory wraps the remote backend."""
+        options = StorageConfig(spool_dir=str(tmp_path / "spool"))
+
+        storage = open_storage("webdav://dav.example.com/drop", options)
+
+        assert isinstance(storage, SpoolingStorage)
+        assert storage.locate("a.pdf") == "webdav://dav.example.com/drop/a.pdf"
+        assert storage.is_remote
+
+
+class FakeWebDAVHandler(BaseHTTPRequestHandler):
+    """Minimal WebDAV server keeping files and collections in memory."""
+
+    files = {}
+    collections = set()
+    auth_headers = []
+
+    def do_HEAD(self):
+        data = self.files.get(self.path)
+        self.send_response(404 if data is None else 200)
+        self.send_header("Content-Length", str(len(data or b"")))
+        self.end_headers()
+
+    def do_MKCOL(self):
+        self.auth_headers.append(self.headers.get("Authorization"))
+        status = 405 if self.path in self.collections else 201
+        self.collections.add(self.path)
+        self.send_response(status)
+        self.send_header("Content-Length", "0")
+        self.end_headers()
+
+    def do_PUT(self):
+        self.auth_headers.append(self.headers.get("Authorization"))
+        parent = self.path.rsplit("/", 1)[0] + "/"
+        if parent != "/" and parent not in self.collections:
+            self.send_response(409)  # Parent collection missing
+        else:
+            length = int(self.headers["Content-Length"])
+            self.files[self.path] = self.rfile.read(length)
+            self.send_response(201)
+        self.send_header("Content-Length", "0")
+        self.end_headers()
+
+    def log_message(self, *args):
+        pass
+
+
+@pytest.fixture
+def webdav_server():
+    """Run the fake WebDAV server on a free local port."""
+    FakeWebDAVHandler.files = {}
+    FakeWebDAVHandler.collections = set()
+    FakeWebDAVHandler.auth_headers = []
+    server = HTTPServer(("127.0.0.1", 0), FakeWebDAVHandler)
+    thread = threading.Thread(target=server.serve_forever, daemon=True)
+    thread.start()
+    yield f"127.0.0.1:{server.server_address[1]}"
+    server.shutdown()
+    server.server_close()
+
+
+class TestWebDAVStorage:
+    """Test the WebDAV backend against a local server."""
+
+    async def test_write_creates_folders_and_uploads(self, webdav_server):
+        """Missing collections are created before the upload."""
+        options = StorageConfig(username="drop", password="secret")
+        storage = open_storage(f"webdav://{webdav_server}/incoming", options)
+
+        assert isinstance(storage, WebDAVStorage)
+        assert storage.size("vendor/a.pdf") is None
+
+        await storage.write("vendor/a.pdf", b"12345")
+
+        assert FakeWebDAVHandler.files == {"/incoming/vendor/a.pdf": b"12345"}
+        assert storage.size("vendor/a.pdf") == 5
+        assert (
+            storage.locate("vendor/a.pdf")
+            == f"webdav://{webdav_server}/incoming/vendor/a.pdf"
+        )
+
+    async def test_basic_auth(self, webdav_server):
+        """Credentials are sent as an HTTP Basic header."""
+        options = StorageConfig(username="drop", password="secret")
+        storage = open_storage(f"webdav://{webdav_server}", options)
+
+        await storage.write("a.pdf", b"x")
+
+        assert FakeWebDAVHandler.auth_headers == ["Basic ZHJvcDpzZWNyZXQ="]
+
+    def test_unreachable_server(self):
+        """Connection failures surface as StorageError."""
+        storage = open_storage(
+            "webdav://127.0.0.1:1/dir", StorageConfig(timeout_seconds=1)
+        )
+
+        with pytest.raises(StorageError):
+            storage.size("a.pdf")
@@ -0,0 +1,191 @@
+"""
+Tests for tokenstore module
+"""
+
+import os
+import sys
+import types
+from pathlib import Path
+
+import pytest
+from gmail_downloader.config import GmailConfig
+from gmail_downloader.tokenstore import (
+    KEYRING_SERVICE,
+    EncryptedFileTokenStore,
+    EnvTokenStore,
+    FileTokenStore,
+    KeyringTokenStore,
+    TokenStoreError,
+    is_encrypted,
+    open_token_store,
+    token_variables,
+)
+
+try:
+    import cryptography  # noqa: F401
+    HAVE_CRYPTOGRAPHY = True
+except ImportError:
+    HAVE_CRYPTOGRAPHY = False
+
+TOKEN = '{"token": "ya29.abc", "refresh_token": "1//xyz"}'
+
+
+@pytest.fixture
+def fake_keyring(monkeypatch):
+    """An in-memory stand-in for the keyring package"""
+    passwords = {}
+    errors = types.SimpleNamespace(KeyringError=RuntimeError)
+    module = types.SimpleNamespace(
+        errors=errors,
+        get_password=lambda service,
+        name: passwords.get((service, name)),
+        set_password=lambda service,
+        name,
+        value: passwords.__setitem__((service, name), value),
+    )
+    monkeypatch.setitem(sys.modules, "keyring", module)
+    return passwords
+
+
+class TestOpenTokenStore:
+    """Test choosing the backend"""
+
+    def test_backends(self, tmp_path):
+        """gmail.token_store picks the store for the current profile"""
+        config = GmailConfig(token_file=str(tmp_path / "work.json"))
+
+        assert isinstance(open_token_store(config), FileTokenStore)
+        config.token_store = "encrypted"
+        assert isinstance(open_token_store(config), EncryptedFileTokenStore)
+        config.token_store = "keyring"
+        store = open_token_store(config)
+        assert isinstance(store, KeyringTokenStore) and store.profile == "work"
+        config.token_store = "env"
+        assert isinstance(open_token_store(config), EnvTokenStore)
+
+
+class TestFileTokenStore:
+    """Test plain token files"""
+
+    def test_round_trip(self, tmp_path):
+        """The token is saved as is, readable only by its owner"""
+        store = FileTokenStore(tmp_path / "config" / "token.json")
+
+        assert store.load() is None
+        store.save(TOKEN)
+
+        assert store.load() == TOKEN
+        if os.name == "posix":
+            assert (store.path.stat().st_mode & 0o777) == 0o600
+
+    @pytest.mark.skipif(os.name != "posix", reason="file modes are POSIX")
+    def test_existing_file_made_private(self, tmp_path):
+        """A token file others could read is made owner-only before writing"""
+        path = tmp_path / "token.json"
+        path.write_text("old")
+        path.chmod(0o644)
+
+        FileTokenStore(path).save(TOKEN)
+
+        assert (path.stat().st_mode & 0o777) == 0o600
+        assert path.read_text() == TOKEN
+
+
+class TestEnvTokenStore:
+    """Test tokens from the environment"""
+
+    def test_profile_variable_first(self, monkeypatch):
+        """A profile's own variable wins over the shared one"""
+        monkeypatch.setenv("GMAIL_DOWNLOADER_TOKEN", "shared")
+        monkeypatch.setenv("GMAIL_DOWNLOADER_TOKEN_WORK_MAIL", "work")
+
+        assert EnvTokenStore("work-mail").load() == "work"
+        assert EnvTokenStore("personal").load() == "shared"
+        assert token_variables("work-mail") == [
+            "GMAIL_DOWNLOADER_TOKEN_WORK_MAIL", "GMAIL_DOWNLOADER_TOKEN"
+        ]
+
+    def test_read_only(self, monkeypatch):
+        """Saving leaves the environment alone"""
+        monkeypatch.delenv("GMAIL_DOWNLOADER_TOKEN", raising=False)
+        monkeypatch.delenv("GMAIL_DOWNLOADER_TOKEN_WORK", raising=False)
+        store = EnvTokenStore("work")
+
+        store.save(TOKEN)
+
+        assert store.load() is None
+
+
+class TestKeyringTokenStore:
+    """Test the OS keychain backend"""
+
+    def test_round_trip(self, fake_keyring):
+        """Tokens are filed under the profile name"""
+        store = KeyringTokenStore("work")
+
+        assert store.load() is None
+        store.save(TOKEN)
+
+        assert store.load() == TOKEN
+        assert fake_keyring == {(KEYRING_SERVICE, "work"): TOKEN}
+
+    def test_moves_plain_file(self, fake_keyring, tmp_path):
+        """A token file from the file store is used, then replaced by the keychain"""
+        legacy = tmp_path / "work.json"
+        legacy.write_text(TOKEN)
+        store = KeyringTokenStore("work", legacy_path=legacy)
+
+        assert store.load() == TOKEN
+        store.save(TOKEN)
+
+        assert not legacy.exists()
+        assert store.load() == TOKEN
+
+    def test_not_installed(self, monkeypatch):
+        """Without the package the error says what to install"""
+        monkeypatch.setitem(sys.modules, "keyring", None)
+
+        with pytest.raises(TokenStoreError, match="secrets"):
+            KeyringTokenStore("work").load()
+
+
+class TestEncryptedFileTokenStore:
+    """Test passphrase-encrypted token files"""
+
+    @pytest.mark.skipif(not HAVE_CRYPTOGRAPHY, reason="needs cryptography")
+    def test_round_trip(self, tmp_path, monkeypatch):
+        """The file holds no plaintext and opens with the passphrase"""
+        monkeypatch.setenv("GMAIL_DOWNLOADER_TOKEN_PASSPHRASE", "correct horse")
+        store = EncryptedFileTokenStore(tmp_path / "token.json", interactive=False)
+
+        store.save(TOKEN)
+
+        content = store.path.read_text()
+        assert is_encrypted(content) and "ya29" not in content
+        assert EncryptedFileTokenStore(store.path, interactive=False).load() == TOKEN
+
+    @pytest.mark.skipif(not HAVE_CRYPTOGRAPHY, reason="needs cryptography")
+    def test_wrong_passphrase(self, tmp_path, monkeypatch):
+        """A wrong passphrase is reported as such"""
+        monkeypatch.setenv("GMAIL_DOWNLOADER_TOKEN_PASSPHRASE", "correct horse")
+        EncryptedFileTokenStore(tmp_path / "token.json", interactive=False).save(TOKEN)
+        monkeypatch.setenv("GMAIL_DOWNLOADER_TOKEN_PASSPHRASE", "battery staple")
+
+        with pytest.raises(TokenStoreError, match="Wrong passphrase"):
+            EncryptedFileTokenStore(tmp_path / "token.json", interactive=False).load()
+
+    def test_plain_file_still_readable(self, tmp_path):
+        """A token file from the file store is used until it is saved encrypted"""
+        path = tmp_path / "token.json"
+        path.write_text(TOKEN)
+
+        assert EncryptedFileTokenStore(path, interactive=False).load() == TOKEN
+
+    def test_needs_passphrase(self, tmp_path, monkeypatch):
+        """Without a terminal the passphrase must come from the environment"""
+        monkeypatch.delenv("GMAIL_DOWNLOADER_TOKEN_PASSPHRASE", raising=False)
+
+        with pytest.raises(TokenStoreError, match="GMAIL_DOWNLOADER_TOKEN_PASSPHRASE"):
+            EncryptedFileTokenStore(
+                Path(tmp_path / "token.json"), interactive=False
+            ).passphrase()
@@ -0,0 +1,180 @@
+"""
+Tests for transforms module
+"""
+
+import sys
+import types
+from pathlib import Path
+
+import pytest
+
+from gmail_downloader.config import CsvToParquetConfig, PdfTextConfig, TransformsConfig
+from gmail_downloader.manifest import ManifestEntry
+from gmail_downloader.transforms import (
+    TransformError,
+    csv_to_parquet,
+    mirror_path,
+    open_transforms,
+    pdf_text,
+)
+
+
+def save(tmp_path, relative_path, data):
+    """A file saved below tmp_path, and its manifest entry"""
+    path = tmp_path / relative_path
+    path.parent.mkdir(parents=True, exist_ok=True)
+    path.write_bytes(data)
+    entry = ManifestEntry(
+        message_id="m1", attachment_id="a1", filename=path.name, path=relative_path,
+        size=len(data), sha256="", sender="bi@acme.com",
+    )
+    return entry, path
+
+
+def parquet_transforms(tmp_path, **settings):
+    return open_transforms(
+        TransformsConfig(csv_to_parquet=CsvToParquetConfig(enabled=True, **settings)),
+        tmp_path,
+    )
+
+
+class TestMirror:
+    """Test where derived files go"""
+
+    def test_mirror_path(self):
+        """The file keeps its place below the mirror directory"""
+        assert mirror_path(
+            Path("/dl"), "parquet", "acme.com/2024-06/sales.csv", ".parquet"
+        ) == Path("/dl/parquet/acme.com/2024-06/sales.csv.parquet")
+        assert mirror_path(
+            Path("/dl"), "parquet", "acme.com/sales.tsv", ".parquet"
+        ) == Path("/dl/parquet/acme.com/sales.tsv.parquet")
+
+    def test_off_by_default(self, tmp_path):
+        """Without a transform turned on there is nothing to run"""
+        assert open_transforms(TransformsConfig(), tmp_path) is None
+
+    async def test_other_files_untouched(self, tmp_path):
+        """Only CSV/TSV files are converted"""
+        entry, path = save(tmp_path, "acme.com/report.pdf", b"%PDF-1.4")
+
+        assert await parquet_transforms(tmp_path).apply(entry, path) == []
+        assert not (tmp_path / "parquet").exists()
+
+
+class TestCsvToParquet:
+    """Test converting tables"""
+
+    def test_needs_pyarrow(self, tmp_path, monkeypatch):
+        """Without pyarrow the error says what to install"""
+        monkeypatch.setitem(sys.modules, "pyarrow", None)
+        _, path = save(tmp_path, "a.csv", b"a,b\n1,2\n")
+
+        with pytest.raises(TransformError, match=r"\[parquet\]"):
+            csv_to_parquet(path, tmp_path / "a.parquet")
+
+    async def test_infers_types(self, tmp_path):
+        """A semicolon-separated file is read with its column types"""
+        pa_parquet = pytest.importorskip("pyarrow.parquet")
+        entry, path = save(
+            tmp_path,
+            "acme.com/sales.csv",
+            b"id;amount;region\n007;1.5;EU\n008;2.25;US\n",
+        )
+
+        written = await parquet_transforms(
+            tmp_path, compression="zstd"
+        ).apply(entry, path)
+
+        assert written == [tmp_path / "parquet" / "acme.com" / "sales.csv.parquet"]
+        table = pa_parquet.read_table(written[0])
+        assert table.column_names == ["id", "amount", "region"]
+        assert table.column("amount").to_pylist() == [1.5, 2.25]
+        assert path.exists()
+
+    async def test_text_columns(self, tmp_path):
+        """Without infer_schema every value is kept as written"""
+        pa_parquet = pytest.importorskip("pyarrow.parquet")
+        entry, path = save(tmp_path, "acme.com/ids.tsv", b"id\tname\n007\tBond\n")
+
+        written = await parquet_transforms(
+            tmp_path, infer_schema=False
+        ).apply(entry, path)
+
+        assert pa_parquet.read_table(written[0]).column("id").to_pylist() == ["007"]
+
+
+def fake_pypdf(pages, encrypted=False):
+    """A stand-in for pypdf whose PDFs have pages with these texts"""
+    module = types.ModuleType("pypdf")
+    module.errors = types.SimpleNamespace(
+        PyPdfError=type("PyPdfError", (Exception,), {})
+    )
+
+    class PdfReader:
+        def __init__(self, source):
+            self.is_encrypted = encrypted
+            self.pages = [
+                types.SimpleNamespace(extract_text=lambda text=text: text)
+                for text in pages
+            ]
+
+        def decrypt(self, password):
+            return 0
+
+    module.PdfReader = PdfReader
+    return module
+
+
+class TestPdfText:
+    """Test extracting the text of PDFs"""
+
+    async def test_sidecar(self, tmp_path, monkeypatch):
+        """The text goes next to the PDF, pages separated by form feeds"""
+        monkeypatch.setitem(
+            sys.modules, "pypdf", fake_pypdf(["Invoice 42", "Total: 10 EUR"])
+        )
+        entry, path = save(tmp_path, "acme.com/invoice.pdf", b"%PDF-1.4")
+        transforms = open_transforms(
+            TransformsConfig(pdf_text=PdfTextConfig(enabled=True)), tmp_path
+        )
+
+        written = await transforms.apply(entry, path)
+
+        assert written == [tmp_path / "acme.com" / "invoice.pdf.txt"]
+        assert written[0].read_text() == "Invoice 42\n\f\nTotal: 10 EUR\n"
+
+    async def test_scan_has_no_sidecar(self, tmp_path, monkeypatch):
+        """A PDF without a text layer gets no sidecar"""
+        monkeypatch.setitem(sys.modules, "pypdf", fake_pypdf(["", None]))
+        entry, path = save(tmp_path, "scan.pdf", b"%PDF-1.4")
+        transforms = open_transforms(
+            TransformsConfig(pdf_text=PdfTextConfig(enabled=True)), tmp_path
+        )
+
+        assert await transforms.apply(entry, path) == []
+        assert not (tmp_path / "scan.pdf.txt").exists()
+
+    def test_max_pages_and_passwords(self, tmp_path, monkeypatch):
+        """max_pages stops early; a PDF needing a password is an error"""
+        _, path = save(tmp_path, "a.pdf", b"%PDF-1.4")
+        monkeypatch.setitem(sys.modules, "pypdf", fake_pypdf(["one", "two", "three"]))
+        assert pdf_text(path, max_pages=2) == "one\n\f\ntwo"
+
+        monkeypatch.setitem(
+            sys.modules, "pypdf", fake_pypdf(["secret"], encrypted=True)
+        )
+        with pytest.raises(TransformError, match="password"):
+            pdf_text(path)
+
+    async def test_damaged_pdf(self, tmp_path, monkeypatch):
+        """Whatever pypdf raises on a damaged PDF, the file just has no sidecar"""
+        module = fake_pypdf([])
+        module.PdfReader = lambda source: (_ for _ in ()).throw(KeyError("/Root"))
+        monkeypatch.setitem(sys.modules, "pypdf", module)
+        entry, path = save(tmp_path, "broken.pdf", b"%PDF-1.4")
+        transforms = open_transforms(
+            TransformsConfig(pdf_text=PdfTextConfig(enabled=True)), tmp_path
+        )
+
+        assert await transforms.apply(entry, path) == []
@@ -0,0 +1,229 @@
+"""
+Tests for unlock module
+"""
+
+import io
+import struct
+import sys
+import zipfile
+import zlib
+
+from gmail_downloader.config import AppConfig
+from gmail_downloader.downloader import AttachmentDownloader, DownloadService
+from gmail_downloader.manifest import DownloadManifest
+from gmail_downloader.unlock import (
+    OLE_MAGIC,
+    PROTECTION_LOCKED,
+    PROTECTION_UNLOCKED,
+    Unlocker,
+    is_protected,
+    matching_passwords,
+    unlock_zip,
+)
+
+from tests.gmailtest import FakeGmail
+
+
+def crc_table():
+    """CRC-32 table ZipCrypto updates its keys with"""
+    table = []
+    for value in range(256):
+        for _ in range(8):
+            value = (value >> 1) ^ 0xEDB88320 if value & 1 else value >> 1
+        table.append(value)
+    return table
+
+
+CRC_TABLE = crc_table()
+
+
+def protected_zip(files, password):
+    """A ZIP whose stored members are ZipCrypto-encrypted, as vendors' tools do"""
+    local, central = b"", b""
+    for name, data in files.items():
+        keys = [0x12345678, 0x23456789, 0x34567890]
+
+        def update(byte):
+            keys[0] = (keys[0] >> 8) ^ CRC_TABLE[(keys[0] ^ byte) & 0xFF]
+            keys[1] = ((keys[1] + (keys[0] & 0xFF)) * 134775813 + 1) & 0xFFFFFFFF
+            keys[2] = (keys[2] >> 8) ^ CRC_TABLE[(keys[2] ^ (keys[1] >> 24)) & 0xFF]
+
+        def encrypt(plain):
+            out = bytearray()
+            for byte in plain:
+                temp = (keys[2] | 2) & 0xFFFF
+                out.append(byte ^ (((temp * (temp ^ 1)) >> 8) & 0xFF))
+                update(byte)
+            return bytes(out)
+
+        for byte in password.encode():
+            update(byte)
+        crc = zlib.crc32(data)
+        encrypted = encrypt(bytes(11) + bytes([crc >> 24])) + encrypt(data)
+        offset = len(local)
+        local += struct.pack(
+            "<IHHHHHIIIHH",
+            0x04034B50,
+            20,
+            1,
+            0,
+            0,
+            0x21,
+            crc,
+            len(encrypted),
+            len(data),
+            len(name),
+            0,
+        ) + name.encode() + encrypted
+        central += struct.pack(
+            "<IHHHHHHIIIHHHHHII",
+            0x02014B50,
+            20,
+            20,
+            1,
+            0,
+            0,
+            0x21,
+            crc,
+            len(encrypted),
+            len(data),
+            len(name),
+            0,
+            0,
+            0,
+            0,
+            0,
+            offset,
+        ) + name.encode()
+    end = struct.pack(
+        "<IHHHHIIH",
+        0x06054B50,
+        0,
+        0,
+        len(files),
+        len(files),
+        len(central),
+        len(local),
+        0,
+    )
+    return local + central + end
+
+
+def plain_zip(files):
+    """An ordinary ZIP"""
+    output = io.BytesIO()
+    with zipfile.ZipFile(output, "w") as archive:
+        for name, data in files.items():
+            archive.writestr(name, data)
+    return output.getvalue()
+
+
+class TestPasswords:
+    """Test choosing passwords for a message"""
+
+    def test_most_specific_first(self):
+        """Address before domain before subject, without repeats"""
+        passwords = {
+            "subject:Monthly*": "by-subject",
+            "@vendor.com": ["by-domain", "shared"],
+            "Reports@Vendor.com": ["by-address", "shared"],
+            "other@vendor.com": "not-this",
+        }
+
+        assert matching_passwords(
+            passwords, "Vendor <reports@vendor.com>", "monthly figures"
+        ) == ["by-address", "shared", "by-domain", "by-subject",]
+        assert matching_passwords(passwords, "someone@else.org", "Weekly") == []
+
+
+class TestUnlock:
+    """Test removing passwords"""
+
+    def test_detects_protection(self):
+        """Encrypted ZIPs and OLE-wrapped Office files are protected, plain ones not"""
+        assert is_protected("a.zip", protected_zip({"a.csv": b"1,2"}, "pw"))
+        assert not is_protected("a.zip", plain_zip({"a.csv": b"1,2"}))
+        assert not is_protected(
+            "a.xlsx", plain_zip({"[Content_Types].xml": b"<Types/>"})
+        )
+        assert is_protected("a.xlsx", OLE_MAGIC + bytes(504))
+        assert not is_protected("a.pdf", b"%PDF-1.7")
+
+    def test_zip(self):
+        """The password that works gives the same members without protection"""
+        data = protected_zip({"a.csv": b"1,2", "b/c.txt": b"hello"}, "right")
+
+        unlocked = unlock_zip(data, ["wrong", "right"])
+
+        with zipfile.ZipFile(io.BytesIO(unlocked)) as archive:
+            assert archive.read("a.csv") == b"1,2"
+            assert archive.read("b/c.txt") == b"hello"
+        assert unlock_zip(data, ["wrong"]) is None
+
+    def test_zip_size_limit(self):
+        """ZIPs unpacking to more than the limit stay locked"""
+        data = protected_zip({"a.csv": b"1" * 600, "b.csv": b"2" * 600}, "right")
+
+        assert unlock_zip(data, ["right"], max_bytes=1000) is None
+        assert unlock_zip(data, ["right"], max_bytes=1200) is not None
+
+    def test_locked(self):
+        """Without a working password the data is kept as received"""
+        data = protected_zip({"a.csv": b"1,2"}, "right")
+        unlocker = Unlocker({"@vendor.com": "wrong"})
+
+        assert unlocker.unlock(
+            "a.zip", data, "reports@vendor.com", ""
+        ) == (data, PROTECTION_LOCKED)
+        assert unlocker.unlock(
+            "a.zip", data, "someone@else.org", ""
+        ) == (data, PROTECTION_LOCKED)
+
+    def test_office_needs_extra(self, monkeypatch):
+        """Encrypted Office files stay locked when msoffcrypto-tool is not installed"""
+        monkeypatch.setitem(sys.modules, "msoffcrypto", None)
+        data = OLE_MAGIC + bytes(504)
+
+        assert Unlocker({"@vendor.com": "pw"}).unlock(
+            "a.xlsx", data, "a@vendor.com", ""
+        ) == (data, PROTECTION_LOCKED)
+
+
+class TestDownload:
+    """Test unlocking while downloading"""
+
+    async def test_saved_unprotected(self, tmp_path):
+        """Protected archives are saved without their password and flagged"""
+        gmail = FakeGmail()
+        gmail.add_message(
+            "reports@vendor.com",
+            "Payroll June",
+            attachments={"payroll.zip": protected_zip({"june.csv": b"1,2"}, "pw")},
+        )
+        gmail.add_message(
+            "other@partner.com",
+            "Figures",
+            attachments={"figures.zip": protected_zip({"f.csv": b"3"}, "secret")},
+        )
+        config = AppConfig()
+        config.filters.extensions = [".zip"]
+        config.filters.min_size = 1
+        config.passwords = {"subject:payroll*": "pw"}
+        client = gmail.client(config)
+        service = DownloadService(
+            client,
+            AttachmentDownloader(str(tmp_path)),
+            DownloadManifest(tmp_path),
+            config,
+        )
+
+        saved = await service.execute(await service.plan())
+
+        payroll = next(path for path in saved if path.name == "payroll.zip")
+        with zipfile.ZipFile(payroll) as archive:
+            assert archive.read("june.csv") == b"1,2"
+        protection = {entry.filename: entry.protection for entry in service.manifest}
+        assert protection == {
+            "payroll.zip": PROTECTION_UNLOCKED, "figures.zip": PROTECTION_LOCKED
+        }
+        assert [entry.filename for entry in service.locked] == ["figures.zip"]
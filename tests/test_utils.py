@@ -13,17 +13,34 @@ import pytest
 import tempfile
 import os
 from pathlib import Path
-from datetime import datetime
+from datetime import datetime, timedelta, timezone
 
 # Import the functions we want to test
 from gmail_downloader.utils import (
     parse_date,
     format_file_size,
+    parse_file_size,
+    parse_bandwidth,
+    parse_duration,
     sanitize_filename,
     is_valid_email,
+    extract_all_emails,
+    extract_display_name,
     extract_email_address,
+    format_sender,
     ensure_directory,
-    truncate_string
+    free_disk_space,
+    long_path,
+    unc_share,
+    truncate_string,
+    clean_subject,
+    resolve_sender_alias,
+    type_folder,
+    matches_filename_pattern,
+    parse_email_date,
+    format_date_folder,
+    day_start_timestamp,
+    unsafe_filename,
 )
 
 
@@ -149,6 +166,71 @@ class TestFormatFileSize:
         assert "1.7" in result
 
 
+class TestParseFileSize:
+    """Test the parse_file_size function (the reverse of format_file_size)."""
+    
+    def test_plain_bytes(self):
+        """Test numbers without a unit are bytes."""
+        assert parse_file_size("512") == 512
+        assert parse_file_size(2048) == 2048
+    
+    def test_units(self):
+        """Test binary units in various spellings."""
+        assert parse_file_size("1KB") == 1024
+        assert parse_file_size("10MB") == 10 * 1024 * 1024
+        assert parse_file_size("2 gb") == 2 * 1024 ** 3
+        assert parse_file_size("3K") == 3 * 1024
+    
+    def test_decimal_values(self):
+        """Test fractional sizes are accepted."""
+        assert parse_file_size("1.5 KB") == 1536
+    
+    def test_round_trip_with_format(self):
+        """Test parse_file_size understands what format_file_size produces."""
+        assert parse_file_size(format_file_size(1536)) == 1536
+    
+    def test_invalid_values(self):
+        """Test unparseable values return None."""
+        assert parse_file_size("lots") is None
+        assert parse_file_size("10 XB") is None
+        assert parse_file_size("") is None
+        assert parse_file_size(-1) is None
+
+
+class TestParseBandwidth:
+    """Test the parse_bandwidth function used for download.max_bandwidth."""
+    
+    def test_rates(self):
+        """Test rates with and without the /s suffix."""
+        assert parse_bandwidth("5MB/s") == 5 * 1024 * 1024
+        assert parse_bandwidth("500 KB/s") == 500 * 1024
+        assert parse_bandwidth("1mb") == 1024 * 1024
+    
+    def test_invalid_values(self):
+        """Test unparseable or zero rates return None."""
+        assert parse_bandwidth("fast") is None
+        assert parse_bandwidth("0MB/s") is None
+
+
+class TestParseDuration:
+    """Test the parse_duration function used for time windows."""
+    
+    def test_units(self):
+        """Test every supported unit."""
+        assert parse_duration("30s") == timedelta(seconds=30)
+        assert parse_duration("15m") == timedelta(minutes=15)
+        assert parse_duration("12h") == timedelta(hours=12)
+        assert parse_duration("7d") == timedelta(days=7)
+        assert parse_duration("2W") == timedelta(weeks=2)
+    
+    def test_invalid_values(self):
+        """Test unparseable durations return None."""
+        assert parse_duration("7") is None
+        assert parse_duration("1.5d") is None
+        assert parse_duration("soon") is None
+        assert parse_duration("") is None
+
+
 class TestSanitizeFilename:
     """Test the sanitize_filename function with various problematic inputs."""
     
@@ -174,16 +256,21 @@ class TestSanitizeFilename:
         """Test filenames with multiple illegal characters."""
         # Function consolidates multiple underscores into single underscore
         assert sanitize_filename("file<>:|name.pdf") == "file_name.pdf"
-        assert sanitize_filename("really*bad?file|name.pdf") == "really_bad_file_name.pdf"
+        assert (
+            sanitize_filename("really*bad?file|name.pdf") == "really_bad_file_name.pdf"
+        )
     
     def test_unicode_characters(self):
         """Test Unicode character handling."""
-        # Accented characters should be converted to ASCII equivalents
-        result = sanitize_filename("résumé.pdf")
+        # Accented characters are kept by default
+        assert sanitize_filename("résumé.pdf") == "résumé.pdf"
+        
+        # and converted to ASCII equivalents with unicode="ascii"
+        result = sanitize_filename("résumé.pdf", "ascii")
         assert "resume" in result.lower()
         
         # Other Unicode characters
-        result = sanitize_filename("file_naïve.pdf")
+        result = sanitize_filename("file_naïve.pdf", "ascii")
         assert "naive" in result.lower()
     
     def test_empty_and_whitespace(self):
@@ -195,8 +282,10 @@ class TestSanitizeFilename:
     def test_leading_trailing_issues(self):
         """Test removal of leading/trailing problematic characters."""
         assert sanitize_filename(".hidden_file.txt") == "hidden_file.txt"
-        assert sanitize_filename("_file_.txt") == "file_.txt"  # Strips leading _ but not trailing _ before extension
-        assert sanitize_filename("..file..txt") == "file..txt"  # Only strips leading dots (dots before extension stay)
+        # Strips leading _ but not trailing _ before extension
+        assert sanitize_filename("_file_.txt") == "file_.txt"
+        # Only strips leading dots (dots before extension stay)
+        assert sanitize_filename("..file..txt") == "file..txt"
     
     def test_multiple_underscores(self):
         """Test consolidation of multiple underscores."""
@@ -228,6 +317,58 @@ class TestSanitizeFilename:
         
         assert len(result) <= 200
         assert result == "x" * 200
+    
+    def test_keep_native_characters(self):
+        """Non-Latin scripts and emoji survive in keep mode"""
+        assert sanitize_filename("報告書 2024.pdf", unicode="keep") == "報告書 2024.pdf"
+        assert sanitize_filename(
+            "Отчёт: март.xlsx", unicode="keep"
+        ) == "Отчёт_ март.xlsx"
+        assert sanitize_filename("👩‍💻 notes.txt", unicode="keep") == "👩‍💻 notes.txt"
+    
+    def test_keep_normalizes_to_nfc(self):
+        """Decomposed accents (as macOS mail clients send) become single characters"""
+        assert sanitize_filename(
+            "re\u0301sume\u0301.pdf", unicode="keep"
+        ) == "r\u00e9sum\u00e9.pdf"
+    
+    def test_keep_removes_invisible_characters(self):
+        """Direction overrides and control characters are stripped"""
+        assert sanitize_filename(
+            "invoice\u202efdp.exe", unicode="keep"
+        ) == "invoicefdp.exe"
+        assert sanitize_filename("a\x00b.pdf", unicode="keep") == "ab.pdf"
+    
+    def test_ascii_drops_other_scripts(self):
+        """ASCII mode keeps only what folds to ASCII"""
+        assert sanitize_filename("Отчёт report.pdf", unicode="ascii") == "report.pdf"
+    
+    def test_length_limit_counts_bytes(self):
+        """Multi-byte names are cut to the byte limit without splitting characters"""
+        result = sanitize_filename("資" * 150 + ".pdf", unicode="keep")
+        
+        assert len(result.encode("utf-8")) <= 200
+        assert result.endswith(".pdf")
+        assert set(result[:-4]) == {"資"}
+
+
+class TestUnsafeFilename:
+    """Test spotting names that should not be saved under a cleaned-up version."""
+    
+    def test_ordinary_names(self):
+        """Odd but harmless names are fine"""
+        assert unsafe_filename("report.pdf") == ""
+        assert unsafe_filename("Q1/Q2: Results.xlsx") == ""
+        assert unsafe_filename("報告書.pdf") == ""
+    
+    def test_crafted_names(self):
+        """Disguised extensions, traversal, absolute paths and NUL bytes are flagged"""
+        assert "direction override" in unsafe_filename("invoice\u202efdp.exe")
+        assert "traversal" in unsafe_filename("../../.bashrc")
+        assert "traversal" in unsafe_filename("..\\startup\\run.bat")
+        assert "absolute" in unsafe_filename("/etc/cron.d/job")
+        assert "absolute" in unsafe_filename("C:\\Windows\\evil.dll")
+        assert "NUL" in unsafe_filename("report.pdf\x00.exe")
 
 
 class TestIsValidEmail:
@@ -283,6 +424,21 @@ class TestIsValidEmail:
         """Test that whitespace is handled correctly."""
         assert is_valid_email("  user@example.com  ")
         assert not is_valid_email("user @example.com")  # Space in middle
+    
+    def test_rfc5322_local_parts(self):
+        """Test dot-atoms and quoted strings in the local part."""
+        assert is_valid_email("o'brien@example.ie")
+        assert is_valid_email('"john doe"@example.com')
+        assert not is_valid_email("john..doe@example.com")  # Empty atom
+        assert not is_valid_email(".john@example.com")
+        assert not is_valid_email("John <john@example.com>")  # Not a bare address
+    
+    def test_domains(self):
+        """Test that domain labels and top-level domains are checked."""
+        assert is_valid_email("user@xn--mller-kva.de")
+        assert not is_valid_email("user@-example.com")
+        assert not is_valid_email("user@example..com")
+        assert not is_valid_email("user@localhost")
 
 
 class TestExtractEmailAddress:
@@ -295,7 +451,9 @@ class TestExtractEmailAddress:
     def test_bracketed_email(self):
         """Test extraction from bracketed format."""
         assert extract_email_address("<user@example.com>") == "user@example.com"
-        assert extract_email_address("John Doe <john@example.com>") == "john@example.com"
+        assert (
+            extract_email_address("John Doe <john@example.com>") == "john@example.com"
+        )
     
     def test_name_and_email_format(self):
         """Test extraction from 'Name <email>' format."""
@@ -324,6 +482,62 @@ class TestExtractEmailAddress:
         # Multiple brackets (should extract first)
         result = extract_email_address("Name <first@example.com> <second@example.com>")
         assert result == "first@example.com"
+    
+    def test_quoted_names_and_comments(self):
+        """Test that brackets and commas inside quotes do not confuse extraction."""
+        assert extract_email_address(
+            '"Doe, John <ops>" <john@example.com>'
+        ) == "john@example.com"
+        assert (
+            extract_email_address("john@example.com (John Doe)") == "john@example.com"
+        )
+        assert extract_email_address("a@example.com, b@example.com") == "a@example.com"
+    
+    def test_malformed_header(self):
+        """Test an unclosed quote, which strict parsing rejects, yields the address."""
+        assert extract_email_address(
+            '"Doe, John <john@example.com>'
+        ) == "john@example.com"
+
+
+class TestExtractAllEmails:
+    """Test the extract_all_emails function with address lists."""
+    
+    def test_lists(self):
+        """Test every address of a list is returned once, in order."""
+        header = '"Doe, John" <John@example.com>, ops@example.com, john@example.com'
+        
+        assert extract_all_emails(header) == ["john@example.com", "ops@example.com"]
+    
+    def test_no_addresses(self):
+        """Test headers without addresses give an empty list."""
+        assert extract_all_emails("") == []
+        assert extract_all_emails("undisclosed-recipients:;") == []
+
+
+class TestExtractDisplayName:
+    """Test reading the display name of a From header."""
+    
+    @pytest.mark.parametrize("header,expected", [
+        ("Acme Billing <billing@acme.com>", "Acme Billing"),
+        ('"Müller, Jan" <jan@example.de>', "Müller, Jan"),
+        ("=?UTF-8?B?5bGx55Sw?= <yamada@example.jp>", "山田"),
+        ("billing@acme.com (Acme Billing)", "Acme Billing"),
+        ("billing@acme.com", ""),
+    ])
+    def test_display_name(self, header, expected):
+        """Test quoted, encoded, comment and missing names."""
+        assert extract_display_name(header) == expected
+    
+    def test_format_sender(self):
+        """Test names are joined to addresses, quoted when needed."""
+        assert format_sender(
+            "reports@acme.com", "Acme Analytics"
+        ) == "Acme Analytics <reports@acme.com>"
+        assert format_sender(
+            "jan@example.de", "Müller, Jan"
+        ) == '"Müller, Jan" <jan@example.de>'
+        assert format_sender("reports@acme.com") == "reports@acme.com"
 
 
 class TestEnsureDirectory:
@@ -395,6 +609,56 @@ class TestEnsureDirectory:
         except PermissionError:
             # This is expected behavior
             pass
+    
+    def test_unreachable_share(self):
+        """A UNC path on a share that is not reachable gives a clear error"""
+        with pytest.raises(OSError, match="Network share not reachable"):
+            ensure_directory(r"\\no-such-server\share\downloads")
+
+
+class TestFreeDiskSpace:
+    """Test measuring free space for a download directory."""
+    
+    def test_missing_directory(self, tmp_path):
+        """Test a directory not created yet is measured at its existing parent."""
+        free = free_disk_space(tmp_path / "not" / "yet")
+        
+        assert free is not None
+        assert free > 0
+
+
+class TestWindowsPaths:
+    """Test UNC detection and long-path prefixing."""
+    
+    def test_unc_share(self):
+        """The share root is found in plain, forward-slash and prefixed UNC paths"""
+        assert unc_share(r"\\server\share\downloads\deep") == r"\\server\share"
+        assert unc_share("//server/share/downloads") == r"\\server\share"
+        assert unc_share(r"\\?\UNC\server\share\downloads") == r"\\server\share"
+    
+    def test_not_unc(self):
+        """Drive paths, prefixed drive paths and bare servers are not shares"""
+        assert unc_share(r"C:\downloads") is None
+        assert unc_share(r"\\?\C:\downloads") is None
+        assert unc_share(r"\\server") is None
+    
+    def test_long_path_drive(self):
+        """Drive paths get the prefix, backslashes and no .. segments"""
+        assert long_path("C:/data/reports/../2024", windows=True) == r"\\?\C:\data\2024"
+    
+    def test_long_path_unc(self):
+        """UNC paths use the long UNC form"""
+        assert long_path(
+            r"\\server\share\downloads", windows=True
+        ) == r"\\?\UNC\server\share\downloads"
+    
+    def test_long_path_idempotent(self):
+        """Already prefixed paths are left alone"""
+        assert long_path(r"\\?\C:\data", windows=True) == r"\\?\C:\data"
+    
+    def test_long_path_other_systems(self):
+        """Outside Windows paths are unchanged"""
+        assert long_path("/srv/downloads", windows=False) == "/srv/downloads"
 
 
 class TestTruncateString:
@@ -491,7 +755,7 @@ def test_format_file_size_units(size, expected_unit):
     ("normal_file.pdf", False),
     ("file<bad>.pdf", True),
     ("file|bad.pdf", True),
-    ("résumé.pdf", True),  # Unicode changes
+    ("résumé.pdf", False),  # Unicode is kept
     ("", True),  # Empty becomes unnamed_file
 ])
 def test_sanitize_filename_parametrized(filename, should_change):
@@ -503,6 +767,187 @@ def test_sanitize_filename_parametrized(filename, should_change):
         assert result == filename
 
 
+class TestCleanSubject:
+    """Test turning subjects into stable folder names."""
+    
+    @pytest.mark.parametrize("subject,expected", [
+        ("Re: FW: Daily sales report 2024-06-01 [#4411]", "Daily sales report"),
+        ("RE[2]: AW: Invoice OPS-1234 - 06/01/2024", "Invoice"),
+        ("Weekly report (2024-06-07)", "Weekly report"),
+        ("Ticket #551: printer broken", "Ticket: printer broken"),
+        ("Quarterly numbers", "Quarterly numbers"),
+    ])
+    def test_default_cleanup(self, subject, expected):
+        """Test that reply prefixes, dates and ticket numbers are removed."""
+        assert clean_subject(subject) == expected
+    
+    def test_recurring_subjects_match(self):
+        """Test that a recurring thread maps to one name."""
+        assert clean_subject("Report 2024-06-01") == clean_subject(
+            "Re: Report 2024-06-02"
+        )
+    
+    def test_empty_result(self):
+        """Test that a subject with nothing left gets a placeholder."""
+        assert clean_subject("Re:") == "no-subject"
+        assert clean_subject("") == "no-subject"
+    
+    def test_custom_patterns(self):
+        """Test that custom patterns replace the defaults."""
+        assert clean_subject("Re: Build 8812 passed", [r"\d+"]) == "Re: Build passed"
+
+
+class TestTypeFolder:
+    """Test grouping files into folders by type."""
+    
+    @pytest.mark.parametrize("filename,expected", [
+        ("export.csv", "tabular"),
+        ("EXPORT.TSV", "tabular"),
+        ("analysis.ipynb", "code"),
+        ("invoice.pdf", "docs"),
+        ("feed.xml", "xml"),
+        ("README", "other"),
+    ])
+    def test_default_groups(self, filename, expected):
+        """Test that known extensions map to groups and others to a dot-less folder."""
+        assert type_folder(filename) == expected
+    
+    def test_custom_groups_take_precedence(self):
+        """Test that user groups add folders and take extensions over."""
+        groups = {"notebooks": [".ipynb"], "gis": ["geojson"]}
+        
+        assert type_folder("analysis.ipynb", groups) == "notebooks"
+        assert type_folder("map.geojson", groups) == "gis"
+        assert type_folder("script.py", groups) == "code"
+
+
+class TestMatchesFilenamePattern:
+    """Test matching attachment names against globs and regexes."""
+    
+    @pytest.mark.parametrize("filename,expected", [
+        ("report_june.csv", True),
+        ("REPORT_June.CSV", True),
+        ("report_june.xlsx", False),
+        ("metrics_20240601.xlsx", True),
+        ("metrics_2024.xlsx", False),
+        ("old_metrics_20240601.xlsx", False),
+    ])
+    def test_globs_and_regexes(self, filename, expected):
+        """Test plain patterns are globs and anchored ones regexes, ignoring case."""
+        patterns = ["report_*.csv", r"^metrics_\d{8}\.xlsx$"]
+        assert matches_filename_pattern(filename, patterns) is expected
+    
+    def test_no_patterns_match_everything(self):
+        """Test that an empty pattern list does not filter."""
+        assert matches_filename_pattern("anything.bin", [])
+        assert matches_filename_pattern("anything.bin", None)
+
+
+class TestParseEmailDate:
+    """Test parsing email Date headers."""
+    
+    def test_keeps_offset(self):
+        """Test that the sender's time zone offset is kept."""
+        result = parse_email_date("Mon, 3 Jun 2024 23:30:00 +0200")
+        
+        assert result == datetime(2024, 6, 3, 21, 30, tzinfo=timezone.utc)
+        assert result.utcoffset() == timedelta(hours=2)
+    
+    def test_comments_and_unknown_zone(self):
+        """Test that trailing comments parse and -0000 means UTC."""
+        result = parse_email_date("Mon, 3 Jun 2024 09:12:00 -0000 (UTC)")
+        
+        assert result == datetime(2024, 6, 3, 9, 12, tzinfo=timezone.utc)
+    
+    @pytest.mark.parametrize("value", ["", "yesterday", "2024-13-45"])
+    def test_invalid(self, value):
+        """Test that anything else gives None."""
+        assert parse_email_date(value) is None
+
+
+class TestFormatDateFolder:
+    """Test naming date folders."""
+    
+    @pytest.mark.parametrize("date_format,expected", [
+        ("day", ["2024-06-03"]),
+        ("month", ["2024", "06"]),
+        ("year", ["2024"]),
+        ("week", ["2024-W23"]),
+        ("quarter", ["2024-Q2"]),
+        ("%Y/Q{quarter}/%m", ["2024", "Q2", "06"]),
+    ])
+    def test_formats(self, date_format, expected):
+        """Test that named layouts and strftime patterns nest on slashes."""
+        assert format_date_folder(datetime(2024, 6, 3, 12, 0), date_format) == expected
+    
+    def test_iso_week_year(self):
+        """Test that early-January days can belong to the previous ISO year."""
+        assert format_date_folder(datetime(2021, 1, 2), "week") == ["2020-W53"]
+    
+    def test_time_zone_moves_day(self):
+        """Test that aware dates are converted before naming the folder."""
+        late = datetime(2024, 3, 31, 23, 30, tzinfo=timezone.utc)
+        
+        assert format_date_folder(late, "quarter") == ["2024-Q1"]
+        assert format_date_folder(late, "quarter", "Europe/Berlin") == ["2024-Q2"]
+        assert format_date_folder(late, "day", "America/New_York") == ["2024-03-31"]
+    
+    def test_unknown_time_zone(self):
+        """Test that an unknown zone name is an error."""
+        with pytest.raises(ValueError):
+            format_date_folder(
+                datetime(2024, 6, 3, tzinfo=timezone.utc), "day", "Mars/Olympus"
+            )
+
+
+class TestDayStartTimestamp:
+    """Test where a day starts in a time zone."""
+    
+    def test_zones(self):
+        """Test that the same day starts at different moments per zone."""
+        assert day_start_timestamp(datetime(2024, 6, 1)) == 1717200000
+        assert day_start_timestamp(
+            datetime(2024, 6, 1), "Europe/Berlin"
+        ) == 1717200000 - 2 * 3600
+        assert day_start_timestamp(
+            datetime(2024, 1, 1), "America/New_York"
+        ) == 1704085200
+    
+    def test_only_the_day_counts(self):
+        """Test that the time and zone of the date itself are ignored."""
+        late = datetime(2024, 6, 1, 23, 30, tzinfo=timezone(timedelta(hours=-7)))
+        
+        assert day_start_timestamp(late, "UTC") == day_start_timestamp(
+            datetime(2024, 6, 1), "UTC"
+        )
+
+
+class TestResolveSenderAlias:
+    """Test mapping sender addresses to partner aliases."""
+    
+    ALIASES = {
+        "no-reply@vendor-a.com": "vendor_a",
+        "@vendor-a.io": "vendor_a",
+        "billing@vendor-a.io": "vendor_a_billing",
+    }
+    
+    @pytest.mark.parametrize("sender,expected", [
+        ("no-reply@vendor-a.com", "vendor_a"),
+        ("Vendor A <No-Reply@Vendor-A.com>", "vendor_a"),
+        ("reports@vendor-a.io", "vendor_a"),
+        ("billing@vendor-a.io", "vendor_a_billing"),
+        ("someone@else.com", None),
+    ])
+    def test_lookup(self, sender, expected):
+        """Test exact, domain and case-insensitive matches."""
+        assert resolve_sender_alias(sender, self.ALIASES) == expected
+    
+    def test_no_aliases(self):
+        """Test that missing alias config resolves nothing."""
+        assert resolve_sender_alias("a@b.com", None) is None
+        assert resolve_sender_alias("a@b.com", {}) is None
+
+
 if __name__ == "__main__":
     """
     Run tests when executed directly.